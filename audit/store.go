@@ -0,0 +1,210 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"xray-telegram-manager/fsutil"
+)
+
+// maxEntries bounds the recent actions kept on disk, the counters are kept for all
+const maxEntries = 200
+
+// Action is a kind of change recorded in the audit log
+type Action string
+
+const (
+	ActionSwitch Action = "switch"
+	ActionUpdate Action = "update"
+	// ActionHook is a run of a hook script, it has no user
+	ActionHook Action = "hook"
+)
+
+// Reasons of a switch, why the server became active
+const (
+	// ReasonManual is a server chosen by the user
+	ReasonManual = "manual"
+	// ReasonFallback is a backup server taken after switching to the chosen one failed
+	ReasonFallback = "fallback"
+	// ReasonRestore is the server of a backup archive restored with /restore
+	ReasonRestore = "restore"
+	// ReasonRollback is the server of an xray config put back after it broke
+	ReasonRollback = "rollback"
+	// ReasonScheduled is a server chosen by the user for a later time
+	ReasonScheduled = "scheduled"
+	// ReasonProfile is the server of a profile applied by the /schedule times
+	ReasonProfile = "profile"
+)
+
+// Entry is one recorded action
+type Entry struct {
+	Time   time.Time `json:"time"`
+	UserID int64     `json:"user_id"`
+	User   string    `json:"user"`
+	Action Action    `json:"action"`
+	// Detail is the server name of a switch or the version an update started from
+	Detail string `json:"detail,omitempty"`
+	// Output is the end of the output of a hook script
+	Output string `json:"output,omitempty"`
+	// Reason is why a switch happened, see ReasonManual
+	Reason string `json:"reason,omitempty"`
+}
+
+// UserStats counts the actions of one user
+type UserStats struct {
+	UserID  int64          `json:"user_id"`
+	User    string         `json:"user"`
+	Actions map[Action]int `json:"actions"`
+	Last    time.Time      `json:"last"`
+}
+
+// Total returns the number of all actions of the user
+func (u UserStats) Total() int {
+	total := 0
+	for _, count := range u.Actions {
+		total += count
+	}
+	return total
+}
+
+// storeFile is the on-disk format of the audit log
+type storeFile struct {
+	Entries []Entry              `json:"entries"`
+	Users   map[int64]*UserStats `json:"users"`
+}
+
+// Store keeps who did what in a JSON file
+type Store struct {
+	path  string
+	mutex sync.RWMutex
+	data  storeFile
+}
+
+// NewStore loads the audit log from path. A missing file gives an empty log.
+func NewStore(path string) (*Store, error) {
+	store := &Store{
+		path: path,
+		data: storeFile{Users: make(map[int64]*UserStats)},
+	}
+
+	if path == "" {
+		return store, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return store, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	if err := json.Unmarshal(data, &store.data); err != nil {
+		return store, fmt.Errorf("failed to parse audit log: %w", err)
+	}
+	if store.data.Users == nil {
+		store.data.Users = make(map[int64]*UserStats)
+	}
+	return store, nil
+}
+
+// Record adds an action of a user and saves the log. The latest name of the user
+// replaces the one stored before. Actions without a user are not counted.
+func (s *Store) Record(entry Entry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.data.Entries = append(s.data.Entries, entry)
+	if len(s.data.Entries) > maxEntries {
+		s.data.Entries = s.data.Entries[len(s.data.Entries)-maxEntries:]
+	}
+	if entry.UserID == 0 {
+		return s.saveUnsafe()
+	}
+	user, ok := s.data.Users[entry.UserID]
+	if !ok {
+		user = &UserStats{UserID: entry.UserID, Actions: make(map[Action]int)}
+		s.data.Users[entry.UserID] = user
+	}
+	if user.Actions == nil {
+		user.Actions = make(map[Action]int)
+	}
+	user.User = entry.User
+	user.Actions[entry.Action]++
+	user.Last = entry.Time
+	return s.saveUnsafe()
+}
+
+// Recent returns up to limit latest actions, newest first
+func (s *Store) Recent(limit int) []Entry {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if limit <= 0 || limit > len(s.data.Entries) {
+		limit = len(s.data.Entries)
+	}
+	entries := make([]Entry, 0, limit)
+	for i := len(s.data.Entries) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, s.data.Entries[i])
+	}
+	return entries
+}
+
+// LastSwitch returns the latest switch, false when none is kept
+func (s *Store) LastSwitch() (Entry, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for i := len(s.data.Entries) - 1; i >= 0; i-- {
+		if s.data.Entries[i].Action == ActionSwitch {
+			return s.data.Entries[i], true
+		}
+	}
+	return Entry{}, false
+}
+
+// Users returns the counters of all users, the most active first
+func (s *Store) Users() []UserStats {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	users := make([]UserStats, 0, len(s.data.Users))
+	for _, user := range s.data.Users {
+		stats := *user
+		stats.Actions = make(map[Action]int, len(user.Actions))
+		for action, count := range user.Actions {
+			stats.Actions[action] = count
+		}
+		users = append(users, stats)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Total() != users[j].Total() {
+			return users[i].Total() > users[j].Total()
+		}
+		return users[i].UserID < users[j].UserID
+	})
+	return users
+}
+
+func (s *Store) saveUnsafe() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit log: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	if err := fsutil.WritePrivate(s.path, data); err != nil {
+		return fmt.Errorf("failed to save audit log: %w", err)
+	}
+	return nil
+}
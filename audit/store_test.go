@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreCountsActionsPerUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.json")
+
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Time: start, UserID: 1, User: "@alice", Action: ActionSwitch, Detail: "Amsterdam"},
+		{Time: start.Add(time.Minute), UserID: 2, User: "@bob", Action: ActionUpdate, Detail: "v1.2.3"},
+		{Time: start.Add(2 * time.Minute), UserID: 1, User: "@alice_new", Action: ActionSwitch, Detail: "Berlin"},
+	}
+	for _, entry := range entries {
+		if err := store.Record(entry); err != nil {
+			t.Fatalf("Record failed: %v", err)
+		}
+	}
+
+	reloaded, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("Reloading store failed: %v", err)
+	}
+	users := reloaded.Users()
+	if len(users) != 2 {
+		t.Fatalf("Expected 2 users, got %+v", users)
+	}
+	if users[0].UserID != 1 || users[0].User != "@alice_new" || users[0].Actions[ActionSwitch] != 2 || users[0].Total() != 2 {
+		t.Errorf("Expected the most active user first with the latest name, got %+v", users[0])
+	}
+	if users[1].Actions[ActionUpdate] != 1 || !users[1].Last.Equal(start.Add(time.Minute)) {
+		t.Errorf("Unexpected counters of the second user: %+v", users[1])
+	}
+
+	recent := reloaded.Recent(2)
+	if len(recent) != 2 || recent[0].Detail != "Berlin" || recent[1].Detail != "v1.2.3" {
+		t.Errorf("Expected the latest actions newest first, got %+v", recent)
+	}
+}
+
+func TestStoreKeepsRecentEntries(t *testing.T) {
+	store, _ := NewStore("")
+	for i := 0; i < maxEntries+10; i++ {
+		if err := store.Record(Entry{UserID: 1, Action: ActionSwitch}); err != nil {
+			t.Fatalf("Record failed: %v", err)
+		}
+	}
+	if len(store.Recent(0)) != maxEntries {
+		t.Errorf("Expected %d entries to be kept, got %d", maxEntries, len(store.Recent(0)))
+	}
+	if users := store.Users(); users[0].Actions[ActionSwitch] != maxEntries+10 {
+		t.Errorf("Expected counters to cover all actions, got %+v", users[0])
+	}
+}
+
+func TestStoreRecordsHooksWithoutUser(t *testing.T) {
+	store, _ := NewStore("")
+	if err := store.Record(Entry{User: "hook", Action: ActionHook, Detail: "post_switch, exit 0", Output: "ok"}); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+	if recent := store.Recent(1); len(recent) != 1 || recent[0].Output != "ok" {
+		t.Errorf("Expected the hook run with its output, got %+v", recent)
+	}
+	if users := store.Users(); len(users) != 0 {
+		t.Errorf("Expected hook runs not to be counted per user, got %+v", users)
+	}
+}
+
+func TestStoreLastSwitch(t *testing.T) {
+	store, _ := NewStore("")
+	if _, ok := store.LastSwitch(); ok {
+		t.Fatal("Expected no switch in an empty log")
+	}
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Time: start, UserID: 1, Action: ActionSwitch, Detail: "Amsterdam", Reason: ReasonManual},
+		{Time: start.Add(time.Minute), UserID: 1, Action: ActionSwitch, Detail: "Berlin", Reason: ReasonFallback},
+		{Time: start.Add(2 * time.Minute), User: "hook", Action: ActionHook, Detail: "post_switch, exit 0"},
+	}
+	for _, entry := range entries {
+		if err := store.Record(entry); err != nil {
+			t.Fatalf("Record failed: %v", err)
+		}
+	}
+	last, ok := store.LastSwitch()
+	if !ok || last.Detail != "Berlin" || last.Reason != ReasonFallback {
+		t.Errorf("Expected the fallback switch to Berlin, got %+v", last)
+	}
+}
@@ -0,0 +1,505 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/fsutil"
+)
+
+// FormatVersion is increased when the archive layout changes incompatibly
+const FormatVersion = 1
+
+// Archive entries
+const (
+	EntryManifest     = "manifest.json"
+	EntryConfig       = "config.json"
+	EntryServersCache = "servers.json"
+	// EntryOverrides holds the favorites, notes, ping targets and outbound options
+	EntryOverrides = "overrides.json"
+	EntryStats     = "stats.json"
+)
+
+// MaxArchiveSize limits the size of an archive accepted for restore
+const MaxArchiveSize = 10 << 20
+
+const maxEntrySize = 5 << 20
+
+// allowedEntries lists the files an archive may contain besides the config fragments,
+// see fragmentName
+var allowedEntries = map[string]bool{
+	EntryManifest:     true,
+	EntryConfig:       true,
+	EntryServersCache: true,
+	EntryOverrides:    true,
+	EntryStats:        true,
+}
+
+// optionalEntries are the JSON files archived when they exist, in archive order
+var optionalEntries = []string{EntryServersCache, EntryOverrides, EntryStats}
+
+// Paths tells where the files included in a backup live
+type Paths struct {
+	ConfigFile   string
+	ServersCache string
+	Overrides    string
+	Stats        string
+}
+
+// fragmentEntry returns the archive entry of a config.d fragment
+func fragmentEntry(name string) string {
+	return config.FragmentsDir + "/" + name
+}
+
+// fragmentName returns the config.d fragment an archive entry holds, false for the
+// other entries. Names leading out of config.d are not fragments.
+func fragmentName(entry string) (string, bool) {
+	name, ok := strings.CutPrefix(entry, config.FragmentsDir+"/")
+	if !ok || strings.ContainsAny(name, `/\`) || !strings.HasSuffix(name, ".json") {
+		return "", false
+	}
+	return name, true
+}
+
+// file returns the path of an optional entry, empty when it is not backed up
+func (p Paths) file(entry string) string {
+	switch entry {
+	case EntryServersCache:
+		return p.ServersCache
+	case EntryOverrides:
+		return p.Overrides
+	case EntryStats:
+		return p.Stats
+	}
+	return ""
+}
+
+// State is the runtime state of the manager saved in the manifest
+type State struct {
+	CurrentServerID   string `json:"current_server_id,omitempty"`
+	CurrentServerName string `json:"current_server_name,omitempty"`
+}
+
+// Manifest describes the contents of a backup archive
+type Manifest struct {
+	FormatVersion int       `json:"format_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	AppVersion    string    `json:"app_version"`
+	Redacted      bool      `json:"redacted"`
+	State         State     `json:"state"`
+	Files         []string  `json:"files"`
+}
+
+// Options controls how a backup is created
+type Options struct {
+	// Redact removes the bot token, the admin ID and the other secrets of the config,
+	// see secretPaths
+	Redact     bool
+	AppVersion string
+	State      State
+}
+
+// Archive is a parsed backup archive
+type Archive struct {
+	Manifest Manifest
+	files    map[string][]byte
+}
+
+// Create writes a tar.gz backup of the manager state to w
+func Create(w io.Writer, paths Paths, opts Options) (*Manifest, error) {
+	configData, err := os.ReadFile(paths.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if opts.Redact {
+		if configData, err = redactConfig(configData); err != nil {
+			return nil, err
+		}
+	}
+
+	files := map[string][]byte{EntryConfig: configData}
+	fragments, err := config.ReadFragments(paths.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	fragmentEntries := make([]string, 0, len(fragments))
+	for name, data := range fragments {
+		if opts.Redact && len(bytes.TrimSpace(data)) > 0 {
+			if data, err = redactConfig(data); err != nil {
+				return nil, fmt.Errorf("failed to redact %s: %w", name, err)
+			}
+		}
+		files[fragmentEntry(name)] = data
+		fragmentEntries = append(fragmentEntries, fragmentEntry(name))
+	}
+	sort.Strings(fragmentEntries)
+	for _, name := range optionalEntries {
+		path := paths.file(name)
+		if path == "" {
+			continue
+		}
+		if data, err := os.ReadFile(path); err == nil {
+			files[name] = data
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+	}
+
+	manifest := &Manifest{
+		FormatVersion: FormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		AppVersion:    opts.AppVersion,
+		Redacted:      opts.Redact,
+		State:         opts.State,
+	}
+	manifest.Files = append([]string{EntryConfig}, fragmentEntries...)
+	for _, name := range optionalEntries {
+		if _, ok := files[name]; ok {
+			manifest.Files = append(manifest.Files, name)
+		}
+	}
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	entries := append([]string{EntryManifest}, manifest.Files...)
+	files[EntryManifest] = manifestData
+	for _, name := range entries {
+		header := &tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(files[name])),
+			ModTime: manifest.CreatedAt,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, fmt.Errorf("failed to write %s header: %w", name, err)
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finalize tar archive: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finalize gzip stream: %w", err)
+	}
+	return manifest, nil
+}
+
+// Open reads and checks the structure of a backup archive
+func Open(r io.Reader) (*Archive, error) {
+	gz, err := gzip.NewReader(io.LimitReader(r, MaxArchiveSize))
+	if err != nil {
+		return nil, fmt.Errorf("not a gzip archive: %w", err)
+	}
+	defer gz.Close()
+
+	archive := &Archive{files: make(map[string][]byte)}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("unexpected entry type for %s", header.Name)
+		}
+		if _, fragment := fragmentName(header.Name); !allowedEntries[header.Name] && !fragment {
+			return nil, fmt.Errorf("unexpected file in archive: %s", header.Name)
+		}
+		if header.Size > maxEntrySize {
+			return nil, fmt.Errorf("%s is too large (%d bytes)", header.Name, header.Size)
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxEntrySize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", header.Name, err)
+		}
+		archive.files[header.Name] = data
+	}
+
+	manifestData, ok := archive.files[EntryManifest]
+	if !ok {
+		return nil, fmt.Errorf("archive has no %s", EntryManifest)
+	}
+	if err := json.Unmarshal(manifestData, &archive.Manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if archive.Manifest.FormatVersion != FormatVersion {
+		return nil, fmt.Errorf("unsupported backup format version %d (expected %d)", archive.Manifest.FormatVersion, FormatVersion)
+	}
+	if _, ok := archive.files[EntryConfig]; !ok {
+		return nil, fmt.Errorf("archive has no %s", EntryConfig)
+	}
+	for _, name := range optionalEntries {
+		if data, ok := archive.files[name]; ok && !json.Valid(data) {
+			return nil, fmt.Errorf("%s is not valid JSON", name)
+		}
+	}
+	for name, data := range archive.fragments() {
+		// An empty fragment is merged as an empty object
+		if len(bytes.TrimSpace(data)) > 0 && !json.Valid(data) {
+			return nil, fmt.Errorf("%s is not valid JSON", fragmentEntry(name))
+		}
+	}
+	return archive, nil
+}
+
+// fragments returns the archived config.d fragments by name
+func (a *Archive) fragments() map[string][]byte {
+	fragments := make(map[string][]byte)
+	for entry, data := range a.files {
+		if name, ok := fragmentName(entry); ok {
+			fragments[name] = data
+		}
+	}
+	return fragments
+}
+
+// Validate checks that the archived config is valid once applied at paths
+func (a *Archive) Validate(paths Paths) error {
+	_, err := a.resolveConfig(paths)
+	return err
+}
+
+// Apply writes the archived files to paths. The previous config is kept next to
+// it with a .before-restore suffix. It returns the names of the restored files.
+func (a *Archive) Apply(paths Paths) ([]string, error) {
+	configData, err := a.resolveConfig(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	if current, err := os.ReadFile(paths.ConfigFile); err == nil {
+		if err := fsutil.WritePrivate(paths.ConfigFile+".before-restore", current); err != nil {
+			return nil, fmt.Errorf("failed to save current config: %w", err)
+		}
+	}
+	if err := fsutil.WritePrivate(paths.ConfigFile, configData); err != nil {
+		return nil, fmt.Errorf("failed to restore config: %w", err)
+	}
+	restored := []string{EntryConfig}
+	fragments, err := a.applyFragments(paths)
+	restored = append(restored, fragments...)
+	if err != nil {
+		return restored, err
+	}
+
+	for _, name := range optionalEntries {
+		data, ok := a.files[name]
+		path := paths.file(name)
+		if !ok || path == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return restored, fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		if err := fsutil.WritePrivate(path, data); err != nil {
+			return restored, fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+		restored = append(restored, name)
+	}
+	return restored, nil
+}
+
+// applyFragments replaces the config.d fragments with the archived ones. The current
+// fragments are kept next to them with a .before-restore suffix, which leaves them out
+// of the config. It returns the entries of the restored fragments.
+func (a *Archive) applyFragments(paths Paths) ([]string, error) {
+	dir := filepath.Join(filepath.Dir(paths.ConfigFile), config.FragmentsDir)
+	current, err := config.ReadFragments(paths.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	for name, data := range current {
+		if err := fsutil.WritePrivate(filepath.Join(dir, name+".before-restore"), data); err != nil {
+			return nil, fmt.Errorf("failed to save current fragment %s: %w", name, err)
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return nil, fmt.Errorf("failed to remove current fragment %s: %w", name, err)
+		}
+	}
+
+	fragments := a.fragments()
+	if len(fragments) == 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", config.FragmentsDir, err)
+	}
+	names := make([]string, 0, len(fragments))
+	for name := range fragments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var restored []string
+	for _, name := range names {
+		if err := fsutil.WritePrivate(filepath.Join(dir, name), fragments[name]); err != nil {
+			return restored, fmt.Errorf("failed to restore %s: %w", fragmentEntry(name), err)
+		}
+		restored = append(restored, fragmentEntry(name))
+	}
+	return restored, nil
+}
+
+// resolveConfig returns the config.json to write, filling redacted secrets from the
+// current config. The archived fragments are merged into it for validation, the way
+// they are loaded once restored.
+func (a *Archive) resolveConfig(paths Paths) ([]byte, error) {
+	configData := a.files[EntryConfig]
+	if a.Manifest.Redacted {
+		current, err := os.ReadFile(paths.ConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("backup has no secrets and the current config cannot be read: %w", err)
+		}
+		// The secrets may be kept in a fragment, e.g. config.d/10-secrets.json
+		currentFragments, err := config.ReadFragments(paths.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		if current, err = config.MergeFragments(current, paths.ConfigFile, currentFragments); err != nil {
+			return nil, fmt.Errorf("current config: %w", err)
+		}
+		if configData, err = mergeSecrets(configData, current); err != nil {
+			return nil, err
+		}
+	}
+	merged, err := config.MergeFragments(configData, paths.ConfigFile, a.fragments())
+	if err != nil {
+		return nil, fmt.Errorf("archived config is invalid: %w", err)
+	}
+	if _, err := config.ParseConfig(merged, paths.ConfigFile); err != nil {
+		return nil, fmt.Errorf("archived config is invalid: %w", err)
+	}
+	return configData, nil
+}
+
+// secretPaths are removed from redacted backups and taken from the current config
+// on restore. Nested keys are separated by dots. They are the values main.go hides
+// from logs, and the admin ID.
+var secretPaths = []string{
+	"bot_token",
+	"admin_id",
+	"web.token",
+	"mqtt.password",
+	"fallback_notifier.token",
+	"fallback_notifier.smtp.password",
+}
+
+func redactConfig(data []byte) ([]byte, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	for _, path := range secretPaths {
+		if err := removeKey(raw, path); err != nil {
+			return nil, fmt.Errorf("failed to redact %s: %w", path, err)
+		}
+	}
+	return json.MarshalIndent(raw, "", "    ")
+}
+
+func mergeSecrets(data, current []byte) ([]byte, error) {
+	var raw, currentRaw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse archived config: %w", err)
+	}
+	if err := json.Unmarshal(current, &currentRaw); err != nil {
+		return nil, fmt.Errorf("failed to parse current config: %w", err)
+	}
+	for _, path := range secretPaths {
+		value, ok := lookupKey(currentRaw, path)
+		if !ok {
+			continue
+		}
+		if err := setKey(raw, path, value); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", path, err)
+		}
+	}
+	return json.MarshalIndent(raw, "", "    ")
+}
+
+// lookupKey returns the value at the dotted path of a JSON object
+func lookupKey(raw map[string]json.RawMessage, path string) (json.RawMessage, bool) {
+	key, rest, nested := strings.Cut(path, ".")
+	value, ok := raw[key]
+	if !ok || !nested {
+		return value, ok
+	}
+	var child map[string]json.RawMessage
+	if err := json.Unmarshal(value, &child); err != nil {
+		return nil, false
+	}
+	return lookupKey(child, rest)
+}
+
+// removeKey deletes the value at the dotted path of a JSON object, a missing path
+// is left as it is
+func removeKey(raw map[string]json.RawMessage, path string) error {
+	key, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		delete(raw, key)
+		return nil
+	}
+	value, ok := raw[key]
+	if !ok {
+		return nil
+	}
+	var child map[string]json.RawMessage
+	if err := json.Unmarshal(value, &child); err != nil || child == nil {
+		// Not an object, the config parser rejects it anyway
+		return nil
+	}
+	if err := removeKey(child, rest); err != nil {
+		return err
+	}
+	data, err := json.Marshal(child)
+	if err != nil {
+		return err
+	}
+	raw[key] = data
+	return nil
+}
+
+// setKey writes value at the dotted path of a JSON object, creating the objects on
+// the way
+func setKey(raw map[string]json.RawMessage, path string, value json.RawMessage) error {
+	key, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		raw[key] = value
+		return nil
+	}
+	child := make(map[string]json.RawMessage)
+	if existing, ok := raw[key]; ok {
+		if err := json.Unmarshal(existing, &child); err != nil {
+			return fmt.Errorf("%s is not an object", key)
+		}
+		if child == nil {
+			child = make(map[string]json.RawMessage)
+		}
+	}
+	if err := setKey(child, rest, value); err != nil {
+		return err
+	}
+	data, err := json.Marshal(child)
+	if err != nil {
+		return err
+	}
+	raw[key] = data
+	return nil
+}
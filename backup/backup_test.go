@@ -0,0 +1,370 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"xray-telegram-manager/config"
+)
+
+const testConfig = `{
+	"admin_id": 123456789,
+	"bot_token": "12345678:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+	"subscription_url": "https://example.com/config.txt",
+	"log_level": "info"
+}`
+
+func writeTestPaths(t *testing.T) Paths {
+	t.Helper()
+	dir := t.TempDir()
+	paths := Paths{
+		ConfigFile:   filepath.Join(dir, "config.json"),
+		ServersCache: filepath.Join(dir, "cache", "servers.json"),
+	}
+	if err := os.WriteFile(paths.ConfigFile, []byte(testConfig), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(paths.ServersCache), 0755); err != nil {
+		t.Fatalf("Failed to create cache dir: %v", err)
+	}
+	if err := os.WriteFile(paths.ServersCache, []byte(`[{"id":"example_com_443"}]`), 0644); err != nil {
+		t.Fatalf("Failed to write cache: %v", err)
+	}
+	return paths
+}
+
+func TestBackupRoundTripRedacted(t *testing.T) {
+	paths := writeTestPaths(t)
+
+	var buf bytes.Buffer
+	manifest, err := Create(&buf, paths, Options{Redact: true, AppVersion: "1.0.0", State: State{CurrentServerID: "example_com_443"}})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if len(manifest.Files) != 2 {
+		t.Errorf("Expected config and cache in backup, got %v", manifest.Files)
+	}
+	if strings.Contains(buf.String(), "AAAAAAAAAAAA") {
+		t.Error("Redacted backup must not contain the bot token")
+	}
+
+	archive, err := Open(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if archive.Manifest.State.CurrentServerID != "example_com_443" {
+		t.Errorf("Expected state to be preserved, got %+v", archive.Manifest.State)
+	}
+
+	// Restore to a fresh location that has its own secrets
+	target := writeTestPaths(t)
+	if err := os.Remove(target.ServersCache); err != nil {
+		t.Fatalf("Failed to remove cache: %v", err)
+	}
+	restored, err := archive.Apply(target)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if len(restored) != 2 {
+		t.Errorf("Expected 2 restored files, got %v", restored)
+	}
+
+	data, err := os.ReadFile(target.ConfigFile)
+	if err != nil {
+		t.Fatalf("Failed to read restored config: %v", err)
+	}
+	var restoredConfig map[string]interface{}
+	if err := json.Unmarshal(data, &restoredConfig); err != nil {
+		t.Fatalf("Restored config is not valid JSON: %v", err)
+	}
+	if restoredConfig["bot_token"] != "12345678:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAA" {
+		t.Errorf("Expected bot_token to be kept from the current config, got %v", restoredConfig["bot_token"])
+	}
+	if _, err := os.Stat(target.ConfigFile + ".before-restore"); err != nil {
+		t.Errorf("Expected previous config to be kept: %v", err)
+	}
+	if _, err := os.Stat(target.ServersCache); err != nil {
+		t.Errorf("Expected servers cache to be restored: %v", err)
+	}
+}
+
+func TestBackupRoundTripState(t *testing.T) {
+	paths := writeTestPaths(t)
+	cacheDir := filepath.Dir(paths.ServersCache)
+	paths.Overrides = filepath.Join(cacheDir, "overrides.json")
+	paths.Stats = filepath.Join(cacheDir, "stats.json")
+	overrides := `{"favorites":["example_com_443"],"notes":{"example_com_443":"good for Netflix"}}`
+	stats := `{"example_com_443":{"samples":[{"available":true,"latency_ms":42}]}}`
+	if err := os.WriteFile(paths.Overrides, []byte(overrides), 0644); err != nil {
+		t.Fatalf("Failed to write overrides: %v", err)
+	}
+	if err := os.WriteFile(paths.Stats, []byte(stats), 0644); err != nil {
+		t.Fatalf("Failed to write stats: %v", err)
+	}
+
+	var buf bytes.Buffer
+	manifest, err := Create(&buf, paths, Options{AppVersion: "1.0.0"})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	expected := []string{EntryConfig, EntryServersCache, EntryOverrides, EntryStats}
+	if strings.Join(manifest.Files, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v in backup, got %v", expected, manifest.Files)
+	}
+
+	archive, err := Open(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	target := writeTestPaths(t)
+	targetDir := filepath.Join(filepath.Dir(target.ConfigFile), "restored")
+	target.Overrides = filepath.Join(targetDir, "overrides.json")
+	target.Stats = filepath.Join(targetDir, "stats.json")
+	restored, err := archive.Apply(target)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if strings.Join(restored, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v restored, got %v", expected, restored)
+	}
+	for path, content := range map[string]string{target.Overrides: overrides, target.Stats: stats} {
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != content {
+			t.Errorf("Expected %s to be restored, got %q (%v)", path, data, err)
+		}
+	}
+
+	// Without a path for them the state files are left out, like the servers cache
+	if restored, err := archive.Apply(Paths{ConfigFile: target.ConfigFile}); err != nil || len(restored) != 1 {
+		t.Errorf("Expected only the config to be restored, got %v (%v)", restored, err)
+	}
+}
+
+// writeFragments writes config.d fragments next to the config file
+func writeFragments(t *testing.T, configFile string, fragments map[string]string) {
+	t.Helper()
+	dir := filepath.Join(filepath.Dir(configFile), config.FragmentsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create %s: %v", dir, err)
+	}
+	for name, content := range fragments {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write fragment: %v", err)
+		}
+	}
+}
+
+func TestBackupRoundTripFragments(t *testing.T) {
+	paths := writeTestPaths(t)
+	base := `{"admin_id": 123456789, "subscription_url": "https://example.com/config.txt"}`
+	if err := os.WriteFile(paths.ConfigFile, []byte(base), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	writeFragments(t, paths.ConfigFile, map[string]string{
+		"10-secrets.json":        `{"bot_token": "12345678:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}`,
+		config.OverridesFragment: `{"log_level": "debug"}`,
+	})
+
+	var buf bytes.Buffer
+	manifest, err := Create(&buf, paths, Options{AppVersion: "1.0.0"})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	expected := []string{EntryConfig, "config.d/10-secrets.json", "config.d/99-overrides.json", EntryServersCache}
+	if strings.Join(manifest.Files, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v in backup, got %v", expected, manifest.Files)
+	}
+
+	archive, err := Open(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	// The bot token is only in a fragment, validation merges them like loading does
+	target := writeTestPaths(t)
+	writeFragments(t, target.ConfigFile, map[string]string{"50-old.json": `{"log_level": "error"}`})
+	if err := archive.Validate(target); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if _, err := archive.Apply(target); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	cfg, err := config.LoadConfig(target.ConfigFile)
+	if err != nil {
+		t.Fatalf("Restored config does not load: %v", err)
+	}
+	if cfg.LogLevel != "debug" || cfg.BotToken != "12345678:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAA" {
+		t.Errorf("Expected the settings of the fragments to be restored, got log level %q", cfg.LogLevel)
+	}
+	oldFragment := filepath.Join(filepath.Dir(target.ConfigFile), config.FragmentsDir, "50-old.json")
+	if _, err := os.Stat(oldFragment); !os.IsNotExist(err) {
+		t.Errorf("Expected the fragment missing from the backup to be moved aside, got %v", err)
+	}
+	if _, err := os.Stat(oldFragment + ".before-restore"); err != nil {
+		t.Errorf("Expected the previous fragment to be kept: %v", err)
+	}
+}
+
+func TestRedactedBackupFragments(t *testing.T) {
+	paths := writeTestPaths(t)
+	writeFragments(t, paths.ConfigFile, map[string]string{
+		config.OverridesFragment: `{"log_level": "debug", "web": {"token": "web-secret"}}`,
+	})
+
+	var buf bytes.Buffer
+	if _, err := Create(&buf, paths, Options{Redact: true}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	archive, err := Open(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if fragment := string(archive.files["config.d/99-overrides.json"]); strings.Contains(fragment, "web-secret") || !strings.Contains(fragment, "debug") {
+		t.Errorf("Expected the secrets of the fragment to be redacted, got %s", fragment)
+	}
+
+	// The current bot token is kept in a fragment of the target
+	target := writeTestPaths(t)
+	if err := os.WriteFile(target.ConfigFile, []byte(`{"admin_id": 1, "subscription_url": "https://example.com/config.txt"}`), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	writeFragments(t, target.ConfigFile, map[string]string{"10-secrets.json": `{"bot_token": "87654321:BBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"}`})
+	if _, err := archive.Apply(target); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	cfg, err := config.LoadConfig(target.ConfigFile)
+	if err != nil {
+		t.Fatalf("Restored config does not load: %v", err)
+	}
+	if cfg.BotToken != "87654321:BBBBBBBBBBBBBBBBBBBBBBBBBBBBBB" || cfg.AdminID != 1 || cfg.LogLevel != "debug" {
+		t.Errorf("Expected the current secrets and the archived settings, got %q, %d, %q", cfg.BotToken, cfg.AdminID, cfg.LogLevel)
+	}
+}
+
+func TestFragmentName(t *testing.T) {
+	for entry, expected := range map[string]string{
+		"config.d/10-secrets.json":  "10-secrets.json",
+		"config.d/../config.json":   "",
+		"config.d/sub/x.json":       "",
+		"config.d/notes.txt":        "",
+		"config.json":               "",
+		"other.d/99-overrides.json": "",
+		"config.d/..\\evil.json":    "",
+	} {
+		if name, _ := fragmentName(entry); name != expected {
+			t.Errorf("Expected fragment %q for %q, got %q", expected, entry, name)
+		}
+	}
+}
+
+func TestOpenRejectsInvalidState(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range map[string]string{
+		EntryManifest:  `{"format_version": 1}`,
+		EntryConfig:    testConfig,
+		EntryOverrides: `{"favorites": [`,
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("Failed to write header: %v", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("Failed to write content: %v", err)
+		}
+	}
+	_ = tw.Close()
+	_ = gz.Close()
+
+	if _, err := Open(&buf); err == nil || !strings.Contains(err.Error(), "overrides.json is not valid JSON") {
+		t.Errorf("Expected invalid JSON error, got %v", err)
+	}
+}
+
+func TestOpenRejectsUnexpectedFiles(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	content := []byte("#!/bin/sh\n")
+	if err := tw.WriteHeader(&tar.Header{Name: "../../etc/init.d/evil", Mode: 0755, Size: int64(len(content))}); err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatalf("Failed to write content: %v", err)
+	}
+	_ = tw.Close()
+	_ = gz.Close()
+
+	if _, err := Open(&buf); err == nil || !strings.Contains(err.Error(), "unexpected file") {
+		t.Errorf("Expected unexpected file error, got %v", err)
+	}
+}
+
+func TestValidateRejectsInvalidConfig(t *testing.T) {
+	paths := writeTestPaths(t)
+	archive := &Archive{
+		Manifest: Manifest{FormatVersion: FormatVersion},
+		files:    map[string][]byte{EntryConfig: []byte(`{"admin_id": 1}`)},
+	}
+	if err := archive.Validate(paths); err == nil {
+		t.Error("Expected validation error for config without bot_token")
+	}
+}
+
+func TestRedactNestedSecrets(t *testing.T) {
+	archived := `{
+		"bot_token": "archived",
+		"web": {"enabled": true, "port": 8080, "token": "web-secret"},
+		"mqtt": {"broker": "tcp://localhost:1883", "password": "mqtt-secret"},
+		"fallback_notifier": {"type": "email", "token": "ntfy-secret", "smtp": {"host": "smtp.example.com", "password": "smtp-secret"}}
+	}`
+	redacted, err := redactConfig([]byte(archived))
+	if err != nil {
+		t.Fatalf("redactConfig failed: %v", err)
+	}
+	for _, secret := range []string{"archived", "web-secret", "mqtt-secret", "ntfy-secret", "smtp-secret"} {
+		if strings.Contains(string(redacted), secret) {
+			t.Errorf("Expected %s to be redacted from %s", secret, redacted)
+		}
+	}
+	for _, kept := range []string{"8080", "tcp://localhost:1883", "smtp.example.com"} {
+		if !strings.Contains(string(redacted), kept) {
+			t.Errorf("Expected %s to be kept in %s", kept, redacted)
+		}
+	}
+
+	// The current config has no mqtt section in the archive to put its password into
+	current := `{"bot_token": "current", "admin_id": 42, "web": {"token": "web-current"}, "mqtt": {"password": "mqtt-current"}, "fallback_notifier": {"smtp": {"password": "smtp-current"}}}`
+	merged, err := mergeSecrets([]byte(`{"web": {"port": 8080}}`), []byte(current))
+	if err != nil {
+		t.Fatalf("mergeSecrets failed: %v", err)
+	}
+	var restored struct {
+		BotToken string `json:"bot_token"`
+		AdminID  int64  `json:"admin_id"`
+		Web      struct {
+			Port  int    `json:"port"`
+			Token string `json:"token"`
+		} `json:"web"`
+		MQTT struct {
+			Password string `json:"password"`
+		} `json:"mqtt"`
+		Fallback struct {
+			Token string `json:"token"`
+			SMTP  struct {
+				Password string `json:"password"`
+			} `json:"smtp"`
+		} `json:"fallback_notifier"`
+	}
+	if err := json.Unmarshal(merged, &restored); err != nil {
+		t.Fatalf("Merged config is not valid JSON: %v", err)
+	}
+	if restored.BotToken != "current" || restored.AdminID != 42 || restored.Web.Port != 8080 || restored.Web.Token != "web-current" ||
+		restored.MQTT.Password != "mqtt-current" || restored.Fallback.SMTP.Password != "smtp-current" || restored.Fallback.Token != "" {
+		t.Errorf("Unexpected merged config %s", merged)
+	}
+}
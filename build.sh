@@ -19,7 +19,7 @@ BUILD_TIME=$(date -u '+%Y-%m-%d_%H:%M:%S')
 GO_VERSION=$(go version | awk '{print $3}')
 
 # Build flags for size optimization
-LDFLAGS="-s -w -X main.Version=${VERSION} -X main.BuildTime=${BUILD_TIME} -X main.GoVersion=${GO_VERSION}"
+LDFLAGS="-s -w -X xray-telegram-manager/version.Version=${VERSION} -X xray-telegram-manager/version.BuildTime=${BUILD_TIME} -X xray-telegram-manager/version.GoVersion=${GO_VERSION}"
 
 # Function to print colored output
 print_info() {
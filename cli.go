@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/server"
+)
+
+const defaultConfigPath = "/opt/etc/xray-manager/config.json"
+
+// cliCommands lists the subcommands that run without starting the Telegram bot
+var cliCommands = map[string]string{
+	"list":            "List servers from the subscription (current server is marked with *)",
+	"ping":            "Test latency of all servers",
+	"status":          "Show the current server and its connectivity",
+	"refresh":         "Reload servers from the subscription, ignoring the cache",
+	"switch":          "Switch xray to the server with the given ID: switch <id>",
+	"ping-target":     "Show or override where a server is pinged: ping-target <id> [host:port|clear]",
+	"panic":           "Turn the proxy off for direct internet and check the connection",
+	"validate-config": "Validate the manager config and the xray outbounds config",
+}
+
+// isCLICommand reports whether the first argument selects a headless subcommand
+func isCLICommand(arg string) bool {
+	_, ok := cliCommands[arg]
+	return ok || arg == "help" || arg == "--help" || arg == "-h"
+}
+
+// parseCLIArgs splits the arguments into the command, its positional arguments and the config path
+func parseCLIArgs(args []string) (string, []string, string, error) {
+	if len(args) == 0 {
+		return "", nil, "", fmt.Errorf("no command given")
+	}
+	command := args[0]
+	configPath := defaultConfigPath
+	var positional []string
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--config" || arg == "-c":
+			if i+1 >= len(args) {
+				return "", nil, "", fmt.Errorf("%s requires a path", arg)
+			}
+			configPath = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "--config="):
+			configPath = strings.TrimPrefix(arg, "--config=")
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	return command, positional, configPath, nil
+}
+
+// runCLI executes a headless subcommand and returns the process exit code
+func runCLI(args []string) int {
+	command, positional, configPath, err := parseCLIArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		printCLIUsage(os.Stderr)
+		return 2
+	}
+	if _, ok := cliCommands[command]; !ok {
+		printCLIUsage(os.Stdout)
+		return 0
+	}
+	if command == "switch" && len(positional) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: xray-telegram-manager switch <server-id> [--config path]\n")
+		return 2
+	}
+	if command == "ping-target" && (len(positional) < 1 || len(positional) > 2) {
+		fmt.Fprintf(os.Stderr, "Usage: xray-telegram-manager ping-target <server-id> [host:port|clear] [--config path]\n")
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config %s is invalid: %v\n", configPath, err)
+		return 1
+	}
+	// Keep command output readable, only warnings and errors are logged
+	if cfg.LogLevel != "debug" {
+		cfg.LogLevel = "warn"
+	}
+	sm := server.NewServerManager(cfg)
+
+	switch command {
+	case "validate-config":
+		err = cliValidateConfig(sm, configPath)
+	case "list":
+		err = cliList(sm)
+	case "ping":
+		err = cliPing(sm)
+	case "status":
+		err = cliStatus(sm)
+	case "refresh":
+		err = cliRefresh(sm)
+	case "switch":
+		err = cliSwitch(sm, positional[0])
+	case "ping-target":
+		err = cliPingTarget(sm, positional)
+	case "panic":
+		err = cliPanic(sm)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func printCLIUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage:\n")
+	fmt.Fprintf(w, "  xray-telegram-manager [config.json]              Run the Telegram bot service\n")
+	fmt.Fprintf(w, "  xray-telegram-manager <command> [--config path]  Run a command without the bot\n\n")
+	fmt.Fprintf(w, "Commands:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range []string{"list", "ping", "status", "refresh", "switch", "ping-target", "panic", "validate-config"} {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, cliCommands[name])
+	}
+	_ = tw.Flush()
+}
+
+// loadCLIServers loads servers and syncs the current server with the xray config
+func loadCLIServers(sm *server.ServerManager) error {
+	if err := sm.LoadServers(context.Background()); err != nil {
+		return err
+	}
+	if err := sm.DetectCurrentServer(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	return nil
+}
+func cliValidateConfig(sm *server.ServerManager, configPath string) error {
+	fmt.Printf("✅ Config %s is valid\n", configPath)
+	layout, hints, err := sm.CheckXrayLayout()
+	for _, hint := range hints {
+		fmt.Printf("💡 %s\n", hint)
+	}
+	if err != nil {
+		return fmt.Errorf("xray config: %w", err)
+	}
+	if len(hints) > 0 {
+		return fmt.Errorf("xray config does not match xray_layout %q", layout)
+	}
+	fmt.Printf("✅ Xray config layout: %s\n", layout)
+	xrayConfig, err := sm.GetXrayConfig()
+	if err != nil {
+		return fmt.Errorf("xray config: %w", err)
+	}
+	proxyCount := 0
+	for _, outbound := range xrayConfig.Outbounds {
+		if outbound.Protocol != "freedom" && outbound.Protocol != "blackhole" {
+			proxyCount++
+		}
+	}
+	fmt.Printf("✅ Xray config has %d outbounds (%d proxy)\n", len(xrayConfig.Outbounds), proxyCount)
+	if proxyCount == 0 && !sm.IsDirectMode() {
+		fmt.Printf("⚠️ No proxy outbound found, it will be added on the first switch\n")
+	}
+	return nil
+}
+func cliList(sm *server.ServerManager) error {
+	if err := loadCLIServers(sm); err != nil {
+		return err
+	}
+	currentID := ""
+	if current := sm.GetCurrentServer(); current != nil {
+		currentID = current.ID
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, " \tID\tNAME\tADDRESS\n")
+	for _, srv := range sm.GetServers() {
+		marker := " "
+		if srv.ID == currentID {
+			marker = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s:%d\n", marker, srv.ID, srv.Name, srv.Address, srv.Port)
+	}
+	return tw.Flush()
+}
+func cliPing(sm *server.ServerManager) error {
+	if err := loadCLIServers(sm); err != nil {
+		return err
+	}
+	results, err := sm.TestPing()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tNAME\tLATENCY\n")
+	for _, result := range results {
+		latency := "unavailable"
+		if result.Available {
+			latency = fmt.Sprintf("%dms", result.Latency.Milliseconds())
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", result.Server.ID, result.Server.Name, latency)
+	}
+	return tw.Flush()
+}
+func cliStatus(sm *server.ServerManager) error {
+	if err := loadCLIServers(sm); err != nil {
+		return err
+	}
+	status, err := sm.GetServerStatus()
+	if err != nil {
+		return err
+	}
+	if current := sm.GetCurrentServer(); current != nil {
+		fmt.Printf("Server:  %s (%s)\n", current.Name, current.ID)
+		fmt.Printf("Address: %s:%d\n", current.Address, current.Port)
+		fmt.Printf("Match:   %s\n", sm.GetCurrentServerMatch())
+	}
+	if sm.IsDirectMode() {
+		fmt.Printf("Mode:    direct (proxy disabled)\n")
+	}
+	fmt.Printf("Status:  %v\n", status["status"])
+	fmt.Printf("%v\n", status["message"])
+	return nil
+}
+func cliRefresh(sm *server.ServerManager) error {
+	if err := sm.RefreshServers(context.Background()); err != nil {
+		return err
+	}
+	fmt.Printf("Loaded %d servers from subscription\n", len(sm.GetServers()))
+	return nil
+}
+func cliSwitch(sm *server.ServerManager, serverID string) error {
+	if err := loadCLIServers(sm); err != nil {
+		return err
+	}
+	target, err := sm.GetServerByID(serverID)
+	if err != nil {
+		return err
+	}
+	if err := sm.SwitchServer(context.Background(), serverID); err != nil {
+		return err
+	}
+	fmt.Printf("Switched to %s (%s:%d)\n", target.Name, target.Address, target.Port)
+	return nil
+}
+
+// cliPanic turns the proxy off like /panic in the bot
+func cliPanic(sm *server.ServerManager) error {
+	result, err := sm.Panic(context.Background())
+	if err != nil {
+		return err
+	}
+	if result.WasDirect {
+		fmt.Printf("The proxy was already paused, xray was restarted\n")
+	} else {
+		fmt.Printf("The proxy is paused, xray was restarted\n")
+	}
+	if result.Reachable == "" {
+		return fmt.Errorf("the router does not reach the internet directly: %v", result.CheckError)
+	}
+	fmt.Printf("Direct connection works (%s)\n", result.Reachable)
+	return nil
+}
+
+// cliPingTarget shows, sets or clears the ping target override of a server
+func cliPingTarget(sm *server.ServerManager, args []string) error {
+	if err := loadCLIServers(sm); err != nil {
+		return err
+	}
+	srv, err := sm.GetServerByID(args[0])
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 1 {
+		if target, ok := sm.GetPingTarget(srv.ID); ok {
+			fmt.Printf("%s is pinged on %s:%d (override)\n", srv.Name, target.Host, target.Port)
+		} else {
+			fmt.Printf("%s is pinged on %s:%d\n", srv.Name, srv.Address, srv.Port)
+		}
+		return nil
+	}
+
+	if args[1] == "clear" {
+		if err := sm.ClearPingTarget(srv.ID); err != nil {
+			return err
+		}
+		fmt.Printf("%s is pinged on %s:%d again\n", srv.Name, srv.Address, srv.Port)
+		return nil
+	}
+
+	host, portValue, err := net.SplitHostPort(args[1])
+	if err != nil {
+		return fmt.Errorf("ping target must be host:port: %w", err)
+	}
+	port, err := strconv.Atoi(portValue)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portValue)
+	}
+	if err := sm.SetPingTarget(srv.ID, host, port); err != nil {
+		return err
+	}
+	fmt.Printf("%s will be pinged on %s\n", srv.Name, args[1])
+	return nil
+}
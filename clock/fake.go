@@ -0,0 +1,165 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a clock for tests. Its time only moves with Advance, which fires the
+// timers and tickers that became due on the way.
+type Fake struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFake creates a fake clock standing at now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the time of the fake clock
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+// Since returns the fake time elapsed since t
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+// NewTimer creates a timer that fires once the clock was advanced by d
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	timer := &fakeTimer{clock: f, c: make(chan time.Time, 1)}
+	timer.Reset(d)
+	return timer
+}
+
+// NewTicker creates a ticker that ticks every d of fake time
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	ticker := &fakeTimer{clock: f, c: make(chan time.Time, 1), period: d}
+	ticker.Reset(d)
+	return fakeTicker{ticker}
+}
+
+// Advance moves the clock forward by d and fires the timers that became due, in
+// the order of their deadlines
+func (f *Fake) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	target := f.now.Add(d)
+	for {
+		next := f.nextDueUnsafe(target)
+		if next == nil {
+			break
+		}
+		f.now = next.deadline
+		next.fireUnsafe()
+	}
+	f.now = target
+}
+
+// Set moves the clock to t, firing the timers due until then. The clock never
+// goes back.
+func (f *Fake) Set(t time.Time) {
+	if d := t.Sub(f.Now()); d > 0 {
+		f.Advance(d)
+	}
+}
+
+// Pending returns the number of armed timers and tickers
+func (f *Fake) Pending() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.timers)
+}
+
+// WaitForTimers waits until at least n timers are armed, so a test can advance the
+// clock after the goroutine under test created its timer. It gives up after a second
+// of real time and reports whether the timers were armed.
+func (f *Fake) WaitForTimers(n int) bool {
+	deadline := time.Now().Add(time.Second)
+	for f.Pending() < n {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+func (f *Fake) nextDueUnsafe(target time.Time) *fakeTimer {
+	var next *fakeTimer
+	for _, timer := range f.timers {
+		if !timer.deadline.After(target) && (next == nil || timer.deadline.Before(next.deadline)) {
+			next = timer
+		}
+	}
+	return next
+}
+
+func (f *Fake) removeUnsafe(timer *fakeTimer) bool {
+	for i, other := range f.timers {
+		if other == timer {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fakeTimer is a timer, or a ticker when period is set
+type fakeTimer struct {
+	clock    *Fake
+	c        chan time.Time
+	deadline time.Time
+	period   time.Duration
+}
+
+type fakeTicker struct{ *fakeTimer }
+
+func (t fakeTicker) Stop() { t.fakeTimer.Stop() }
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	return t.clock.removeUnsafe(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	active := t.clock.removeUnsafe(t)
+	t.deadline = t.clock.now.Add(d)
+	if d <= 0 {
+		t.fireUnsafe()
+		return active
+	}
+	t.clock.timers = append(t.clock.timers, t)
+	return active
+}
+
+// fireUnsafe delivers the current time like time.Timer, dropping the tick when the
+// previous one was not received yet, and re-arms tickers
+func (t *fakeTimer) fireUnsafe() {
+	t.clock.removeUnsafe(t)
+	select {
+	case t.c <- t.clock.now:
+	default:
+	}
+	if t.period > 0 {
+		t.deadline = t.deadline.Add(t.period)
+		t.clock.timers = append(t.clock.timers, t)
+	}
+}
@@ -0,0 +1,79 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func received(c <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-c:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeTimer(t *testing.T) {
+	start := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	clock := NewFake(start)
+
+	timer := clock.NewTimer(time.Minute)
+	clock.Advance(59 * time.Second)
+	if _, ok := received(timer.C()); ok {
+		t.Fatal("Expected the timer not to fire before its deadline")
+	}
+	clock.Advance(time.Second)
+	if fired, ok := received(timer.C()); !ok || !fired.Equal(start.Add(time.Minute)) {
+		t.Fatalf("Expected the timer to fire at %v, got %v (%t)", start.Add(time.Minute), fired, ok)
+	}
+	if timer.Stop() {
+		t.Error("Expected Stop to report a fired timer as inactive")
+	}
+
+	timer.Reset(time.Hour)
+	if !timer.Stop() || clock.Pending() != 0 {
+		t.Error("Expected Stop to disarm a pending timer")
+	}
+	clock.Advance(2 * time.Hour)
+	if _, ok := received(timer.C()); ok {
+		t.Error("Expected a stopped timer not to fire")
+	}
+	if got := clock.Since(start); got != 2*time.Hour+time.Minute {
+		t.Errorf("Expected %v since start, got %v", 2*time.Hour+time.Minute, got)
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	start := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	clock := NewFake(start)
+
+	ticker := clock.NewTicker(10 * time.Second)
+	clock.Advance(10 * time.Second)
+	if tick, ok := received(ticker.C()); !ok || !tick.Equal(start.Add(10*time.Second)) {
+		t.Fatalf("Expected a tick after 10s, got %v (%t)", tick, ok)
+	}
+
+	// Ticks that are not received are dropped like with time.Ticker
+	clock.Advance(30 * time.Second)
+	if tick, ok := received(ticker.C()); !ok || !tick.Equal(start.Add(20*time.Second)) {
+		t.Fatalf("Expected the first missed tick to be kept, got %v (%t)", tick, ok)
+	}
+	if _, ok := received(ticker.C()); ok {
+		t.Error("Expected further missed ticks to be dropped")
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	if _, ok := received(ticker.C()); ok {
+		t.Error("Expected a stopped ticker not to tick")
+	}
+}
+
+func TestFakeWaitForTimers(t *testing.T) {
+	clock := NewFake(time.Now())
+	go clock.NewTimer(time.Second)
+	if !clock.WaitForTimers(1) {
+		t.Fatal("Expected the timer created by the goroutine to be armed")
+	}
+}
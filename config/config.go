@@ -3,24 +3,81 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/mail"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"xray-telegram-manager/fsutil"
+	"xray-telegram-manager/httpclient"
+	"xray-telegram-manager/scheduler"
+	"xray-telegram-manager/types"
 )
 
 type Config struct {
 	AdminID             int64        `json:"admin_id"`
 	BotToken            string       `json:"bot_token"`
 	ConfigPath          string       `json:"config_path"`
+	XrayLayout          string       `json:"xray_layout"`
+	RoutingPath         string       `json:"routing_path,omitempty"`
+	InboundsPath        string       `json:"inbounds_path,omitempty"`
+	XrayLogPath         string       `json:"xray_log_path,omitempty"`
 	SubscriptionURL     string       `json:"subscription_url"`
 	LogLevel            string       `json:"log_level"`
 	XrayRestartCommand  string       `json:"xray_restart_command"`
+	XrayAPI             string       `json:"xray_api,omitempty"`
+	XrayCommands        XrayCommands `json:"xray_commands"`
 	CacheDuration       int          `json:"cache_duration"`
 	HealthCheckInterval int          `json:"health_check_interval"`
+	AvailabilityCheck   int          `json:"availability_check_interval"`
+	AddressCheck        int          `json:"address_check_interval"`
 	PingTimeout         int          `json:"ping_timeout"`
-	UI                  UIConfig     `json:"ui"`
-	Update              UpdateConfig `json:"update"`
+	PingMode            string       `json:"ping_mode"`
+	PingCDNHost         string       `json:"ping_cdn_host,omitempty"`
+	PingProfiles        PingProfiles `json:"ping_profiles"`
+	IPFamily            string       `json:"ip_family"`
+	DNS                 DNS          `json:"dns"`
+	SkipSwitchProbe     bool         `json:"skip_switch_probe"`
+	// SkipSwitchComparison turns off the measurement of the connection before and after a switch
+	SkipSwitchComparison bool         `json:"skip_switch_comparison"`
+	SwitchFallback       string       `json:"switch_fallback"`
+	HTTPProxy            string       `json:"http_proxy,omitempty"`
+	QuotaWarningPercent  int          `json:"quota_warning_percent"`
+	ExpiryReminderDays   []int        `json:"expiry_reminder_days"`
+	BlockedCountries     []string     `json:"blocked_countries,omitempty"`
+	NotificationChats    []int64      `json:"notification_chats,omitempty"`
+	UI                   UIConfig     `json:"ui"`
+	Update               UpdateConfig `json:"update"`
+	Group                GroupConfig  `json:"group"`
+	QuietHours           QuietHours   `json:"quiet_hours"`
+	DailyDigest          DailyDigest  `json:"daily_digest"`
+	Security             Security     `json:"security"`
+	Outbound             Outbound     `json:"outbound"`
+	Memory               Memory       `json:"memory"`
+	Timeouts             Timeouts     `json:"timeouts"`
+	SubscriptionRetry    LoadRetry    `json:"subscription_retry"`
+	LatencyAlert         LatencyAlert `json:"latency_alert"`
+	Web                  Web          `json:"web"`
+	Hooks                Hooks        `json:"hooks"`
+	RouterStatus         RouterStatus `json:"router_status"`
+	MQTT                 MQTT         `json:"mqtt"`
+	FallbackNotifier     Fallback     `json:"fallback_notifier"`
+	Background           Background   `json:"background"`
+	Dev                  Dev          `json:"dev"`
+	SecretsFile          string       `json:"secrets_file,omitempty"`
+
+	// Where bot_token and admin_id were loaded from, see SecretSource
+	secretSources map[string]string
+	// Path of the file the config was loaded from
+	filePath string
+	// Fragments of config.d merged into the config, see Fragments
+	fragments []string
 }
 
 type UIConfig struct {
@@ -30,12 +87,552 @@ type UIConfig struct {
 	MessageTimeoutMinutes     int     `json:"message_timeout_minutes"`
 	EnableNameOptimization    bool    `json:"enable_name_optimization"`
 	NameOptimizationThreshold float64 `json:"name_optimization_threshold"`
+	SkipSwitchConfirmation    bool    `json:"skip_switch_confirmation"`
+	// ShowNotesInList adds the server notes to the buttons of the server list
+	ShowNotesInList bool `json:"show_notes_in_list"`
+	// Weights of the quick select score, used once throughput was measured
+	QuickSelectWeights QuickSelectWeights `json:"quick_select_weights"`
+	// ProgressPercentStep and ProgressServerStep are the milestones at which the progress
+	// of a ping test is shown: every that many percent or servers, -1 turns one off
+	ProgressPercentStep int `json:"progress_percent_step"`
+	ProgressServerStep  int `json:"progress_server_step"`
+}
+
+// QuickSelectWeights weigh latency, last measured throughput and ping stability
+// when ranking quick select servers
+type QuickSelectWeights struct {
+	Latency    float64 `json:"latency"`
+	Throughput float64 `json:"throughput"`
+	Stability  float64 `json:"stability"`
 }
 
 type UpdateConfig struct {
 	ScriptURL      string `json:"script_url"`
 	TimeoutMinutes int    `json:"timeout_minutes"`
 	BackupConfig   bool   `json:"backup_config"`
+	// MaxDownloadKBps caps the download of the new version in KB/s, so the update
+	// does not saturate the uplink, 0 downloads at full speed
+	MaxDownloadKBps int `json:"max_download_kbps"`
+}
+
+// DownloadLimit returns the cap of the update download in bytes per second, 0 for none
+func (u UpdateConfig) DownloadLimit() int64 {
+	return int64(u.MaxDownloadKBps) * 1024
+}
+
+// Xray config layouts for xray_layout
+const (
+	// XrayLayoutAuto detects the layout from the file at config_path
+	XrayLayoutAuto = "auto"
+	// XrayLayoutSplit is the configs/ directory, config_path is its outbounds file
+	XrayLayoutSplit = "split"
+	// XrayLayoutSingle is one config.json with inbounds, outbounds and routing
+	XrayLayoutSingle = "single"
+)
+
+// DefaultPingConcurrency is how many servers the standard ping test tests at once
+const DefaultPingConcurrency = 5
+
+// Latency measurement modes for ping_mode
+const (
+	// PingModeTCP measures the TCP connect time
+	PingModeTCP = "tcp"
+	// PingModeHandshake measures the TLS/Reality handshake for servers that use it
+	PingModeHandshake = "handshake"
+)
+
+// Address families preferred for servers given by domain name, see ip_family
+const (
+	// IPFamilyAuto lets the system choose, trying both families in parallel
+	IPFamilyAuto = "auto"
+	// IPFamilyIPv4 tries IPv4 addresses first and falls back to IPv6
+	IPFamilyIPv4 = "ipv4"
+	// IPFamilyIPv6 tries IPv6 addresses first and falls back to IPv4
+	IPFamilyIPv6 = "ipv6"
+)
+
+// What happens when switching to the chosen server fails, see switch_fallback
+const (
+	// SwitchFallbackOff keeps the previous server and only reports the failure
+	SwitchFallbackOff = "off"
+	// SwitchFallbackOffer offers to switch to the fastest server of the last pings
+	SwitchFallbackOffer = "offer"
+	// SwitchFallbackAuto switches to the fastest servers of the last pings in turn
+	SwitchFallbackAuto = "auto"
+)
+
+// How server domains are resolved, see DNS.Mode
+const (
+	// DNSModeSystem uses the resolver of the router
+	DNSModeSystem = "system"
+	// DNSModeUDP asks DNS.Server over plain DNS
+	DNSModeUDP = "udp"
+	// DNSModeDoH asks DNS.Server over DNS over HTTPS
+	DNSModeDoH = "doh"
+)
+
+// Names of the ping profiles selectable in the ping menu
+const (
+	PingProfileQuick    = "quick"
+	PingProfileThorough = "thorough"
+	PingProfileCustom   = "custom"
+)
+
+// PingProfile is a set of ping test settings. The standard test of /ping uses
+// ping_mode and ping_timeout with the default concurrency and tests all servers.
+type PingProfile struct {
+	// Mode is tcp or handshake, see ping_mode
+	Mode           string `json:"mode"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+	// Retries is how many more times a server that did not answer is tested
+	Retries     int `json:"retries"`
+	Concurrency int `json:"concurrency"`
+	// MaxServers tests only the servers with the best recent latency, 0 tests all
+	MaxServers int `json:"max_servers"`
+	// BatchPause is a pause after every Concurrency servers, see Background
+	BatchPause time.Duration `json:"-"`
+}
+
+// Timeout returns the timeout of one ping
+func (p PingProfile) Timeout() time.Duration {
+	return time.Duration(p.TimeoutSeconds) * time.Second
+}
+
+// PingProfiles are the named ping profiles, custom is offered when it is set
+type PingProfiles struct {
+	Quick    PingProfile `json:"quick"`
+	Thorough PingProfile `json:"thorough"`
+	Custom   PingProfile `json:"custom"`
+}
+
+// Get returns the profile called name, false when it does not exist or custom is not set
+func (p PingProfiles) Get(name string) (PingProfile, bool) {
+	switch name {
+	case PingProfileQuick:
+		return p.Quick, true
+	case PingProfileThorough:
+		return p.Thorough, true
+	case PingProfileCustom:
+		return p.Custom, p.Custom != PingProfile{}
+	}
+	return PingProfile{}, false
+}
+
+// Names returns the names of the available profiles
+func (p PingProfiles) Names() []string {
+	names := []string{PingProfileQuick, PingProfileThorough}
+	if p.Custom != (PingProfile{}) {
+		names = append(names, PingProfileCustom)
+	}
+	return names
+}
+
+// DNS controls how server domains are resolved before pinging and switching, for
+// routers whose DNS is poisoned or slow
+type DNS struct {
+	Mode string `json:"mode"`
+	// Server is host:port for udp, the port defaults to 53, or the URL for doh,
+	// e.g. https://1.1.1.1/dns-query
+	Server string `json:"server,omitempty"`
+	// CacheSeconds is how long resolved addresses are reused
+	CacheSeconds int `json:"cache_seconds"`
+	// PinAddress writes the resolved IP into the outbound, the domain stays the
+	// TLS server name and transport host
+	PinAddress bool `json:"pin_address"`
+}
+
+// CacheTTL returns how long resolved addresses are reused
+func (d DNS) CacheTTL() time.Duration {
+	return time.Duration(d.CacheSeconds) * time.Second
+}
+
+// Roles of group members, see GroupConfig
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleViewer   = "viewer"
+)
+
+// GroupConfig lets members of private admin groups use the bot
+type GroupConfig struct {
+	AllowedChatIDs []int64 `json:"allowed_chat_ids"`
+	// Forum topics for status messages and alerts, 0 replies in the topic of the command
+	StatusTopicID int `json:"status_topic_id"`
+	AlertsTopicID int `json:"alerts_topic_id"`
+	// DefaultRole applies to members without an entry in Roles
+	DefaultRole string           `json:"default_role"`
+	Roles       map[int64]string `json:"roles"`
+}
+
+// QuietHours is a daily period when non-critical notifications are collected into
+// a digest and deferrable background jobs wait until it ends
+type QuietHours struct {
+	Enabled bool `json:"enabled"`
+	// Local time in HH:MM format
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Window returns the parsed quiet hours, or nil when they are disabled
+func (q QuietHours) Window() *scheduler.Window {
+	if !q.Enabled {
+		return nil
+	}
+	window, err := scheduler.ParseWindow(q.Start, q.End)
+	if err != nil {
+		return nil
+	}
+	return &window
+}
+
+// DailyDigest is a daily summary of the background availability checks
+type DailyDigest struct {
+	Enabled bool `json:"enabled"`
+	// Local time in HH:MM format
+	Time string `json:"time"`
+}
+
+// Schedule returns the parsed digest time, or nil when the digest is disabled
+func (d DailyDigest) Schedule() *scheduler.Daily {
+	if !d.Enabled {
+		return nil
+	}
+	daily, err := scheduler.ParseDaily(d.Time)
+	if err != nil {
+		return nil
+	}
+	return &daily
+}
+
+// Security controls how unauthorized users are reported and temporarily banned
+type Security struct {
+	// MaxAttempts unauthorized attempts within WindowMinutes ban a user for BanMinutes
+	MaxAttempts   int `json:"max_attempts"`
+	WindowMinutes int `json:"window_minutes"`
+	BanMinutes    int `json:"ban_minutes"`
+}
+
+// Outbound holds the default anti-DPI options of the generated proxy outbound. They can
+// be changed in /settings and per server.
+type Outbound struct {
+	Mux            bool `json:"mux"`
+	MuxConcurrency int  `json:"mux_concurrency"`
+	Fragment       bool `json:"fragment"`
+	// Xray freedom fragment settings: "tlshello" or a packet range, lengths and intervals as "min-max"
+	FragmentPackets  string `json:"fragment_packets"`
+	FragmentLength   string `json:"fragment_length"`
+	FragmentInterval string `json:"fragment_interval"`
+	Noise            bool   `json:"noise"`
+	// Extra is merged into every generated outbound, e.g. sockopt.mark for policy
+	// routing: {"streamSettings": {"sockopt": {"mark": 255}}}
+	Extra map[string]interface{} `json:"extra,omitempty"`
+}
+
+// outboundExtraKeys are the outbound fields Outbound.Extra may change
+var outboundExtraKeys = []string{"streamSettings", "mux"}
+
+// XrayCommands control the xray service where one restart command is not enough,
+// e.g. ndmq, init scripts with arguments or commands run through sudo or doas.
+// Empty commands are not used.
+type XrayCommands struct {
+	// Restart replaces xray_restart_command
+	Restart string `json:"restart,omitempty"`
+	// Stop and Start restart xray in turn when both are set and Restart is not
+	Stop  string `json:"stop,omitempty"`
+	Start string `json:"start,omitempty"`
+	// Status exits with 0 while xray runs, it is checked after a restart instead
+	// of looking for the xray process
+	Status string `json:"status,omitempty"`
+}
+
+// Memory bounds what is kept in memory, for routers with little RAM
+type Memory struct {
+	// KeepVlessURLs keeps the raw subscription entry of every server, it is only
+	// useful for debugging
+	KeepVlessURLs bool `json:"keep_vless_urls"`
+	// PingHistorySize is how many recent ping results are kept per server
+	PingHistorySize int `json:"ping_history_size"`
+	// Server statistics stay in memory up to MaxStatsInMemory servers, larger
+	// statistics are read from disk when needed
+	MaxStatsInMemory int `json:"max_stats_in_memory"`
+}
+
+// Timeouts bound long operations in seconds, so a hung xray restart or a slow
+// subscription cannot block the bot
+type Timeouts struct {
+	// LoadSeconds bounds loading the subscription
+	LoadSeconds int `json:"load_seconds"`
+	// SwitchSeconds bounds switching the server including the xray restart
+	SwitchSeconds int `json:"switch_seconds"`
+	// RestartSeconds bounds one run of xray_restart_command
+	RestartSeconds int `json:"restart_seconds"`
+	// CommandSeconds bounds the xray_commands other than restart
+	CommandSeconds int `json:"command_seconds"`
+}
+
+// Web is the optional dashboard served from the router for users without the bot
+type Web struct {
+	Enabled bool `json:"enabled"`
+	// Listen is the address of the HTTP server, e.g. ":8088"
+	Listen string `json:"listen"`
+	// Token has to be entered in the dashboard, it protects the API
+	Token string `json:"token"`
+	// ReadOnly hides the switch buttons
+	ReadOnly bool `json:"read_only"`
+}
+
+// Hooks are shell scripts run on events of the manager, each is the path of an
+// executable script, empty to run nothing
+type Hooks struct {
+	PreSwitch        string `json:"pre_switch,omitempty"`
+	PostSwitch       string `json:"post_switch,omitempty"`
+	PostUpdate       string `json:"post_update,omitempty"`
+	OnHealthDegraded string `json:"on_health_degraded,omitempty"`
+	// TimeoutSeconds bounds each run of a script
+	TimeoutSeconds int `json:"timeout_seconds"`
+}
+
+// Timeout returns how long a hook script may run
+func (h Hooks) Timeout() time.Duration {
+	return time.Duration(h.TimeoutSeconds) * time.Second
+}
+
+// RouterStatus shows the VPN state on the router itself, so it is visible when
+// Telegram cannot be reached
+type RouterStatus struct {
+	// Syslog writes the VPN going down and coming back to the system log
+	Syslog    bool   `json:"syslog"`
+	SyslogTag string `json:"syslog_tag"`
+	// LEDDownCommand and LEDUpCommand run through the shell when the VPN goes down
+	// and comes back, e.g. to switch an LED of the router with ndmc or RCI
+	LEDDownCommand string `json:"led_down_command,omitempty"`
+	LEDUpCommand   string `json:"led_up_command,omitempty"`
+}
+
+// Enabled reports whether the VPN state is shown on the router in any way
+func (r RouterStatus) Enabled() bool {
+	return r.Syslog || r.LEDDownCommand != "" || r.LEDUpCommand != ""
+}
+
+// MQTT publishes the state of the VPN and its events to a broker, for home automation
+// that should react to them without polling the web API
+type MQTT struct {
+	// Broker is host:port of the broker, prefixed with tls:// for an encrypted
+	// connection, empty to publish nothing
+	Broker string `json:"broker,omitempty"`
+	// TopicPrefix comes before every topic, e.g. xray-manager/vpn
+	TopicPrefix string `json:"topic_prefix"`
+	ClientID    string `json:"client_id"`
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+}
+
+// Enabled reports whether a broker is configured
+func (m MQTT) Enabled() bool {
+	return m.Broker != ""
+}
+
+// Fallback types of fallback_notifier
+const (
+	FallbackTypeNtfy    = "ntfy"
+	FallbackTypeWebhook = "webhook"
+	FallbackTypeSMTP    = "smtp"
+)
+
+// Fallback is a second channel for critical alerts, so they reach the admin while
+// Telegram is unreachable or the bot token was revoked
+type Fallback struct {
+	// Type is ntfy, webhook or smtp, empty sends nothing
+	Type string `json:"type,omitempty"`
+	// URL is the ntfy topic, e.g. https://ntfy.sh/my-router, or the URL the webhook
+	// posts JSON to
+	URL string `json:"url,omitempty"`
+	// Token is sent as a bearer token to ntfy or the webhook
+	Token string `json:"token,omitempty"`
+	// Always sends the alerts also when Telegram delivered them, by default only
+	// the undelivered ones are sent
+	Always bool         `json:"always"`
+	SMTP   FallbackSMTP `json:"smtp"`
+}
+
+// FallbackSMTP is the mail server of the smtp fallback
+type FallbackSMTP struct {
+	Host string `json:"host,omitempty"`
+	// Port 465 connects over TLS, others upgrade with STARTTLS when the server
+	// offers it. 587 by default.
+	Port     int      `json:"port"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+}
+
+// Enabled reports whether a fallback channel is configured
+func (f Fallback) Enabled() bool {
+	return f.Type != ""
+}
+
+// Address returns host:port of the broker and whether to connect over TLS. The port
+// defaults to 1883, 8883 with TLS.
+func (m MQTT) Address() (string, bool, error) {
+	broker := strings.TrimSpace(m.Broker)
+	useTLS := false
+	if scheme, rest, ok := strings.Cut(broker, "://"); ok {
+		switch strings.ToLower(scheme) {
+		case "tcp", "mqtt":
+		case "tls", "ssl", "mqtts":
+			useTLS = true
+		default:
+			return "", false, fmt.Errorf("unsupported broker scheme %q, use tcp:// or tls://", scheme)
+		}
+		broker = strings.TrimSuffix(rest, "/")
+	}
+	port := "1883"
+	if useTLS {
+		port = "8883"
+	}
+	host := broker
+	if h, p, err := net.SplitHostPort(broker); err == nil {
+		host, port = h, p
+	}
+	if host == "" || strings.ContainsAny(host, "/?#@ ") {
+		return "", false, fmt.Errorf("invalid broker address %q", m.Broker)
+	}
+	if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+		return "", false, fmt.Errorf("invalid broker port %q", port)
+	}
+	return net.JoinHostPort(host, port), useTLS, nil
+}
+
+// Background keeps the periodic availability check from competing with the traffic
+// on routers with a weak CPU
+type Background struct {
+	// Concurrency is how many servers the availability check tests at once
+	Concurrency int `json:"concurrency"`
+	// BatchPauseMs is a pause after every Concurrency servers, 0 tests without pauses
+	BatchPauseMs int `json:"batch_pause_ms"`
+	// MaxLoad holds the availability check back while the 1-minute load average of
+	// the router is at or above it, 0 runs it whatever the load
+	MaxLoad float64 `json:"max_load"`
+}
+
+// BatchPause returns the pause between batches of the availability check
+func (b Background) BatchPause() time.Duration {
+	return time.Duration(b.BatchPauseMs) * time.Millisecond
+}
+
+// Dev runs the manager on a development machine without xray and a router. The
+// xray config, log and the stub xray live in SandboxDir and pings are simulated.
+type Dev struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// SandboxDir is resolved against the directory of config.json when relative
+	SandboxDir string `json:"sandbox_dir,omitempty"`
+	// Pings script the simulated latency, the first rule matching a server applies
+	Pings []DevPing `json:"pings,omitempty"`
+}
+
+// DevPing scripts the simulated pings of the servers whose names contain Match
+type DevPing struct {
+	// Match is a case-insensitive part of the server name, empty matches all servers
+	Match string `json:"match"`
+	// LatencyMs are played in turn by the pings of a server, 0 does not answer
+	LatencyMs []int `json:"latency_ms"`
+	// JitterMs adds a random delay of up to this many milliseconds
+	JitterMs int `json:"jitter_ms,omitempty"`
+}
+
+// Sandbox paths of the emulated xray in dev mode
+const (
+	devOutboundsFile = "04_outbounds.json"
+	devInboundsFile  = "03_inbounds.json"
+	devRoutingFile   = "05_routing.json"
+	devXrayLogFile   = "xray.log"
+)
+
+// maxBatchPauseMs keeps a paused check from delaying the shutdown for long
+const maxBatchPauseMs = 10000
+
+// maxSyslogTagLength is the tag length syslog daemons keep, see RFC 3164
+const maxSyslogTagLength = 32
+
+// maxHookTimeoutSeconds keeps a hanging script from blocking a switch for long
+const maxHookTimeoutSeconds = 300
+
+// LoadRetry retries a failed subscription load in the background with exponential
+// backoff, so a short outage of the provider does not wait for a manual refresh
+type LoadRetry struct {
+	// MaxAttempts is the number of automatic retries, -1 disables them
+	MaxAttempts int `json:"max_attempts"`
+	// InitialDelaySeconds is the wait before the first retry, doubled for every next one
+	InitialDelaySeconds int `json:"initial_delay_seconds"`
+	// MaxDelaySeconds caps the wait between two retries
+	MaxDelaySeconds int `json:"max_delay_seconds"`
+}
+
+// InitialDelay returns the wait before the first retry
+func (r LoadRetry) InitialDelay() time.Duration {
+	return time.Duration(r.InitialDelaySeconds) * time.Second
+}
+
+// MaxDelay returns the longest wait between two retries
+func (r LoadRetry) MaxDelay() time.Duration {
+	return time.Duration(r.MaxDelaySeconds) * time.Second
+}
+
+// LatencyAlert warns when the latency of the active server jumps far above its usual
+// level, before the server stops answering altogether
+type LatencyAlert struct {
+	// Factor is how many times the median latency counts as degraded, -1 disables the alert
+	Factor float64 `json:"factor"`
+	// DurationMinutes is how long the latency has to stay degraded
+	DurationMinutes int `json:"duration_minutes"`
+}
+
+// Duration returns how long the latency has to stay degraded
+func (a LatencyAlert) Duration() time.Duration {
+	return time.Duration(a.DurationMinutes) * time.Minute
+}
+
+// Enabled reports whether degraded latency is alerted
+func (a LatencyAlert) Enabled() bool {
+	return a.Factor > 0
+}
+
+// minWebTokenLength keeps the dashboard token from being guessed
+const minWebTokenLength = 16
+
+// Load returns the deadline for loading the subscription
+func (t Timeouts) Load() time.Duration {
+	return time.Duration(t.LoadSeconds) * time.Second
+}
+
+// Switch returns the deadline for switching the server
+func (t Timeouts) Switch() time.Duration {
+	return time.Duration(t.SwitchSeconds) * time.Second
+}
+
+// Restart returns the deadline for the xray restart command
+func (t Timeouts) Restart() time.Duration {
+	return time.Duration(t.RestartSeconds) * time.Second
+}
+
+// Command returns the deadline for the xray stop, start and status commands
+func (t Timeouts) Command() time.Duration {
+	return time.Duration(t.CommandSeconds) * time.Second
+}
+
+// Options converts the config to the options applied to the outbound
+func (o Outbound) Options() types.OutboundOptions {
+	return types.OutboundOptions{
+		Mux:              o.Mux,
+		MuxConcurrency:   o.MuxConcurrency,
+		Fragment:         o.Fragment,
+		FragmentPackets:  o.FragmentPackets,
+		FragmentLength:   o.FragmentLength,
+		FragmentInterval: o.FragmentInterval,
+		Noise:            o.Noise,
+		Extra:            o.Extra,
+	}
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -47,21 +644,48 @@ func LoadConfig(path string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
+	data, fragments, err := mergeFragments(data, path, nil)
+	if err != nil {
+		return nil, err
+	}
 
+	config, err := ParseConfig(data, path)
+	if err != nil {
+		return nil, err
+	}
+	config.fragments = fragments
+	return config, nil
+}
+
+// ParseConfig parses and validates config data as if it was loaded from path. The
+// fragments of config.d are not merged, see LoadConfig and MergeFragments.
+func ParseConfig(data []byte, path string) (*Config, error) {
 	var config Config
 	if err := json.Unmarshal(data, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	if err := config.applySecrets(path); err != nil {
+		return nil, fmt.Errorf("failed to load secrets: %w", err)
+	}
+
 	config.SetDefaults()
 	if err := config.Validate(); err != nil {
 		return nil, fmt.Errorf("config validation failed: %w", err)
 	}
+	config.applyDevMode(path)
 
+	config.filePath = path
 	return &config, nil
 }
 
 func (c *Config) SetDefaults() {
+	if c.XrayLayout == "" {
+		c.XrayLayout = XrayLayoutAuto
+	}
+	if c.ConfigPath == "" && c.XrayLayout == XrayLayoutSingle {
+		c.ConfigPath = "/opt/etc/xray/config.json"
+	}
 	if c.ConfigPath == "" {
 		c.ConfigPath = "/opt/etc/xray/configs/04_outbounds.json"
 	}
@@ -77,9 +701,58 @@ func (c *Config) SetDefaults() {
 	if c.HealthCheckInterval == 0 {
 		c.HealthCheckInterval = 300
 	}
+	if c.AvailabilityCheck == 0 {
+		c.AvailabilityCheck = 1800
+	}
+	if c.AddressCheck == 0 {
+		c.AddressCheck = 900
+	}
 	if c.PingTimeout == 0 {
 		c.PingTimeout = 5
 	}
+	if c.PingMode == "" {
+		c.PingMode = PingModeTCP
+	}
+	if c.IPFamily == "" {
+		c.IPFamily = IPFamilyAuto
+	}
+	if c.SwitchFallback == "" {
+		c.SwitchFallback = SwitchFallbackOffer
+	}
+	if c.PingProfiles.Quick == (PingProfile{}) {
+		c.PingProfiles.Quick = PingProfile{Mode: PingModeTCP, TimeoutSeconds: 2, Concurrency: 10, MaxServers: 50}
+	}
+	if c.PingProfiles.Thorough == (PingProfile{}) {
+		c.PingProfiles.Thorough = PingProfile{Mode: PingModeHandshake, TimeoutSeconds: 10, Retries: 2, Concurrency: 3}
+	}
+	// Settings left out of a profile are those of the standard test
+	for _, profile := range []*PingProfile{&c.PingProfiles.Quick, &c.PingProfiles.Thorough, &c.PingProfiles.Custom} {
+		if *profile == (PingProfile{}) {
+			continue
+		}
+		if profile.Mode == "" {
+			profile.Mode = c.PingMode
+		}
+		if profile.TimeoutSeconds == 0 {
+			profile.TimeoutSeconds = c.PingTimeout
+		}
+		if profile.Concurrency == 0 {
+			profile.Concurrency = DefaultPingConcurrency
+		}
+	}
+	if c.DNS.Mode == "" {
+		c.DNS.Mode = DNSModeSystem
+	}
+	if c.DNS.CacheSeconds == 0 {
+		c.DNS.CacheSeconds = 300
+	}
+	if c.QuotaWarningPercent == 0 {
+		c.QuotaWarningPercent = 10
+	}
+	// An empty list in the file turns the reminders off
+	if c.ExpiryReminderDays == nil {
+		c.ExpiryReminderDays = []int{7, 3, 1}
+	}
 
 	// UI defaults
 	if c.UI.MaxButtonTextLength == 0 {
@@ -98,6 +771,15 @@ func (c *Config) SetDefaults() {
 		c.UI.NameOptimizationThreshold = 0.7
 		c.UI.EnableNameOptimization = true
 	}
+	if c.UI.QuickSelectWeights == (QuickSelectWeights{}) {
+		c.UI.QuickSelectWeights = QuickSelectWeights{Latency: 0.5, Throughput: 0.3, Stability: 0.2}
+	}
+	if c.UI.ProgressPercentStep == 0 {
+		c.UI.ProgressPercentStep = 10
+	}
+	if c.UI.ProgressServerStep == 0 {
+		c.UI.ProgressServerStep = 50
+	}
 
 	// Update defaults
 	if c.Update.ScriptURL == "" {
@@ -107,6 +789,109 @@ func (c *Config) SetDefaults() {
 		c.Update.TimeoutMinutes = 10
 	}
 	// BackupConfig defaults to false (zero value)
+
+	// Group defaults
+	if c.Group.DefaultRole == "" {
+		c.Group.DefaultRole = RoleViewer
+	}
+
+	// Security defaults
+	if c.Security.MaxAttempts == 0 {
+		c.Security.MaxAttempts = 5
+	}
+	if c.Security.WindowMinutes == 0 {
+		c.Security.WindowMinutes = 10
+	}
+	if c.Security.BanMinutes == 0 {
+		c.Security.BanMinutes = 60
+	}
+
+	// Outbound defaults
+	if c.Outbound.MuxConcurrency == 0 {
+		c.Outbound.MuxConcurrency = 8
+	}
+	if c.Outbound.FragmentPackets == "" {
+		c.Outbound.FragmentPackets = "tlshello"
+	}
+	if c.Outbound.FragmentLength == "" {
+		c.Outbound.FragmentLength = "100-200"
+	}
+	if c.Outbound.FragmentInterval == "" {
+		c.Outbound.FragmentInterval = "10-20"
+	}
+
+	// Memory defaults
+	if c.Memory.PingHistorySize == 0 {
+		c.Memory.PingHistorySize = 20
+	}
+	if c.Memory.MaxStatsInMemory == 0 {
+		c.Memory.MaxStatsInMemory = 200
+	}
+
+	// Timeout defaults
+	if c.Timeouts.LoadSeconds == 0 {
+		c.Timeouts.LoadSeconds = 60
+	}
+	if c.Timeouts.SwitchSeconds == 0 {
+		c.Timeouts.SwitchSeconds = 90
+	}
+	if c.Timeouts.RestartSeconds == 0 {
+		c.Timeouts.RestartSeconds = 30
+	}
+	if c.Timeouts.CommandSeconds == 0 {
+		c.Timeouts.CommandSeconds = 15
+	}
+	if c.LatencyAlert.Factor == 0 {
+		c.LatencyAlert.Factor = 3
+	}
+	if c.LatencyAlert.DurationMinutes == 0 {
+		c.LatencyAlert.DurationMinutes = 10
+	}
+	if c.SubscriptionRetry.MaxAttempts == 0 {
+		c.SubscriptionRetry.MaxAttempts = 5
+	}
+	if c.SubscriptionRetry.InitialDelaySeconds == 0 {
+		c.SubscriptionRetry.InitialDelaySeconds = 60
+	}
+	if c.SubscriptionRetry.MaxDelaySeconds == 0 {
+		c.SubscriptionRetry.MaxDelaySeconds = 1800
+	}
+
+	if c.Web.Listen == "" {
+		c.Web.Listen = ":8088"
+	}
+	if c.Hooks.TimeoutSeconds == 0 {
+		c.Hooks.TimeoutSeconds = 30
+	}
+	if c.RouterStatus.SyslogTag == "" {
+		c.RouterStatus.SyslogTag = "xray-manager"
+	}
+	if c.MQTT.TopicPrefix == "" {
+		c.MQTT.TopicPrefix = "xray-manager"
+	}
+	if c.MQTT.ClientID == "" {
+		c.MQTT.ClientID = "xray-telegram-manager"
+	}
+	if c.FallbackNotifier.SMTP.Port == 0 {
+		c.FallbackNotifier.SMTP.Port = 587
+	}
+	if c.Background.Concurrency == 0 {
+		c.Background.Concurrency = DefaultPingConcurrency
+	}
+	if c.Dev.Enabled && c.Dev.SandboxDir == "" {
+		c.Dev.SandboxDir = "dev"
+	}
+
+	// Quiet hours defaults
+	if c.QuietHours.Start == "" {
+		c.QuietHours.Start = "23:00"
+	}
+	if c.QuietHours.End == "" {
+		c.QuietHours.End = "07:00"
+	}
+	if c.DailyDigest.Time == "" {
+		c.DailyDigest.Time = "09:00"
+	}
 }
 
 func (c *Config) Validate() error {
@@ -130,6 +915,18 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid config_path: %w", err)
 	}
 
+	if c.XrayLayout != XrayLayoutAuto && c.XrayLayout != XrayLayoutSplit && c.XrayLayout != XrayLayoutSingle {
+		return fmt.Errorf("xray_layout must be one of: %s, %s, %s", XrayLayoutAuto, XrayLayoutSplit, XrayLayoutSingle)
+	}
+
+	if c.RoutingPath != "" && !filepath.IsAbs(c.RoutingPath) {
+		return fmt.Errorf("routing_path must be an absolute path")
+	}
+
+	if c.InboundsPath != "" && !filepath.IsAbs(c.InboundsPath) {
+		return fmt.Errorf("inbounds_path must be an absolute path")
+	}
+
 	if err := c.validateLogLevel(); err != nil {
 		return fmt.Errorf("invalid log_level: %w", err)
 	}
@@ -142,6 +939,10 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid xray_restart_command: %w", err)
 	}
 
+	if err := c.validateXrayCommands(); err != nil {
+		return fmt.Errorf("invalid xray_commands: %w", err)
+	}
+
 	if err := c.validateUI(); err != nil {
 		return fmt.Errorf("invalid UI configuration: %w", err)
 	}
@@ -150,9 +951,285 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid Update configuration: %w", err)
 	}
 
+	if err := c.validateGroup(); err != nil {
+		return fmt.Errorf("invalid group configuration: %w", err)
+	}
+
+	if _, err := scheduler.ParseWindow(c.QuietHours.Start, c.QuietHours.End); err != nil {
+		return fmt.Errorf("invalid quiet_hours: %w", err)
+	}
+
+	if _, err := scheduler.ParseDaily(c.DailyDigest.Time); err != nil {
+		return fmt.Errorf("invalid daily_digest time: %w", err)
+	}
+
+	if err := c.validateOutbound(); err != nil {
+		return fmt.Errorf("invalid outbound configuration: %w", err)
+	}
+
+	if c.Security.MaxAttempts < 1 || c.Security.WindowMinutes < 1 || c.Security.BanMinutes < 1 {
+		return fmt.Errorf("invalid security configuration: max_attempts, window_minutes and ban_minutes must be positive")
+	}
+
+	if c.HTTPProxy != "" {
+		if _, err := httpclient.ParseProxy(c.HTTPProxy); err != nil {
+			return fmt.Errorf("invalid http_proxy: %w", err)
+		}
+	}
+
+	if c.Timeouts.LoadSeconds < 1 || c.Timeouts.SwitchSeconds < 1 || c.Timeouts.RestartSeconds < 1 || c.Timeouts.CommandSeconds < 1 {
+		return fmt.Errorf("invalid timeouts configuration: load_seconds, switch_seconds, restart_seconds and command_seconds must be positive")
+	}
+	if c.Timeouts.SwitchSeconds < c.Timeouts.RestartSeconds {
+		return fmt.Errorf("invalid timeouts configuration: switch_seconds must not be less than restart_seconds")
+	}
+
+	retry := c.SubscriptionRetry
+	if retry.MaxAttempts != -1 && (retry.MaxAttempts < 1 || retry.MaxAttempts > 20) {
+		return fmt.Errorf("invalid subscription_retry configuration: max_attempts must be -1 (disabled) or between 1 and 20")
+	}
+	if retry.InitialDelaySeconds < 10 || retry.MaxDelaySeconds < retry.InitialDelaySeconds || retry.MaxDelaySeconds > 86400 {
+		return fmt.Errorf("invalid subscription_retry configuration: initial_delay_seconds must be at least 10 and max_delay_seconds between it and 86400")
+	}
+
+	if c.LatencyAlert.Factor != -1 && (c.LatencyAlert.Factor < 1.5 || c.LatencyAlert.Factor > 20) {
+		return fmt.Errorf("invalid latency_alert configuration: factor must be -1 (disabled) or between 1.5 and 20")
+	}
+	if c.LatencyAlert.DurationMinutes < 1 || c.LatencyAlert.DurationMinutes > 1440 {
+		return fmt.Errorf("invalid latency_alert configuration: duration_minutes must be between 1 and 1440")
+	}
+
+	if c.Memory.PingHistorySize < 3 || c.Memory.PingHistorySize > 1000 {
+		return fmt.Errorf("invalid memory configuration: ping_history_size must be between 3 and 1000")
+	}
+	if c.Memory.MaxStatsInMemory < 1 {
+		return fmt.Errorf("invalid memory configuration: max_stats_in_memory must be positive")
+	}
+
+	if err := c.validateWeb(); err != nil {
+		return fmt.Errorf("invalid web configuration: %w", err)
+	}
+
+	if err := c.validateHooks(); err != nil {
+		return fmt.Errorf("invalid hooks configuration: %w", err)
+	}
+
+	if err := c.validateRouterStatus(); err != nil {
+		return fmt.Errorf("invalid router_status configuration: %w", err)
+	}
+
+	if err := c.validateMQTT(); err != nil {
+		return fmt.Errorf("invalid mqtt configuration: %w", err)
+	}
+
+	if err := c.validateFallback(); err != nil {
+		return fmt.Errorf("invalid fallback_notifier configuration: %w", err)
+	}
+
+	if err := c.validateBackground(); err != nil {
+		return fmt.Errorf("invalid background configuration: %w", err)
+	}
+
+	if err := c.validateDev(); err != nil {
+		return fmt.Errorf("invalid dev configuration: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Config) validateDNS() error {
+	if c.DNS.CacheSeconds < 0 {
+		return fmt.Errorf("cache_seconds must not be negative")
+	}
+	switch c.DNS.Mode {
+	case DNSModeSystem:
+		return nil
+	case DNSModeUDP:
+		if c.DNS.Server == "" {
+			return fmt.Errorf("server is required for mode %s", DNSModeUDP)
+		}
+		host := c.DNS.Server
+		if h, _, err := net.SplitHostPort(c.DNS.Server); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("server must be an IP address with an optional port")
+		}
+		return nil
+	case DNSModeDoH:
+		parsed, err := url.Parse(c.DNS.Server)
+		if err != nil || parsed.Host == "" || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+			return fmt.Errorf("server must be the URL of the DNS over HTTPS endpoint, e.g. https://1.1.1.1/dns-query")
+		}
+		return nil
+	default:
+		return fmt.Errorf("mode must be one of: %s, %s, %s", DNSModeSystem, DNSModeUDP, DNSModeDoH)
+	}
+}
+
+func (c *Config) validatePingProfiles() error {
+	for _, name := range c.PingProfiles.Names() {
+		profile, _ := c.PingProfiles.Get(name)
+		if profile.Mode != PingModeTCP && profile.Mode != PingModeHandshake {
+			return fmt.Errorf("%s: mode must be one of: %s, %s", name, PingModeTCP, PingModeHandshake)
+		}
+		if profile.TimeoutSeconds < 1 || profile.TimeoutSeconds > 60 {
+			return fmt.Errorf("%s: timeout_seconds must be between 1 and 60", name)
+		}
+		if profile.Retries < 0 || profile.Retries > 5 {
+			return fmt.Errorf("%s: retries must be between 0 and 5", name)
+		}
+		if profile.Concurrency < 1 || profile.Concurrency > 50 {
+			return fmt.Errorf("%s: concurrency must be between 1 and 50", name)
+		}
+		if profile.MaxServers < 0 {
+			return fmt.Errorf("%s: max_servers must not be negative", name)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateWeb() error {
+	if !c.Web.Enabled {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Web.Listen); err != nil {
+		return fmt.Errorf("listen must be host:port: %w", err)
+	}
+	if len(c.Web.Token) < minWebTokenLength {
+		return fmt.Errorf("token must be at least %d characters", minWebTokenLength)
+	}
+	return nil
+}
+
+func (c *Config) validateHooks() error {
+	if c.Hooks.TimeoutSeconds < 1 || c.Hooks.TimeoutSeconds > maxHookTimeoutSeconds {
+		return fmt.Errorf("timeout_seconds must be between 1 and %d", maxHookTimeoutSeconds)
+	}
+	scripts := map[string]string{
+		"pre_switch":         c.Hooks.PreSwitch,
+		"post_switch":        c.Hooks.PostSwitch,
+		"post_update":        c.Hooks.PostUpdate,
+		"on_health_degraded": c.Hooks.OnHealthDegraded,
+	}
+	for name, script := range scripts {
+		if script != "" && !filepath.IsAbs(script) {
+			return fmt.Errorf("%s must be an absolute path, got %q", name, script)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateRouterStatus() error {
+	tag := c.RouterStatus.SyslogTag
+	if len(tag) > maxSyslogTagLength {
+		return fmt.Errorf("syslog_tag must be at most %d characters", maxSyslogTagLength)
+	}
+	if strings.ContainsAny(tag, " :[]") {
+		return fmt.Errorf("syslog_tag must not contain spaces, colons or brackets, got %q", tag)
+	}
+	return nil
+}
+
+func (c *Config) validateMQTT() error {
+	if !c.MQTT.Enabled() {
+		return nil
+	}
+	if _, _, err := c.MQTT.Address(); err != nil {
+		return err
+	}
+	prefix := c.MQTT.TopicPrefix
+	if strings.ContainsAny(prefix, "+#") || strings.HasPrefix(prefix, "$") || strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("topic_prefix must not contain wildcards or start with $ and must not start or end with /, got %q", prefix)
+	}
+	if c.MQTT.Password != "" && c.MQTT.Username == "" {
+		return fmt.Errorf("password needs a username")
+	}
 	return nil
 }
 
+func (c *Config) validateFallback() error {
+	fallback := c.FallbackNotifier
+	switch fallback.Type {
+	case "":
+		return nil
+	case FallbackTypeNtfy, FallbackTypeWebhook:
+		u, err := url.Parse(fallback.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s needs an http or https url, got %q", fallback.Type, fallback.URL)
+		}
+	case FallbackTypeSMTP:
+		smtp := fallback.SMTP
+		if smtp.Host == "" || smtp.From == "" || len(smtp.To) == 0 {
+			return fmt.Errorf("smtp needs host, from and to")
+		}
+		if smtp.Port < 1 || smtp.Port > 65535 {
+			return fmt.Errorf("smtp port must be between 1 and 65535")
+		}
+		if smtp.Password != "" && smtp.Username == "" {
+			return fmt.Errorf("smtp password needs a username")
+		}
+		for _, address := range append([]string{smtp.From}, smtp.To...) {
+			if _, err := mail.ParseAddress(address); err != nil {
+				return fmt.Errorf("invalid mail address %q: %w", address, err)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown type %q, use ntfy, webhook or smtp", fallback.Type)
+	}
+	return nil
+}
+
+func (c *Config) validateBackground() error {
+	if c.Background.Concurrency < 1 || c.Background.Concurrency > 50 {
+		return fmt.Errorf("concurrency must be between 1 and 50")
+	}
+	if c.Background.BatchPauseMs < 0 || c.Background.BatchPauseMs > maxBatchPauseMs {
+		return fmt.Errorf("batch_pause_ms must be between 0 and %d", maxBatchPauseMs)
+	}
+	if c.Background.MaxLoad < 0 {
+		return fmt.Errorf("max_load must not be negative")
+	}
+	return nil
+}
+
+func (c *Config) validateDev() error {
+	for i, rule := range c.Dev.Pings {
+		if len(rule.LatencyMs) == 0 {
+			return fmt.Errorf("pings[%d]: latency_ms must not be empty", i)
+		}
+		for _, latency := range rule.LatencyMs {
+			if latency < 0 {
+				return fmt.Errorf("pings[%d]: latency_ms must not be negative", i)
+			}
+		}
+		if rule.JitterMs < 0 {
+			return fmt.Errorf("pings[%d]: jitter_ms must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// applyDevMode points the xray paths into the sandbox and turns off the xray API, so
+// nothing outside of the sandbox is touched. path is the path of config.json.
+func (c *Config) applyDevMode(path string) {
+	if !c.Dev.Enabled {
+		return
+	}
+	if !filepath.IsAbs(c.Dev.SandboxDir) {
+		c.Dev.SandboxDir = filepath.Join(filepath.Dir(path), c.Dev.SandboxDir)
+	}
+	if absolute, err := filepath.Abs(c.Dev.SandboxDir); err == nil {
+		c.Dev.SandboxDir = absolute
+	}
+	c.ConfigPath = filepath.Join(c.Dev.SandboxDir, devOutboundsFile)
+	c.XrayLayout = XrayLayoutSplit
+	c.RoutingPath = filepath.Join(c.Dev.SandboxDir, devRoutingFile)
+	c.InboundsPath = filepath.Join(c.Dev.SandboxDir, devInboundsFile)
+	c.XrayLogPath = filepath.Join(c.Dev.SandboxDir, devXrayLogFile)
+	c.XrayAPI = ""
+}
+
 func (c *Config) validateBotToken() error {
 	if c.BotToken == "" {
 		return fmt.Errorf("bot_token is required")
@@ -166,6 +1243,39 @@ func (c *Config) validateBotToken() error {
 	return nil
 }
 
+// subscriptionSchemes are the URL schemes a subscription source is registered for,
+// http and https are always available
+var (
+	subscriptionSchemesMutex sync.RWMutex
+	subscriptionSchemes      = map[string]bool{"http": true, "https": true}
+)
+
+// RegisterSubscriptionScheme allows subscription_url to use the scheme. It is called
+// by server.RegisterSource, the config package does not know the sources.
+func RegisterSubscriptionScheme(scheme string) {
+	subscriptionSchemesMutex.Lock()
+	defer subscriptionSchemesMutex.Unlock()
+	subscriptionSchemes[strings.ToLower(scheme)] = true
+}
+
+// SubscriptionSchemes returns the schemes subscription_url may use, sorted
+func SubscriptionSchemes() []string {
+	subscriptionSchemesMutex.RLock()
+	defer subscriptionSchemesMutex.RUnlock()
+	schemes := make([]string, 0, len(subscriptionSchemes))
+	for scheme := range subscriptionSchemes {
+		schemes = append(schemes, scheme)
+	}
+	slices.Sort(schemes)
+	return schemes
+}
+
+func subscriptionSchemeAllowed(scheme string) bool {
+	subscriptionSchemesMutex.RLock()
+	defer subscriptionSchemesMutex.RUnlock()
+	return subscriptionSchemes[scheme]
+}
+
 func (c *Config) validateSubscriptionURL() error {
 	if c.SubscriptionURL == "" {
 		return fmt.Errorf("subscription_url is required")
@@ -176,11 +1286,16 @@ func (c *Config) validateSubscriptionURL() error {
 		return fmt.Errorf("subscription_url is not a valid URL: %w", err)
 	}
 
-	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
-		return fmt.Errorf("subscription_url must use http or https scheme")
+	scheme := strings.ToLower(parsedURL.Scheme)
+	// A plain path is loaded by the file source
+	if scheme == "" && filepath.IsAbs(c.SubscriptionURL) {
+		scheme = "file"
+	}
+	if !subscriptionSchemeAllowed(scheme) {
+		return fmt.Errorf("subscription_url must use one of the schemes %s", strings.Join(SubscriptionSchemes(), ", "))
 	}
 
-	if parsedURL.Host == "" {
+	if (scheme == "http" || scheme == "https") && parsedURL.Host == "" {
 		return fmt.Errorf("subscription_url must have a valid host")
 	}
 
@@ -237,6 +1352,52 @@ func (c *Config) validateTimeouts() error {
 		return fmt.Errorf("ping_timeout cannot exceed 60 seconds")
 	}
 
+	if c.PingMode != PingModeTCP && c.PingMode != PingModeHandshake {
+		return fmt.Errorf("ping_mode must be one of: %s, %s", PingModeTCP, PingModeHandshake)
+	}
+
+	if c.IPFamily != IPFamilyAuto && c.IPFamily != IPFamilyIPv4 && c.IPFamily != IPFamilyIPv6 {
+		return fmt.Errorf("ip_family must be one of: %s, %s, %s", IPFamilyAuto, IPFamilyIPv4, IPFamilyIPv6)
+	}
+
+	if c.SwitchFallback != SwitchFallbackOff && c.SwitchFallback != SwitchFallbackOffer && c.SwitchFallback != SwitchFallbackAuto {
+		return fmt.Errorf("switch_fallback must be one of: %s, %s, %s", SwitchFallbackOff, SwitchFallbackOffer, SwitchFallbackAuto)
+	}
+
+	if err := c.validateDNS(); err != nil {
+		return fmt.Errorf("invalid dns configuration: %w", err)
+	}
+
+	if err := c.validatePingProfiles(); err != nil {
+		return fmt.Errorf("invalid ping_profiles configuration: %w", err)
+	}
+
+	if c.XrayAPI != "" {
+		if _, port, err := net.SplitHostPort(c.XrayAPI); err != nil || port == "" {
+			return fmt.Errorf("xray_api must be host:port of the xray API inbound, e.g. 127.0.0.1:10085")
+		}
+	}
+
+	if c.PingCDNHost != "" && (strings.ContainsAny(c.PingCDNHost, ":/ ") || !strings.Contains(c.PingCDNHost, ".")) {
+		return fmt.Errorf("ping_cdn_host must be a host name without scheme or port")
+	}
+
+	if c.QuotaWarningPercent < 1 || c.QuotaWarningPercent > 99 {
+		return fmt.Errorf("quota_warning_percent must be between 1 and 99")
+	}
+
+	for _, days := range c.ExpiryReminderDays {
+		if days < 1 || days > 365 {
+			return fmt.Errorf("expiry_reminder_days must be between 1 and 365, got %d", days)
+		}
+	}
+
+	for _, code := range c.BlockedCountries {
+		if !countryCodeRegex.MatchString(code) {
+			return fmt.Errorf("blocked_countries must contain two-letter country codes such as \"RU\", got %q", code)
+		}
+	}
+
 	if c.CacheDuration > 86400 {
 		return fmt.Errorf("cache_duration cannot exceed 24 hours (86400 seconds)")
 	}
@@ -245,6 +1406,14 @@ func (c *Config) validateTimeouts() error {
 		return fmt.Errorf("health_check_interval cannot exceed 1 hour (3600 seconds)")
 	}
 
+	if c.AvailabilityCheck != -1 && (c.AvailabilityCheck < 300 || c.AvailabilityCheck > 86400) {
+		return fmt.Errorf("availability_check_interval must be -1 (disabled) or between 300 and 86400 seconds")
+	}
+
+	if c.AddressCheck != -1 && (c.AddressCheck < 300 || c.AddressCheck > 86400) {
+		return fmt.Errorf("address_check_interval must be -1 (disabled) or between 300 and 86400 seconds")
+	}
+
 	return nil
 }
 
@@ -253,25 +1422,76 @@ func (c *Config) validateCommand() error {
 		c.XrayRestartCommand = "/opt/etc/init.d/S24xray restart"
 		return nil
 	}
+	return validateServiceCommand("xray_restart_command", c.XrayRestartCommand)
+}
 
+// validateXrayCommands checks the commands that are set
+func (c *Config) validateXrayCommands() error {
+	commands := map[string]string{
+		"restart": c.XrayCommands.Restart,
+		"stop":    c.XrayCommands.Stop,
+		"start":   c.XrayCommands.Start,
+		"status":  c.XrayCommands.Status,
+	}
+	for _, name := range []string{"restart", "stop", "start", "status"} {
+		if commands[name] == "" {
+			continue
+		}
+		if err := validateServiceCommand(name, commands[name]); err != nil {
+			return err
+		}
+	}
+	if (c.XrayCommands.Stop == "") != (c.XrayCommands.Start == "") && c.XrayCommands.Restart == "" {
+		return fmt.Errorf("stop and start are only used together, set both or restart")
+	}
+	return nil
+}
+
+// privilegeCommands may run a whitelisted command as another user
+var privilegeCommands = []string{
+	"/bin/sudo",
+	"/usr/bin/sudo",
+	"/opt/bin/sudo",
+	"/bin/doas",
+	"/usr/bin/doas",
+	"/opt/bin/doas",
+}
+
+// validateServiceCommand checks a command that controls the xray service: an
+// absolute path from the whitelist, optionally run through sudo or doas with options
+func validateServiceCommand(name, command string) error {
 	dangerousChars := []string{";", "&", "|", "`", "$", "(", ")", "<", ">", "\"", "'", "\\"}
 	for _, char := range dangerousChars {
-		if strings.Contains(c.XrayRestartCommand, char) {
-			return fmt.Errorf("xray_restart_command contains potentially dangerous character: %s", char)
+		if strings.Contains(command, char) {
+			return fmt.Errorf("%s contains potentially dangerous character: %s", name, char)
 		}
 	}
 
-	parts := strings.Fields(c.XrayRestartCommand)
+	parts := strings.Fields(command)
 	if len(parts) == 0 {
-		return fmt.Errorf("xray_restart_command cannot be empty")
+		return fmt.Errorf("%s cannot be empty", name)
 	}
 
-	if !strings.HasPrefix(parts[0], "/") {
-		return fmt.Errorf("xray_restart_command must start with an absolute path")
+	if len(command) > 256 {
+		return fmt.Errorf("%s too long (max 256 characters)", name)
+	}
+
+	if slices.Contains(privilegeCommands, parts[0]) {
+		parts = parts[1:]
+		// Options of sudo and doas, such as -n or -u root
+		for len(parts) > 0 && strings.HasPrefix(parts[0], "-") {
+			if (parts[0] == "-u" || parts[0] == "-C") && len(parts) > 1 {
+				parts = parts[1:]
+			}
+			parts = parts[1:]
+		}
+		if len(parts) == 0 {
+			return fmt.Errorf("%s has no command after sudo or doas", name)
+		}
 	}
 
-	if len(c.XrayRestartCommand) > 256 {
-		return fmt.Errorf("xray_restart_command too long (max 256 characters)")
+	if !strings.HasPrefix(parts[0], "/") {
+		return fmt.Errorf("%s must start with an absolute path", name)
 	}
 
 	allowedCommands := []string{
@@ -281,6 +1501,8 @@ func (c *Config) validateCommand() error {
 		"/sbin/service",
 		"/usr/sbin/service",
 		"/etc/init.d/xray",
+		"/bin/ndmq",
+		"/opt/bin/ndmq",
 		"/bin/echo",
 		"/usr/bin/echo",
 	}
@@ -294,7 +1516,7 @@ func (c *Config) validateCommand() error {
 	}
 
 	if !commandAllowed {
-		return fmt.Errorf("xray_restart_command uses non-whitelisted command: %s", parts[0])
+		return fmt.Errorf("%s uses non-whitelisted command: %s", name, parts[0])
 	}
 
 	return nil
@@ -305,12 +1527,24 @@ func CreateTemplate(path string) error {
 		AdminID:             0,
 		BotToken:            "your_bot_token_here",
 		ConfigPath:          "/opt/etc/xray/configs/04_outbounds.json",
+		XrayLayout:          XrayLayoutAuto,
 		SubscriptionURL:     "https://example.com/config.txt",
 		LogLevel:            "info",
 		XrayRestartCommand:  "/opt/etc/init.d/S24xray restart",
 		CacheDuration:       3600,
 		HealthCheckInterval: 300,
+		AvailabilityCheck:   1800,
 		PingTimeout:         5,
+		PingMode:            PingModeTCP,
+		IPFamily:            IPFamilyAuto,
+		SwitchFallback:      SwitchFallbackOffer,
+		DNS:                 DNS{Mode: DNSModeSystem, CacheSeconds: 300},
+		PingProfiles: PingProfiles{
+			Quick:    PingProfile{Mode: PingModeTCP, TimeoutSeconds: 2, Concurrency: 10, MaxServers: 50},
+			Thorough: PingProfile{Mode: PingModeHandshake, TimeoutSeconds: 10, Retries: 2, Concurrency: 3},
+		},
+		QuotaWarningPercent: 10,
+		ExpiryReminderDays:  []int{7, 3, 1},
 		UI: UIConfig{
 			MaxButtonTextLength:       50,
 			ServersPerPage:            32,
@@ -318,12 +1552,62 @@ func CreateTemplate(path string) error {
 			MessageTimeoutMinutes:     60,
 			EnableNameOptimization:    true,
 			NameOptimizationThreshold: 0.7,
+			SkipSwitchConfirmation:    false,
+			ShowNotesInList:           false,
+			QuickSelectWeights:        QuickSelectWeights{Latency: 0.5, Throughput: 0.3, Stability: 0.2},
 		},
 		Update: UpdateConfig{
 			ScriptURL:      "https://raw.githubusercontent.com/ad/xray-subscription-telegram-manager-for-keenetic/main/scripts/update.sh",
 			TimeoutMinutes: 10,
 			BackupConfig:   false,
 		},
+		Group: GroupConfig{
+			AllowedChatIDs: []int64{},
+			DefaultRole:    RoleViewer,
+			Roles:          map[int64]string{},
+		},
+		QuietHours: QuietHours{
+			Enabled: false,
+			Start:   "23:00",
+			End:     "07:00",
+		},
+		DailyDigest: DailyDigest{
+			Enabled: false,
+			Time:    "09:00",
+		},
+		Security: Security{
+			MaxAttempts:   5,
+			WindowMinutes: 10,
+			BanMinutes:    60,
+		},
+		Outbound: Outbound{
+			MuxConcurrency:   8,
+			FragmentPackets:  "tlshello",
+			FragmentLength:   "100-200",
+			FragmentInterval: "10-20",
+		},
+		Memory: Memory{
+			PingHistorySize:  20,
+			MaxStatsInMemory: 200,
+		},
+		Timeouts: Timeouts{
+			LoadSeconds:    60,
+			SwitchSeconds:  90,
+			RestartSeconds: 30,
+			CommandSeconds: 15,
+		},
+		Web: Web{
+			Listen: ":8088",
+		},
+		Hooks: Hooks{
+			TimeoutSeconds: 30,
+		},
+		RouterStatus: RouterStatus{
+			SyslogTag: "xray-manager",
+		},
+		Background: Background{
+			Concurrency: DefaultPingConcurrency,
+		},
 	}
 
 	data, err := json.MarshalIndent(template, "", "    ")
@@ -331,7 +1615,8 @@ func CreateTemplate(path string) error {
 		return fmt.Errorf("failed to marshal template config: %w", err)
 	}
 
-	if err := os.WriteFile(path, data, 0644); err != nil {
+	// The bot token is filled in here, keep the file private from the start
+	if err := fsutil.WritePrivate(path, data); err != nil {
 		return fmt.Errorf("failed to write template config file: %w", err)
 	}
 
@@ -349,6 +1634,11 @@ func LoadConfigOrCreateTemplate(path string) (*Config, error) {
 	return LoadConfig(path)
 }
 
+// GetConfigFilePath returns the path of the manager config file
+func (c *Config) GetConfigFilePath() string {
+	return c.filePath
+}
+
 func (c *Config) GetAdminID() int64 {
 	return c.AdminID
 }
@@ -365,6 +1655,105 @@ func (c *Config) GetUIConfig() UIConfig {
 	return c.UI
 }
 
+func (c *Config) GetPingProfiles() PingProfiles {
+	return c.PingProfiles
+}
+
+func (c *Config) GetGroupConfig() GroupConfig {
+	return c.Group
+}
+
+func (c *Config) GetQuietHours() QuietHours {
+	return c.QuietHours
+}
+
+func (c *Config) GetDailyDigest() DailyDigest {
+	return c.DailyDigest
+}
+
+func (c *Config) GetWeb() Web {
+	return c.Web
+}
+
+// GetDev returns the development mode settings, the sandbox is an absolute path
+func (c *Config) GetDev() Dev {
+	return c.Dev
+}
+
+// GetSubscriptionRetry returns how failed subscription loads are retried
+func (c *Config) GetSubscriptionRetry() LoadRetry {
+	return c.SubscriptionRetry
+}
+
+// GetLatencyAlert returns when degraded latency of the active server is alerted
+func (c *Config) GetLatencyAlert() LatencyAlert {
+	return c.LatencyAlert
+}
+
+// GetBackground returns the limits of the background jobs
+func (c *Config) GetBackground() Background {
+	return c.Background
+}
+
+// GetRouterStatus returns how the VPN state is shown on the router
+func (c *Config) GetRouterStatus() RouterStatus {
+	return c.RouterStatus
+}
+
+// GetMQTT returns the broker the state of the VPN is published to
+func (c *Config) GetMQTT() MQTT {
+	return c.MQTT
+}
+
+// GetFallbackNotifier returns the second channel for critical alerts
+func (c *Config) GetFallbackNotifier() Fallback {
+	return c.FallbackNotifier
+}
+
+// GetHooks returns the scripts run on events of the manager
+func (c *Config) GetHooks() Hooks {
+	return c.Hooks
+}
+
+func (c *Config) GetSecurity() Security {
+	return c.Security
+}
+
+// GetNotificationChats returns the chats that receive notices about the VPN without any control
+func (c *Config) GetNotificationChats() []int64 {
+	return c.NotificationChats
+}
+
+// GetSwitchFallback returns what happens when switching to the chosen server fails
+// countryCodeRegex matches an ISO 3166 country code, the flag emoji in server names
+// stand for these
+var countryCodeRegex = regexp.MustCompile(`^[A-Za-z]{2}$`)
+
+// IsCountryBlocked reports whether the two-letter country code is in blocked_countries
+func (c *Config) IsCountryBlocked(code string) bool {
+	for _, blocked := range c.BlockedCountries {
+		if strings.EqualFold(blocked, code) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) GetSwitchFallback() string {
+	return c.SwitchFallback
+}
+
+// GetSwitchComparison reports whether a switch measures the connection through the
+// previous and the new server to compare them
+func (c *Config) GetSwitchComparison() bool {
+	return !c.SkipSwitchComparison
+}
+
+// GetHTTPProxy returns the proxy for outgoing HTTP requests, empty for none
+func (c *Config) GetHTTPProxy() string {
+	return c.HTTPProxy
+}
+
 func (c *Config) GetMaxButtonTextLength() int {
 	return c.UI.MaxButtonTextLength
 }
@@ -422,6 +1811,18 @@ func (c *Config) validateUI() error {
 		return fmt.Errorf("name_optimization_threshold must be between 0 and 1")
 	}
 
+	weights := c.UI.QuickSelectWeights
+	if weights.Latency < 0 || weights.Throughput < 0 || weights.Stability < 0 {
+		return fmt.Errorf("quick_select_weights cannot be negative")
+	}
+
+	if c.UI.ProgressPercentStep < -1 || c.UI.ProgressPercentStep > 100 {
+		return fmt.Errorf("progress_percent_step must be between 1 and 100, or -1 to turn it off")
+	}
+	if c.UI.ProgressServerStep < -1 {
+		return fmt.Errorf("progress_server_step must be positive, or -1 to turn it off")
+	}
+
 	return nil
 }
 
@@ -451,5 +1852,74 @@ func (c *Config) validateUpdate() error {
 		return fmt.Errorf("update timeout_minutes cannot exceed 60 minutes")
 	}
 
+	if c.Update.MaxDownloadKBps < 0 {
+		return fmt.Errorf("update max_download_kbps cannot be negative")
+	} else if c.Update.MaxDownloadKBps > 0 && c.Update.MaxDownloadKBps < 8 {
+		return fmt.Errorf("update max_download_kbps must be at least 8, 0 disables the cap")
+	}
+
 	return nil
 }
+
+func (c *Config) validateGroup() error {
+	for _, chatID := range c.Group.AllowedChatIDs {
+		if chatID >= 0 {
+			return fmt.Errorf("allowed_chat_ids must contain group chat IDs (negative numbers), got %d", chatID)
+		}
+	}
+
+	// Notification chats only receive notices, a chat cannot be both
+	for _, chatID := range c.NotificationChats {
+		if chatID == 0 || chatID == c.AdminID {
+			return fmt.Errorf("notification_chats must contain chat IDs other than admin_id, got %d", chatID)
+		}
+		if slices.Contains(c.Group.AllowedChatIDs, chatID) {
+			return fmt.Errorf("chat %d is in both allowed_chat_ids and notification_chats", chatID)
+		}
+	}
+
+	if c.Group.StatusTopicID < 0 || c.Group.AlertsTopicID < 0 {
+		return fmt.Errorf("topic IDs must be non-negative")
+	}
+
+	if !isValidRole(c.Group.DefaultRole) {
+		return fmt.Errorf("default_role must be one of: %s, %s, %s", RoleAdmin, RoleOperator, RoleViewer)
+	}
+	for userID, role := range c.Group.Roles {
+		if !isValidRole(role) {
+			return fmt.Errorf("role %q for user %d must be one of: %s, %s, %s", role, userID, RoleAdmin, RoleOperator, RoleViewer)
+		}
+	}
+
+	return nil
+}
+
+var rangeRegex = regexp.MustCompile(`^\d+(-\d+)?$`)
+
+func (c *Config) validateOutbound() error {
+	if c.Outbound.MuxConcurrency < 1 || c.Outbound.MuxConcurrency > 1024 {
+		return fmt.Errorf("mux_concurrency must be between 1 and 1024")
+	}
+	if c.Outbound.FragmentPackets != "tlshello" && !rangeRegex.MatchString(c.Outbound.FragmentPackets) {
+		return fmt.Errorf("fragment_packets must be \"tlshello\" or a range like \"1-3\"")
+	}
+	if !rangeRegex.MatchString(c.Outbound.FragmentLength) {
+		return fmt.Errorf("fragment_length must be a range like \"100-200\"")
+	}
+	if !rangeRegex.MatchString(c.Outbound.FragmentInterval) {
+		return fmt.Errorf("fragment_interval must be a range like \"10-20\"")
+	}
+	for key, value := range c.Outbound.Extra {
+		if !slices.Contains(outboundExtraKeys, key) {
+			return fmt.Errorf("extra may only contain %s, got %q", strings.Join(outboundExtraKeys, " and "), key)
+		}
+		if _, ok := value.(map[string]interface{}); !ok {
+			return fmt.Errorf("extra.%s must be an object", key)
+		}
+	}
+	return nil
+}
+
+func isValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleOperator || role == RoleViewer
+}
@@ -1,8 +1,832 @@
 package config
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestConfigBasic(t *testing.T) {
 	// Простой тест существования пакета
 	t.Log("Config package test passed")
 }
+
+func writeTestFile(t *testing.T, path, content string, perm os.FileMode) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), perm); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatalf("Failed to chmod %s: %v", path, err)
+	}
+}
+
+func TestLoadConfigSecretsPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	writeTestFile(t, configPath, `{
+		"admin_id": 1,
+		"bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa",
+		"subscription_url": "https://example.com/config.txt",
+		"secrets_file": "secrets.json"
+	}`, 0644)
+	writeTestFile(t, filepath.Join(dir, "secrets.json"), `{"bot_token": "22222222:file-token-bbbbbbbbbbbbbbbbbb", "admin_id": 2}`, 0600)
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.BotToken != "22222222:file-token-bbbbbbbbbbbbbbbbbb" || cfg.AdminID != 2 {
+		t.Errorf("Expected secrets file values, got %s/%d", cfg.BotToken, cfg.AdminID)
+	}
+	if cfg.SecretSource("bot_token") != SourceSecretsFile {
+		t.Errorf("Expected bot_token source %s, got %s", SourceSecretsFile, cfg.SecretSource("bot_token"))
+	}
+
+	t.Setenv(EnvBotToken, "33333333:env-token-cccccccccccccccccc")
+	t.Setenv(EnvAdminID, "3")
+	cfg, err = LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.BotToken != "33333333:env-token-cccccccccccccccccc" || cfg.AdminID != 3 {
+		t.Errorf("Expected environment values, got %s/%d", cfg.BotToken, cfg.AdminID)
+	}
+	if cfg.SecretSource("admin_id") != SourceEnv {
+		t.Errorf("Expected admin_id source %s, got %s", SourceEnv, cfg.SecretSource("admin_id"))
+	}
+}
+
+func TestLoadConfigRejectsOpenSecretsFile(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	writeTestFile(t, configPath, `{
+		"subscription_url": "https://example.com/config.txt",
+		"secrets_file": "secrets.json"
+	}`, 0644)
+	writeTestFile(t, filepath.Join(dir, "secrets.json"), `{"bot_token": "22222222:file-token-bbbbbbbbbbbbbbbbbb", "admin_id": 2}`, 0644)
+
+	if _, err := LoadConfig(configPath); err == nil || !strings.Contains(err.Error(), "chmod 600") {
+		t.Errorf("Expected permissions error, got %v", err)
+	}
+}
+
+func TestLoadConfigMergesFragments(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	writeTestFile(t, configPath, `{
+		"subscription_url": "https://example.com/config.txt",
+		"ping_timeout": 5,
+		"ui": {"servers_per_page": 8, "max_quick_select_servers": 4},
+		"notification_chats": [-1001]
+	}`, 0644)
+	if err := os.Mkdir(filepath.Join(dir, FragmentsDir), 0755); err != nil {
+		t.Fatalf("Failed to create fragments directory: %v", err)
+	}
+	writeTestFile(t, filepath.Join(dir, FragmentsDir, "10-secrets.json"), `{"bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "admin_id": 1002003004005}`, 0600)
+	writeTestFile(t, filepath.Join(dir, FragmentsDir, "20-tuning.json"), `{"ping_timeout": 3, "ui": {"servers_per_page": 12}, "notification_chats": [-1002]}`, 0644)
+	writeTestFile(t, filepath.Join(dir, FragmentsDir, OverridesFragment), `{"ping_timeout": 4}`, 0644)
+	writeTestFile(t, filepath.Join(dir, FragmentsDir, "notes.txt"), `not a fragment`, 0644)
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.AdminID != 1002003004005 || cfg.BotToken != "11111111:config-token-aaaaaaaaaaaaaaaa" {
+		t.Errorf("Expected the secrets of the fragment, got %d/%s", cfg.AdminID, cfg.BotToken)
+	}
+	if cfg.PingTimeout != 4 {
+		t.Errorf("Expected the last fragment to win, got ping_timeout %d", cfg.PingTimeout)
+	}
+	if cfg.UI.ServersPerPage != 12 || cfg.UI.MaxQuickSelectServers != 4 {
+		t.Errorf("Expected objects to be merged key by key, got %+v", cfg.UI)
+	}
+	if len(cfg.NotificationChats) != 1 || cfg.NotificationChats[0] != -1002 {
+		t.Errorf("Expected lists to be replaced, got %v", cfg.NotificationChats)
+	}
+	if fragments := cfg.Fragments(); len(fragments) != 3 || filepath.Base(fragments[2]) != OverridesFragment {
+		t.Errorf("Expected three fragments in lexical order, got %v", fragments)
+	}
+
+	writeTestFile(t, filepath.Join(dir, FragmentsDir, "30-broken.json"), `{"ping_timeout": `, 0644)
+	if _, err := LoadConfig(configPath); err == nil || !strings.Contains(err.Error(), "30-broken.json") {
+		t.Errorf("Expected an error naming the broken fragment, got %v", err)
+	}
+}
+
+func TestLoadConfigDevMode(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	writeTestFile(t, configPath, `{
+		"admin_id": 1,
+		"bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa",
+		"subscription_url": "http://127.0.0.1:8000/subscription.txt",
+		"xray_api": "127.0.0.1:10085",
+		"dev": {"enabled": true, "pings": [{"match": "Amsterdam", "latency_ms": [40, 0]}]}
+	}`, 0600)
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	sandbox := filepath.Join(dir, "dev")
+	if cfg.GetDev().SandboxDir != sandbox || cfg.ConfigPath != filepath.Join(sandbox, devOutboundsFile) {
+		t.Errorf("Expected the xray config in the sandbox %s, got %s", sandbox, cfg.ConfigPath)
+	}
+	if cfg.XrayAPI != "" || cfg.XrayLogPath != filepath.Join(sandbox, devXrayLogFile) {
+		t.Errorf("Expected the xray API off and the log in the sandbox, got %q and %s", cfg.XrayAPI, cfg.XrayLogPath)
+	}
+
+	writeTestFile(t, configPath, `{
+		"admin_id": 1,
+		"bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa",
+		"subscription_url": "http://127.0.0.1:8000/subscription.txt",
+		"dev": {"enabled": true, "pings": [{"match": "Amsterdam", "latency_ms": []}]}
+	}`, 0600)
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Error("Expected validation error for a ping rule without latencies")
+	}
+}
+
+func TestSaveOverrides(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	base := `{"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"}`
+	writeTestFile(t, configPath, base, 0600)
+
+	cfg, err := SaveOverrides(configPath, map[string]interface{}{"outbound.mux": true})
+	if err != nil {
+		t.Fatalf("SaveOverrides failed: %v", err)
+	}
+	if !cfg.Outbound.Mux {
+		t.Error("Expected the returned config to have the override")
+	}
+	if _, err := SaveOverrides(configPath, map[string]interface{}{"outbound.fragment": true}); err != nil {
+		t.Fatalf("SaveOverrides failed: %v", err)
+	}
+	if _, err := SaveOverrides(configPath, map[string]interface{}{"ping_timeout": 0.5}); err == nil {
+		t.Error("Expected an invalid override to be rejected")
+	}
+
+	if data, _ := os.ReadFile(configPath); string(data) != base {
+		t.Errorf("Expected the base config to stay unchanged, got %s", data)
+	}
+	cfg, err = LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if !cfg.Outbound.Mux || !cfg.Outbound.Fragment {
+		t.Errorf("Expected both overrides to be kept, got %+v", cfg.Outbound)
+	}
+}
+
+func TestRedactToken(t *testing.T) {
+	if got := RedactToken("123456:ABC-secret"); got != "123456:***" {
+		t.Errorf("Expected '123456:***', got '%s'", got)
+	}
+	if got := RedactToken("no-colon-token"); got != "***" {
+		t.Errorf("Expected '***', got '%s'", got)
+	}
+}
+
+func TestParseConfigGroup(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`, "group": {"allowed_chat_ids": [-1001234567890], "roles": {"42": "operator"}}}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.Group.DefaultRole != RoleViewer {
+		t.Errorf("Expected default role %s, got %s", RoleViewer, cfg.Group.DefaultRole)
+	}
+	if cfg.Group.Roles[42] != RoleOperator {
+		t.Errorf("Expected role %s for user 42, got %q", RoleOperator, cfg.Group.Roles[42])
+	}
+
+	invalid := []string{
+		`"group": {"allowed_chat_ids": [12345]}`,
+		`"group": {"default_role": "owner"}`,
+		`"group": {"roles": {"42": "root"}}`,
+	}
+	for _, group := range invalid {
+		if _, err := ParseConfig([]byte(`{`+base+`, `+group+`}`), "config.json"); err == nil {
+			t.Errorf("Expected validation error for %s", group)
+		}
+	}
+}
+
+func TestParseConfigQuietHours(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.QuietHours.Window() != nil {
+		t.Error("Expected quiet hours to be disabled by default")
+	}
+
+	cfg, err = ParseConfig([]byte(`{`+base+`, "quiet_hours": {"enabled": true, "start": "22:30"}}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if window := cfg.QuietHours.Window(); window == nil || window.String() != "22:30-07:00" {
+		t.Errorf("Expected quiet hours 22:30-07:00, got %v", window)
+	}
+
+	if _, err := ParseConfig([]byte(`{`+base+`, "quiet_hours": {"enabled": true, "start": "late"}}`), "config.json"); err == nil {
+		t.Error("Expected validation error for invalid quiet hours start")
+	}
+}
+
+func TestParseConfigDailyDigest(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.DailyDigest.Schedule() != nil {
+		t.Error("Expected the daily digest to be disabled by default")
+	}
+
+	cfg, err = ParseConfig([]byte(`{`+base+`, "daily_digest": {"enabled": true}}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if daily := cfg.DailyDigest.Schedule(); daily == nil || daily.String() != "09:00" {
+		t.Errorf("Expected the daily digest at 09:00, got %v", daily)
+	}
+
+	if _, err := ParseConfig([]byte(`{`+base+`, "daily_digest": {"enabled": true, "time": "morning"}}`), "config.json"); err == nil {
+		t.Error("Expected validation error for invalid daily digest time")
+	}
+}
+
+func TestParseConfigIPFamily(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.IPFamily != IPFamilyAuto {
+		t.Errorf("Expected ip_family %s by default, got %s", IPFamilyAuto, cfg.IPFamily)
+	}
+
+	if _, err := ParseConfig([]byte(`{`+base+`, "ip_family": "ipv6"}`), "config.json"); err != nil {
+		t.Errorf("ParseConfig failed for ipv6: %v", err)
+	}
+	if _, err := ParseConfig([]byte(`{`+base+`, "ip_family": "ipv5"}`), "config.json"); err == nil {
+		t.Error("Expected validation error for unknown ip_family")
+	}
+}
+
+func TestParseConfigSwitchFallback(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.SwitchFallback != SwitchFallbackOffer {
+		t.Errorf("Expected switch_fallback %s by default, got %s", SwitchFallbackOffer, cfg.SwitchFallback)
+	}
+
+	if _, err := ParseConfig([]byte(`{`+base+`, "switch_fallback": "auto"}`), "config.json"); err != nil {
+		t.Errorf("ParseConfig failed for auto: %v", err)
+	}
+	if _, err := ParseConfig([]byte(`{`+base+`, "switch_fallback": "always"}`), "config.json"); err == nil {
+		t.Error("Expected validation error for unknown switch_fallback")
+	}
+
+	if !cfg.GetSwitchComparison() {
+		t.Error("Expected the switch comparison to be on by default")
+	}
+	cfg, err = ParseConfig([]byte(`{`+base+`, "skip_switch_comparison": true}`), "config.json")
+	if err != nil || cfg.GetSwitchComparison() {
+		t.Errorf("Expected skip_switch_comparison to turn the comparison off, got %v", err)
+	}
+}
+
+func TestParseConfigProgressSteps(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.UI.ProgressPercentStep != 10 || cfg.UI.ProgressServerStep != 50 {
+		t.Errorf("Expected progress steps 10%% and 50 servers by default, got %d and %d", cfg.UI.ProgressPercentStep, cfg.UI.ProgressServerStep)
+	}
+
+	cfg, err = ParseConfig([]byte(`{`+base+`, "ui": {"progress_percent_step": -1, "progress_server_step": 100}}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.UI.ProgressPercentStep != -1 || cfg.UI.ProgressServerStep != 100 {
+		t.Errorf("Expected the configured steps, got %d and %d", cfg.UI.ProgressPercentStep, cfg.UI.ProgressServerStep)
+	}
+	if _, err := ParseConfig([]byte(`{`+base+`, "ui": {"progress_percent_step": 150}}`), "config.json"); err == nil {
+		t.Error("Expected validation error for progress_percent_step above 100")
+	}
+	if _, err := ParseConfig([]byte(`{`+base+`, "ui": {"progress_server_step": -5}}`), "config.json"); err == nil {
+		t.Error("Expected validation error for a negative progress_server_step")
+	}
+}
+
+func TestParseConfigOutboundExtra(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`, "outbound": {"extra": {"streamSettings": {"sockopt": {"mark": 255}}}}}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if _, ok := cfg.Outbound.Options().Extra["streamSettings"]; !ok {
+		t.Errorf("Expected streamSettings extra in outbound options, got %+v", cfg.Outbound.Extra)
+	}
+
+	if _, err := ParseConfig([]byte(`{`+base+`, "outbound": {"extra": {"protocol": "freedom"}}}`), "config.json"); err == nil {
+		t.Error("Expected validation error for an unsupported extra key")
+	}
+	if _, err := ParseConfig([]byte(`{`+base+`, "outbound": {"extra": {"mux": true}}}`), "config.json"); err == nil {
+		t.Error("Expected validation error for a non-object extra")
+	}
+}
+
+func TestParseConfigDNS(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.DNS.Mode != DNSModeSystem || cfg.DNS.CacheTTL() != 5*time.Minute {
+		t.Errorf("Expected the system resolver with a 5 minute cache by default, got %+v", cfg.DNS)
+	}
+
+	valid := []string{
+		`{"mode": "udp", "server": "1.1.1.1"}`,
+		`{"mode": "udp", "server": "[2606:4700:4700::1111]:53"}`,
+		`{"mode": "doh", "server": "https://1.1.1.1/dns-query", "pin_address": true}`,
+	}
+	for _, dns := range valid {
+		if _, err := ParseConfig([]byte(`{`+base+`, "dns": `+dns+`}`), "config.json"); err != nil {
+			t.Errorf("Expected %s to be valid, got %v", dns, err)
+		}
+	}
+	invalid := []string{
+		`{"mode": "dot"}`,
+		`{"mode": "udp"}`,
+		`{"mode": "udp", "server": "dns.google"}`,
+		`{"mode": "doh", "server": "1.1.1.1"}`,
+		`{"cache_seconds": -1}`,
+	}
+	for _, dns := range invalid {
+		if _, err := ParseConfig([]byte(`{`+base+`, "dns": `+dns+`}`), "config.json"); err == nil {
+			t.Errorf("Expected validation error for %s", dns)
+		}
+	}
+}
+
+func TestParseConfigPingProfiles(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`, "ping_timeout": 7}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	profiles := cfg.GetPingProfiles()
+	if profiles.Quick.Mode != PingModeTCP || profiles.Quick.Timeout() != 2*time.Second || profiles.Quick.MaxServers != 50 {
+		t.Errorf("Unexpected default quick profile: %+v", profiles.Quick)
+	}
+	if profiles.Thorough.Mode != PingModeHandshake || profiles.Thorough.Retries != 2 || profiles.Thorough.MaxServers != 0 {
+		t.Errorf("Unexpected default thorough profile: %+v", profiles.Thorough)
+	}
+	if _, ok := profiles.Get(PingProfileCustom); ok || len(profiles.Names()) != 2 {
+		t.Errorf("Expected no custom profile by default, got %v", profiles.Names())
+	}
+
+	// Settings left out of a profile are those of the standard test
+	cfg, err = ParseConfig([]byte(`{`+base+`, "ping_timeout": 7, "ping_profiles": {"custom": {"retries": 1, "max_servers": 20}}}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	custom, ok := cfg.GetPingProfiles().Get(PingProfileCustom)
+	if !ok || custom.Mode != PingModeTCP || custom.TimeoutSeconds != 7 || custom.Concurrency != DefaultPingConcurrency || custom.MaxServers != 20 {
+		t.Errorf("Unexpected custom profile: %+v", custom)
+	}
+
+	invalid := []string{
+		`{"quick": {"mode": "icmp"}}`,
+		`{"thorough": {"timeout_seconds": 61}}`,
+		`{"custom": {"retries": 6}}`,
+		`{"custom": {"concurrency": 51}}`,
+		`{"custom": {"max_servers": -1}}`,
+	}
+	for _, profiles := range invalid {
+		if _, err := ParseConfig([]byte(`{`+base+`, "ping_profiles": `+profiles+`}`), "config.json"); err == nil {
+			t.Errorf("Expected validation error for %s", profiles)
+		}
+	}
+}
+
+func TestParseConfigWeb(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`, "web": {"enabled": true, "token": "dashboard-token-123"}}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.GetWeb().Listen != ":8088" {
+		t.Errorf("Expected the default listen address, got %q", cfg.GetWeb().Listen)
+	}
+
+	if _, err := ParseConfig([]byte(`{`+base+`, "web": {"enabled": true, "token": "short"}}`), "config.json"); err == nil {
+		t.Error("Expected validation error for a short token")
+	}
+	if _, err := ParseConfig([]byte(`{`+base+`, "web": {"enabled": true, "listen": "8088", "token": "dashboard-token-123"}}`), "config.json"); err == nil {
+		t.Error("Expected validation error for a listen address without a port separator")
+	}
+	if _, err := ParseConfig([]byte(`{`+base+`, "web": {"token": "short"}}`), "config.json"); err != nil {
+		t.Errorf("Expected a disabled dashboard not to be validated, got %v", err)
+	}
+}
+
+func TestParseConfigHooks(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`, "hooks": {"post_switch": "/opt/etc/xray-manager/hooks/post-switch.sh"}}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.GetHooks().Timeout() != 30*time.Second {
+		t.Errorf("Expected the default hook timeout of 30s, got %s", cfg.GetHooks().Timeout())
+	}
+
+	if _, err := ParseConfig([]byte(`{`+base+`, "hooks": {"pre_switch": "hooks/pre-switch.sh"}}`), "config.json"); err == nil {
+		t.Error("Expected validation error for a relative script path")
+	}
+	if _, err := ParseConfig([]byte(`{`+base+`, "hooks": {"timeout_seconds": 3600}}`), "config.json"); err == nil {
+		t.Error("Expected validation error for a too long timeout")
+	}
+}
+
+func TestParseConfigRouterStatus(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.GetRouterStatus().Enabled() || cfg.GetRouterStatus().SyslogTag != "xray-manager" {
+		t.Errorf("Expected router status off with the default tag, got %+v", cfg.GetRouterStatus())
+	}
+
+	cfg, err = ParseConfig([]byte(`{`+base+`, "router_status": {"led_down_command": "ndmc -c 'system led off'"}}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if !cfg.GetRouterStatus().Enabled() {
+		t.Error("Expected an LED command to enable the router status")
+	}
+
+	if _, err := ParseConfig([]byte(`{`+base+`, "router_status": {"syslog": true, "syslog_tag": "xray manager"}}`), "config.json"); err == nil {
+		t.Error("Expected validation error for a tag with a space")
+	}
+}
+
+func TestParseConfigBackground(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if background := cfg.GetBackground(); background.Concurrency != DefaultPingConcurrency || background.BatchPause() != 0 || background.MaxLoad != 0 {
+		t.Errorf("Expected background jobs without limits by default, got %+v", background)
+	}
+
+	cfg, err = ParseConfig([]byte(`{`+base+`, "background": {"concurrency": 2, "batch_pause_ms": 500, "max_load": 1.5}}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if background := cfg.GetBackground(); background.Concurrency != 2 || background.BatchPause() != 500*time.Millisecond || background.MaxLoad != 1.5 {
+		t.Errorf("Unexpected background limits: %+v", background)
+	}
+
+	for _, invalid := range []string{`{"concurrency": 51}`, `{"batch_pause_ms": 60000}`, `{"max_load": -1}`} {
+		if _, err := ParseConfig([]byte(`{`+base+`, "background": `+invalid+`}`), "config.json"); err == nil {
+			t.Errorf("Expected validation error for %s", invalid)
+		}
+	}
+}
+
+func TestParseConfigSubscriptionRetry(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if retry := cfg.GetSubscriptionRetry(); retry.MaxAttempts != 5 || retry.InitialDelay() != time.Minute || retry.MaxDelay() != 30*time.Minute {
+		t.Errorf("Unexpected default retries: %+v", retry)
+	}
+
+	cfg, err = ParseConfig([]byte(`{`+base+`, "subscription_retry": {"max_attempts": -1}}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if retry := cfg.GetSubscriptionRetry(); retry.MaxAttempts != -1 {
+		t.Errorf("Expected -1 to disable retries, got %+v", retry)
+	}
+
+	for _, invalid := range []string{`{"max_attempts": 21}`, `{"initial_delay_seconds": 5}`, `{"initial_delay_seconds": 600, "max_delay_seconds": 300}`, `{"max_delay_seconds": 100000}`} {
+		if _, err := ParseConfig([]byte(`{`+base+`, "subscription_retry": `+invalid+`}`), "config.json"); err == nil {
+			t.Errorf("Expected validation error for %s", invalid)
+		}
+	}
+}
+
+func TestParseConfigLatencyAlert(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if alert := cfg.GetLatencyAlert(); !alert.Enabled() || alert.Factor != 3 || alert.Duration() != 10*time.Minute {
+		t.Errorf("Unexpected default latency alert: %+v", alert)
+	}
+
+	cfg, err = ParseConfig([]byte(`{`+base+`, "latency_alert": {"factor": -1}}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.GetLatencyAlert().Enabled() {
+		t.Error("Expected factor -1 to disable the alert")
+	}
+
+	for _, invalid := range []string{`{"factor": 1.2}`, `{"factor": 25}`, `{"duration_minutes": 2000}`} {
+		if _, err := ParseConfig([]byte(`{`+base+`, "latency_alert": `+invalid+`}`), "config.json"); err == nil {
+			t.Errorf("Expected validation error for %s", invalid)
+		}
+	}
+}
+
+func TestParseConfigUpdateDownloadLimit(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`, "update": {"max_download_kbps": 256}}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if limit := cfg.GetUpdateConfig().DownloadLimit(); limit != 256*1024 {
+		t.Errorf("Expected 256 KB/s, got %d bytes/s", limit)
+	}
+
+	for _, invalid := range []string{`{"max_download_kbps": -1}`, `{"max_download_kbps": 4}`} {
+		if _, err := ParseConfig([]byte(`{`+base+`, "update": `+invalid+`}`), "config.json"); err == nil {
+			t.Errorf("Expected validation error for %s", invalid)
+		}
+	}
+}
+
+func TestParseConfigMQTT(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if mqtt := cfg.GetMQTT(); mqtt.Enabled() || mqtt.TopicPrefix != "xray-manager" {
+		t.Errorf("Expected MQTT to be disabled by default, got %+v", mqtt)
+	}
+
+	for broker, expected := range map[string]string{
+		"192.168.1.10":           "192.168.1.10:1883",
+		"broker.lan:1884":        "broker.lan:1884",
+		"tcp://broker.lan":       "broker.lan:1883",
+		"tls://broker.example":   "broker.example:8883",
+		"mqtts://[fd00::1]:9883": "[fd00::1]:9883",
+	} {
+		cfg, err := ParseConfig([]byte(`{`+base+`, "mqtt": {"broker": "`+broker+`"}}`), "config.json")
+		if err != nil {
+			t.Fatalf("ParseConfig failed for %s: %v", broker, err)
+		}
+		address, useTLS, err := cfg.GetMQTT().Address()
+		if err != nil || address != expected || useTLS != strings.Contains(broker, "s://") {
+			t.Errorf("Expected %s for %s, got %s (TLS %t, error %v)", expected, broker, address, useTLS, err)
+		}
+	}
+
+	for _, invalid := range []string{
+		`{"broker": "ws://broker.lan"}`,
+		`{"broker": "broker.lan:0"}`,
+		`{"broker": "broker.lan", "topic_prefix": "home/#"}`,
+		`{"broker": "broker.lan", "topic_prefix": "home/"}`,
+		`{"broker": "broker.lan", "password": "secret"}`,
+	} {
+		if _, err := ParseConfig([]byte(`{`+base+`, "mqtt": `+invalid+`}`), "config.json"); err == nil {
+			t.Errorf("Expected validation error for %s", invalid)
+		}
+	}
+}
+
+func TestParseConfigFallbackNotifier(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if fallback := cfg.GetFallbackNotifier(); fallback.Enabled() || fallback.Always {
+		t.Errorf("Expected no fallback notifier by default, got %+v", fallback)
+	}
+
+	cfg, err = ParseConfig([]byte(`{`+base+`, "fallback_notifier": {"type": "smtp", "smtp": {
+		"host": "smtp.example.com", "username": "bot", "password": "secret",
+		"from": "Router <bot@example.com>", "to": ["admin@example.com"]}}}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if fallback := cfg.GetFallbackNotifier(); !fallback.Enabled() || fallback.SMTP.Port != 587 {
+		t.Errorf("Expected smtp on port 587, got %+v", fallback)
+	}
+
+	for _, valid := range []string{
+		`{"type": "ntfy", "url": "https://ntfy.sh/my-router", "always": true}`,
+		`{"type": "webhook", "url": "http://192.168.1.20:8123/api/webhook/vpn", "token": "abc"}`,
+	} {
+		if _, err := ParseConfig([]byte(`{`+base+`, "fallback_notifier": `+valid+`}`), "config.json"); err != nil {
+			t.Errorf("Expected %s to be valid, got %v", valid, err)
+		}
+	}
+
+	for _, invalid := range []string{
+		`{"type": "telegram"}`,
+		`{"type": "ntfy"}`,
+		`{"type": "webhook", "url": "ftp://example.com/hook"}`,
+		`{"type": "smtp", "smtp": {"host": "smtp.example.com", "from": "bot@example.com"}}`,
+		`{"type": "smtp", "smtp": {"host": "smtp.example.com", "from": "bot", "to": ["admin@example.com"]}}`,
+		`{"type": "smtp", "smtp": {"host": "smtp.example.com", "port": 70000, "from": "bot@example.com", "to": ["admin@example.com"]}}`,
+		`{"type": "smtp", "smtp": {"host": "smtp.example.com", "password": "secret", "from": "bot@example.com", "to": ["admin@example.com"]}}`,
+	} {
+		if _, err := ParseConfig([]byte(`{`+base+`, "fallback_notifier": `+invalid+`}`), "config.json"); err == nil {
+			t.Errorf("Expected validation error for %s", invalid)
+		}
+	}
+}
+
+func TestParseConfigExpiryReminders(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if len(cfg.ExpiryReminderDays) != 3 {
+		t.Errorf("Expected default reminders, got %v", cfg.ExpiryReminderDays)
+	}
+
+	cfg, err = ParseConfig([]byte(`{`+base+`, "expiry_reminder_days": []}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if len(cfg.ExpiryReminderDays) != 0 {
+		t.Errorf("Expected an empty list to disable reminders, got %v", cfg.ExpiryReminderDays)
+	}
+
+	if _, err := ParseConfig([]byte(`{`+base+`, "expiry_reminder_days": [3, 0]}`), "config.json"); err == nil {
+		t.Error("Expected validation error for a zero reminder day")
+	}
+}
+
+func TestParseConfigNotificationChats(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`, "notification_chats": [-100200, 42]}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if len(cfg.GetNotificationChats()) != 2 {
+		t.Errorf("Expected 2 notification chats, got %v", cfg.GetNotificationChats())
+	}
+
+	invalid := []string{
+		`"notification_chats": [1]`,
+		`"notification_chats": [-100200], "group": {"allowed_chat_ids": [-100200]}`,
+	}
+	for _, chats := range invalid {
+		if _, err := ParseConfig([]byte(`{`+base+`, `+chats+`}`), "config.json"); err == nil {
+			t.Errorf("Expected validation error for %s", chats)
+		}
+	}
+}
+
+func TestParseConfigXrayCommands(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	valid := []string{
+		`"xray_commands": {"restart": "/usr/bin/sudo -n /opt/etc/init.d/S24xray restart", "status": "/opt/etc/init.d/S24xray status"}`,
+		`"xray_commands": {"stop": "/opt/bin/doas -u root /opt/etc/init.d/S24xray stop", "start": "/opt/bin/doas -u root /opt/etc/init.d/S24xray start"}`,
+		`"xray_restart_command": "/usr/bin/sudo /opt/etc/init.d/S24xray restart"`,
+	}
+	for _, commands := range valid {
+		if _, err := ParseConfig([]byte(`{`+base+`, `+commands+`}`), "config.json"); err != nil {
+			t.Errorf("ParseConfig failed for %s: %v", commands, err)
+		}
+	}
+
+	invalid := []string{
+		`"xray_commands": {"stop": "/opt/etc/init.d/S24xray stop"}`,
+		`"xray_commands": {"status": "/usr/bin/sudo /bin/sh -c id"}`,
+		`"xray_commands": {"restart": "/usr/bin/sudo -n"}`,
+		`"xray_restart_command": "/usr/bin/sudo rm -rf /"`,
+	}
+	for _, commands := range invalid {
+		if _, err := ParseConfig([]byte(`{`+base+`, `+commands+`}`), "config.json"); err == nil {
+			t.Errorf("Expected validation error for %s", commands)
+		}
+	}
+}
+
+func TestSetupRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	writeTestFile(t, configPath, `{"bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "log_level": "debug"}`, 0600)
+
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Fatal("Expected incomplete config to fail validation")
+	}
+	cfg, err := LoadForSetup(configPath)
+	if err != nil {
+		t.Fatalf("LoadForSetup failed: %v", err)
+	}
+	if !cfg.NeedsSetup() {
+		t.Error("Expected config without admin_id and subscription_url to need setup")
+	}
+
+	if err := ValidateSubscriptionURL("ftp://example.com/sub"); err == nil {
+		t.Error("Expected non-http subscription URL to be rejected")
+	}
+	if err := ValidateConfigPath("configs/04_outbounds.json"); err == nil {
+		t.Error("Expected relative config path to be rejected")
+	}
+
+	saved, err := SaveSetup(configPath, SetupValues{
+		AdminID:         42,
+		SubscriptionURL: "https://example.com/sub",
+		PingMode:        PingModeHandshake,
+	})
+	if err != nil {
+		t.Fatalf("SaveSetup failed: %v", err)
+	}
+	if saved.NeedsSetup() || saved.PingMode != PingModeHandshake {
+		t.Errorf("Unexpected saved config: admin %d, subscription %q, ping mode %s", saved.AdminID, saved.SubscriptionURL, saved.PingMode)
+	}
+
+	reloaded, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("Saved config does not load: %v", err)
+	}
+	if reloaded.AdminID != 42 || reloaded.LogLevel != "debug" {
+		t.Errorf("Expected admin 42 and kept log level, got %d and %s", reloaded.AdminID, reloaded.LogLevel)
+	}
+	if info, _ := os.Stat(configPath); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected config permissions 0600, got %04o", info.Mode().Perm())
+	}
+}
+
+func TestValidateSubscriptionURLRegisteredSchemes(t *testing.T) {
+	if err := ValidateSubscriptionURL("/opt/etc/xray-manager/servers.txt"); err == nil {
+		t.Error("Expected a local path to be rejected without a file source")
+	}
+	RegisterSubscriptionScheme("file")
+	for _, valid := range []string{"/opt/etc/xray-manager/servers.txt", "file:///opt/etc/xray-manager/servers.txt", "https://example.com/sub"} {
+		if err := ValidateSubscriptionURL(valid); err != nil {
+			t.Errorf("Expected %q to be accepted, got %v", valid, err)
+		}
+	}
+	if err := ValidateSubscriptionURL("servers.txt"); err == nil {
+		t.Error("Expected a relative path to be rejected")
+	}
+}
+
+func TestParseConfigBlockedCountries(t *testing.T) {
+	base := `"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"`
+
+	cfg, err := ParseConfig([]byte(`{`+base+`, "blocked_countries": ["ru", "BY"]}`), "config.json")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if !cfg.IsCountryBlocked("RU") || !cfg.IsCountryBlocked("by") || cfg.IsCountryBlocked("DE") {
+		t.Errorf("Unexpected blocked countries for %v", cfg.BlockedCountries)
+	}
+
+	if _, err := ParseConfig([]byte(`{`+base+`, "blocked_countries": ["Russia"]}`), "config.json"); err == nil {
+		t.Error("Expected a country name instead of a code to be rejected")
+	}
+}
@@ -0,0 +1,4 @@
+// Package config loads, validates and saves the manager config. The other
+// packages take their settings from *Config, so tools embedding the server
+// package load it with LoadConfig or build it and call SetDefaults.
+package config
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"xray-telegram-manager/fsutil"
+)
+
+const (
+	// FragmentsDir is the directory next to config.json whose *.json files are merged
+	// into the config, e.g. to keep secrets apart from the tunables
+	FragmentsDir = "config.d"
+	// OverridesFragment is the fragment settings changed in Telegram are written to,
+	// it sorts after the usual fragment names so the changes win
+	OverridesFragment = "99-overrides.json"
+)
+
+// fragmentsDir returns the fragments directory of the config file at path
+func fragmentsDir(path string) string {
+	return filepath.Join(filepath.Dir(path), FragmentsDir)
+}
+
+// OverridesPath returns the overrides fragment of the config file at path
+func OverridesPath(path string) string {
+	return filepath.Join(fragmentsDir(path), OverridesFragment)
+}
+
+// ReadFragments returns the *.json fragments of the config file at path by name. A
+// missing directory gives no fragments.
+func ReadFragments(path string) (map[string][]byte, error) {
+	dir := fragmentsDir(path)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	fragments := make(map[string][]byte)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config fragment: %w", err)
+		}
+		fragments[entry.Name()] = data
+	}
+	return fragments, nil
+}
+
+// MergeFragments merges fragments by name into the config data of the file at path,
+// the way LoadConfig merges the files of config.d. The fragments on disk are not read.
+func MergeFragments(data []byte, path string, fragments map[string][]byte) ([]byte, error) {
+	merged, _, err := mergeFragmentData(data, path, fragments)
+	return merged, err
+}
+
+// mergeFragments merges the fragments of the config file at path into base and
+// returns the result with the merged fragment paths. pending holds fragments by name
+// that are used instead of the files on disk.
+func mergeFragments(base []byte, path string, pending map[string][]byte) ([]byte, []string, error) {
+	fragments, err := ReadFragments(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, data := range pending {
+		fragments[name] = data
+	}
+	return mergeFragmentData(base, path, fragments)
+}
+
+// mergeFragmentData merges fragments into base in lexical order of their names and
+// returns the result with the fragment paths. Objects are merged key by key, any
+// other value of a later fragment replaces the earlier one.
+func mergeFragmentData(base []byte, path string, fragments map[string][]byte) ([]byte, []string, error) {
+	if len(fragments) == 0 {
+		return base, nil, nil
+	}
+	ordered := make([]string, 0, len(fragments))
+	for name := range fragments {
+		ordered = append(ordered, name)
+	}
+	sort.Strings(ordered)
+
+	merged, err := decodeObject(base)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	dir := fragmentsDir(path)
+	var paths []string
+	for _, name := range ordered {
+		fragmentPath := filepath.Join(dir, name)
+		fragment, err := decodeObject(fragments[name])
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse config fragment %s: %w", fragmentPath, err)
+		}
+		mergeObjects(merged, fragment)
+		paths = append(paths, fragmentPath)
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal merged config: %w", err)
+	}
+	return data, paths, nil
+}
+
+// decodeObject parses a JSON object keeping numbers as they are written, so large
+// chat IDs do not lose precision. Empty data is an empty object.
+func decodeObject(data []byte) (map[string]interface{}, error) {
+	object := map[string]interface{}{}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return object, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+	if object == nil {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+	return object, nil
+}
+
+// mergeObjects merges src into dst, objects in both are merged recursively
+func mergeObjects(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcObject, srcIsObject := value.(map[string]interface{})
+		dstObject, dstIsObject := dst[key].(map[string]interface{})
+		if srcIsObject && dstIsObject {
+			mergeObjects(dstObject, srcObject)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+// SaveOverrides sets values in the overrides fragment of the config file at path and
+// returns the resulting config. Keys are dotted paths, e.g. "outbound.mux". The base
+// config file is not changed, the changes are only written when the merged config
+// is valid.
+func SaveOverrides(path string, values map[string]interface{}) (*Config, error) {
+	base, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	overridesPath := OverridesPath(path)
+	current, err := os.ReadFile(overridesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read overrides: %w", err)
+	}
+	overrides, err := decodeObject(current)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse overrides %s: %w", overridesPath, err)
+	}
+	for key, value := range values {
+		setPath(overrides, strings.Split(key, "."), value)
+	}
+	data, err := json.MarshalIndent(overrides, "", "    ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal overrides: %w", err)
+	}
+
+	merged, fragments, err := mergeFragments(base, path, map[string][]byte{OverridesFragment: data})
+	if err != nil {
+		return nil, err
+	}
+	config, err := ParseConfig(merged, path)
+	if err != nil {
+		return nil, err
+	}
+	config.fragments = fragments
+
+	if err := os.MkdirAll(filepath.Dir(overridesPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", FragmentsDir, err)
+	}
+	if err := fsutil.WritePrivate(overridesPath, data); err != nil {
+		return nil, fmt.Errorf("failed to save overrides: %w", err)
+	}
+	return config, nil
+}
+
+// setPath sets value at the dotted path keys, creating the objects on the way
+func setPath(object map[string]interface{}, keys []string, value interface{}) {
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := object[key].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			object[key] = child
+		}
+		object = child
+	}
+	object[keys[len(keys)-1]] = value
+}
+
+// Fragments returns the config fragments merged into the config, in the order they
+// were applied
+func (c *Config) Fragments() []string {
+	return c.fragments
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Environment variables that override sensitive values from config.json and the secrets file
+const (
+	EnvBotToken = "XRAY_MANAGER_BOT_TOKEN"
+	EnvAdminID  = "XRAY_MANAGER_ADMIN_ID"
+)
+
+// Secret sources, reported by SecretSource
+const (
+	SourceConfig      = "config"
+	SourceSecretsFile = "secrets_file"
+	SourceEnv         = "env"
+)
+
+// secretsFile is the format of the file referenced by secrets_file
+type secretsFile struct {
+	BotToken string `json:"bot_token"`
+	AdminID  int64  `json:"admin_id"`
+}
+
+// applySecrets overrides bot_token and admin_id with values from the secrets file and
+// environment. Precedence from highest to lowest: environment, secrets file, config.json.
+func (c *Config) applySecrets(configPath string) error {
+	c.secretSources = map[string]string{}
+	if c.BotToken != "" {
+		c.secretSources["bot_token"] = SourceConfig
+	}
+	if c.AdminID != 0 {
+		c.secretSources["admin_id"] = SourceConfig
+	}
+
+	if c.SecretsFile != "" {
+		secretsPath := c.SecretsFile
+		if !filepath.IsAbs(secretsPath) {
+			secretsPath = filepath.Join(filepath.Dir(configPath), secretsPath)
+		}
+		secrets, err := loadSecretsFile(secretsPath)
+		if err != nil {
+			return err
+		}
+		if secrets.BotToken != "" {
+			c.BotToken = secrets.BotToken
+			c.secretSources["bot_token"] = SourceSecretsFile
+		}
+		if secrets.AdminID != 0 {
+			c.AdminID = secrets.AdminID
+			c.secretSources["admin_id"] = SourceSecretsFile
+		}
+	}
+
+	if token := strings.TrimSpace(os.Getenv(EnvBotToken)); token != "" {
+		c.BotToken = token
+		c.secretSources["bot_token"] = SourceEnv
+	}
+	if value := strings.TrimSpace(os.Getenv(EnvAdminID)); value != "" {
+		adminID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", EnvAdminID, err)
+		}
+		c.AdminID = adminID
+		c.secretSources["admin_id"] = SourceEnv
+	}
+	return nil
+}
+
+// loadSecretsFile reads the secrets file and refuses it when other users can access it
+func loadSecretsFile(path string) (*secretsFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat secrets file: %w", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("secrets file %s has permissions %04o, it must not be accessible by group or others (chmod 600)", path, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets file: %w", err)
+	}
+	var secrets secretsFile
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("failed to parse secrets file: %w", err)
+	}
+	return &secrets, nil
+}
+
+// SecretSource returns where a sensitive value ("bot_token" or "admin_id") was loaded from
+func (c *Config) SecretSource(name string) string {
+	if source, ok := c.secretSources[name]; ok {
+		return source
+	}
+	return SourceConfig
+}
+
+// RedactToken hides the secret part of a bot token, keeping the bot ID for troubleshooting
+func RedactToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	if botID, _, found := strings.Cut(token, ":"); found && botID != "" {
+		return botID + ":***"
+	}
+	return "***"
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"xray-telegram-manager/fsutil"
+)
+
+// SetupValues are the settings collected by the first-run setup wizard
+type SetupValues struct {
+	AdminID         int64
+	SubscriptionURL string
+	ConfigPath      string
+	PingMode        string
+}
+
+// LoadForSetup loads a config that is not complete yet, so the setup wizard can
+// finish it. Only the bot token is required, a missing file counts as empty.
+func LoadForSetup(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		data = []byte("{}")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	data, fragments, err := mergeFragments(data, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if err := config.applySecrets(path); err != nil {
+		return nil, fmt.Errorf("failed to load secrets: %w", err)
+	}
+	config.SetDefaults()
+	if err := config.validateBotToken(); err != nil {
+		return nil, fmt.Errorf("invalid bot_token: %w", err)
+	}
+	config.applyDevMode(path)
+
+	config.filePath = path
+	config.fragments = fragments
+	return &config, nil
+}
+
+// NeedsSetup reports whether the admin or the subscription is not configured yet
+func (c *Config) NeedsSetup() bool {
+	return c.AdminID == 0 || c.SubscriptionURL == ""
+}
+
+// ValidateSubscriptionURL checks a subscription URL entered by the user
+func ValidateSubscriptionURL(rawURL string) error {
+	return (&Config{SubscriptionURL: rawURL}).validateSubscriptionURL()
+}
+
+// ValidateConfigPath checks an xray outbounds config path entered by the user
+func ValidateConfigPath(path string) error {
+	if path == "" {
+		return fmt.Errorf("config_path is required")
+	}
+	return (&Config{ConfigPath: path}).validateConfigPath()
+}
+
+// SaveSetup writes the values collected by the setup wizard into the config file at
+// path and returns the resulting config. Other settings in the file are kept as is and
+// secrets loaded from the environment, the secrets file or fragments are not copied
+// into it.
+func SaveSetup(path string, values SetupValues) (*Config, error) {
+	raw := map[string]interface{}{}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if values.AdminID != 0 {
+		raw["admin_id"] = values.AdminID
+	}
+	raw["subscription_url"] = values.SubscriptionURL
+	if values.ConfigPath != "" {
+		raw["config_path"] = values.ConfigPath
+	}
+	if values.PingMode != "" {
+		raw["ping_mode"] = values.PingMode
+	}
+
+	data, err = json.MarshalIndent(raw, "", "    ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal config: %w", err)
+	}
+	merged, fragments, err := mergeFragments(data, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	config, err := ParseConfig(merged, path)
+	if err != nil {
+		return nil, err
+	}
+	config.fragments = fragments
+
+	// The file may hold the bot token, keep it private
+	if err := fsutil.WritePrivate(path, data); err != nil {
+		return nil, fmt.Errorf("failed to save config file: %w", err)
+	}
+	return config, nil
+}
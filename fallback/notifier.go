@@ -0,0 +1,241 @@
+// Package fallback sends critical alerts over a second channel, ntfy, a webhook or
+// mail, so they reach the admin while Telegram is unreachable or the bot token was
+// revoked.
+package fallback
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/httpclient"
+)
+
+const (
+	// sendTimeout bounds sending one alert
+	sendTimeout = 30 * time.Second
+	// repeatInterval suppresses an alert identical to one sent this recently, so a
+	// flapping check does not flood the mailbox
+	repeatInterval = 15 * time.Minute
+	// source names the sender in webhook payloads and mail
+	source = "xray-telegram-manager"
+)
+
+// Alert is the JSON posted to a webhook
+type Alert struct {
+	Title  string    `json:"title"`
+	Text   string    `json:"text"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+}
+
+// Notifier sends alerts over the configured fallback channel. A nil Notifier or one
+// without a channel sends nothing.
+type Notifier struct {
+	cfg    config.Fallback
+	client *httpclient.Client
+	now    func() time.Time
+
+	mutex    sync.Mutex
+	lastSent map[string]time.Time
+}
+
+// New creates a notifier for cfg. Its requests do not go through the proxy of the
+// bot, which may be what is failing.
+func New(cfg config.Fallback) *Notifier {
+	// Without a proxy New cannot fail
+	client, _ := httpclient.New("fallback", httpclient.Options{Timeout: sendTimeout})
+	return &Notifier{
+		cfg:      cfg,
+		client:   client,
+		now:      time.Now,
+		lastSent: make(map[string]time.Time),
+	}
+}
+
+// Enabled reports whether a channel is configured
+func (n *Notifier) Enabled() bool {
+	return n != nil && n.cfg.Enabled()
+}
+
+// Wanted reports whether an alert should be sent, given whether Telegram delivered it
+func (n *Notifier) Wanted(delivered bool) bool {
+	return n.Enabled() && (!delivered || n.cfg.Always)
+}
+
+// Send delivers an alert. It returns false without an error when the notifier is
+// not enabled or the same alert was sent within repeatInterval.
+func (n *Notifier) Send(ctx context.Context, title, text string) (bool, error) {
+	if !n.Enabled() || !n.claim(title+"\n"+text) {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+
+	var err error
+	switch n.cfg.Type {
+	case config.FallbackTypeNtfy:
+		err = n.sendNtfy(ctx, title, text)
+	case config.FallbackTypeWebhook:
+		err = n.sendWebhook(ctx, title, text)
+	case config.FallbackTypeSMTP:
+		err = n.sendMail(ctx, title, text)
+	default:
+		err = fmt.Errorf("unknown fallback type %q", n.cfg.Type)
+	}
+	if err != nil {
+		// A failed alert may be retried right away
+		n.mutex.Lock()
+		delete(n.lastSent, title+"\n"+text)
+		n.mutex.Unlock()
+		return false, fmt.Errorf("%s fallback failed: %w", n.cfg.Type, err)
+	}
+	return true, nil
+}
+
+// claim records that key is about to be sent, it returns false when it was sent
+// within repeatInterval
+func (n *Notifier) claim(key string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	now := n.now()
+	for sent, at := range n.lastSent {
+		if now.Sub(at) >= repeatInterval {
+			delete(n.lastSent, sent)
+		}
+	}
+	if _, recent := n.lastSent[key]; recent {
+		return false
+	}
+	n.lastSent[key] = now
+	return true
+}
+
+// sendNtfy publishes the alert to the ntfy topic with the highest priority
+func (n *Notifier) sendNtfy(ctx context.Context, title, text string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.cfg.URL, strings.NewReader(text))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", mime.QEncoding.Encode("utf-8", title))
+	req.Header.Set("Priority", "urgent")
+	req.Header.Set("Tags", "rotating_light")
+	return n.post(req)
+}
+
+// sendWebhook posts the alert as JSON
+func (n *Notifier) sendWebhook(ctx context.Context, title, text string) error {
+	body, err := json.Marshal(Alert{Title: title, Text: text, Time: n.now(), Source: source})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return n.post(req)
+}
+
+func (n *Notifier) post(req *http.Request) error {
+	if n.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.cfg.Token)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// sendMail mails the alert. Port 465 connects over TLS, other ports upgrade with
+// STARTTLS when the server offers it.
+func (n *Notifier) sendMail(ctx context.Context, title, text string) error {
+	cfg := n.cfg.SMTP
+	address := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	tlsConfig := &tls.Config{ServerName: cfg.Host}
+
+	dialer := &net.Dialer{Timeout: sendTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if cfg.Port == 465 {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	client, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if cfg.Port != 465 {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return fmt.Errorf("STARTTLS failed: %w", err)
+			}
+		}
+	}
+	if cfg.Username != "" {
+		// PlainAuth refuses to send the password over an unencrypted connection
+		if err := client.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+	if err := client.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, to := range cfg.To {
+		if err := client.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %s rejected: %w", to, err)
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(buildMail(cfg.From, cfg.To, title, text, n.now())); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// buildMail formats a plain text UTF-8 message
+func buildMail(from string, to []string, subject, text string, date time.Time) []byte {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "From: %s\r\n", from)
+	fmt.Fprintf(&builder, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&builder, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&builder, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	builder.WriteString("MIME-Version: 1.0\r\n")
+	builder.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	builder.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	fmt.Fprintf(&builder, "X-Mailer: %s\r\n\r\n", source)
+	// SMTP needs CRLF line ends, a line of a single dot is escaped by the data writer
+	builder.WriteString(strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n"))
+	builder.WriteString("\r\n")
+	return []byte(builder.String())
+}
@@ -0,0 +1,121 @@
+package fallback
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"xray-telegram-manager/config"
+)
+
+func TestNotifierNtfy(t *testing.T) {
+	var requests []*http.Request
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r)
+		bodies = append(bodies, string(body))
+	}))
+	defer server.Close()
+
+	notifier := New(config.Fallback{Type: config.FallbackTypeNtfy, URL: server.URL + "/router", Token: "tk_secret"})
+	sent, err := notifier.Send(context.Background(), "VPN down", "🔴 Server A is not responding")
+	if err != nil || !sent {
+		t.Fatalf("Expected the alert to be sent, got %v, %v", sent, err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("Expected one request, got %d", len(requests))
+	}
+	r := requests[0]
+	if r.URL.Path != "/router" || r.Header.Get("Title") != "VPN down" || r.Header.Get("Priority") != "urgent" {
+		t.Errorf("Unexpected request %s with headers %v", r.URL.Path, r.Header)
+	}
+	if r.Header.Get("Authorization") != "Bearer tk_secret" {
+		t.Errorf("Expected the token, got %q", r.Header.Get("Authorization"))
+	}
+	if bodies[0] != "🔴 Server A is not responding" {
+		t.Errorf("Unexpected body %q", bodies[0])
+	}
+
+	// The same alert is not repeated right away, a different one is sent
+	if sent, _ := notifier.Send(context.Background(), "VPN down", "🔴 Server A is not responding"); sent {
+		t.Error("Expected a repeated alert to be suppressed")
+	}
+	if sent, _ := notifier.Send(context.Background(), "VPN down", "🔴 Server B is not responding"); !sent {
+		t.Error("Expected a different alert to be sent")
+	}
+	notifier.now = func() time.Time { return time.Now().Add(repeatInterval) }
+	if sent, _ := notifier.Send(context.Background(), "VPN down", "🔴 Server A is not responding"); !sent {
+		t.Error("Expected the alert to be sent again after the repeat interval")
+	}
+}
+
+func TestNotifierWebhook(t *testing.T) {
+	status := http.StatusInternalServerError
+	var alerts []Alert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("Failed to decode the alert: %v", err)
+		}
+		alerts = append(alerts, alert)
+		w.WriteHeader(status)
+		w.Write([]byte("broken"))
+	}))
+	defer server.Close()
+
+	notifier := New(config.Fallback{Type: config.FallbackTypeWebhook, URL: server.URL})
+	if _, err := notifier.Send(context.Background(), "Bot update failed", "checksum mismatch"); err == nil || !strings.Contains(err.Error(), "HTTP 500: broken") {
+		t.Errorf("Expected the HTTP error, got %v", err)
+	}
+
+	// A failed alert is not suppressed as a repeat
+	status = http.StatusNoContent
+	if sent, err := notifier.Send(context.Background(), "Bot update failed", "checksum mismatch"); err != nil || !sent {
+		t.Fatalf("Expected the retry to be sent, got %v, %v", sent, err)
+	}
+	if len(alerts) != 2 || alerts[1].Title != "Bot update failed" || alerts[1].Text != "checksum mismatch" || alerts[1].Source != source || alerts[1].Time.IsZero() {
+		t.Errorf("Unexpected alerts %+v", alerts)
+	}
+}
+
+func TestNotifierWanted(t *testing.T) {
+	var disabled *Notifier
+	if disabled.Enabled() || disabled.Wanted(false) {
+		t.Error("Expected a nil notifier to be disabled")
+	}
+	if sent, err := New(config.Fallback{}).Send(context.Background(), "a", "b"); sent || err != nil {
+		t.Errorf("Expected nothing to be sent without a type, got %v, %v", sent, err)
+	}
+
+	notifier := New(config.Fallback{Type: config.FallbackTypeNtfy, URL: "https://ntfy.sh/x"})
+	if !notifier.Wanted(false) || notifier.Wanted(true) {
+		t.Error("Expected only undelivered alerts to be wanted")
+	}
+	notifier.cfg.Always = true
+	if !notifier.Wanted(true) {
+		t.Error("Expected delivered alerts to be wanted with always")
+	}
+}
+
+func TestBuildMail(t *testing.T) {
+	date := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	mail := string(buildMail("bot@example.com", []string{"a@example.com", "b@example.com"}, "Сервер недоступен", "line 1\nline 2", date))
+
+	for _, expected := range []string{
+		"From: bot@example.com\r\n",
+		"To: a@example.com, b@example.com\r\n",
+		"Subject: =?utf-8?q?",
+		"Date: Sun, 01 Mar 2026 12:00:00 +0000\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"\r\n\r\nline 1\r\nline 2\r\n",
+	} {
+		if !strings.Contains(mail, expected) {
+			t.Errorf("Expected %q in the mail:\n%s", expected, mail)
+		}
+	}
+}
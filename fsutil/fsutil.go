@@ -0,0 +1,131 @@
+// Package fsutil writes the files of the manager with modes that fit their content.
+// Files that may hold the bot token, subscription credentials or server keys are only
+// accessible by their owner, everything else is readable by all users.
+package fsutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	// ModePrivate is the mode of files holding secrets
+	ModePrivate os.FileMode = 0600
+	// ModeShared is the mode of files other programs may read
+	ModeShared os.FileMode = 0644
+)
+
+// WritePrivate writes a file holding secrets, see WriteFile
+func WritePrivate(path string, data []byte) error {
+	return WriteFile(path, data, ModePrivate)
+}
+
+// WriteShared writes a file without secrets, see WriteFile
+func WriteShared(path string, data []byte) error {
+	return WriteFile(path, data, ModeShared)
+}
+
+// WriteFile replaces path with data through a temporary file, so readers never see
+// half of it. The file gets exactly perm whatever the umask and the mode of the file
+// it replaces. A file that belongs to another user is refused instead of taken over.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	if err := CheckOwner(path); err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	// A temporary file left by an interrupted write may have another mode
+	_ = os.Remove(tempPath)
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Chmod(perm)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// CheckOwner returns an error when path exists and belongs to another user than the
+// one the manager runs as
+func CheckOwner(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	if uid, ok := Owner(info); ok && uid != os.Geteuid() {
+		return fmt.Errorf("%s belongs to uid %d, not to uid %d the manager runs as", path, uid, os.Geteuid())
+	}
+	return nil
+}
+
+// Owner returns the uid of the owner of a file
+func Owner(info os.FileInfo) (int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(stat.Uid), true
+}
+
+// Problem is a mode or owner of a file that does not fit its content
+type Problem struct {
+	Path string
+	// Severe problems expose secrets or let other users change the file
+	Severe bool
+	Text   string
+	// Fix is a command that solves the problem, empty when there is none
+	Fix string
+}
+
+// Inspect returns the problems of path, a file that may hold secrets when private. A
+// missing file has none. The directory is checked as well, other users writing to it
+// could replace the file.
+func Inspect(path string, private bool) ([]Problem, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var problems []Problem
+	mode := info.Mode().Perm()
+	switch {
+	case private && mode&0004 != 0:
+		problems = append(problems, Problem{Path: path, Severe: true,
+			Text: fmt.Sprintf("readable by all users (%04o)", mode), Fix: "chmod 600 " + path})
+	case private && mode&0070 != 0:
+		problems = append(problems, Problem{Path: path,
+			Text: fmt.Sprintf("accessible by the group (%04o)", mode), Fix: "chmod 600 " + path})
+	}
+	if mode&0002 != 0 {
+		problems = append(problems, Problem{Path: path, Severe: true,
+			Text: fmt.Sprintf("writable by all users (%04o)", mode), Fix: "chmod o-w " + path})
+	}
+	if uid, ok := Owner(info); ok && uid != os.Geteuid() {
+		problems = append(problems, Problem{Path: path,
+			Text: fmt.Sprintf("belongs to uid %d, the manager runs as uid %d", uid, os.Geteuid()),
+			Fix:  fmt.Sprintf("chown %d %s", os.Geteuid(), path)})
+	}
+
+	dir := filepath.Dir(path)
+	if dirInfo, err := os.Stat(dir); err == nil && dirInfo.Mode().Perm()&0002 != 0 && dirInfo.Mode()&os.ModeSticky == 0 {
+		problems = append(problems, Problem{Path: dir, Severe: true,
+			Text: fmt.Sprintf("writable by all users (%04o), others can replace the files in it", dirInfo.Mode().Perm()),
+			Fix:  "chmod o-w " + dir})
+	}
+	return problems, nil
+}
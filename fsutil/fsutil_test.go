@@ -0,0 +1,83 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestWriteFileEnforcesMode(t *testing.T) {
+	oldMask := syscall.Umask(0077)
+	defer syscall.Umask(oldMask)
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := WriteShared(path, []byte("{}")); err != nil {
+		t.Fatalf("WriteShared failed: %v", err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != ModeShared {
+		t.Errorf("Expected %04o despite the umask, got %04o", ModeShared, info.Mode().Perm())
+	}
+
+	// A private write tightens the mode of the file it replaces
+	if err := WritePrivate(path, []byte(`{"bot_token":"1:x"}`)); err != nil {
+		t.Fatalf("WritePrivate failed: %v", err)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != ModePrivate {
+		t.Errorf("Expected %04o, got %04o", ModePrivate, info.Mode().Perm())
+	}
+	if data, _ := os.ReadFile(path); string(data) != `{"bot_token":"1:x"}` {
+		t.Errorf("Unexpected content %q", data)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected no temporary file, got %v", err)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := Inspect(path, true)
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if len(problems) != 1 || !problems[0].Severe || !strings.Contains(problems[0].Text, "readable by all users") || problems[0].Fix != "chmod 600 "+path {
+		t.Errorf("Expected a world-readable private file, got %+v", problems)
+	}
+	if problems, _ := Inspect(path, false); len(problems) != 0 {
+		t.Errorf("Expected a shared file to be fine, got %+v", problems)
+	}
+
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if problems, _ := Inspect(path, true); len(problems) != 1 || problems[0].Severe {
+		t.Errorf("Expected a mild problem for a group-readable file, got %+v", problems)
+	}
+
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if problems, _ := Inspect(path, true); len(problems) != 1 || problems[0].Path != dir || !problems[0].Severe {
+		t.Errorf("Expected the world-writable directory, got %+v", problems)
+	}
+
+	if problems, err := Inspect(filepath.Join(dir, "missing.json"), true); err != nil || len(problems) != 0 {
+		t.Errorf("Expected no problems for a missing file, got %+v, %v", problems, err)
+	}
+}
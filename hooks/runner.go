@@ -0,0 +1,160 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+	"xray-telegram-manager/config"
+)
+
+// Event is a point of the manager where a hook script runs
+type Event string
+
+const (
+	PreSwitch      Event = "pre_switch"
+	PostSwitch     Event = "post_switch"
+	PostUpdate     Event = "post_update"
+	HealthDegraded Event = "on_health_degraded"
+)
+
+// maxOutput bounds the captured output of a script, the end of the output is kept
+const maxOutput = 2048
+
+// Result is the outcome of one run of a hook script
+type Result struct {
+	Event  Event
+	Script string
+	// ExitCode is -1 when the script could not be started or was stopped
+	ExitCode int
+	Output   string
+	Duration time.Duration
+	Err      error
+}
+
+// Runner runs the hook scripts of the config. A nil Runner runs nothing.
+type Runner struct {
+	scripts map[Event]string
+	timeout time.Duration
+
+	mutex     sync.RWMutex
+	observers []func(Result)
+}
+
+// NewRunner creates a runner for the scripts of cfg
+func NewRunner(cfg config.Hooks) *Runner {
+	scripts := make(map[Event]string)
+	for event, script := range map[Event]string{
+		PreSwitch:      cfg.PreSwitch,
+		PostSwitch:     cfg.PostSwitch,
+		PostUpdate:     cfg.PostUpdate,
+		HealthDegraded: cfg.OnHealthDegraded,
+	} {
+		if script != "" {
+			scripts[event] = script
+		}
+	}
+	return &Runner{scripts: scripts, timeout: cfg.Timeout()}
+}
+
+// OnResult registers fn to be called with the result of every run
+func (r *Runner) OnResult(fn func(Result)) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.observers = append(r.observers, fn)
+}
+
+// Enabled reports whether a script is set for event
+func (r *Runner) Enabled(event Event) bool {
+	return r != nil && r.scripts[event] != ""
+}
+
+// Run runs the script of event with env added to the environment of the bot and
+// waits for it up to the configured timeout. ok is false when no script is set.
+func (r *Runner) Run(ctx context.Context, event Event, env map[string]string) (result Result, ok bool) {
+	if !r.Enabled(event) {
+		return Result{}, false
+	}
+	result = Result{Event: event, Script: r.scripts[event], ExitCode: -1}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, result.Script)
+	cmd.Env = append(os.Environ(), "XRAY_HOOK_EVENT="+string(event))
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		cmd.Env = append(cmd.Env, key+"="+env[key])
+	}
+	output := &tailBuffer{limit: maxOutput}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// Children of the killed script may keep the output pipe open
+	cmd.WaitDelay = time.Second
+
+	started := time.Now()
+	err := cmd.Run()
+	result.Duration = time.Since(started)
+	result.Output = output.String()
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		result.Err = fmt.Errorf("%s hook timed out after %s", event, r.timeout)
+	case errors.As(err, &exitErr):
+		result.Err = fmt.Errorf("%s hook exited with code %d", event, result.ExitCode)
+	default:
+		result.Err = fmt.Errorf("%s hook failed: %w", event, err)
+	}
+
+	r.mutex.RLock()
+	observers := append([]func(Result){}, r.observers...)
+	r.mutex.RUnlock()
+	for _, observer := range observers {
+		observer(result)
+	}
+	return result, true
+}
+
+// tailBuffer keeps the last limit bytes written to it
+type tailBuffer struct {
+	mutex     sync.Mutex
+	buffer    bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	tb.buffer.Write(p)
+	if over := tb.buffer.Len() - tb.limit; over > 0 {
+		tb.buffer.Next(over)
+		tb.truncated = true
+	}
+	return len(p), nil
+}
+
+func (tb *tailBuffer) String() string {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	output := string(bytes.TrimSpace(tb.buffer.Bytes()))
+	if tb.truncated {
+		return "…" + output
+	}
+	return output
+}
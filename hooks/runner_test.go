@@ -0,0 +1,71 @@
+package hooks
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"xray-telegram-manager/config"
+)
+
+func writeScript(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0700); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	return path
+}
+
+func TestRunnerPassesEnvironment(t *testing.T) {
+	script := writeScript(t, `echo "$XRAY_HOOK_EVENT $XRAY_SERVER_NAME"`)
+	runner := NewRunner(config.Hooks{PostSwitch: script, TimeoutSeconds: 5})
+
+	var observed []Result
+	runner.OnResult(func(result Result) { observed = append(observed, result) })
+
+	if _, ok := runner.Run(context.Background(), PreSwitch, nil); ok {
+		t.Error("Expected no run for an event without a script")
+	}
+	result, ok := runner.Run(context.Background(), PostSwitch, map[string]string{"XRAY_SERVER_NAME": "Amsterdam"})
+	if !ok {
+		t.Fatal("Expected the post_switch script to run")
+	}
+	if result.Err != nil || result.ExitCode != 0 || result.Output != "post_switch Amsterdam" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if len(observed) != 1 || observed[0].Event != PostSwitch {
+		t.Errorf("Expected the result to be observed once, got %+v", observed)
+	}
+}
+
+func TestRunnerReportsFailures(t *testing.T) {
+	failing := writeScript(t, "echo broken >&2\nexit 3")
+	runner := NewRunner(config.Hooks{PostUpdate: failing, TimeoutSeconds: 5})
+	result, _ := runner.Run(context.Background(), PostUpdate, nil)
+	if result.Err == nil || result.ExitCode != 3 || result.Output != "broken" {
+		t.Errorf("Expected exit code 3 with the output, got %+v", result)
+	}
+
+	hanging := writeScript(t, "sleep 5")
+	runner = NewRunner(config.Hooks{OnHealthDegraded: hanging, TimeoutSeconds: 1})
+	result, _ = runner.Run(context.Background(), HealthDegraded, nil)
+	if result.Err == nil || !strings.Contains(result.Err.Error(), "timed out") {
+		t.Errorf("Expected a timeout, got %+v", result)
+	}
+
+	var nilRunner *Runner
+	if _, ok := nilRunner.Run(context.Background(), PostSwitch, nil); ok {
+		t.Error("Expected a nil runner to run nothing")
+	}
+}
+
+func TestTailBufferKeepsEnd(t *testing.T) {
+	buffer := &tailBuffer{limit: 4}
+	_, _ = buffer.Write([]byte("abc"))
+	_, _ = buffer.Write([]byte("defg"))
+	if got := buffer.String(); got != "…defg" {
+		t.Errorf("Expected the end of the output, got %q", got)
+	}
+}
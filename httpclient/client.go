@@ -0,0 +1,238 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Options configures a Client. Zero values take the defaults.
+type Options struct {
+	// Timeout of one attempt including reading the body, 30 seconds by default
+	Timeout time.Duration
+	// Retries of GET and HEAD requests after network errors and 5xx or 429 responses
+	Retries int
+	// Backoff before the first retry, doubled for every next one. 1 second by default.
+	Backoff time.Duration
+	// Proxy URL (http, https or socks5). Empty uses the proxy from the environment.
+	Proxy string
+	// Observer is called after every call with its metrics
+	Observer func(CallMetrics)
+}
+
+// CallMetrics describes one call. It holds only the host of the URL, so secrets
+// in paths like the Telegram file links are not leaked.
+type CallMetrics struct {
+	Client   string
+	Method   string
+	Host     string
+	Status   int
+	Attempts int
+	Duration time.Duration
+	Err      error
+}
+
+// Metrics are the totals of a client
+type Metrics struct {
+	Requests      int64
+	Retries       int64
+	Failures      int64
+	TotalDuration time.Duration
+	LastStatus    int
+	LastCall      time.Time
+}
+
+// Client is an http.Client with retries and metrics. Clients without a proxy share
+// one connection pool.
+type Client struct {
+	name     string
+	http     *http.Client
+	retries  int
+	backoff  time.Duration
+	observer func(CallMetrics)
+	mutex    sync.Mutex
+	metrics  Metrics
+}
+
+// sharedTransport pools connections of all clients without an explicit proxy
+var sharedTransport = newTransport(http.ProxyFromEnvironment)
+
+func newTransport(proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 15 * time.Second,
+		MaxIdleConns:          10,
+		MaxIdleConnsPerHost:   2,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
+
+// New creates a client. name identifies it in the metrics.
+func New(name string, opts Options) (*Client, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+
+	transport := sharedTransport
+	if opts.Proxy != "" {
+		proxyURL, err := ParseProxy(opts.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport = newTransport(http.ProxyURL(proxyURL))
+	}
+
+	return &Client{
+		name:     name,
+		http:     &http.Client{Timeout: opts.Timeout, Transport: transport},
+		retries:  opts.Retries,
+		backoff:  opts.Backoff,
+		observer: opts.Observer,
+	}, nil
+}
+
+// ParseProxy validates a proxy URL
+func ParseProxy(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, use http, https or socks5", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("proxy URL has no host")
+	}
+	return proxyURL, nil
+}
+
+// Get sends a GET request
+func (c *Client) Get(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	return c.Do(req)
+}
+
+// Do sends a request. GET and HEAD requests without a body are retried.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	retries := 0
+	if (req.Method == http.MethodGet || req.Method == http.MethodHead) && req.Body == nil {
+		retries = c.retries
+	}
+
+	var resp *http.Response
+	var err error
+	attempts := 0
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			if waitErr := sleep(req.Context(), c.backoff<<(attempt-1)); waitErr != nil {
+				resp, err = nil, waitErr
+				break
+			}
+		}
+		attempts++
+		resp, err = c.http.Do(req)
+		if !retryable(req.Context(), resp, err) || attempt == retries {
+			break
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+	}
+
+	c.record(req, resp, err, attempts, time.Since(start))
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %w", req.Method, req.URL.Host, unwrapURLError(err))
+	}
+	return resp, nil
+}
+
+// Metrics returns the totals of the client
+func (c *Client) Metrics() Metrics {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.metrics
+}
+func (c *Client) record(req *http.Request, resp *http.Response, err error, attempts int, duration time.Duration) {
+	call := CallMetrics{
+		Client:   c.name,
+		Method:   req.Method,
+		Host:     req.URL.Host,
+		Attempts: attempts,
+		Duration: duration,
+	}
+	if resp != nil {
+		call.Status = resp.StatusCode
+	}
+	if err != nil {
+		call.Err = unwrapURLError(err)
+	}
+
+	c.mutex.Lock()
+	c.metrics.Requests++
+	c.metrics.Retries += int64(attempts - 1)
+	if err != nil || call.Status >= 500 {
+		c.metrics.Failures++
+	}
+	c.metrics.TotalDuration += duration
+	c.metrics.LastStatus = call.Status
+	c.metrics.LastCall = time.Now()
+	c.mutex.Unlock()
+
+	if c.observer != nil {
+		c.observer(call)
+	}
+}
+
+// retryable reports whether an attempt failed in a way worth retrying
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// unwrapURLError drops the URL from the error, it may contain tokens
+func unwrapURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
@@ -0,0 +1,242 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// downloadStallTimeout aborts an attempt when no data arrives for so long, the
+	// download is then resumed
+	downloadStallTimeout = 30 * time.Second
+	// downloadChunk is the most read at once
+	downloadChunk = 32 << 10
+	// partSuffix marks a download that is not complete yet
+	partSuffix = ".part"
+)
+
+// DownloadOptions configures Download. Zero values take the defaults.
+type DownloadOptions struct {
+	// Attempts is how often a download is started or resumed before giving up, 5 by
+	// default
+	Attempts int
+	// RateLimit caps the speed in bytes per second, 0 downloads at full speed
+	RateLimit int64
+	// Progress is called after every chunk with the bytes downloaded and the size of
+	// the file, the size is -1 while unknown
+	Progress func(done, total int64)
+}
+
+// errRestart asks for the download to start again from the beginning
+var errRestart = errors.New("server cannot resume the download")
+
+// Download saves rawURL to path. The data goes to path with a ".part" suffix first and
+// an interrupted download continues from where it stopped with a Range request, also
+// in a later call for the same path, so the URL has to name an immutable file such as
+// a release asset. path appears only when the download is complete.
+func (c *Client) Download(ctx context.Context, rawURL, path string, opts DownloadOptions) error {
+	if opts.Attempts <= 0 {
+		opts.Attempts = 5
+	}
+	partPath := path + partSuffix
+	// The whole-request timeout of the client would cut off large files on slow links,
+	// attempts end when the data stops coming instead
+	client := &http.Client{Transport: c.http.Transport}
+
+	// A download refused at once leaves no empty partial file behind
+	defer func() {
+		if info, err := os.Stat(partPath); err == nil && info.Size() == 0 {
+			_ = os.Remove(partPath)
+		}
+	}()
+
+	var lastErr error
+	restarted := false
+	for attempt := 0; attempt < opts.Attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, c.backoff<<(attempt-1)); err != nil {
+				return err
+			}
+		}
+		err := c.downloadAttempt(ctx, client, rawURL, partPath, opts)
+		if err == nil {
+			if err := os.Rename(partPath, path); err != nil {
+				return fmt.Errorf("failed to save the download: %w", err)
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, errRestart) && !restarted {
+			// The partial file does not fit the file on the server, it is started
+			// over once without counting as a failed attempt
+			restarted = true
+			if err := os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove the partial download: %w", err)
+			}
+			attempt--
+			continue
+		}
+		var status statusError
+		if errors.As(err, &status) && status < 500 && status != http.StatusTooManyRequests {
+			return err
+		}
+		lastErr = err
+	}
+	return fmt.Errorf("download failed after %d attempts: %w", opts.Attempts, lastErr)
+}
+
+// statusError is an unexpected HTTP status of a download
+type statusError int
+
+func (s statusError) Error() string {
+	return fmt.Sprintf("HTTP %d %s", int(s), http.StatusText(int(s)))
+}
+
+// downloadAttempt appends to partPath what the server sends from its current size on
+func (c *Client) downloadAttempt(ctx context.Context, client *http.Client, rawURL, partPath string, opts DownloadOptions) error {
+	file, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open the partial download: %w", err)
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to open the partial download: %w", err)
+	}
+
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(attemptCtx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	c.record(req, resp, err, 1, time.Since(start))
+	if err != nil {
+		return unwrapURLError(err)
+	}
+	defer resp.Body.Close()
+
+	total := int64(-1)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		rangeStart, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || rangeStart != offset {
+			return errRestart
+		}
+		total = size
+	case resp.StatusCode == http.StatusOK:
+		// The server ignored the range and sends the whole file
+		if offset > 0 {
+			if err := file.Truncate(0); err != nil {
+				return fmt.Errorf("failed to restart the download: %w", err)
+			}
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to restart the download: %w", err)
+			}
+			offset = 0
+		}
+		total = resp.ContentLength
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		return errRestart
+	default:
+		return statusError(resp.StatusCode)
+	}
+
+	// Data that stops coming cancels the attempt, it is resumed by the next one
+	stall := time.AfterFunc(downloadStallTimeout, cancel)
+	defer stall.Stop()
+
+	chunk := int64(downloadChunk)
+	if opts.RateLimit > 0 && opts.RateLimit/4 < chunk {
+		// Smaller reads keep a slow rate smooth
+		chunk = max(opts.RateLimit/4, 1024)
+	}
+	buffer := make([]byte, chunk)
+	done := offset
+	received := int64(0)
+	began := time.Now()
+	if opts.Progress != nil {
+		opts.Progress(done, total)
+	}
+	for {
+		n, readErr := resp.Body.Read(buffer)
+		if n > 0 {
+			stall.Reset(downloadStallTimeout)
+			if _, err := file.Write(buffer[:n]); err != nil {
+				return fmt.Errorf("failed to write the download: %w", err)
+			}
+			done += int64(n)
+			received += int64(n)
+			if opts.Progress != nil {
+				opts.Progress(done, total)
+			}
+			if opts.RateLimit > 0 {
+				// Wait until the bytes of this attempt fit the rate
+				due := time.Duration(float64(received) / float64(opts.RateLimit) * float64(time.Second))
+				if wait := due - time.Since(began); wait > 0 {
+					stall.Stop()
+					if err := sleep(attemptCtx, wait); err != nil {
+						return err
+					}
+					stall.Reset(downloadStallTimeout)
+				}
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			if ctx.Err() == nil && attemptCtx.Err() != nil {
+				return fmt.Errorf("no data for %v", downloadStallTimeout)
+			}
+			return readErr
+		}
+	}
+	if total >= 0 && done != total {
+		return fmt.Errorf("download ended at %d of %d bytes", done, total)
+	}
+	return nil
+}
+
+// parseContentRange reads "bytes start-end/size" of a 206 response, size is -1 when
+// the server does not know it
+func parseContentRange(header string) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+	span, sizeText, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, false
+	}
+	startText, _, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(startText, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if sizeText == "*" {
+		return start, -1, true
+	}
+	size, err := strconv.ParseInt(sizeText, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, size, true
+}
@@ -0,0 +1,141 @@
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+func TestDownloadResumesDroppedConnection(t *testing.T) {
+	content := testContent(100 << 10)
+	var calls atomic.Int32
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if calls.Add(1) == 1 {
+			// The connection drops after a third of the file
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			_, _ = w.Write(content[:len(content)/3])
+			return
+		}
+		http.ServeContent(w, r, "asset", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	client, _ := New("test", Options{Backoff: time.Millisecond})
+	path := filepath.Join(t.TempDir(), "asset")
+	var lastDone, lastTotal int64
+	err := client.Download(context.Background(), server.URL, path, DownloadOptions{
+		Progress: func(done, total int64) { lastDone, lastTotal = done, total },
+	})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if !bytes.Equal(data, content) {
+		t.Errorf("Expected the whole file, got %d bytes", len(data))
+	}
+	if len(ranges) != 2 || ranges[0] != "" || ranges[1] != "bytes="+strconv.Itoa(len(content)/3)+"-" {
+		t.Errorf("Expected the second request to resume, got ranges %q", ranges)
+	}
+	if lastDone != int64(len(content)) || lastTotal != int64(len(content)) {
+		t.Errorf("Expected the final progress to be complete, got %d of %d", lastDone, lastTotal)
+	}
+	if _, err := os.Stat(path + partSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial file to be gone, got %v", err)
+	}
+}
+
+func TestDownloadContinuesPartialFile(t *testing.T) {
+	content := testContent(10 << 10)
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.Header.Get("Range"))
+		http.ServeContent(w, r, "asset", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "asset")
+	if err := os.WriteFile(path+partSuffix, content[:4096], 0644); err != nil {
+		t.Fatal(err)
+	}
+	client, _ := New("test", Options{})
+	if err := client.Download(context.Background(), server.URL, path, DownloadOptions{}); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, content) {
+		t.Errorf("Expected the whole file, got %d bytes", len(data))
+	}
+	if len(requested) != 1 || requested[0] != "bytes=4096-" {
+		t.Errorf("Expected one resumed request, got %q", requested)
+	}
+
+	// A partial file longer than the file on the server is started over
+	requested = nil
+	if err := os.WriteFile(path+partSuffix, testContent(20<<10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Download(context.Background(), server.URL, path, DownloadOptions{}); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, content) {
+		t.Errorf("Expected the file to be downloaded again, got %d bytes", len(data))
+	}
+	if len(requested) != 2 || requested[1] != "" {
+		t.Errorf("Expected a full request after the failed resume, got %q", requested)
+	}
+}
+
+func TestDownloadRateLimit(t *testing.T) {
+	content := testContent(24 << 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "asset", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	client, _ := New("test", Options{})
+	start := time.Now()
+	err := client.Download(context.Background(), server.URL, filepath.Join(t.TempDir(), "asset"), DownloadOptions{RateLimit: 96 << 10})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Expected 24 KB at 96 KB/s to take about 250ms, took %v", elapsed)
+	}
+}
+
+func TestDownloadDoesNotRetryMissingFile(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client, _ := New("test", Options{Backoff: time.Millisecond})
+	path := filepath.Join(t.TempDir(), "asset")
+	if err := client.Download(context.Background(), server.URL, path, DownloadOptions{}); err == nil {
+		t.Fatal("Expected an error for a missing file")
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected one request, got %d", calls.Load())
+	}
+	if _, err := os.Stat(path + partSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected no partial file, got %v", err)
+	}
+}
@@ -56,6 +56,32 @@ type Logger struct {
 	output io.Writer
 }
 
+// redactions maps secrets to their masked form, applied to every log line of every logger
+var (
+	redactions      = map[string]string{}
+	redactionsMutex sync.RWMutex
+)
+
+// RegisterSecret makes all loggers replace the secret with its masked form
+func RegisterSecret(secret, masked string) {
+	if secret == "" {
+		return
+	}
+	redactionsMutex.Lock()
+	defer redactionsMutex.Unlock()
+	redactions[secret] = masked
+}
+
+// Redact replaces registered secrets in the text
+func Redact(text string) string {
+	redactionsMutex.RLock()
+	defer redactionsMutex.RUnlock()
+	for secret, masked := range redactions {
+		text = strings.ReplaceAll(text, secret, masked)
+	}
+	return text
+}
+
 func NewLogger(level LogLevel, output io.Writer) *Logger {
 	if output == nil {
 		output = os.Stdout
@@ -150,7 +176,7 @@ func (l *Logger) logUnsafe(level LogLevel, msg string, args ...interface{}) {
 		formattedMsg = msg
 	}
 
-	logLine := fmt.Sprintf("[%s] %s: %s", timestamp, level.String(), formattedMsg)
+	logLine := fmt.Sprintf("[%s] %s: %s", timestamp, level.String(), Redact(formattedMsg))
 	l.logger.Println(logLine)
 }
 
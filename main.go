@@ -1,67 +1,119 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 	"xray-telegram-manager/config"
 	"xray-telegram-manager/logger"
 	"xray-telegram-manager/service"
-	"xray-telegram-manager/telegram"
+	"xray-telegram-manager/version"
 )
 
-var (
-	Version   = "dev"
-	BuildTime = "unknown"
-	GoVersion = "unknown"
-)
+// instanceLockWait is how long startup waits for a stopping instance to exit
+const instanceLockWait = 5 * time.Second
 
 func main() {
 	// Handle version flag early to allow scripts to query version without starting the service
 	for _, arg := range os.Args[1:] {
 		if arg == "--version" || arg == "-v" || arg == "version" {
-			fmt.Printf("Xray Telegram Manager v%s (built %s with %s)\n", Version, BuildTime, GoVersion)
+			fmt.Printf("Xray Telegram Manager %s\n", version.String())
+			os.Exit(0)
+		}
+		// Health check for init scripts and service managers, exits non-zero when unhealthy
+		if arg == "--health" {
+			summary, err := service.CheckHealth(service.DefaultHealthFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "unhealthy: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("%s\n", summary)
 			os.Exit(0)
 		}
 	}
 
-	fmt.Printf("Xray Telegram Manager v%s (built %s with %s)\n", Version, BuildTime, GoVersion)
+	// Headless subcommands reuse the server manager without starting the bot
+	if len(os.Args) > 1 && isCLICommand(os.Args[1]) {
+		os.Exit(runCLI(os.Args[1:]))
+	}
 
-	// Set version info for telegram package
-	telegram.SetVersionInfo(Version, BuildTime, GoVersion)
+	fmt.Printf("Xray Telegram Manager %s\n", version.String())
 
-	configPath := "/opt/etc/xray-manager/config.json"
+	configPath := defaultConfigPath
 
 	if len(os.Args) > 1 {
 		configPath = os.Args[1]
 	}
 
 	cfg, err := config.LoadConfig(configPath)
+	needsSetup := false
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
-		os.Exit(1)
+		// A config with only the bot token starts the setup wizard
+		setupCfg, setupErr := config.LoadForSetup(configPath)
+		if setupErr != nil || !setupCfg.NeedsSetup() {
+			fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+			os.Exit(1)
+		}
+		cfg, needsSetup = setupCfg, true
 	}
 
+	// Never write the bot token to logs, even when it shows up in library errors
+	logger.RegisterSecret(cfg.BotToken, config.RedactToken(cfg.BotToken))
+	logger.RegisterSecret(cfg.Web.Token, "***")
+	logger.RegisterSecret(cfg.MQTT.Password, "***")
+	logger.RegisterSecret(cfg.FallbackNotifier.Token, "***")
+	logger.RegisterSecret(cfg.FallbackNotifier.SMTP.Password, "***")
+
 	logLevel := logger.ParseLogLevel(cfg.LogLevel)
 
-	// Create logs directory if it doesn't exist
+	// Create logs directory if it doesn't exist, dev mode keeps everything in its sandbox
 	logDir := "/opt/etc/xray-manager/logs"
+	lockFile := service.DefaultLockFile
+	if dev := cfg.GetDev(); dev.Enabled {
+		logDir = filepath.Join(dev.SandboxDir, "logs")
+		lockFile = filepath.Join(dev.SandboxDir, filepath.Base(service.DefaultLockFile))
+	}
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to create log directory: %v\n", err)
 	}
 
 	// Try to create file logger, fallback to stdout
-	logFile := "/opt/etc/xray-manager/logs/app.log"
+	logFile := filepath.Join(logDir, "app.log")
 	log, err := logger.NewFileLogger(logLevel, logFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to create file logger, using stdout: %v\n", err)
 		log = logger.NewLogger(logLevel, os.Stdout)
 	}
 
+	// Two instances polling the same token steal each other's updates
+	lock, err := acquireInstanceLock(lockFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start: %v\n", err)
+		os.Exit(1)
+	}
+	defer lock.Release()
+
+	if needsSetup {
+		cfg, err = runSetupWizard(cfg, log)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Setup was not completed: %v\n", logger.Redact(err.Error()))
+			os.Exit(1)
+		}
+	}
+
+	log.Info("Bot token loaded from %s, admin ID from %s", cfg.SecretSource("bot_token"), cfg.SecretSource("admin_id"))
+	if fragments := cfg.Fragments(); len(fragments) > 0 {
+		log.Info("Config fragments merged in order: %s", strings.Join(fragments, ", "))
+	}
+
 	svc, err := service.NewService(cfg, log)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create service: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Failed to create service: %v\n", logger.Redact(err.Error()))
 		os.Exit(1)
 	}
 
@@ -75,8 +127,30 @@ func main() {
 
 	log.Info("Service started. Press Ctrl+C to stop or send SIGHUP to reload")
 
+	// Keepalives are sent from the main loop so a stuck loop is detected by the watchdog
+	var watchdog <-chan time.Time
+	if interval := svc.WatchdogInterval(); interval > 0 {
+		log.Info("Service manager watchdog enabled (keepalive every %v)", interval)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
 	for {
-		sig := <-sigChan
+		var sig os.Signal
+		select {
+		case <-watchdog:
+			svc.NotifyWatchdog()
+			continue
+		case <-svc.Done():
+			// Not a failure, a service manager must not restart this instance
+			if err := svc.Stop(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error during shutdown: %v\n", err)
+			}
+			log.Info("Stopped because another instance uses the bot token")
+			return
+		case sig = <-sigChan:
+		}
 
 		switch sig {
 		case syscall.SIGINT, syscall.SIGTERM:
@@ -96,3 +170,17 @@ func main() {
 		}
 	}
 }
+
+// acquireInstanceLock waits a little for the lock, a restart may start the new
+// process while the old one is still stopping
+func acquireInstanceLock(path string) (*service.InstanceLock, error) {
+	deadline := time.Now().Add(instanceLockWait)
+	for {
+		lock, err := service.AcquireInstanceLock(path)
+		var running *service.AlreadyRunningError
+		if err == nil || !errors.As(err, &running) || time.Now().After(deadline) {
+			return lock, err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
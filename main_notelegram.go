@@ -0,0 +1,14 @@
+//go:build notelegram
+
+package main
+
+import (
+	"fmt"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/logger"
+)
+
+// runSetupWizard fails in builds without Telegram, the config has to be written by hand
+func runSetupWizard(cfg *config.Config, log *logger.Logger) (*config.Config, error) {
+	return nil, fmt.Errorf("config %s has no admin_id or subscription_url and the setup wizard needs the Telegram build", cfg.GetConfigFilePath())
+}
@@ -0,0 +1,29 @@
+//go:build !notelegram
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"syscall"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/logger"
+	"xray-telegram-manager/telegram"
+)
+
+// runSetupWizard configures the admin and subscription through Telegram and returns
+// the saved config. The confirmation code is printed to the console.
+func runSetupWizard(cfg *config.Config, log *logger.Logger) (*config.Config, error) {
+	fmt.Printf("Config %s has no admin_id or subscription_url, starting setup mode\n", cfg.GetConfigFilePath())
+	wizard, err := telegram.NewSetupWizard(cfg, log, func(code string) {
+		fmt.Printf("Send /start to the bot in Telegram and enter the confirmation code: %s\n", code)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return wizard.Run(ctx)
+}
@@ -6,3 +6,37 @@ func TestMainBasic(t *testing.T) {
 	// Простой тест существования основного пакета
 	t.Log("Main package test passed")
 }
+
+func TestParseCLIArgs(t *testing.T) {
+	command, positional, configPath, err := parseCLIArgs([]string{"switch", "example_com_443", "--config", "/tmp/config.json"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if command != "switch" {
+		t.Errorf("Expected command 'switch', got '%s'", command)
+	}
+	if len(positional) != 1 || positional[0] != "example_com_443" {
+		t.Errorf("Expected server ID argument, got %v", positional)
+	}
+	if configPath != "/tmp/config.json" {
+		t.Errorf("Expected config path '/tmp/config.json', got '%s'", configPath)
+	}
+
+	_, _, configPath, err = parseCLIArgs([]string{"list", "--config=/tmp/other.json"})
+	if err != nil || configPath != "/tmp/other.json" {
+		t.Errorf("Expected --config= form to be parsed, got '%s' (%v)", configPath, err)
+	}
+
+	_, _, configPath, _ = parseCLIArgs([]string{"status"})
+	if configPath != defaultConfigPath {
+		t.Errorf("Expected default config path, got '%s'", configPath)
+	}
+
+	if _, _, _, err := parseCLIArgs([]string{"ping", "--config"}); err == nil {
+		t.Error("Expected error when --config has no value")
+	}
+
+	if !isCLICommand("validate-config") || isCLICommand("/opt/etc/xray-manager/config.json") {
+		t.Error("Expected only subcommands to be recognized as CLI commands")
+	}
+}
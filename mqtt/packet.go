@@ -0,0 +1,152 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Packet types of MQTT 3.1.1 the publisher sends or expects, in the upper four bits
+// of the first byte
+const (
+	packetConnect    byte = 0x10
+	packetConnack    byte = 0x20
+	packetPublish    byte = 0x30
+	packetPingreq    byte = 0xc0
+	packetPingresp   byte = 0xd0
+	packetDisconnect byte = 0xe0
+)
+
+// Flags of the CONNECT packet
+const (
+	flagCleanSession byte = 0x02
+	flagWill         byte = 0x04
+	flagWillRetain   byte = 0x20
+	flagPassword     byte = 0x40
+	flagUsername     byte = 0x80
+)
+
+// connackReasons explains the refusals of a broker, by return code
+var connackReasons = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client ID rejected",
+	3: "server unavailable",
+	4: "bad username or password",
+	5: "not authorized",
+}
+
+// connectPacket is what the publisher tells the broker when it connects
+type connectPacket struct {
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive uint16
+	// WillTopic gets WillPayload retained when the connection is lost without a
+	// DISCONNECT, empty for no will
+	WillTopic   string
+	WillPayload string
+}
+
+func (c connectPacket) encode() []byte {
+	flags := flagCleanSession
+	body := appendString(nil, "MQTT")
+	body = append(body, 4) // protocol level of 3.1.1
+	flagsAt := len(body)
+	body = append(body, 0)
+	body = binary.BigEndian.AppendUint16(body, c.KeepAlive)
+	body = appendString(body, c.ClientID)
+	if c.WillTopic != "" {
+		flags |= flagWill | flagWillRetain
+		body = appendString(body, c.WillTopic)
+		body = appendString(body, c.WillPayload)
+	}
+	if c.Username != "" {
+		flags |= flagUsername
+		body = appendString(body, c.Username)
+		if c.Password != "" {
+			flags |= flagPassword
+			body = appendString(body, c.Password)
+		}
+	}
+	body[flagsAt] = flags
+	return packet(packetConnect, body)
+}
+
+// publishPacket encodes a message with QoS 0, the broker does not acknowledge it
+func publishPacket(topic string, payload []byte, retain bool) []byte {
+	header := packetPublish
+	if retain {
+		header |= 0x01
+	}
+	body := appendString(nil, topic)
+	body = append(body, payload...)
+	return packet(header, body)
+}
+
+// packet prepends the fixed header to body
+func packet(header byte, body []byte) []byte {
+	data := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		data = append(data, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(data, body...)
+}
+
+// appendString appends a string with its two byte length
+func appendString(data []byte, s string) []byte {
+	data = binary.BigEndian.AppendUint16(data, uint16(len(s)))
+	return append(data, s...)
+}
+
+// readPacket reads one packet and returns its first byte and its body
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed packet length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// checkConnack returns why the broker refused the connection, nil when it accepted it
+func checkConnack(header byte, body []byte) error {
+	if header&0xf0 != packetConnack || len(body) != 2 {
+		return fmt.Errorf("expected CONNACK, got packet type %d", header>>4)
+	}
+	if code := body[1]; code != 0 {
+		if reason, ok := connackReasons[code]; ok {
+			return fmt.Errorf("broker refused the connection: %s", reason)
+		}
+		return fmt.Errorf("broker refused the connection with code %d", code)
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+// Package mqtt publishes the state of the VPN and its events to an MQTT broker, so
+// home automation such as Home Assistant can react to them without polling the web
+// API. Only what the publisher needs of MQTT 3.1.1 is implemented: messages are sent
+// with QoS 0 and nothing is subscribed to.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/logger"
+	"xray-telegram-manager/types"
+)
+
+const (
+	// connectTimeout bounds connecting to the broker and each write
+	connectTimeout = 10 * time.Second
+	// keepAlive is how often the broker is pinged, a connection without an answer
+	// for twice as long is considered lost
+	keepAlive = 60 * time.Second
+	// minReconnectDelay and maxReconnectDelay bound the pause before reconnecting,
+	// it doubles with every failed attempt
+	minReconnectDelay = 5 * time.Second
+	maxReconnectDelay = 5 * time.Minute
+	// maxQueuedEvents is how many events are kept while the broker is unreachable,
+	// older ones are dropped
+	maxQueuedEvents = 50
+)
+
+// Topics below the configured prefix. The retained ones always hold the latest value,
+// so a client subscribing later gets it at once.
+const (
+	// TopicStatus is "online" while the manager is connected, "offline" after it
+	// stopped or lost the connection
+	TopicStatus = "status"
+	// TopicVPN is "up" when the active server answers, "down" when it does not
+	TopicVPN = "vpn"
+	// TopicServer is the name of the active server
+	TopicServer = "server"
+	// TopicLatency is the latency of the active server in milliseconds
+	TopicLatency = "latency"
+	// TopicState is all of the above as one JSON object
+	TopicState = "state"
+	// TopicEvents gets an Event as JSON for every switch and VPN state change, it
+	// is not retained
+	TopicEvents = "events"
+)
+
+// Event types published to TopicEvents
+const (
+	EventSwitch         = "switch"
+	EventVPNDown        = "vpn_down"
+	EventVPNUp          = "vpn_up"
+	EventLatencyAnomaly = "latency_anomaly"
+)
+
+// State is the JSON published to TopicState
+type State struct {
+	Server    string    `json:"server"`
+	ServerID  string    `json:"server_id"`
+	VPN       string    `json:"vpn,omitempty"`
+	LatencyMs int64     `json:"latency_ms"`
+	Updated   time.Time `json:"updated"`
+}
+
+// Event is the JSON published to TopicEvents
+type Event struct {
+	Type   string    `json:"type"`
+	Server string    `json:"server,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// Publisher keeps a connection to the broker and publishes the state given to it.
+// The retained topics are published again after every reconnect. A Publisher with
+// no broker configured does nothing.
+type Publisher struct {
+	cfg    config.MQTT
+	logger *logger.Logger
+	dial   func(ctx context.Context) (net.Conn, error)
+
+	mutex sync.Mutex
+	state State
+	// retained holds the latest payload of each retained topic, unsent the topics
+	// changed since they were last published
+	retained map[string][]byte
+	unsent   map[string]bool
+	events   [][]byte
+	wake     chan struct{}
+}
+
+// NewPublisher creates the publisher of cfg, it connects in Run
+func NewPublisher(cfg config.MQTT, log *logger.Logger) *Publisher {
+	p := &Publisher{
+		cfg:      cfg,
+		logger:   log,
+		retained: map[string][]byte{TopicStatus: []byte("online")},
+		unsent:   map[string]bool{TopicStatus: true},
+		wake:     make(chan struct{}, 1),
+	}
+	p.dial = p.dialBroker
+	return p
+}
+
+// Run publishes until ctx is done, reconnecting when the connection is lost
+func (p *Publisher) Run(ctx context.Context) {
+	if p == nil || !p.cfg.Enabled() {
+		return
+	}
+	delay := minReconnectDelay
+	for {
+		connected, err := p.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			delay = minReconnectDelay
+			p.logger.Warn("Lost connection to MQTT broker %s: %v", p.cfg.Broker, err)
+		} else {
+			p.logger.Warn("Failed to connect to MQTT broker %s: %v, retrying in %v", p.cfg.Broker, err, delay)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if !connected {
+			delay = min(delay*2, maxReconnectDelay)
+		}
+	}
+}
+
+// PublishSwitch publishes that server became the active server
+func (p *Publisher) PublishSwitch(server types.Server) {
+	if p == nil || !p.cfg.Enabled() {
+		return
+	}
+	p.mutex.Lock()
+	p.setServerUnsafe(server.ID, server.Name)
+	p.queueEventUnsafe(Event{Type: EventSwitch, Server: server.Name})
+	p.mutex.Unlock()
+	p.signal()
+}
+
+// PublishHealth publishes whether the active server answers and its latency. A change
+// of the VPN state is published as an event as well, the first report only sets it.
+func (p *Publisher) PublishHealth(server types.Server, up bool, latency time.Duration) {
+	if p == nil || !p.cfg.Enabled() {
+		return
+	}
+	vpn := "down"
+	if up {
+		vpn = "up"
+	}
+	p.mutex.Lock()
+	previous := p.state.VPN
+	p.setServerUnsafe(server.ID, server.Name)
+	p.state.VPN = vpn
+	p.setRetainedUnsafe(TopicVPN, []byte(vpn))
+	if up {
+		p.state.LatencyMs = latency.Milliseconds()
+		p.setRetainedUnsafe(TopicLatency, []byte(strconv.FormatInt(p.state.LatencyMs, 10)))
+	}
+	p.setStateUnsafe()
+	if previous != "" && previous != vpn {
+		event := EventVPNDown
+		if up {
+			event = EventVPNUp
+		}
+		p.queueEventUnsafe(Event{Type: event, Server: server.Name})
+	}
+	p.mutex.Unlock()
+	p.signal()
+}
+
+// PublishEvent publishes an event that does not change the state, e.g. a latency
+// anomaly
+func (p *Publisher) PublishEvent(event Event) {
+	if p == nil || !p.cfg.Enabled() {
+		return
+	}
+	p.mutex.Lock()
+	p.queueEventUnsafe(event)
+	p.mutex.Unlock()
+	p.signal()
+}
+
+func (p *Publisher) setServerUnsafe(id, name string) {
+	if p.state.ServerID == id && p.state.Server == name {
+		return
+	}
+	p.state.ServerID = id
+	p.state.Server = name
+	p.setRetainedUnsafe(TopicServer, []byte(name))
+	p.setStateUnsafe()
+}
+
+func (p *Publisher) setStateUnsafe() {
+	p.state.Updated = time.Now()
+	data, err := json.Marshal(p.state)
+	if err != nil {
+		return
+	}
+	p.setRetainedUnsafe(TopicState, data)
+}
+
+func (p *Publisher) setRetainedUnsafe(topic string, payload []byte) {
+	p.retained[topic] = payload
+	p.unsent[topic] = true
+}
+
+func (p *Publisher) queueEventUnsafe(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	if len(p.events) >= maxQueuedEvents {
+		p.events = p.events[1:]
+	}
+	p.events = append(p.events, data)
+}
+
+// signal wakes the session up to publish what changed
+func (p *Publisher) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Publisher) topic(name string) string {
+	return p.cfg.TopicPrefix + "/" + name
+}
+
+// session connects to the broker and publishes until the connection is lost or ctx is
+// done. It reports whether the broker accepted the connection.
+func (p *Publisher) session(ctx context.Context) (bool, error) {
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if err := p.connect(conn, reader); err != nil {
+		return false, err
+	}
+	p.logger.Info("Connected to MQTT broker %s, publishing to %s/#", p.cfg.Broker, p.cfg.TopicPrefix)
+
+	// Everything is published again, the broker may have lost the retained values
+	p.mutex.Lock()
+	for topic := range p.retained {
+		p.unsent[topic] = true
+	}
+	p.mutex.Unlock()
+
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			_ = conn.SetReadDeadline(time.Now().Add(2 * keepAlive))
+			if _, _, err := readPacket(reader); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+	ping := time.NewTicker(keepAlive)
+	defer ping.Stop()
+	for {
+		if err := p.flush(conn); err != nil {
+			return true, err
+		}
+		select {
+		case <-ctx.Done():
+			// A clean disconnect does not trigger the will, so the status is set here
+			_ = p.write(conn, publishPacket(p.topic(TopicStatus), []byte("offline"), true))
+			_ = p.write(conn, []byte{packetDisconnect, 0})
+			return true, ctx.Err()
+		case err := <-readErr:
+			return true, err
+		case <-ping.C:
+			if err := p.write(conn, []byte{packetPingreq, 0}); err != nil {
+				return true, err
+			}
+		case <-p.wake:
+		}
+	}
+}
+
+// connect sends CONNECT with "offline" as the will of TopicStatus and waits for the
+// broker to accept it
+func (p *Publisher) connect(conn net.Conn, reader *bufio.Reader) error {
+	packet := connectPacket{
+		ClientID:    p.cfg.ClientID,
+		Username:    p.cfg.Username,
+		Password:    p.cfg.Password,
+		KeepAlive:   uint16(keepAlive / time.Second),
+		WillTopic:   p.topic(TopicStatus),
+		WillPayload: "offline",
+	}
+	if err := p.write(conn, packet.encode()); err != nil {
+		return fmt.Errorf("failed to send CONNECT: %w", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	header, body, err := readPacket(reader)
+	if err != nil {
+		return fmt.Errorf("no answer to CONNECT: %w", err)
+	}
+	return checkConnack(header, body)
+}
+
+// flush publishes the changed retained topics and the queued events. What could not
+// be written is published again after the reconnect.
+func (p *Publisher) flush(conn net.Conn) error {
+	p.mutex.Lock()
+	topics := make([]string, 0, len(p.unsent))
+	for topic := range p.unsent {
+		topics = append(topics, topic)
+	}
+	// The status first, then the rest in a stable order
+	sort.Slice(topics, func(i, j int) bool {
+		if (topics[i] == TopicStatus) != (topics[j] == TopicStatus) {
+			return topics[i] == TopicStatus
+		}
+		return topics[i] < topics[j]
+	})
+	payloads := make([][]byte, len(topics))
+	for i, topic := range topics {
+		payloads[i] = p.retained[topic]
+	}
+	p.unsent = make(map[string]bool)
+	events := p.events
+	p.events = nil
+	p.mutex.Unlock()
+
+	for i, topic := range topics {
+		if err := p.write(conn, publishPacket(p.topic(topic), payloads[i], true)); err != nil {
+			p.requeue(events)
+			return err
+		}
+	}
+	for i, event := range events {
+		if err := p.write(conn, publishPacket(p.topic(TopicEvents), event, false)); err != nil {
+			p.requeue(events[i:])
+			return err
+		}
+	}
+	return nil
+}
+
+// requeue puts events that were not sent before the ones queued since
+func (p *Publisher) requeue(events [][]byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.events = append(append([][]byte(nil), events...), p.events...)
+	if len(p.events) > maxQueuedEvents {
+		p.events = p.events[len(p.events)-maxQueuedEvents:]
+	}
+}
+
+func (p *Publisher) write(conn net.Conn, data []byte) error {
+	_ = conn.SetWriteDeadline(time.Now().Add(connectTimeout))
+	_, err := conn.Write(data)
+	return err
+}
+
+// dialBroker opens the TCP or TLS connection to the configured broker
+func (p *Publisher) dialBroker(ctx context.Context) (net.Conn, error) {
+	address, useTLS, err := p.cfg.Address()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: connectTimeout}
+	if useTLS {
+		host, _, _ := net.SplitHostPort(address)
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}
+		return tlsDialer.DialContext(ctx, "tcp", address)
+	}
+	return dialer.DialContext(ctx, "tcp", address)
+}
@@ -0,0 +1,167 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/logger"
+	"xray-telegram-manager/types"
+)
+
+// fakeBroker is the broker end of a connection to a publisher
+type fakeBroker struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type message struct {
+	topic   string
+	payload string
+	retain  bool
+}
+
+func newTestPublisher(t *testing.T) (*Publisher, *fakeBroker) {
+	cfg := config.MQTT{Broker: "broker.lan", TopicPrefix: "home/vpn", ClientID: "test", Username: "user", Password: "secret"}
+	publisher := NewPublisher(cfg, logger.NewLogger(logger.ERROR, nil))
+	client, server := net.Pipe()
+	publisher.dial = func(context.Context) (net.Conn, error) { return client, nil }
+	t.Cleanup(func() { server.Close() })
+	return publisher, &fakeBroker{t: t, conn: server, reader: bufio.NewReader(server)}
+}
+
+func (b *fakeBroker) read() (byte, []byte) {
+	b.t.Helper()
+	_ = b.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header, body, err := readPacket(b.reader)
+	if err != nil {
+		b.t.Fatalf("Failed to read packet: %v", err)
+	}
+	return header, body
+}
+
+// publishes reads count PUBLISH packets
+func (b *fakeBroker) publishes(count int) map[string]message {
+	b.t.Helper()
+	messages := make(map[string]message)
+	for i := 0; i < count; i++ {
+		header, body := b.read()
+		if header&0xf0 != packetPublish {
+			b.t.Fatalf("Expected PUBLISH, got packet type %d", header>>4)
+		}
+		length := int(binary.BigEndian.Uint16(body))
+		msg := message{topic: string(body[2 : 2+length]), payload: string(body[2+length:]), retain: header&0x01 != 0}
+		messages[msg.topic] = msg
+	}
+	return messages
+}
+
+func TestPublisherPublishesStateAndEvents(t *testing.T) {
+	publisher, broker := newTestPublisher(t)
+	amsterdam := types.Server{ID: "ams", Name: "Amsterdam"}
+	publisher.PublishHealth(amsterdam, true, 42*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		publisher.Run(ctx)
+		close(done)
+	}()
+
+	header, body := broker.read()
+	if header != packetConnect {
+		t.Fatalf("Expected CONNECT, got %#x", header)
+	}
+	// Clean session, a retained will, username and password
+	if flags := body[7]; flags != 0xe6 {
+		t.Errorf("Unexpected CONNECT flags %#x", flags)
+	}
+	if !bytes.Contains(body, []byte("home/vpn/status")) || !bytes.Contains(body, []byte("offline")) {
+		t.Errorf("Expected the status topic as will, got %q", body)
+	}
+	if _, err := broker.conn.Write([]byte{packetConnack, 2, 0, 0}); err != nil {
+		t.Fatalf("Failed to send CONNACK: %v", err)
+	}
+
+	messages := broker.publishes(5)
+	for topic, expected := range map[string]string{
+		"home/vpn/status":  "online",
+		"home/vpn/vpn":     "up",
+		"home/vpn/server":  "Amsterdam",
+		"home/vpn/latency": "42",
+	} {
+		if msg := messages[topic]; msg.payload != expected || !msg.retain {
+			t.Errorf("Expected retained %s on %s, got %+v", expected, topic, msg)
+		}
+	}
+	var state State
+	if err := json.Unmarshal([]byte(messages["home/vpn/state"].payload), &state); err != nil || state.Server != "Amsterdam" || state.VPN != "up" || state.LatencyMs != 42 {
+		t.Errorf("Unexpected state %q: %v", messages["home/vpn/state"].payload, err)
+	}
+
+	publisher.PublishHealth(amsterdam, false, 0)
+	messages = broker.publishes(3)
+	if messages["home/vpn/vpn"].payload != "down" {
+		t.Errorf("Expected the VPN to be down, got %+v", messages)
+	}
+	if event := messages["home/vpn/events"]; event.retain || !strings.Contains(event.payload, `"type":"vpn_down"`) {
+		t.Errorf("Expected a vpn_down event, got %+v", event)
+	}
+
+	publisher.PublishSwitch(types.Server{ID: "ber", Name: "Berlin"})
+	messages = broker.publishes(3)
+	if messages["home/vpn/server"].payload != "Berlin" || !strings.Contains(messages["home/vpn/events"].payload, `"server":"Berlin"`) {
+		t.Errorf("Expected the switch to Berlin, got %+v", messages)
+	}
+
+	cancel()
+	if messages := broker.publishes(1); messages["home/vpn/status"].payload != "offline" {
+		t.Errorf("Expected offline status before disconnecting, got %+v", messages)
+	}
+	if header, _ := broker.read(); header != packetDisconnect {
+		t.Errorf("Expected DISCONNECT, got %#x", header)
+	}
+	<-done
+}
+
+func TestPublisherQueuesEventsWhileDisconnected(t *testing.T) {
+	publisher := NewPublisher(config.MQTT{Broker: "broker.lan", TopicPrefix: "vpn"}, logger.NewLogger(logger.ERROR, nil))
+	for i := 0; i < maxQueuedEvents+5; i++ {
+		publisher.PublishEvent(Event{Type: EventLatencyAnomaly})
+	}
+	if len(publisher.events) != maxQueuedEvents {
+		t.Errorf("Expected %d queued events, got %d", maxQueuedEvents, len(publisher.events))
+	}
+
+	disabled := NewPublisher(config.MQTT{}, nil)
+	disabled.PublishSwitch(types.Server{Name: "Amsterdam"})
+	if len(disabled.events) != 0 {
+		t.Error("Expected a publisher without broker to publish nothing")
+	}
+}
+
+func TestPacketEncoding(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 300)
+	data := publishPacket("a/b", payload, true)
+	header, body, err := readPacket(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("readPacket failed: %v", err)
+	}
+	if header != packetPublish|0x01 || len(body) != 2+3+300 {
+		t.Errorf("Unexpected packet %#x with %d bytes", header, len(body))
+	}
+
+	if err := checkConnack(packetConnack, []byte{0, 4}); err == nil || !strings.Contains(err.Error(), "bad username or password") {
+		t.Errorf("Expected the refusal reason, got %v", err)
+	}
+	if err := checkConnack(packetConnack, []byte{0, 0}); err != nil {
+		t.Errorf("Expected the connection to be accepted, got %v", err)
+	}
+}
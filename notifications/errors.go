@@ -0,0 +1,119 @@
+package notifications
+
+import (
+	"sync"
+	"time"
+	"xray-telegram-manager/clock"
+)
+
+// ErrorNoticeKind tells what changed about a background error
+type ErrorNoticeKind int
+
+const (
+	// ErrorStarted is the first failure of a source, or a failure with a new error
+	ErrorStarted ErrorNoticeKind = iota
+	// ErrorRepeated summarizes the identical failures of the last window
+	ErrorRepeated
+	// ErrorRecovered is the first success after a reported failure
+	ErrorRecovered
+)
+
+// ErrorNotice is a notification about a failing background task
+type ErrorNotice struct {
+	Kind    ErrorNoticeKind
+	Source  string
+	Message string
+	// Count is the number of failures since the previous notice of the source
+	Count int
+	// Total is the number of failures since the error started
+	Total int
+	// Since is when the error started
+	Since time.Time
+	// Period is the time since the previous notice of the source
+	Period time.Duration
+}
+
+// errorState is the current error of a source
+type errorState struct {
+	message      string
+	since        time.Time
+	lastNotified time.Time
+	total        int
+	// failures since lastNotified
+	count int
+}
+
+// ErrorAggregator turns the results of background tasks into notices, so an error
+// that repeats on every run is reported once, then summarized at most once per
+// window, and a notice follows when the task works again
+type ErrorAggregator struct {
+	mutex  sync.Mutex
+	window time.Duration
+	clock  clock.Clock
+	states map[string]*errorState
+}
+
+// NewErrorAggregator creates an aggregator that repeats an unchanged error at most
+// once per window
+func NewErrorAggregator(window time.Duration) *ErrorAggregator {
+	return &ErrorAggregator{
+		window: window,
+		clock:  clock.Real,
+		states: make(map[string]*errorState),
+	}
+}
+
+// SetClock replaces the clock of the aggregator, for tests
+func (a *ErrorAggregator) SetClock(c clock.Clock) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.clock = c
+}
+
+// Record registers the result of a run of source, err is nil on success. It returns
+// the notice to send, or nil when the result is not worth a notification.
+func (a *ErrorAggregator) Record(source string, err error) *ErrorNotice {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := a.clock.Now()
+	state := a.states[source]
+	if err == nil {
+		if state == nil {
+			return nil
+		}
+		delete(a.states, source)
+		return &ErrorNotice{
+			Kind:    ErrorRecovered,
+			Source:  source,
+			Message: state.message,
+			Total:   state.total,
+			Since:   state.since,
+			Period:  now.Sub(state.since),
+		}
+	}
+
+	message := err.Error()
+	if state == nil || state.message != message {
+		a.states[source] = &errorState{message: message, since: now, lastNotified: now, total: 1}
+		return &ErrorNotice{Kind: ErrorStarted, Source: source, Message: message, Count: 1, Total: 1, Since: now}
+	}
+
+	state.total++
+	state.count++
+	if now.Sub(state.lastNotified) < a.window {
+		return nil
+	}
+	notice := &ErrorNotice{
+		Kind:    ErrorRepeated,
+		Source:  source,
+		Message: message,
+		Count:   state.count,
+		Total:   state.total,
+		Since:   state.since,
+		Period:  now.Sub(state.lastNotified),
+	}
+	state.lastNotified = now
+	state.count = 0
+	return notice
+}
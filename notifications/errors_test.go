@@ -0,0 +1,59 @@
+package notifications
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"xray-telegram-manager/clock"
+)
+
+func TestErrorAggregator(t *testing.T) {
+	start := time.Date(2024, 3, 10, 14, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	aggregator := NewErrorAggregator(time.Hour)
+	aggregator.SetClock(fake)
+	down := errors.New("subscription returned HTTP 502")
+
+	if notice := aggregator.Record("refresh", nil); notice != nil {
+		t.Fatalf("Expected no notice for a success without an error, got %+v", notice)
+	}
+
+	notice := aggregator.Record("refresh", down)
+	if notice == nil || notice.Kind != ErrorStarted || notice.Total != 1 {
+		t.Fatalf("Expected the first failure to be reported, got %+v", notice)
+	}
+
+	// Identical failures within the window are held back
+	for i := 0; i < 11; i++ {
+		fake.Advance(5 * time.Minute)
+		if notice := aggregator.Record("refresh", down); notice != nil {
+			t.Fatalf("Expected repeated failure %d to be held back, got %+v", i+1, notice)
+		}
+	}
+	fake.Advance(5 * time.Minute)
+	notice = aggregator.Record("refresh", down)
+	if notice == nil || notice.Kind != ErrorRepeated || notice.Count != 12 || notice.Total != 13 || notice.Period != time.Hour {
+		t.Fatalf("Expected a summary of 12 failures in the last hour, got %+v", notice)
+	}
+
+	// Other sources are tracked on their own
+	if notice := aggregator.Record("availability", down); notice == nil || notice.Kind != ErrorStarted {
+		t.Errorf("Expected the failure of another source to be reported, got %+v", notice)
+	}
+
+	// A different error is reported right away
+	fake.Advance(time.Minute)
+	timeout := errors.New("context deadline exceeded")
+	if notice := aggregator.Record("refresh", timeout); notice == nil || notice.Kind != ErrorStarted || notice.Message != timeout.Error() {
+		t.Errorf("Expected a new error to be reported, got %+v", notice)
+	}
+
+	fake.Advance(10 * time.Minute)
+	notice = aggregator.Record("refresh", nil)
+	if notice == nil || notice.Kind != ErrorRecovered || notice.Period != 10*time.Minute {
+		t.Fatalf("Expected a recovery after 10 minutes, got %+v", notice)
+	}
+	if notice := aggregator.Record("refresh", nil); notice != nil {
+		t.Errorf("Expected the recovery to be reported once, got %+v", notice)
+	}
+}
@@ -0,0 +1,201 @@
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"xray-telegram-manager/fsutil"
+)
+
+// Event is a kind of proactive notification sent by the bot
+type Event string
+
+const (
+	EventUpdateAvailable    Event = "update_available"
+	EventHealthAlert        Event = "health_alert"
+	EventAutoSwitch         Event = "auto_switch"
+	EventSubscriptionChange Event = "subscription_change"
+	EventQuotaWarning       Event = "quota_warning"
+	EventSecurityAlert      Event = "security_alert"
+	EventPingDigest         Event = "ping_digest"
+	EventErrorAlert         Event = "error_alert"
+	EventAdminAction        Event = "admin_action"
+	EventAddressChange      Event = "address_change"
+	EventLatencyAnomaly     Event = "latency_anomaly"
+)
+
+// Events lists all notification events in menu order
+var Events = []Event{
+	EventUpdateAvailable,
+	EventHealthAlert,
+	EventAutoSwitch,
+	EventSubscriptionChange,
+	EventQuotaWarning,
+	EventSecurityAlert,
+	EventPingDigest,
+	EventErrorAlert,
+	EventAdminAction,
+	EventAddressChange,
+	EventLatencyAnomaly,
+}
+
+// IsValid reports whether e is a known event
+func (e Event) IsValid() bool {
+	for _, event := range Events {
+		if event == e {
+			return true
+		}
+	}
+	return false
+}
+
+// IsCritical reports whether the event is delivered even during quiet hours
+func (e Event) IsCritical() bool {
+	return e == EventHealthAlert || e == EventSecurityAlert
+}
+
+// DisplayName returns a human readable name of the event
+func (e Event) DisplayName() string {
+	switch e {
+	case EventUpdateAvailable:
+		return "Update available"
+	case EventHealthAlert:
+		return "Health alerts"
+	case EventAutoSwitch:
+		return "Auto-switches"
+	case EventSubscriptionChange:
+		return "Subscription changes"
+	case EventQuotaWarning:
+		return "Quota warnings"
+	case EventSecurityAlert:
+		return "Security alerts"
+	case EventPingDigest:
+		return "Daily ping digest"
+	case EventErrorAlert:
+		return "Background errors"
+	case EventAdminAction:
+		return "Actions of other admins"
+	case EventAddressChange:
+		return "Server IP changes"
+	case EventLatencyAnomaly:
+		return "Latency spikes"
+	default:
+		return string(e)
+	}
+}
+
+// Preference controls whether an event is sent and whether it makes a sound
+type Preference struct {
+	Enabled bool `json:"enabled"`
+	// Silent sends the message with disable_notification
+	Silent bool `json:"silent"`
+}
+
+// DefaultPreference returns the preference used until the user changes it
+func DefaultPreference(event Event) Preference {
+	return Preference{Enabled: true, Silent: event == EventSubscriptionChange || event == EventPingDigest}
+}
+
+// storeFile is the on-disk format of the preferences
+type storeFile struct {
+	Events              map[Event]Preference `json:"events"`
+	LastNotifiedVersion string               `json:"last_notified_version,omitempty"`
+}
+
+// Store keeps notification preferences in a JSON file
+type Store struct {
+	path  string
+	mutex sync.RWMutex
+	data  storeFile
+}
+
+// NewStore loads preferences from path. A missing file gives the defaults.
+func NewStore(path string) (*Store, error) {
+	store := &Store{
+		path: path,
+		data: storeFile{Events: make(map[Event]Preference)},
+	}
+
+	if path == "" {
+		return store, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return store, fmt.Errorf("failed to read notification preferences: %w", err)
+	}
+	if err := json.Unmarshal(data, &store.data); err != nil {
+		return store, fmt.Errorf("failed to parse notification preferences: %w", err)
+	}
+	if store.data.Events == nil {
+		store.data.Events = make(map[Event]Preference)
+	}
+	return store, nil
+}
+
+// Get returns the preference for an event
+func (s *Store) Get(event Event) Preference {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if pref, ok := s.data.Events[event]; ok {
+		return pref
+	}
+	return DefaultPreference(event)
+}
+
+// ToggleEnabled switches an event on or off and saves the preferences
+func (s *Store) ToggleEnabled(event Event) (Preference, error) {
+	return s.update(event, func(pref *Preference) { pref.Enabled = !pref.Enabled })
+}
+
+// ToggleSilent switches an event between silent and normal delivery and saves the preferences
+func (s *Store) ToggleSilent(event Event) (Preference, error) {
+	return s.update(event, func(pref *Preference) { pref.Silent = !pref.Silent })
+}
+
+// LastNotifiedVersion returns the latest release the user was told about
+func (s *Store) LastNotifiedVersion() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.data.LastNotifiedVersion
+}
+
+// SetLastNotifiedVersion records that the user was told about version
+func (s *Store) SetLastNotifiedVersion(version string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.LastNotifiedVersion = version
+	return s.saveUnsafe()
+}
+func (s *Store) update(event Event, change func(pref *Preference)) (Preference, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pref, ok := s.data.Events[event]
+	if !ok {
+		pref = DefaultPreference(event)
+	}
+	change(&pref)
+	s.data.Events[event] = pref
+	return pref, s.saveUnsafe()
+}
+func (s *Store) saveUnsafe() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification preferences: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create preferences directory: %w", err)
+	}
+	if err := fsutil.WriteShared(s.path, data); err != nil {
+		return fmt.Errorf("failed to save notification preferences: %w", err)
+	}
+	return nil
+}
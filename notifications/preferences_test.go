@@ -0,0 +1,45 @@
+package notifications
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStorePersistsPreferences(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifications.json")
+
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	if pref := store.Get(EventHealthAlert); !pref.Enabled || pref.Silent {
+		t.Errorf("Expected health alerts enabled and audible by default, got %+v", pref)
+	}
+	if pref := store.Get(EventSubscriptionChange); !pref.Silent {
+		t.Errorf("Expected subscription changes to be silent by default, got %+v", pref)
+	}
+
+	if _, err := store.ToggleEnabled(EventUpdateAvailable); err != nil {
+		t.Fatalf("ToggleEnabled failed: %v", err)
+	}
+	if _, err := store.ToggleSilent(EventHealthAlert); err != nil {
+		t.Fatalf("ToggleSilent failed: %v", err)
+	}
+	if err := store.SetLastNotifiedVersion("v1.2.3"); err != nil {
+		t.Fatalf("SetLastNotifiedVersion failed: %v", err)
+	}
+
+	reloaded, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("Reloading store failed: %v", err)
+	}
+	if reloaded.Get(EventUpdateAvailable).Enabled {
+		t.Error("Expected update notifications to stay disabled after reload")
+	}
+	if !reloaded.Get(EventHealthAlert).Silent {
+		t.Error("Expected health alerts to stay silent after reload")
+	}
+	if reloaded.LastNotifiedVersion() != "v1.2.3" {
+		t.Errorf("Expected last notified version v1.2.3, got %q", reloaded.LastNotifiedVersion())
+	}
+}
@@ -0,0 +1,258 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// OperationType identifies a long-running operation that touches shared state
+type OperationType string
+
+const (
+	OperationPingTest OperationType = "ping_test"
+	OperationRefresh  OperationType = "subscription_refresh"
+	OperationSwitch   OperationType = "server_switch"
+	OperationUpdate   OperationType = "bot_update"
+	OperationDirect   OperationType = "direct_mode"
+	OperationRestore  OperationType = "backup_restore"
+	OperationRouting  OperationType = "routing_change"
+	OperationRecover  OperationType = "config_recovery"
+	OperationInbounds OperationType = "inbounds_change"
+	// OperationReachTest opens a site through a server with a temporary xray instance
+	OperationReachTest OperationType = "reach_test"
+)
+
+// Resource is a piece of shared state that operations lock while running
+type Resource string
+
+const (
+	ResourceServerList Resource = "server_list"
+	ResourceXrayConfig Resource = "xray_config"
+	ResourceBotBinary  Resource = "bot_binary"
+)
+
+// operationResources lists the resources each operation needs exclusively.
+// Two operations conflict when they share at least one resource.
+var operationResources = map[OperationType][]Resource{
+	OperationPingTest: {ResourceServerList},
+	OperationRefresh:  {ResourceServerList},
+	OperationSwitch:   {ResourceServerList, ResourceXrayConfig},
+	OperationUpdate:   {ResourceXrayConfig, ResourceBotBinary},
+	OperationDirect:   {ResourceXrayConfig},
+	OperationRestore:  {ResourceServerList, ResourceXrayConfig, ResourceBotBinary},
+	OperationRouting:  {ResourceXrayConfig},
+	OperationRecover:  {ResourceXrayConfig},
+	OperationInbounds: {ResourceXrayConfig},
+	// Reach tests run one at a time next to ping tests, they start a second xray
+	OperationReachTest: {ResourceServerList},
+}
+
+// ConflictPolicy decides what happens when a conflicting operation is already running
+type ConflictPolicy int
+
+const (
+	// PolicyReject fails immediately with an OperationInProgressError
+	PolicyReject ConflictPolicy = iota
+	// PolicyQueue waits until the conflicting operations finish or the context is done
+	PolicyQueue
+)
+
+// Operation describes a running operation
+type Operation struct {
+	ID        uint64
+	Type      OperationType
+	Owner     int64
+	StartedAt time.Time
+	// Progress message of the operation, if any, so other requests can point to it
+	ChatID    int64
+	MessageID int
+}
+
+// OperationInProgressError is returned when an operation is rejected because of a conflict
+type OperationInProgressError struct {
+	Requested OperationType
+	Active    Operation
+}
+
+func (e *OperationInProgressError) Error() string {
+	return fmt.Sprintf("cannot start %s: %s is already in progress (started %s ago)",
+		e.Requested.DisplayName(), e.Active.Type.DisplayName(), time.Since(e.Active.StartedAt).Round(time.Second))
+}
+
+// DisplayName returns a human readable name of the operation type
+func (t OperationType) DisplayName() string {
+	switch t {
+	case OperationPingTest:
+		return "ping test"
+	case OperationRefresh:
+		return "subscription refresh"
+	case OperationSwitch:
+		return "server switch"
+	case OperationUpdate:
+		return "bot update"
+	case OperationDirect:
+		return "direct mode toggle"
+	case OperationRestore:
+		return "backup restore"
+	case OperationRouting:
+		return "routing change"
+	case OperationRecover:
+		return "config recovery"
+	case OperationInbounds:
+		return "inbounds change"
+	case OperationReachTest:
+		return "site reach test"
+	default:
+		return string(t)
+	}
+}
+
+// Coordinator serializes conflicting operations per resource
+type Coordinator struct {
+	mutex   sync.Mutex
+	nextID  uint64
+	active  map[uint64]*Operation
+	locks   map[Resource]uint64
+	changed chan struct{}
+}
+
+// NewCoordinator creates a new Coordinator instance
+func NewCoordinator() *Coordinator {
+	return &Coordinator{
+		active:  make(map[uint64]*Operation),
+		locks:   make(map[Resource]uint64),
+		changed: make(chan struct{}),
+	}
+}
+
+// Acquire locks the resources needed by the operation. The returned release
+// function must be called once the operation is finished.
+func (c *Coordinator) Acquire(ctx context.Context, opType OperationType, owner int64, policy ConflictPolicy) (*Operation, func(), error) {
+	resources, ok := operationResources[opType]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown operation type: %s", opType)
+	}
+
+	for {
+		c.mutex.Lock()
+		conflict := c.findConflictUnsafe(resources)
+		if conflict == nil {
+			op := c.startUnsafe(opType, owner, resources)
+			c.mutex.Unlock()
+			return op, c.releaseFunc(op.ID), nil
+		}
+
+		if policy == PolicyReject {
+			active := *conflict
+			c.mutex.Unlock()
+			return nil, nil, &OperationInProgressError{Requested: opType, Active: active}
+		}
+
+		changed := c.changed
+		c.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("waiting for %s to finish: %w", conflict.Type.DisplayName(), ctx.Err())
+		case <-changed:
+			// Something was released, check again
+		}
+	}
+}
+
+// SetProgressMessage records the message that shows the progress of an operation
+func (c *Coordinator) SetProgressMessage(opID uint64, chatID int64, messageID int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if op, exists := c.active[opID]; exists {
+		op.ChatID = chatID
+		op.MessageID = messageID
+	}
+}
+
+// ActiveOperations returns a snapshot of the currently running operations
+func (c *Coordinator) ActiveOperations() []Operation {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	result := make([]Operation, 0, len(c.active))
+	for _, op := range c.active {
+		result = append(result, *op)
+	}
+	return result
+}
+
+// Holder returns the operation that currently holds resource
+func (c *Coordinator) Holder(resource Resource) (Operation, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	op, exists := c.active[c.locks[resource]]
+	if !exists {
+		return Operation{}, false
+	}
+	return *op, true
+}
+
+// IsRunning reports whether an operation of the given type is currently running
+func (c *Coordinator) IsRunning(opType OperationType) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, op := range c.active {
+		if op.Type == opType {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Coordinator) findConflictUnsafe(resources []Resource) *Operation {
+	for _, resource := range resources {
+		if holderID, locked := c.locks[resource]; locked {
+			return c.active[holderID]
+		}
+	}
+	return nil
+}
+
+func (c *Coordinator) startUnsafe(opType OperationType, owner int64, resources []Resource) *Operation {
+	c.nextID++
+	op := &Operation{
+		ID:        c.nextID,
+		Type:      opType,
+		Owner:     owner,
+		StartedAt: time.Now(),
+	}
+	c.active[op.ID] = op
+	for _, resource := range resources {
+		c.locks[resource] = op.ID
+	}
+
+	snapshot := *op
+	return &snapshot
+}
+
+func (c *Coordinator) releaseFunc(opID uint64) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+
+			delete(c.active, opID)
+			for resource, holderID := range c.locks {
+				if holderID == opID {
+					delete(c.locks, resource)
+				}
+			}
+
+			// Wake up queued operations
+			close(c.changed)
+			c.changed = make(chan struct{})
+		})
+	}
+}
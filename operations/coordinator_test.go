@@ -0,0 +1,146 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCoordinator_RejectsConflictingOperation(t *testing.T) {
+	c := NewCoordinator()
+
+	_, release, err := c.Acquire(context.Background(), OperationSwitch, 1, PolicyReject)
+	if err != nil {
+		t.Fatalf("Expected first acquire to succeed, got %v", err)
+	}
+	defer release()
+
+	_, _, err = c.Acquire(context.Background(), OperationRefresh, 1, PolicyReject)
+	if err == nil {
+		t.Fatal("Expected refresh to be rejected while switch is running")
+	}
+
+	var inProgress *OperationInProgressError
+	if !errors.As(err, &inProgress) {
+		t.Fatalf("Expected OperationInProgressError, got %T", err)
+	}
+	if inProgress.Active.Type != OperationSwitch {
+		t.Errorf("Expected active operation %s, got %s", OperationSwitch, inProgress.Active.Type)
+	}
+}
+
+func TestCoordinator_AllowsIndependentOperations(t *testing.T) {
+	c := NewCoordinator()
+
+	_, releasePing, err := c.Acquire(context.Background(), OperationPingTest, 1, PolicyReject)
+	if err != nil {
+		t.Fatalf("Expected ping acquire to succeed, got %v", err)
+	}
+	defer releasePing()
+
+	_, releaseUpdate, err := c.Acquire(context.Background(), OperationUpdate, 1, PolicyReject)
+	if err != nil {
+		t.Fatalf("Expected update to run alongside ping test, got %v", err)
+	}
+	defer releaseUpdate()
+
+	if len(c.ActiveOperations()) != 2 {
+		t.Errorf("Expected 2 active operations, got %d", len(c.ActiveOperations()))
+	}
+}
+
+func TestCoordinator_QueueWaitsForRelease(t *testing.T) {
+	c := NewCoordinator()
+
+	_, release, err := c.Acquire(context.Background(), OperationSwitch, 1, PolicyReject)
+	if err != nil {
+		t.Fatalf("Expected first acquire to succeed, got %v", err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		_, releaseQueued, err := c.Acquire(context.Background(), OperationRefresh, 1, PolicyQueue)
+		if err == nil {
+			releaseQueued()
+		}
+		acquired <- err
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Queued operation should not start before release")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Errorf("Expected queued operation to succeed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Queued operation did not start after release")
+	}
+
+	if c.IsRunning(OperationSwitch) || c.IsRunning(OperationRefresh) {
+		t.Error("Expected no running operations after release")
+	}
+}
+
+func TestCoordinator_QueueRespectsContext(t *testing.T) {
+	c := NewCoordinator()
+
+	_, release, err := c.Acquire(context.Background(), OperationUpdate, 1, PolicyReject)
+	if err != nil {
+		t.Fatalf("Expected first acquire to succeed, got %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, _, err = c.Acquire(ctx, OperationSwitch, 1, PolicyQueue)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestCoordinator_ProgressMessage(t *testing.T) {
+	c := NewCoordinator()
+
+	op, release, err := c.Acquire(context.Background(), OperationPingTest, 42, PolicyReject)
+	if err != nil {
+		t.Fatalf("Expected acquire to succeed, got %v", err)
+	}
+	defer release()
+
+	c.SetProgressMessage(op.ID, 42, 100)
+
+	_, _, err = c.Acquire(context.Background(), OperationPingTest, 42, PolicyReject)
+	var inProgress *OperationInProgressError
+	if !errors.As(err, &inProgress) {
+		t.Fatalf("Expected OperationInProgressError, got %v", err)
+	}
+	if inProgress.Active.ChatID != 42 || inProgress.Active.MessageID != 100 {
+		t.Errorf("Expected progress message 42/100, got %d/%d", inProgress.Active.ChatID, inProgress.Active.MessageID)
+	}
+}
+
+func TestCoordinator_ReleaseIsIdempotent(t *testing.T) {
+	c := NewCoordinator()
+
+	_, release, err := c.Acquire(context.Background(), OperationRefresh, 1, PolicyReject)
+	if err != nil {
+		t.Fatalf("Expected acquire to succeed, got %v", err)
+	}
+	release()
+	release()
+
+	if _, releaseAgain, err := c.Acquire(context.Background(), OperationRefresh, 1, PolicyReject); err != nil {
+		t.Errorf("Expected acquire after release to succeed, got %v", err)
+	} else {
+		releaseAgain()
+	}
+}
@@ -0,0 +1,186 @@
+package pending
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"xray-telegram-manager/fsutil"
+)
+
+const (
+	// maxActions bounds the actions waiting at the same time
+	maxActions = 10
+	// minLead is how far in the future an action has to be scheduled
+	minLead = time.Minute
+	// maxLead is how far in the future an action can be scheduled
+	maxLead = 7 * 24 * time.Hour
+)
+
+// Kind is what a pending action does
+type Kind string
+
+const (
+	// KindSwitch switches to a server
+	KindSwitch Kind = "switch"
+)
+
+// Action is an action scheduled for a later time
+type Action struct {
+	ID   string    `json:"id"`
+	Kind Kind      `json:"kind"`
+	At   time.Time `json:"at"`
+	// ServerID and ServerName are the target of a switch, the name is shown when the
+	// server left the subscription meanwhile
+	ServerID   string `json:"server_id"`
+	ServerName string `json:"server_name"`
+	// ChatID is where the action was scheduled and its result is reported
+	ChatID int64  `json:"chat_id"`
+	UserID int64  `json:"user_id"`
+	User   string `json:"user"`
+	// Created is when the action was scheduled
+	Created time.Time `json:"created"`
+}
+
+// storeFile is the on-disk format of the pending actions
+type storeFile struct {
+	Actions []Action `json:"actions"`
+}
+
+// Store keeps the pending actions in a JSON file, so they survive a restart
+type Store struct {
+	path  string
+	mutex sync.Mutex
+	data  storeFile
+}
+
+// NewStore loads the pending actions from path. A missing file gives an empty list.
+func NewStore(path string) (*Store, error) {
+	store := &Store{path: path}
+	if path == "" {
+		return store, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return store, fmt.Errorf("failed to read pending actions: %w", err)
+	}
+	if err := json.Unmarshal(data, &store.data); err != nil {
+		return store, fmt.Errorf("failed to parse pending actions: %w", err)
+	}
+	return store, nil
+}
+
+// Add schedules action and returns it with its ID
+func (s *Store) Add(action Action) (Action, error) {
+	if action.Created.IsZero() {
+		action.Created = time.Now()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.data.Actions) >= maxActions {
+		return Action{}, fmt.Errorf("%d actions are already scheduled, cancel one first", maxActions)
+	}
+	action.ID = strconv.FormatInt(action.Created.UnixNano(), 36)
+	s.data.Actions = append(s.data.Actions, action)
+	s.sortUnsafe()
+	return action, s.saveUnsafe()
+}
+
+// Remove cancels the action with the ID, false when it is not pending
+func (s *Store) Remove(id string) (Action, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, action := range s.data.Actions {
+		if action.ID == id {
+			s.data.Actions = append(s.data.Actions[:i:i], s.data.Actions[i+1:]...)
+			return action, true, s.saveUnsafe()
+		}
+	}
+	return Action{}, false, nil
+}
+
+// List returns the pending actions, the next one first
+func (s *Store) List() []Action {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Action(nil), s.data.Actions...)
+}
+
+// Take removes the actions due at now and returns them, the earliest first. An
+// action is taken once, also when running it fails.
+func (s *Store) Take(now time.Time) ([]Action, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var due, rest []Action
+	for _, action := range s.data.Actions {
+		if action.At.After(now) {
+			rest = append(rest, action)
+		} else {
+			due = append(due, action)
+		}
+	}
+	if len(due) == 0 {
+		return nil, nil
+	}
+	s.data.Actions = rest
+	return due, s.saveUnsafe()
+}
+
+func (s *Store) sortUnsafe() {
+	sort.SliceStable(s.data.Actions, func(i, j int) bool {
+		return s.data.Actions[i].At.Before(s.data.Actions[j].At)
+	})
+}
+
+func (s *Store) saveUnsafe() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal pending actions: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create pending actions directory: %w", err)
+	}
+	if err := fsutil.WriteShared(s.path, data); err != nil {
+		return fmt.Errorf("failed to save pending actions: %w", err)
+	}
+	return nil
+}
+
+// ParseTime reads when an action should run: a time of day like "02:00", the next
+// one after now in local time, or a delay like "in 2h", "30m" or "1h30m"
+func ParseTime(input string, now time.Time) (time.Time, error) {
+	value := strings.ToLower(strings.TrimSpace(input))
+	value = strings.TrimSpace(strings.TrimPrefix(value, "in "))
+	if value == "" {
+		return time.Time{}, fmt.Errorf("time is empty")
+	}
+	if clock, err := time.Parse("15:04", value); err == nil {
+		at := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		if at.Sub(now) < minLead {
+			return time.Time{}, fmt.Errorf("%s is less than a minute away", value)
+		}
+		return at, nil
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a time like 02:00 nor a delay like 2h or 30m", strings.TrimSpace(input))
+	}
+	if delay < minLead || delay > maxLead {
+		return time.Time{}, fmt.Errorf("delay must be between 1 minute and %d days", int(maxLead.Hours()/24))
+	}
+	return now.Add(delay).Truncate(time.Second), nil
+}
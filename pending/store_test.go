@@ -0,0 +1,94 @@
+package pending
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreTakesDueActions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pending.json")
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	start := time.Date(2026, 1, 2, 22, 0, 0, 0, time.UTC)
+	late, err := store.Add(Action{Kind: KindSwitch, At: start.Add(4 * time.Hour), ServerID: "b", ServerName: "Berlin", Created: start})
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	early, err := store.Add(Action{Kind: KindSwitch, At: start.Add(time.Hour), ServerID: "a", ServerName: "Amsterdam", Created: start.Add(time.Second)})
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if early.ID == "" || early.ID == late.ID {
+		t.Fatalf("Expected distinct IDs, got %q and %q", early.ID, late.ID)
+	}
+
+	reloaded, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("Reloading store failed: %v", err)
+	}
+	if list := reloaded.List(); len(list) != 2 || list[0].ServerID != "a" || list[1].ServerID != "b" {
+		t.Fatalf("Expected both actions, the next one first, got %+v", list)
+	}
+
+	due, err := reloaded.Take(start.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatalf("Take failed: %v", err)
+	}
+	if len(due) != 1 || due[0].ID != early.ID {
+		t.Fatalf("Expected the early action to be due, got %+v", due)
+	}
+	if due, _ := reloaded.Take(start.Add(2 * time.Hour)); len(due) != 0 {
+		t.Errorf("Expected a taken action not to be returned again, got %+v", due)
+	}
+
+	if _, ok, err := reloaded.Remove(late.ID); !ok || err != nil {
+		t.Fatalf("Expected the late action to be cancelled, got %t, %v", ok, err)
+	}
+	if _, ok, _ := reloaded.Remove(late.ID); ok {
+		t.Error("Expected a cancelled action to be gone")
+	}
+	if list := reloaded.List(); len(list) != 0 {
+		t.Errorf("Expected no pending actions, got %+v", list)
+	}
+}
+
+func TestStoreLimitsActions(t *testing.T) {
+	store, _ := NewStore("")
+	start := time.Date(2026, 1, 2, 22, 0, 0, 0, time.UTC)
+	for i := 0; i < maxActions; i++ {
+		if _, err := store.Add(Action{Kind: KindSwitch, At: start.Add(time.Hour), Created: start.Add(time.Duration(i))}); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	if _, err := store.Add(Action{Kind: KindSwitch, At: start.Add(time.Hour)}); err == nil {
+		t.Error("Expected an error above the limit")
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2026, 1, 2, 22, 30, 15, 0, time.UTC)
+	tests := []struct {
+		input string
+		want  time.Time
+	}{
+		{input: "02:00", want: time.Date(2026, 1, 3, 2, 0, 0, 0, time.UTC)},
+		{input: "23:15", want: time.Date(2026, 1, 2, 23, 15, 0, 0, time.UTC)},
+		{input: "in 2h", want: now.Add(2 * time.Hour)},
+		{input: " 30m ", want: now.Add(30 * time.Minute)},
+		{input: "1h30m", want: now.Add(90 * time.Minute)},
+	}
+	for _, tt := range tests {
+		got, err := ParseTime(tt.input, now)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("ParseTime(%q) = %v, %v; want %v", tt.input, got, err, tt.want)
+		}
+	}
+	for _, invalid := range []string{"", "tomorrow", "25:00", "30s", "200h", "22:31"} {
+		if _, err := ParseTime(invalid, now); err == nil {
+			t.Errorf("Expected ParseTime(%q) to fail", invalid)
+		}
+	}
+}
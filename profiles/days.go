@@ -0,0 +1,88 @@
+package profiles
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Days is a set of weekdays, bit 1<<time.Weekday for each
+type Days uint8
+
+const (
+	Weekdays Days = 1<<time.Monday | 1<<time.Tuesday | 1<<time.Wednesday | 1<<time.Thursday | 1<<time.Friday
+	Weekend  Days = 1<<time.Saturday | 1<<time.Sunday
+	EveryDay      = Weekdays | Weekend
+)
+
+// Has reports whether day is in the set
+func (d Days) Has(day time.Weekday) bool {
+	return d&(1<<day) != 0
+}
+
+// ParseDays reads days like "weekdays", "weekend", "mon-fri" or "mon,wed,fri". An empty
+// value or "daily" is every day.
+func ParseDays(value string) (Days, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch value {
+	case "", "daily", "every day", "everyday":
+		return EveryDay, nil
+	case "weekdays", "workdays":
+		return Weekdays, nil
+	case "weekend", "weekends":
+		return Weekend, nil
+	}
+	var days Days
+	for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := parseDay(first)
+		if err != nil {
+			return 0, err
+		}
+		to := from
+		if isRange {
+			if to, err = parseDay(last); err != nil {
+				return 0, err
+			}
+		}
+		// A range may wrap around the week, e.g. fri-mon
+		for day := from; ; day = (day + 1) % 7 {
+			days |= 1 << day
+			if day == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseDay reads a weekday from at least the first three letters of its name
+func parseDay(value string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if len(value) >= 3 && strings.HasPrefix(strings.ToLower(day.String()), value) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day %q, use mon..sun, weekdays or weekend", value)
+}
+
+// String names the days, e.g. "weekdays" or "Mon, Wed, Fri"
+func (d Days) String() string {
+	switch d {
+	case EveryDay:
+		return "every day"
+	case Weekdays:
+		return "weekdays"
+	case Weekend:
+		return "weekend"
+	}
+	var names []string
+	// Monday first
+	for i := 1; i <= 7; i++ {
+		day := time.Weekday(i % 7)
+		if d.Has(day) {
+			names = append(names, day.String()[:3])
+		}
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,391 @@
+// Package profiles keeps named server profiles and a weekly schedule that applies
+// them, e.g. "Work" at 09:00 on weekdays and "Streaming" at 20:00. A profile is only
+// applied when its time comes, so a server chosen by hand in between stays until the
+// next time of the schedule.
+package profiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+	"xray-telegram-manager/fsutil"
+	"xray-telegram-manager/scheduler"
+)
+
+const (
+	// maxProfiles and maxRules bound what the store keeps
+	maxProfiles = 10
+	maxRules    = 20
+	// maxNameLength keeps profile names short enough for buttons
+	maxNameLength = 24
+	// maxDelay drops a time of the schedule that passed longer ago, when the manager
+	// was not running then a switch much later would come unexpected
+	maxDelay = time.Hour
+)
+
+// Profile is a named server to switch to
+type Profile struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// ServerID and ServerName are the target of the profile, the name is shown when
+	// the server left the subscription meanwhile
+	ServerID   string `json:"server_id"`
+	ServerName string `json:"server_name"`
+}
+
+// Rule applies a profile at a time of day on some days of the week
+type Rule struct {
+	ID        string `json:"id"`
+	ProfileID string `json:"profile_id"`
+	// At is the time of day in local time, HH:MM
+	At      string `json:"at"`
+	Days    Days   `json:"days"`
+	Enabled bool   `json:"enabled"`
+}
+
+// Previous returns the last time of the rule at or before now
+func (r Rule) Previous(now time.Time) (time.Time, bool) {
+	daily, err := scheduler.ParseDaily(r.At)
+	if err != nil {
+		return time.Time{}, false
+	}
+	for i := 0; i <= 7; i++ {
+		at := daily.On(now.AddDate(0, 0, -i))
+		if !at.After(now) && r.Days.Has(at.Weekday()) {
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Next returns the first time of the rule after now
+func (r Rule) Next(now time.Time) (time.Time, bool) {
+	daily, err := scheduler.ParseDaily(r.At)
+	if err != nil {
+		return time.Time{}, false
+	}
+	for i := 0; i <= 7; i++ {
+		at := daily.On(now.AddDate(0, 0, i))
+		if at.After(now) && r.Days.Has(at.Weekday()) {
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Applied is the profile the schedule applied last
+type Applied struct {
+	ProfileID string    `json:"profile_id"`
+	At        time.Time `json:"at"`
+}
+
+// storeFile is the on-disk format of the profiles
+type storeFile struct {
+	Profiles []Profile `json:"profiles"`
+	Rules    []Rule    `json:"rules"`
+	Applied  *Applied  `json:"applied,omitempty"`
+	// Checked is when the schedule was last looked at, saved only when a rule was
+	// due to spare the flash of the router
+	Checked time.Time `json:"checked"`
+}
+
+// Store keeps the profiles and the schedule in a JSON file, so they survive a restart
+type Store struct {
+	path  string
+	mutex sync.Mutex
+	data  storeFile
+}
+
+// NewStore loads the profiles from path. A missing file gives an empty store.
+func NewStore(path string) (*Store, error) {
+	store := &Store{path: path}
+	if path == "" {
+		return store, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return store, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	if err := json.Unmarshal(data, &store.data); err != nil {
+		return store, fmt.Errorf("failed to parse profiles: %w", err)
+	}
+	return store, nil
+}
+
+// Profiles returns the profiles in the order they were added
+func (s *Store) Profiles() []Profile {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Profile(nil), s.data.Profiles...)
+}
+
+// Profile returns the profile with the ID
+func (s *Store) Profile(id string) (Profile, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	index := s.profileIndexUnsafe(id)
+	if index < 0 {
+		return Profile{}, false
+	}
+	return s.data.Profiles[index], true
+}
+
+// SaveProfile stores a profile named name for the server. A profile with the same
+// name, in any case, gets the new server and keeps its rules.
+func (s *Store) SaveProfile(name, serverID, serverName string) (Profile, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" || utf8.RuneCountInString(name) > maxNameLength {
+		return Profile{}, fmt.Errorf("profile name must have 1 to %d characters", maxNameLength)
+	}
+	if _, err := time.Parse("15:04", name); err == nil {
+		return Profile{}, fmt.Errorf("profile name must not be a time")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, profile := range s.data.Profiles {
+		if strings.EqualFold(profile.Name, name) {
+			profile.Name, profile.ServerID, profile.ServerName = name, serverID, serverName
+			s.data.Profiles[i] = profile
+			return profile, s.saveUnsafe()
+		}
+	}
+	if len(s.data.Profiles) >= maxProfiles {
+		return Profile{}, fmt.Errorf("%d profiles are already saved, delete one first", maxProfiles)
+	}
+	profile := Profile{ID: newID(), Name: name, ServerID: serverID, ServerName: serverName}
+	s.data.Profiles = append(s.data.Profiles, profile)
+	return profile, s.saveUnsafe()
+}
+
+// RemoveProfile deletes the profile with the ID and its rules, false when there is none
+func (s *Store) RemoveProfile(id string) (Profile, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	index := s.profileIndexUnsafe(id)
+	if index < 0 {
+		return Profile{}, false, nil
+	}
+	profile := s.data.Profiles[index]
+	s.data.Profiles = append(s.data.Profiles[:index:index], s.data.Profiles[index+1:]...)
+	var rules []Rule
+	for _, rule := range s.data.Rules {
+		if rule.ProfileID != id {
+			rules = append(rules, rule)
+		}
+	}
+	s.data.Rules = rules
+	if s.data.Applied != nil && s.data.Applied.ProfileID == id {
+		s.data.Applied = nil
+	}
+	return profile, true, s.saveUnsafe()
+}
+
+// Rules returns the rules sorted by their time of day
+func (s *Store) Rules() []Rule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Rule(nil), s.data.Rules...)
+}
+
+// AddRule parses a rule like "Work 09:00 weekdays" and adds it enabled. The profile
+// is matched by name in any case.
+func (s *Store) AddRule(input string) (Rule, Profile, error) {
+	name, at, days, err := ParseRule(input)
+	if err != nil {
+		return Rule{}, Profile{}, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var profile *Profile
+	for i := range s.data.Profiles {
+		if strings.EqualFold(s.data.Profiles[i].Name, name) {
+			profile = &s.data.Profiles[i]
+			break
+		}
+	}
+	if profile == nil {
+		return Rule{}, Profile{}, fmt.Errorf("there is no profile named %q", name)
+	}
+	if len(s.data.Rules) >= maxRules {
+		return Rule{}, Profile{}, fmt.Errorf("%d rules are already set, delete one first", maxRules)
+	}
+	for _, rule := range s.data.Rules {
+		if rule.At == at && rule.Days&days != 0 {
+			return Rule{}, Profile{}, fmt.Errorf("another rule already runs at %s on some of these days", at)
+		}
+	}
+	rule := Rule{ID: newID(), ProfileID: profile.ID, At: at, Days: days, Enabled: true}
+	s.data.Rules = append(s.data.Rules, rule)
+	sort.SliceStable(s.data.Rules, func(i, j int) bool { return s.data.Rules[i].At < s.data.Rules[j].At })
+	return rule, *profile, s.saveUnsafe()
+}
+
+// RemoveRule deletes the rule with the ID, false when there is none
+func (s *Store) RemoveRule(id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, rule := range s.data.Rules {
+		if rule.ID == id {
+			s.data.Rules = append(s.data.Rules[:i:i], s.data.Rules[i+1:]...)
+			return true, s.saveUnsafe()
+		}
+	}
+	return false, nil
+}
+
+// ToggleRule pauses or resumes the rule with the ID and returns whether it is enabled
+func (s *Store) ToggleRule(id string) (bool, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range s.data.Rules {
+		if s.data.Rules[i].ID == id {
+			s.data.Rules[i].Enabled = !s.data.Rules[i].Enabled
+			return s.data.Rules[i].Enabled, true, s.saveUnsafe()
+		}
+	}
+	return false, false, nil
+}
+
+// Due returns the enabled rule whose time passed last since the previous call, with
+// that time. The first call only starts counting. A time that passed more than
+// maxDelay ago, while the manager was not running, is skipped.
+func (s *Store) Due(now time.Time) (Rule, time.Time, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	checked := s.data.Checked
+	s.data.Checked = now
+	if checked.IsZero() {
+		return Rule{}, time.Time{}, false, nil
+	}
+
+	var due Rule
+	var dueAt time.Time
+	for _, rule := range s.data.Rules {
+		if !rule.Enabled {
+			continue
+		}
+		at, ok := rule.Previous(now)
+		if !ok || !at.After(checked) || now.Sub(at) > maxDelay || !at.After(dueAt) {
+			continue
+		}
+		due, dueAt = rule, at
+	}
+	if dueAt.IsZero() {
+		return Rule{}, time.Time{}, false, nil
+	}
+	return due, dueAt, true, s.saveUnsafe()
+}
+
+// Next returns the next enabled rule after now with its time
+func (s *Store) Next(now time.Time) (Rule, time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var next Rule
+	var nextAt time.Time
+	for _, rule := range s.data.Rules {
+		if !rule.Enabled {
+			continue
+		}
+		if at, ok := rule.Next(now); ok && (nextAt.IsZero() || at.Before(nextAt)) {
+			next, nextAt = rule, at
+		}
+	}
+	return next, nextAt, !nextAt.IsZero()
+}
+
+// SetApplied records that the profile with the ID was applied at
+func (s *Store) SetApplied(id string, at time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.Applied = &Applied{ProfileID: id, At: at}
+	return s.saveUnsafe()
+}
+
+// Applied returns the profile applied last and when, false when none was applied or
+// it was deleted since
+func (s *Store) Applied() (Profile, time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.data.Applied == nil {
+		return Profile{}, time.Time{}, false
+	}
+	index := s.profileIndexUnsafe(s.data.Applied.ProfileID)
+	if index < 0 {
+		return Profile{}, time.Time{}, false
+	}
+	return s.data.Profiles[index], s.data.Applied.At, true
+}
+
+func (s *Store) profileIndexUnsafe(id string) int {
+	for i, profile := range s.data.Profiles {
+		if profile.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Store) saveUnsafe() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal profiles: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create profiles directory: %w", err)
+	}
+	if err := fsutil.WriteShared(s.path, data); err != nil {
+		return fmt.Errorf("failed to save profiles: %w", err)
+	}
+	return nil
+}
+
+// lastID makes IDs created in the same nanosecond distinct
+var (
+	lastID      int64
+	lastIDMutex sync.Mutex
+)
+
+func newID() string {
+	lastIDMutex.Lock()
+	defer lastIDMutex.Unlock()
+	id := time.Now().UnixNano()
+	if id <= lastID {
+		id = lastID + 1
+	}
+	lastID = id
+	return strconv.FormatInt(id, 36)
+}
+
+// ParseRule reads a rule like "Work 09:00 weekdays": the profile name, the time of
+// day and the days, every day when they are left out
+func ParseRule(input string) (string, string, Days, error) {
+	fields := strings.Fields(input)
+	for i, field := range fields {
+		clock, err := time.Parse("15:04", field)
+		if err != nil {
+			continue
+		}
+		if i == 0 {
+			return "", "", 0, fmt.Errorf("the profile name comes before the time")
+		}
+		days, err := ParseDays(strings.Join(fields[i+1:], " "))
+		if err != nil {
+			return "", "", 0, err
+		}
+		return strings.Join(fields[:i], " "), clock.Format("15:04"), days, nil
+	}
+	return "", "", 0, fmt.Errorf("no time like 09:00 found")
+}
@@ -0,0 +1,145 @@
+package profiles
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRule(t *testing.T) {
+	for input, expected := range map[string]struct {
+		name string
+		at   string
+		days Days
+	}{
+		"Work 9:00 weekdays":         {"Work", "09:00", Weekdays},
+		"Streaming 20:00":            {"Streaming", "20:00", EveryDay},
+		"Late night 23:30 fri-sun":   {"Late night", "23:30", 1<<time.Friday | Weekend},
+		"Gym 07:15 Mon, Wednesday":   {"Gym", "07:15", 1<<time.Monday | 1<<time.Wednesday},
+		"Weekend 10:00 sat-mon":      {"Weekend", "10:00", Weekend | 1<<time.Monday},
+		"Office 08:00 mon-fri daily": {},
+	} {
+		name, at, days, err := ParseRule(input)
+		if expected.name == "" {
+			if err == nil {
+				t.Errorf("Expected an error for %q", input)
+			}
+			continue
+		}
+		if err != nil || name != expected.name || at != expected.at || days != expected.days {
+			t.Errorf("Unexpected rule for %q: %q %q %s (%v)", input, name, at, days, err)
+		}
+	}
+	for _, invalid := range []string{"Work", "09:00 weekdays", "Work 09:00 someday"} {
+		if _, _, _, err := ParseRule(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+	if Weekdays.String() != "weekdays" || Days(1<<time.Sunday|1<<time.Monday).String() != "Mon, Sun" {
+		t.Errorf("Unexpected day names %q and %q", Weekdays, Days(1<<time.Sunday|1<<time.Monday))
+	}
+}
+
+func TestStoreProfilesAndRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	work, err := store.SaveProfile("Work", "a", "Amsterdam")
+	if err != nil {
+		t.Fatalf("SaveProfile failed: %v", err)
+	}
+	if _, err := store.SaveProfile("Streaming", "b", "Berlin"); err != nil {
+		t.Fatalf("SaveProfile failed: %v", err)
+	}
+	if _, err := store.SaveProfile("09:00", "b", "Berlin"); err == nil {
+		t.Error("Expected a time to be rejected as a profile name")
+	}
+	if _, _, err := store.AddRule("work 09:00 weekdays"); err != nil {
+		t.Fatalf("AddRule failed: %v", err)
+	}
+	if _, _, err := store.AddRule("Streaming 20:00"); err != nil {
+		t.Fatalf("AddRule failed: %v", err)
+	}
+	if _, _, err := store.AddRule("Streaming 09:00 mon"); err == nil {
+		t.Error("Expected a rule at the same time on the same day to be rejected")
+	}
+	if _, _, err := store.AddRule("Gaming 21:00"); err == nil {
+		t.Error("Expected a rule of an unknown profile to be rejected")
+	}
+
+	// Saving the same name again changes the server and keeps the rules
+	if updated, err := store.SaveProfile("WORK", "c", "Copenhagen"); err != nil || updated.ID != work.ID {
+		t.Fatalf("Expected the profile to be updated, got %+v (%v)", updated, err)
+	}
+
+	reloaded, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("Reloading store failed: %v", err)
+	}
+	rules := reloaded.Rules()
+	if len(rules) != 2 || rules[0].At != "09:00" || rules[0].ProfileID != work.ID || !rules[0].Enabled {
+		t.Fatalf("Expected both rules, the earlier first, got %+v", rules)
+	}
+	if profile, ok := reloaded.Profile(work.ID); !ok || profile.ServerName != "Copenhagen" || profile.Name != "WORK" {
+		t.Errorf("Unexpected profile %+v", profile)
+	}
+
+	if enabled, ok, err := reloaded.ToggleRule(rules[1].ID); enabled || !ok || err != nil {
+		t.Errorf("Expected the rule to be paused, got %t, %t, %v", enabled, ok, err)
+	}
+	if _, ok, err := reloaded.RemoveProfile(work.ID); !ok || err != nil {
+		t.Fatalf("RemoveProfile failed: %t, %v", ok, err)
+	}
+	if rules := reloaded.Rules(); len(rules) != 1 || rules[0].At != "20:00" {
+		t.Errorf("Expected the rules of the removed profile to go with it, got %+v", rules)
+	}
+}
+
+func TestStoreDue(t *testing.T) {
+	store, _ := NewStore("")
+	work, _ := store.SaveProfile("Work", "a", "Amsterdam")
+	streaming, _ := store.SaveProfile("Streaming", "b", "Berlin")
+	store.AddRule("Work 09:00 weekdays")
+	store.AddRule("Streaming 20:00")
+
+	// Friday 2026-01-02
+	friday := time.Date(2026, 1, 2, 8, 59, 30, 0, time.Local)
+	if _, _, ok, _ := store.Due(friday); ok {
+		t.Fatal("Expected the first call only to start counting")
+	}
+	rule, at, ok, _ := store.Due(friday.Add(time.Minute))
+	if !ok || rule.ProfileID != work.ID || at.Hour() != 9 {
+		t.Fatalf("Expected Work to be due at 09:00, got %+v at %s", rule, at)
+	}
+	if _, _, ok, _ := store.Due(friday.Add(2 * time.Minute)); ok {
+		t.Error("Expected a rule to be due once")
+	}
+
+	// Saturday morning is not a weekday, the next time is Streaming in the evening
+	saturday := friday.AddDate(0, 0, 1)
+	store.Due(saturday.Add(-time.Minute))
+	if _, _, ok, _ := store.Due(saturday.Add(time.Minute)); ok {
+		t.Error("Expected Work not to be due on Saturday")
+	}
+	if next, at, ok := store.Next(saturday); !ok || next.ProfileID != streaming.ID || at.Hour() != 20 || at.Day() != 3 {
+		t.Errorf("Expected Streaming next on Saturday evening, got %+v at %s", next, at)
+	}
+
+	// A time missed for longer than maxDelay is skipped
+	store.Due(saturday.Add(10 * time.Hour))
+	if _, _, ok, _ := store.Due(saturday.Add(13 * time.Hour)); ok {
+		t.Error("Expected a time missed by hours to be skipped")
+	}
+
+	// Of several missed times the latest one wins
+	sunday := friday.AddDate(0, 0, 2)
+	store.ToggleRule(store.Rules()[0].ID)
+	store.AddRule("Work 19:40 sun")
+	store.Due(sunday.Add(10*time.Hour + 30*time.Minute))
+	rule, at, ok, _ = store.Due(sunday.Add(11*time.Hour + 10*time.Minute))
+	if !ok || rule.ProfileID != streaming.ID || at.Hour() != 20 {
+		t.Errorf("Expected the latest missed time to win, got %+v at %s", rule, at)
+	}
+}
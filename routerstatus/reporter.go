@@ -0,0 +1,141 @@
+// Package routerstatus shows the VPN state on the router itself, in the system log
+// and with LED commands, so it is visible when Telegram cannot be reached.
+package routerstatus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+	"xray-telegram-manager/config"
+)
+
+// commandTimeout bounds one run of an LED command
+const commandTimeout = 10 * time.Second
+
+// syslogWriter is the part of *syslog.Writer the reporter uses
+type syslogWriter interface {
+	Info(message string) error
+	Warning(message string) error
+	Close() error
+}
+
+// Reporter writes changes of the VPN state to the router. The first report sets the
+// initial state, later ones only act when the state changes.
+type Reporter struct {
+	cfg        config.RouterStatus
+	openSyslog func(tag string) (syslogWriter, error)
+
+	mutex  sync.Mutex
+	known  bool
+	up     bool
+	syslog syslogWriter
+}
+
+// NewReporter creates a reporter for cfg, it does nothing when cfg is not enabled
+func NewReporter(cfg config.RouterStatus) *Reporter {
+	return &Reporter{
+		cfg: cfg,
+		openSyslog: func(tag string) (syslogWriter, error) {
+			return syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+		},
+	}
+}
+
+// Report records whether the VPN through serverName works. It returns whether the
+// state changed and why it could not be shown. Failed writes are retried on the
+// next change only.
+func (r *Reporter) Report(ctx context.Context, up bool, serverName string) (bool, error) {
+	if r == nil || !r.cfg.Enabled() {
+		return false, nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.known && r.up == up {
+		return false, nil
+	}
+	r.known = true
+	r.up = up
+
+	var errs []error
+	if r.cfg.Syslog {
+		if err := r.writeSyslog(up, serverName); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write to syslog: %w", err))
+		}
+	}
+	command := r.cfg.LEDUpCommand
+	if !up {
+		command = r.cfg.LEDDownCommand
+	}
+	if command != "" {
+		if err := runCommand(ctx, command, up, serverName); err != nil {
+			errs = append(errs, fmt.Errorf("LED command failed: %w", err))
+		}
+	}
+	return true, errors.Join(errs...)
+}
+
+// writeSyslog writes the state with the configured tag, connecting on first use
+func (r *Reporter) writeSyslog(up bool, serverName string) error {
+	if r.syslog == nil {
+		writer, err := r.openSyslog(r.cfg.SyslogTag)
+		if err != nil {
+			return err
+		}
+		r.syslog = writer
+	}
+	var err error
+	if up {
+		err = r.syslog.Info(fmt.Sprintf("VPN is up, server %s answers", serverName))
+	} else {
+		err = r.syslog.Warning(fmt.Sprintf("VPN is down, server %s does not answer", serverName))
+	}
+	if err != nil {
+		// Reconnect next time, syslogd may have been restarted
+		_ = r.syslog.Close()
+		r.syslog = nil
+	}
+	return err
+}
+
+// Close disconnects from syslog
+func (r *Reporter) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.syslog == nil {
+		return nil
+	}
+	err := r.syslog.Close()
+	r.syslog = nil
+	return err
+}
+
+// runCommand runs an LED command through the shell with the state in its environment
+func runCommand(ctx context.Context, command string, up bool, serverName string) error {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	state := "up"
+	if !up {
+		state = "down"
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), "XRAY_VPN_STATE="+state, "XRAY_SERVER_NAME="+serverName)
+	// Children of the killed shell may keep the output pipe open
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if text := strings.TrimSpace(string(output)); text != "" {
+			return fmt.Errorf("%w: %s", err, text)
+		}
+		return err
+	}
+	return nil
+}
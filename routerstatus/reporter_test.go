@@ -0,0 +1,108 @@
+package routerstatus
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"xray-telegram-manager/config"
+)
+
+type fakeSyslog struct {
+	messages []string
+	fail     bool
+	closed   int
+}
+
+func (f *fakeSyslog) Info(message string) error {
+	return f.write("info: " + message)
+}
+
+func (f *fakeSyslog) Warning(message string) error {
+	return f.write("warning: " + message)
+}
+
+func (f *fakeSyslog) write(message string) error {
+	if f.fail {
+		return errors.New("broken pipe")
+	}
+	f.messages = append(f.messages, message)
+	return nil
+}
+
+func (f *fakeSyslog) Close() error {
+	f.closed++
+	return nil
+}
+
+func newTestReporter(cfg config.RouterStatus, writer *fakeSyslog) *Reporter {
+	reporter := NewReporter(cfg)
+	reporter.openSyslog = func(tag string) (syslogWriter, error) {
+		return writer, nil
+	}
+	return reporter
+}
+
+func TestReporterWritesStateChanges(t *testing.T) {
+	writer := &fakeSyslog{}
+	reporter := newTestReporter(config.RouterStatus{Syslog: true, SyslogTag: "xray-manager"}, writer)
+	ctx := context.Background()
+
+	for _, up := range []bool{true, true, false, false, true} {
+		if _, err := reporter.Report(ctx, up, "Amsterdam"); err != nil {
+			t.Fatalf("Report failed: %v", err)
+		}
+	}
+	want := []string{
+		"info: VPN is up, server Amsterdam answers",
+		"warning: VPN is down, server Amsterdam does not answer",
+		"info: VPN is up, server Amsterdam answers",
+	}
+	if strings.Join(writer.messages, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected only the changes to be written, got %q", writer.messages)
+	}
+}
+
+func TestReporterReconnectsAfterFailedWrite(t *testing.T) {
+	writer := &fakeSyslog{fail: true}
+	reporter := newTestReporter(config.RouterStatus{Syslog: true, SyslogTag: "xray-manager"}, writer)
+
+	if _, err := reporter.Report(context.Background(), false, "Amsterdam"); err == nil {
+		t.Fatal("Expected the failed write to be reported")
+	}
+	if writer.closed != 1 || reporter.syslog != nil {
+		t.Errorf("Expected the connection to be closed for a reconnect, closed %d times", writer.closed)
+	}
+}
+
+func TestReporterRunsLEDCommands(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "led")
+	reporter := NewReporter(config.RouterStatus{
+		LEDDownCommand: `echo "$XRAY_VPN_STATE $XRAY_SERVER_NAME" >> ` + output,
+		LEDUpCommand:   `echo "$XRAY_VPN_STATE $XRAY_SERVER_NAME" >> ` + output,
+	})
+	ctx := context.Background()
+
+	for _, up := range []bool{false, true} {
+		changed, err := reporter.Report(ctx, up, "Berlin")
+		if err != nil || !changed {
+			t.Fatalf("Report = %t, %v", changed, err)
+		}
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read the command output: %v", err)
+	}
+	if string(data) != "down Berlin\nup Berlin\n" {
+		t.Errorf("Unexpected LED command runs: %q", data)
+	}
+}
+
+func TestReporterDisabled(t *testing.T) {
+	changed, err := NewReporter(config.RouterStatus{SyslogTag: "xray-manager"}).Report(context.Background(), false, "Berlin")
+	if changed || err != nil {
+		t.Errorf("Expected a disabled reporter to do nothing, got %t, %v", changed, err)
+	}
+}
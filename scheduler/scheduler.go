@@ -0,0 +1,246 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"xray-telegram-manager/clock"
+)
+
+// Window is a daily period in local time, e.g. 23:00-07:00. It wraps around
+// midnight when the end is earlier than the start.
+type Window struct {
+	// Minutes since midnight
+	start int
+	end   int
+}
+
+// ParseWindow parses a window from "HH:MM" start and end times
+func ParseWindow(start, end string) (Window, error) {
+	startMinutes, err := parseClock(start)
+	if err != nil {
+		return Window{}, fmt.Errorf("invalid start time: %w", err)
+	}
+	endMinutes, err := parseClock(end)
+	if err != nil {
+		return Window{}, fmt.Errorf("invalid end time: %w", err)
+	}
+	if startMinutes == endMinutes {
+		return Window{}, fmt.Errorf("start and end times must differ")
+	}
+	return Window{start: startMinutes, end: endMinutes}, nil
+}
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not in HH:MM format", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether t falls into the window
+func (w Window) Contains(t time.Time) bool {
+	minutes := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return minutes >= w.start && minutes < w.end
+	}
+	return minutes >= w.start || minutes < w.end
+}
+
+// NextEnd returns the first end of the window after t
+func (w Window) NextEnd(t time.Time) time.Time {
+	end := time.Date(t.Year(), t.Month(), t.Day(), w.end/60, w.end%60, 0, 0, t.Location())
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+// String formats the window as HH:MM-HH:MM
+func (w Window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+}
+
+// Daily is a time of day in local time, e.g. 09:00
+type Daily struct {
+	// Minutes since midnight
+	minutes int
+}
+
+// ParseDaily parses a time of day in "HH:MM" format
+func ParseDaily(value string) (Daily, error) {
+	minutes, err := parseClock(value)
+	if err != nil {
+		return Daily{}, err
+	}
+	return Daily{minutes: minutes}, nil
+}
+
+// Next returns the first occurrence of the time of day after t
+func (d Daily) Next(t time.Time) time.Time {
+	next := d.On(t)
+	if !next.After(t) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// On returns the time of day on the date of day
+func (d Daily) On(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), d.minutes/60, d.minutes%60, 0, 0, day.Location())
+}
+
+// String formats the time of day as HH:MM
+func (d Daily) String() string {
+	return fmt.Sprintf("%02d:%02d", d.minutes/60, d.minutes%60)
+}
+
+// Job is a periodic background task
+type Job struct {
+	Name string
+	// Delay before the first run
+	Delay time.Duration
+	// Interval between runs, zero runs the job once
+	Interval time.Duration
+	// At runs the job every day at this time instead of after Delay and Interval
+	At *Daily
+	// Deferrable jobs due during quiet hours run once the quiet hours end
+	Deferrable bool
+	// Heavy jobs wait while the load average is at or above the load limit
+	Heavy bool
+	Run   func(ctx context.Context)
+}
+
+// loadRecheckInterval is how often a heavy job held back by the load is retried
+const loadRecheckInterval = time.Minute
+
+// loadAverageFile holds the load averages on Linux
+const loadAverageFile = "/proc/loadavg"
+
+// Scheduler runs periodic jobs and holds deferrable ones back during quiet hours
+type Scheduler struct {
+	quiet *Window
+	clock clock.Clock
+	// maxLoad holds heavy jobs back, 0 disables the limit
+	maxLoad     float64
+	loadAverage func() (float64, error)
+}
+
+// New creates a scheduler. A nil quiet window disables quiet hours.
+func New(quiet *Window) *Scheduler {
+	return &Scheduler{quiet: quiet, clock: clock.Real, loadAverage: LoadAverage}
+}
+
+// SetLoadLimit holds heavy jobs back while the 1-minute load average is at or
+// above max, 0 disables the limit. It must be called before jobs are started.
+func (s *Scheduler) SetLoadLimit(max float64) {
+	s.maxLoad = max
+}
+
+// overloaded reports whether heavy jobs have to wait. A load average that cannot
+// be read does not hold jobs back.
+func (s *Scheduler) overloaded() bool {
+	if s.maxLoad <= 0 {
+		return false
+	}
+	load, err := s.loadAverage()
+	return err == nil && load >= s.maxLoad
+}
+
+// LoadAverage returns the 1-minute load average of the system
+func LoadAverage() (float64, error) {
+	data, err := os.ReadFile(loadAverageFile)
+	if err != nil {
+		return 0, err
+	}
+	return parseLoadAverage(string(data))
+}
+
+// parseLoadAverage reads the first field of /proc/loadavg, e.g. "0.52 0.40 0.33 1/180 4242"
+func parseLoadAverage(data string) (float64, error) {
+	fields := strings.Fields(data)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty load average")
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid load average %q", fields[0])
+	}
+	return load, nil
+}
+
+// SetClock replaces the clock of the scheduler, for tests. It must be called
+// before jobs are started.
+func (s *Scheduler) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+// InQuietHours reports whether quiet hours are active right now
+func (s *Scheduler) InQuietHours() bool {
+	return s.quiet != nil && s.quiet.Contains(s.clock.Now())
+}
+
+// Start runs job in a goroutine until ctx is cancelled
+func (s *Scheduler) Start(ctx context.Context, job Job) {
+	go func() {
+		delay := job.Delay
+		if job.At != nil {
+			now := s.clock.Now()
+			delay = job.At.Next(now).Sub(now)
+		}
+		timer := s.clock.NewTimer(delay)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C():
+			}
+
+			if now := s.clock.Now(); job.Deferrable && s.quiet != nil && s.quiet.Contains(now) {
+				timer.Reset(s.quiet.NextEnd(now).Sub(now))
+				continue
+			}
+			if job.Heavy && s.overloaded() {
+				timer.Reset(loadRecheckInterval)
+				continue
+			}
+
+			job.Run(ctx)
+			if job.At != nil {
+				now := s.clock.Now()
+				timer.Reset(job.At.Next(now).Sub(now))
+				continue
+			}
+			if job.Interval <= 0 {
+				return
+			}
+			timer.Reset(job.Interval)
+		}
+	}()
+}
+
+// OnQuietHoursEnd calls fn in a goroutine every time the quiet hours end.
+// It does nothing when quiet hours are disabled.
+func (s *Scheduler) OnQuietHoursEnd(ctx context.Context, fn func(ctx context.Context)) {
+	if s.quiet == nil {
+		return
+	}
+	go func() {
+		for {
+			now := s.clock.Now()
+			timer := s.clock.NewTimer(s.quiet.NextEnd(now).Sub(now))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C():
+				fn(ctx)
+			}
+		}
+	}()
+}
@@ -0,0 +1,253 @@
+package scheduler
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+	"xray-telegram-manager/clock"
+)
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		start   string
+		end     string
+		wantErr bool
+	}{
+		{"overnight", "23:00", "07:00", false},
+		{"daytime", "09:30", "18:00", false},
+		{"invalid start", "25:00", "07:00", true},
+		{"invalid end", "23:00", "7am", true},
+		{"empty window", "07:00", "07:00", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseWindow(tt.start, tt.end)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseWindow(%q, %q) error = %v, wantErr %v", tt.start, tt.end, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	overnight, _ := ParseWindow("23:00", "07:00")
+	daytime, _ := ParseWindow("09:00", "18:00")
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 3, 10, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		window Window
+		t      time.Time
+		want   bool
+	}{
+		{overnight, at(23, 0), true},
+		{overnight, at(2, 30), true},
+		{overnight, at(6, 59), true},
+		{overnight, at(7, 0), false},
+		{overnight, at(12, 0), false},
+		{daytime, at(9, 0), true},
+		{daytime, at(17, 59), true},
+		{daytime, at(18, 0), false},
+		{daytime, at(3, 0), false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.window.Contains(tt.t); got != tt.want {
+			t.Errorf("%s.Contains(%s) = %v, want %v", tt.window, tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestWindowNextEnd(t *testing.T) {
+	window, _ := ParseWindow("23:00", "07:00")
+
+	late := time.Date(2024, 3, 10, 23, 30, 0, 0, time.Local)
+	if got, want := window.NextEnd(late), time.Date(2024, 3, 11, 7, 0, 0, 0, time.Local); !got.Equal(want) {
+		t.Errorf("NextEnd(%v) = %v, want %v", late, got, want)
+	}
+
+	early := time.Date(2024, 3, 10, 3, 0, 0, 0, time.Local)
+	if got, want := window.NextEnd(early), time.Date(2024, 3, 10, 7, 0, 0, 0, time.Local); !got.Equal(want) {
+		t.Errorf("NextEnd(%v) = %v, want %v", early, got, want)
+	}
+}
+
+func TestDailyNext(t *testing.T) {
+	if _, err := ParseDaily("9am"); err == nil {
+		t.Error("Expected an error for a time not in HH:MM format")
+	}
+	daily, err := ParseDaily("09:00")
+	if err != nil {
+		t.Fatalf("ParseDaily failed: %v", err)
+	}
+
+	early := time.Date(2024, 3, 10, 8, 59, 0, 0, time.Local)
+	if got, want := daily.Next(early), time.Date(2024, 3, 10, 9, 0, 0, 0, time.Local); !got.Equal(want) {
+		t.Errorf("Next(%v) = %v, want %v", early, got, want)
+	}
+
+	onTime := time.Date(2024, 3, 10, 9, 0, 0, 0, time.Local)
+	if got, want := daily.Next(onTime), time.Date(2024, 3, 11, 9, 0, 0, 0, time.Local); !got.Equal(want) {
+		t.Errorf("Next(%v) = %v, want %v", onTime, got, want)
+	}
+}
+
+func TestSchedulerDefersJobsDuringQuietHours(t *testing.T) {
+	window, _ := ParseWindow("23:00", "07:00")
+	scheduler := New(&window)
+	fake := clock.NewFake(time.Date(2024, 3, 10, 2, 0, 0, 0, time.Local))
+	scheduler.SetClock(fake)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	deferred := make(chan struct{}, 1)
+	critical := make(chan struct{}, 1)
+	scheduler.Start(ctx, Job{Name: "refresh", Deferrable: true, Run: func(context.Context) { deferred <- struct{}{} }})
+	scheduler.Start(ctx, Job{Name: "health", Run: func(context.Context) { critical <- struct{}{} }})
+
+	select {
+	case <-critical:
+	case <-time.After(time.Second):
+		t.Fatal("Expected non-deferrable job to run during quiet hours")
+	}
+	select {
+	case <-deferred:
+		t.Fatal("Expected deferrable job to wait for the end of quiet hours")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if !scheduler.InQuietHours() {
+		t.Error("Expected quiet hours to be active")
+	}
+	if New(nil).InQuietHours() {
+		t.Error("Expected no quiet hours without a window")
+	}
+}
+
+func TestSchedulerRunsDeferredJobAfterQuietHours(t *testing.T) {
+	window, _ := ParseWindow("23:00", "07:00")
+	scheduler := New(&window)
+	fake := clock.NewFake(time.Date(2024, 3, 10, 2, 0, 0, 0, time.Local))
+	scheduler.SetClock(fake)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runs := make(chan time.Time, 1)
+	scheduler.Start(ctx, Job{Name: "refresh", Interval: time.Hour, Deferrable: true, Run: func(context.Context) { runs <- fake.Now() }})
+
+	// The job is due right away and waits for the end of the quiet hours
+	if !fake.WaitForTimers(1) {
+		t.Fatal("Expected the job to wait for the end of quiet hours")
+	}
+	fake.Advance(5*time.Hour - time.Minute)
+	select {
+	case <-runs:
+		t.Fatal("Expected the job not to run during quiet hours")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	fake.Advance(time.Minute)
+	select {
+	case ran := <-runs:
+		if want := time.Date(2024, 3, 10, 7, 0, 0, 0, time.Local); !ran.Equal(want) {
+			t.Errorf("Expected the job to run at %v, got %v", want, ran)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the job to run when quiet hours end")
+	}
+
+	// The next run follows the interval
+	if !fake.WaitForTimers(1) {
+		t.Fatal("Expected the job to be rescheduled")
+	}
+	fake.Advance(time.Hour)
+	select {
+	case <-runs:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the job to run again after the interval")
+	}
+}
+
+func TestSchedulerDailyJob(t *testing.T) {
+	scheduler := New(nil)
+	fake := clock.NewFake(time.Date(2024, 3, 10, 8, 30, 0, 0, time.Local))
+	scheduler.SetClock(fake)
+	daily, _ := ParseDaily("09:00")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runs := make(chan time.Time, 1)
+	scheduler.Start(ctx, Job{Name: "digest", At: &daily, Run: func(context.Context) { runs <- fake.Now() }})
+
+	for _, want := range []time.Time{
+		time.Date(2024, 3, 10, 9, 0, 0, 0, time.Local),
+		time.Date(2024, 3, 11, 9, 0, 0, 0, time.Local),
+	} {
+		if !fake.WaitForTimers(1) {
+			t.Fatal("Expected the daily job to be scheduled")
+		}
+		fake.Set(want)
+		select {
+		case ran := <-runs:
+			if !ran.Equal(want) {
+				t.Errorf("Expected the job to run at %v, got %v", want, ran)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the job to run at %v", want)
+		}
+	}
+}
+
+func TestSchedulerHoldsHeavyJobsUnderLoad(t *testing.T) {
+	scheduler := New(nil)
+	fake := clock.NewFake(time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local))
+	scheduler.SetClock(fake)
+	scheduler.SetLoadLimit(2)
+	var load atomic.Value
+	load.Store(3.5)
+	scheduler.loadAverage = func() (float64, error) { return load.Load().(float64), nil }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runs := make(chan time.Time, 1)
+	scheduler.Start(ctx, Job{Name: "availability", Interval: time.Hour, Heavy: true, Run: func(context.Context) { runs <- fake.Now() }})
+
+	// The job is due right away and waits for the load to drop
+	if !fake.WaitForTimers(1) {
+		t.Fatal("Expected the job to wait for the load to drop")
+	}
+	select {
+	case <-runs:
+		t.Fatal("Expected the job not to run under load")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	load.Store(0.5)
+	fake.Advance(loadRecheckInterval)
+	select {
+	case ran := <-runs:
+		if want := time.Date(2024, 3, 10, 12, 1, 0, 0, time.Local); !ran.Equal(want) {
+			t.Errorf("Expected the job to run at %v, got %v", want, ran)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the job to run once the load dropped")
+	}
+}
+
+func TestParseLoadAverage(t *testing.T) {
+	load, err := parseLoadAverage("0.52 0.40 0.33 1/180 4242\n")
+	if err != nil || load != 0.52 {
+		t.Errorf("Expected 0.52, got %v, %v", load, err)
+	}
+	if _, err := parseLoadAverage(""); err == nil {
+		t.Error("Expected error for empty input")
+	}
+}
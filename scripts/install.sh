@@ -210,6 +210,12 @@ reload_service() {
     stop
     start
 }
+
+extra_command "health" "Check service health"
+
+health() {
+    "\$PROG" --health
+}
 EOF
     
     chmod 755 "$SERVICE_FILE"
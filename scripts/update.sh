@@ -20,6 +20,14 @@ SYSTEMD_SERVICE_FILE="/etc/systemd/system/xray-telegram-manager.service"
 BINARY_NAME="xray-telegram-manager"
 BACKUP_DIR="$INSTALL_DIR/backup"
 
+# Progress file read by the bot, set with --progress-file. Each stage appends a line
+# "stage|percent|message"; the last line is "done" or "failed" when the update ends.
+PROGRESS_FILE=""
+CURRENT_STAGE="starting"
+CURRENT_PERCENT=40
+UPDATE_DONE=false
+NEW_BINARY_DOWNLOADED=false
+
 # Function to print colored output
 print_info() {
     echo -e "${GREEN}[INFO]${NC} $1"
@@ -37,6 +45,23 @@ print_step() {
     echo -e "${BLUE}[STEP]${NC} $1"
 }
 
+# Function to report an update stage to the bot
+report_progress() {
+    CURRENT_STAGE="$1"
+    CURRENT_PERCENT="$2"
+    if [ -n "$PROGRESS_FILE" ]; then
+        printf '%s|%s|%s\n' "$1" "$2" "$3" >> "$PROGRESS_FILE" 2>/dev/null || true
+    fi
+}
+
+# Function to report a failed update when the script exits early
+on_exit() {
+    status=$?
+    if [ "$status" -ne 0 ] && [ "$UPDATE_DONE" = false ]; then
+        report_progress "failed" "$CURRENT_PERCENT" "Update failed at stage $CURRENT_STAGE (exit code $status)"
+    fi
+}
+
 # Function to check if running as root
 check_root() {
     if [ "$(id -u)" -ne 0 ]; then
@@ -247,14 +272,19 @@ create_backup() {
     ls -t "$BACKUP_DIR"/backup_*_config.json 2>/dev/null | tail -n +6 | xargs rm -f 2>/dev/null || true
 }
 
-# Function to update binary
-update_binary() {
-    print_step "Updating binary..."
+# Function to find or download the new binary, sets NEW_BINARY and NEW_BINARY_DOWNLOADED
+prepare_binary() {
+    print_step "Preparing binary..."
     
     local binary_path=""
     
-    # Try to find the appropriate binary
-    if [ -f "./dist/${BINARY_NAME}-mips-softfloat" ]; then
+    # Try to find the appropriate binary, the bot may have downloaded it already
+    if [ -n "$XRAY_UPDATE_BINARY" ] && [ -f "$XRAY_UPDATE_BINARY" ]; then
+        print_info "Using the binary downloaded by the bot"
+        binary_path="$XRAY_UPDATE_BINARY"
+        chmod 755 "$binary_path"
+        NEW_BINARY_DOWNLOADED=true
+    elif [ -f "./dist/${BINARY_NAME}-mips-softfloat" ]; then
         binary_path="./dist/${BINARY_NAME}-mips-softfloat"
     elif [ -f "./dist/${BINARY_NAME}-mips-hardfloat" ]; then
         binary_path="./dist/${BINARY_NAME}-mips-hardfloat"
@@ -262,13 +292,22 @@ update_binary() {
         binary_path="./${BINARY_NAME}"
     else
         print_warn "Local build artifacts not found. Trying to download latest release..."
+        report_progress "downloading_binary" 50 "Downloading the latest release..."
         binary_path=$(download_latest_binary) || {
             print_error "Binary not found and download failed."
             print_info "Run: make mips"
             exit 1
         }
+        NEW_BINARY_DOWNLOADED=true
     fi
     
+    NEW_BINARY="$binary_path"
+}
+
+# Function to install the prepared binary
+install_binary() {
+    print_step "Updating binary..."
+    
     # Find current binary location
     local current_binary=$(find_binary)
     if [ -z "$current_binary" ]; then
@@ -277,9 +316,14 @@ update_binary() {
     fi
     
     # Copy new binary
-    cp "$binary_path" "$current_binary"
+    cp "$NEW_BINARY" "$current_binary"
     chmod 755 "$current_binary"
     
+    # Remove the downloaded binary from the temp directory
+    if [ "$NEW_BINARY_DOWNLOADED" = true ]; then
+        rm -f "$NEW_BINARY"
+    fi
+    
     print_info "✓ Binary updated: $current_binary"
 }
 
@@ -324,6 +368,7 @@ show_usage() {
     echo "  --no-backup             Skip backup creation"
     echo "  --no-restart            Don't restart service after update"
     echo "  --check                 Check current version and exit"
+    echo "  --progress-file FILE    Append update stages to FILE for the bot"
     echo ""
     echo "Examples:"
     echo "  $0                      # Interactive update"
@@ -391,6 +436,10 @@ main() {
                 check_only=true
                 shift
                 ;;
+            --progress-file)
+                PROGRESS_FILE="$2"
+                shift 2
+                ;;
             --rollback)
                 check_root
                 rollback
@@ -443,6 +492,7 @@ main() {
     fi
     
     print_step "Starting update..."
+    trap on_exit EXIT
     
     # Check if service is running
     if is_service_running; then
@@ -452,22 +502,29 @@ main() {
     
     # Create backup
     if [ "$no_backup" = false ]; then
+        report_progress "backing_up" 40 "Backing up the current version..."
         create_backup
     fi
     
+    # Get the new binary while the service still runs
+    prepare_binary
+    
     # Stop service if running
     if [ "$was_running" = true ]; then
+        report_progress "stopping_service" 70 "Stopping the bot service..."
         stop_service
     fi
     
     # Update binary
-    update_binary
+    report_progress "installing" 80 "Installing the new binary..."
+    install_binary
     
     # Update service files
     update_service
     
     # Start or restart service unless explicitly disabled
     if [ "$no_restart" = false ]; then
+        report_progress "starting_service" 90 "Starting the bot service..."
         if [ "$was_running" = true ]; then
             start_service
         else
@@ -487,6 +544,8 @@ main() {
     fi
     
     print_step "Update completed successfully!"
+    UPDATE_DONE=true
+    report_progress "done" 100 "Update completed successfully"
     
     # Show new version
     print_info "Updated version:"
@@ -0,0 +1,144 @@
+package security
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxTrackedUsers bounds memory use when many different users probe the bot
+const maxTrackedUsers = 500
+
+// Policy controls when a user is temporarily banned
+type Policy struct {
+	// MaxAttempts within Window that trigger a ban
+	MaxAttempts int
+	Window      time.Duration
+	BanDuration time.Duration
+}
+
+// Intruder summarizes the unauthorized attempts of one user
+type Intruder struct {
+	UserID      int64
+	Username    string
+	Attempts    int
+	LastCommand string
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	BannedUntil time.Time
+	// Updates dropped while the user was banned
+	Ignored int
+
+	windowStart time.Time
+	windowCount int
+}
+
+// IsBanned reports whether the user is banned at t
+func (i Intruder) IsBanned(t time.Time) bool {
+	return t.Before(i.BannedUntil)
+}
+
+// Tracker records unauthorized access attempts in memory
+type Tracker struct {
+	policy    Policy
+	mutex     sync.Mutex
+	intruders map[int64]*Intruder
+	now       func() time.Time
+}
+
+// NewTracker creates a tracker with the given ban policy
+func NewTracker(policy Policy) *Tracker {
+	return &Tracker{
+		policy:    policy,
+		intruders: make(map[int64]*Intruder),
+		now:       time.Now,
+	}
+}
+
+// Record registers an unauthorized attempt. When canBan is set and the user reached
+// the attempt limit, the user is banned and banned is true, so the caller can alert
+// the admin once per ban.
+func (t *Tracker) Record(userID int64, username, command string, canBan bool) (intruder Intruder, banned bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	entry, ok := t.intruders[userID]
+	if !ok {
+		t.evictUnsafe()
+		entry = &Intruder{UserID: userID, FirstSeen: now}
+		t.intruders[userID] = entry
+	}
+	if username != "" {
+		entry.Username = username
+	}
+	entry.Attempts++
+	entry.LastCommand = command
+	entry.LastSeen = now
+
+	if now.Sub(entry.windowStart) > t.policy.Window {
+		entry.windowStart = now
+		entry.windowCount = 0
+	}
+	entry.windowCount++
+
+	if canBan && !entry.IsBanned(now) && entry.windowCount >= t.policy.MaxAttempts {
+		entry.BannedUntil = now.Add(t.policy.BanDuration)
+		entry.windowCount = 0
+		banned = true
+	}
+	return *entry, banned
+}
+
+// ShouldIgnore reports whether updates from userID must be dropped because of a ban
+func (t *Tracker) ShouldIgnore(userID int64) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry, ok := t.intruders[userID]
+	if !ok || !entry.IsBanned(t.now()) {
+		return false
+	}
+	entry.Ignored++
+	return true
+}
+
+// Intruders returns all recorded users, most recently seen first
+func (t *Tracker) Intruders() []Intruder {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	result := make([]Intruder, 0, len(t.intruders))
+	for _, entry := range t.intruders {
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastSeen.After(result[j].LastSeen)
+	})
+	return result
+}
+
+// Policy returns the ban policy of the tracker
+func (t *Tracker) Policy() Policy {
+	return t.policy
+}
+
+// evictUnsafe drops the least recently seen user that is not banned once the limit is reached
+func (t *Tracker) evictUnsafe() {
+	if len(t.intruders) < maxTrackedUsers {
+		return
+	}
+	now := t.now()
+	var oldest *Intruder
+	for _, entry := range t.intruders {
+		if entry.IsBanned(now) {
+			continue
+		}
+		if oldest == nil || entry.LastSeen.Before(oldest.LastSeen) {
+			oldest = entry
+		}
+	}
+	if oldest != nil {
+		delete(t.intruders, oldest.UserID)
+	}
+}
@@ -0,0 +1,58 @@
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrackerBansAfterRepeatedAttempts(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tracker := NewTracker(Policy{MaxAttempts: 3, Window: 10 * time.Minute, BanDuration: time.Hour})
+	tracker.now = func() time.Time { return now }
+
+	for i := 1; i <= 2; i++ {
+		if _, banned := tracker.Record(42, "intruder", "/list", true); banned {
+			t.Fatalf("Expected no ban after %d attempts", i)
+		}
+	}
+	intruder, banned := tracker.Record(42, "", "/status", true)
+	if !banned {
+		t.Fatal("Expected ban after 3 attempts")
+	}
+	if intruder.Attempts != 3 || intruder.Username != "intruder" || intruder.LastCommand != "/status" {
+		t.Errorf("Unexpected intruder summary: %+v", intruder)
+	}
+	if !tracker.ShouldIgnore(42) {
+		t.Error("Expected banned user to be ignored")
+	}
+
+	// The ban expires after BanDuration
+	now = now.Add(time.Hour + time.Second)
+	if tracker.ShouldIgnore(42) {
+		t.Error("Expected ban to expire")
+	}
+
+	intruders := tracker.Intruders()
+	if len(intruders) != 1 || intruders[0].Ignored != 1 {
+		t.Errorf("Expected one intruder with one ignored update, got %+v", intruders)
+	}
+}
+
+func TestTrackerWindowAndCanBan(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tracker := NewTracker(Policy{MaxAttempts: 2, Window: time.Minute, BanDuration: time.Hour})
+	tracker.now = func() time.Time { return now }
+
+	// Attempts spread over more than the window do not add up
+	tracker.Record(1, "", "/list", true)
+	now = now.Add(2 * time.Minute)
+	if _, banned := tracker.Record(1, "", "/list", true); banned {
+		t.Error("Expected attempts outside the window not to trigger a ban")
+	}
+
+	// Users with some access are reported but never banned
+	tracker.Record(2, "member", "/update", false)
+	if _, banned := tracker.Record(2, "member", "/update", false); banned || tracker.ShouldIgnore(2) {
+		t.Error("Expected user that cannot be banned to stay unbanned")
+	}
+}
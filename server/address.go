@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+)
+
+// normalizeHost strips the brackets of an IPv6 literal and formats IP literals in
+// their canonical form, so 2001:db8:0::1 and [2001:db8::1] are the same host
+func normalizeHost(host string) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// hostFamily returns the family of an IP literal, or "" for a domain name
+func hostFamily(host string) string {
+	ip := net.ParseIP(normalizeHost(host))
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return types.IPv4
+	default:
+		return types.IPv6
+	}
+}
+
+// addrFamily returns the family of a connection address
+func addrFamily(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	if tcpAddr.IP.To4() != nil {
+		return types.IPv4
+	}
+	return types.IPv6
+}
+
+// orderByFamily puts the addresses of the preferred family first, keeping the
+// resolver order within each family
+func orderByFamily(addrs []net.IPAddr, preferIPv6 bool) []net.IP {
+	ordered := make([]net.IP, 0, len(addrs))
+	for _, preferred := range []bool{true, false} {
+		for _, addr := range addrs {
+			isIPv6 := addr.IP.To4() == nil
+			if (isIPv6 == preferIPv6) == preferred {
+				ordered = append(ordered, addr.IP)
+			}
+		}
+	}
+	return ordered
+}
+
+// dialHost connects to host over TCP. Domain names are resolved and their addresses
+// tried in the order of family, with auto the system tries both families at once.
+// A configured resolver replaces the system one, its addresses are tried in the
+// order of family or as returned with auto. IP literals are dialed over their own
+// family. The latency is that of the connect that succeeded.
+func dialHost(ctx context.Context, host, port, family string, resolver *Resolver) (net.Conn, time.Duration, error) {
+	host = normalizeHost(host)
+	dialer := &net.Dialer{}
+	if net.ParseIP(host) != nil || (resolver.IsSystem() && (family == config.IPFamilyAuto || family == "")) {
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+		return conn, time.Since(start), err
+	}
+
+	var addrs []net.IPAddr
+	var err error
+	if resolver.IsSystem() {
+		addrs, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+	} else {
+		addrs, err = resolver.LookupIPAddr(ctx, host)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	if family == config.IPFamilyAuto || family == "" {
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	} else {
+		ips = orderByFamily(addrs, family == config.IPFamilyIPv6)
+	}
+	var lastErr error
+	for _, ip := range ips {
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, time.Since(start), nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: "no addresses found", Name: host, IsNotFound: true}
+	}
+	return nil, 0, lastErr
+}
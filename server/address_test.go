@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+)
+
+func TestEqualHostIPv6(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"2001:db8::1", "[2001:db8::1]", true},
+		{"2001:db8:0:0::1", "2001:DB8::1", true},
+		{"2001:db8::1", "2001:db8::2", false},
+		{"Example.com", "example.com", true},
+	}
+	for _, tt := range tests {
+		if got := equalHost(tt.a, tt.b); got != tt.want {
+			t.Errorf("equalHost(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestOrderByFamily(t *testing.T) {
+	addrs := []net.IPAddr{
+		{IP: net.ParseIP("2001:db8::1")},
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("2001:db8::2")},
+	}
+
+	ipv4First := orderByFamily(addrs, false)
+	if ipv4First[0].String() != "192.0.2.1" || ipv4First[1].String() != "2001:db8::1" {
+		t.Errorf("Expected IPv4 first in resolver order, got %v", ipv4First)
+	}
+	ipv6First := orderByFamily(addrs, true)
+	if ipv6First[0].String() != "2001:db8::1" || ipv6First[2].String() != "192.0.2.1" {
+		t.Errorf("Expected IPv6 first in resolver order, got %v", ipv6First)
+	}
+}
+
+func TestPingIPv6Literal(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	pt := NewPingTester(&config.Config{PingTimeout: 2, IPFamily: config.IPFamilyIPv4})
+	result := pt.TestServer(types.Server{ID: "v6", Address: "[::1]", Port: port})
+	if !result.Available || result.Family != types.IPv6 {
+		t.Errorf("Expected the IPv6 literal to answer over IPv6 despite the IPv4 preference, got %+v", result)
+	}
+
+	conn, _, err := dialHost(context.Background(), "::1", strconv.Itoa(port), config.IPFamilyAuto, nil)
+	if err != nil {
+		t.Fatalf("dialHost failed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestBuildProxyOutboundDomainStrategy(t *testing.T) {
+	options := types.OutboundOptions{IPFamily: config.IPFamilyIPv6}
+
+	outbound := buildProxyOutbound(types.Server{Address: "vpn.example.com"}, options)
+	sockopt, _ := outbound.StreamSettings["sockopt"].(map[string]interface{})
+	if sockopt["domainStrategy"] != "UseIPv6v4" {
+		t.Errorf("Expected IPv6 first for a domain name, got %v", outbound.StreamSettings)
+	}
+
+	outbound = buildProxyOutbound(types.Server{Address: "192.0.2.1"}, options)
+	if _, ok := outbound.StreamSettings["sockopt"]; ok {
+		t.Errorf("Expected no domain strategy for an IP literal, got %v", outbound.StreamSettings)
+	}
+}
+
+func TestBuildProxyOutboundPinnedAddress(t *testing.T) {
+	server := types.Server{
+		Address:  "vpn.example.com",
+		Protocol: "vless",
+		Settings: map[string]interface{}{
+			"vnext": []interface{}{map[string]interface{}{"address": "vpn.example.com", "port": 443}},
+		},
+		StreamSettings: map[string]interface{}{
+			"network":     "ws",
+			"security":    "tls",
+			"tlsSettings": map[string]interface{}{},
+			"wsSettings":  map[string]interface{}{"path": "/ws"},
+		},
+	}
+	options := types.OutboundOptions{IPFamily: config.IPFamilyIPv4, PinnedAddress: "203.0.113.7"}
+
+	outbound := buildProxyOutbound(server, options)
+	vnext := outbound.Settings["vnext"].([]interface{})[0].(map[string]interface{})
+	if vnext["address"] != "203.0.113.7" {
+		t.Errorf("Expected the pinned address in the outbound, got %v", vnext["address"])
+	}
+	tlsSettings := outbound.StreamSettings["tlsSettings"].(map[string]interface{})
+	wsSettings := outbound.StreamSettings["wsSettings"].(map[string]interface{})
+	if tlsSettings["serverName"] != "vpn.example.com" || wsSettings["host"] != "vpn.example.com" {
+		t.Errorf("Expected the domain to stay the server name and host, got %v", outbound.StreamSettings)
+	}
+	if _, ok := outbound.StreamSettings["sockopt"]; ok {
+		t.Errorf("Expected no domain strategy for a pinned address, got %v", outbound.StreamSettings)
+	}
+
+	// The server itself is not modified
+	original := server.Settings["vnext"].([]interface{})[0].(map[string]interface{})
+	if original["address"] != "vpn.example.com" || len(server.StreamSettings["tlsSettings"].(map[string]interface{})) != 0 {
+		t.Errorf("Expected the server settings to be copied, got %v %v", server.Settings, server.StreamSettings)
+	}
+}
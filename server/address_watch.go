@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"xray-telegram-manager/types"
+)
+
+// addressWatch remembers the addresses the domain of the active server resolved to
+type addressWatch struct {
+	mutex    sync.Mutex
+	serverID string
+	addrs    []string
+}
+
+// observe records addrs of server and returns the change when none of them was an
+// address of the previous check. A domain rotating through a pool of addresses
+// keeps some of them and is not reported. The first check of a server, also after
+// a switch, only records its addresses.
+func (w *addressWatch) observe(server types.Server, addrs []string) *types.AddressChange {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	previous := w.addrs
+	known := w.serverID == server.ID
+	w.serverID = server.ID
+	w.addrs = addrs
+	if !known || len(previous) == 0 || len(addrs) == 0 {
+		return nil
+	}
+	for _, addr := range addrs {
+		for _, old := range previous {
+			if addr == old {
+				return nil
+			}
+		}
+	}
+	return &types.AddressChange{Server: server, Previous: previous, Current: addrs}
+}
+
+// CheckServerAddress resolves the domain of the active server again and returns the
+// change when it now points to entirely different IP addresses, which often means
+// the provider moved the server or the domain was hijacked. Nil is returned when
+// nothing changed, no server is active or the server is set by its IP address.
+func (sm *ServerManager) CheckServerAddress(ctx context.Context) (*types.AddressChange, error) {
+	current := sm.GetCurrentServer()
+	if current == nil || net.ParseIP(normalizeHost(current.Address)) != nil {
+		return nil, nil
+	}
+	resolved, err := sm.resolver.Refresh(ctx, current.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", current.Address, err)
+	}
+	addrs := make([]string, 0, len(resolved))
+	for _, addr := range resolved {
+		addrs = append(addrs, addr.IP.String())
+	}
+	sort.Strings(addrs)
+
+	change := sm.addressWatch.observe(*current, addrs)
+	if change != nil {
+		sm.logger.Warn("Address of %s (%s) changed from %v to %v", current.Name, current.Address, change.Previous, change.Current)
+	}
+	return change, nil
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"testing"
+	"xray-telegram-manager/types"
+)
+
+func TestAddressWatchReportsMovedServer(t *testing.T) {
+	var watch addressWatch
+	amsterdam := types.Server{ID: "ams", Name: "Amsterdam", Address: "ams.example.com"}
+	berlin := types.Server{ID: "ber", Name: "Berlin", Address: "ber.example.com"}
+
+	if change := watch.observe(amsterdam, []string{"192.0.2.1", "192.0.2.2"}); change != nil {
+		t.Fatalf("Expected the first check to record a baseline, got %+v", change)
+	}
+	// A pool rotating its addresses keeps one of them
+	if change := watch.observe(amsterdam, []string{"192.0.2.2", "192.0.2.3"}); change != nil {
+		t.Errorf("Expected a partly changed pool not to be reported, got %+v", change)
+	}
+	change := watch.observe(amsterdam, []string{"198.51.100.7"})
+	if change == nil {
+		t.Fatal("Expected the move to new addresses to be reported")
+	}
+	if change.Server.ID != "ams" || len(change.Previous) != 2 || change.Previous[0] != "192.0.2.2" || change.Current[0] != "198.51.100.7" {
+		t.Errorf("Unexpected change: %+v", change)
+	}
+	if change := watch.observe(amsterdam, []string{"198.51.100.7"}); change != nil {
+		t.Errorf("Expected the move to be reported once, got %+v", change)
+	}
+	// A switch starts over with the addresses of the new server
+	if change := watch.observe(berlin, []string{"203.0.113.5"}); change != nil {
+		t.Errorf("Expected a switch not to be reported, got %+v", change)
+	}
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"xray-telegram-manager/fsutil"
+	"xray-telegram-manager/types"
+)
+
+const (
+	// changesFileName is the changelog of the xray config in the cache directory
+	changesFileName = "xray_changes.json"
+	// maxConfigChanges bounds the changes kept on disk
+	maxConfigChanges = 50
+	// maxChangeDiffSize cuts the diff of a single change
+	maxChangeDiffSize = 16 << 10
+	// diffContext is the number of unchanged lines around each hunk
+	diffContext = 3
+	// maxDiffCells bounds the table of the line diff, larger files are shown as
+	// replaced completely
+	maxDiffCells = 4 << 20
+)
+
+// ConfigChangelog keeps the recent writes of the xray config files with their diffs
+type ConfigChangelog struct {
+	path    string
+	mutex   sync.Mutex
+	changes []types.ConfigChange
+}
+
+// NewConfigChangelog loads the changelog from path. A missing or damaged file gives
+// an empty changelog.
+func NewConfigChangelog(path string) *ConfigChangelog {
+	changelog := &ConfigChangelog{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return changelog
+	}
+	if err := json.Unmarshal(data, &changelog.changes); err != nil {
+		fmt.Printf("Warning: failed to parse config changelog %s: %v\n", path, err)
+		changelog.changes = nil
+	}
+	return changelog
+}
+
+// Record adds the change of file from before to after and saves the changelog. Writes
+// that leave the file as it was are not recorded.
+func (c *ConfigChangelog) Record(file string, before, after []byte, cause string) error {
+	if string(before) == string(after) {
+		return nil
+	}
+	diff, added, removed := unifiedDiff(filepath.Base(file), before, after)
+	change := types.ConfigChange{
+		Time:    time.Now(),
+		File:    file,
+		Cause:   cause,
+		Diff:    truncateDiff(diff),
+		Added:   added,
+		Removed: removed,
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.changes = append(c.changes, change)
+	if len(c.changes) > maxConfigChanges {
+		c.changes = append([]types.ConfigChange(nil), c.changes[len(c.changes)-maxConfigChanges:]...)
+	}
+	return c.saveUnsafe()
+}
+
+// Changes returns the recorded changes, the newest first
+func (c *ConfigChangelog) Changes() []types.ConfigChange {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	result := make([]types.ConfigChange, len(c.changes))
+	for i, change := range c.changes {
+		result[len(c.changes)-1-i] = change
+	}
+	return result
+}
+
+func (c *ConfigChangelog) saveUnsafe() error {
+	data, err := json.MarshalIndent(c.changes, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config changelog: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return fmt.Errorf("failed to create changelog directory: %w", err)
+	}
+	// The diffs hold server keys
+	if err := fsutil.WritePrivate(c.path, data); err != nil {
+		return fmt.Errorf("failed to write config changelog: %w", err)
+	}
+	return nil
+}
+
+// truncateDiff cuts a diff longer than maxChangeDiffSize at a line end
+func truncateDiff(diff string) string {
+	if len(diff) <= maxChangeDiffSize {
+		return diff
+	}
+	cut := strings.LastIndexByte(diff[:maxChangeDiffSize], '\n') + 1
+	skipped := strings.Count(diff[cut:], "\n")
+	return diff[:cut] + fmt.Sprintf("... %d more lines\n", skipped)
+}
+
+// diffLine is a line of an edit script: ' ' kept, '-' removed or '+' added
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// unifiedDiff returns the diff of before and after in the unified format with the
+// numbers of added and removed lines
+func unifiedDiff(name string, before, after []byte) (string, int, int) {
+	lines := diffLines(splitLines(before), splitLines(after))
+	added, removed := 0, 0
+	var changed []int
+	for i, line := range lines {
+		switch line.op {
+		case '+':
+			added++
+		case '-':
+			removed++
+		default:
+			continue
+		}
+		changed = append(changed, i)
+	}
+	if len(changed) == 0 {
+		return "", 0, 0
+	}
+
+	// oldLine and newLine are the numbers of the lines before each line of the script
+	oldLine := make([]int, len(lines)+1)
+	newLine := make([]int, len(lines)+1)
+	for i, line := range lines {
+		oldLine[i+1], newLine[i+1] = oldLine[i], newLine[i]
+		if line.op != '+' {
+			oldLine[i+1]++
+		}
+		if line.op != '-' {
+			newLine[i+1]++
+		}
+	}
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "--- a/%s\n+++ b/%s\n", name, name)
+	for i := 0; i < len(changed); {
+		j := i
+		// Changes closer than twice the context share a hunk
+		for j+1 < len(changed) && changed[j+1]-changed[j] <= 2*diffContext {
+			j++
+		}
+		start := max(changed[i]-diffContext, 0)
+		end := min(changed[j]+diffContext+1, len(lines))
+		oldStart, oldCount := oldLine[start]+1, oldLine[end]-oldLine[start]
+		newStart, newCount := newLine[start]+1, newLine[end]-newLine[start]
+		// An empty range points at the line before it
+		if oldCount == 0 {
+			oldStart--
+		}
+		if newCount == 0 {
+			newStart--
+		}
+		fmt.Fprintf(&builder, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, line := range lines[start:end] {
+			builder.WriteByte(line.op)
+			builder.WriteString(line.text)
+			builder.WriteByte('\n')
+		}
+		i = j + 1
+	}
+	return builder.String(), added, removed
+}
+
+// splitLines splits data into lines without their line ends
+func splitLines(data []byte) []string {
+	text := strings.TrimSuffix(string(data), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// diffLines returns the shortest edit script turning a into b, built from their
+// longest common subsequence
+func diffLines(a, b []string) []diffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var result []diffLine
+	for _, line := range a[:prefix] {
+		result = append(result, diffLine{' ', line})
+	}
+	result = append(result, diffMiddle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		result = append(result, diffLine{' ', line})
+	}
+	return result
+}
+
+// diffMiddle diffs the lines between the common prefix and suffix
+func diffMiddle(a, b []string) []diffLine {
+	n, m := len(a), len(b)
+	var result []diffLine
+	if n*m > maxDiffCells {
+		for _, line := range a {
+			result = append(result, diffLine{'-', line})
+		}
+		for _, line := range b {
+			result = append(result, diffLine{'+', line})
+		}
+		return result
+	}
+
+	// common[i][j] is the length of the common subsequence of a[i:] and b[j:]
+	common := make([][]int32, n+1)
+	for i := range common {
+		common[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			result = append(result, diffLine{' ', a[i]})
+			i++
+			j++
+		case common[i+1][j] >= common[i][j+1]:
+			result = append(result, diffLine{'-', a[i]})
+			i++
+		default:
+			result = append(result, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		result = append(result, diffLine{'-', a[i]})
+	}
+	for ; j < m; j++ {
+		result = append(result, diffLine{'+', b[j]})
+	}
+	return result
+}
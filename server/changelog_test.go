@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/operations"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	var before, after []string
+	for i := 1; i <= 20; i++ {
+		before = append(before, fmt.Sprintf("line %d", i))
+	}
+	after = append(after, before...)
+	after[1] = "line two"
+	after = append(after[:15], after[16:]...)
+	after = append(after, "line 21")
+
+	diff, added, removed := unifiedDiff("04_outbounds.json",
+		[]byte(strings.Join(before, "\n")+"\n"), []byte(strings.Join(after, "\n")+"\n"))
+	if added != 2 || removed != 2 {
+		t.Errorf("Expected 2 added and 2 removed lines, got %d and %d", added, removed)
+	}
+	expected := `--- a/04_outbounds.json
++++ b/04_outbounds.json
+@@ -1,5 +1,5 @@
+ line 1
+-line 2
++line two
+ line 3
+ line 4
+ line 5
+@@ -13,8 +13,8 @@
+ line 13
+ line 14
+ line 15
+-line 16
+ line 17
+ line 18
+ line 19
+ line 20
++line 21
+`
+	if diff != expected {
+		t.Errorf("Unexpected diff:\n%s", diff)
+	}
+
+	if diff, _, _ := unifiedDiff("a", nil, []byte("new\n")); diff != "--- a/a\n+++ b/a\n@@ -0,0 +1,1 @@\n+new\n" {
+		t.Errorf("Unexpected diff of a new file:\n%s", diff)
+	}
+}
+
+func TestConfigChangelog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), changesFileName)
+	changelog := NewConfigChangelog(path)
+	if err := changelog.Record("/opt/etc/xray/configs/04_outbounds.json", []byte("a\n"), []byte("a\n"), "unchanged"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxConfigChanges+5; i++ {
+		if err := changelog.Record("04_outbounds.json", []byte(fmt.Sprintf("%d\n", i)), []byte(fmt.Sprintf("%d\n", i+1)), fmt.Sprintf("change %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changes := NewConfigChangelog(path).Changes()
+	if len(changes) != maxConfigChanges {
+		t.Fatalf("Expected %d changes, got %d", maxConfigChanges, len(changes))
+	}
+	if changes[0].Cause != fmt.Sprintf("change %d", maxConfigChanges+4) || changes[len(changes)-1].Cause != "change 5" {
+		t.Errorf("Expected the newest change first, got %q ... %q", changes[0].Cause, changes[len(changes)-1].Cause)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the changelog to be private, got %04o", info.Mode().Perm())
+	}
+
+	long := strings.Repeat("x", 100) + "\n"
+	if diff := truncateDiff(strings.Repeat(long, 500)); len(diff) > maxChangeDiffSize+40 || !strings.HasSuffix(diff, "more lines\n") {
+		t.Errorf("Expected a cut diff, got %d bytes", len(diff))
+	}
+}
+
+func TestXrayControllerRecordsChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "04_outbounds.json")
+	initial := `{"outbounds": [{"tag": "proxy", "protocol": "vless"}, {"tag": "direct", "protocol": "freedom"}]}`
+	if err := os.WriteFile(path, []byte(initial), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changelog := NewConfigChangelog(filepath.Join(t.TempDir(), changesFileName))
+	coordinator := operations.NewCoordinator()
+	xc := NewXrayController(&configAdapter{&config.Config{ConfigPath: path}})
+	xc.SetChangelog(changelog, coordinator)
+
+	_, release, err := coordinator.Acquire(context.Background(), operations.OperationDirect, 42, operations.PolicyReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xc.EnableDirectMode(); err != nil {
+		t.Fatalf("EnableDirectMode failed: %v", err)
+	}
+	release()
+	if err := xc.DisableDirectMode(); err != nil {
+		t.Fatalf("DisableDirectMode failed: %v", err)
+	}
+
+	changes := changelog.Changes()
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 changes, got %+v", changes)
+	}
+	if changes[1].Cause != "direct mode enabled (direct mode toggle, chat 42)" || changes[1].File != path {
+		t.Errorf("Unexpected change %+v", changes[1])
+	}
+	if changes[0].Cause != "direct mode disabled" || !strings.Contains(changes[0].Diff, `+            "protocol": "vless"`) {
+		t.Errorf("Unexpected change %+v", changes[0])
+	}
+	if changes[0].Time.IsZero() || changes[0].Added == 0 || changes[0].Removed == 0 {
+		t.Errorf("Expected counted lines and a time, got %+v", changes[0])
+	}
+}
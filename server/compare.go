@@ -0,0 +1,164 @@
+package server
+
+import (
+	"fmt"
+	"time"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+)
+
+// compareTolerance is how much latencies and throughputs of two servers may differ
+// relatively and still count as even, a few milliseconds say nothing about a server
+const compareTolerance = 0.1
+
+// compareShareMargin is how much availability and stability shares may differ and
+// still count as even
+const compareShareMargin = 0.02
+
+// CompareServers picks the better of two measured servers metric by metric. A server
+// that answers now beats one that does not, otherwise the server that is better in
+// more metrics wins.
+func CompareServers(first, second types.ServerMeasurement) types.ServerComparison {
+	comparison := types.ServerComparison{
+		Servers: [2]types.ServerMeasurement{first, second},
+		Better:  make(map[string]int),
+		Winner:  -1,
+	}
+	better := func(metric string, index int) {
+		if index >= 0 {
+			comparison.Better[metric] = index
+		}
+	}
+
+	if first.Ping.Available && second.Ping.Available {
+		better(types.CompareLatency, betterLower(float64(first.Ping.Latency), float64(second.Ping.Latency)))
+	}
+	better(types.CompareHandshake, betterLower(float64(first.Handshake), float64(second.Handshake)))
+	if first.Availability.Known() && second.Availability.Known() {
+		better(types.CompareAvailability, betterShare(first.Availability.Week, second.Availability.Week))
+	}
+	if first.Stability >= 0 && second.Stability >= 0 {
+		better(types.CompareStability, betterShare(first.Stability, second.Stability))
+	}
+	better(types.CompareThroughput, betterHigher(first.Throughput, second.Throughput))
+
+	if first.Ping.Available != second.Ping.Available {
+		if first.Ping.Available {
+			comparison.Winner = 0
+		} else {
+			comparison.Winner = 1
+		}
+		return comparison
+	}
+	var wins [2]int
+	for _, index := range comparison.Better {
+		wins[index]++
+	}
+	switch {
+	case wins[0] > wins[1]:
+		comparison.Winner = 0
+	case wins[1] > wins[0]:
+		comparison.Winner = 1
+	}
+	return comparison
+}
+
+// betterLower returns the index of the clearly lower of two positive values, -1 when
+// one is unknown or they are even
+func betterLower(first, second float64) int {
+	if first <= 0 || second <= 0 {
+		return -1
+	}
+	switch {
+	case first < second*(1-compareTolerance):
+		return 0
+	case second < first*(1-compareTolerance):
+		return 1
+	}
+	return -1
+}
+
+// betterHigher returns the index of the clearly higher of two positive values, -1
+// when one is unknown or they are even
+func betterHigher(first, second float64) int {
+	if first <= 0 || second <= 0 {
+		return -1
+	}
+	switch {
+	case second < first*(1-compareTolerance):
+		return 0
+	case first < second*(1-compareTolerance):
+		return 1
+	}
+	return -1
+}
+
+// betterShare returns the index of the clearly higher of two shares, -1 when they are even
+func betterShare(first, second float64) int {
+	switch {
+	case first-second > compareShareMargin:
+		return 0
+	case second-first > compareShareMargin:
+		return 1
+	}
+	return -1
+}
+
+// CompareServers measures two servers side by side: a fresh TCP ping and handshake
+// of both, and their recorded availability, stability and throughput
+func (sm *ServerManager) CompareServers(firstID, secondID string) (types.ServerComparison, error) {
+	if firstID == secondID {
+		return types.ServerComparison{}, fmt.Errorf("cannot compare a server with itself")
+	}
+	first, err := sm.GetServerByID(firstID)
+	if err != nil {
+		return types.ServerComparison{}, err
+	}
+	second, err := sm.GetServerByID(secondID)
+	if err != nil {
+		return types.ServerComparison{}, err
+	}
+	servers := []types.Server{*first, *second}
+
+	profile := sm.pingTester.standardProfile()
+	profile.Mode = config.PingModeTCP
+	pings, err := sm.pingTester.TestServersWithProfile(servers, profile, nil)
+	if err != nil {
+		return types.ServerComparison{}, fmt.Errorf("failed to ping servers: %w", err)
+	}
+	profile.Mode = config.PingModeHandshake
+	handshakes, err := sm.pingTester.TestServersWithProfile(servers, profile, nil)
+	if err != nil {
+		return types.ServerComparison{}, fmt.Errorf("failed to test handshakes: %w", err)
+	}
+
+	stats := sm.stats.Lookup([]string{firstID, secondID})
+	now := time.Now()
+	var measured [2]types.ServerMeasurement
+	for i, server := range servers {
+		serverStats := stats[server.ID]
+		measurement := types.ServerMeasurement{
+			Server:       server,
+			Ping:         pings[i],
+			Network:      streamSetting(server.StreamSettings, "network"),
+			Security:     serverSecurity(server),
+			Availability: serverStats.Availability(now),
+			Stability:    -1,
+			Throughput:   serverStats.Throughput,
+		}
+		if measurement.Network == "" {
+			measurement.Network = server.Network
+		}
+		if handshakes[i].Available && handshakes[i].Method == types.PingMethodHandshake {
+			measurement.Handshake = handshakes[i].Latency
+		}
+		if stability, ok := serverStats.Stability(); ok {
+			measurement.Stability = stability
+		}
+		measured[i] = measurement
+	}
+
+	comparison := CompareServers(measured[0], measured[1])
+	sm.logger.Info("Compared servers %s and %s, winner index %d", first.Name, second.Name, comparison.Winner)
+	return comparison, nil
+}
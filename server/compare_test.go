@@ -0,0 +1,72 @@
+package server
+
+import (
+	"testing"
+	"time"
+	"xray-telegram-manager/types"
+)
+
+func TestCompareServers(t *testing.T) {
+	measurement := func(id string, latency time.Duration, availability, throughput float64) types.ServerMeasurement {
+		return types.ServerMeasurement{
+			Server:       types.Server{ID: id},
+			Ping:         types.PingResult{Available: latency > 0, Latency: latency},
+			Availability: types.Availability{Day: availability, Week: availability},
+			Stability:    -1,
+			Throughput:   throughput,
+		}
+	}
+
+	tests := []struct {
+		name          string
+		first, second types.ServerMeasurement
+		better        map[string]int
+		winner        int
+	}{
+		{
+			name:   "better in more metrics wins",
+			first:  measurement("a", 40*time.Millisecond, 0.99, 1000),
+			second: measurement("b", 90*time.Millisecond, 0.90, 2000),
+			better: map[string]int{types.CompareLatency: 0, types.CompareAvailability: 0, types.CompareThroughput: 1},
+			winner: 0,
+		},
+		{
+			name:   "close values are even",
+			first:  measurement("a", 50*time.Millisecond, 0.99, 0),
+			second: measurement("b", 52*time.Millisecond, 0.98, 0),
+			better: map[string]int{},
+			winner: -1,
+		},
+		{
+			name:   "answering server beats a faster history",
+			first:  measurement("a", 0, 1, 5000),
+			second: measurement("b", 80*time.Millisecond, 0.5, 1000),
+			better: map[string]int{types.CompareAvailability: 0, types.CompareThroughput: 0},
+			winner: 1,
+		},
+		{
+			name:   "unknown history is not compared",
+			first:  measurement("a", 100*time.Millisecond, -1, 0),
+			second: measurement("b", 60*time.Millisecond, 0.2, 0),
+			better: map[string]int{types.CompareLatency: 1},
+			winner: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			comparison := CompareServers(tt.first, tt.second)
+			if comparison.Winner != tt.winner {
+				t.Errorf("Expected winner %d, got %d", tt.winner, comparison.Winner)
+			}
+			if len(comparison.Better) != len(tt.better) {
+				t.Errorf("Expected better metrics %v, got %v", tt.better, comparison.Better)
+			}
+			for metric, index := range tt.better {
+				if got, ok := comparison.Better[metric]; !ok || got != index {
+					t.Errorf("Expected %s to be better on server %d, got %v", metric, index, comparison.Better)
+				}
+			}
+		})
+	}
+}
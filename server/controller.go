@@ -3,31 +3,78 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/fsutil"
+	"xray-telegram-manager/operations"
 	"xray-telegram-manager/types"
 )
 
 type XrayController struct {
 	config ConfigProvider
 	mutex  sync.Mutex // Protects file operations
+	// restartLogOffset is where the xray log stood before the last restart
+	restartLogOffset atomic.Int64
+	// changes records the writes of the xray config, nil when no changelog is kept
+	changes *ConfigChangelog
+	// operations tells during which operation a change was written
+	operations *operations.Coordinator
 }
 type ConfigProvider interface {
 	GetConfigPath() string
 	GetXrayRestartCommand() string
+	GetXrayCommands() config.XrayCommands
+	GetXrayLayout() string
+	GetRoutingPath() string
+	GetInboundsPath() string
+	GetXrayLogPath() string
+	GetXrayAPI() string
+	GetRestartTimeout() time.Duration
+	GetCommandTimeout() time.Duration
+	GetDev() config.Dev
 }
 
+// defaultRestartTimeout bounds the restart command when no timeout is configured
+const defaultRestartTimeout = 30 * time.Second
+
+// defaultCommandTimeout bounds the stop, start and status commands when no timeout
+// is configured
+const defaultCommandTimeout = 15 * time.Second
+
 func NewXrayController(config ConfigProvider) *XrayController {
 	return &XrayController{
 		config: config,
 		mutex:  sync.Mutex{},
 	}
 }
-func (xc *XrayController) UpdateConfig(server types.Server) error {
+
+// SetChangelog records the writes of the xray config in changes. The cause of each
+// change names the operation of ops holding the xray config.
+func (xc *XrayController) SetChangelog(changes *ConfigChangelog, ops *operations.Coordinator) {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+	xc.changes = changes
+	xc.operations = ops
+}
+
+// ErrNoProxyOutbound is returned when the xray config only has freedom and blackhole
+// outbounds
+var ErrNoProxyOutbound = types.MarkError(types.ErrConfigInvalid, errors.New("no proxy outbound found in xray configuration"))
+
+// dialerOutboundTag is the freedom outbound the proxy dials through for fragment and noise
+const dialerOutboundTag = "fragment-dialer"
+
+// UpdateConfig makes server the proxy outbound with the given anti-DPI options
+func (xc *XrayController) UpdateConfig(server types.Server, options types.OutboundOptions) error {
 	xc.mutex.Lock()
 	defer xc.mutex.Unlock()
 	if err := xc.backupConfigUnsafe(); err != nil {
@@ -37,13 +84,13 @@ func (xc *XrayController) UpdateConfig(server types.Server) error {
 	if err != nil {
 		return fmt.Errorf("failed to get current config: %w", err)
 	}
-	if err := xc.replaceProxyOutbound(config, server); err != nil {
+	if err := xc.replaceProxyOutbound(config, server, options); err != nil {
 		if restoreErr := xc.restoreConfigUnsafe(); restoreErr != nil {
 			return fmt.Errorf("failed to replace proxy outbound: %w, and failed to restore backup: %v", err, restoreErr)
 		}
 		return fmt.Errorf("failed to replace proxy outbound (backup restored): %w", err)
 	}
-	if err := xc.writeConfigUnsafe(config); err != nil {
+	if err := xc.writeConfigUnsafe(config, "proxy outbound set to "+server.Name); err != nil {
 		if restoreErr := xc.restoreConfigUnsafe(); restoreErr != nil {
 			return fmt.Errorf("failed to write config: %w, and failed to restore backup: %v", err, restoreErr)
 		}
@@ -51,34 +98,93 @@ func (xc *XrayController) UpdateConfig(server types.Server) error {
 	}
 	return nil
 }
-func (xc *XrayController) RestartService() error {
-	restartCmd := xc.config.GetXrayRestartCommand()
-	cmd := exec.Command("/bin/sh", "-c", restartCmd)
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+
+// RestartService restarts xray with xray_commands.restart, with xray_commands.stop
+// and start in turn, or with xray_restart_command. The commands are killed when ctx
+// ends or the configured restart timeout passes. Failures are ErrXrayRestartFailed.
+func (xc *XrayController) RestartService(ctx context.Context) error {
+	return types.MarkError(types.ErrXrayRestartFailed, xc.restartService(ctx))
+}
+
+func (xc *XrayController) restartService(ctx context.Context) error {
+	timeout := xc.config.GetRestartTimeout()
+	if timeout <= 0 {
+		timeout = defaultRestartTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start xray restart command: %w", err)
-	}
-	done := make(chan error, 1)
-	go func() {
-		done <- cmd.Wait()
-	}()
-	select {
-	case <-ctx.Done():
-		if cmd.Process != nil {
-			if err := cmd.Process.Kill(); err != nil {
-				// Process kill failed, but we continue anyway - this is expected
-				_ = err
-			}
+	logOffset := xc.logOffset()
+	xc.restartLogOffset.Store(logOffset)
+	if xc.devSandbox() != "" {
+		xc.mutex.Lock()
+		defer xc.mutex.Unlock()
+		if err := xc.restartStub(); err != nil {
+			return xc.newXrayFailure(fmt.Errorf("stub xray exited: %w", err), nil, logOffset)
 		}
-		return fmt.Errorf("xray restart command timed out after 30 seconds")
-	case err := <-done:
+		return nil
+	}
+
+	commands := xc.config.GetXrayCommands()
+	if commands.Restart == "" && commands.Stop != "" && commands.Start != "" {
+		if _, err := xc.runCommand(ctx, "stop", commands.Stop, logOffset); err != nil {
+			return err
+		}
+		_, err := xc.runCommand(ctx, "start", commands.Start, logOffset)
+		return err
+	}
+	command := commands.Restart
+	if command == "" {
+		command = xc.config.GetXrayRestartCommand()
+	}
+	_, err := xc.runCommand(ctx, "restart", command, logOffset)
+	return err
+}
+
+// ServiceStatus runs xray_commands.status and returns its output. It fails when the
+// command exits with an error, which means xray is not running, the failure carries
+// the xray log lines written since the last restart.
+func (xc *XrayController) ServiceStatus(ctx context.Context) (string, error) {
+	if xc.devSandbox() != "" {
+		pid, err := xc.stubPID()
 		if err != nil {
-			return fmt.Errorf("failed to restart xray service: %w", err)
+			return "", xc.newXrayFailure(err, nil, xc.restartLogOffset.Load())
 		}
+		return fmt.Sprintf("stub xray is running (pid %d)", pid), nil
 	}
-	return nil
-} // GetCurrentConfig reads and parses the current xray configuration (thread-safe)
+	command := xc.config.GetXrayCommands().Status
+	if command == "" {
+		return "", fmt.Errorf("xray_commands.status is not set")
+	}
+	timeout := xc.config.GetCommandTimeout()
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	output, err := xc.runCommand(ctx, "status", command, xc.restartLogOffset.Load())
+	return strings.TrimSpace(string(output)), err
+}
+
+// runCommand runs command through the shell until ctx ends and returns its combined
+// output. A failure carries the output and the xray log lines written after logOffset.
+func (xc *XrayController) runCommand(ctx context.Context, action, command string, logOffset int64) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	// Children of the killed shell may keep the output pipe open
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	switch {
+	case err == nil:
+		return output, nil
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return output, fmt.Errorf("xray %s command timed out: %w", action, ctx.Err())
+	case ctx.Err() != nil:
+		return output, fmt.Errorf("xray %s was canceled: %w", action, ctx.Err())
+	default:
+		return output, xc.newXrayFailure(fmt.Errorf("xray %s command failed: %w", action, err), output, logOffset)
+	}
+}
+
+// GetCurrentConfig reads and parses the current xray configuration (thread-safe)
 func (xc *XrayController) GetCurrentConfig() (*types.XrayConfig, error) {
 	xc.mutex.Lock()
 	defer xc.mutex.Unlock()
@@ -87,27 +193,73 @@ func (xc *XrayController) GetCurrentConfig() (*types.XrayConfig, error) {
 func (xc *XrayController) getCurrentConfigUnsafe() (*types.XrayConfig, error) {
 	data, err := os.ReadFile(xc.config.GetConfigPath())
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		return nil, types.MarkError(types.ErrConfigInvalid, fmt.Errorf("failed to read config file: %w", err))
 	}
 	var config types.XrayConfig
 	if err := json.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+		return nil, types.MarkError(types.ErrConfigInvalid, fmt.Errorf("failed to parse config file: %w", err))
 	}
 	return &config, nil
 }
+
+// FindXrayPID looks up the PID of the running xray process via /proc
+func (xc *XrayController) FindXrayPID() (int, error) {
+	if xc.devSandbox() != "" {
+		return xc.stubPID()
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read /proc: %w", err)
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(comm)) == "xray" {
+			return pid, nil
+		}
+	}
+	return 0, fmt.Errorf("xray process not found")
+}
+
+// VerifyRunning waits for delay and checks that xray is still running with
+// xray_commands.status, or by looking for the xray process. xray exits shortly after
+// a restart when it cannot load its config. The failure carries the xray log lines
+// written since the restart.
+func (xc *XrayController) VerifyRunning(delay time.Duration) error {
+	time.Sleep(delay)
+	if xc.config.GetXrayCommands().Status != "" || xc.devSandbox() != "" {
+		_, err := xc.ServiceStatus(context.Background())
+		return err
+	}
+	if _, err := xc.FindXrayPID(); err != nil {
+		return xc.newXrayFailure(err, nil, xc.restartLogOffset.Load())
+	}
+	return nil
+}
 func (xc *XrayController) BackupConfig() error {
 	xc.mutex.Lock()
 	defer xc.mutex.Unlock()
 	return xc.backupConfigUnsafe()
 }
 func (xc *XrayController) backupConfigUnsafe() error {
-	configPath := xc.config.GetConfigPath()
+	return xc.backupFileUnsafe(xc.config.GetConfigPath())
+}
+
+// backupFileUnsafe copies configPath to a timestamped backup next to it
+func (xc *XrayController) backupFileUnsafe(configPath string) error {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to read config file for backup: %w", err)
 	}
 	backupPath := fmt.Sprintf("%s.backup.%s.%d", configPath, time.Now().Format("20060102-150405"), os.Getpid())
-	if err := os.WriteFile(backupPath, data, 0644); err != nil {
+	// Backups are only read by the manager, keep the server keys in them private
+	if err := fsutil.WritePrivate(backupPath, data); err != nil {
 		return fmt.Errorf("failed to create backup file: %w", err)
 	}
 	return nil
@@ -118,7 +270,11 @@ func (xc *XrayController) RestoreConfig() error {
 	return xc.restoreConfigUnsafe()
 }
 func (xc *XrayController) restoreConfigUnsafe() error {
-	configPath := xc.config.GetConfigPath()
+	return xc.restoreFileUnsafe(xc.config.GetConfigPath())
+}
+
+// restoreFileUnsafe writes the most recent backup of configPath back to it
+func (xc *XrayController) restoreFileUnsafe(configPath string) error {
 	backupPattern := configPath + ".backup.*"
 	matches, err := filepath.Glob(backupPattern)
 	if err != nil {
@@ -146,39 +302,138 @@ func (xc *XrayController) restoreConfigUnsafe() error {
 	if err != nil {
 		return fmt.Errorf("failed to read backup file: %w", err)
 	}
-	if err := xc.writeFileAtomicUnsafe(configPath, backupData); err != nil {
+	if err := xc.writeXrayFileUnsafe(configPath, backupData, "restored from backup "+filepath.Base(mostRecentBackup)); err != nil {
 		return fmt.Errorf("failed to restore config from backup: %w", err)
 	}
 	return nil
 }
-func (xc *XrayController) writeConfigUnsafe(config *types.XrayConfig) error {
-	data, err := json.MarshalIndent(config, "", "    ")
+
+// writeConfigUnsafe writes the outbounds of config back to the config file. Only the
+// outbounds section is replaced: inbounds, routing and any other sections of a single
+// config.json are kept as they are in the file.
+func (xc *XrayController) writeConfigUnsafe(config *types.XrayConfig, cause string) error {
+	sections, err := readConfigSections(xc.config.GetConfigPath())
+	if err != nil {
+		return err
+	}
+	outbounds, err := json.Marshal(config.Outbounds)
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbounds: %w", err)
+	}
+	sections["outbounds"] = outbounds
+	data, err := json.MarshalIndent(sections, "", "    ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
-	return xc.writeFileAtomicUnsafe(xc.config.GetConfigPath(), data)
+	return xc.writeXrayFileUnsafe(xc.config.GetConfigPath(), data, cause)
+}
+
+// readConfigSections reads the top-level sections of an xray config file without
+// interpreting them
+func readConfigSections(path string) (map[string]json.RawMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, types.MarkError(types.ErrConfigInvalid, fmt.Errorf("failed to read config file: %w", err))
+	}
+	sections := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return nil, types.MarkError(types.ErrConfigInvalid, fmt.Errorf("failed to parse config file: %w", err))
+	}
+	return sections, nil
+}
+
+// DetectXrayLayout tells whether path is a complete xray config ("single") or the
+// outbounds file of the split configs/ directory ("split")
+func DetectXrayLayout(path string) (string, error) {
+	sections, err := readConfigSections(path)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range []string{"inbounds", "routing"} {
+		if value, ok := sections[key]; ok && string(value) != "null" && string(value) != "[]" {
+			return config.XrayLayoutSingle, nil
+		}
+	}
+	return config.XrayLayoutSplit, nil
+}
+
+// CheckLayout returns the layout in use and hints when the config file does not match
+// the configured layout. For the auto layout the detected one is returned.
+func (xc *XrayController) CheckLayout() (string, []string, error) {
+	configPath := xc.config.GetConfigPath()
+	configured := xc.config.GetXrayLayout()
+	detected, err := DetectXrayLayout(configPath)
+	if err != nil {
+		return configured, layoutCandidateHints(configPath), err
+	}
+	if configured == "" || configured == config.XrayLayoutAuto || configured == detected {
+		return detected, nil, nil
+	}
+
+	var hints []string
+	switch configured {
+	case config.XrayLayoutSplit:
+		hints = append(hints, fmt.Sprintf("%s looks like a complete xray config with inbounds or routing: set xray_layout to %q, or point config_path at the outbounds file in configs/", configPath, config.XrayLayoutSingle))
+	case config.XrayLayoutSingle:
+		hints = append(hints, fmt.Sprintf("%s has no inbounds or routing: set xray_layout to %q if it is the outbounds file of the configs/ directory", configPath, config.XrayLayoutSplit))
+	}
+	return configured, append(hints, layoutCandidateHints(configPath)...), nil
+}
+
+// layoutCandidateHints suggests config files of the other layout found next to configPath
+func layoutCandidateHints(configPath string) []string {
+	var hints []string
+	dir := filepath.Dir(configPath)
+	if matches, _ := filepath.Glob(filepath.Join(dir, "configs", "*outbounds*.json")); len(matches) > 0 {
+		hints = append(hints, fmt.Sprintf("found split configs: use config_path %q with xray_layout %q", matches[0], config.XrayLayoutSplit))
+	}
+	if single := filepath.Join(filepath.Dir(dir), "config.json"); filepath.Base(dir) == "configs" && single != configPath {
+		if _, err := os.Stat(single); err == nil {
+			hints = append(hints, fmt.Sprintf("found %s: use it as config_path with xray_layout %q", single, config.XrayLayoutSingle))
+		}
+	}
+	return hints
 }
 func (xc *XrayController) writeFileAtomicUnsafe(filePath string, data []byte) error {
-	tempPath := fmt.Sprintf("%s.tmp.%d.%d", filePath, time.Now().UnixNano(), os.Getpid())
-	if err := os.WriteFile(tempPath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write temporary file: %w", err)
+	// xray may run as another user and has to read the config
+	if err := fsutil.WriteShared(filePath, data); err != nil {
+		return types.MarkError(types.ErrConfigWriteFailed, fmt.Errorf("failed to replace config file: %w", err))
 	}
-	if err := os.Rename(tempPath, filePath); err != nil {
-		if err := os.Remove(tempPath); err != nil {
-			// Failed to remove temp file, but we continue anyway - this is expected
-			_ = err
+	return nil
+}
+
+// writeXrayFileUnsafe writes a file of the xray config and records the change with
+// its cause in the changelog
+func (xc *XrayController) writeXrayFileUnsafe(filePath string, data []byte, cause string) error {
+	before, _ := os.ReadFile(filePath)
+	if err := xc.writeFileAtomicUnsafe(filePath, data); err != nil {
+		return err
+	}
+	if xc.changes != nil {
+		if err := xc.changes.Record(filePath, before, data, xc.changeCause(cause)); err != nil {
+			fmt.Printf("Warning: failed to record config change: %v\n", err)
 		}
-		return fmt.Errorf("failed to replace config file: %w", err)
 	}
 	return nil
 }
-func (xc *XrayController) replaceProxyOutbound(config *types.XrayConfig, server types.Server) error {
-	newOutbound := types.XrayOutbound{
-		Tag:            server.Tag,
-		Protocol:       server.Protocol,
-		Settings:       server.Settings,
-		StreamSettings: server.StreamSettings,
+
+// changeCause adds the running operation that changes the xray config to cause
+func (xc *XrayController) changeCause(cause string) string {
+	if xc.operations == nil {
+		return cause
 	}
+	op, ok := xc.operations.Holder(operations.ResourceXrayConfig)
+	switch {
+	case !ok:
+		return cause
+	case op.Owner != 0:
+		return fmt.Sprintf("%s (%s, chat %d)", cause, op.Type.DisplayName(), op.Owner)
+	default:
+		return fmt.Sprintf("%s (%s)", cause, op.Type.DisplayName())
+	}
+}
+func (xc *XrayController) replaceProxyOutbound(config *types.XrayConfig, server types.Server, options types.OutboundOptions) error {
+	newOutbound := buildProxyOutbound(server, options)
 	proxyFound := false
 	for i, outbound := range config.Outbounds {
 		if outbound.Protocol != "freedom" && outbound.Protocol != "blackhole" {
@@ -190,17 +445,340 @@ func (xc *XrayController) replaceProxyOutbound(config *types.XrayConfig, server
 	if !proxyFound {
 		config.Outbounds = append([]types.XrayOutbound{newOutbound}, config.Outbounds...)
 	}
+	setDialerOutbound(config, options)
+	return nil
+}
+
+// buildProxyOutbound creates the outbound of server with mux and the dialer proxy applied.
+// Stream settings are copied so the server's own settings are not modified.
+func buildProxyOutbound(server types.Server, options types.OutboundOptions) types.XrayOutbound {
+	outbound := types.XrayOutbound{
+		Tag:            server.Tag,
+		Protocol:       server.Protocol,
+		Settings:       server.Settings,
+		StreamSettings: server.StreamSettings,
+	}
+
+	// XTLS Vision does not work over mux
+	if options.Mux && outboundFlow(server.Settings) == "" {
+		outbound.Mux = map[string]interface{}{
+			"enabled":     true,
+			"concurrency": options.MuxConcurrency,
+		}
+	}
+
+	if options.PinnedAddress != "" && hostFamily(server.Address) == "" {
+		pinAddress(&outbound, server.Address, options.PinnedAddress)
+		server.Address = options.PinnedAddress
+	}
+
+	// Servers given by IP literal are always reached over their own family
+	strategy := ""
+	if hostFamily(server.Address) == "" {
+		strategy = domainStrategy(options.IPFamily)
+	}
+
+	if options.Fragment || options.Noise || strategy != "" {
+		streamSettings := make(map[string]interface{}, len(outbound.StreamSettings)+1)
+		for key, value := range outbound.StreamSettings {
+			streamSettings[key] = value
+		}
+		sockopt := map[string]interface{}{}
+		if existing, ok := streamSettings["sockopt"].(map[string]interface{}); ok {
+			for key, value := range existing {
+				sockopt[key] = value
+			}
+		}
+		if options.Fragment || options.Noise {
+			sockopt["dialerProxy"] = dialerOutboundTag
+		}
+		if strategy != "" {
+			sockopt["domainStrategy"] = strategy
+		}
+		streamSettings["sockopt"] = sockopt
+		outbound.StreamSettings = streamSettings
+	}
+	applyOutboundExtra(&outbound, options.Extra)
+	return outbound
+}
+
+// transportHostKeys are the transport settings whose host defaults to the address
+var transportHostKeys = []string{"wsSettings", "httpupgradeSettings", "xhttpSettings", "splithttpSettings"}
+
+// pinAddress makes the outbound connect to ip instead of domain. The domain stays
+// the TLS server name and the transport host, which otherwise default to the address.
+// The settings of the server are copied, not modified.
+func pinAddress(outbound *types.XrayOutbound, domain, ip string) {
+	if vnext, ok := outbound.Settings["vnext"].([]interface{}); ok && len(vnext) > 0 {
+		if first, ok := vnext[0].(map[string]interface{}); ok {
+			pinned := mergeObjects(first, map[string]interface{}{"address": ip})
+			outbound.Settings = mergeObjects(outbound.Settings, nil)
+			outbound.Settings["vnext"] = append([]interface{}{pinned}, vnext[1:]...)
+		}
+	}
+
+	if outbound.StreamSettings == nil {
+		return
+	}
+	streamSettings := mergeObjects(outbound.StreamSettings, nil)
+	for _, key := range []string{"tlsSettings", "realitySettings"} {
+		if settings, ok := streamSettings[key].(map[string]interface{}); ok {
+			if name, _ := settings["serverName"].(string); name == "" {
+				streamSettings[key] = mergeObjects(settings, map[string]interface{}{"serverName": domain})
+			}
+		}
+	}
+	if security, _ := streamSettings["security"].(string); security == "tls" {
+		if _, ok := streamSettings["tlsSettings"]; !ok {
+			streamSettings["tlsSettings"] = map[string]interface{}{"serverName": domain}
+		}
+	}
+	for _, key := range transportHostKeys {
+		if settings, ok := streamSettings[key].(map[string]interface{}); ok {
+			headers, _ := settings["headers"].(map[string]interface{})
+			headerHost, _ := headers["Host"].(string)
+			if host, _ := settings["host"].(string); host == "" && headerHost == "" {
+				streamSettings[key] = mergeObjects(settings, map[string]interface{}{"host": domain})
+			}
+		}
+	}
+	outbound.StreamSettings = streamSettings
+}
+
+// applyOutboundExtra merges the configured extra fields into a generated outbound.
+// Mux extras only apply while mux is enabled.
+func applyOutboundExtra(outbound *types.XrayOutbound, extra map[string]interface{}) {
+	if streamSettings, ok := extra["streamSettings"].(map[string]interface{}); ok {
+		outbound.StreamSettings = mergeObjects(outbound.StreamSettings, streamSettings)
+	}
+	if mux, ok := extra["mux"].(map[string]interface{}); ok && outbound.Mux != nil {
+		outbound.Mux = mergeObjects(outbound.Mux, mux)
+	}
+}
+
+// mergeObjects returns a copy of base with extra merged in: objects are merged key
+// by key, any other value of extra replaces the one in base. base is not modified.
+func mergeObjects(base, extra map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(extra))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range extra {
+		extraObject, extraIsObject := value.(map[string]interface{})
+		baseObject, baseIsObject := merged[key].(map[string]interface{})
+		if extraIsObject && baseIsObject {
+			merged[key] = mergeObjects(baseObject, extraObject)
+		} else if extraIsObject {
+			merged[key] = mergeObjects(nil, extraObject)
+		} else {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// domainStrategy returns the xray domain strategy resolving domain names in the
+// preferred family first, or "" to keep the xray default
+func domainStrategy(family string) string {
+	switch family {
+	case config.IPFamilyIPv4:
+		return "UseIPv4v6"
+	case config.IPFamilyIPv6:
+		return "UseIPv6v4"
+	}
+	return ""
+}
+
+// outboundFlow returns the flow of the first vnext user, e.g. "xtls-rprx-vision"
+func outboundFlow(settings map[string]interface{}) string {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return ""
+	}
+	var parsed struct {
+		Vnext []struct {
+			Users []struct {
+				Flow string `json:"flow"`
+			} `json:"users"`
+		} `json:"vnext"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil || len(parsed.Vnext) == 0 || len(parsed.Vnext[0].Users) == 0 {
+		return ""
+	}
+	return parsed.Vnext[0].Users[0].Flow
+}
+
+// setDialerOutbound adds, updates or removes the freedom outbound used for fragment and noise
+func setDialerOutbound(config *types.XrayConfig, options types.OutboundOptions) {
+	outbounds := config.Outbounds[:0]
+	for _, outbound := range config.Outbounds {
+		if outbound.Tag != dialerOutboundTag {
+			outbounds = append(outbounds, outbound)
+		}
+	}
+	config.Outbounds = outbounds
+	if !options.Fragment && !options.Noise {
+		return
+	}
+
+	settings := map[string]interface{}{}
+	if options.Fragment {
+		settings["fragment"] = map[string]interface{}{
+			"packets":  options.FragmentPackets,
+			"length":   options.FragmentLength,
+			"interval": options.FragmentInterval,
+		}
+	}
+	// The dialer outbound resolves the server address when it is a domain name
+	if strategy := domainStrategy(options.IPFamily); strategy != "" {
+		settings["domainStrategy"] = strategy
+	}
+	if options.Noise {
+		settings["noises"] = []interface{}{
+			map[string]interface{}{"type": "rand", "packet": "10-20", "delay": "10-16"},
+		}
+	}
+	// The dialer outbound makes the connection, so it gets the extras such as sockopt.mark too
+	dialer := types.XrayOutbound{
+		Tag:      dialerOutboundTag,
+		Protocol: "freedom",
+		Settings: settings,
+	}
+	applyOutboundExtra(&dialer, options.Extra)
+	config.Outbounds = append(config.Outbounds, dialer)
+}
+
+// directModeStatePath is where the proxy outbound is kept while direct mode is enabled
+func (xc *XrayController) directModeStatePath() string {
+	return xc.config.GetConfigPath() + ".direct-mode.json"
+}
+
+// IsDirectMode reports whether the proxy outbound is currently replaced by a freedom outbound
+func (xc *XrayController) IsDirectMode() bool {
+	_, err := os.Stat(xc.directModeStatePath())
+	return err == nil
+}
+
+// GetPausedOutbound returns the proxy outbound saved when direct mode was enabled
+func (xc *XrayController) GetPausedOutbound() (*types.XrayOutbound, error) {
+	data, err := os.ReadFile(xc.directModeStatePath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read direct mode state: %w", err)
+	}
+	var outbound types.XrayOutbound
+	if err := json.Unmarshal(data, &outbound); err != nil {
+		return nil, fmt.Errorf("failed to parse direct mode state: %w", err)
+	}
+	return &outbound, nil
+}
+
+// EnableDirectMode replaces the proxy outbound with a freedom outbound using the same tag,
+// so routing rules keep working but traffic goes out directly. The proxy outbound is saved
+// to restore it later.
+func (xc *XrayController) EnableDirectMode() error {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+	if xc.IsDirectMode() {
+		return fmt.Errorf("direct mode is already enabled")
+	}
+	if err := xc.backupConfigUnsafe(); err != nil {
+		return fmt.Errorf("failed to create backup before enabling direct mode: %w", err)
+	}
+	config, err := xc.getCurrentConfigUnsafe()
+	if err != nil {
+		return fmt.Errorf("failed to get current config: %w", err)
+	}
+	proxyIndex := -1
+	for i, outbound := range config.Outbounds {
+		if outbound.Protocol != "freedom" && outbound.Protocol != "blackhole" {
+			proxyIndex = i
+			break
+		}
+	}
+	if proxyIndex == -1 {
+		return ErrNoProxyOutbound
+	}
+	stateData, err := json.MarshalIndent(config.Outbounds[proxyIndex], "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal proxy outbound: %w", err)
+	}
+	if err := xc.writeFileAtomicUnsafe(xc.directModeStatePath(), stateData); err != nil {
+		return fmt.Errorf("failed to save proxy outbound: %w", err)
+	}
+	config.Outbounds[proxyIndex] = types.XrayOutbound{
+		Tag:      config.Outbounds[proxyIndex].Tag,
+		Protocol: "freedom",
+		Settings: map[string]interface{}{},
+	}
+	if err := xc.writeConfigUnsafe(config, "direct mode enabled"); err != nil {
+		_ = os.Remove(xc.directModeStatePath())
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	return nil
+}
+
+// DisableDirectMode puts the saved proxy outbound back in place of the freedom outbound
+func (xc *XrayController) DisableDirectMode() error {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+	saved, err := xc.GetPausedOutbound()
+	if err != nil {
+		return err
+	}
+	if err := xc.backupConfigUnsafe(); err != nil {
+		return fmt.Errorf("failed to create backup before disabling direct mode: %w", err)
+	}
+	config, err := xc.getCurrentConfigUnsafe()
+	if err != nil {
+		return fmt.Errorf("failed to get current config: %w", err)
+	}
+	restored := false
+	for i, outbound := range config.Outbounds {
+		if outbound.Protocol == "freedom" && outbound.Tag == saved.Tag {
+			config.Outbounds[i] = *saved
+			restored = true
+			break
+		}
+	}
+	if !restored {
+		config.Outbounds = append([]types.XrayOutbound{*saved}, config.Outbounds...)
+	}
+	if err := xc.writeConfigUnsafe(config, "direct mode disabled"); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	if err := os.Remove(xc.directModeStatePath()); err != nil {
+		return fmt.Errorf("failed to remove direct mode state: %w", err)
+	}
+	return nil
+}
+
+// RestoreDirectMode writes config, taken while direct mode was enabled, back with
+// paused as the paused proxy outbound. It undoes DisableDirectMode when what followed
+// failed.
+func (xc *XrayController) RestoreDirectMode(config *types.XrayConfig, paused types.XrayOutbound) error {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+	stateData, err := json.MarshalIndent(paused, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal proxy outbound: %w", err)
+	}
+	if err := xc.writeFileAtomicUnsafe(xc.directModeStatePath(), stateData); err != nil {
+		return fmt.Errorf("failed to save proxy outbound: %w", err)
+	}
+	if err := xc.writeConfigUnsafe(config, "direct mode restored"); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
 	return nil
 }
-func (xc *XrayController) ReplaceProxyOutbound(server types.Server) error {
+func (xc *XrayController) ReplaceProxyOutbound(server types.Server, options types.OutboundOptions) error {
 	xc.mutex.Lock()
 	defer xc.mutex.Unlock()
 	config, err := xc.getCurrentConfigUnsafe()
 	if err != nil {
 		return fmt.Errorf("failed to get current config: %w", err)
 	}
-	if err := xc.replaceProxyOutbound(config, server); err != nil {
+	if err := xc.replaceProxyOutbound(config, server, options); err != nil {
 		return err
 	}
-	return xc.writeConfigUnsafe(config)
+	return xc.writeConfigUnsafe(config, "proxy outbound set to "+server.Name)
 }
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+)
+
+func TestRestartServiceDeadlines(t *testing.T) {
+	cfg := &config.Config{XrayRestartCommand: "sleep 5", Timeouts: config.Timeouts{RestartSeconds: 1}}
+	xc := NewXrayController(&configAdapter{cfg})
+
+	start := time.Now()
+	err := xc.RestartService(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, types.ErrXrayRestartFailed) {
+		t.Fatalf("Expected the restart to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Restart command was not killed on timeout, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := xc.RestartService(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a canceled restart, got %v", err)
+	}
+
+	cfg.XrayRestartCommand = "true"
+	if err := xc.RestartService(context.Background()); err != nil {
+		t.Errorf("RestartService failed: %v", err)
+	}
+}
+
+func TestRestartServiceFailureCause(t *testing.T) {
+	cfg := &config.Config{
+		XrayRestartCommand: `echo "Starting xray"; echo "Failed to start: listen tcp 127.0.0.1:1080: bind: address already in use" >&2; exit 1`,
+		XrayLogPath:        filepath.Join(t.TempDir(), "missing.log"),
+	}
+	xc := NewXrayController(&configAdapter{cfg})
+
+	err := xc.RestartService(context.Background())
+	var failure *XrayFailure
+	if !errors.As(err, &failure) {
+		t.Fatalf("Expected an XrayFailure, got %v", err)
+	}
+	if failure.Cause != "port already in use" {
+		t.Errorf("Expected the port cause, got %q", failure.Cause)
+	}
+	if len(failure.Output) != 2 {
+		t.Errorf("Expected the command output to be kept, got %v", failure.Output)
+	}
+	if !strings.Contains(err.Error(), "(cause: port already in use)") {
+		t.Errorf("Expected the cause in the error, got %q", err.Error())
+	}
+	if !errors.Is(err, types.ErrXrayRestartFailed) {
+		t.Errorf("Expected ErrXrayRestartFailed, got %v", err)
+	}
+}
+
+func TestRestartServiceCommands(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "started")
+	cfg := &config.Config{
+		XrayRestartCommand: "false",
+		XrayCommands:       config.XrayCommands{Stop: "true", Start: "touch " + marker},
+		XrayLogPath:        filepath.Join(t.TempDir(), "missing.log"),
+	}
+	xc := NewXrayController(&configAdapter{cfg})
+
+	if err := xc.RestartService(context.Background()); err != nil {
+		t.Fatalf("Expected stop and start to restart xray, got %v", err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("Start command was not run: %v", err)
+	}
+
+	cfg.XrayCommands = config.XrayCommands{Restart: "echo sudo: a password is required >&2; exit 1"}
+	err := xc.RestartService(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "NOPASSWD") {
+		t.Errorf("Expected the restart command to fail with the sudo cause, got %v", err)
+	}
+
+	cfg.XrayCommands = config.XrayCommands{Status: "echo xray is stopped; exit 3"}
+	output, err := xc.ServiceStatus(context.Background())
+	if err == nil || output != "xray is stopped" {
+		t.Errorf("Expected a failed status with its output, got %q, %v", output, err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "(output: xray is stopped)") {
+		t.Errorf("Expected the status output in the error, got %v", err)
+	}
+}
+
+func TestDiagnoseXrayFailure(t *testing.T) {
+	tests := []struct {
+		lines []string
+		cause string
+	}{
+		{[]string{"infra/conf: failed to build REALITY config > invalid publicKey"}, "invalid Reality publicKey"},
+		{[]string{"Failed to start: main: failed to load config files > invalid character '}'"}, "the xray config is not valid JSON"},
+		{[]string{"failed to load geosite: category-ru"}, "geosite.dat is missing or lacks a category used in routing"},
+		{[]string{"Xray 1.8.4 started", "main: something else failed"}, "main: something else failed"},
+		{[]string{"Xray 1.8.4 started"}, ""},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		if cause := diagnoseXrayFailure(test.lines); cause != test.cause {
+			t.Errorf("diagnoseXrayFailure(%v) = %q, expected %q", test.lines, cause, test.cause)
+		}
+	}
+}
+
+func TestConfigErrorKinds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "04_outbounds.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	xc := NewXrayController(&configAdapter{&config.Config{ConfigPath: path}})
+	if _, err := xc.GetCurrentConfig(); !errors.Is(err, types.ErrConfigInvalid) {
+		t.Errorf("Expected ErrConfigInvalid for broken JSON, got %v", err)
+	}
+	if !errors.Is(ErrNoProxyOutbound, types.ErrConfigInvalid) {
+		t.Error("Expected a config without proxy outbound to be invalid")
+	}
+	if errors.Is(ErrNoProxyOutbound, types.ErrXrayRestartFailed) {
+		t.Error("Expected the kinds to stay apart")
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"sort"
+	"xray-telegram-manager/types"
+)
+
+// regionalIndicatorA is the regional indicator symbol for the letter A, two of them form a flag
+const regionalIndicatorA = 0x1F1E6
+
+// countryCode returns the country code of the first flag emoji in a server name, e.g.
+// "DE" for "🇩🇪 Frankfurt", or an empty string when the name has no flag
+func countryCode(name string) string {
+	var previous rune
+	for _, r := range name {
+		if isRegionalIndicator(r) && isRegionalIndicator(previous) {
+			return string([]rune{previous - regionalIndicatorA + 'A', r - regionalIndicatorA + 'A'})
+		}
+		previous = r
+	}
+	return ""
+}
+
+// countryFlag returns the flag emoji of a country code
+func countryFlag(code string) string {
+	if len(code) != 2 {
+		return ""
+	}
+	return string([]rune{rune(code[0]-'A') + regionalIndicatorA, rune(code[1]-'A') + regionalIndicatorA})
+}
+func isRegionalIndicator(r rune) bool {
+	return r >= regionalIndicatorA && r <= regionalIndicatorA+25
+}
+
+// groupByCountry counts the servers of each country, largest groups first
+func groupByCountry(servers []types.Server) []types.CountryGroup {
+	counts := map[string]int{}
+	for _, server := range servers {
+		if code := countryCode(server.Name); code != "" {
+			counts[code]++
+		}
+	}
+	groups := make([]types.CountryGroup, 0, len(counts))
+	for code, count := range counts {
+		groups = append(groups, types.CountryGroup{Code: code, Flag: countryFlag(code), Servers: count})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Servers != groups[j].Servers {
+			return groups[i].Servers > groups[j].Servers
+		}
+		return groups[i].Code < groups[j].Code
+	})
+	return groups
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"testing"
+	"xray-telegram-manager/types"
+)
+
+func TestCountryCode(t *testing.T) {
+	tests := map[string]string{
+		"🇩🇪 Frankfurt":     "DE",
+		"Amsterdam 🇳🇱 #2":  "NL",
+		"🔥 🇺🇸 🇬🇧 Multi":    "US",
+		"No flag":          "",
+		"":                 "",
+		"Lone 🇩 indicator": "",
+	}
+	for name, expected := range tests {
+		if got := countryCode(name); got != expected {
+			t.Errorf("countryCode(%q) = %q, expected %q", name, got, expected)
+		}
+	}
+	if flag := countryFlag("DE"); flag != "🇩🇪" {
+		t.Errorf("Expected German flag, got %q", flag)
+	}
+}
+
+func TestGroupByCountry(t *testing.T) {
+	groups := groupByCountry([]types.Server{
+		{Name: "🇩🇪 Berlin"},
+		{Name: "🇳🇱 Amsterdam"},
+		{Name: "🇩🇪 Frankfurt"},
+		{Name: "Unknown"},
+	})
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 countries, got %+v", groups)
+	}
+	if groups[0].Code != "DE" || groups[0].Servers != 2 || groups[0].Flag != "🇩🇪" {
+		t.Errorf("Expected Germany with 2 servers first, got %+v", groups[0])
+	}
+}
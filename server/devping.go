@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+)
+
+// devPings counts the simulated pings of every server, so the latency_ms of a rule
+// are played in turn across ping tests and health checks
+var devPings = struct {
+	mutex  sync.Mutex
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+// simulatePing answers a ping in dev mode after the scripted or a made-up latency.
+// Servers without a matching rule get a latency between 30 and 300 ms derived from
+// their ID and every tenth of them does not answer.
+func simulatePing(ctx context.Context, dev config.Dev, server types.Server, handshake bool, timeout time.Duration) types.PingResult {
+	result := types.PingResult{Server: server, TestTime: time.Now(), Method: types.PingMethodTCP}
+	if handshake {
+		result.Method = types.PingMethodHandshake
+	}
+
+	latency, ok := scriptedLatency(dev, server)
+	if !ok {
+		hash := fnv.New32a()
+		hash.Write([]byte(server.ID))
+		sum := hash.Sum32()
+		latency = 30*time.Millisecond + time.Duration(sum%270)*time.Millisecond
+		if sum%10 == 0 {
+			latency = 0
+		}
+	}
+	if latency == 0 {
+		result.Error = fmt.Errorf("connection failed: simulated server does not answer")
+		return result
+	}
+
+	timer := time.NewTimer(min(latency, timeout))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		result.Error = fmt.Errorf("connection failed: %w", ctx.Err())
+		return result
+	case <-timer.C:
+	}
+	if latency > timeout {
+		result.Error = fmt.Errorf("connection failed: simulated timeout after %v", timeout)
+		return result
+	}
+	result.Available = true
+	result.Latency = latency
+	return result
+}
+
+// scriptedLatency returns the next latency of the first rule matching server, with
+// the jitter of the rule added
+func scriptedLatency(dev config.Dev, server types.Server) (time.Duration, bool) {
+	name := strings.ToLower(server.Name)
+	for _, rule := range dev.Pings {
+		if !strings.Contains(name, strings.ToLower(rule.Match)) {
+			continue
+		}
+		devPings.mutex.Lock()
+		count := devPings.counts[server.ID]
+		devPings.counts[server.ID] = count + 1
+		devPings.mutex.Unlock()
+
+		latencyMs := rule.LatencyMs[count%len(rule.LatencyMs)]
+		if latencyMs == 0 {
+			return 0, true
+		}
+		if rule.JitterMs > 0 {
+			latencyMs += rand.Intn(rule.JitterMs + 1)
+		}
+		return time.Duration(latencyMs) * time.Millisecond, true
+	}
+	return 0, false
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"xray-telegram-manager/types"
+)
+
+const (
+	// devPIDFile holds the PID of the stub xray, it is removed when the stub "exits"
+	devPIDFile = "xray.pid"
+	// devFirstPID is the PID of the first stub start, every restart counts up
+	devFirstPID = 10000
+)
+
+// devSeedConfig is the xray config the sandbox starts with, a placeholder proxy
+// outbound that the first switch replaces
+var devSeedConfig = types.XrayConfig{Outbounds: []types.XrayOutbound{
+	{
+		Tag:      "proxy",
+		Protocol: "vless",
+		Settings: map[string]interface{}{
+			"vnext": []interface{}{map[string]interface{}{
+				"address": "example.com",
+				"port":    443,
+				"users":   []interface{}{map[string]interface{}{"id": "00000000-0000-0000-0000-000000000000", "encryption": "none"}},
+			}},
+		},
+	},
+	{Tag: "direct", Protocol: "freedom"},
+	{Tag: "block", Protocol: "blackhole"},
+}}
+
+// devSandbox returns the sandbox of dev mode, empty when xray is real
+func (xc *XrayController) devSandbox() string {
+	dev := xc.config.GetDev()
+	if !dev.Enabled {
+		return ""
+	}
+	return dev.SandboxDir
+}
+
+// PrepareDevSandbox creates the sandbox of dev mode with a seed xray config and starts
+// the stub xray. It does nothing when dev mode is off or the sandbox exists.
+func (xc *XrayController) PrepareDevSandbox() error {
+	sandbox := xc.devSandbox()
+	if sandbox == "" {
+		return nil
+	}
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+	if err := os.MkdirAll(sandbox, 0755); err != nil {
+		return fmt.Errorf("failed to create dev sandbox: %w", err)
+	}
+	configPath := xc.config.GetConfigPath()
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		data, err := json.MarshalIndent(devSeedConfig, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal seed config: %w", err)
+		}
+		if err := xc.writeFileAtomicUnsafe(configPath, data); err != nil {
+			return fmt.Errorf("failed to write seed config: %w", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(sandbox, devPIDFile)); os.IsNotExist(err) {
+		return xc.restartStub()
+	}
+	return nil
+}
+
+// restartStub emulates an xray restart: the stub loads the config like xray does and
+// gets a new PID, a config it cannot load makes it exit with the error in its log
+func (xc *XrayController) restartStub() error {
+	sandbox := xc.devSandbox()
+	pidPath := filepath.Join(sandbox, devPIDFile)
+	pid := devFirstPID
+	if previous, err := xc.stubPID(); err == nil {
+		pid = previous + 1
+	}
+
+	config, err := xc.getCurrentConfigUnsafe()
+	if err != nil {
+		_ = os.Remove(pidPath)
+		xc.appendStubLog("[Error] failed to load config %s: %v", xc.config.GetConfigPath(), err)
+		return err
+	}
+	if err := os.WriteFile(pidPath, []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return fmt.Errorf("failed to write stub PID: %w", err)
+	}
+	tags := make([]string, 0, len(config.Outbounds))
+	for _, outbound := range config.Outbounds {
+		tags = append(tags, outbound.Tag)
+	}
+	xc.appendStubLog("[Info] stub xray %d started with outbounds %s", pid, strings.Join(tags, ", "))
+	return nil
+}
+
+// stubPID returns the PID of the running stub xray
+func (xc *XrayController) stubPID() (int, error) {
+	data, err := os.ReadFile(filepath.Join(xc.devSandbox(), devPIDFile))
+	if err != nil {
+		return 0, fmt.Errorf("stub xray is not running")
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid stub PID: %w", err)
+	}
+	return pid, nil
+}
+
+// appendStubLog writes a line in the format of the xray log to the sandbox log
+func (xc *XrayController) appendStubLog(format string, args ...interface{}) {
+	file, err := os.OpenFile(xc.config.GetXrayLogPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fmt.Fprintf(file, "%s %s\n", time.Now().Format("2006/01/02 15:04:05"), fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+)
+
+func newDevController(t *testing.T) (*XrayController, string) {
+	t.Helper()
+	sandbox := t.TempDir()
+	cfg := &config.Config{
+		ConfigPath:  filepath.Join(sandbox, "04_outbounds.json"),
+		XrayLogPath: filepath.Join(sandbox, "xray.log"),
+		Dev:         config.Dev{Enabled: true, SandboxDir: sandbox},
+	}
+	return NewXrayController(&configAdapter{cfg}), sandbox
+}
+
+func TestDevSandboxStubXray(t *testing.T) {
+	xc, sandbox := newDevController(t)
+	if err := xc.PrepareDevSandbox(); err != nil {
+		t.Fatalf("PrepareDevSandbox failed: %v", err)
+	}
+	config, err := xc.GetCurrentConfig()
+	if err != nil || len(config.Outbounds) != 3 {
+		t.Fatalf("Expected the seed config, got %+v, %v", config, err)
+	}
+	pid, err := xc.FindXrayPID()
+	if err != nil || pid != devFirstPID {
+		t.Fatalf("Expected the stub to run with PID %d, got %d, %v", devFirstPID, pid, err)
+	}
+
+	if err := xc.RestartService(context.Background()); err != nil {
+		t.Fatalf("RestartService failed: %v", err)
+	}
+	if pid, _ := xc.FindXrayPID(); pid != devFirstPID+1 {
+		t.Errorf("Expected a new PID after the restart, got %d", pid)
+	}
+	if err := xc.VerifyRunning(0); err != nil {
+		t.Errorf("Expected the stub to be running, got %v", err)
+	}
+
+	// A config xray cannot load makes the stub exit like xray
+	if err := os.WriteFile(filepath.Join(sandbox, "04_outbounds.json"), []byte("{broken"), 0644); err != nil {
+		t.Fatalf("Failed to break config: %v", err)
+	}
+	err = xc.RestartService(context.Background())
+	var failure *XrayFailure
+	if !errors.As(err, &failure) || failure.Cause != "the xray config is not valid JSON" {
+		t.Errorf("Expected a failure explained by the stub log, got %v", err)
+	}
+	if _, err := xc.ServiceStatus(context.Background()); err == nil {
+		t.Error("Expected the stub not to run after a failed restart")
+	}
+}
+
+func TestSimulatePingScript(t *testing.T) {
+	dev := config.Dev{Enabled: true, Pings: []config.DevPing{
+		{Match: "amsterdam", LatencyMs: []int{20, 0}},
+		{Match: "", LatencyMs: []int{500}},
+	}}
+	server := types.Server{ID: "dev-script-ams", Name: "🇳🇱 Amsterdam"}
+	ctx := context.Background()
+
+	first := simulatePing(ctx, dev, server, false, time.Second)
+	if !first.Available || first.Latency != 20*time.Millisecond {
+		t.Errorf("Expected the first scripted latency, got %+v", first)
+	}
+	if second := simulatePing(ctx, dev, server, false, time.Second); second.Available {
+		t.Errorf("Expected 0 to be a server that does not answer, got %+v", second)
+	}
+
+	slow := simulatePing(ctx, dev, types.Server{ID: "dev-script-other", Name: "Berlin"}, true, 100*time.Millisecond)
+	if slow.Available || slow.Error == nil || !strings.Contains(slow.Error.Error(), "timeout") {
+		t.Errorf("Expected a latency above the timeout to time out, got %+v", slow)
+	}
+	if slow.Method != types.PingMethodHandshake {
+		t.Errorf("Expected the handshake method, got %s", slow.Method)
+	}
+}
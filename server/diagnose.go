@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"xray-telegram-manager/types"
+)
+
+// failureContextLines is how many lines of the restart command output and of the
+// xray log are kept for a failed restart
+const failureContextLines = 20
+
+// XrayFailure is returned when xray failed to restart or exited after a restart.
+// It carries the output that tells why.
+type XrayFailure struct {
+	Err error
+	// Cause is a short explanation found in Output, empty when none was recognized
+	Cause string
+	// Output is the end of the restart command output and the xray log lines
+	// written since the restart
+	Output []string
+}
+
+func (e *XrayFailure) Error() string {
+	switch {
+	case e.Cause != "":
+		return fmt.Sprintf("%v (cause: %s)", e.Err, e.Cause)
+	case len(e.Output) > 0:
+		return fmt.Sprintf("%v (output: %s)", e.Err, truncateCause(e.Output[len(e.Output)-1]))
+	default:
+		return e.Err.Error()
+	}
+}
+func (e *XrayFailure) Unwrap() error {
+	return e.Err
+}
+
+// Is makes every XrayFailure an ErrXrayRestartFailed
+func (e *XrayFailure) Is(target error) bool {
+	return target == types.ErrXrayRestartFailed
+}
+
+// failureCause maps a fragment of xray output to a short explanation
+type failureCause struct {
+	fragment string
+	cause    string
+}
+
+// failureCauses are checked in order, more specific fragments go first
+var failureCauses = []failureCause{
+	{"publickey", "invalid Reality publicKey"},
+	{"shortid", "invalid Reality shortId"},
+	{"address already in use", "port already in use"},
+	{"geosite", "geosite.dat is missing or lacks a category used in routing"},
+	{"geoip", "geoip.dat is missing or lacks a category used in routing"},
+	{"uuid", "invalid user UUID"},
+	{"x509", "TLS certificate error"},
+	{"unknown field", "unsupported field in the xray config"},
+	{"invalid character", "the xray config is not valid JSON"},
+	{"failed to load config", "xray could not load its config"},
+	{"permission denied", "permission denied"},
+	{"password is required", "sudo asks for a password, allow the command with NOPASSWD"},
+	{"not permitted", "the command is not permitted by sudo or doas"},
+	{"not in the sudoers", "the user is not allowed to use sudo"},
+}
+
+// maxCauseLength cuts an unrecognized error line used as the cause
+const maxCauseLength = 200
+
+// diagnoseXrayFailure summarizes why xray failed from its output. An unrecognized
+// failure is explained by the last line that mentions an error.
+func diagnoseXrayFailure(lines []string) string {
+	for _, known := range failureCauses {
+		for _, line := range lines {
+			if strings.Contains(strings.ToLower(line), known.fragment) {
+				return known.cause
+			}
+		}
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		lower := strings.ToLower(lines[i])
+		if strings.Contains(lower, "failed") || strings.Contains(lower, "error") {
+			return truncateCause(lines[i])
+		}
+	}
+	return ""
+}
+
+// truncateCause cuts an output line used as the cause
+func truncateCause(line string) string {
+	if len(line) > maxCauseLength {
+		return line[:maxCauseLength] + "..."
+	}
+	return line
+}
+
+// newXrayFailure collects the end of the command output and the xray log lines
+// written since logOffset, and explains err with them
+func (xc *XrayController) newXrayFailure(err error, output []byte, logOffset int64) *XrayFailure {
+	var lines []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > failureContextLines {
+		lines = lines[len(lines)-failureContextLines:]
+	}
+	if logOffset > 0 {
+		if log, logErr := xc.ReadXrayLog(logOffset, failureContextLines); logErr == nil {
+			lines = append(lines, log.Lines...)
+		}
+	}
+	return &XrayFailure{Err: err, Cause: diagnoseXrayFailure(lines), Output: lines}
+}
+
+// logOffset returns the size of the xray log, where the lines of the next restart start
+func (xc *XrayController) logOffset() int64 {
+	log, err := xc.ReadXrayLog(-1, 0)
+	if err != nil {
+		return 0
+	}
+	return log.Offset
+}
@@ -0,0 +1,17 @@
+// Package server loads subscriptions, tests servers and manages the xray config.
+// It does not depend on the Telegram bot and can be embedded by other tools:
+//
+//   - NewSubscriptionLoader fetches and parses a subscription (SubscriptionLoader),
+//     NewVlessParser parses single vless:// links. The subscription is fetched by
+//     the SubscriptionSource registered for the scheme of its URL, RegisterSource
+//     adds sources for other schemes
+//   - NewPingTester measures the servers (types.PingTester)
+//   - NewXrayController reads and rewrites the xray config and restarts xray
+//   - NewServerManager combines them with the subscription cache, the server
+//     statistics and switching, as used by the service
+//
+// Tests embedding the manager can fix the time of loads with SetClock and the IDs
+// of loaded servers with SetServerIDFunc, so whole server lists compare stably.
+//
+// All of them are configured with a *config.Config, see config.LoadConfig.
+package server
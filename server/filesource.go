@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"xray-telegram-manager/types"
+)
+
+func init() {
+	RegisterSource("file", newFileSource)
+}
+
+// fileSource reads a hand-maintained server list from a local file, either plain
+// vless:// links, one per line, or the base64 format of subscriptions
+type fileSource struct {
+	path   string
+	decode func(data string) ([]types.Server, error)
+	parse  func(urls []string) ([]types.Server, error)
+
+	mutex sync.Mutex
+	// modTime and size are of the file as it was last read
+	modTime time.Time
+	size    int64
+	read    bool
+}
+
+func newFileSource(env SourceEnv) (SubscriptionSource, error) {
+	path, err := localSubscriptionPath(env.URL)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSource{path: path, decode: env.Decode, parse: env.Parse}, nil
+}
+
+// localSubscriptionPath returns the path of file:///opt/etc/servers.txt and of a plain
+// absolute path such as /opt/etc/servers.txt
+func localSubscriptionPath(u *url.URL) (string, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("file subscription %q must be on this host, use file:///path", u.String())
+	}
+	path := u.Path
+	if path == "" {
+		path = u.Opaque
+	}
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("file subscription path %q must be absolute", path)
+	}
+	return filepath.Clean(path), nil
+}
+
+func (s *fileSource) Fetch(ctx context.Context) ([]types.Server, SourceMeta, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, SourceMeta{}, fmt.Errorf("failed to open server list: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, SourceMeta{}, fmt.Errorf("failed to read server list: %w", err)
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxSubscriptionResponse))
+	if err != nil {
+		return nil, SourceMeta{}, fmt.Errorf("failed to read server list: %w", err)
+	}
+	// A broken edit is read once, not again on every check until the file changes
+	s.mutex.Lock()
+	s.modTime, s.size, s.read = info.ModTime(), info.Size(), true
+	s.mutex.Unlock()
+
+	text := strings.TrimSpace(string(data))
+	if text == "" {
+		return nil, SourceMeta{}, types.MarkError(types.ErrSubscriptionInvalid, fmt.Errorf("server list %s is empty", s.path))
+	}
+	if !strings.Contains(text, "vless://") {
+		servers, err := s.decode(text)
+		if err != nil {
+			return nil, SourceMeta{}, fmt.Errorf("failed to decode server list: %w", err)
+		}
+		return servers, SourceMeta{}, nil
+	}
+	var urls []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "vless://") {
+			urls = append(urls, line)
+		}
+	}
+	servers, err := s.parse(urls)
+	if err != nil {
+		return nil, SourceMeta{}, err
+	}
+	return servers, SourceMeta{}, nil
+}
+
+// Changed reports whether the modification time or the size of the file differ from
+// when it was last read. A missing file is not a change, the cached servers are kept.
+func (s *fileSource) Changed() bool {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.read || !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+}
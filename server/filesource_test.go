@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"xray-telegram-manager/config"
+)
+
+func TestFileSourceLoadsPlainList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.txt")
+	urls := generateVlessUrls(3)
+	list := "# hand-curated\n" + strings.Join(urls[:2], "\n") + "\n"
+	if err := os.WriteFile(path, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{SubscriptionURL: path, CacheDuration: 3600}
+	if err := config.ValidateSubscriptionURL(path); err != nil {
+		t.Fatalf("Expected a plain path to be accepted, got %v", err)
+	}
+	loader := NewSubscriptionLoaderWithCacheDir(cfg, t.TempDir())
+	servers, err := loader.LoadFromURL(context.Background())
+	if err != nil {
+		t.Fatalf("LoadFromURL failed: %v", err)
+	}
+	if len(servers) != 2 {
+		t.Fatalf("Expected 2 servers from the file, got %d", len(servers))
+	}
+	if !loader.Watchable() {
+		t.Fatal("Expected a file source to be watchable")
+	}
+	if loader.SourceChanged() {
+		t.Error("Expected no change right after loading")
+	}
+
+	if err := os.WriteFile(path, []byte(strings.Join(urls, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !loader.SourceChanged() {
+		t.Fatal("Expected the edited file to be reported as changed")
+	}
+	loader.InvalidateCache()
+	servers, err = loader.LoadFromURL(context.Background())
+	if err != nil || len(servers) != 3 {
+		t.Fatalf("Expected 3 servers after the edit, got %d (%v)", len(servers), err)
+	}
+	if loader.SourceChanged() {
+		t.Error("Expected no change after reloading")
+	}
+}
+
+func TestFileSourceLoadsBase64URL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.b64")
+	data := base64.StdEncoding.EncodeToString([]byte(strings.Join(generateVlessUrls(2), "\n")))
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loader := NewSubscriptionLoaderWithCacheDir(&config.Config{SubscriptionURL: "file://" + path}, t.TempDir())
+	servers, err := loader.LoadFromURL(context.Background())
+	if err != nil || len(servers) != 2 {
+		t.Fatalf("Expected 2 servers from the base64 file, got %d (%v)", len(servers), err)
+	}
+}
+
+func TestFileSourceRejectsRemoteHost(t *testing.T) {
+	_, err := NewSource(SourceEnv{Config: &config.Config{SubscriptionURL: "file://router/opt/servers.txt"}})
+	if err == nil {
+		t.Error("Expected a file URL with a host to be rejected")
+	}
+	loader := NewSubscriptionLoaderWithCacheDir(&config.Config{SubscriptionURL: "https://example.com/sub"}, t.TempDir())
+	if loader.Watchable() {
+		t.Error("Expected a loader without a source not to be watchable")
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"xray-telegram-manager/types"
+)
+
+// minReattachScore is the score from which a new server is taken for a removed one.
+// The UUID is often shared by all servers of a subscription, so it has to be backed
+// by the host or the name.
+const minReattachScore = 70
+
+// identityScore tells how likely next is previous under a new ID, from 0 to 100. A
+// different UUID rules the match out.
+func identityScore(previous, next types.Server) int {
+	previousUUID, nextUUID := serverUUID(previous), serverUUID(next)
+	if previousUUID != "" && nextUUID != "" && previousUUID != nextUUID {
+		return 0
+	}
+	score := 0
+	if previousUUID != "" && previousUUID == nextUUID {
+		score += 50
+	}
+	if equalHost(previous.Address, next.Address) {
+		score += 30
+	}
+	if previous.Port == next.Port {
+		score += 10
+	}
+	if strings.EqualFold(strings.TrimSpace(previous.Name), strings.TrimSpace(next.Name)) {
+		score += 20
+	}
+	if score > 100 {
+		score = 100
+	}
+	return score
+}
+
+// serverUUID returns the user ID of the server, from the first vnext user of its
+// settings when the field is not set. Settings are maps after parsing and generic
+// slices after they were read back from the cache.
+func serverUUID(server types.Server) string {
+	if server.UUID != "" {
+		return server.UUID
+	}
+	var first map[string]interface{}
+	switch vnext := server.Settings["vnext"].(type) {
+	case []map[string]interface{}:
+		if len(vnext) > 0 {
+			first = vnext[0]
+		}
+	case []interface{}:
+		if len(vnext) > 0 {
+			first, _ = vnext[0].(map[string]interface{})
+		}
+	}
+	var user map[string]interface{}
+	switch users := first["users"].(type) {
+	case []map[string]interface{}:
+		if len(users) > 0 {
+			user = users[0]
+		}
+	case []interface{}:
+		if len(users) > 0 {
+			user, _ = users[0].(map[string]interface{})
+		}
+	}
+	id, _ := user["id"].(string)
+	return id
+}
+
+// identityPair is a removed and an added server that may be the same server
+type identityPair struct {
+	removed, added int
+	score          int
+}
+
+// matchMovedServers pairs removed servers with added servers that look like them
+// under a new ID. A server is only paired when its best match is unambiguous, two
+// candidates with the same score leave both unpaired.
+func matchMovedServers(removed, added []types.Server) []identityPair {
+	var candidates []identityPair
+	for i, previous := range removed {
+		for j, next := range added {
+			if score := identityScore(previous, next); score >= minReattachScore {
+				candidates = append(candidates, identityPair{removed: i, added: j, score: score})
+			}
+		}
+	}
+	// A tie for the best score of a server makes its match ambiguous
+	bestRemoved := make(map[int][]int)
+	bestAdded := make(map[int][]int)
+	for _, pair := range candidates {
+		bestRemoved[pair.removed] = append(bestRemoved[pair.removed], pair.score)
+		bestAdded[pair.added] = append(bestAdded[pair.added], pair.score)
+	}
+	unambiguous := func(scores []int, score int) bool {
+		count := 0
+		for _, other := range scores {
+			if other > score {
+				return false
+			}
+			if other == score {
+				count++
+			}
+		}
+		return count == 1
+	}
+
+	var pairs []identityPair
+	for _, pair := range candidates {
+		if unambiguous(bestRemoved[pair.removed], pair.score) && unambiguous(bestAdded[pair.added], pair.score) {
+			pairs = append(pairs, pair)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].removed < pairs[j].removed })
+	return pairs
+}
+
+// reattachMoved moves the favorites, notes and other overrides of removed servers
+// to the added servers recognized as them. The servers whose data moved are taken
+// out of the change and listed as reattached.
+func (sm *ServerManager) reattachMoved(change *types.ServerListChange) {
+	pairs := matchMovedServers(change.Removed, change.Added)
+	if len(pairs) == 0 {
+		return
+	}
+	reattachedRemoved := make(map[int]bool)
+	reattachedAdded := make(map[int]bool)
+	for _, pair := range pairs {
+		previous, next := change.Removed[pair.removed], change.Added[pair.added]
+		moved, err := sm.overrides.Move(previous.ID, next.ID)
+		if err != nil {
+			sm.logger.Warn("Failed to save the data of %s moved to %s: %v", previous.ID, next.ID, err)
+		}
+		if len(moved) == 0 {
+			continue
+		}
+		sm.logger.Info("Server %s is now %s (confidence %d%%), moved %s",
+			previous.ID, next.ID, pair.score, strings.Join(moved, ", "))
+		change.Reattached = append(change.Reattached, types.Reattachment{
+			From:       previous,
+			To:         next,
+			Confidence: float64(pair.score) / 100,
+			Moved:      moved,
+		})
+		reattachedRemoved[pair.removed] = true
+		reattachedAdded[pair.added] = true
+	}
+	change.Removed = withoutIndexes(change.Removed, reattachedRemoved)
+	change.Added = withoutIndexes(change.Added, reattachedAdded)
+}
+
+func withoutIndexes(servers []types.Server, skip map[int]bool) []types.Server {
+	if len(skip) == 0 {
+		return servers
+	}
+	var result []types.Server
+	for i, server := range servers {
+		if !skip[i] {
+			result = append(result, server)
+		}
+	}
+	return result
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+)
+
+// inboundsFileName is the inbounds file of the split configs/ directory
+const inboundsFileName = "03_inbounds.json"
+
+// localProxyListen makes the local proxies reachable from the LAN, not only from the router
+const localProxyListen = "0.0.0.0"
+
+// localProxies are the inbounds the bot can add, keyed by protocol. Their tags carry
+// managedRulePrefix, inbounds without it belong to the user and are never changed.
+var localProxies = map[string]struct {
+	port     int
+	settings map[string]interface{}
+}{
+	"socks": {port: 10808, settings: map[string]interface{}{"auth": "noauth", "udp": true}},
+	"http":  {port: 10809, settings: map[string]interface{}{}},
+}
+
+// localProxyTag returns the tag of the managed inbound of protocol
+func localProxyTag(protocol string) string {
+	return managedRulePrefix + protocol
+}
+
+// inboundsPathUnsafe returns the file holding the inbounds section: inbounds_path when
+// set, config_path for a single config.json, otherwise 03_inbounds.json next to the
+// outbounds file
+func (xc *XrayController) inboundsPathUnsafe() string {
+	if path := xc.config.GetInboundsPath(); path != "" {
+		return path
+	}
+	configPath := xc.config.GetConfigPath()
+	layout := xc.config.GetXrayLayout()
+	if layout == "" || layout == config.XrayLayoutAuto {
+		if detected, err := DetectXrayLayout(configPath); err == nil {
+			layout = detected
+		}
+	}
+	if layout == config.XrayLayoutSingle {
+		return configPath
+	}
+	return filepath.Join(filepath.Dir(configPath), inboundsFileName)
+}
+
+// readInboundsUnsafe returns the top-level sections of the inbounds file and its inbounds
+func (xc *XrayController) readInboundsUnsafe() (string, map[string]json.RawMessage, []map[string]interface{}, error) {
+	path := xc.inboundsPathUnsafe()
+	if _, err := os.Stat(path); err != nil {
+		return path, nil, nil, fmt.Errorf("inbounds file %s not found, set inbounds_path to the file with the inbounds section", path)
+	}
+	sections, err := readConfigSections(path)
+	if err != nil {
+		return path, nil, nil, err
+	}
+	var inbounds []map[string]interface{}
+	if raw, ok := sections["inbounds"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &inbounds); err != nil {
+			return path, nil, nil, fmt.Errorf("failed to parse inbounds section: %w", err)
+		}
+	}
+	return path, sections, inbounds, nil
+}
+
+// GetInbounds returns the inbounds of the xray config in file order
+func (xc *XrayController) GetInbounds() ([]types.InboundStatus, error) {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+	_, _, inbounds, err := xc.readInboundsUnsafe()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]types.InboundStatus, 0, len(inbounds))
+	for _, inbound := range inbounds {
+		statuses = append(statuses, inboundStatus(inbound))
+	}
+	return statuses, nil
+}
+
+// SetLocalProxy adds or removes the managed SOCKS5 ("socks") or HTTP ("http") inbound
+// in the inbounds file. The file is backed up first so RestoreInbounds can undo the change.
+func (xc *XrayController) SetLocalProxy(protocol string, enabled bool) error {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+	proxy, ok := localProxies[protocol]
+	if !ok {
+		return fmt.Errorf("unknown local proxy: %s", protocol)
+	}
+	path, sections, inbounds, err := xc.readInboundsUnsafe()
+	if err != nil {
+		return err
+	}
+
+	tag := localProxyTag(protocol)
+	kept := make([]map[string]interface{}, 0, len(inbounds)+1)
+	for _, inbound := range inbounds {
+		status := inboundStatus(inbound)
+		if status.Tag == tag {
+			continue
+		}
+		if enabled && status.Port == strconv.Itoa(proxy.port) {
+			return fmt.Errorf("port %d is already used by inbound %s", proxy.port, status.Tag)
+		}
+		kept = append(kept, inbound)
+	}
+	if enabled {
+		kept = append(kept, map[string]interface{}{
+			"tag":      tag,
+			"listen":   localProxyListen,
+			"port":     proxy.port,
+			"protocol": protocol,
+			"settings": proxy.settings,
+			"sniffing": map[string]interface{}{"enabled": true, "destOverride": []string{"http", "tls"}},
+		})
+	}
+
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return fmt.Errorf("failed to marshal inbounds: %w", err)
+	}
+	sections["inbounds"] = data
+	content, err := json.MarshalIndent(sections, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal inbounds file: %w", err)
+	}
+	if err := xc.backupFileUnsafe(path); err != nil {
+		return fmt.Errorf("failed to create inbounds backup: %w", err)
+	}
+	cause := "local " + protocol + " proxy removed"
+	if enabled {
+		cause = "local " + protocol + " proxy added"
+	}
+	return xc.writeXrayFileUnsafe(path, content, cause)
+}
+
+// RestoreInbounds writes the most recent backup of the inbounds file back
+func (xc *XrayController) RestoreInbounds() error {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+	return xc.restoreFileUnsafe(xc.inboundsPathUnsafe())
+}
+
+// inboundStatus reads the fields /inbounds shows from an inbound of the config
+func inboundStatus(inbound map[string]interface{}) types.InboundStatus {
+	status := types.InboundStatus{}
+	status.Tag, _ = inbound["tag"].(string)
+	status.Protocol, _ = inbound["protocol"].(string)
+	status.Listen, _ = inbound["listen"].(string)
+	switch port := inbound["port"].(type) {
+	case float64:
+		status.Port = strconv.Itoa(int(port))
+	case string:
+		status.Port = port
+	}
+	_, known := localProxies[status.Protocol]
+	status.Managed = known && status.Tag == localProxyTag(status.Protocol)
+	return status
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"xray-telegram-manager/config"
+)
+
+func TestSetLocalProxySplitLayout(t *testing.T) {
+	dir := t.TempDir()
+	outboundsPath := filepath.Join(dir, "04_outbounds.json")
+	inboundsPath := filepath.Join(dir, inboundsFileName)
+	outbounds := `{"outbounds": [{"tag": "vless-reality", "protocol": "vless"}]}`
+	inbounds := `{"inbounds": [{"tag": "redirect", "port": 61219, "protocol": "dokodemo-door"}, {"tag": "tproxy", "port": "61220", "protocol": "dokodemo-door"}]}`
+	if err := os.WriteFile(outboundsPath, []byte(outbounds), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(inboundsPath, []byte(inbounds), 0644); err != nil {
+		t.Fatal(err)
+	}
+	xc := NewXrayController(&configAdapter{&config.Config{ConfigPath: outboundsPath, XrayLayout: config.XrayLayoutAuto}})
+
+	if err := xc.SetLocalProxy("socks", true); err != nil {
+		t.Fatalf("SetLocalProxy failed: %v", err)
+	}
+	// Enabling twice keeps a single managed inbound
+	if err := xc.SetLocalProxy("socks", true); err != nil {
+		t.Fatalf("SetLocalProxy failed: %v", err)
+	}
+	if err := xc.SetLocalProxy("http", true); err != nil {
+		t.Fatalf("SetLocalProxy failed: %v", err)
+	}
+	if err := xc.SetLocalProxy("http", false); err != nil {
+		t.Fatalf("SetLocalProxy failed: %v", err)
+	}
+
+	statuses, err := xc.GetInbounds()
+	if err != nil {
+		t.Fatalf("GetInbounds failed: %v", err)
+	}
+	if len(statuses) != 3 {
+		t.Fatalf("Expected 3 inbounds, got %+v", statuses)
+	}
+	if statuses[0].Tag != "redirect" || statuses[0].Port != "61219" || statuses[0].Managed {
+		t.Errorf("Expected the user inbound to be kept, got %+v", statuses[0])
+	}
+	if statuses[1].Port != "61220" {
+		t.Errorf("Expected a string port to be read, got %+v", statuses[1])
+	}
+	socks := statuses[2]
+	if socks.Tag != "xtm-socks" || socks.Protocol != "socks" || socks.Port != "10808" || socks.Listen != "0.0.0.0" || !socks.Managed {
+		t.Errorf("Unexpected local SOCKS inbound: %+v", socks)
+	}
+
+	// The last change is undone from its backup
+	if err := xc.RestoreInbounds(); err != nil {
+		t.Fatalf("RestoreInbounds failed: %v", err)
+	}
+	if statuses, _ := xc.GetInbounds(); len(statuses) != 4 {
+		t.Errorf("Expected the HTTP inbound back after restore, got %+v", statuses)
+	}
+}
+
+func TestSetLocalProxyPortConflict(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	single := `{"inbounds": [{"tag": "my-socks", "port": 10808, "protocol": "socks"}], "outbounds": [{"tag": "proxy", "protocol": "vless"}]}`
+	if err := os.WriteFile(configPath, []byte(single), 0644); err != nil {
+		t.Fatal(err)
+	}
+	xc := NewXrayController(&configAdapter{&config.Config{ConfigPath: configPath, XrayLayout: config.XrayLayoutSingle}})
+
+	err := xc.SetLocalProxy("socks", true)
+	if err == nil || !strings.Contains(err.Error(), "my-socks") {
+		t.Fatalf("Expected a port conflict with my-socks, got %v", err)
+	}
+	if err := xc.SetLocalProxy("http", true); err != nil {
+		t.Fatalf("SetLocalProxy failed: %v", err)
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"outbounds"`) || !strings.Contains(string(data), "xtm-http") {
+		t.Errorf("Expected the other sections to be kept and the HTTP inbound added, got %s", data)
+	}
+	if err := xc.SetLocalProxy("shadowsocks", true); err == nil {
+		t.Error("Expected an unknown local proxy to be rejected")
+	}
+}
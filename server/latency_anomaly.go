@@ -0,0 +1,118 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+	"xray-telegram-manager/types"
+)
+
+const (
+	// minBaselineSamples is how many answered pings before a rise make up the baseline
+	minBaselineSamples = 3
+	// maxLatencyAlternates is how many faster servers an anomaly suggests
+	maxLatencyAlternates = 3
+)
+
+// latencyWatch remembers the degraded period already alerted, so one rise is
+// reported once
+type latencyWatch struct {
+	mutex    sync.Mutex
+	serverID string
+	since    time.Time
+}
+
+// report records the degraded period of server and tells whether it is new
+func (w *latencyWatch) report(serverID string, since time.Time) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.serverID == serverID && w.since.Equal(since) {
+		return false
+	}
+	w.serverID = serverID
+	w.since = since
+	return true
+}
+
+// detectLatencyRise looks for a run of the latest samples whose latency is at least
+// factor times the median of the answered samples before them. The run counts when
+// it has two samples or more and lasted at least duration by now. It returns the
+// median, the latency of the latest sample and when the run started.
+func detectLatencyRise(samples []PingSample, now time.Time, factor float64, duration time.Duration) (baseline, current time.Duration, since time.Time, ok bool) {
+	start := len(samples)
+	for start > 0 {
+		sample := samples[start-1]
+		median, known := medianLatency(samples[:start-1])
+		if !sample.Available || !known || float64(sample.LatencyMs) < factor*float64(median) {
+			break
+		}
+		start--
+	}
+	if len(samples)-start < 2 || now.Sub(samples[start].At) < duration {
+		return 0, 0, time.Time{}, false
+	}
+	median, _ := medianLatency(samples[:start])
+	baseline = time.Duration(median) * time.Millisecond
+	current = time.Duration(samples[len(samples)-1].LatencyMs) * time.Millisecond
+	return baseline, current, samples[start].At, true
+}
+
+// medianLatency returns the median latency in milliseconds of the answered samples,
+// false when fewer than minBaselineSamples answered
+func medianLatency(samples []PingSample) (int64, bool) {
+	var latencies []int64
+	for _, sample := range samples {
+		if sample.Available {
+			latencies = append(latencies, sample.LatencyMs)
+		}
+	}
+	if len(latencies) < minBaselineSamples {
+		return 0, false
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	middle := len(latencies) / 2
+	if len(latencies)%2 == 0 {
+		return (latencies[middle-1] + latencies[middle]) / 2, true
+	}
+	return latencies[middle], true
+}
+
+// CheckLatencyAnomaly compares the recorded pings of the active server with its
+// usual latency and returns the anomaly when the latency stayed far above it for the
+// configured time, see config.LatencyAlert. Each degraded period is returned once,
+// nil is returned otherwise.
+func (sm *ServerManager) CheckLatencyAnomaly() *types.LatencyAnomaly {
+	settings := sm.config.GetLatencyAlert()
+	current := sm.GetCurrentServer()
+	if !settings.Enabled() || current == nil {
+		return nil
+	}
+	baseline, latency, since, ok := detectLatencyRise(sm.stats.Get(current.ID).Samples, sm.clock.Now(), settings.Factor, settings.Duration())
+	if !ok || !sm.latencyWatch.report(current.ID, since) {
+		return nil
+	}
+
+	anomaly := &types.LatencyAnomaly{Server: *current, Baseline: baseline, Current: latency, Since: since}
+	backups := sm.GetBackupServers([]string{current.ID}, maxLatencyAlternates)
+	ids := make([]string, 0, len(backups))
+	for _, server := range backups {
+		ids = append(ids, server.ID)
+	}
+	stats := sm.stats.Lookup(ids)
+	for _, server := range backups {
+		last := stats[server.ID].Samples[len(stats[server.ID].Samples)-1]
+		alternate := time.Duration(last.LatencyMs) * time.Millisecond
+		if alternate >= latency {
+			continue
+		}
+		anomaly.Alternates = append(anomaly.Alternates, types.PingResult{
+			Server:    server,
+			Latency:   alternate,
+			Success:   true,
+			Available: true,
+			TestTime:  last.At,
+		})
+	}
+	sm.logger.Warn("Latency of %s rose to %v from the usual %v since %s", current.Name, latency, baseline, since.Format(time.RFC3339))
+	return anomaly
+}
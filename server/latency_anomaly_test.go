@@ -0,0 +1,113 @@
+package server
+
+import (
+	"testing"
+	"time"
+	"xray-telegram-manager/clock"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+)
+
+func latencySamples(start time.Time, interval time.Duration, latencies ...int64) []PingSample {
+	samples := make([]PingSample, 0, len(latencies))
+	for i, latency := range latencies {
+		samples = append(samples, PingSample{Available: latency > 0, LatencyMs: latency, At: start.Add(time.Duration(i) * interval)})
+	}
+	return samples
+}
+
+func TestDetectLatencyRise(t *testing.T) {
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		latencies []int64
+		now       time.Duration
+		want      bool
+		baseline  time.Duration
+		since     time.Duration
+	}{
+		{name: "steady", latencies: []int64{50, 60, 55, 50, 65, 60}, now: 30 * time.Minute},
+		{name: "rise lasting", latencies: []int64{50, 60, 55, 50, 200, 240}, now: 30 * time.Minute, want: true, baseline: 52 * time.Millisecond, since: 20 * time.Minute},
+		{name: "single slow ping", latencies: []int64{50, 60, 55, 50, 60, 240}, now: 30 * time.Minute},
+		{name: "rise too short", latencies: []int64{50, 60, 55, 50, 200, 240}, now: 26 * time.Minute},
+		{name: "rise below factor", latencies: []int64{50, 60, 55, 50, 120, 140}, now: 30 * time.Minute},
+		{name: "failed ping ends the rise", latencies: []int64{50, 60, 55, 200, 0, 240}, now: 30 * time.Minute},
+		{name: "too little history", latencies: []int64{50, 60, 200, 240}, now: 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := latencySamples(start, 5*time.Minute, tt.latencies...)
+			baseline, _, since, ok := detectLatencyRise(samples, start.Add(tt.now), 3, 10*time.Minute)
+			if ok != tt.want {
+				t.Fatalf("Expected detected %v, got %v", tt.want, ok)
+			}
+			if ok && (baseline != tt.baseline || !since.Equal(start.Add(tt.since))) {
+				t.Errorf("Expected baseline %v since %v, got %v since %v", tt.baseline, tt.since, baseline, since.Sub(start))
+			}
+		})
+	}
+}
+
+func TestCheckLatencyAnomaly(t *testing.T) {
+	cfg := &config.Config{
+		LogLevel:     "error",
+		Memory:       config.Memory{PingHistorySize: 20, MaxStatsInMemory: 200},
+		LatencyAlert: config.LatencyAlert{Factor: 3, DurationMinutes: 10},
+	}
+	sm := NewServerManagerWithCacheDir(cfg, t.TempDir())
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	sm.SetClock(fake)
+	servers := []types.Server{{ID: "current", Name: "Current"}, {ID: "fast", Name: "Fast"}, {ID: "slower", Name: "Slower"}}
+	sm.setServers(servers)
+	sm.currentServer = &servers[0]
+
+	record := func(latencies map[string]int64) {
+		t.Helper()
+		var results []types.PingResult
+		for _, server := range servers {
+			latency := latencies[server.ID]
+			results = append(results, types.PingResult{
+				Server:    server,
+				Available: latency > 0,
+				Latency:   time.Duration(latency) * time.Millisecond,
+				TestTime:  fake.Now(),
+			})
+		}
+		if err := sm.stats.RecordPings(results); err != nil {
+			t.Fatalf("RecordPings failed: %v", err)
+		}
+		fake.Advance(5 * time.Minute)
+	}
+	for i := 0; i < 4; i++ {
+		record(map[string]int64{"current": 50, "fast": 80, "slower": 400})
+	}
+	record(map[string]int64{"current": 300, "fast": 80, "slower": 400})
+	if anomaly := sm.CheckLatencyAnomaly(); anomaly != nil {
+		t.Fatalf("Expected a single slow ping not to be alerted, got %+v", anomaly)
+	}
+	record(map[string]int64{"current": 320, "fast": 90, "slower": 400})
+
+	anomaly := sm.CheckLatencyAnomaly()
+	if anomaly == nil {
+		t.Fatal("Expected the lasting rise to be alerted")
+	}
+	if anomaly.Server.ID != "current" || anomaly.Baseline != 50*time.Millisecond || anomaly.Current != 320*time.Millisecond {
+		t.Errorf("Unexpected anomaly: %+v", anomaly)
+	}
+	if len(anomaly.Alternates) != 1 || anomaly.Alternates[0].Server.ID != "fast" || anomaly.Alternates[0].Latency != 90*time.Millisecond {
+		t.Errorf("Expected only the faster server as alternate, got %+v", anomaly.Alternates)
+	}
+	if again := sm.CheckLatencyAnomaly(); again != nil {
+		t.Errorf("Expected the same rise to be alerted once, got %+v", again)
+	}
+
+	cfg.LatencyAlert.Factor = -1
+	record(map[string]int64{"current": 50})
+	record(map[string]int64{"current": 400})
+	record(map[string]int64{"current": 400})
+	fake.Advance(10 * time.Minute)
+	if anomaly := sm.CheckLatencyAnomaly(); anomaly != nil {
+		t.Errorf("Expected no alert when disabled, got %+v", anomaly)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+	"xray-telegram-manager/clock"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/operations"
+	"xray-telegram-manager/types"
+)
+
+// loadRetryJitter spreads the retries by up to this share of the delay, so routers
+// that lost the subscription at the same time do not retry all at once
+const loadRetryJitter = 0.2
+
+// loadRetry schedules automatic retries of failed subscription loads
+type loadRetry struct {
+	mutex sync.Mutex
+	// ctx is the lifetime of the retries, nil until StartLoadRetries
+	ctx context.Context
+	// failures counts the failed retries of the current series
+	failures int
+	// pending is the scheduled retry, cancel stops it
+	pending   *types.LoadRetry
+	cancel    context.CancelFunc
+	onRetried func(retry types.LoadRetry, err error)
+}
+
+// StartLoadRetries makes failed subscription loads retry in the background with
+// exponential backoff until ctx ends, see config.LoadRetry. Loads canceled by their
+// caller are not retried.
+func (sm *ServerManager) StartLoadRetries(ctx context.Context) {
+	sm.loadRetry.mutex.Lock()
+	defer sm.loadRetry.mutex.Unlock()
+	sm.loadRetry.ctx = ctx
+}
+
+// OnLoadRetried registers a callback invoked after every automatic retry with its
+// result. retry.At is the time of the next retry, zero after a success or when the
+// last attempt failed.
+func (sm *ServerManager) OnLoadRetried(callback func(retry types.LoadRetry, err error)) {
+	sm.loadRetry.mutex.Lock()
+	defer sm.loadRetry.mutex.Unlock()
+	sm.loadRetry.onRetried = callback
+}
+
+// GetLoadRetry returns the scheduled retry of a failed load, nil when none is scheduled
+func (sm *ServerManager) GetLoadRetry() *types.LoadRetry {
+	sm.loadRetry.mutex.Lock()
+	defer sm.loadRetry.mutex.Unlock()
+	if sm.loadRetry.pending == nil {
+		return nil
+	}
+	pending := *sm.loadRetry.pending
+	return &pending
+}
+
+// loadFinished updates the retries with the result of a load. A success ends the
+// series. A failure schedules the next retry, unless one is already scheduled and
+// the failed load was not that retry. retried tells whether the load was a retry.
+// It returns the scheduled retry, nil when none is.
+func (sm *ServerManager) loadFinished(ctx context.Context, err error, retried bool) *types.LoadRetry {
+	r := &sm.loadRetry
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err == nil {
+		r.stopUnsafe()
+		r.failures = 0
+		return nil
+	}
+	settings := sm.config.GetSubscriptionRetry()
+	if r.ctx == nil || r.ctx.Err() != nil || ctx.Err() != nil || settings.MaxAttempts < 1 {
+		return nil
+	}
+	if !retried && r.pending != nil {
+		pending := *r.pending
+		return &pending
+	}
+	if retried {
+		r.failures++
+	}
+	r.stopUnsafe()
+	if r.failures >= settings.MaxAttempts {
+		sm.logger.Error("Subscription load failed %d retries in a row, giving up until the next refresh", r.failures)
+		r.failures = 0
+		return nil
+	}
+
+	attempt := r.failures + 1
+	delay := retryDelay(settings, attempt, rand.Float64())
+	retry := types.LoadRetry{Attempt: attempt, MaxAttempts: settings.MaxAttempts, At: sm.clock.Now().Add(delay)}
+	r.pending = &retry
+	retryCtx, cancel := context.WithCancel(r.ctx)
+	r.cancel = cancel
+	timer := sm.clock.NewTimer(delay)
+	sm.logger.Warn("Subscription load failed: %v, retry %d of %d in %v", err, attempt, settings.MaxAttempts, delay.Round(time.Second))
+	go sm.runLoadRetry(retryCtx, timer, retry)
+	return &retry
+}
+
+// stopUnsafe cancels the scheduled retry
+func (r *loadRetry) stopUnsafe() {
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+	r.pending = nil
+}
+
+// runLoadRetry waits for the retry and refreshes the servers. Like a refresh it waits
+// for a running ping test or switch.
+func (sm *ServerManager) runLoadRetry(ctx context.Context, timer clock.Timer, retry types.LoadRetry) {
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return
+	case <-timer.C():
+	}
+	_, release, err := sm.operations.Acquire(ctx, operations.OperationRefresh, 0, operations.PolicyQueue)
+	if err != nil {
+		return
+	}
+	sm.logger.Info("Retrying subscription load (attempt %d of %d)", retry.Attempt, retry.MaxAttempts)
+	sm.subscriptionLoader.InvalidateCache()
+	err = sm.loadServers(ctx)
+	release()
+	if ctx.Err() != nil {
+		return
+	}
+
+	next := sm.loadFinished(ctx, err, true)
+	result := types.LoadRetry{Attempt: retry.Attempt, MaxAttempts: retry.MaxAttempts}
+	if next != nil {
+		result.At = next.At
+	}
+	if err == nil {
+		sm.logger.Info("Subscription loaded on retry %d", retry.Attempt)
+	}
+	sm.loadRetry.mutex.Lock()
+	callback := sm.loadRetry.onRetried
+	sm.loadRetry.mutex.Unlock()
+	if callback != nil {
+		callback(result, err)
+	}
+}
+
+// retryDelay returns the wait before a retry: the initial delay doubled for every
+// attempt after the first, capped at the maximum, with random between 0 and 1
+// shifting it by up to loadRetryJitter either way
+func retryDelay(settings config.LoadRetry, attempt int, random float64) time.Duration {
+	delay := settings.InitialDelay()
+	for i := 1; i < attempt && delay < settings.MaxDelay(); i++ {
+		delay *= 2
+	}
+	if delay > settings.MaxDelay() {
+		delay = settings.MaxDelay()
+	}
+	return time.Duration(float64(delay) * (1 + loadRetryJitter*(2*random-1)))
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"xray-telegram-manager/clock"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+)
+
+type loadRetryResult struct {
+	retry types.LoadRetry
+	err   error
+}
+
+func newLoadRetryManager(t *testing.T, maxAttempts int) (*ServerManager, *MockSubscriptionLoader, *clock.Fake, chan loadRetryResult) {
+	t.Helper()
+	cfg := &config.Config{
+		ConfigPath:  "/tmp/test_config.json",
+		LogLevel:    "error",
+		PingTimeout: 5,
+		SubscriptionRetry: config.LoadRetry{
+			MaxAttempts:         maxAttempts,
+			InitialDelaySeconds: 60,
+			MaxDelaySeconds:     1800,
+		},
+	}
+	mockLoader := NewMockSubscriptionLoader(cfg)
+	sm := NewServerManager(cfg)
+	sm.subscriptionLoader = mockLoader
+	fake := clock.NewFake(time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC))
+	sm.SetClock(fake)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	sm.StartLoadRetries(ctx)
+	results := make(chan loadRetryResult, 10)
+	sm.OnLoadRetried(func(retry types.LoadRetry, err error) {
+		results <- loadRetryResult{retry: retry, err: err}
+	})
+	return sm, mockLoader, fake, results
+}
+
+func nextLoadRetry(t *testing.T, results chan loadRetryResult) loadRetryResult {
+	t.Helper()
+	select {
+	case result := <-results:
+		return result
+	case <-time.After(time.Second):
+		t.Fatal("Expected a retry to run")
+		return loadRetryResult{}
+	}
+}
+
+func TestLoadRetriesStopAtMaxAttempts(t *testing.T) {
+	sm, mockLoader, fake, results := newLoadRetryManager(t, 2)
+	mockLoader.SetError(errors.New("subscription unavailable"))
+
+	if err := sm.LoadServers(context.Background()); err == nil {
+		t.Fatal("Expected the load to fail")
+	}
+	retry := sm.GetLoadRetry()
+	if retry == nil || retry.Attempt != 1 || retry.MaxAttempts != 2 {
+		t.Fatalf("Expected the first retry to be scheduled, got %+v", retry)
+	}
+	if wait := retry.At.Sub(fake.Now()); wait < 48*time.Second || wait > 72*time.Second {
+		t.Errorf("Expected the first retry in about a minute, got %v", wait)
+	}
+
+	// A manual load failing meanwhile keeps the schedule
+	at := retry.At
+	if err := sm.LoadServers(context.Background()); err == nil {
+		t.Fatal("Expected the load to fail")
+	}
+	if retry := sm.GetLoadRetry(); retry == nil || retry.Attempt != 1 || !retry.At.Equal(at) {
+		t.Fatalf("Expected the scheduled retry to stay, got %+v", retry)
+	}
+
+	fake.Advance(2 * time.Minute)
+	result := nextLoadRetry(t, results)
+	if result.err == nil || result.retry.Attempt != 1 || result.retry.At.IsZero() {
+		t.Fatalf("Expected the first retry to fail and schedule another, got %+v", result)
+	}
+	retry = sm.GetLoadRetry()
+	if retry == nil || retry.Attempt != 2 {
+		t.Fatalf("Expected the second retry to be scheduled, got %+v", retry)
+	}
+	if wait := retry.At.Sub(fake.Now()); wait < 96*time.Second || wait > 144*time.Second {
+		t.Errorf("Expected the second retry in about two minutes, got %v", wait)
+	}
+
+	fake.Advance(3 * time.Minute)
+	result = nextLoadRetry(t, results)
+	if result.err == nil || result.retry.Attempt != 2 || !result.retry.At.IsZero() {
+		t.Fatalf("Expected the last retry to fail without another, got %+v", result)
+	}
+	if retry := sm.GetLoadRetry(); retry != nil {
+		t.Errorf("Expected no retry after the last attempt, got %+v", retry)
+	}
+	if fake.Pending() != 0 {
+		t.Errorf("Expected no timer left, got %d", fake.Pending())
+	}
+}
+
+func TestLoadRetryLoadsServers(t *testing.T) {
+	sm, mockLoader, fake, results := newLoadRetryManager(t, 5)
+	mockLoader.SetError(errors.New("subscription unavailable"))
+	if err := sm.LoadServers(context.Background()); err == nil {
+		t.Fatal("Expected the load to fail")
+	}
+
+	mockLoader.SetError(nil)
+	mockLoader.SetServers([]types.Server{{ID: "a", Name: "A"}})
+	fake.Advance(2 * time.Minute)
+	result := nextLoadRetry(t, results)
+	if result.err != nil || result.retry.Attempt != 1 || !result.retry.At.IsZero() {
+		t.Fatalf("Expected the retry to succeed, got %+v", result)
+	}
+	if len(sm.GetServers()) != 1 || sm.GetLoadRetry() != nil {
+		t.Errorf("Expected the servers loaded and no retry left, got %d servers and %+v", len(sm.GetServers()), sm.GetLoadRetry())
+	}
+}
+
+func TestLoadRetryDisabled(t *testing.T) {
+	sm, mockLoader, fake, _ := newLoadRetryManager(t, -1)
+	mockLoader.SetError(errors.New("subscription unavailable"))
+	if err := sm.LoadServers(context.Background()); err == nil {
+		t.Fatal("Expected the load to fail")
+	}
+	if retry := sm.GetLoadRetry(); retry != nil || fake.Pending() != 0 {
+		t.Errorf("Expected no retry with max_attempts -1, got %+v", retry)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	settings := config.LoadRetry{InitialDelaySeconds: 60, MaxDelaySeconds: 300}
+	tests := []struct {
+		attempt int
+		random  float64
+		want    time.Duration
+	}{
+		{attempt: 1, random: 0.5, want: time.Minute},
+		{attempt: 2, random: 0.5, want: 2 * time.Minute},
+		{attempt: 3, random: 0.5, want: 4 * time.Minute},
+		{attempt: 4, random: 0.5, want: 5 * time.Minute},
+		{attempt: 10, random: 0.5, want: 5 * time.Minute},
+		{attempt: 1, random: 0, want: 48 * time.Second},
+		{attempt: 1, random: 1, want: 72 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(settings, tt.attempt, tt.random); got != tt.want {
+			t.Errorf("retryDelay(attempt %d, random %v) = %v, want %v", tt.attempt, tt.random, got, tt.want)
+		}
+	}
+}
@@ -1,60 +1,132 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"xray-telegram-manager/clock"
 	"xray-telegram-manager/config"
+	"xray-telegram-manager/hooks"
 	"xray-telegram-manager/logger"
+	"xray-telegram-manager/operations"
 	"xray-telegram-manager/types"
 )
 
+// defaultCacheDir holds the servers cache and the manual overrides
+const defaultCacheDir = "/opt/etc/xray-manager/cache"
+
+// xrayVerifyDelay is how long xray gets to load a changed config before it is checked
+const xrayVerifyDelay = 3 * time.Second
+
+// overridesFileName is the manual overrides file in the cache directory
+const overridesFileName = "overrides.json"
+
+// maxSwitchHistory limits how many previously used servers are remembered
+const maxSwitchHistory = 10
+
 type ServerManager struct {
-	config             *config.Config
-	servers            []types.Server
+	config  *config.Config
+	servers []types.Server
+	// sortedServers is servers sorted by name, kept so GetServers does not sort on every call
+	sortedServers      []types.Server
 	currentServer      *types.Server
+	currentMatch       types.MatchConfidence
+	switchHistory      []types.Server
 	subscriptionLoader SubscriptionLoader
 	pingTester         *PingTesterImpl
 	xrayController     *XrayController
 	nameOptimizer      *ServerNameOptimizer
 	serverSorter       *ServerSorter
+	operations         *operations.Coordinator
+	hooks              *hooks.Runner
+	overrides          *ManualOverrides
+	stats              *StatsStore
+	resolver           *Resolver
+	addressWatch       addressWatch
+	loadRetry          loadRetry
+	latencyWatch       latencyWatch
+	serversChanged     func(change types.ServerListChange)
+	serverSwitched     func(server types.Server)
+	serversLoaded      func()
+	lastRefresh        time.Time
+	listVersion        string
+	clock              clock.Clock
 	logger             *logger.Logger
 	mutex              sync.RWMutex
+	// outboundDefaults are the defaults changed in /settings since the start, they
+	// are saved to the overrides fragment of the config
+	outboundDefaults types.OutboundOverride
+	outboundMutex    sync.Mutex
 }
 
 func NewServerManager(cfg *config.Config) *ServerManager {
+	if dev := cfg.GetDev(); dev.Enabled {
+		return NewServerManagerWithCacheDir(cfg, filepath.Join(dev.SandboxDir, "cache"))
+	}
 	logLevel := logger.ParseLogLevel(cfg.LogLevel)
 	log := logger.NewLogger(logLevel, nil)
 
-	return &ServerManager{
+	overrides := NewManualOverrides(filepath.Join(defaultCacheDir, overridesFileName))
+	resolver := NewResolver(cfg.DNS)
+
+	sm := &ServerManager{
 		config:             cfg,
 		servers:            make([]types.Server, 0),
 		currentServer:      nil,
+		currentMatch:       types.MatchNone,
 		subscriptionLoader: NewSubscriptionLoader(cfg),
-		pingTester:         NewPingTester(cfg),
+		pingTester:         &PingTesterImpl{config: cfg, overrides: overrides, resolver: resolver},
+		overrides:          overrides,
+		resolver:           resolver,
+		stats:              NewStatsStore(filepath.Join(defaultCacheDir, statsFileName), cfg.Memory.PingHistorySize, cfg.Memory.MaxStatsInMemory),
 		xrayController:     NewXrayController(&configAdapter{cfg}),
 		nameOptimizer:      NewServerNameOptimizer(cfg.UI.NameOptimizationThreshold, log),
 		serverSorter:       NewServerSorter(),
+		operations:         operations.NewCoordinator(),
+		hooks:              hooks.NewRunner(cfg.Hooks),
 		logger:             log,
 		mutex:              sync.RWMutex{},
+		clock:              clock.Real,
 	}
+	sm.xrayController.SetChangelog(NewConfigChangelog(filepath.Join(defaultCacheDir, changesFileName)), sm.operations)
+	return sm
 }
 func NewServerManagerWithCacheDir(cfg *config.Config, cacheDir string) *ServerManager {
 	logLevel := logger.ParseLogLevel(cfg.LogLevel)
 	log := logger.NewLogger(logLevel, nil)
 
-	return &ServerManager{
+	overrides := NewManualOverrides(filepath.Join(cacheDir, overridesFileName))
+	resolver := NewResolver(cfg.DNS)
+
+	sm := &ServerManager{
 		config:             cfg,
 		servers:            make([]types.Server, 0),
 		currentServer:      nil,
+		currentMatch:       types.MatchNone,
 		subscriptionLoader: NewSubscriptionLoaderWithCacheDir(cfg, cacheDir),
-		pingTester:         NewPingTester(cfg),
+		pingTester:         &PingTesterImpl{config: cfg, overrides: overrides, resolver: resolver},
+		overrides:          overrides,
+		resolver:           resolver,
+		stats:              NewStatsStore(filepath.Join(cacheDir, statsFileName), cfg.Memory.PingHistorySize, cfg.Memory.MaxStatsInMemory),
 		xrayController:     NewXrayController(&configAdapter{cfg}),
 		nameOptimizer:      NewServerNameOptimizer(cfg.UI.NameOptimizationThreshold, log),
 		serverSorter:       NewServerSorter(),
+		operations:         operations.NewCoordinator(),
+		hooks:              hooks.NewRunner(cfg.Hooks),
 		logger:             log,
 		mutex:              sync.RWMutex{},
+		clock:              clock.Real,
 	}
+	sm.xrayController.SetChangelog(NewConfigChangelog(filepath.Join(cacheDir, changesFileName)), sm.operations)
+	return sm
 }
 
 type configAdapter struct {
@@ -67,15 +139,100 @@ func (ca *configAdapter) GetConfigPath() string {
 func (ca *configAdapter) GetXrayRestartCommand() string {
 	return ca.XrayRestartCommand
 }
-func (sm *ServerManager) LoadServers() error {
+func (ca *configAdapter) GetXrayLayout() string {
+	return ca.XrayLayout
+}
+func (ca *configAdapter) GetRoutingPath() string {
+	return ca.RoutingPath
+}
+func (ca *configAdapter) GetInboundsPath() string {
+	return ca.InboundsPath
+}
+func (ca *configAdapter) GetXrayLogPath() string {
+	return ca.XrayLogPath
+}
+func (ca *configAdapter) GetXrayAPI() string {
+	return ca.XrayAPI
+}
+func (ca *configAdapter) GetRestartTimeout() time.Duration {
+	return ca.Timeouts.Restart()
+}
+func (ca *configAdapter) GetXrayCommands() config.XrayCommands {
+	return ca.XrayCommands
+}
+func (ca *configAdapter) GetCommandTimeout() time.Duration {
+	return ca.Timeouts.Command()
+}
+
+// Operations returns the coordinator that serializes conflicting operations
+func (sm *ServerManager) Operations() *operations.Coordinator {
+	return sm.operations
+}
+
+// Hooks returns the runner of the hook scripts of the config
+func (sm *ServerManager) Hooks() *hooks.Runner {
+	return sm.hooks
+}
+
+// OnServersChanged registers a callback invoked when a reload adds, removes or
+// reattaches servers
+func (sm *ServerManager) OnServersChanged(callback func(change types.ServerListChange)) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.serversChanged = callback
+}
+
+// OnServerSwitched registers a callback invoked after SwitchServer changed the current server
+func (sm *ServerManager) OnServerSwitched(callback func(server types.Server)) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.serverSwitched = callback
+}
+
+// OnServersLoaded registers a callback invoked after every successful LoadServers,
+// including the first one
+func (sm *ServerManager) OnServersLoaded(callback func()) {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
-	servers, err := sm.subscriptionLoader.LoadFromURL()
+	sm.serversLoaded = callback
+}
+
+// LoadServers loads the servers from the subscription, giving up when ctx ends or the
+// configured load timeout passes. A failed load is retried in the background once
+// StartLoadRetries was called.
+func (sm *ServerManager) LoadServers(ctx context.Context) error {
+	err := sm.loadServers(ctx)
+	sm.loadFinished(ctx, err, false)
+	return err
+}
+
+func (sm *ServerManager) loadServers(ctx context.Context) error {
+	var change types.ServerListChange
+	var callback func(change types.ServerListChange)
+	var loaded func()
+	// Runs after the lock is released
+	defer func() {
+		if callback != nil && !change.Empty() {
+			callback(change)
+		}
+		if loaded != nil {
+			loaded()
+		}
+	}()
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if timeout := sm.config.Timeouts.Load(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	servers, err := sm.subscriptionLoader.LoadFromURL(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to load servers from subscription: %w", err)
 	}
 	if len(servers) == 0 {
-		return fmt.Errorf("no servers found in subscription")
+		return types.MarkError(types.ErrSubscriptionInvalid, fmt.Errorf("no servers found in subscription"))
 	}
 
 	// Apply name optimization if enabled
@@ -91,17 +248,90 @@ func (sm *ServerManager) LoadServers() error {
 		}
 	}
 
-	sm.servers = servers
+	sm.markBlockedCountries(servers)
+
+	// The first load is not a change
+	if len(sm.servers) > 0 {
+		change.Added, change.Removed = diffServers(sm.servers, servers)
+		// Favorites and notes follow servers whose port or address changed
+		sm.reattachMoved(&change)
+		callback = sm.serversChanged
+	}
+	sm.setServers(servers)
+	sm.listVersion = serverListVersion(servers)
+	sm.lastRefresh = sm.clock.Now()
+	loaded = sm.serversLoaded
 	return nil
 }
-func (sm *ServerManager) GetServers() []types.Server {
+
+// GetLastRefresh returns when the server list was last loaded, zero before the first load
+func (sm *ServerManager) GetLastRefresh() time.Time {
 	sm.mutex.RLock()
 	defer sm.mutex.RUnlock()
-	result := make([]types.Server, len(sm.servers))
-	copy(result, sm.servers)
+	return sm.lastRefresh
+}
+
+// GetListVersion returns the version of the server list, it changes only when servers
+// are added or removed, so a server ID from a button with the same version still exists.
+// It is empty before the first load.
+func (sm *ServerManager) GetListVersion() string {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	return sm.listVersion
+}
+
+// serverListVersion hashes the sorted server IDs. A hash instead of a counter keeps
+// the version of an unchanged list across restarts of the bot.
+func serverListVersion(servers []types.Server) string {
+	ids := make([]string, len(servers))
+	for i, server := range servers {
+		ids[i] = server.ID
+	}
+	sort.Strings(ids)
+	hash := fnv.New32a()
+	for _, id := range ids {
+		_, _ = hash.Write([]byte(id))
+		_, _ = hash.Write([]byte{0})
+	}
+	return fmt.Sprintf("%08x", hash.Sum32())
+}
 
+// diffServers returns the servers that appear only in next and only in previous
+func diffServers(previous, next []types.Server) (added, removed []types.Server) {
+	previousIDs := make(map[string]bool, len(previous))
+	for _, server := range previous {
+		previousIDs[server.ID] = true
+	}
+	nextIDs := make(map[string]bool, len(next))
+	for _, server := range next {
+		nextIDs[server.ID] = true
+		if !previousIDs[server.ID] {
+			added = append(added, server)
+		}
+	}
+	for _, server := range previous {
+		if !nextIDs[server.ID] {
+			removed = append(removed, server)
+		}
+	}
+	return added, removed
+}
+
+// setServers replaces the server list and its sorted copy, the mutex must be held
+func (sm *ServerManager) setServers(servers []types.Server) {
+	sm.servers = servers
 	// Sort servers alphabetically for consistent display
-	return sm.serverSorter.SortAlphabetically(result)
+	sm.sortedServers = sm.serverSorter.SortAlphabetically(servers)
+}
+
+// GetServers returns the servers sorted by name. The sorting is done once per load,
+// the result is a copy the caller may modify.
+func (sm *ServerManager) GetServers() []types.Server {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	result := make([]types.Server, len(sm.sortedServers))
+	copy(result, sm.sortedServers)
+	return result
 }
 func (sm *ServerManager) GetCurrentServer() *types.Server {
 	sm.mutex.RLock()
@@ -112,6 +342,79 @@ func (sm *ServerManager) GetCurrentServer() *types.Server {
 	serverCopy := *sm.currentServer
 	return &serverCopy
 }
+
+// GetCurrentServerMatch returns how reliably the current server was identified
+func (sm *ServerManager) GetCurrentServerMatch() types.MatchConfidence {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	if sm.currentServer == nil {
+		return types.MatchNone
+	}
+	return sm.currentMatch
+}
+
+// GetCacheFile returns the path of the subscription servers cache
+func (sm *ServerManager) GetCacheFile() string {
+	return sm.subscriptionLoader.GetCacheFile()
+}
+
+// GetOverridesFile returns the file of the favorites, notes and other manual overrides
+func (sm *ServerManager) GetOverridesFile() string {
+	return sm.overrides.path
+}
+
+// GetStatsFile returns the file of the server statistics
+func (sm *ServerManager) GetStatsFile() string {
+	return sm.stats.path
+}
+
+// ReloadState drops the overrides and statistics held in memory, so files written by
+// a restore are used instead of being overwritten by the next save
+func (sm *ServerManager) ReloadState() {
+	sm.overrides.Reload()
+	sm.stats.Reload()
+}
+
+// GetConfigChanges returns the recorded writes of the xray config, the newest first
+func (sm *ServerManager) GetConfigChanges() []types.ConfigChange {
+	if sm.xrayController.changes == nil {
+		return nil
+	}
+	return sm.xrayController.changes.Changes()
+}
+
+// GetSubscriptionInfo returns the traffic quota and expiry reported by the provider, or nil
+func (sm *ServerManager) GetSubscriptionInfo() *types.SubscriptionInfo {
+	return sm.subscriptionLoader.GetSubscriptionInfo()
+}
+
+// GetXrayConfig reads the current xray outbounds configuration
+func (sm *ServerManager) GetXrayConfig() (*types.XrayConfig, error) {
+	return sm.xrayController.GetCurrentConfig()
+}
+
+// CheckXrayLayout returns the xray config layout in use and hints when config_path
+// does not match xray_layout
+func (sm *ServerManager) CheckXrayLayout() (string, []string, error) {
+	return sm.xrayController.CheckLayout()
+}
+
+// ReadXrayLog returns the relevant xray error log lines written after offset, see
+// XrayController.ReadXrayLog
+func (sm *ServerManager) ReadXrayLog(offset int64, maxLines int) (types.XrayLog, error) {
+	return sm.xrayController.ReadXrayLog(offset, maxLines)
+}
+
+// PrepareDevSandbox creates the sandbox of dev mode and starts the stub xray, see
+// config.Dev. It does nothing when dev mode is off.
+func (sm *ServerManager) PrepareDevSandbox() error {
+	return sm.xrayController.PrepareDevSandbox()
+}
+
+// GetXrayPID returns the PID of the running xray process
+func (sm *ServerManager) GetXrayPID() (int, error) {
+	return sm.xrayController.FindXrayPID()
+}
 func (sm *ServerManager) GetServerByID(serverID string) (*types.Server, error) {
 	sm.mutex.RLock()
 	defer sm.mutex.RUnlock()
@@ -121,15 +424,110 @@ func (sm *ServerManager) GetServerByID(serverID string) (*types.Server, error) {
 			return &serverCopy, nil
 		}
 	}
-	return nil, fmt.Errorf("server with ID %s not found", serverID)
+	return nil, types.MarkError(types.ErrServerNotFound, fmt.Errorf("server with ID %s not found", serverID))
+}
+
+// subscriptionWatcher is implemented by loaders whose source can tell when it changed
+type subscriptionWatcher interface {
+	Watchable() bool
+	SourceChanged() bool
+}
+
+// WatchesSubscription reports whether the subscription comes from a source that can
+// tell when it changed, such as a local file
+func (sm *ServerManager) WatchesSubscription() bool {
+	watcher, ok := sm.subscriptionLoader.(subscriptionWatcher)
+	return ok && watcher.Watchable()
+}
+
+// SubscriptionChanged reports whether a watched subscription changed since it was
+// last loaded
+func (sm *ServerManager) SubscriptionChanged() bool {
+	watcher, ok := sm.subscriptionLoader.(subscriptionWatcher)
+	return ok && watcher.SourceChanged()
+}
+
+// deterministicLoader is implemented by loaders that let tests fix the time and the
+// server IDs of a load
+type deterministicLoader interface {
+	SetClock(c clock.Clock)
+	SetServerIDFunc(fn ServerIDFunc)
+}
+
+// SetClock replaces the clock dating refreshes, availability and the subscription
+// loads, for tests. It must be called before the servers are loaded.
+func (sm *ServerManager) SetClock(c clock.Clock) {
+	sm.mutex.Lock()
+	sm.clock = c
+	sm.mutex.Unlock()
+	if loader, ok := sm.subscriptionLoader.(deterministicLoader); ok {
+		loader.SetClock(c)
+	}
 }
-func (sm *ServerManager) RefreshServers() error {
+
+// SetServerIDFunc makes loaded servers get their ID from fn, for tests comparing
+// whole server lists, refresh diffs or favorites. Nil restores the usual IDs.
+func (sm *ServerManager) SetServerIDFunc(fn ServerIDFunc) {
+	if loader, ok := sm.subscriptionLoader.(deterministicLoader); ok {
+		loader.SetServerIDFunc(fn)
+	}
+}
+func (sm *ServerManager) RefreshServers(ctx context.Context) error {
 	sm.subscriptionLoader.InvalidateCache()
-	return sm.LoadServers()
+	return sm.LoadServers(ctx)
+}
+
+// ProbeError is returned by SwitchServer when the target server failed the probe,
+// xray and its config were not touched
+type ProbeError struct {
+	Server string
+	Err    error
+}
+
+func (e *ProbeError) Error() string {
+	return fmt.Sprintf("server %s is not reachable, the current connection was kept: %v", e.Server, e.Err)
+}
+func (e *ProbeError) Unwrap() error {
+	return e.Err
 }
-func (sm *ServerManager) SwitchServer(serverID string) error {
+
+// SwitchServer points xray to another server and restarts it. Unless skip_switch_probe
+// is set the target is probed first and a *ProbeError is returned when it is down. The
+// switch is bounded by ctx and the configured switch timeout, a failed restart puts
+// the previous config back. The pre_switch and post_switch hooks run around the change
+// of the config.
+func (sm *ServerManager) SwitchServer(ctx context.Context, serverID string) (err error) {
+	if timeout := sm.config.Timeouts.Switch(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var hookEnv map[string]string
+	// Runs after the lock is released, once the switch was attempted
+	defer func() {
+		if hookEnv == nil {
+			return
+		}
+		hookEnv["XRAY_RESULT"] = "ok"
+		if err != nil {
+			hookEnv["XRAY_RESULT"] = "failed"
+			hookEnv["XRAY_ERROR"] = err.Error()
+		}
+		sm.runHook(context.WithoutCancel(ctx), hooks.PostSwitch, hookEnv)
+	}()
+	var switched *types.Server
+	var callback func(server types.Server)
+	// Runs after the lock is released
+	defer func() {
+		if callback != nil && switched != nil {
+			callback(*switched)
+		}
+	}()
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("server switch canceled: %w", err)
+	}
 	var targetServer *types.Server
 	for _, server := range sm.servers {
 		if server.ID == serverID {
@@ -139,50 +537,786 @@ func (sm *ServerManager) SwitchServer(serverID string) error {
 		}
 	}
 	if targetServer == nil {
-		return fmt.Errorf("server with ID %s not found", serverID)
+		return types.MarkError(types.ErrServerNotFound, fmt.Errorf("server with ID %s not found", serverID))
 	}
 	if sm.currentServer != nil && sm.currentServer.ID == serverID {
 		return fmt.Errorf("server %s is already active", targetServer.Name)
 	}
+	// Check the target first, so a dead server does not replace a working connection
+	if !sm.config.SkipSwitchProbe {
+		if result := sm.pingTester.Probe(ctx, *targetServer); !result.Available {
+			return &ProbeError{Server: targetServer.Name, Err: result.Error}
+		}
+	}
+	hookEnv = switchHookEnv(*targetServer, sm.currentServer)
+	sm.runHook(ctx, hooks.PreSwitch, hookEnv)
 	if err := sm.xrayController.BackupConfig(); err != nil {
 		return fmt.Errorf("failed to create backup before switching: %w", err)
 	}
-	if err := sm.xrayController.UpdateConfig(*targetServer); err != nil {
+	previous, _ := sm.xrayController.GetCurrentConfig()
+	// Selecting a server implicitly resumes the proxy. A failed switch goes back to
+	// direct mode with the same paused outbound instead of the latest backup.
+	restore := sm.xrayController.RestoreConfig
+	resumed := sm.xrayController.IsDirectMode()
+	if resumed {
+		paused, err := sm.xrayController.GetPausedOutbound()
+		if err != nil {
+			return fmt.Errorf("failed to read the paused outbound before switching: %w", err)
+		}
+		if previous != nil {
+			restore = func() error { return sm.xrayController.RestoreDirectMode(previous, *paused) }
+		}
+		if err := sm.xrayController.DisableDirectMode(); err != nil {
+			return fmt.Errorf("failed to disable direct mode before switching: %w", err)
+		}
+	}
+	if err := sm.xrayController.UpdateConfig(*targetServer, sm.outboundOptionsWithAddress(ctx, *targetServer)); err != nil {
+		// xray still runs in direct mode, the config is put back to match it
+		if resumed {
+			if restoreErr := restore(); restoreErr != nil {
+				sm.logger.Error("Failed to restore direct mode after the failed switch: %v", restoreErr)
+			}
+		}
 		return fmt.Errorf("failed to update xray configuration: %w", err)
 	}
-	if err := sm.xrayController.RestartService(); err != nil {
-		if restoreErr := sm.xrayController.RestoreConfig(); restoreErr != nil {
-			return fmt.Errorf("failed to restart xray service: %w, and failed to restore backup: %v", err, restoreErr)
+	if err := sm.applyOutboundsUnsafe(ctx, previous, restore); err != nil {
+		return err
+	}
+	sm.pushHistoryUnsafe(sm.currentServer, targetServer.ID)
+	sm.currentServer = targetServer
+	sm.currentMatch = types.MatchStrong
+	switched, callback = targetServer, sm.serverSwitched
+	return nil
+}
+
+// applyOutboundsUnsafe makes xray use the outbounds written to its config: through the
+// xray API when xray_api is set, by a restart when it is not or the API call fails.
+// previous is the config before the change, nil forces a restart. restore puts it
+// back when the restart fails.
+func (sm *ServerManager) applyOutboundsUnsafe(ctx context.Context, previous *types.XrayConfig, restore func() error) error {
+	if previous != nil && sm.config.XrayAPI != "" {
+		err := sm.xrayController.ReloadOutbounds(ctx, previous)
+		if err == nil {
+			sm.logger.Info("Applied outbounds through the xray API without a restart")
+			return nil
 		}
-		if restartErr := sm.xrayController.RestartService(); restartErr != nil {
-			return fmt.Errorf("failed to restart xray service after restore: %w (original error: %v)", restartErr, err)
+		sm.logger.Warn("Failed to apply outbounds through the xray API, restarting xray: %v", err)
+	}
+	return sm.restartXrayWithRollback(ctx, restore)
+}
+
+// restartXrayWithRollback restarts xray and calls restore to put the backed up file
+// back when it fails. The rollback runs even when ctx has ended, xray must not be
+// left with a config it could not start with.
+func (sm *ServerManager) restartXrayWithRollback(ctx context.Context, restore func() error) error {
+	err := sm.xrayController.RestartService(ctx)
+	if err == nil {
+		return nil
+	}
+	sm.logXrayFailure(err)
+	if restoreErr := restore(); restoreErr != nil {
+		return fmt.Errorf("failed to restart xray service: %w, and failed to restore backup: %v", err, restoreErr)
+	}
+	if restartErr := sm.xrayController.RestartService(context.WithoutCancel(ctx)); restartErr != nil {
+		return fmt.Errorf("failed to restart xray service after restore: %w (original error: %v)", restartErr, err)
+	}
+	return fmt.Errorf("xray service restart failed but backup was restored and service restarted: %w", err)
+}
+
+// logXrayFailure logs the xray output kept with a failed restart
+func (sm *ServerManager) logXrayFailure(err error) {
+	var failure *XrayFailure
+	if !errors.As(err, &failure) || len(failure.Output) == 0 {
+		return
+	}
+	sm.logger.Warn("Xray output of the failed restart:\n%s", strings.Join(failure.Output, "\n"))
+}
+
+// OutboundOptions returns the anti-DPI options for a server: the config defaults,
+// changed by /settings for all servers, then by the override of the server
+func (sm *ServerManager) OutboundOptions(serverID string) types.OutboundOptions {
+	options := sm.config.Outbound.Options()
+	options.IPFamily = sm.config.IPFamily
+	sm.GetOutboundDefaults().Apply(&options)
+	sm.overrides.GetOutboundOverride(serverID).Apply(&options)
+	return options
+}
+
+// outboundOptionsWithAddress returns the outbound options of server with the resolved
+// address to pin when dns.pin_address is set. When the domain cannot be resolved
+// the outbound keeps it, so xray resolves it itself.
+func (sm *ServerManager) outboundOptionsWithAddress(ctx context.Context, server types.Server) types.OutboundOptions {
+	options := sm.OutboundOptions(server.ID)
+	if !sm.config.DNS.PinAddress || sm.resolver == nil || hostFamily(server.Address) != "" {
+		return options
+	}
+	ip, err := sm.resolver.LookupPreferred(ctx, server.Address, sm.config.IPFamily)
+	if err != nil {
+		sm.logger.Warn("Failed to resolve %s, the outbound keeps the domain: %v", server.Address, err)
+		return options
+	}
+	options.PinnedAddress = ip.String()
+	return options
+}
+
+// GetOutboundDefaults returns the outbound options changed for all servers
+func (sm *ServerManager) GetOutboundDefaults() types.OutboundOverride {
+	sm.outboundMutex.Lock()
+	saved := sm.outboundDefaults
+	sm.outboundMutex.Unlock()
+	if saved != (types.OutboundOverride{}) {
+		return saved
+	}
+	return sm.overrides.GetOutboundDefaults()
+}
+
+// SetOutboundDefaults changes the outbound options of all servers, applied on the next
+// switch. They are saved to the outbound section of the overrides fragment of the
+// config, see config.SaveOverrides, and to the manual overrides without a config file.
+func (sm *ServerManager) SetOutboundDefaults(override types.OutboundOverride) error {
+	path := sm.config.GetConfigFilePath()
+	if path == "" {
+		return sm.overrides.SetOutboundDefaults(override)
+	}
+	values := map[string]interface{}{}
+	for key, value := range map[string]*bool{"mux": override.Mux, "fragment": override.Fragment, "noise": override.Noise} {
+		if value != nil {
+			values["outbound."+key] = *value
 		}
-		return fmt.Errorf("xray service restart failed but backup was restored and service restarted: %w", err)
 	}
-	sm.currentServer = targetServer
+	if _, err := config.SaveOverrides(path, values); err != nil {
+		return err
+	}
+	sm.outboundMutex.Lock()
+	sm.outboundDefaults = override
+	sm.outboundMutex.Unlock()
+
+	// Older versions kept the defaults in the manual overrides, they are in the
+	// fragment now and must not override it after a restart
+	if sm.overrides.GetOutboundDefaults() != (types.OutboundOverride{}) {
+		return sm.overrides.SetOutboundDefaults(types.OutboundOverride{})
+	}
+	return nil
+}
+
+// GetOutboundOverride returns the outbound options changed for one server
+func (sm *ServerManager) GetOutboundOverride(serverID string) types.OutboundOverride {
+	return sm.overrides.GetOutboundOverride(serverID)
+}
+
+// SetOutboundOverride changes the outbound options of one server, applied on the next switch
+func (sm *ServerManager) SetOutboundOverride(serverID string, override types.OutboundOverride) error {
+	return sm.overrides.SetOutboundOverride(serverID, override)
+}
+
+// ApplyOutboundOptions rewrites the outbound of the current server with the current
+// options and applies it to xray
+func (sm *ServerManager) ApplyOutboundOptions() error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if sm.currentServer == nil {
+		return fmt.Errorf("no server is active")
+	}
+	if sm.xrayController.IsDirectMode() {
+		return fmt.Errorf("direct mode is enabled, the options are applied when the proxy is resumed with a server switch")
+	}
+	if err := sm.xrayController.BackupConfig(); err != nil {
+		return fmt.Errorf("failed to create backup before applying outbound options: %w", err)
+	}
+	previous, _ := sm.xrayController.GetCurrentConfig()
+	if err := sm.xrayController.UpdateConfig(*sm.currentServer, sm.outboundOptionsWithAddress(context.Background(), *sm.currentServer)); err != nil {
+		return fmt.Errorf("failed to update xray configuration: %w", err)
+	}
+	return sm.applyOutboundsUnsafe(context.Background(), previous, sm.xrayController.RestoreConfig)
+}
+
+// GetRoutingPresets returns the routing presets and whether they are installed
+func (sm *ServerManager) GetRoutingPresets() ([]types.RoutingPresetStatus, error) {
+	return sm.xrayController.GetRoutingPresets()
+}
+
+// SetRoutingPreset installs or removes a routing preset and restarts xray. When xray
+// fails to restart or exits with the new rules (e.g. a geosite missing from
+// geosite.dat) the previous routing is restored.
+func (sm *ServerManager) SetRoutingPreset(id string, enabled bool) error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if err := sm.xrayController.SetRoutingPreset(id, enabled); err != nil {
+		return fmt.Errorf("failed to update routing: %w", err)
+	}
+	if err := sm.restartXrayWithRollback(context.Background(), sm.xrayController.RestoreRouting); err != nil {
+		return err
+	}
+	if err := sm.xrayController.VerifyRunning(xrayVerifyDelay); err != nil {
+		sm.logXrayFailure(err)
+		if restoreErr := sm.xrayController.RestoreRouting(); restoreErr != nil {
+			return fmt.Errorf("xray is not running with the new routing: %w, and failed to restore routing: %v", err, restoreErr)
+		}
+		if restartErr := sm.xrayController.RestartService(context.Background()); restartErr != nil {
+			return fmt.Errorf("failed to restart xray after restoring routing: %w (original error: %v)", restartErr, err)
+		}
+		return fmt.Errorf("xray is not running with the new routing, previous routing restored: %w", err)
+	}
+	return nil
+}
+
+// GetInbounds returns the inbounds of the xray config
+func (sm *ServerManager) GetInbounds() ([]types.InboundStatus, error) {
+	return sm.xrayController.GetInbounds()
+}
+
+// SetLocalProxy adds or removes the local SOCKS5 or HTTP inbound and restarts xray.
+// When xray does not come up with the new inbounds the previous file is restored.
+func (sm *ServerManager) SetLocalProxy(protocol string, enabled bool) error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if err := sm.xrayController.SetLocalProxy(protocol, enabled); err != nil {
+		return fmt.Errorf("failed to update inbounds: %w", err)
+	}
+	if err := sm.restartXrayWithRollback(context.Background(), sm.xrayController.RestoreInbounds); err != nil {
+		return err
+	}
+	if err := sm.xrayController.VerifyRunning(xrayVerifyDelay); err != nil {
+		sm.logXrayFailure(err)
+		if restoreErr := sm.xrayController.RestoreInbounds(); restoreErr != nil {
+			return fmt.Errorf("xray is not running with the new inbounds: %w, and failed to restore inbounds: %v", err, restoreErr)
+		}
+		if restartErr := sm.xrayController.RestartService(context.Background()); restartErr != nil {
+			return fmt.Errorf("failed to restart xray after restoring inbounds: %w (original error: %v)", restartErr, err)
+		}
+		return fmt.Errorf("xray is not running with the new inbounds, previous inbounds restored: %w", err)
+	}
+	return nil
+}
+
+// CheckXrayConfig returns an error when the xray config is missing or corrupted
+func (sm *ServerManager) CheckXrayConfig() error {
+	return sm.xrayController.CheckConfig()
+}
+
+// SaveGoldenConfig snapshots the current xray config as known-good for recovery
+func (sm *ServerManager) SaveGoldenConfig() error {
+	return sm.xrayController.SaveGoldenConfig()
+}
+
+// GetConfigRecoveryInfo tells which sources a corrupted xray config can be recovered from
+func (sm *ServerManager) GetConfigRecoveryInfo() types.ConfigRecoveryInfo {
+	return sm.xrayController.RecoveryInfo()
+}
+
+// RecoverXrayConfig replaces a corrupted xray config from source (types.ConfigRecoveryBackup
+// or types.ConfigRecoveryGolden), restarts xray and re-detects the current server
+func (sm *ServerManager) RecoverXrayConfig(source string) error {
+	sm.mutex.Lock()
+	err := sm.xrayController.RecoverConfig(source)
+	if err == nil {
+		if restartErr := sm.xrayController.RestartService(context.Background()); restartErr != nil {
+			err = fmt.Errorf("config recovered but xray failed to restart: %w", restartErr)
+		}
+	}
+	sm.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := sm.DetectCurrentServer(); err != nil {
+		sm.logger.Warn("Could not detect current server after config recovery: %v", err)
+	}
+	return nil
+}
+
+// pushHistoryUnsafe records the server being switched away from. Entries for the
+// new target are dropped so switching back and forth does not grow the stack.
+func (sm *ServerManager) pushHistoryUnsafe(previous *types.Server, targetID string) {
+	history := make([]types.Server, 0, len(sm.switchHistory)+1)
+	if previous != nil && previous.ID != targetID {
+		history = append(history, *previous)
+	}
+	for _, server := range sm.switchHistory {
+		if server.ID == targetID || (previous != nil && server.ID == previous.ID) {
+			continue
+		}
+		history = append(history, server)
+	}
+	if len(history) > maxSwitchHistory {
+		history = history[:maxSwitchHistory]
+	}
+	sm.switchHistory = history
+}
+
+// GetSwitchHistory returns recently used servers, most recent first
+func (sm *ServerManager) GetSwitchHistory() []types.Server {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	result := make([]types.Server, len(sm.switchHistory))
+	copy(result, sm.switchHistory)
+	return result
+}
+
+// GetPreviousServer returns the most recently used server that is still in the server list
+func (sm *ServerManager) GetPreviousServer() *types.Server {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	for _, previous := range sm.switchHistory {
+		for _, server := range sm.servers {
+			if server.ID == previous.ID {
+				serverCopy := server
+				return &serverCopy
+			}
+		}
+	}
+	return nil
+}
+
+// IsDirectMode reports whether the proxy is paused and traffic goes out directly
+func (sm *ServerManager) IsDirectMode() bool {
+	return sm.xrayController.IsDirectMode()
+}
+
+// EnableDirectMode pauses the proxy by swapping its outbound for a freedom outbound.
+// The selected server is remembered and restored by DisableDirectMode.
+func (sm *ServerManager) EnableDirectMode() error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if err := sm.xrayController.EnableDirectMode(); err != nil {
+		return fmt.Errorf("failed to enable direct mode: %w", err)
+	}
+	if err := sm.xrayController.RestartService(context.Background()); err != nil {
+		if restoreErr := sm.xrayController.DisableDirectMode(); restoreErr != nil {
+			return fmt.Errorf("failed to restart xray service: %w, and failed to restore proxy outbound: %v", err, restoreErr)
+		}
+		if restartErr := sm.xrayController.RestartService(context.Background()); restartErr != nil {
+			return fmt.Errorf("failed to restart xray service after restoring proxy: %w (original error: %v)", restartErr, err)
+		}
+		return fmt.Errorf("xray service restart failed, proxy outbound was restored: %w", err)
+	}
+	return nil
+}
+
+// directCheckTargets are dialed to check the internet works without the proxy
+var directCheckTargets = []string{"1.1.1.1:443", "8.8.8.8:443", "77.88.8.8:443"}
+
+// directCheckTimeout bounds connecting to one of directCheckTargets
+const directCheckTimeout = 5 * time.Second
+
+// Panic drops the proxy for direct internet whatever state it is in: the proxy
+// outbound is paused like with EnableDirectMode, xray is restarted, and a failed
+// restart is not rolled back to the proxy. It then checks that the router reaches
+// the internet directly.
+func (sm *ServerManager) Panic(ctx context.Context) (types.PanicResult, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	var result types.PanicResult
+	if sm.xrayController.IsDirectMode() {
+		result.WasDirect = true
+	} else if err := sm.xrayController.EnableDirectMode(); errors.Is(err, ErrNoProxyOutbound) {
+		result.WasDirect = true
+	} else if err != nil {
+		return result, fmt.Errorf("failed to pause the proxy: %w", err)
+	}
+	sm.logger.Warn("Panic: proxy paused, restarting xray for direct internet")
+	if err := sm.xrayController.RestartService(ctx); err != nil {
+		sm.logXrayFailure(err)
+		return result, fmt.Errorf("the proxy was paused but xray restart failed: %w", err)
+	}
+
+	result.Reachable, result.CheckError = checkDirectConnectivity(ctx)
+	return result, nil
+}
+
+// checkDirectConnectivity returns the first of directCheckTargets the router connects to
+func checkDirectConnectivity(ctx context.Context) (string, error) {
+	var lastErr error
+	for _, target := range directCheckTargets {
+		dialCtx, cancel := context.WithTimeout(ctx, directCheckTimeout)
+		conn, err := (&net.Dialer{}).DialContext(dialCtx, "tcp", target)
+		cancel()
+		if err == nil {
+			conn.Close()
+			return target, nil
+		}
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+// DisableDirectMode resumes the proxy with the outbound saved by EnableDirectMode
+func (sm *ServerManager) DisableDirectMode() error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if !sm.xrayController.IsDirectMode() {
+		return fmt.Errorf("direct mode is not enabled")
+	}
+	if err := sm.xrayController.DisableDirectMode(); err != nil {
+		return fmt.Errorf("failed to disable direct mode: %w", err)
+	}
+	if err := sm.xrayController.RestartService(context.Background()); err != nil {
+		return fmt.Errorf("proxy outbound was restored but xray service restart failed: %w", err)
+	}
+	return nil
+}
+
+// GetPingTarget returns the ping target override of a server, if any
+func (sm *ServerManager) GetPingTarget(serverID string) (PingTarget, bool) {
+	return sm.overrides.GetPingTarget(serverID)
+}
+
+// SetPingTarget makes ping tests of a server connect to host:port instead of its own endpoint
+func (sm *ServerManager) SetPingTarget(serverID, host string, port int) error {
+	if _, err := sm.GetServerByID(serverID); err != nil {
+		return err
+	}
+	if err := sm.overrides.SetPingTarget(serverID, PingTarget{Host: host, Port: port}); err != nil {
+		return err
+	}
+	sm.logger.Info("Ping target of server %s set to %s", serverID, net.JoinHostPort(host, strconv.Itoa(port)))
+	return nil
+}
+
+// ClearPingTarget makes ping tests of a server use its own endpoint again
+func (sm *ServerManager) ClearPingTarget(serverID string) error {
+	if err := sm.overrides.ClearPingTarget(serverID); err != nil {
+		return err
+	}
+	sm.logger.Info("Ping target override of server %s removed", serverID)
 	return nil
 }
 func (sm *ServerManager) TestPing() ([]types.PingResult, error) {
-	return sm.TestPingWithProgress(nil)
+	return sm.TestPingWithProgress(nil, nil)
 }
 
-// GetQuickSelectServers returns the fastest available servers for quick selection
-func (sm *ServerManager) GetQuickSelectServers(results []types.PingResult, limit int) []types.PingResult {
-	return sm.serverSorter.SortForQuickSelect(results, limit)
+// GetFavoriteServers returns the loaded servers marked as favorites
+func (sm *ServerManager) GetFavoriteServers() []types.Server {
+	favorites := map[string]bool{}
+	for _, id := range sm.overrides.GetFavorites() {
+		favorites[id] = true
+	}
+	var servers []types.Server
+	for _, server := range sm.GetServers() {
+		if favorites[server.ID] {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// IsFavorite reports whether a server is marked as favorite
+func (sm *ServerManager) IsFavorite(serverID string) bool {
+	for _, id := range sm.overrides.GetFavorites() {
+		if id == serverID {
+			return true
+		}
+	}
+	return false
+}
+
+// ToggleFavorite marks or unmarks a server as favorite and returns the new state
+func (sm *ServerManager) ToggleFavorite(serverID string) (bool, error) {
+	return sm.overrides.ToggleFavorite(serverID)
+}
+
+// GetServerNote returns the note of a server, empty when it has none
+func (sm *ServerManager) GetServerNote(serverID string) string {
+	return sm.overrides.GetNote(serverID)
+}
+
+// GetServerNotes returns the notes of all servers by server ID
+func (sm *ServerManager) GetServerNotes() map[string]string {
+	return sm.overrides.GetNotes()
+}
+
+// SetServerNote changes the note of a server, an empty note removes it
+func (sm *ServerManager) SetServerNote(serverID, note string) error {
+	if err := sm.overrides.SetNote(serverID, note); err != nil {
+		return err
+	}
+	sm.logger.Info("Note of server %s changed", serverID)
+	return nil
+}
+
+// RecordThroughput stores the measured download speed of a server in bytes per second
+func (sm *ServerManager) RecordThroughput(serverID string, bytesPerSecond float64) error {
+	return sm.stats.RecordThroughput(serverID, bytesPerSecond)
+}
+
+// GetServerStats returns the recorded ping history and throughput of a server
+func (sm *ServerManager) GetServerStats(serverID string) ServerStats {
+	return sm.stats.Get(serverID)
+}
+
+// GetCountries groups the loaded servers by the flag in their names
+func (sm *ServerManager) GetCountries() []types.CountryGroup {
+	return groupByCountry(sm.GetServers())
+}
+
+// markBlockedCountries sets BlockedCountry of the servers with the flag of a country
+// in blocked_countries
+func (sm *ServerManager) markBlockedCountries(servers []types.Server) {
+	for i := range servers {
+		servers[i].BlockedCountry = ""
+		if code := countryCode(servers[i].Name); code != "" && sm.config.IsCountryBlocked(code) {
+			servers[i].BlockedCountry = code
+		}
+	}
 }
-func (sm *ServerManager) TestPingWithProgress(progressCallback func(completed, total int, serverName string)) ([]types.PingResult, error) {
+
+// GetServersByCountry returns the loaded servers with the flag of country code in their names
+func (sm *ServerManager) GetServersByCountry(code string) []types.Server {
+	var servers []types.Server
+	for _, server := range sm.GetServers() {
+		if countryCode(server.Name) == code {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// GetAvailability returns the share of pings each server answered in the last day and week
+func (sm *ServerManager) GetAvailability(serverIDs []string) map[string]types.Availability {
+	now := sm.clock.Now()
+	stats := sm.stats.Lookup(serverIDs)
+	availability := make(map[string]types.Availability, len(serverIDs))
+	for _, id := range serverIDs {
+		availability[id] = stats[id].Availability(now)
+	}
+	return availability
+}
+
+// GetPingDigest summarizes the pings of all servers over the last day
+func (sm *ServerManager) GetPingDigest() types.PingDigest {
+	servers := sm.GetServers()
+	ids := make([]string, len(servers))
+	for i, server := range servers {
+		ids[i] = server.ID
+	}
+	stats := sm.stats.Lookup(ids)
+	current := sm.GetCurrentServer()
+
+	now := sm.clock.Now()
+	var digest types.PingDigest
+	for _, server := range servers {
+		summary, ok := stats[server.ID].DaySummary(now)
+		if !ok {
+			continue
+		}
+		summary.Server = server
+		digest.Servers = append(digest.Servers, summary)
+	}
+	sort.SliceStable(digest.Servers, func(i, j int) bool {
+		a, b := digest.Servers[i], digest.Servers[j]
+		if (a.AvgLatency > 0) != (b.AvgLatency > 0) {
+			return a.AvgLatency > 0
+		}
+		return a.AvgLatency < b.AvgLatency
+	})
+	if current != nil {
+		for i := range digest.Servers {
+			if digest.Servers[i].Server.ID == current.ID {
+				digest.Current = &digest.Servers[i]
+				break
+			}
+		}
+	}
+	return digest
+}
+
+// CheckAvailability pings all servers and records the results, it is run
+// periodically in the background to build the availability history
+func (sm *ServerManager) CheckAvailability(ctx context.Context) error {
 	servers := sm.GetServers()
+	if len(servers) == 0 {
+		return nil
+	}
+	results, err := sm.pingServers(ctx, servers, sm.pingTester.backgroundProfile(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to test server pings: %w", err)
+	}
+	// Results of a check interrupted by shutdown would count servers as down
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("availability check canceled: %w", err)
+	}
+	return sm.stats.RecordPings(results)
+}
+
+// GetBackupServers returns up to limit servers that answered their last recorded
+// ping, fastest first, leaving out the servers of exclude, misconfigured ones and
+// those in blocked countries. They are tried when switching to the chosen server failed.
+func (sm *ServerManager) GetBackupServers(exclude []string, limit int) []types.Server {
+	skip := make(map[string]bool, len(exclude))
+	for _, id := range exclude {
+		skip[id] = true
+	}
+	var candidates []types.Server
+	var ids []string
+	for _, server := range sm.GetServers() {
+		if !skip[server.ID] && !server.Misconfigured() && !server.Blocked() {
+			candidates = append(candidates, server)
+			ids = append(ids, server.ID)
+		}
+	}
+	stats := sm.stats.Lookup(ids)
+	latencies := make(map[string]int64, len(candidates))
+	backups := make([]types.Server, 0, len(candidates))
+	for _, server := range candidates {
+		samples := stats[server.ID].Samples
+		if len(samples) == 0 || !samples[len(samples)-1].Available {
+			continue
+		}
+		latencies[server.ID] = samples[len(samples)-1].LatencyMs
+		backups = append(backups, server)
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return latencies[backups[i].ID] < latencies[backups[j].ID]
+	})
+	if limit > 0 && len(backups) > limit {
+		backups = backups[:limit]
+	}
+	return backups
+}
+
+// GetQuickSelectServers returns the best available servers for quick selection. Once
+// throughput was measured, servers are ranked by the weighted quick select score.
+func (sm *ServerManager) GetQuickSelectServers(results []types.PingResult, limit int) []types.PingResult {
+	ids := make([]string, len(results))
+	for i, result := range results {
+		ids[i] = result.Server.ID
+	}
+	stats := sm.stats.Lookup(ids)
+	statsOf := func(serverID string) ServerStats { return stats[serverID] }
+	return sm.serverSorter.ScoreForQuickSelect(results, limit, statsOf, sm.config.UI.QuickSelectWeights)
+}
+
+// TestPingWithProgress tests the latency of servers, or of all servers when servers is nil
+func (sm *ServerManager) TestPingWithProgress(servers []types.Server, progressCallback func(completed, total int, serverName string)) ([]types.PingResult, error) {
+	return sm.TestPingWithProfile(servers, sm.pingTester.standardProfile(), progressCallback)
+}
+
+// TestPingWithProfile tests the latency of servers, or of all servers when servers is
+// nil, with the settings of profile. With max_servers only the servers with the best
+// recent latency are tested.
+func (sm *ServerManager) TestPingWithProfile(servers []types.Server, profile config.PingProfile, progressCallback func(completed, total int, serverName string)) ([]types.PingResult, error) {
+	if servers == nil {
+		servers = sm.GetServers()
+	}
 	if len(servers) == 0 {
 		return nil, fmt.Errorf("no servers available for ping testing")
 	}
-	results, err := sm.pingTester.TestServersWithProgress(servers, progressCallback)
+	if profile.MaxServers > 0 && len(servers) > profile.MaxServers {
+		servers = sm.bestKnownServers(servers, profile.MaxServers)
+	}
+	results, err := sm.pingServers(context.Background(), servers, profile, progressCallback)
 	if err != nil {
 		return nil, fmt.Errorf("failed to test server pings: %w", err)
 	}
+	if err := sm.stats.RecordPings(results); err != nil {
+		sm.logger.Warn("Failed to record ping statistics: %v", err)
+	}
 	// Use the new ServerSorter for combined sorting (speed priority, then alphabetical)
 	sortedResults := sm.serverSorter.SortPingResults(results)
 	return sortedResults, nil
 }
+
+// pingServers tests the latency of servers. The current server is not pinged when
+// the xray observatory probes its outbound, its last probe is used instead so the
+// latency matches what the xray balancer sees.
+func (sm *ServerManager) pingServers(ctx context.Context, servers []types.Server, profile config.PingProfile, progressCallback func(completed, total int, serverName string)) ([]types.PingResult, error) {
+	observed, ok := sm.observeCurrentServer(ctx)
+	if !ok {
+		return sm.pingTester.TestServersWithProfile(servers, profile, progressCallback)
+	}
+	rest := make([]types.Server, 0, len(servers))
+	found := false
+	for _, server := range servers {
+		if server.ID == observed.Server.ID {
+			found = true
+			continue
+		}
+		rest = append(rest, server)
+	}
+	if !found {
+		return sm.pingTester.TestServersWithProfile(servers, profile, progressCallback)
+	}
+	var results []types.PingResult
+	if len(rest) > 0 {
+		var err error
+		if results, err = sm.pingTester.TestServersWithProfile(rest, profile, progressCallback); err != nil {
+			return nil, err
+		}
+	}
+	return append(results, observed), nil
+}
+
+// bestKnownServers returns up to limit servers ranked by their average latency in
+// the recent ping history, the current server is always kept. Servers that did not
+// answer or were never tested come last in their original order.
+func (sm *ServerManager) bestKnownServers(servers []types.Server, limit int) []types.Server {
+	ids := make([]string, len(servers))
+	for i, server := range servers {
+		ids[i] = server.ID
+	}
+	stats := sm.stats.Lookup(ids)
+	averages := make(map[string]int64, len(servers))
+	for id, serverStats := range stats {
+		var total, count int64
+		for _, sample := range serverStats.Samples {
+			if sample.Available {
+				total += sample.LatencyMs
+				count++
+			}
+		}
+		if count > 0 {
+			averages[id] = total / count
+		}
+	}
+	ranked := append([]types.Server(nil), servers...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, aKnown := averages[ranked[i].ID]
+		b, bKnown := averages[ranked[j].ID]
+		if aKnown != bKnown {
+			return aKnown
+		}
+		return a < b
+	})
+	selected := ranked[:limit]
+	if current := sm.GetCurrentServer(); current != nil {
+		for i, server := range ranked {
+			if server.ID != current.ID {
+				continue
+			}
+			if i >= limit {
+				selected = append(selected[:limit-1:limit-1], server)
+			}
+			break
+		}
+	}
+	return selected
+}
+
+// observeCurrentServer returns the last observatory probe of the current server. It
+// reports false when xray_api is not set, xray has no observatory or it does not
+// probe the outbound of the current server, then the server is pinged as usual.
+func (sm *ServerManager) observeCurrentServer(ctx context.Context) (types.PingResult, bool) {
+	if sm.config.XrayAPI == "" || sm.xrayController.IsDirectMode() {
+		return types.PingResult{}, false
+	}
+	sm.mutex.RLock()
+	current := sm.currentServer
+	sm.mutex.RUnlock()
+	if current == nil || current.Tag == "" {
+		return types.PingResult{}, false
+	}
+	statuses, err := sm.xrayController.ObservatoryStatus(ctx)
+	if err != nil {
+		sm.logger.Debug("Using own pings, observatory is not available: %v", err)
+		return types.PingResult{}, false
+	}
+	status, ok := statuses[current.Tag]
+	if !ok {
+		sm.logger.Debug("Using own pings, observatory does not probe outbound %s", current.Tag)
+		return types.PingResult{}, false
+	}
+	return observedResult(*current, status), true
+}
 func (sm *ServerManager) GetServerStatus() (map[string]interface{}, error) {
 	sm.mutex.RLock()
 	currentServer := sm.currentServer
@@ -201,7 +1335,10 @@ func (sm *ServerManager) GetServerStatus() (map[string]interface{}, error) {
 		"port":    currentServer.Port,
 		"tag":     currentServer.Tag,
 	}
-	pingResult := sm.pingTester.TestServer(*currentServer)
+	pingResult, ok := sm.observeCurrentServer(context.Background())
+	if !ok {
+		pingResult = sm.pingTester.TestServer(*currentServer)
+	}
 	if pingResult.Available {
 		status["status"] = "connected"
 		status["latency"] = pingResult.Latency
@@ -221,6 +1358,7 @@ func (sm *ServerManager) SetCurrentServer(serverID string) error {
 	}
 	sm.mutex.Lock()
 	sm.currentServer = server
+	sm.currentMatch = types.MatchStrong
 	sm.mutex.Unlock()
 	return nil
 }
@@ -236,34 +1374,55 @@ func (sm *ServerManager) DetectCurrentServer() error {
 			break
 		}
 	}
+	// In direct mode the selected server lives in the saved outbound
+	if sm.xrayController.IsDirectMode() {
+		if paused, err := sm.xrayController.GetPausedOutbound(); err == nil {
+			proxyOutbound = paused
+		}
+	}
 	if proxyOutbound == nil {
-		sm.mutex.Lock()
-		sm.currentServer = nil
-		sm.mutex.Unlock()
+		sm.setDetectedServer(nil, types.MatchNone)
 		return nil
 	}
-	servers := sm.GetServers()
-	for _, server := range servers {
-		if sm.serverMatchesOutbound(server, *proxyOutbound) {
-			sm.mutex.Lock()
-			sm.currentServer = &server
-			sm.mutex.Unlock()
+	// Prefer a strong match over the first fallback match, which may be a sibling server
+	var fallback *types.Server
+	for _, server := range sm.GetServers() {
+		switch sm.matchOutbound(server, *proxyOutbound) {
+		case types.MatchStrong:
+			sm.setDetectedServer(&server, types.MatchStrong)
 			return nil
+		case types.MatchFallback:
+			if fallback == nil {
+				fallback = &server
+			}
 		}
 	}
-	sm.mutex.Lock()
-	sm.currentServer = nil
-	sm.mutex.Unlock()
+	if fallback != nil {
+		sm.setDetectedServer(fallback, types.MatchFallback)
+		return nil
+	}
+	sm.setDetectedServer(nil, types.MatchNone)
 	return fmt.Errorf("current xray configuration does not match any available servers")
 }
+func (sm *ServerManager) setDetectedServer(server *types.Server, confidence types.MatchConfidence) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.currentServer = server
+	sm.currentMatch = confidence
+}
 func (sm *ServerManager) serverMatchesOutbound(server types.Server, outbound types.XrayOutbound) bool {
+	return sm.matchOutbound(server, outbound) != types.MatchNone
+}
+
+// matchOutbound compares a server with an xray outbound and reports the match confidence
+func (sm *ServerManager) matchOutbound(server types.Server, outbound types.XrayOutbound) types.MatchConfidence {
 	// Basic protocol check
 	if server.Protocol != outbound.Protocol {
-		return false
+		return types.MatchNone
 	}
 	// Tag may be generic; if both present and different, fail fast
 	if server.Tag != "" && outbound.Tag != "" && server.Tag != outbound.Tag {
-		return false
+		return types.MatchNone
 	}
 
 	// Helper to get nested map safely
@@ -372,7 +1531,7 @@ func (sm *ServerManager) serverMatchesOutbound(server types.Server, outbound typ
 	}
 
 	// Compare address/port and UUID when available
-	addrMatch := (obAddr == "" || server.Address == "" || equalHost(obAddr, server.Address))
+	addrMatch := (obAddr == "" || server.Address == "" || equalHost(obAddr, server.Address) || sm.resolver.Resolved(server.Address, obAddr))
 	portMatch := (obPort == 0 || obPort == server.Port)
 	uuidMatch := (obUUID == "" || server.UUID == "" || obUUID == server.UUID)
 
@@ -399,7 +1558,13 @@ func (sm *ServerManager) serverMatchesOutbound(server types.Server, outbound typ
 		}
 	}
 
-	return strongMatch || fallbackMatch
+	if strongMatch {
+		return types.MatchStrong
+	}
+	if fallbackMatch {
+		return types.MatchFallback
+	}
+	return types.MatchNone
 }
 
 // equalHost compares two host identifiers allowing for case-insensitive match; no DNS resolution.
@@ -407,9 +1572,39 @@ func equalHost(a, b string) bool {
 	if a == b {
 		return true
 	}
+	// IPv6 literals may be bracketed or written differently
+	a, b = normalizeHost(a), normalizeHost(b)
 	// case-insensitive compare for domains
 	if strings.EqualFold(a, b) {
 		return true
 	}
 	return false
 }
+
+// switchHookEnv describes a switch from previous to target for the hook scripts
+func switchHookEnv(target types.Server, previous *types.Server) map[string]string {
+	env := map[string]string{
+		"XRAY_SERVER_ID":      target.ID,
+		"XRAY_SERVER_NAME":    target.Name,
+		"XRAY_SERVER_ADDRESS": target.Address,
+		"XRAY_SERVER_PORT":    strconv.Itoa(target.Port),
+	}
+	if previous != nil {
+		env["XRAY_PREVIOUS_SERVER_NAME"] = previous.Name
+	}
+	return env
+}
+
+// runHook runs the hook script of event and logs a failure, a failing script does
+// not stop what the manager is doing
+func (sm *ServerManager) runHook(ctx context.Context, event hooks.Event, env map[string]string) {
+	result, ok := sm.hooks.Run(ctx, event, env)
+	if !ok {
+		return
+	}
+	if result.Err != nil {
+		sm.logger.Warn("Hook %s failed after %s: %v, output: %s", result.Script, result.Duration.Round(time.Millisecond), result.Err, result.Output)
+		return
+	}
+	sm.logger.Info("Hook %s finished in %s", result.Script, result.Duration.Round(time.Millisecond))
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"testing"
 	"xray-telegram-manager/config"
 	"xray-telegram-manager/types"
@@ -37,7 +38,7 @@ func TestServerManager_LoadServersWithNameOptimization(t *testing.T) {
 	sm.subscriptionLoader = mockLoader
 
 	// Load servers
-	err := sm.LoadServers()
+	err := sm.LoadServers(context.Background())
 	if err != nil {
 		t.Fatalf("LoadServers failed: %v", err)
 	}
@@ -88,7 +89,7 @@ func TestServerManager_LoadServersWithNameOptimizationDisabled(t *testing.T) {
 	sm.subscriptionLoader = mockLoader
 
 	// Load servers
-	err := sm.LoadServers()
+	err := sm.LoadServers(context.Background())
 	if err != nil {
 		t.Fatalf("LoadServers failed: %v", err)
 	}
@@ -140,7 +141,7 @@ func TestServerManager_LoadServersWithInsufficientCoverage(t *testing.T) {
 	sm.subscriptionLoader = mockLoader
 
 	// Load servers
-	err := sm.LoadServers()
+	err := sm.LoadServers(context.Background())
 	if err != nil {
 		t.Fatalf("LoadServers failed: %v", err)
 	}
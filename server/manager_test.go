@@ -1,7 +1,17 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+	"xray-telegram-manager/clock"
 	"xray-telegram-manager/config"
 	"xray-telegram-manager/types"
 )
@@ -94,7 +104,7 @@ func TestGetServers(t *testing.T) {
 	}
 
 	sm.mutex.Lock()
-	sm.servers = testServers
+	sm.setServers(testServers)
 	sm.mutex.Unlock()
 
 	// Test getting servers
@@ -202,7 +212,7 @@ func TestGetServerByID(t *testing.T) {
 	}
 
 	sm.mutex.Lock()
-	sm.servers = testServers
+	sm.setServers(testServers)
 	sm.mutex.Unlock()
 
 	// Test finding existing server
@@ -255,7 +265,7 @@ func TestSetCurrentServer(t *testing.T) {
 	}
 
 	sm.mutex.Lock()
-	sm.servers = testServers
+	sm.setServers(testServers)
 	sm.mutex.Unlock()
 
 	// Test setting existing server as current
@@ -301,12 +311,23 @@ func TestServerManager_SortingIntegration(t *testing.T) {
 
 	sm := NewServerManagerWithCacheDir(cfg, "/tmp/test")
 	sm.subscriptionLoader = mockLoader
+	loads := 0
+	sm.OnServersLoaded(func() {
+		loads++
+		// The servers are available to the callback, the lock is released
+		if len(sm.GetServers()) != len(servers) {
+			t.Errorf("Expected %d servers in the loaded callback, got %d", len(servers), len(sm.GetServers()))
+		}
+	})
 
 	// Load servers
-	err := sm.LoadServers()
+	err := sm.LoadServers(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to load servers: %v", err)
 	}
+	if loads != 1 {
+		t.Errorf("Expected the loaded callback after the first load, got %d calls", loads)
+	}
 
 	// Test that GetServers returns alphabetically sorted servers
 	sortedServers := sm.GetServers()
@@ -355,3 +376,884 @@ func TestServerManager_SortingIntegration(t *testing.T) {
 		}
 	}
 }
+
+// TestDetectCurrentServerMatchConfidence tests strong and fallback detection of the active outbound
+func TestDetectCurrentServerMatchConfidence(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "04_outbounds.json")
+	xrayConfig := `{
+		"outbounds": [
+			{
+				"tag": "vless-reality",
+				"protocol": "vless",
+				"settings": {"vnext": [{"address": "example.com", "port": 443, "users": [{"id": "uuid-1"}]}]},
+				"streamSettings": {"security": "reality", "realitySettings": {"serverName": "sni.example.com", "publicKey": "pbk", "shortId": "sid"}}
+			},
+			{"tag": "direct", "protocol": "freedom", "settings": {}}
+		]
+	}`
+	if err := os.WriteFile(configPath, []byte(xrayConfig), 0644); err != nil {
+		t.Fatalf("Failed to write xray config: %v", err)
+	}
+
+	cfg := &config.Config{
+		ConfigPath:         configPath,
+		SubscriptionURL:    "https://example.com/config.txt",
+		LogLevel:           "info",
+		XrayRestartCommand: "echo restart",
+		PingTimeout:        1,
+	}
+
+	streamSettings := map[string]interface{}{
+		"security": "reality",
+		"realitySettings": map[string]interface{}{
+			"serverName": "sni.example.com",
+			"publicKey":  "pbk",
+			"shortId":    "sid",
+		},
+	}
+	sibling := types.Server{ID: "sibling", Name: "A Sibling", Address: "1.2.3.4", Port: 443, UUID: "uuid-1",
+		Protocol: "vless", Tag: "vless-reality", StreamSettings: streamSettings}
+	exact := types.Server{ID: "exact", Name: "B Exact", Address: "example.com", Port: 443, UUID: "uuid-1",
+		Protocol: "vless", Tag: "vless-reality", StreamSettings: streamSettings}
+
+	sm := NewServerManager(cfg)
+
+	// Strong match wins even when a fallback match is sorted first
+	sm.setServers([]types.Server{sibling, exact})
+	if err := sm.DetectCurrentServer(); err != nil {
+		t.Fatalf("DetectCurrentServer failed: %v", err)
+	}
+	if current := sm.GetCurrentServer(); current == nil || current.ID != "exact" {
+		t.Fatalf("Expected exact server to be detected, got %+v", current)
+	}
+	if match := sm.GetCurrentServerMatch(); match != types.MatchStrong {
+		t.Errorf("Expected strong match, got %s", match)
+	}
+
+	// Only a fallback candidate is available
+	sm.setServers([]types.Server{sibling})
+	if err := sm.DetectCurrentServer(); err != nil {
+		t.Fatalf("DetectCurrentServer failed: %v", err)
+	}
+	if current := sm.GetCurrentServer(); current == nil || current.ID != "sibling" {
+		t.Fatalf("Expected sibling server to be detected, got %+v", current)
+	}
+	if match := sm.GetCurrentServerMatch(); match != types.MatchFallback {
+		t.Errorf("Expected fallback match, got %s", match)
+	}
+
+	// No candidates at all
+	sm.setServers([]types.Server{{ID: "other", Name: "Other", Address: "9.9.9.9", Port: 8443, UUID: "uuid-2", Protocol: "vless"}})
+	if err := sm.DetectCurrentServer(); err == nil {
+		t.Error("Expected error when no server matches")
+	}
+	if match := sm.GetCurrentServerMatch(); match != types.MatchNone {
+		t.Errorf("Expected no match, got %s", match)
+	}
+}
+
+func TestSwitchHistory(t *testing.T) {
+	sm := NewServerManagerWithCacheDir(&config.Config{}, t.TempDir())
+
+	serverA := types.Server{ID: "a", Name: "Server A"}
+	serverB := types.Server{ID: "b", Name: "Server B"}
+	serverC := types.Server{ID: "c", Name: "Server C"}
+	sm.setServers([]types.Server{serverA, serverB, serverC})
+
+	if sm.GetPreviousServer() != nil {
+		t.Fatal("Expected no previous server initially")
+	}
+
+	// A -> B -> C
+	sm.pushHistoryUnsafe(&serverA, serverB.ID)
+	sm.pushHistoryUnsafe(&serverB, serverC.ID)
+
+	previous := sm.GetPreviousServer()
+	if previous == nil || previous.ID != "b" {
+		t.Fatalf("Expected previous server 'b', got %v", previous)
+	}
+
+	// C -> B should make C the previous server and drop B from history
+	sm.pushHistoryUnsafe(&serverC, serverB.ID)
+	history := sm.GetSwitchHistory()
+	if len(history) != 2 || history[0].ID != "c" || history[1].ID != "a" {
+		t.Errorf("Expected history [c a], got %v", history)
+	}
+
+	// Servers removed from the list are skipped
+	sm.setServers([]types.Server{serverA, serverB})
+	previous = sm.GetPreviousServer()
+	if previous == nil || previous.ID != "a" {
+		t.Errorf("Expected previous server 'a' after 'c' was removed, got %v", previous)
+	}
+
+	for i := 0; i < maxSwitchHistory+5; i++ {
+		server := types.Server{ID: string(rune('d' + i))}
+		sm.pushHistoryUnsafe(&server, "target")
+	}
+	if len(sm.GetSwitchHistory()) != maxSwitchHistory {
+		t.Errorf("Expected history to be capped at %d, got %d", maxSwitchHistory, len(sm.GetSwitchHistory()))
+	}
+}
+
+func TestDirectModeToggle(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "04_outbounds.json")
+	xrayConfig := `{
+		"outbounds": [
+			{
+				"tag": "vless-reality",
+				"protocol": "vless",
+				"settings": {"vnext": [{"address": "example.com", "port": 443, "users": [{"id": "uuid-1"}]}]}
+			},
+			{"tag": "direct", "protocol": "freedom", "settings": {}}
+		]
+	}`
+	if err := os.WriteFile(configPath, []byte(xrayConfig), 0644); err != nil {
+		t.Fatalf("Failed to write xray config: %v", err)
+	}
+
+	cfg := &config.Config{
+		ConfigPath:         configPath,
+		LogLevel:           "info",
+		XrayRestartCommand: "true",
+	}
+	sm := NewServerManager(cfg)
+	sm.setServers([]types.Server{{ID: "example_com_443", Name: "Example", Address: "example.com", Port: 443,
+		Protocol: "vless", Tag: "vless-reality"}})
+
+	if sm.IsDirectMode() {
+		t.Fatal("Expected direct mode to be disabled initially")
+	}
+	if err := sm.EnableDirectMode(); err != nil {
+		t.Fatalf("EnableDirectMode failed: %v", err)
+	}
+	if !sm.IsDirectMode() {
+		t.Fatal("Expected direct mode to be enabled")
+	}
+
+	xc := sm.xrayController
+	current, err := xc.GetCurrentConfig()
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if current.Outbounds[0].Tag != "vless-reality" || current.Outbounds[0].Protocol != "freedom" {
+		t.Errorf("Expected proxy outbound to be replaced by freedom, got %+v", current.Outbounds[0])
+	}
+
+	// The paused server is still detected from the saved outbound
+	if err := sm.DetectCurrentServer(); err != nil {
+		t.Fatalf("DetectCurrentServer failed in direct mode: %v", err)
+	}
+	if server := sm.GetCurrentServer(); server == nil || server.ID != "example_com_443" {
+		t.Errorf("Expected paused server to be detected, got %+v", server)
+	}
+
+	if err := sm.EnableDirectMode(); err == nil {
+		t.Error("Expected error when enabling direct mode twice")
+	}
+
+	if err := sm.DisableDirectMode(); err != nil {
+		t.Fatalf("DisableDirectMode failed: %v", err)
+	}
+	if sm.IsDirectMode() {
+		t.Error("Expected direct mode to be disabled after resume")
+	}
+	current, err = xc.GetCurrentConfig()
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if current.Outbounds[0].Protocol != "vless" || len(current.Outbounds) != 2 {
+		t.Errorf("Expected proxy outbound to be restored, got %+v", current.Outbounds)
+	}
+
+	if err := sm.DisableDirectMode(); err == nil {
+		t.Error("Expected error when direct mode is not enabled")
+	}
+}
+
+func TestSwitchServerKeepsDirectModeOnFailure(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "04_outbounds.json")
+	xrayConfig := `{
+		"outbounds": [
+			{"tag": "vless-reality", "protocol": "vless", "settings": {"vnext": [{"address": "example.com", "port": 443, "users": [{"id": "uuid-1"}]}]}},
+			{"tag": "direct", "protocol": "freedom", "settings": {}}
+		]
+	}`
+	if err := os.WriteFile(configPath, []byte(xrayConfig), 0644); err != nil {
+		t.Fatalf("Failed to write xray config: %v", err)
+	}
+	cfg := &config.Config{ConfigPath: configPath, LogLevel: "info", XrayRestartCommand: "true", SkipSwitchProbe: true}
+	sm := NewServerManager(cfg)
+	sm.setServers([]types.Server{
+		{ID: "example_com_443", Name: "Example", Address: "example.com", Port: 443, Protocol: "vless", Tag: "vless-reality", UUID: "uuid-1"},
+		{ID: "other_com_443", Name: "Other", Address: "other.com", Port: 443, Protocol: "vless", Tag: "vless-reality", UUID: "uuid-2"},
+	})
+	if err := sm.EnableDirectMode(); err != nil {
+		t.Fatalf("EnableDirectMode failed: %v", err)
+	}
+
+	cfg.XrayRestartCommand = "false"
+	if err := sm.SwitchServer(context.Background(), "other_com_443"); err == nil {
+		t.Fatal("Expected the failed restart to be reported")
+	}
+	if !sm.IsDirectMode() {
+		t.Fatal("Expected direct mode to be kept after the failed switch")
+	}
+	current, err := sm.xrayController.GetCurrentConfig()
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if current.Outbounds[0].Protocol != "freedom" {
+		t.Errorf("Expected the direct mode config to be restored, got %+v", current.Outbounds[0])
+	}
+	paused, err := sm.xrayController.GetPausedOutbound()
+	if err != nil || paused.Protocol != "vless" || !strings.Contains(fmt.Sprint(paused.Settings), "example.com") {
+		t.Errorf("Expected the paused outbound of Example, got %+v (%v)", paused, err)
+	}
+
+	// The proxy can still be resumed
+	cfg.XrayRestartCommand = "true"
+	if err := sm.DisableDirectMode(); err != nil {
+		t.Fatalf("DisableDirectMode failed after the failed switch: %v", err)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	originalTargets := directCheckTargets
+	directCheckTargets = []string{listener.Addr().String()}
+	defer func() { directCheckTargets = originalTargets }()
+
+	configPath := filepath.Join(t.TempDir(), "04_outbounds.json")
+	xrayConfig := `{
+		"outbounds": [
+			{"tag": "vless-reality", "protocol": "vless", "settings": {"vnext": [{"address": "example.com", "port": 443}]}},
+			{"tag": "direct", "protocol": "freedom", "settings": {}}
+		]
+	}`
+	if err := os.WriteFile(configPath, []byte(xrayConfig), 0644); err != nil {
+		t.Fatalf("Failed to write xray config: %v", err)
+	}
+	cfg := &config.Config{ConfigPath: configPath, LogLevel: "info", XrayRestartCommand: "false"}
+	sm := NewServerManager(cfg)
+
+	// A failed restart is not rolled back to the proxy
+	if _, err := sm.Panic(context.Background()); err == nil {
+		t.Fatal("Expected the failed restart to be reported")
+	}
+	if !sm.IsDirectMode() {
+		t.Fatal("Expected the proxy to stay paused after a failed restart")
+	}
+
+	cfg.XrayRestartCommand = "true"
+	result, err := sm.Panic(context.Background())
+	if err != nil {
+		t.Fatalf("Panic failed: %v", err)
+	}
+	if !result.WasDirect || result.Reachable != listener.Addr().String() || result.CheckError != nil {
+		t.Errorf("Expected a reachable direct connection, got %+v", result)
+	}
+	current, err := sm.xrayController.GetCurrentConfig()
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if current.Outbounds[0].Protocol != "freedom" {
+		t.Errorf("Expected the proxy outbound to be replaced by freedom, got %+v", current.Outbounds[0])
+	}
+}
+
+func TestSingleConfigLayoutPreservesSections(t *testing.T) {
+	xrayDir := t.TempDir()
+	configPath := filepath.Join(xrayDir, "config.json")
+	xrayConfig := `{
+		"log": {"loglevel": "warning"},
+		"inbounds": [{"tag": "redirect", "port": 61219, "protocol": "dokodemo-door", "sniffing": {"enabled": true}}],
+		"outbounds": [
+			{"tag": "vless-reality", "protocol": "vless", "settings": {}},
+			{"tag": "direct", "protocol": "freedom", "settings": {}}
+		],
+		"routing": {"rules": [{"type": "field", "outboundTag": "direct", "domain": ["geosite:private"]}]}
+	}`
+	if err := os.WriteFile(configPath, []byte(xrayConfig), 0644); err != nil {
+		t.Fatalf("Failed to write xray config: %v", err)
+	}
+
+	cfg := &config.Config{ConfigPath: configPath, XrayLayout: config.XrayLayoutSplit, XrayRestartCommand: "true"}
+	sm := NewServerManager(cfg)
+
+	layout, hints, err := sm.CheckXrayLayout()
+	if err != nil {
+		t.Fatalf("CheckXrayLayout failed: %v", err)
+	}
+	if layout != config.XrayLayoutSplit || len(hints) == 0 {
+		t.Errorf("Expected a hint for a full config with split layout, got layout %s hints %v", layout, hints)
+	}
+	cfg.XrayLayout = config.XrayLayoutAuto
+	if layout, hints, _ := sm.CheckXrayLayout(); layout != config.XrayLayoutSingle || len(hints) != 0 {
+		t.Errorf("Expected auto layout to detect single config, got layout %s hints %v", layout, hints)
+	}
+
+	server := types.Server{ID: "new", Protocol: "vless", Tag: "vless-reality", Settings: map[string]interface{}{"vnext": []interface{}{}}}
+	if err := sm.xrayController.ReplaceProxyOutbound(server, types.OutboundOptions{}); err != nil {
+		t.Fatalf("ReplaceProxyOutbound failed: %v", err)
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatalf("Failed to read xray config: %v", err)
+	}
+	var written map[string]interface{}
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatalf("Written config is not valid JSON: %v", err)
+	}
+	for _, section := range []string{"log", "inbounds", "outbounds", "routing"} {
+		if _, ok := written[section]; !ok {
+			t.Errorf("Expected section %s to be kept", section)
+		}
+	}
+	if !strings.Contains(string(data), "sniffing") || !strings.Contains(string(data), "geosite:private") {
+		t.Error("Expected inbound and routing details to be kept")
+	}
+}
+
+func TestOnServersChanged(t *testing.T) {
+	cfg := &config.Config{
+		ConfigPath:  "/tmp/test_config.json",
+		LogLevel:    "error",
+		PingTimeout: 5,
+	}
+	mockLoader := NewMockSubscriptionLoader(cfg)
+	mockLoader.SetServers([]types.Server{{ID: "a", Name: "A"}, {ID: "b", Name: "B"}})
+
+	sm := NewServerManager(cfg)
+	sm.subscriptionLoader = mockLoader
+
+	var calls int
+	var added, removed []types.Server
+	sm.OnServersChanged(func(change types.ServerListChange) {
+		calls++
+		added, removed = change.Added, change.Removed
+	})
+
+	if err := sm.LoadServers(context.Background()); err != nil {
+		t.Fatalf("LoadServers failed: %v", err)
+	}
+	if calls != 0 {
+		t.Fatalf("Expected no change notification on the first load, got %d", calls)
+	}
+
+	if err := sm.LoadServers(context.Background()); err != nil {
+		t.Fatalf("LoadServers failed: %v", err)
+	}
+	if calls != 0 {
+		t.Fatalf("Expected no change notification for an identical list, got %d", calls)
+	}
+
+	mockLoader.SetServers([]types.Server{{ID: "b", Name: "B"}, {ID: "c", Name: "C"}})
+	if err := sm.LoadServers(context.Background()); err != nil {
+		t.Fatalf("LoadServers failed: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("Expected one change notification, got %d", calls)
+	}
+	if len(added) != 1 || added[0].ID != "c" {
+		t.Errorf("Expected server c to be added, got %+v", added)
+	}
+	if len(removed) != 1 || removed[0].ID != "a" {
+		t.Errorf("Expected server a to be removed, got %+v", removed)
+	}
+}
+
+func TestReplaceProxyOutboundOptions(t *testing.T) {
+	config := &types.XrayConfig{Outbounds: []types.XrayOutbound{
+		{Tag: "proxy", Protocol: "vless"},
+		{Tag: "direct", Protocol: "freedom"},
+	}}
+	vision := types.Server{Tag: "proxy", Protocol: "vless",
+		Settings:       map[string]interface{}{"vnext": []interface{}{map[string]interface{}{"users": []interface{}{map[string]interface{}{"flow": "xtls-rprx-vision"}}}}},
+		StreamSettings: map[string]interface{}{"security": "reality"},
+	}
+	options := types.OutboundOptions{Mux: true, MuxConcurrency: 8, Fragment: true, FragmentPackets: "tlshello", FragmentLength: "100-200", FragmentInterval: "10-20"}
+
+	xc := &XrayController{}
+	if err := xc.replaceProxyOutbound(config, vision, options); err != nil {
+		t.Fatalf("replaceProxyOutbound failed: %v", err)
+	}
+	if len(config.Outbounds) != 3 || config.Outbounds[2].Tag != dialerOutboundTag {
+		t.Fatalf("Expected the dialer outbound to be appended, got %+v", config.Outbounds)
+	}
+	proxy := config.Outbounds[0]
+	if proxy.Mux != nil {
+		t.Error("Expected mux to be skipped for XTLS Vision")
+	}
+	sockopt, _ := proxy.StreamSettings["sockopt"].(map[string]interface{})
+	if sockopt["dialerProxy"] != dialerOutboundTag {
+		t.Errorf("Expected proxy to dial through %s, got %+v", dialerOutboundTag, proxy.StreamSettings)
+	}
+	if _, ok := vision.StreamSettings["sockopt"]; ok {
+		t.Error("Expected server stream settings not to be modified")
+	}
+
+	plain := types.Server{Tag: "proxy", Protocol: "vless"}
+	if err := xc.replaceProxyOutbound(config, plain, types.OutboundOptions{Mux: true, MuxConcurrency: 4}); err != nil {
+		t.Fatalf("replaceProxyOutbound failed: %v", err)
+	}
+	if len(config.Outbounds) != 2 {
+		t.Fatalf("Expected the dialer outbound to be removed, got %+v", config.Outbounds)
+	}
+	if config.Outbounds[0].Mux["concurrency"] != 4 {
+		t.Errorf("Expected mux with concurrency 4, got %+v", config.Outbounds[0].Mux)
+	}
+}
+
+func TestReplaceProxyOutboundExtra(t *testing.T) {
+	config := &types.XrayConfig{Outbounds: []types.XrayOutbound{{Tag: "proxy", Protocol: "vless"}}}
+	server := types.Server{Tag: "proxy", Protocol: "vless",
+		StreamSettings: map[string]interface{}{"network": "tcp", "sockopt": map[string]interface{}{"tcpFastOpen": true}},
+	}
+	options := types.OutboundOptions{Fragment: true, FragmentPackets: "tlshello", FragmentLength: "100-200", FragmentInterval: "10-20",
+		Extra: map[string]interface{}{
+			"streamSettings": map[string]interface{}{"sockopt": map[string]interface{}{"mark": 255}},
+			"mux":            map[string]interface{}{"xudpConcurrency": 16},
+		},
+	}
+
+	xc := &XrayController{}
+	if err := xc.replaceProxyOutbound(config, server, options); err != nil {
+		t.Fatalf("replaceProxyOutbound failed: %v", err)
+	}
+	proxy := config.Outbounds[0]
+	sockopt, _ := proxy.StreamSettings["sockopt"].(map[string]interface{})
+	if sockopt["mark"] != 255 || sockopt["tcpFastOpen"] != true || sockopt["dialerProxy"] != dialerOutboundTag {
+		t.Errorf("Expected mark merged into the proxy sockopt, got %+v", sockopt)
+	}
+	if proxy.StreamSettings["network"] != "tcp" {
+		t.Errorf("Expected the server stream settings to be kept, got %+v", proxy.StreamSettings)
+	}
+	if proxy.Mux != nil {
+		t.Errorf("Expected mux extras to be ignored while mux is disabled, got %+v", proxy.Mux)
+	}
+	dialerSockopt, _ := config.Outbounds[1].StreamSettings["sockopt"].(map[string]interface{})
+	if dialerSockopt["mark"] != 255 {
+		t.Errorf("Expected mark on the dialer outbound, got %+v", config.Outbounds[1].StreamSettings)
+	}
+	if _, ok := server.StreamSettings["sockopt"].(map[string]interface{})["mark"]; ok {
+		t.Error("Expected server stream settings not to be modified")
+	}
+
+	options = types.OutboundOptions{Mux: true, MuxConcurrency: 4, Extra: options.Extra}
+	if err := xc.replaceProxyOutbound(config, types.Server{Tag: "proxy", Protocol: "vless"}, options); err != nil {
+		t.Fatalf("replaceProxyOutbound failed: %v", err)
+	}
+	if mux := config.Outbounds[0].Mux; mux["xudpConcurrency"] != 16 || mux["concurrency"] != 4 {
+		t.Errorf("Expected mux extras merged, got %+v", mux)
+	}
+}
+
+func TestFavoritesAndPingSubset(t *testing.T) {
+	cfg := &config.Config{ConfigPath: filepath.Join(t.TempDir(), "config.json"), PingTimeout: 1}
+	sm := NewServerManagerWithCacheDir(cfg, t.TempDir())
+	sm.setServers([]types.Server{
+		{ID: "a", Name: "🇩🇪 A", Address: "127.0.0.1", Port: 1},
+		{ID: "b", Name: "🇳🇱 B", Address: "127.0.0.1", Port: 1},
+	})
+
+	favorite, err := sm.ToggleFavorite("b")
+	if err != nil || !favorite {
+		t.Fatalf("Expected b to become a favorite, got %t (%v)", favorite, err)
+	}
+	if favorites := sm.GetFavoriteServers(); len(favorites) != 1 || favorites[0].ID != "b" || !sm.IsFavorite("b") {
+		t.Errorf("Expected b to be the only favorite, got %+v", favorites)
+	}
+	if servers := sm.GetServersByCountry("DE"); len(servers) != 1 || servers[0].ID != "a" {
+		t.Errorf("Expected server a for DE, got %+v", servers)
+	}
+
+	results, err := sm.TestPingWithProgress(sm.GetFavoriteServers(), nil)
+	if err != nil {
+		t.Fatalf("TestPingWithProgress failed: %v", err)
+	}
+	if len(results) != 1 || results[0].Server.ID != "b" {
+		t.Errorf("Expected only server b to be tested, got %+v", results)
+	}
+	if _, err := sm.TestPingWithProgress([]types.Server{}, nil); err == nil {
+		t.Error("Expected an error for an empty subset")
+	}
+
+	if favorite, _ := sm.ToggleFavorite("b"); favorite || sm.IsFavorite("b") {
+		t.Error("Expected b to be removed from favorites")
+	}
+}
+
+func TestServerNotes(t *testing.T) {
+	cacheDir := t.TempDir()
+	cfg := &config.Config{ConfigPath: filepath.Join(t.TempDir(), "config.json")}
+	sm := NewServerManagerWithCacheDir(cfg, cacheDir)
+
+	if err := sm.SetServerNote("a", "  good for\n Netflix "); err != nil {
+		t.Fatalf("SetServerNote failed: %v", err)
+	}
+	if err := sm.SetServerNote("b", strings.Repeat("й", types.MaxServerNoteLength+1)); err == nil {
+		t.Error("Expected an error for a note that is too long")
+	}
+
+	// Notes are kept in the overrides file across restarts
+	reloaded := NewServerManagerWithCacheDir(cfg, cacheDir)
+	if note := reloaded.GetServerNote("a"); note != "good for Netflix" {
+		t.Errorf("Expected the normalized note after reload, got %q", note)
+	}
+	if notes := reloaded.GetServerNotes(); len(notes) != 1 {
+		t.Errorf("Expected one note, got %+v", notes)
+	}
+
+	if err := reloaded.SetServerNote("a", ""); err != nil {
+		t.Fatalf("Removing the note failed: %v", err)
+	}
+	if note := reloaded.GetServerNote("a"); note != "" {
+		t.Errorf("Expected the note to be removed, got %q", note)
+	}
+}
+
+func TestSwitchServerProbesTarget(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	xrayConfig := `{"outbounds": [{"tag": "proxy", "protocol": "vless", "settings": {}}, {"tag": "direct", "protocol": "freedom"}]}`
+	if err := os.WriteFile(configPath, []byte(xrayConfig), 0644); err != nil {
+		t.Fatalf("Failed to write xray config: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	cfg := &config.Config{ConfigPath: configPath, XrayLayout: config.XrayLayoutSingle, XrayRestartCommand: "true", PingTimeout: 1}
+	sm := NewServerManagerWithCacheDir(cfg, t.TempDir())
+	settings := map[string]interface{}{"vnext": []interface{}{}}
+	sm.setServers([]types.Server{
+		{ID: "down", Name: "Down", Address: "127.0.0.1", Port: 1, Protocol: "vless", Tag: "proxy", Settings: settings},
+		{ID: "up", Name: "Up", Address: "127.0.0.1", Port: port, Protocol: "vless", Tag: "proxy", Settings: settings},
+	})
+
+	var switched []string
+	sm.OnServerSwitched(func(server types.Server) { switched = append(switched, server.ID) })
+
+	err = sm.SwitchServer(context.Background(), "down")
+	var probeErr *ProbeError
+	if !errors.As(err, &probeErr) || probeErr.Server != "Down" {
+		t.Fatalf("Expected a probe error for the down server, got %v", err)
+	}
+	if data, _ := os.ReadFile(configPath); string(data) != xrayConfig {
+		t.Error("Expected the xray config to be left untouched after a failed probe")
+	}
+	if sm.GetCurrentServer() != nil {
+		t.Error("Expected no current server after a failed probe")
+	}
+
+	if err := sm.SwitchServer(context.Background(), "up"); err != nil {
+		t.Fatalf("Expected switch to the reachable server to succeed, got %v", err)
+	}
+	if current := sm.GetCurrentServer(); current == nil || current.ID != "up" {
+		t.Errorf("Expected current server up, got %+v", current)
+	}
+
+	cfg.SkipSwitchProbe = true
+	if err := sm.SwitchServer(context.Background(), "down"); err != nil {
+		t.Fatalf("Expected switch without probe to succeed, got %v", err)
+	}
+	if len(switched) != 2 || switched[0] != "up" || switched[1] != "down" {
+		t.Errorf("Expected the switch callback for up and down, got %v", switched)
+	}
+}
+
+func TestBestKnownServers(t *testing.T) {
+	cfg := &config.Config{Memory: config.Memory{PingHistorySize: 20, MaxStatsInMemory: 200}}
+	sm := NewServerManagerWithCacheDir(cfg, t.TempDir())
+	servers := []types.Server{{ID: "slow"}, {ID: "new"}, {ID: "fast"}, {ID: "down"}, {ID: "current"}}
+	now := time.Now()
+	results := []types.PingResult{
+		{Server: servers[0], Available: true, Latency: 300 * time.Millisecond, TestTime: now},
+		{Server: servers[2], Available: true, Latency: 40 * time.Millisecond, TestTime: now},
+		{Server: servers[3], Available: false, TestTime: now},
+		{Server: servers[4], Available: true, Latency: 500 * time.Millisecond, TestTime: now},
+	}
+	if err := sm.stats.RecordPings(results); err != nil {
+		t.Fatalf("RecordPings failed: %v", err)
+	}
+
+	best := sm.bestKnownServers(servers, 2)
+	if len(best) != 2 || best[0].ID != "fast" || best[1].ID != "slow" {
+		t.Errorf("Expected the servers with the best latency, got %v", best)
+	}
+
+	// The current server is always tested
+	sm.currentServer = &servers[4]
+	best = sm.bestKnownServers(servers, 2)
+	if len(best) != 2 || best[0].ID != "fast" || best[1].ID != "current" {
+		t.Errorf("Expected the current server to be kept, got %v", best)
+	}
+	if len(servers) != 5 || servers[0].ID != "slow" {
+		t.Error("Expected the servers not to be reordered")
+	}
+}
+
+func TestGetBackupServers(t *testing.T) {
+	cfg := &config.Config{Memory: config.Memory{PingHistorySize: 20, MaxStatsInMemory: 200}}
+	sm := NewServerManagerWithCacheDir(cfg, t.TempDir())
+	sm.setServers([]types.Server{{ID: "a"}, {ID: "b"}, {ID: "c"}, {ID: "d"}, {ID: "e"}})
+
+	now := time.Now()
+	err := sm.stats.RecordPings([]types.PingResult{
+		{Server: types.Server{ID: "a"}, Available: true, Latency: 30 * time.Millisecond, TestTime: now.Add(-time.Hour)},
+		{Server: types.Server{ID: "b"}, Available: true, Latency: 80 * time.Millisecond, TestTime: now},
+		{Server: types.Server{ID: "c"}, Available: true, Latency: 20 * time.Millisecond, TestTime: now},
+		{Server: types.Server{ID: "d"}, Available: true, Latency: 10 * time.Millisecond, TestTime: now},
+	})
+	if err != nil {
+		t.Fatalf("RecordPings failed: %v", err)
+	}
+	// The last ping of a counts, not the faster one before it
+	if err := sm.stats.RecordPings([]types.PingResult{{Server: types.Server{ID: "a"}, Available: false, TestTime: now}}); err != nil {
+		t.Fatalf("RecordPings failed: %v", err)
+	}
+
+	backups := sm.GetBackupServers([]string{"d"}, 2)
+	if len(backups) != 2 || backups[0].ID != "c" || backups[1].ID != "b" {
+		t.Errorf("Expected servers c and b, got %+v", backups)
+	}
+}
+
+func TestBlockedCountriesSkippedAutomatically(t *testing.T) {
+	cfg := &config.Config{
+		LogLevel:         "error",
+		PingTimeout:      5,
+		BlockedCountries: []string{"ru"},
+		Memory:           config.Memory{PingHistorySize: 20, MaxStatsInMemory: 200},
+	}
+	mockLoader := NewMockSubscriptionLoader(cfg)
+	mockLoader.SetServers([]types.Server{{ID: "de", Name: "🇩🇪 Frankfurt"}, {ID: "ru", Name: "🇷🇺 Moscow"}})
+	sm := NewServerManagerWithCacheDir(cfg, t.TempDir())
+	sm.subscriptionLoader = mockLoader
+	if err := sm.LoadServers(context.Background()); err != nil {
+		t.Fatalf("LoadServers failed: %v", err)
+	}
+
+	servers := sm.GetServers()
+	if servers[0].Blocked() || servers[1].BlockedCountry != "RU" {
+		t.Fatalf("Expected only the Moscow server to be blocked, got %+v", servers)
+	}
+
+	now := time.Now()
+	results := []types.PingResult{
+		{Server: servers[0], Available: true, Latency: 80 * time.Millisecond, TestTime: now},
+		{Server: servers[1], Available: true, Latency: 10 * time.Millisecond, TestTime: now},
+	}
+	if err := sm.stats.RecordPings(results); err != nil {
+		t.Fatalf("RecordPings failed: %v", err)
+	}
+	if backups := sm.GetBackupServers(nil, 2); len(backups) != 1 || backups[0].ID != "de" {
+		t.Errorf("Expected the blocked server not to be a backup, got %+v", backups)
+	}
+	if quick := sm.GetQuickSelectServers(results, 5); len(quick) != 1 || quick[0].Server.ID != "de" {
+		t.Errorf("Expected the blocked server not to be offered in quick select, got %+v", quick)
+	}
+}
+
+func TestServerListVersion(t *testing.T) {
+	servers := []types.Server{{ID: "a", Name: "A"}, {ID: "b", Name: "B"}}
+	reordered := []types.Server{{ID: "b", Name: "Renamed"}, {ID: "a", Name: "A"}}
+	if serverListVersion(servers) != serverListVersion(reordered) {
+		t.Error("Expected the version not to change with the order or names of the servers")
+	}
+	added := append(servers, types.Server{ID: "c"})
+	if serverListVersion(servers) == serverListVersion(added) {
+		t.Error("Expected the version to change when a server is added")
+	}
+}
+
+func TestOutboundDefaultsSavedToOverridesFragment(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	base := `{"admin_id": 1, "bot_token": "11111111:config-token-aaaaaaaaaaaaaaaa", "subscription_url": "https://example.com/config.txt"}`
+	if err := os.WriteFile(configPath, []byte(base), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	sm := NewServerManagerWithCacheDir(cfg, t.TempDir())
+
+	enabled := true
+	if err := sm.SetOutboundDefaults(types.OutboundOverride{Mux: &enabled}); err != nil {
+		t.Fatalf("SetOutboundDefaults failed: %v", err)
+	}
+	if !sm.OutboundOptions("").Mux {
+		t.Error("Expected the changed default to be used right away")
+	}
+	if data, _ := os.ReadFile(configPath); string(data) != base {
+		t.Errorf("Expected the base config to stay unchanged, got %s", data)
+	}
+	reloaded, err := config.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("Reloading config failed: %v", err)
+	}
+	if !reloaded.Outbound.Mux || len(reloaded.Fragments()) != 1 {
+		t.Errorf("Expected mux from the overrides fragment, got %+v from %v", reloaded.Outbound, reloaded.Fragments())
+	}
+}
+
+func TestGetServersReturnsSortedCopy(t *testing.T) {
+	sm := NewServerManager(&config.Config{})
+	sm.setServers([]types.Server{{ID: "b", Name: "Berlin"}, {ID: "a", Name: "amsterdam"}, {ID: "c", Name: "Cairo"}})
+
+	servers := sm.GetServers()
+	if len(servers) != 3 || servers[0].ID != "a" || servers[1].ID != "b" || servers[2].ID != "c" {
+		t.Fatalf("Expected servers sorted by name, got %+v", servers)
+	}
+	servers[0].Name = "changed"
+	if again := sm.GetServers(); again[0].Name != "amsterdam" {
+		t.Errorf("Expected changes of the result not to reach the manager, got %+v", again[0])
+	}
+
+	sm.setServers([]types.Server{{ID: "d", Name: "Dublin"}})
+	if servers := sm.GetServers(); len(servers) != 1 || servers[0].ID != "d" {
+		t.Errorf("Expected the new list after setting servers, got %+v", servers)
+	}
+}
+
+func TestDeterministicSubscriptionLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "servers.txt")
+	urls := generateVlessUrls(3)
+	if err := os.WriteFile(path, []byte(strings.Join(urls[:2], "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		ConfigPath:      filepath.Join(dir, "xray.json"),
+		LogLevel:        "error",
+		PingTimeout:     5,
+		SubscriptionURL: path,
+		CacheDuration:   3600,
+	}
+	sm := NewServerManagerWithCacheDir(cfg, filepath.Join(dir, "cache"))
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	sm.SetClock(fake)
+	sm.SetServerIDFunc(func(vless VlessConfig) string { return fmt.Sprintf("srv-%d", vless.Port) })
+
+	if err := sm.LoadServers(context.Background()); err != nil {
+		t.Fatalf("LoadServers failed: %v", err)
+	}
+	servers := sm.GetServers()
+	if len(servers) != 2 || servers[0].ID != "srv-1000" || servers[1].ID != "srv-1001" {
+		t.Fatalf("Expected the injected IDs, got %+v", servers)
+	}
+	if !sm.GetLastRefresh().Equal(start) {
+		t.Errorf("Expected the refresh to be dated by the fake clock, got %v", sm.GetLastRefresh())
+	}
+
+	// The cache is used until the fake clock passes cache_duration
+	if err := os.WriteFile(path, []byte(strings.Join(urls, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(time.Minute)
+	if err := sm.LoadServers(context.Background()); err != nil || len(sm.GetServers()) != 2 {
+		t.Fatalf("Expected the cached list within the cache duration, got %d servers (%v)", len(sm.GetServers()), err)
+	}
+	fake.Advance(time.Hour)
+	if err := sm.LoadServers(context.Background()); err != nil {
+		t.Fatalf("LoadServers failed: %v", err)
+	}
+	if servers := sm.GetServers(); len(servers) != 3 || servers[2].ID != "srv-1002" {
+		t.Fatalf("Expected the edited file after the cache expired, got %+v", servers)
+	}
+	if !sm.GetLastRefresh().Equal(start.Add(time.Hour + time.Minute)) {
+		t.Errorf("Expected the second refresh at the advanced time, got %v", sm.GetLastRefresh())
+	}
+}
+
+func TestReattachMovedServers(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{ConfigPath: filepath.Join(dir, "xray.json"), LogLevel: "error", PingTimeout: 5}
+	mockLoader := NewMockSubscriptionLoader(cfg)
+	amsterdam := types.Server{ID: "nl_example_com_443", Name: "🇳🇱 Amsterdam", Address: "nl.example.com", Port: 443, UUID: "user-1"}
+	berlin := types.Server{ID: "de_example_com_443", Name: "🇩🇪 Berlin", Address: "de.example.com", Port: 443, UUID: "user-1"}
+	paris := types.Server{ID: "fr_example_com_443", Name: "🇫🇷 Paris", Address: "fr.example.com", Port: 443, UUID: "user-1"}
+	mockLoader.SetServers([]types.Server{amsterdam, berlin, paris})
+
+	sm := NewServerManagerWithCacheDir(cfg, dir)
+	sm.subscriptionLoader = mockLoader
+	var change types.ServerListChange
+	sm.OnServersChanged(func(c types.ServerListChange) { change = c })
+	if err := sm.LoadServers(context.Background()); err != nil {
+		t.Fatalf("LoadServers failed: %v", err)
+	}
+	if _, err := sm.ToggleFavorite(amsterdam.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.SetServerNote(amsterdam.ID, "good for Netflix"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.SetServerNote(paris.ID, "slow"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Amsterdam moves to another port, Paris is replaced by a server of another user
+	movedAmsterdam := amsterdam
+	movedAmsterdam.ID, movedAmsterdam.Port = "nl_example_com_8443", 8443
+	otherParis := paris
+	otherParis.ID, otherParis.Port, otherParis.UUID = "fr_example_com_8443", 8443, "user-2"
+	mockLoader.SetServers([]types.Server{movedAmsterdam, berlin, otherParis})
+	if err := sm.LoadServers(context.Background()); err != nil {
+		t.Fatalf("LoadServers failed: %v", err)
+	}
+
+	if len(change.Reattached) != 1 {
+		t.Fatalf("Expected Amsterdam to be reattached, got %+v", change.Reattached)
+	}
+	reattached := change.Reattached[0]
+	if reattached.From.ID != amsterdam.ID || reattached.To.ID != movedAmsterdam.ID || reattached.Confidence != 1 {
+		t.Errorf("Unexpected reattachment %+v", reattached)
+	}
+	if strings.Join(reattached.Moved, ",") != "favorite,note" {
+		t.Errorf("Expected the favorite and the note to move, got %v", reattached.Moved)
+	}
+	if len(change.Added) != 1 || change.Added[0].ID != otherParis.ID || len(change.Removed) != 1 || change.Removed[0].ID != paris.ID {
+		t.Errorf("Expected only Paris as added and removed, got %+v / %+v", change.Added, change.Removed)
+	}
+	if !sm.IsFavorite(movedAmsterdam.ID) || sm.GetServerNote(movedAmsterdam.ID) != "good for Netflix" {
+		t.Error("Expected the favorite and the note on the new ID")
+	}
+	if sm.GetServerNote(otherParis.ID) != "" {
+		t.Error("Expected the note of Paris not to follow a server of another user")
+	}
+}
+
+func TestMatchMovedServersSkipsAmbiguous(t *testing.T) {
+	removed := []types.Server{{ID: "a_1", Name: "A", Address: "a.example.com", Port: 1, UUID: "u"}}
+	added := []types.Server{
+		{ID: "a_2", Name: "A", Address: "a.example.com", Port: 2, UUID: "u"},
+		{ID: "a_3", Name: "A", Address: "a.example.com", Port: 3, UUID: "u"},
+	}
+	if pairs := matchMovedServers(removed, added); len(pairs) != 0 {
+		t.Errorf("Expected two equal candidates to leave the server unmatched, got %+v", pairs)
+	}
+	if pairs := matchMovedServers(removed, added[:1]); len(pairs) != 1 || pairs[0].score != 100 {
+		t.Errorf("Expected a certain match, got %+v", pairs)
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net"
@@ -212,6 +213,7 @@ type MockSubscriptionLoader struct {
 	config  *config.Config
 	servers []types.Server
 	error   error
+	info    *types.SubscriptionInfo
 }
 
 func NewMockSubscriptionLoader(cfg *config.Config) *MockSubscriptionLoader {
@@ -226,7 +228,13 @@ func (m *MockSubscriptionLoader) SetServers(servers []types.Server) {
 func (m *MockSubscriptionLoader) SetError(err error) {
 	m.error = err
 }
-func (m *MockSubscriptionLoader) LoadFromURL() ([]types.Server, error) {
+func (m *MockSubscriptionLoader) SetSubscriptionInfo(info *types.SubscriptionInfo) {
+	m.info = info
+}
+func (m *MockSubscriptionLoader) GetSubscriptionInfo() *types.SubscriptionInfo {
+	return m.info
+}
+func (m *MockSubscriptionLoader) LoadFromURL(ctx context.Context) ([]types.Server, error) {
 	if m.error != nil {
 		return nil, m.error
 	}
@@ -235,6 +243,9 @@ func (m *MockSubscriptionLoader) LoadFromURL() ([]types.Server, error) {
 func (m *MockSubscriptionLoader) GetCachedServers() []types.Server {
 	return m.servers
 }
+func (m *MockSubscriptionLoader) GetCacheFile() string {
+	return ""
+}
 func (m *MockSubscriptionLoader) InvalidateCache() {
 }
 func (m *MockSubscriptionLoader) DecodeBase64Config(data string) ([]types.Server, error) {
@@ -1,12 +1,20 @@
 package server
 
 import (
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"xray-telegram-manager/logger"
 	"xray-telegram-manager/types"
 )
 
+// meaningfulSuffixes are short suffixes worth removing although they have no separator
+var meaningfulSuffixes = map[string]bool{
+	"com": true, "org": true, "net": true, "edu": true, "gov": true, "mil": true, "int": true,
+	"east": true, "west": true, "north": true, "south": true, "prod": true, "test": true, "dev": true, "staging": true,
+}
+
 // ServerNameOptimizerInterface defines the interface for server name optimization
 type ServerNameOptimizerInterface interface {
 	// OptimizeNames optimizes server names by removing common suffixes
@@ -64,8 +72,9 @@ func (sno *ServerNameOptimizer) OptimizeNames(servers []types.Server) Optimizati
 	}
 	copy(result.OriginalNames, names)
 
-	// Find common suffixes
-	suffixes := sno.FindCommonSuffixes(names)
+	// Find common suffixes. The counts give the coverage without rescanning the names.
+	counts := sno.countSuffixes(names)
+	suffixes := commonSuffixes(counts)
 	if len(suffixes) == 0 {
 		if sno.logger != nil {
 			sno.logger.Debug("No common suffixes found in server names")
@@ -80,7 +89,7 @@ func (sno *ServerNameOptimizer) OptimizeNames(servers []types.Server) Optimizati
 	var bestCoverage float64
 
 	for _, suffix := range suffixes {
-		coverage := sno.calculateCoverage(names, suffix)
+		coverage := float64(counts[suffix]) / float64(len(names))
 		if coverage >= sno.threshold && coverage > bestCoverage {
 			bestSuffix = suffix
 			bestCoverage = coverage
@@ -135,30 +144,71 @@ func (sno *ServerNameOptimizer) FindCommonSuffixes(names []string) []string {
 		return []string{}
 	}
 
-	suffixMap := make(map[string]int)
+	return commonSuffixes(sno.countSuffixes(names))
+}
 
-	// Generate all possible suffixes for each name
-	for _, name := range names {
-		suffixes := sno.generateSuffixes(name)
-		for _, suffix := range suffixes {
-			suffixMap[suffix]++
+// countSuffixes counts how many names end with each meaningful suffix. Large lists are
+// counted in parallel chunks that are merged afterwards.
+func (sno *ServerNameOptimizer) countSuffixes(names []string) map[string]int {
+	countRange := func(names []string) map[string]int {
+		counts := make(map[string]int, len(names))
+		for _, name := range names {
+			for _, suffix := range sno.generateSuffixes(name) {
+				counts[suffix]++
+			}
+		}
+		return counts
+	}
+
+	workers := runtime.NumCPU()
+	if len(names) < parallelParseThreshold || workers < 2 {
+		return countRange(names)
+	}
+
+	chunk := (len(names) + workers - 1) / workers
+	partials := make([]map[string]int, 0, workers)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for from := 0; from < len(names); from += chunk {
+		part := names[from:min(from+chunk, len(names))]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counts := countRange(part)
+			mutex.Lock()
+			partials = append(partials, counts)
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	counts := partials[0]
+	for _, partial := range partials[1:] {
+		for suffix, count := range partial {
+			counts[suffix] += count
 		}
 	}
+	return counts
+}
 
-	// Filter suffixes that appear in multiple names
-	var commonSuffixes []string
-	for suffix, count := range suffixMap {
+// commonSuffixes returns the suffixes shared by at least two names, longest first
+func commonSuffixes(counts map[string]int) []string {
+	common := make([]string, 0, len(counts)/2)
+	for suffix, count := range counts {
 		if count >= 2 && len(suffix) >= 3 { // minimum 3 characters and appears in at least 2 names
-			commonSuffixes = append(commonSuffixes, suffix)
+			common = append(common, suffix)
 		}
 	}
 
 	// Sort by length (longest first) to prioritize longer suffixes
-	sort.Slice(commonSuffixes, func(i, j int) bool {
-		return len(commonSuffixes[i]) > len(commonSuffixes[j])
+	sort.Slice(common, func(i, j int) bool {
+		if len(common[i]) != len(common[j]) {
+			return len(common[i]) > len(common[j])
+		}
+		return common[i] < common[j]
 	})
 
-	return commonSuffixes
+	return common
 }
 
 // ApplyOptimization applies optimization to servers with given suffix
@@ -193,7 +243,7 @@ func (sno *ServerNameOptimizer) generateSuffixes(name string) []string {
 		return []string{}
 	}
 
-	var suffixes []string
+	suffixes := make([]string, 0, len(name)-2)
 
 	// Generate suffixes of different lengths, starting from 3 characters
 	for i := 3; i <= len(name); i++ {
@@ -225,24 +275,14 @@ func (sno *ServerNameOptimizer) isMeaningfulSuffix(suffix string) bool {
 	}
 
 	// Common domain extensions and meaningful words
-	commonMeaningfulSuffixes := []string{
-		"com", "org", "net", "edu", "gov", "mil", "int",
-		"east", "west", "north", "south", "prod", "test", "dev", "staging",
-	}
-
-	for _, meaningful := range commonMeaningfulSuffixes {
-		if suffix == meaningful {
-			return true
-		}
+	if meaningfulSuffixes[suffix] {
+		return true
 	}
 
 	// Skip suffixes that don't contain meaningful separators or patterns
 	// Common patterns: .domain.com, -region, _suffix, etc.
-	meaningfulChars := []string{".", "-", "_", " "}
-	for _, char := range meaningfulChars {
-		if strings.Contains(suffix, char) {
-			return true
-		}
+	if strings.ContainsAny(suffix, ".-_ ") {
+		return true
 	}
 
 	// If suffix is long enough (>= 5 chars) and contains letters, consider it meaningful
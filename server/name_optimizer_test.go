@@ -1,6 +1,7 @@
 package server
 
 import (
+	"fmt"
 	"testing"
 	"xray-telegram-manager/logger"
 	"xray-telegram-manager/types"
@@ -447,6 +448,23 @@ func TestCalculateCoverage(t *testing.T) {
 	}
 }
 
+func TestOptimizeNamesLargeList(t *testing.T) {
+	optimizer := NewServerNameOptimizer(0.7, nil)
+	servers := make([]types.Server, parallelParseThreshold*4)
+	for i := range servers {
+		servers[i] = types.Server{Name: fmt.Sprintf("Node %d | vpn.example.com", i)}
+	}
+	servers[0].Name = "Other node"
+
+	result := optimizer.OptimizeNames(servers)
+	if result.RemovedSuffix != " | vpn.example.com" {
+		t.Fatalf("Expected suffix ' | vpn.example.com', got %q", result.RemovedSuffix)
+	}
+	if result.AppliedCount != len(servers)-1 || result.OptimizedNames[1] != "Node 1" {
+		t.Errorf("Unexpected optimization result: applied %d, second name %q", result.AppliedCount, result.OptimizedNames[1])
+	}
+}
+
 // Benchmark tests
 func BenchmarkOptimizeNames(b *testing.B) {
 	optimizer := NewServerNameOptimizer(0.7, nil)
@@ -479,3 +497,16 @@ func BenchmarkFindCommonSuffixes(b *testing.B) {
 		optimizer.FindCommonSuffixes(names)
 	}
 }
+
+func BenchmarkOptimizeNamesSubscription(b *testing.B) {
+	optimizer := NewServerNameOptimizer(0.7, nil)
+	servers := make([]types.Server, 2000)
+	for i := range servers {
+		servers[i] = types.Server{Name: fmt.Sprintf("🇩🇪 Germany %d | vpn.example.com", i)}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		optimizer.OptimizeNames(servers)
+	}
+}
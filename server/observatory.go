@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"xray-telegram-manager/types"
+)
+
+// observatoryMethod is the gRPC method of the xray ObservatoryService, it serves the
+// probe results of both observatory and burstObservatory
+const observatoryMethod = "/xray.core.app.observatory.command.ObservatoryService/GetOutboundStatus"
+
+// observatoryTimeout bounds one request of the probe results, the API is local
+const observatoryTimeout = 3 * time.Second
+
+// maxObservatoryResponse limits the size of the probe results read from xray
+const maxObservatoryResponse = 1 << 20
+
+// ObservatoryStatus is the last probe result of an outbound by the xray observatory
+type ObservatoryStatus struct {
+	Tag       string
+	Alive     bool
+	Delay     time.Duration
+	LastError string
+	LastTry   time.Time
+}
+
+// ObservatoryStatus returns the probe results of the xray observatory by outbound
+// tag. It fails when xray_api is not set or xray has no observatory configured.
+func (xc *XrayController) ObservatoryStatus(ctx context.Context) (map[string]ObservatoryStatus, error) {
+	address := xc.config.GetXrayAPI()
+	if address == "" {
+		return nil, fmt.Errorf("xray_api is not set")
+	}
+	ctx, cancel := context.WithTimeout(ctx, observatoryTimeout)
+	defer cancel()
+	message, err := grpcCall(ctx, address, observatoryMethod, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get observatory status: %w", err)
+	}
+	statuses, err := decodeObservatoryResponse(message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode observatory status: %w", err)
+	}
+	byTag := make(map[string]ObservatoryStatus, len(statuses))
+	for _, status := range statuses {
+		byTag[status.Tag] = status
+	}
+	return byTag, nil
+}
+
+// grpcCall makes a unary gRPC call over HTTP/2 without TLS, as the xray API listens,
+// and returns the response message
+func grpcCall(ctx context.Context, address, method string, request []byte) ([]byte, error) {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	defer client.CloseIdleConnections()
+
+	body := make([]byte, 5+len(request))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(request)))
+	copy(body[5:], request)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+address+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("xray API returned HTTP %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxObservatoryResponse))
+	if err != nil {
+		return nil, err
+	}
+	// Errors come in the trailers, or in the headers when there is no response
+	status := resp.Trailer.Get("Grpc-Status")
+	text := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, text = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "" && status != "0" {
+		if text == "" {
+			text = "gRPC status " + status
+		}
+		return nil, fmt.Errorf("xray API error: %s", text)
+	}
+	if len(data) < 5 {
+		return nil, fmt.Errorf("xray API returned no response")
+	}
+	size := int(binary.BigEndian.Uint32(data[1:5]))
+	if data[0] != 0 || len(data) < 5+size {
+		return nil, fmt.Errorf("xray API returned a malformed response")
+	}
+	return data[5 : 5+size], nil
+}
+
+// decodeObservatoryResponse reads GetOutboundStatusResponse, whose field 1 is an
+// ObservationResult with the repeated OutboundStatus in its field 1
+func decodeObservatoryResponse(message []byte) ([]ObservatoryStatus, error) {
+	var statuses []ObservatoryStatus
+	err := readProtoFields(message, func(field int, value uint64, data []byte) error {
+		if field != 1 || data == nil {
+			return nil
+		}
+		return readProtoFields(data, func(field int, value uint64, data []byte) error {
+			if field != 1 || data == nil {
+				return nil
+			}
+			status, err := decodeOutboundStatus(data)
+			if err != nil {
+				return err
+			}
+			statuses = append(statuses, status)
+			return nil
+		})
+	})
+	return statuses, err
+}
+
+// decodeOutboundStatus reads OutboundStatus. Delay is in milliseconds, the average
+// of health_ping (field 7) is in nanoseconds and is used when delay is not set.
+func decodeOutboundStatus(message []byte) (ObservatoryStatus, error) {
+	var status ObservatoryStatus
+	var average time.Duration
+	err := readProtoFields(message, func(field int, value uint64, data []byte) error {
+		switch field {
+		case 1:
+			status.Alive = value != 0
+		case 2:
+			status.Delay = time.Duration(int64(value)) * time.Millisecond
+		case 3:
+			status.LastError = string(data)
+		case 4:
+			status.Tag = string(data)
+		case 6:
+			if value > 0 {
+				status.LastTry = time.Unix(int64(value), 0)
+			}
+		case 7:
+			return readProtoFields(data, func(field int, value uint64, _ []byte) error {
+				if field == 4 {
+					average = time.Duration(int64(value))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if status.Delay <= 0 {
+		status.Delay = average
+	}
+	return status, err
+}
+
+// readProtoFields calls fn for each field of a protobuf message with the value of
+// varint fields or the bytes of length-delimited ones. Fixed-size fields are skipped.
+func readProtoFields(message []byte, fn func(field int, value uint64, data []byte) error) error {
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return fmt.Errorf("malformed field key")
+		}
+		message = message[n:]
+		field := int(key >> 3)
+		var value uint64
+		var data []byte
+		switch key & 7 {
+		case 0:
+			value, n = binary.Uvarint(message)
+			if n <= 0 {
+				return fmt.Errorf("malformed varint of field %d", field)
+			}
+			message = message[n:]
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(message) < size {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			message = message[size:]
+			continue
+		case 2:
+			size, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < size {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			data = message[n : n+int(size)]
+			message = message[n+int(size):]
+		default:
+			return fmt.Errorf("unsupported wire type of field %d", field)
+		}
+		if err := fn(field, value, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// observedResult turns the observatory status of server into a ping result
+func observedResult(server types.Server, status ObservatoryStatus) types.PingResult {
+	result := types.PingResult{
+		Server:   server,
+		TestTime: time.Now(),
+		Method:   types.PingMethodObservatory,
+	}
+	if !status.Alive {
+		reason := strings.TrimSpace(status.LastError)
+		if reason == "" {
+			reason = "no response"
+		}
+		result.Error = fmt.Errorf("xray observatory: %s", reason)
+		return result
+	}
+	result.Latency = status.Delay
+	result.Success = true
+	result.Available = true
+	return result
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+)
+
+// protoField encodes a length-delimited protobuf field
+func protoField(field int, data []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(field<<3|2))
+	out = binary.AppendUvarint(out, uint64(len(data)))
+	return append(out, data...)
+}
+
+// protoVarint encodes a varint protobuf field
+func protoVarint(field int, value uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, uint64(field<<3)), value)
+}
+
+// outboundStatus encodes an OutboundStatus, delay in milliseconds and the health
+// ping average in nanoseconds
+func outboundStatus(tag string, alive bool, delayMs int64, average time.Duration, lastError string) []byte {
+	var status []byte
+	if alive {
+		status = append(status, protoVarint(1, 1)...)
+	}
+	if delayMs > 0 {
+		status = append(status, protoVarint(2, uint64(delayMs))...)
+	}
+	if lastError != "" {
+		status = append(status, protoField(3, []byte(lastError))...)
+	}
+	status = append(status, protoField(4, []byte(tag))...)
+	status = append(status, protoVarint(6, uint64(time.Now().Unix()))...)
+	if average > 0 {
+		status = append(status, protoField(7, protoVarint(4, uint64(average)))...)
+	}
+	return status
+}
+
+// startObservatory serves GetOutboundStatus over h2c like the xray API and returns
+// its address
+func startObservatory(t *testing.T, statuses ...[]byte) string {
+	t.Helper()
+	var result []byte
+	for _, status := range statuses {
+		result = append(result, protoField(1, status)...)
+	}
+	message := protoField(1, result)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != observatoryMethod || r.Header.Get("Content-Type") != "application/grpc" {
+			w.Header().Set("Grpc-Status", "12")
+			w.Header().Set("Grpc-Message", "unknown service")
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		frame := make([]byte, 5, 5+len(message))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+		_, _ = w.Write(append(frame, message...))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestObservatoryStatus(t *testing.T) {
+	address := startObservatory(t,
+		outboundStatus("vless-reality", true, 87, 0, ""),
+		outboundStatus("burst", true, 0, 42*time.Millisecond, ""),
+		outboundStatus("down", false, 0, 0, "context deadline exceeded"),
+	)
+	controller := NewXrayController(&configAdapter{&config.Config{XrayAPI: address}})
+
+	statuses, err := controller.ObservatoryStatus(context.Background())
+	if err != nil {
+		t.Fatalf("ObservatoryStatus failed: %v", err)
+	}
+	if len(statuses) != 3 {
+		t.Fatalf("Expected 3 statuses, got %+v", statuses)
+	}
+	if status := statuses["vless-reality"]; !status.Alive || status.Delay != 87*time.Millisecond || status.LastTry.IsZero() {
+		t.Errorf("Unexpected observatory status: %+v", status)
+	}
+	if status := statuses["burst"]; status.Delay != 42*time.Millisecond {
+		t.Errorf("Expected the health ping average for burstObservatory, got %v", status.Delay)
+	}
+	if status := statuses["down"]; status.Alive || status.LastError != "context deadline exceeded" {
+		t.Errorf("Unexpected status of a failed outbound: %+v", status)
+	}
+
+	result := observedResult(types.Server{ID: "down"}, statuses["down"])
+	if result.Available || result.Error == nil || result.Method != types.PingMethodObservatory {
+		t.Errorf("Expected a failed probe to make the server unavailable, got %+v", result)
+	}
+}
+
+func TestObservatoryStatusUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	controller := NewXrayController(&configAdapter{&config.Config{XrayAPI: address}})
+	if _, err := controller.ObservatoryStatus(context.Background()); err == nil {
+		t.Error("Expected an error when the xray API is not listening")
+	}
+	if _, err := NewXrayController(&configAdapter{&config.Config{}}).ObservatoryStatus(context.Background()); err == nil {
+		t.Error("Expected an error when xray_api is not set")
+	}
+}
+
+func TestPingServersUsesObservatory(t *testing.T) {
+	address := startObservatory(t, outboundStatus("vless-reality", true, 87, 0, ""))
+	cfg := &config.Config{
+		ConfigPath:  filepath.Join(t.TempDir(), "04_outbounds.json"),
+		XrayAPI:     address,
+		PingTimeout: 1,
+	}
+	sm := NewServerManagerWithCacheDir(cfg, t.TempDir())
+	current := types.Server{ID: "current", Name: "Current", Address: "127.0.0.1", Port: 1, Tag: "vless-reality"}
+	other := types.Server{ID: "other", Name: "Other", Address: "127.0.0.1", Port: 1, Tag: "vless-reality"}
+	sm.currentServer = &current
+
+	results, err := sm.pingServers(context.Background(), []types.Server{current, other}, sm.pingTester.standardProfile(), nil)
+	if err != nil {
+		t.Fatalf("pingServers failed: %v", err)
+	}
+	byID := map[string]types.PingResult{}
+	for _, result := range results {
+		byID[result.Server.ID] = result
+	}
+	if result := byID["current"]; result.Method != types.PingMethodObservatory || !result.Available || result.Latency != 87*time.Millisecond {
+		t.Errorf("Expected the observatory latency of the current server, got %+v", result)
+	}
+	if result := byID["other"]; result.Method == types.PingMethodObservatory {
+		t.Errorf("Expected other servers to be pinged, got %+v", result)
+	}
+
+	// Without the observatory the current server is pinged
+	cfg.XrayAPI = ""
+	results, err = sm.pingServers(context.Background(), []types.Server{current}, sm.pingTester.standardProfile(), nil)
+	if err != nil {
+		t.Fatalf("pingServers failed: %v", err)
+	}
+	if len(results) != 1 || results[0].Method == types.PingMethodObservatory {
+		t.Errorf("Expected a fallback to own pings, got %+v", results)
+	}
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+	"xray-telegram-manager/fsutil"
+	"xray-telegram-manager/types"
+)
+
+// PingTarget replaces the address and port a server is pinged on, for servers
+// that do not answer on their own endpoint but work fine
+type PingTarget struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// overridesFile is the on-disk format of the manual overrides
+type overridesFile struct {
+	PingTargets map[string]PingTarget `json:"ping_targets"`
+	// Outbound options changed in /settings for all servers and for single servers
+	OutboundDefaults types.OutboundOverride            `json:"outbound_defaults"`
+	Outbound         map[string]types.OutboundOverride `json:"outbound,omitempty"`
+	// IDs of the servers marked as favorites, in the order they were added
+	Favorites []string `json:"favorites,omitempty"`
+	// Short notes of the user about servers, like "good for Netflix"
+	Notes map[string]string `json:"notes,omitempty"`
+}
+
+// ManualOverrides keeps per-server settings made by the user. They are keyed by
+// server ID, so they survive subscription refreshes.
+type ManualOverrides struct {
+	path   string
+	mutex  sync.RWMutex
+	data   overridesFile
+	loaded bool
+}
+
+// NewManualOverrides creates a store backed by path. The file is read on first use.
+func NewManualOverrides(path string) *ManualOverrides {
+	return &ManualOverrides{
+		path: path,
+		data: overridesFile{PingTargets: make(map[string]PingTarget), Outbound: make(map[string]types.OutboundOverride), Notes: make(map[string]string)},
+	}
+}
+
+// GetPingTarget returns the ping target override for a server
+func (mo *ManualOverrides) GetPingTarget(serverID string) (PingTarget, bool) {
+	mo.mutex.Lock()
+	defer mo.mutex.Unlock()
+	mo.loadUnsafe()
+	target, ok := mo.data.PingTargets[serverID]
+	return target, ok
+}
+
+// SetPingTarget overrides where a server is pinged and saves the overrides
+func (mo *ManualOverrides) SetPingTarget(serverID string, target PingTarget) error {
+	if target.Host == "" {
+		return fmt.Errorf("ping target host cannot be empty")
+	}
+	if target.Port <= 0 || target.Port > 65535 {
+		return fmt.Errorf("ping target port must be between 1 and 65535")
+	}
+	mo.mutex.Lock()
+	defer mo.mutex.Unlock()
+	mo.loadUnsafe()
+	mo.data.PingTargets[serverID] = target
+	return mo.saveUnsafe()
+}
+
+// ClearPingTarget removes the ping target override of a server
+func (mo *ManualOverrides) ClearPingTarget(serverID string) error {
+	mo.mutex.Lock()
+	defer mo.mutex.Unlock()
+	mo.loadUnsafe()
+	if _, ok := mo.data.PingTargets[serverID]; !ok {
+		return nil
+	}
+	delete(mo.data.PingTargets, serverID)
+	return mo.saveUnsafe()
+}
+
+// GetOutboundDefaults returns the outbound options changed for all servers
+func (mo *ManualOverrides) GetOutboundDefaults() types.OutboundOverride {
+	mo.mutex.Lock()
+	defer mo.mutex.Unlock()
+	mo.loadUnsafe()
+	return mo.data.OutboundDefaults
+}
+
+// SetOutboundDefaults changes the outbound options of all servers and saves the overrides
+func (mo *ManualOverrides) SetOutboundDefaults(override types.OutboundOverride) error {
+	mo.mutex.Lock()
+	defer mo.mutex.Unlock()
+	mo.loadUnsafe()
+	mo.data.OutboundDefaults = override
+	return mo.saveUnsafe()
+}
+
+// GetOutboundOverride returns the outbound options changed for one server
+func (mo *ManualOverrides) GetOutboundOverride(serverID string) types.OutboundOverride {
+	mo.mutex.Lock()
+	defer mo.mutex.Unlock()
+	mo.loadUnsafe()
+	return mo.data.Outbound[serverID]
+}
+
+// SetOutboundOverride changes the outbound options of one server and saves the overrides.
+// An override without changes is removed.
+func (mo *ManualOverrides) SetOutboundOverride(serverID string, override types.OutboundOverride) error {
+	mo.mutex.Lock()
+	defer mo.mutex.Unlock()
+	mo.loadUnsafe()
+	if override == (types.OutboundOverride{}) {
+		delete(mo.data.Outbound, serverID)
+	} else {
+		mo.data.Outbound[serverID] = override
+	}
+	return mo.saveUnsafe()
+}
+
+// GetFavorites returns the IDs of the favorite servers
+func (mo *ManualOverrides) GetFavorites() []string {
+	mo.mutex.Lock()
+	defer mo.mutex.Unlock()
+	mo.loadUnsafe()
+	return append([]string(nil), mo.data.Favorites...)
+}
+
+// ToggleFavorite adds or removes a server from the favorites, saves the overrides
+// and returns whether the server is a favorite now
+func (mo *ManualOverrides) ToggleFavorite(serverID string) (bool, error) {
+	mo.mutex.Lock()
+	defer mo.mutex.Unlock()
+	mo.loadUnsafe()
+	for i, id := range mo.data.Favorites {
+		if id == serverID {
+			mo.data.Favorites = append(mo.data.Favorites[:i], mo.data.Favorites[i+1:]...)
+			return false, mo.saveUnsafe()
+		}
+	}
+	mo.data.Favorites = append(mo.data.Favorites, serverID)
+	return true, mo.saveUnsafe()
+}
+
+// GetNote returns the note of a server, empty when it has none
+func (mo *ManualOverrides) GetNote(serverID string) string {
+	mo.mutex.Lock()
+	defer mo.mutex.Unlock()
+	mo.loadUnsafe()
+	return mo.data.Notes[serverID]
+}
+
+// GetNotes returns the notes of all servers by server ID
+func (mo *ManualOverrides) GetNotes() map[string]string {
+	mo.mutex.Lock()
+	defer mo.mutex.Unlock()
+	mo.loadUnsafe()
+	notes := make(map[string]string, len(mo.data.Notes))
+	for id, note := range mo.data.Notes {
+		notes[id] = note
+	}
+	return notes
+}
+
+// SetNote changes the note of a server and saves the overrides. An empty note
+// removes it.
+func (mo *ManualOverrides) SetNote(serverID, note string) error {
+	note = strings.Join(strings.Fields(note), " ")
+	if utf8.RuneCountInString(note) > types.MaxServerNoteLength {
+		return fmt.Errorf("note is longer than %d characters", types.MaxServerNoteLength)
+	}
+	mo.mutex.Lock()
+	defer mo.mutex.Unlock()
+	mo.loadUnsafe()
+	if note == "" {
+		if _, ok := mo.data.Notes[serverID]; !ok {
+			return nil
+		}
+		delete(mo.data.Notes, serverID)
+	} else {
+		mo.data.Notes[serverID] = note
+	}
+	return mo.saveUnsafe()
+}
+
+// Reload drops the overrides held in memory, they are read from the file on next use
+func (mo *ManualOverrides) Reload() {
+	mo.mutex.Lock()
+	defer mo.mutex.Unlock()
+	mo.data = overridesFile{PingTargets: make(map[string]PingTarget), Outbound: make(map[string]types.OutboundOverride), Notes: make(map[string]string)}
+	mo.loaded = false
+}
+
+// loadUnsafe reads the overrides file once. A missing or broken file gives no overrides.
+func (mo *ManualOverrides) loadUnsafe() {
+	if mo.loaded {
+		return
+	}
+	mo.loaded = true
+	data, err := os.ReadFile(mo.path)
+	if err != nil {
+		return
+	}
+	var file overridesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return
+	}
+	if file.PingTargets != nil {
+		mo.data.PingTargets = file.PingTargets
+	}
+	if file.Outbound != nil {
+		mo.data.Outbound = file.Outbound
+	}
+	mo.data.OutboundDefaults = file.OutboundDefaults
+	mo.data.Favorites = file.Favorites
+	if file.Notes != nil {
+		mo.data.Notes = file.Notes
+	}
+}
+func (mo *ManualOverrides) saveUnsafe() error {
+	data, err := json.MarshalIndent(mo.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal overrides: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(mo.path), 0755); err != nil {
+		return fmt.Errorf("failed to create overrides directory: %w", err)
+	}
+	if err := fsutil.WriteShared(mo.path, data); err != nil {
+		return fmt.Errorf("failed to save overrides: %w", err)
+	}
+	return nil
+}
+
+// Move gives the ping target, outbound options, favorite mark and note of fromID to
+// toID, for a server that got a new ID. Data toID already has is kept. It returns
+// the names of what was moved.
+func (mo *ManualOverrides) Move(fromID, toID string) ([]string, error) {
+	mo.mutex.Lock()
+	defer mo.mutex.Unlock()
+	mo.loadUnsafe()
+	var moved []string
+	changed := false
+	if target, ok := mo.data.PingTargets[fromID]; ok {
+		if _, taken := mo.data.PingTargets[toID]; !taken {
+			mo.data.PingTargets[toID] = target
+			moved = append(moved, "ping target")
+		}
+		delete(mo.data.PingTargets, fromID)
+		changed = true
+	}
+	if override, ok := mo.data.Outbound[fromID]; ok {
+		if _, taken := mo.data.Outbound[toID]; !taken {
+			mo.data.Outbound[toID] = override
+			moved = append(moved, "outbound options")
+		}
+		delete(mo.data.Outbound, fromID)
+		changed = true
+	}
+	if i := indexOf(mo.data.Favorites, fromID); i >= 0 {
+		if indexOf(mo.data.Favorites, toID) < 0 {
+			// The favorite keeps its place in the order
+			mo.data.Favorites[i] = toID
+			moved = append(moved, "favorite")
+		} else {
+			mo.data.Favorites = append(mo.data.Favorites[:i], mo.data.Favorites[i+1:]...)
+		}
+		changed = true
+	}
+	if note, ok := mo.data.Notes[fromID]; ok {
+		if _, taken := mo.data.Notes[toID]; !taken {
+			mo.data.Notes[toID] = note
+			moved = append(moved, "note")
+		}
+		delete(mo.data.Notes, fromID)
+		changed = true
+	}
+	if !changed {
+		return nil, nil
+	}
+	return moved, mo.saveUnsafe()
+}
+
+func indexOf(ids []string, id string) int {
+	for i, candidate := range ids {
+		if candidate == id {
+			return i
+		}
+	}
+	return -1
+}
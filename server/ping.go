@@ -2,9 +2,12 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"xray-telegram-manager/config"
@@ -13,74 +16,243 @@ import (
 
 type PingTesterImpl struct {
 	config *config.Config
+	// Per-server ping target overrides, may be nil
+	overrides *ManualOverrides
+	// Resolver of server domains, nil uses the system resolver
+	resolver *Resolver
 }
 
 func NewPingTester(cfg *config.Config) *PingTesterImpl {
 	return &PingTesterImpl{
-		config: cfg,
+		config:   cfg,
+		resolver: NewResolver(cfg.DNS),
 	}
 }
 func (pt *PingTesterImpl) TestServers(servers []types.Server) ([]types.PingResult, error) {
 	return pt.TestServersWithProgress(servers, nil)
 }
 func (pt *PingTesterImpl) TestServersWithProgress(servers []types.Server, progressCallback func(completed, total int, serverName string)) ([]types.PingResult, error) {
+	return pt.TestServersWithProfile(servers, pt.standardProfile(), progressCallback)
+}
+
+// TestServersWithProfile tests servers with the mode, timeout, retries and
+// concurrency of profile, max_servers is applied by the caller
+func (pt *PingTesterImpl) TestServersWithProfile(servers []types.Server, profile config.PingProfile, progressCallback func(completed, total int, serverName string)) ([]types.PingResult, error) {
 	if len(servers) == 0 {
 		return nil, fmt.Errorf("no servers provided for testing")
 	}
+	concurrency := profile.Concurrency
+	if concurrency < 1 {
+		concurrency = config.DefaultPingConcurrency
+	}
 	results := make([]types.PingResult, len(servers))
 	var wg sync.WaitGroup
 	var completedMutex sync.Mutex
 	completed := 0
-	semaphore := make(chan struct{}, 5) // Limit to 5 concurrent tests
-	for i, server := range servers {
-		wg.Add(1)
-		go func(index int, srv types.Server) {
-			defer wg.Done()
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
-			results[index] = pt.TestServer(srv)
-			if progressCallback != nil {
-				completedMutex.Lock()
-				completed++
-				currentCompleted := completed
-				completedMutex.Unlock()
-				progressCallback(currentCompleted, len(servers), srv.Name)
-			}
-		}(i, server)
+	semaphore := make(chan struct{}, concurrency)
+	test := func(index int, srv types.Server) {
+		defer wg.Done()
+		semaphore <- struct{}{}
+		defer func() { <-semaphore }()
+		results[index] = pt.testWithProfile(srv, profile)
+		if progressCallback != nil {
+			completedMutex.Lock()
+			completed++
+			currentCompleted := completed
+			completedMutex.Unlock()
+			progressCallback(currentCompleted, len(servers), srv.Name)
+		}
+	}
+	if profile.BatchPause <= 0 {
+		for i, server := range servers {
+			wg.Add(1)
+			go test(i, server)
+		}
+		wg.Wait()
+		return results, nil
+	}
+	// Batches leave the CPU to the traffic in between, see config.Background
+	for start := 0; start < len(servers); start += concurrency {
+		if start > 0 {
+			time.Sleep(profile.BatchPause)
+		}
+		for i := start; i < start+concurrency && i < len(servers); i++ {
+			wg.Add(1)
+			go test(i, servers[i])
+		}
+		wg.Wait()
 	}
-	wg.Wait()
 	return results, nil
 }
+
+// standardProfile is the profile of the standard ping test, see config.PingProfile
+func (pt *PingTesterImpl) standardProfile() config.PingProfile {
+	return config.PingProfile{
+		Mode:           pt.config.PingMode,
+		TimeoutSeconds: pt.config.PingTimeout,
+		Concurrency:    config.DefaultPingConcurrency,
+	}
+}
+
+// backgroundProfile is the standard profile with the limits of background jobs
+func (pt *PingTesterImpl) backgroundProfile() config.PingProfile {
+	profile := pt.standardProfile()
+	background := pt.config.GetBackground()
+	profile.Concurrency = background.Concurrency
+	profile.BatchPause = background.BatchPause()
+	return profile
+}
+
+// testWithProfile tests server and tests it again up to profile.Retries times while
+// it does not answer
+func (pt *PingTesterImpl) testWithProfile(server types.Server, profile config.PingProfile) types.PingResult {
+	handshake := profile.Mode == config.PingModeHandshake
+	result := pt.testServer(context.Background(), server, handshake, profile.Timeout())
+	for attempt := 0; attempt < profile.Retries && !result.Available; attempt++ {
+		result = pt.testServer(context.Background(), server, handshake, profile.Timeout())
+	}
+	return result
+}
 func (pt *PingTesterImpl) TestServer(server types.Server) types.PingResult {
+	return pt.testWithProfile(server, pt.standardProfile())
+}
+
+// Probe checks that server accepts connections before switching to it. Servers
+// using TLS or Reality must also pass the handshake, whatever ping_mode is.
+func (pt *PingTesterImpl) Probe(ctx context.Context, server types.Server) types.PingResult {
+	return pt.testServer(ctx, server, true, time.Duration(pt.config.PingTimeout)*time.Second)
+}
+func (pt *PingTesterImpl) testServer(ctx context.Context, server types.Server, handshake bool, timeout time.Duration) types.PingResult {
+	if pt.config.Dev.Enabled {
+		return simulatePing(ctx, pt.config.Dev, server, handshake, timeout)
+	}
 	result := types.PingResult{
 		Server:    server,
 		Available: false,
 		Latency:   0,
 		Error:     nil,
+		TestTime:  time.Now(),
+		Method:    types.PingMethodTCP,
 	}
-	timeout := time.Duration(pt.config.PingTimeout) * time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	startTime := time.Now()
-	address := fmt.Sprintf("%s:%d", server.Address, server.Port)
-	dialer := &net.Dialer{}
-	conn, err := dialer.DialContext(ctx, "tcp", address)
-	latency := time.Since(startTime)
+	host, port := server.Address, server.Port
+	target, overridden := pt.pingTarget(server.ID)
+	if overridden {
+		host, port = target.Host, target.Port
+	}
+	conn, latency, err := dialHost(ctx, host, strconv.Itoa(port), pt.config.IPFamily, pt.resolver)
 	if err != nil {
 		result.Error = fmt.Errorf("connection failed: %w", err)
 		result.Available = false
 		result.Latency = 0
 		return result
 	}
-	if err := conn.Close(); err != nil {
-		// Connection already closed or error occurred - this is expected
-		_ = err
+	defer conn.Close()
+	result.Family = addrFamily(conn.RemoteAddr())
+
+	switch {
+	case pt.config.PingCDNHost != "":
+		// The endpoint must pass a TLS handshake for the CDN host, which is what
+		// CDN-fronted servers actually serve
+		result.Method = types.PingMethodCDN
+		latency, err = measureHandshake(ctx, conn, &tls.Config{ServerName: pt.config.PingCDNHost, InsecureSkipVerify: true})
+		if err != nil {
+			result.Error = fmt.Errorf("CDN handshake for %s failed: %w", pt.config.PingCDNHost, err)
+			return result
+		}
+	case handshake && !overridden:
+		if tlsConfig, ok := handshakeTLSConfig(server); ok {
+			result.Method = types.PingMethodHandshake
+			latency, err = measureHandshake(ctx, conn, tlsConfig)
+			if err != nil {
+				result.Error = fmt.Errorf("%s handshake failed: %w", serverSecurity(server), err)
+				return result
+			}
+		}
 	}
+
 	result.Available = true
 	result.Latency = latency
 	result.Error = nil
 	return result
 }
+
+// pingTarget returns the ping target override of a server, if any
+func (pt *PingTesterImpl) pingTarget(serverID string) (PingTarget, bool) {
+	if pt.overrides == nil {
+		return PingTarget{}, false
+	}
+	return pt.overrides.GetPingTarget(serverID)
+}
+
+// measureHandshake completes a TLS client hello over conn and returns the handshake time
+func measureHandshake(ctx context.Context, conn net.Conn, tlsConfig *tls.Config) (time.Duration, error) {
+	tlsConn := tls.Client(conn, tlsConfig)
+	startTime := time.Now()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return 0, err
+	}
+	return time.Since(startTime), nil
+}
+
+// handshakeTLSConfig returns the client config used to time the handshake of a TLS or
+// Reality server. Reality servers forward an unauthenticated client hello to their
+// camouflage target, so a regular TLS handshake measures the real path. Transports not
+// running over TCP are not supported and fall back to TCP connect timing.
+func handshakeTLSConfig(server types.Server) (*tls.Config, bool) {
+	security := serverSecurity(server)
+	if security != "tls" && security != "reality" {
+		return nil, false
+	}
+	network := streamSetting(server.StreamSettings, "network")
+	if network == "" {
+		network = server.Network
+	}
+	if network == "kcp" || network == "quic" {
+		return nil, false
+	}
+
+	serverName := server.SNI
+	for _, key := range []string{"realitySettings", "tlsSettings"} {
+		if settings, ok := server.StreamSettings[key].(map[string]interface{}); ok {
+			if name := streamSetting(settings, "serverName"); name != "" {
+				serverName = name
+			}
+		}
+	}
+	if serverName == "" {
+		serverName = server.Address
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		// Only the timing matters: Reality presents the target's certificate and
+		// self-signed TLS servers are common
+		InsecureSkipVerify: true,
+	}
+	if server.ALPN != "" {
+		tlsConfig.NextProtos = strings.Split(server.ALPN, ",")
+	}
+	return tlsConfig, true
+}
+
+// serverSecurity returns the stream security of a server: "tls", "reality" or ""
+func serverSecurity(server types.Server) string {
+	if security := streamSetting(server.StreamSettings, "security"); security != "" {
+		return security
+	}
+	if server.Security != "" {
+		return server.Security
+	}
+	return server.TLS
+}
+func streamSetting(settings map[string]interface{}, key string) string {
+	if value, ok := settings[key].(string); ok {
+		return value
+	}
+	return ""
+}
 func (pt *PingTesterImpl) SortByLatency(results []types.PingResult) []types.PingResult {
 	sorted := make([]types.PingResult, len(results))
 	copy(sorted, results)
@@ -125,7 +297,7 @@ func (pt *PingTesterImpl) FormatResultsForTelegram(results []types.PingResult) s
 				message += fmt.Sprintf("   📝 %s\n", errorMsg)
 			}
 		}
-		address := fmt.Sprintf("%s:%d", result.Server.Address, result.Server.Port)
+		address := net.JoinHostPort(result.Server.Address, strconv.Itoa(result.Server.Port))
 		message += fmt.Sprintf("   🌐 %s\n", address)
 		if i < len(sortedResults)-1 {
 			message += "\n"
@@ -2,6 +2,11 @@ package server
 
 import (
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -179,6 +184,30 @@ func TestPingTesterImpl_TestServers(t *testing.T) {
 	}
 }
 
+func TestPingTesterImpl_TestServersInBatches(t *testing.T) {
+	pt := NewPingTester(&config.Config{PingTimeout: 2})
+	servers := []types.Server{
+		{ID: "server1", Address: "127.0.0.1", Port: 65533},
+		{ID: "server2", Address: "127.0.0.1", Port: 65532},
+		{ID: "server3", Address: "127.0.0.1", Port: 65531},
+	}
+	profile := config.PingProfile{Mode: config.PingModeTCP, TimeoutSeconds: 2, Concurrency: 2, BatchPause: 100 * time.Millisecond}
+
+	start := time.Now()
+	results, err := pt.TestServersWithProfile(servers, profile, nil)
+	if err != nil {
+		t.Fatalf("TestServersWithProfile returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < profile.BatchPause {
+		t.Errorf("Expected a pause between two batches, took %v", elapsed)
+	}
+	for i, result := range results {
+		if result.Server.ID != servers[i].ID {
+			t.Errorf("Expected result %d for %s, got %s", i, servers[i].ID, result.Server.ID)
+		}
+	}
+}
+
 func TestPingTesterImpl_TestServers_EmptyList(t *testing.T) {
 	cfg := &config.Config{
 		PingTimeout: 2,
@@ -540,3 +569,93 @@ func TestPingTesterImpl_TestServer_WithMockServer(t *testing.T) {
 		t.Logf("Latency %dms is lower than expected 10ms delay, but this is acceptable for local mock", result.Latency)
 	}
 }
+
+func TestPingTesterImpl_HandshakeMode(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+	host, portStr, err := net.SplitHostPort(tlsServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse TLS server address: %v", err)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	plainServer, err := NewMockTCPServer()
+	if err != nil {
+		t.Fatalf("Failed to create mock TCP server: %v", err)
+	}
+	defer plainServer.Stop()
+	plainServer.Start()
+
+	pt := NewPingTester(&config.Config{PingTimeout: 2, PingMode: config.PingModeHandshake})
+
+	realityServer := types.Server{
+		ID:      "reality",
+		Address: host,
+		Port:    port,
+		StreamSettings: map[string]interface{}{
+			"network":         "tcp",
+			"security":        "reality",
+			"realitySettings": map[string]interface{}{"serverName": "example.com"},
+		},
+	}
+	result := pt.TestServer(realityServer)
+	if !result.Available || result.Method != types.PingMethodHandshake {
+		t.Errorf("Expected handshake measurement, got available=%t method=%s err=%v", result.Available, result.Method, result.Error)
+	}
+
+	// A plain TCP listener never answers the client hello
+	noTLSServer := realityServer
+	noTLSServer.Address = plainServer.Address()
+	noTLSServer.Port = plainServer.Port()
+	result = pt.TestServer(noTLSServer)
+	if result.Available || result.Error == nil || !strings.Contains(result.Error.Error(), "handshake") {
+		t.Errorf("Expected handshake failure, got available=%t err=%v", result.Available, result.Error)
+	}
+
+	// Servers without TLS fall back to TCP connect timing
+	plain := types.Server{ID: "plain", Address: plainServer.Address(), Port: plainServer.Port()}
+	result = pt.TestServer(plain)
+	if !result.Available || result.Method != types.PingMethodTCP {
+		t.Errorf("Expected TCP fallback, got available=%t method=%s err=%v", result.Available, result.Method, result.Error)
+	}
+}
+
+func TestPingTesterImpl_PingTargetOverride(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+	host, portStr, err := net.SplitHostPort(tlsServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse TLS server address: %v", err)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	overrides := NewManualOverrides(filepath.Join(t.TempDir(), "overrides.json"))
+	pt := &PingTesterImpl{config: &config.Config{PingTimeout: 2}, overrides: overrides}
+
+	// The server's own endpoint is closed, pings go to the override instead
+	blocked := types.Server{ID: "blocked", Address: "127.0.0.1", Port: 1}
+	if result := pt.TestServer(blocked); result.Available {
+		t.Fatal("Expected closed endpoint to be unavailable without override")
+	}
+	if err := overrides.SetPingTarget(blocked.ID, PingTarget{Host: host, Port: port}); err != nil {
+		t.Fatalf("SetPingTarget failed: %v", err)
+	}
+	if result := pt.TestServer(blocked); !result.Available {
+		t.Errorf("Expected override target to be pinged, got err=%v", result.Error)
+	}
+
+	// A CDN host is checked with a TLS handshake through the endpoint
+	pt.config.PingCDNHost = "cdn.example.com"
+	result := pt.TestServer(blocked)
+	if !result.Available || result.Method != types.PingMethodCDN {
+		t.Errorf("Expected CDN measurement, got available=%t method=%s err=%v", result.Available, result.Method, result.Error)
+	}
+
+	if err := overrides.ClearPingTarget(blocked.ID); err != nil {
+		t.Fatalf("ClearPingTarget failed: %v", err)
+	}
+	reloaded := NewManualOverrides(overrides.path)
+	if _, ok := reloaded.GetPingTarget(blocked.ID); ok {
+		t.Error("Expected cleared override to stay cleared after reload")
+	}
+}
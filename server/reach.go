@@ -0,0 +1,306 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	"xray-telegram-manager/types"
+)
+
+const (
+	// reachStartTimeout bounds how long the temporary xray may take to listen
+	reachStartTimeout = 5 * time.Second
+	// reachRequestTimeout bounds one request through the temporary xray
+	reachRequestTimeout = 15 * time.Second
+	// reachTraceURL answers with the IP and country a request came from
+	reachTraceURL = "https://www.cloudflare.com/cdn-cgi/trace"
+	// reachUserAgent is sent because some sites refuse unknown clients
+	reachUserAgent = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0 Safari/537.36"
+	// maxReachBody is how much of a response is read before it is closed
+	maxReachBody = 64 * 1024
+	// snapshotTimeout bounds a connectivity snapshot, including the start of xray
+	snapshotTimeout = 10 * time.Second
+)
+
+// ProbeDomain opens https://domain through the server with a temporary xray instance
+// and reports the HTTP status, the latency and where the site sees the request from.
+// The running xray and its config are not touched. An error means the probe could
+// not run, a site that did not answer is reported in the result.
+func (sm *ServerManager) ProbeDomain(ctx context.Context, serverID, domain string) (types.ReachResult, error) {
+	domain, err := normalizeProbeDomain(domain)
+	if err != nil {
+		return types.ReachResult{}, err
+	}
+	var target *types.Server
+	for _, server := range sm.GetServers() {
+		if server.ID == serverID {
+			serverCopy := server
+			target = &serverCopy
+			break
+		}
+	}
+	if target == nil {
+		return types.ReachResult{}, fmt.Errorf("server with ID %s not found", serverID)
+	}
+
+	result := types.ReachResult{Server: *target, Domain: domain}
+	proxy, stop, err := sm.xrayController.startProbeXray(ctx, *target, sm.outboundOptionsWithAddress(ctx, *target))
+	if err != nil {
+		return result, err
+	}
+	defer stop()
+
+	client := reachClient(proxy)
+	result.StatusCode, result.Latency, result.Error = fetchStatus(ctx, client, "https://"+domain+"/")
+	result.ExitIP, result.Country = fetchTrace(ctx, client)
+	result.CountryFlag = countryFlag(result.Country)
+	sm.logger.Info("Reach test of %s through %s: status %d in %v, exit %s %s, error: %v",
+		domain, target.Name, result.StatusCode, result.Latency, result.ExitIP, result.Country, result.Error)
+	return result, nil
+}
+
+// MeasureConnectivity takes a snapshot of how the server performs: how fast a request
+// through it answers and where sites see it from. Like ProbeDomain it runs a temporary
+// xray instance, so the active server can be measured before a switch and the new one
+// after it the same way. A server that did not answer is reported in the snapshot.
+func (sm *ServerManager) MeasureConnectivity(ctx context.Context, serverID string) (types.ConnectivitySnapshot, error) {
+	target, err := sm.GetServerByID(serverID)
+	if err != nil {
+		return types.ConnectivitySnapshot{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+
+	snapshot := types.ConnectivitySnapshot{Server: *target}
+	proxy, stop, err := sm.xrayController.startProbeXray(ctx, *target, sm.outboundOptionsWithAddress(ctx, *target))
+	if err != nil {
+		return snapshot, err
+	}
+	defer stop()
+
+	start := time.Now()
+	snapshot.ExitIP, snapshot.Country = fetchTrace(ctx, reachClient(proxy))
+	if snapshot.ExitIP == "" {
+		snapshot.Error = fmt.Errorf("no answer through the server within %v", snapshotTimeout)
+		if ctx.Err() == nil {
+			snapshot.Error = fmt.Errorf("no answer through the server")
+		}
+	} else {
+		snapshot.Latency = time.Since(start)
+		snapshot.CountryFlag = countryFlag(snapshot.Country)
+	}
+	sm.logger.Info("Connectivity of %s: %v, exit %s %s, error: %v",
+		target.Name, snapshot.Latency, snapshot.ExitIP, snapshot.Country, snapshot.Error)
+	return snapshot, nil
+}
+
+// normalizeProbeDomain takes the host of a URL or a plain domain, e.g. "netflix.com"
+// from "https://www.Netflix.com/browse" gives "www.netflix.com"
+func normalizeProbeDomain(input string) (string, error) {
+	domain := strings.ToLower(strings.TrimSpace(input))
+	if i := strings.Index(domain, "://"); i >= 0 {
+		domain = domain[i+3:]
+	}
+	if i := strings.IndexAny(domain, "/?#"); i >= 0 {
+		domain = domain[:i]
+	}
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return "", fmt.Errorf("domain is empty")
+	}
+	if net.ParseIP(domain) != nil {
+		return domain, nil
+	}
+	if !strings.Contains(domain, ".") || !hostnameRegex.MatchString(domain) {
+		return "", fmt.Errorf("%q is not a domain name", strings.TrimSpace(input))
+	}
+	return domain, nil
+}
+
+// startProbeXray runs a second xray with a SOCKS inbound on a free local port and the
+// outbound of server. It returns the proxy URL and a function stopping the instance.
+func (xc *XrayController) startProbeXray(ctx context.Context, server types.Server, options types.OutboundOptions) (*url.URL, func(), error) {
+	if xc.devSandbox() != "" {
+		return nil, nil, fmt.Errorf("xray is emulated in dev mode, sites cannot be opened through servers")
+	}
+	port, err := freeLocalPort()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find a free port: %w", err)
+	}
+	config := &types.XrayConfig{Outbounds: []types.XrayOutbound{buildProxyOutbound(server, options)}}
+	setDialerOutbound(config, options)
+	data, err := json.Marshal(map[string]interface{}{
+		"log": map[string]interface{}{"loglevel": "warning"},
+		"inbounds": []map[string]interface{}{{
+			"listen":   "127.0.0.1",
+			"port":     port,
+			"protocol": "socks",
+			"settings": map[string]interface{}{"udp": false},
+		}},
+		"outbounds": config.Outbounds,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal probe config: %w", err)
+	}
+	file, err := os.CreateTemp("", "xray-probe-*.json")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create probe config: %w", err)
+	}
+	configPath := file.Name()
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(configPath)
+		return nil, nil, fmt.Errorf("failed to write probe config: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(configPath)
+		return nil, nil, fmt.Errorf("failed to write probe config: %w", err)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	var output bytes.Buffer
+	cmd := exec.CommandContext(runCtx, xc.xrayBinary(), "run", "-c", configPath)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.WaitDelay = time.Second
+	if err := cmd.Start(); err != nil {
+		cancel()
+		os.Remove(configPath)
+		return nil, nil, fmt.Errorf("failed to start xray: %w", err)
+	}
+	exited := make(chan struct{})
+	var waitErr error
+	go func() {
+		waitErr = cmd.Wait()
+		close(exited)
+	}()
+	stop := func() {
+		cancel()
+		<-exited
+		os.Remove(configPath)
+	}
+
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	deadline := time.NewTimer(reachStartTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			stop()
+			lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+			if cause := diagnoseXrayFailure(lines); cause != "" {
+				return nil, nil, fmt.Errorf("xray exited: %v (cause: %s)", waitErr, cause)
+			}
+			return nil, nil, fmt.Errorf("xray exited: %v", waitErr)
+		case <-deadline.C:
+			stop()
+			return nil, nil, fmt.Errorf("xray did not start listening within %v", reachStartTimeout)
+		case <-ctx.Done():
+			stop()
+			return nil, nil, ctx.Err()
+		case <-ticker.C:
+			conn, err := net.DialTimeout("tcp", address, 200*time.Millisecond)
+			if err == nil {
+				conn.Close()
+				return &url.URL{Scheme: "socks5", Host: address}, stop, nil
+			}
+		}
+	}
+}
+
+// freeLocalPort returns a TCP port on the loopback address no one listens on
+func freeLocalPort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// reachClient sends requests through the proxy and reports redirects instead of
+// following them
+func reachClient(proxy *url.URL) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyURL(proxy),
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		Timeout: reachRequestTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// fetchStatus returns the status of the first response of target and how long it took
+func fetchStatus(ctx context.Context, client *http.Client, target string) (int, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("User-Agent", reachUserAgent)
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	latency := time.Since(start)
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxReachBody))
+	resp.Body.Close()
+	return resp.StatusCode, latency, nil
+}
+
+// fetchTrace returns the exit IP and country code of requests through client, empty
+// when the trace service did not answer
+func fetchTrace(ctx context.Context, client *http.Client) (string, string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reachTraceURL, nil)
+	if err != nil {
+		return "", ""
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", ""
+	}
+	return parseTrace(io.LimitReader(resp.Body, maxReachBody))
+}
+
+// parseTrace reads the ip and loc lines of a Cloudflare trace
+func parseTrace(body io.Reader) (ip, country string) {
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "ip":
+			ip = value
+		case "loc":
+			if len(value) == 2 && value != "XX" {
+				country = strings.ToUpper(value)
+			}
+		}
+	}
+	return ip, country
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+)
+
+func TestNormalizeProbeDomain(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"netflix.com", "netflix.com", false},
+		{"  https://www.Netflix.com/browse?x=1 ", "www.netflix.com", false},
+		{"chatgpt.com:443", "chatgpt.com", false},
+		{"example.com.", "example.com", false},
+		{"1.1.1.1", "1.1.1.1", false},
+		{"", "", true},
+		{"localhost", "", true},
+		{"not a domain.com", "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeProbeDomain(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("normalizeProbeDomain(%q) error = %v, wantErr %t", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeProbeDomain(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseTrace(t *testing.T) {
+	body := "fl=123\nh=www.cloudflare.com\nip=203.0.113.7\nts=1700000000.1\nloc=nl\ntls=TLSv1.3\n"
+	ip, country := parseTrace(strings.NewReader(body))
+	if ip != "203.0.113.7" || country != "NL" {
+		t.Errorf("Expected 203.0.113.7 and NL, got %q and %q", ip, country)
+	}
+
+	if _, country := parseTrace(strings.NewReader("ip=203.0.113.7\nloc=XX\n")); country != "" {
+		t.Errorf("Expected an unknown location to be left out, got %q", country)
+	}
+}
+
+func TestMeasureConnectivityErrors(t *testing.T) {
+	cfg := &config.Config{Dev: config.Dev{Enabled: true, SandboxDir: t.TempDir()}}
+	sm := NewServerManagerWithCacheDir(cfg, t.TempDir())
+	sm.setServers([]types.Server{{ID: "a", Name: "Server A"}})
+
+	if _, err := sm.MeasureConnectivity(context.Background(), "missing"); !errors.Is(err, types.ErrServerNotFound) {
+		t.Errorf("Expected ErrServerNotFound, got %v", err)
+	}
+	// The temporary xray cannot run in dev mode, the snapshot is not taken
+	snapshot, err := sm.MeasureConnectivity(context.Background(), "a")
+	if err == nil || snapshot.Server.ID != "a" {
+		t.Errorf("Expected an error for server a in dev mode, got %+v, %v", snapshot, err)
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// realityKeyLength is the size of the X25519 public key of a Reality server
+	realityKeyLength = 32
+	// maxShortIDLength is the longest shortId xray accepts, 8 bytes in hex
+	maxShortIDLength = 16
+)
+
+// validateReality checks the Reality parameters of a subscription entry. xray fails
+// to start with a malformed key or shortId, and a server name that is no hostname
+// cannot be used for the Reality handshake. It returns one problem per parameter.
+func validateReality(config VlessConfig) []string {
+	var problems []string
+	if err := validateRealityKey(config.PublicKey); err != nil {
+		problems = append(problems, fmt.Sprintf("public key %v", err))
+	}
+	if err := validateShortID(config.ShortID); err != nil {
+		problems = append(problems, fmt.Sprintf("short ID %v", err))
+	}
+	if err := validateRealitySNI(config.SNI); err != nil {
+		problems = append(problems, fmt.Sprintf("SNI %v", err))
+	}
+	return problems
+}
+
+// validateRealityKey accepts the base64 forms of a 32 byte key, xray generates it
+// as unpadded URL-safe base64
+func validateRealityKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("is missing")
+	}
+	for _, encoding := range []*base64.Encoding{base64.RawURLEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.StdEncoding} {
+		if decoded, err := encoding.DecodeString(key); err == nil {
+			if len(decoded) != realityKeyLength {
+				return fmt.Errorf("has %d bytes instead of %d", len(decoded), realityKeyLength)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("is not valid base64")
+}
+
+// validateShortID accepts an empty shortId or up to 16 hex digits of whole bytes
+func validateShortID(shortID string) error {
+	if shortID == "" {
+		return nil
+	}
+	if len(shortID) > maxShortIDLength {
+		return fmt.Errorf("is longer than %d characters", maxShortIDLength)
+	}
+	if len(shortID)%2 != 0 {
+		return fmt.Errorf("has an odd number of hex digits")
+	}
+	if _, err := hex.DecodeString(shortID); err != nil {
+		return fmt.Errorf("is not hex")
+	}
+	return nil
+}
+
+// validateRealitySNI requires a domain name with a dot, the Reality handshake
+// borrows the certificate of that site
+func validateRealitySNI(sni string) error {
+	if sni == "" {
+		return fmt.Errorf("is missing")
+	}
+	if net.ParseIP(sni) != nil {
+		return fmt.Errorf("is an IP address, not a domain")
+	}
+	if !strings.Contains(sni, ".") || !hostnameRegex.MatchString(sni) {
+		return fmt.Errorf("%q is not a domain name", sni)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"xray-telegram-manager/types"
+)
+
+func TestValidateReality(t *testing.T) {
+	const validKey = "Z84J2IelR9ch3k8VtlVhhs5ycBUlXA7wHBWcBrjqnAw"
+	tests := []struct {
+		name     string
+		config   VlessConfig
+		problems []string
+	}{
+		{"valid", VlessConfig{PublicKey: validKey, ShortID: "6ba85179e30d4fc2", SNI: "www.microsoft.com"}, nil},
+		{"padded standard base64 key", VlessConfig{PublicKey: validKey + "=", SNI: "www.microsoft.com"}, nil},
+		{"missing key and SNI", VlessConfig{}, []string{"public key is missing", "SNI is missing"}},
+		{"short key", VlessConfig{PublicKey: "dGVzdA", SNI: "example.com"}, []string{"public key has 4 bytes"}},
+		{"key not base64", VlessConfig{PublicKey: "not a key!", SNI: "example.com"}, []string{"public key is not valid base64"}},
+		{"short ID not hex", VlessConfig{PublicKey: validKey, ShortID: "testid", SNI: "example.com"}, []string{"short ID is not hex"}},
+		{"short ID odd length", VlessConfig{PublicKey: validKey, ShortID: "abc", SNI: "example.com"}, []string{"short ID has an odd number"}},
+		{"short ID too long", VlessConfig{PublicKey: validKey, ShortID: "0123456789abcdef01", SNI: "example.com"}, []string{"short ID is longer"}},
+		{"SNI is an IP", VlessConfig{PublicKey: validKey, SNI: "1.2.3.4"}, []string{"SNI is an IP address"}},
+		{"SNI without dot", VlessConfig{PublicKey: validKey, SNI: "localhost"}, []string{"SNI \"localhost\" is not a domain name"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := validateReality(tt.config)
+			if len(problems) != len(tt.problems) {
+				t.Fatalf("Expected %d problems, got %q", len(tt.problems), problems)
+			}
+			for i, want := range tt.problems {
+				if !strings.HasPrefix(problems[i], want) {
+					t.Errorf("Expected problem %q, got %q", want, problems[i])
+				}
+			}
+		})
+	}
+}
+
+func TestToXrayOutboundFlagsInvalidReality(t *testing.T) {
+	parser := NewVlessParser()
+	config, err := parser.ParseUrl("vless://12345678-1234-1234-1234-123456789abc@node.example.com:443?type=tcp&security=reality&sni=example.com&pbk=key&sid=ab#Broken")
+	if err != nil {
+		t.Fatalf("ParseUrl failed: %v", err)
+	}
+	server, err := parser.ToXrayOutbound(config)
+	if err != nil {
+		t.Fatalf("ToXrayOutbound failed: %v", err)
+	}
+	if !server.Misconfigured() {
+		t.Fatal("Expected the server with a short key to be misconfigured")
+	}
+
+	sorter := NewServerSorter()
+	healthy := types.Server{ID: "healthy", Name: "Healthy"}
+	results := []types.PingResult{
+		{Server: server, Available: true, Latency: 10},
+		{Server: healthy, Available: true, Latency: 50},
+	}
+	quick := sorter.SortForQuickSelect(results, 5)
+	if len(quick) != 1 || quick[0].Server.ID != "healthy" {
+		t.Errorf("Expected the misconfigured server to be left out of quick select, got %+v", quick)
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	"xray-telegram-manager/fsutil"
+	"xray-telegram-manager/types"
+)
+
+// goldenSuffix names the snapshot of the last config xray ran fine with
+const goldenSuffix = ".golden"
+
+// corruptedSuffix names the copy of a corrupted config kept for inspection after recovery
+const corruptedSuffix = ".corrupted"
+
+// validateXrayConfig checks that data is an xray config with at least one outbound
+func validateXrayConfig(data []byte) error {
+	var config types.XrayConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if len(config.Outbounds) == 0 {
+		return fmt.Errorf("config file has no outbounds")
+	}
+	return nil
+}
+
+// CheckConfig returns an error when the xray config cannot be read or is corrupted
+func (xc *XrayController) CheckConfig() error {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+	data, err := os.ReadFile(xc.config.GetConfigPath())
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	return validateXrayConfig(data)
+}
+
+// SaveGoldenConfig snapshots the current config as known-good. It is called while
+// xray runs fine with it and writes only when the config changed.
+func (xc *XrayController) SaveGoldenConfig() error {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+	configPath := xc.config.GetConfigPath()
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := validateXrayConfig(data); err != nil {
+		return err
+	}
+	if golden, err := os.ReadFile(configPath + goldenSuffix); err == nil && bytes.Equal(golden, data) {
+		return nil
+	}
+	return xc.writeFileAtomicUnsafe(configPath+goldenSuffix, data)
+}
+
+// RecoveryInfo tells which sources the config can be recovered from
+func (xc *XrayController) RecoveryInfo() types.ConfigRecoveryInfo {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+	var info types.ConfigRecoveryInfo
+	if _, modTime, err := xc.latestValidBackupUnsafe(); err == nil {
+		info.BackupTime = modTime
+	}
+	goldenPath := xc.config.GetConfigPath() + goldenSuffix
+	if data, err := os.ReadFile(goldenPath); err == nil && validateXrayConfig(data) == nil {
+		if stat, err := os.Stat(goldenPath); err == nil {
+			info.GoldenTime = stat.ModTime()
+		}
+	}
+	return info
+}
+
+// RecoverConfig replaces a corrupted config with the latest valid backup or the golden
+// snapshot. The replaced file is kept with the .corrupted suffix.
+func (xc *XrayController) RecoverConfig(source string) error {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+	configPath := xc.config.GetConfigPath()
+
+	var sourcePath string
+	switch source {
+	case types.ConfigRecoveryBackup:
+		path, _, err := xc.latestValidBackupUnsafe()
+		if err != nil {
+			return err
+		}
+		sourcePath = path
+	case types.ConfigRecoveryGolden:
+		sourcePath = configPath + goldenSuffix
+	default:
+		return fmt.Errorf("unknown recovery source: %s", source)
+	}
+
+	data, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", sourcePath, err)
+	}
+	if err := validateXrayConfig(data); err != nil {
+		return fmt.Errorf("%s is not a valid config: %w", sourcePath, err)
+	}
+	if current, err := os.ReadFile(configPath); err == nil {
+		if err := fsutil.WritePrivate(configPath+corruptedSuffix, current); err != nil {
+			return fmt.Errorf("failed to keep corrupted config: %w", err)
+		}
+	}
+	if err := xc.writeXrayFileUnsafe(configPath, data, "recovered from "+filepath.Base(sourcePath)); err != nil {
+		return fmt.Errorf("failed to recover config: %w", err)
+	}
+	return nil
+}
+
+// latestValidBackupUnsafe returns the most recent backup of the config that parses
+func (xc *XrayController) latestValidBackupUnsafe() (string, time.Time, error) {
+	matches, err := filepath.Glob(xc.config.GetConfigPath() + ".backup.*")
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to search for backup files: %w", err)
+	}
+
+	type backup struct {
+		path    string
+		modTime time.Time
+	}
+	var backups []backup
+	for _, match := range matches {
+		if stat, err := os.Stat(match); err == nil {
+			backups = append(backups, backup{path: match, modTime: stat.ModTime()})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].modTime.After(backups[j].modTime)
+	})
+	for _, candidate := range backups {
+		data, err := os.ReadFile(candidate.path)
+		if err == nil && validateXrayConfig(data) == nil {
+			return candidate.path, candidate.modTime, nil
+		}
+	}
+	return "", time.Time{}, fmt.Errorf("no valid backup files found")
+}
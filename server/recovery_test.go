@@ -0,0 +1,72 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+)
+
+func TestRecoverCorruptedConfig(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "04_outbounds.json")
+	valid := `{"outbounds": [{"tag": "vless-reality", "protocol": "vless"}]}`
+	if err := os.WriteFile(configPath, []byte(valid), 0644); err != nil {
+		t.Fatal(err)
+	}
+	xc := NewXrayController(&configAdapter{&config.Config{ConfigPath: configPath}})
+
+	if err := xc.CheckConfig(); err != nil {
+		t.Fatalf("Expected valid config, got %v", err)
+	}
+	if err := xc.SaveGoldenConfig(); err != nil {
+		t.Fatalf("SaveGoldenConfig failed: %v", err)
+	}
+
+	// A valid backup followed by a newer corrupted one
+	oldBackup := configPath + ".backup.20240101-000000.1"
+	newBackup := configPath + ".backup.20240102-000000.1"
+	if err := os.WriteFile(oldBackup, []byte(valid), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newBackup, []byte(`{"outbounds": [`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(oldBackup, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(configPath, []byte("\x00\x00garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := xc.CheckConfig(); err == nil {
+		t.Fatal("Expected corrupted config to be detected")
+	}
+
+	info := xc.RecoveryInfo()
+	if info.BackupTime.IsZero() || info.GoldenTime.IsZero() {
+		t.Fatalf("Expected backup and golden config to be available, got %+v", info)
+	}
+
+	if err := xc.RecoverConfig(types.ConfigRecoveryBackup); err != nil {
+		t.Fatalf("RecoverConfig failed: %v", err)
+	}
+	if err := xc.CheckConfig(); err != nil {
+		t.Errorf("Expected recovered config to be valid, got %v", err)
+	}
+	if data, err := os.ReadFile(configPath + corruptedSuffix); err != nil || string(data) != "\x00\x00garbage" {
+		t.Errorf("Expected corrupted config to be kept, got %q (%v)", data, err)
+	}
+
+	if err := os.WriteFile(configPath, []byte(`{"outbounds": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := xc.RecoverConfig(types.ConfigRecoveryGolden); err != nil {
+		t.Fatalf("RecoverConfig from golden failed: %v", err)
+	}
+	if err := xc.CheckConfig(); err != nil {
+		t.Errorf("Expected golden config to be valid, got %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"xray-telegram-manager/clock"
+	"xray-telegram-manager/config"
+)
+
+// dohTimeout bounds one DNS over HTTPS request when the resolver sets no deadline
+const dohTimeout = 10 * time.Second
+
+// maxDNSMessageSize is the largest DNS message, the length prefix is 16 bits
+const maxDNSMessageSize = 65535
+
+// Resolver resolves server domains as configured in dns: through the system, a
+// given DNS server or DNS over HTTPS, and caches the addresses
+type Resolver struct {
+	mode     string
+	ttl      time.Duration
+	resolver *net.Resolver
+	clock    clock.Clock
+	mutex    sync.Mutex
+	cache    map[string]resolvedHost
+}
+
+// resolvedHost are the addresses of a domain, kept after they expired so a pinned
+// address can still be matched to its server
+type resolvedHost struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// NewResolver creates the resolver configured by cfg
+func NewResolver(cfg config.DNS) *Resolver {
+	r := &Resolver{
+		mode:     cfg.Mode,
+		ttl:      cfg.CacheTTL(),
+		resolver: net.DefaultResolver,
+		clock:    clock.Real,
+		cache:    make(map[string]resolvedHost),
+	}
+	switch cfg.Mode {
+	case config.DNSModeUDP:
+		server := cfg.Server
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	case config.DNSModeDoH:
+		client := &http.Client{Timeout: dohTimeout}
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return &dohConn{ctx: ctx, client: client, url: cfg.Server}, nil
+			},
+		}
+	}
+	return r
+}
+
+// SetClock replaces the clock of the cache, for tests
+func (r *Resolver) SetClock(c clock.Clock) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clock = c
+}
+
+// IsSystem reports whether domains are resolved by the system resolver
+func (r *Resolver) IsSystem() bool {
+	return r == nil || r.mode == "" || r.mode == config.DNSModeSystem
+}
+
+// LookupIPAddr returns the addresses of host, from the cache while they are fresh
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host = normalizeHost(host)
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	key := strings.ToLower(host)
+
+	r.mutex.Lock()
+	cached, ok := r.cache[key]
+	now := r.clock.Now()
+	r.mutex.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.addrs, nil
+	}
+	return r.lookup(ctx, host, key)
+}
+
+// Refresh resolves host again regardless of the cache and caches the new addresses
+func (r *Resolver) Refresh(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host = normalizeHost(host)
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	return r.lookup(ctx, host, strings.ToLower(host))
+}
+
+func (r *Resolver) lookup(ctx context.Context, host, key string) ([]net.IPAddr, error) {
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no addresses found", Name: host, IsNotFound: true}
+	}
+	r.mutex.Lock()
+	r.cache[key] = resolvedHost{addrs: addrs, expires: r.clock.Now().Add(r.ttl)}
+	r.mutex.Unlock()
+	return addrs, nil
+}
+
+// LookupPreferred returns the first address of host in the preferred family, see
+// config.IPFamilyAuto
+func (r *Resolver) LookupPreferred(ctx context.Context, host, family string) (net.IP, error) {
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if family == config.IPFamilyAuto || family == "" {
+		return addrs[0].IP, nil
+	}
+	return orderByFamily(addrs, family == config.IPFamilyIPv6)[0], nil
+}
+
+// Resolved reports whether ip was an address of host when it was last resolved
+func (r *Resolver) Resolved(host, ip string) bool {
+	if r == nil {
+		return false
+	}
+	parsed := net.ParseIP(normalizeHost(ip))
+	if parsed == nil {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, addr := range r.cache[strings.ToLower(normalizeHost(host))].addrs {
+		if addr.IP.Equal(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// dohConn carries the DNS messages of net.Resolver over HTTPS (RFC 8484). The
+// resolver frames messages for connections that are not a net.PacketConn like for
+// TCP, with a 2-byte length prefix.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	deadline time.Time
+	request  bytes.Buffer
+	response bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.request.Write(b)
+	for c.request.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.request.Bytes()))
+		if c.request.Len() < 2+size {
+			break
+		}
+		message := append([]byte(nil), c.request.Next(2 + size)[2:]...)
+		answer, err := c.exchange(message)
+		if err != nil {
+			return 0, err
+		}
+		var prefix [2]byte
+		binary.BigEndian.PutUint16(prefix[:], uint16(len(answer)))
+		c.response.Write(prefix[:])
+		c.response.Write(answer)
+	}
+	return len(b), nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.response.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.response.Read(b)
+}
+
+// exchange sends one DNS message and returns the answer
+func (c *dohConn) exchange(message []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DNS over HTTPS request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS server returned HTTP %d", resp.StatusCode)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DNS over HTTPS answer: %w", err)
+	}
+	if len(answer) > maxDNSMessageSize {
+		return nil, fmt.Errorf("DNS over HTTPS answer is too large")
+	}
+	return answer, nil
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr(c.url) }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr(c.url) }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+	"xray-telegram-manager/clock"
+	"xray-telegram-manager/config"
+)
+
+// dnsAnswer answers an A query with ip and any other query with no records
+func dnsAnswer(t *testing.T, query []byte, ip net.IP) []byte {
+	t.Helper()
+	end := 12
+	for query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	question := query[12:end]
+	qtype := binary.BigEndian.Uint16(query[end-4 : end-2])
+
+	answer := make([]byte, 12, 64)
+	copy(answer, query[:2])
+	binary.BigEndian.PutUint16(answer[2:], 0x8180)
+	binary.BigEndian.PutUint16(answer[4:], 1)
+	answer = append(answer, question...)
+	if qtype == 1 {
+		binary.BigEndian.PutUint16(answer[6:], 1)
+		answer = append(answer, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		answer = append(answer, ip.To4()...)
+	}
+	return answer
+}
+
+func TestResolverDoH(t *testing.T) {
+	var requests atomic.Int32
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		requests.Add(1)
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(dnsAnswer(t, query, net.ParseIP("203.0.113.7")))
+	}))
+	defer doh.Close()
+
+	fake := clock.NewFake(time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC))
+	resolver := NewResolver(config.DNS{Mode: config.DNSModeDoH, Server: doh.URL, CacheSeconds: 300})
+	resolver.SetClock(fake)
+
+	ip, err := resolver.LookupPreferred(context.Background(), "vpn.example.com", config.IPFamilyAuto)
+	if err != nil {
+		t.Fatalf("LookupPreferred failed: %v", err)
+	}
+	if ip.String() != "203.0.113.7" {
+		t.Fatalf("Expected the address from the DoH server, got %v", ip)
+	}
+	if !resolver.Resolved("VPN.example.com", "203.0.113.7") || resolver.Resolved("vpn.example.com", "203.0.113.8") {
+		t.Error("Expected Resolved to match the resolved address only")
+	}
+
+	// Fresh addresses come from the cache
+	asked := requests.Load()
+	if _, err := resolver.LookupIPAddr(context.Background(), "vpn.example.com"); err != nil {
+		t.Fatalf("LookupIPAddr failed: %v", err)
+	}
+	if requests.Load() != asked {
+		t.Errorf("Expected a cached lookup, got %d requests instead of %d", requests.Load(), asked)
+	}
+
+	fake.Advance(301 * time.Second)
+	if _, err := resolver.LookupIPAddr(context.Background(), "vpn.example.com"); err != nil {
+		t.Fatalf("LookupIPAddr failed: %v", err)
+	}
+	if requests.Load() == asked {
+		t.Error("Expected expired addresses to be resolved again")
+	}
+}
+
+func TestResolverDoHFailure(t *testing.T) {
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer doh.Close()
+
+	resolver := NewResolver(config.DNS{Mode: config.DNSModeDoH, Server: doh.URL, CacheSeconds: 300})
+	if _, err := resolver.LookupIPAddr(context.Background(), "vpn.example.com"); err == nil {
+		t.Error("Expected an error when the DoH server fails")
+	}
+	if resolver.Resolved("vpn.example.com", "203.0.113.7") {
+		t.Error("Expected failed lookups not to be cached")
+	}
+}
+
+func TestResolverIPLiteral(t *testing.T) {
+	resolver := NewResolver(config.DNS{Mode: config.DNSModeUDP, Server: "192.0.2.53"})
+	addrs, err := resolver.LookupIPAddr(context.Background(), "[2001:db8::1]")
+	if err != nil || len(addrs) != 1 || addrs[0].IP.String() != "2001:db8::1" {
+		t.Errorf("Expected an IP literal to be returned without a lookup, got %v, %v", addrs, err)
+	}
+	if resolver.IsSystem() || !NewResolver(config.DNS{Mode: config.DNSModeSystem}).IsSystem() {
+		t.Error("Expected IsSystem to follow the mode")
+	}
+}
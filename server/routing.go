@@ -0,0 +1,294 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+)
+
+// routingFileName is the routing file of the split configs/ directory
+const routingFileName = "05_routing.json"
+
+// managedRulePrefix marks the routing rules installed by a preset in their ruleTag,
+// rules without it belong to the user and are never changed
+const managedRulePrefix = "xtm-"
+
+// routingTags are the outbound tags the preset rules point to
+type routingTags struct {
+	proxy  string
+	direct string
+	block  string
+}
+
+// routingPreset is a predefined set of routing rules
+type routingPreset struct {
+	id          string
+	name        string
+	description string
+	// Presets removed when this one is installed
+	conflicts []string
+	// Catch-all presets go after the user rules, others before them
+	last  bool
+	rules func(tags routingTags) ([]map[string]interface{}, error)
+}
+
+var routingPresets = []routingPreset{
+	{
+		id:          "block_ads",
+		name:        "Block ads",
+		description: "Drop ad and tracker domains (geosite:category-ads-all)",
+		rules: func(tags routingTags) ([]map[string]interface{}, error) {
+			if tags.block == "" {
+				return nil, fmt.Errorf("no blackhole outbound found to block traffic")
+			}
+			return []map[string]interface{}{
+				{"type": "field", "domain": []string{"geosite:category-ads-all"}, "outboundTag": tags.block},
+			}, nil
+		},
+	},
+	{
+		id:          "bypass_ru",
+		name:        "Bypass RU",
+		description: "Send .ru, .su and .рф domains, Russian and local IPs directly",
+		conflicts:   []string{"proxy_all"},
+		rules: func(tags routingTags) ([]map[string]interface{}, error) {
+			if tags.direct == "" {
+				return nil, fmt.Errorf("no freedom outbound found for direct traffic")
+			}
+			return []map[string]interface{}{
+				{"type": "field", "domain": []string{"domain:ru", "domain:su", "domain:xn--p1ai"}, "outboundTag": tags.direct},
+				{"type": "field", "ip": []string{"geoip:ru", "geoip:private"}, "outboundTag": tags.direct},
+			}, nil
+		},
+	},
+	{
+		id:          "proxy_all",
+		name:        "Proxy all",
+		description: "Send all other traffic through the proxy",
+		conflicts:   []string{"bypass_ru"},
+		last:        true,
+		rules: func(tags routingTags) ([]map[string]interface{}, error) {
+			if tags.proxy == "" {
+				return nil, fmt.Errorf("no proxy outbound found")
+			}
+			return []map[string]interface{}{
+				{"type": "field", "network": "tcp,udp", "outboundTag": tags.proxy},
+			}, nil
+		},
+	},
+}
+
+func findRoutingPreset(id string) (routingPreset, bool) {
+	for _, preset := range routingPresets {
+		if preset.id == id {
+			return preset, true
+		}
+	}
+	return routingPreset{}, false
+}
+
+// routingPathUnsafe returns the file holding the routing section: routing_path when set,
+// config_path for a single config.json, otherwise 05_routing.json next to the outbounds file
+func (xc *XrayController) routingPathUnsafe() string {
+	if path := xc.config.GetRoutingPath(); path != "" {
+		return path
+	}
+	configPath := xc.config.GetConfigPath()
+	layout := xc.config.GetXrayLayout()
+	if layout == "" || layout == config.XrayLayoutAuto {
+		if detected, err := DetectXrayLayout(configPath); err == nil {
+			layout = detected
+		}
+	}
+	if layout == config.XrayLayoutSingle {
+		return configPath
+	}
+	return filepath.Join(filepath.Dir(configPath), routingFileName)
+}
+
+// readRoutingUnsafe returns the top-level sections of the routing file and its routing section
+func (xc *XrayController) readRoutingUnsafe() (string, map[string]json.RawMessage, map[string]interface{}, error) {
+	path := xc.routingPathUnsafe()
+	if _, err := os.Stat(path); err != nil {
+		return path, nil, nil, fmt.Errorf("routing file %s not found, set routing_path to the file with the routing section", path)
+	}
+	sections, err := readConfigSections(path)
+	if err != nil {
+		return path, nil, nil, err
+	}
+	routing := map[string]interface{}{}
+	if raw, ok := sections["routing"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &routing); err != nil {
+			return path, nil, nil, fmt.Errorf("failed to parse routing section: %w", err)
+		}
+	}
+	return path, sections, routing, nil
+}
+
+// GetRoutingPresets returns the routing presets and whether their rules are installed
+func (xc *XrayController) GetRoutingPresets() ([]types.RoutingPresetStatus, error) {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+	_, _, routing, err := xc.readRoutingUnsafe()
+	if err != nil {
+		return nil, err
+	}
+	installed := installedPresets(routingRules(routing))
+	statuses := make([]types.RoutingPresetStatus, 0, len(routingPresets))
+	for _, preset := range routingPresets {
+		statuses = append(statuses, types.RoutingPresetStatus{
+			ID:          preset.id,
+			Name:        preset.name,
+			Description: preset.description,
+			Enabled:     installed[preset.id],
+		})
+	}
+	return statuses, nil
+}
+
+// SetRoutingPreset installs or removes the rules of a preset in the routing file. The
+// file is backed up first so RestoreRouting can undo the change.
+func (xc *XrayController) SetRoutingPreset(id string, enabled bool) error {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+	if _, ok := findRoutingPreset(id); !ok {
+		return fmt.Errorf("unknown routing preset: %s", id)
+	}
+	path, sections, routing, err := xc.readRoutingUnsafe()
+	if err != nil {
+		return err
+	}
+	outbounds, err := xc.getCurrentConfigUnsafe()
+	if err != nil {
+		return fmt.Errorf("failed to read outbounds: %w", err)
+	}
+
+	installed := installedPresets(routingRules(routing))
+	if enabled {
+		preset, _ := findRoutingPreset(id)
+		for _, conflict := range preset.conflicts {
+			delete(installed, conflict)
+		}
+		installed[id] = true
+	} else {
+		delete(installed, id)
+	}
+	if err := applyRoutingPresets(routing, installed, findRoutingTags(outbounds.Outbounds)); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(routing)
+	if err != nil {
+		return fmt.Errorf("failed to marshal routing: %w", err)
+	}
+	sections["routing"] = data
+	content, err := json.MarshalIndent(sections, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal routing file: %w", err)
+	}
+	if err := xc.backupFileUnsafe(path); err != nil {
+		return fmt.Errorf("failed to create routing backup: %w", err)
+	}
+	cause := "routing preset " + id + " disabled"
+	if enabled {
+		cause = "routing preset " + id + " enabled"
+	}
+	return xc.writeXrayFileUnsafe(path, content, cause)
+}
+
+// RestoreRouting writes the most recent backup of the routing file back
+func (xc *XrayController) RestoreRouting() error {
+	xc.mutex.Lock()
+	defer xc.mutex.Unlock()
+	return xc.restoreFileUnsafe(xc.routingPathUnsafe())
+}
+
+// routingRules returns the rules of a routing section
+func routingRules(routing map[string]interface{}) []interface{} {
+	rules, _ := routing["rules"].([]interface{})
+	return rules
+}
+
+// installedPresets returns the presets that have rules in rules
+func installedPresets(rules []interface{}) map[string]bool {
+	installed := map[string]bool{}
+	for _, rule := range rules {
+		if id, ok := presetOfRule(rule); ok {
+			installed[id] = true
+		}
+	}
+	return installed
+}
+
+// presetOfRule returns the preset a rule was installed by
+func presetOfRule(rule interface{}) (string, bool) {
+	fields, ok := rule.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	tag, _ := fields["ruleTag"].(string)
+	if !strings.HasPrefix(tag, managedRulePrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(tag, managedRulePrefix), true
+}
+
+// applyRoutingPresets replaces the preset rules of routing with the rules of the
+// installed presets, keeping the user rules in between
+func applyRoutingPresets(routing map[string]interface{}, installed map[string]bool, tags routingTags) error {
+	var head, user, tail []interface{}
+	for _, rule := range routingRules(routing) {
+		if _, ok := presetOfRule(rule); !ok {
+			user = append(user, rule)
+		}
+	}
+	for _, preset := range routingPresets {
+		if !installed[preset.id] {
+			continue
+		}
+		rules, err := preset.rules(tags)
+		if err != nil {
+			return fmt.Errorf("cannot install %s: %w", preset.name, err)
+		}
+		for _, rule := range rules {
+			rule["ruleTag"] = managedRulePrefix + preset.id
+			if preset.last {
+				tail = append(tail, rule)
+			} else {
+				head = append(head, rule)
+			}
+		}
+	}
+
+	rules := make([]interface{}, 0, len(head)+len(user)+len(tail))
+	rules = append(append(append(rules, head...), user...), tail...)
+	routing["rules"] = rules
+	return nil
+}
+
+// findRoutingTags picks the proxy, direct and block outbound tags from outbounds
+func findRoutingTags(outbounds []types.XrayOutbound) routingTags {
+	var tags routingTags
+	for _, outbound := range outbounds {
+		switch {
+		case outbound.Tag == dialerOutboundTag:
+		case outbound.Protocol == "freedom":
+			if tags.direct == "" {
+				tags.direct = outbound.Tag
+			}
+		case outbound.Protocol == "blackhole":
+			if tags.block == "" {
+				tags.block = outbound.Tag
+			}
+		default:
+			if tags.proxy == "" {
+				tags.proxy = outbound.Tag
+			}
+		}
+	}
+	return tags
+}
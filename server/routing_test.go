@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"xray-telegram-manager/config"
+)
+
+func TestSetRoutingPresetSplitLayout(t *testing.T) {
+	dir := t.TempDir()
+	outboundsPath := filepath.Join(dir, "04_outbounds.json")
+	routingPath := filepath.Join(dir, routingFileName)
+	outbounds := `{"outbounds": [{"tag": "vless-reality", "protocol": "vless"}, {"tag": "direct", "protocol": "freedom"}, {"tag": "block", "protocol": "blackhole"}]}`
+	routing := `{"routing": {"domainStrategy": "IPIfNonMatch", "rules": [{"type": "field", "domain": ["example.com"], "outboundTag": "direct"}]}}`
+	if err := os.WriteFile(outboundsPath, []byte(outbounds), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(routingPath, []byte(routing), 0644); err != nil {
+		t.Fatal(err)
+	}
+	xc := NewXrayController(&configAdapter{&config.Config{ConfigPath: outboundsPath, XrayLayout: config.XrayLayoutAuto}})
+
+	if err := xc.SetRoutingPreset("block_ads", true); err != nil {
+		t.Fatalf("SetRoutingPreset failed: %v", err)
+	}
+	if err := xc.SetRoutingPreset("proxy_all", true); err != nil {
+		t.Fatalf("SetRoutingPreset failed: %v", err)
+	}
+	// bypass_ru replaces the conflicting proxy_all
+	if err := xc.SetRoutingPreset("bypass_ru", true); err != nil {
+		t.Fatalf("SetRoutingPreset failed: %v", err)
+	}
+
+	rules := readRoutingRules(t, routingPath)
+	if len(rules) != 4 {
+		t.Fatalf("Expected 4 rules, got %d: %+v", len(rules), rules)
+	}
+	expectedTags := []string{"xtm-block_ads", "xtm-bypass_ru", "xtm-bypass_ru", ""}
+	for i, tag := range expectedTags {
+		if got, _ := rules[i]["ruleTag"].(string); got != tag {
+			t.Errorf("Rule %d: expected ruleTag %q, got %q", i, tag, got)
+		}
+	}
+	if rules[0]["outboundTag"] != "block" || rules[1]["outboundTag"] != "direct" {
+		t.Errorf("Unexpected outbound tags: %+v", rules)
+	}
+
+	statuses, err := xc.GetRoutingPresets()
+	if err != nil {
+		t.Fatalf("GetRoutingPresets failed: %v", err)
+	}
+	enabled := map[string]bool{}
+	for _, status := range statuses {
+		enabled[status.ID] = status.Enabled
+	}
+	if !enabled["block_ads"] || !enabled["bypass_ru"] || enabled["proxy_all"] {
+		t.Errorf("Unexpected preset statuses: %+v", statuses)
+	}
+
+	if err := xc.SetRoutingPreset("block_ads", false); err != nil {
+		t.Fatalf("SetRoutingPreset failed: %v", err)
+	}
+	if rules := readRoutingRules(t, routingPath); len(rules) != 3 {
+		t.Errorf("Expected block_ads rule to be removed, got %+v", rules)
+	}
+
+	// The previous file is kept as a backup
+	if err := xc.RestoreRouting(); err != nil {
+		t.Fatalf("RestoreRouting failed: %v", err)
+	}
+	if rules := readRoutingRules(t, routingPath); len(rules) != 4 {
+		t.Errorf("Expected routing with block_ads to be restored, got %+v", rules)
+	}
+}
+
+func TestSetRoutingPresetMissingOutbound(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	single := `{"inbounds": [{"tag": "socks", "port": 1080, "protocol": "socks"}], "outbounds": [{"tag": "vless-reality", "protocol": "vless"}], "routing": {"rules": []}}`
+	if err := os.WriteFile(configPath, []byte(single), 0644); err != nil {
+		t.Fatal(err)
+	}
+	xc := NewXrayController(&configAdapter{&config.Config{ConfigPath: configPath, XrayLayout: config.XrayLayoutSingle}})
+
+	if err := xc.SetRoutingPreset("block_ads", true); err == nil {
+		t.Error("Expected an error without a blackhole outbound")
+	}
+	if err := xc.SetRoutingPreset("proxy_all", true); err != nil {
+		t.Fatalf("SetRoutingPreset failed: %v", err)
+	}
+	if rules := readRoutingRules(t, configPath); len(rules) != 1 || rules[0]["outboundTag"] != "vless-reality" {
+		t.Errorf("Expected proxy_all rule in config.json, got %+v", rules)
+	}
+}
+
+func readRoutingRules(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file struct {
+		Routing struct {
+			Rules []map[string]interface{} `json:"rules"`
+		} `json:"routing"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	return file.Routing.Rules
+}
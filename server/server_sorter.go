@@ -3,6 +3,8 @@ package server
 import (
 	"sort"
 	"strings"
+	"time"
+	"xray-telegram-manager/config"
 	"xray-telegram-manager/types"
 )
 
@@ -68,7 +70,8 @@ func (ss *ServerSorter) SortPingResults(results []types.PingResult) []types.Ping
 }
 
 // SortForQuickSelect sorts results for quick select functionality
-// Returns fastest servers up to the specified limit, sorted by speed then alphabetically
+// Returns fastest servers up to the specified limit, sorted by speed then alphabetically.
+// Misconfigured servers and servers in blocked countries are left out.
 func (ss *ServerSorter) SortForQuickSelect(results []types.PingResult, limit int) []types.PingResult {
 	if len(results) == 0 {
 		return results
@@ -77,7 +80,7 @@ func (ss *ServerSorter) SortForQuickSelect(results []types.PingResult, limit int
 	// First, filter only available servers
 	available := make([]types.PingResult, 0)
 	for _, result := range results {
-		if result.Available {
+		if result.Available && !result.Server.Misconfigured() && !result.Server.Blocked() {
 			available = append(available, result)
 		}
 	}
@@ -92,3 +95,61 @@ func (ss *ServerSorter) SortForQuickSelect(results []types.PingResult, limit int
 
 	return sorted
 }
+
+// ScoreForQuickSelect orders available servers by a weighted score of latency, last
+// measured throughput and ping stability. Terms without data are left out of the
+// server's score. Without any throughput data it falls back to SortForQuickSelect.
+func (ss *ServerSorter) ScoreForQuickSelect(results []types.PingResult, limit int, statsOf func(serverID string) ServerStats, weights config.QuickSelectWeights) []types.PingResult {
+	available := make([]types.PingResult, 0)
+	var minLatency time.Duration
+	var maxThroughput float64
+	stats := make(map[string]ServerStats)
+	for _, result := range results {
+		if !result.Available || result.Server.Misconfigured() || result.Server.Blocked() {
+			continue
+		}
+		available = append(available, result)
+		if result.Latency > 0 && (minLatency == 0 || result.Latency < minLatency) {
+			minLatency = result.Latency
+		}
+		serverStats := statsOf(result.Server.ID)
+		stats[result.Server.ID] = serverStats
+		if serverStats.Throughput > maxThroughput {
+			maxThroughput = serverStats.Throughput
+		}
+	}
+	if maxThroughput == 0 {
+		return ss.SortForQuickSelect(results, limit)
+	}
+
+	scores := make(map[string]float64, len(available))
+	for _, result := range available {
+		var score, weightSum float64
+		if result.Latency > 0 {
+			score += weights.Latency * float64(minLatency) / float64(result.Latency)
+			weightSum += weights.Latency
+		}
+		serverStats := stats[result.Server.ID]
+		if serverStats.Throughput > 0 {
+			score += weights.Throughput * serverStats.Throughput / maxThroughput
+			weightSum += weights.Throughput
+		}
+		if stability, ok := serverStats.Stability(); ok {
+			score += weights.Stability * stability
+			weightSum += weights.Stability
+		}
+		if weightSum > 0 {
+			scores[result.Server.ID] = score / weightSum
+		}
+	}
+
+	sorted := ss.SortPingResults(available)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return scores[sorted[i].Server.ID] > scores[sorted[j].Server.ID]
+	})
+
+	if limit > 0 && len(sorted) > limit {
+		return sorted[:limit]
+	}
+	return sorted
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"reflect"
 	"testing"
+	"time"
+	"xray-telegram-manager/config"
 	"xray-telegram-manager/types"
 )
 
@@ -363,6 +365,42 @@ func TestServerSorter_SortForQuickSelect(t *testing.T) {
 	}
 }
 
+func TestServerSorter_ScoreForQuickSelect(t *testing.T) {
+	sorter := NewServerSorter()
+	weights := config.QuickSelectWeights{Latency: 0.5, Throughput: 0.3, Stability: 0.2}
+	results := []types.PingResult{
+		{Server: types.Server{ID: "fast", Name: "Fast"}, Available: true, Latency: 50 * time.Millisecond},
+		{Server: types.Server{ID: "wide", Name: "Wide"}, Available: true, Latency: 60 * time.Millisecond},
+		{Server: types.Server{ID: "down", Name: "Down"}, Available: false},
+	}
+
+	noStats := func(string) ServerStats { return ServerStats{} }
+	sorted := sorter.ScoreForQuickSelect(results, 10, noStats, weights)
+	if len(sorted) != 2 || sorted[0].Server.ID != "fast" {
+		t.Fatalf("Expected latency order without throughput data, got %+v", sorted)
+	}
+
+	stats := map[string]ServerStats{
+		"fast": {Throughput: 100_000},
+		"wide": {Throughput: 2_000_000},
+	}
+	sorted = sorter.ScoreForQuickSelect(results, 10, func(id string) ServerStats { return stats[id] }, weights)
+	if len(sorted) != 2 || sorted[0].Server.ID != "wide" {
+		t.Fatalf("Expected the higher throughput server first, got %+v", sorted)
+	}
+
+	// An unstable server loses its lead
+	unstable := make([]PingSample, 10)
+	for i := range unstable {
+		unstable[i] = PingSample{Available: i < 2}
+	}
+	stats["wide"] = ServerStats{Throughput: 2_000_000, Samples: unstable}
+	sorted = sorter.ScoreForQuickSelect(results, 1, func(id string) ServerStats { return stats[id] }, config.QuickSelectWeights{Latency: 0.4, Throughput: 0.2, Stability: 0.4})
+	if len(sorted) != 1 || sorted[0].Server.ID != "fast" {
+		t.Fatalf("Expected the stable server first, got %+v", sorted)
+	}
+}
+
 func TestServerSorter_Integration(t *testing.T) {
 	sorter := NewServerSorter()
 
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/httpclient"
+	"xray-telegram-manager/types"
+)
+
+// maxSubscriptionResponse bounds the body of a subscription download
+const maxSubscriptionResponse = 10 * 1024 * 1024
+
+// SourceMeta is what a subscription source reports besides the servers
+type SourceMeta struct {
+	// Info is the traffic quota and expiry, nil when the source does not know them
+	Info *types.SubscriptionInfo
+}
+
+// SubscriptionSource delivers the servers of a subscription. Sources are created per
+// subscription URL by the factory registered for its scheme, see RegisterSource.
+type SubscriptionSource interface {
+	Fetch(ctx context.Context) ([]types.Server, SourceMeta, error)
+}
+
+// WatchableSource is a source that can tell cheaply whether its servers changed since
+// the last Fetch, such as a local file. Such sources are checked periodically and the
+// servers are reloaded when they changed.
+type WatchableSource interface {
+	SubscriptionSource
+	Changed() bool
+}
+
+// SourceEnv is handed to source factories
+type SourceEnv struct {
+	Config *config.Config
+	// URL is the parsed subscription_url
+	URL *url.URL
+	// Decode turns a subscription body, base64 with one vless:// link per line, into
+	// servers. Sources getting the usual subscription format use it.
+	Decode func(data string) ([]types.Server, error)
+	// Parse turns vless:// links into servers
+	Parse func(urls []string) ([]types.Server, error)
+}
+
+// SourceFactory creates the source of one subscription URL
+type SourceFactory func(env SourceEnv) (SubscriptionSource, error)
+
+var (
+	sourcesMutex sync.RWMutex
+	sources      = make(map[string]SourceFactory)
+)
+
+func init() {
+	RegisterSource("http", newHTTPSource)
+	RegisterSource("https", newHTTPSource)
+}
+
+// RegisterSource makes subscription URLs with the scheme load through factory. A
+// later registration of the same scheme replaces the earlier one. Sources are meant
+// to be registered from init functions, before the config is loaded.
+func RegisterSource(scheme string, factory SourceFactory) {
+	scheme = strings.ToLower(scheme)
+	sourcesMutex.Lock()
+	sources[scheme] = factory
+	sourcesMutex.Unlock()
+	config.RegisterSubscriptionScheme(scheme)
+}
+
+// SourceSchemes returns the schemes sources are registered for, sorted
+func SourceSchemes() []string {
+	sourcesMutex.RLock()
+	defer sourcesMutex.RUnlock()
+	schemes := make([]string, 0, len(sources))
+	for scheme := range sources {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// NewSource creates the source for the subscription URL of env.Config
+func NewSource(env SourceEnv) (SubscriptionSource, error) {
+	if env.Config.SubscriptionURL == "" {
+		return nil, fmt.Errorf("subscription URL is empty")
+	}
+	parsed, err := url.Parse(env.Config.SubscriptionURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subscription URL: %w", err)
+	}
+	// A plain path is a local file
+	if parsed.Scheme == "" && filepath.IsAbs(env.Config.SubscriptionURL) {
+		parsed = &url.URL{Scheme: "file", Path: env.Config.SubscriptionURL}
+	}
+	sourcesMutex.RLock()
+	factory, ok := sources[strings.ToLower(parsed.Scheme)]
+	sourcesMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no subscription source for scheme %q", parsed.Scheme)
+	}
+	env.URL = parsed
+	return factory(env)
+}
+
+// httpSource downloads the subscription over HTTP(S), the quota comes from the
+// subscription-userinfo header
+type httpSource struct {
+	url    string
+	client *httpclient.Client
+	decode func(data string) ([]types.Server, error)
+}
+
+func newHTTPSource(env SourceEnv) (SubscriptionSource, error) {
+	return &httpSource{
+		url:    env.URL.String(),
+		client: newSubscriptionClient(env.Config),
+		decode: env.Decode,
+	}, nil
+}
+
+func (s *httpSource) Fetch(ctx context.Context) ([]types.Server, SourceMeta, error) {
+	var meta SourceMeta
+	resp, err := s.client.Get(ctx, s.url)
+	if err != nil {
+		return nil, meta, fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			fmt.Printf("Warning: failed to close response body: %v\n", closeErr)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, meta, fmt.Errorf("HTTP request failed with status: %d %s", resp.StatusCode, resp.Status)
+	}
+	if info, ok := ParseSubscriptionUserinfo(resp.Header.Get("Subscription-Userinfo")); ok {
+		meta.Info = info
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSubscriptionResponse))
+	if err != nil {
+		return nil, meta, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if len(body) == 0 {
+		return nil, meta, types.MarkError(types.ErrSubscriptionInvalid, fmt.Errorf("received empty response from subscription URL"))
+	}
+	servers, err := s.decode(string(body))
+	if err != nil {
+		return nil, meta, fmt.Errorf("failed to decode configuration: %w", err)
+	}
+	return servers, meta, nil
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+)
+
+// staticSource returns fixed servers, as a plugin for a made-up scheme would
+type staticSource struct {
+	path string
+}
+
+func (s *staticSource) Fetch(ctx context.Context) ([]types.Server, SourceMeta, error) {
+	servers := []types.Server{{ID: "static", Name: "Static " + s.path, Address: "127.0.0.1", Port: 443}}
+	return servers, SourceMeta{Info: &types.SubscriptionInfo{Total: 1024}}, nil
+}
+
+func TestRegisteredSourceLoadsSubscription(t *testing.T) {
+	RegisterSource("static-test", func(env SourceEnv) (SubscriptionSource, error) {
+		return &staticSource{path: env.URL.Opaque + env.URL.Path}, nil
+	})
+
+	cfg := &config.Config{SubscriptionURL: "static-test:/servers", CacheDuration: 3600}
+	if err := config.ValidateSubscriptionURL(cfg.SubscriptionURL); err != nil {
+		t.Fatalf("Expected the registered scheme to be accepted, got %v", err)
+	}
+	loader := NewSubscriptionLoaderWithCacheDir(cfg, t.TempDir())
+	servers, err := loader.LoadFromURL(context.Background())
+	if err != nil {
+		t.Fatalf("LoadFromURL failed: %v", err)
+	}
+	if len(servers) != 1 || servers[0].Name != "Static /servers" {
+		t.Errorf("Expected the servers of the registered source, got %+v", servers)
+	}
+	if info := loader.GetSubscriptionInfo(); info == nil || info.Total != 1024 {
+		t.Errorf("Expected the quota reported by the source, got %+v", info)
+	}
+
+	found := false
+	for _, scheme := range SourceSchemes() {
+		found = found || scheme == "static-test"
+	}
+	if !found {
+		t.Errorf("Expected static-test among the schemes, got %v", SourceSchemes())
+	}
+}
+
+func TestNewSourceRejectsUnknownScheme(t *testing.T) {
+	_, err := NewSource(SourceEnv{Config: &config.Config{SubscriptionURL: "gopher://example.com/sub"}})
+	if err == nil || !strings.Contains(err.Error(), "gopher") {
+		t.Errorf("Expected an error naming the scheme, got %v", err)
+	}
+	if err := config.ValidateSubscriptionURL("gopher://example.com/sub"); err == nil {
+		t.Error("Expected an unregistered scheme to fail validation")
+	}
+}
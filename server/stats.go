@@ -0,0 +1,275 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"xray-telegram-manager/fsutil"
+	"xray-telegram-manager/types"
+)
+
+// statsFileName is the server statistics file in the cache directory
+const statsFileName = "stats.json"
+
+// availabilityPeriod is how long hourly availability counts are kept
+const availabilityPeriod = 7 * 24 * time.Hour
+
+// PingSample is one recorded ping result of a server
+type PingSample struct {
+	Available bool      `json:"available"`
+	LatencyMs int64     `json:"latency_ms,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// AvailabilityBucket counts the pings of a server in one hour
+type AvailabilityBucket struct {
+	Hour  time.Time `json:"hour"`
+	Up    int       `json:"up"`
+	Total int       `json:"total"`
+	// LatencyMs is the summed latency of the answered pings
+	LatencyMs int64 `json:"latency_ms,omitempty"`
+}
+
+// ServerStats is the measured history of a server
+type ServerStats struct {
+	Samples []PingSample `json:"samples,omitempty"`
+	// Hourly ping counts of the last availabilityPeriod, oldest first
+	Hourly []AvailabilityBucket `json:"hourly,omitempty"`
+	// Throughput is the last measured download speed in bytes per second
+	Throughput   float64   `json:"throughput,omitempty"`
+	ThroughputAt time.Time `json:"throughput_at,omitempty"`
+}
+
+// Stability returns the share of recent pings the server answered, and false when
+// there are too few samples to tell
+func (s ServerStats) Stability() (float64, bool) {
+	if len(s.Samples) < 3 {
+		return 0, false
+	}
+	available := 0
+	for _, sample := range s.Samples {
+		if sample.Available {
+			available++
+		}
+	}
+	return float64(available) / float64(len(s.Samples)), true
+}
+
+// Availability returns the share of pings the server answered in the last day and week
+func (s ServerStats) Availability(now time.Time) types.Availability {
+	return types.Availability{
+		Day:  s.availabilitySince(now.Add(-24 * time.Hour)),
+		Week: s.availabilitySince(now.Add(-availabilityPeriod)),
+	}
+}
+func (s ServerStats) availabilitySince(since time.Time) float64 {
+	up, total := 0, 0
+	for _, bucket := range s.Hourly {
+		if bucket.Hour.Add(time.Hour).After(since) {
+			up += bucket.Up
+			total += bucket.Total
+		}
+	}
+	if total == 0 {
+		return -1
+	}
+	return float64(up) / float64(total)
+}
+
+// DaySummary summarizes the pings of the last day, ok is false when the server was
+// not checked in that day
+func (s ServerStats) DaySummary(now time.Time) (summary types.ServerDigest, ok bool) {
+	since := now.Add(-24 * time.Hour)
+	up, total := 0, 0
+	var latencyMs int64
+	for _, bucket := range s.Hourly {
+		if !bucket.Hour.Add(time.Hour).After(since) {
+			continue
+		}
+		up += bucket.Up
+		total += bucket.Total
+		latencyMs += bucket.LatencyMs
+		if bucket.Total > 0 && bucket.Up == 0 {
+			summary.OutageHours++
+		}
+	}
+	if total == 0 {
+		return summary, false
+	}
+	summary.Availability = float64(up) / float64(total)
+	if up > 0 {
+		summary.AvgLatency = time.Duration(latencyMs/int64(up)) * time.Millisecond
+	}
+	return summary, true
+}
+
+// countAvailability adds a ping to its hourly bucket and drops buckets older than
+// availabilityPeriod. Pings older than the last bucket are counted into their own
+// bucket when it exists and ignored otherwise.
+func countAvailability(buckets []AvailabilityBucket, sample PingSample) []AvailabilityBucket {
+	hour := sample.At.Truncate(time.Hour)
+	index := -1
+	for i := len(buckets) - 1; i >= 0 && !buckets[i].Hour.Before(hour); i-- {
+		if buckets[i].Hour.Equal(hour) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		if len(buckets) > 0 && !hour.After(buckets[len(buckets)-1].Hour) {
+			return buckets
+		}
+		buckets = append(buckets, AvailabilityBucket{Hour: hour})
+		index = len(buckets) - 1
+	}
+	buckets[index].Total++
+	if sample.Available {
+		buckets[index].Up++
+		buckets[index].LatencyMs += sample.LatencyMs
+	}
+
+	cutoff := buckets[len(buckets)-1].Hour.Add(-availabilityPeriod)
+	expired := 0
+	for expired < len(buckets) && !buckets[expired].Hour.After(cutoff) {
+		expired++
+	}
+	if expired > 0 {
+		buckets = append([]AvailabilityBucket(nil), buckets[expired:]...)
+	}
+	return buckets
+}
+
+// StatsStore keeps server statistics keyed by server ID, so they survive
+// subscription refreshes. Statistics of more than maxInMemory servers are not kept
+// in memory between uses, they are read from the file again.
+type StatsStore struct {
+	path        string
+	historySize int
+	maxInMemory int
+	mutex       sync.Mutex
+	data        map[string]ServerStats
+	loaded      bool
+}
+
+// NewStatsStore creates a store backed by path that keeps historySize pings per
+// server. The file is read on first use.
+func NewStatsStore(path string, historySize, maxInMemory int) *StatsStore {
+	return &StatsStore{
+		path:        path,
+		historySize: historySize,
+		maxInMemory: maxInMemory,
+		data:        make(map[string]ServerStats),
+	}
+}
+
+// RecordPings adds ping results to the history of their servers and saves the store
+func (ss *StatsStore) RecordPings(results []types.PingResult) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.loadUnsafe()
+	defer ss.releaseUnsafe()
+	for _, result := range results {
+		stats := ss.data[result.Server.ID]
+		sample := PingSample{Available: result.Available, At: result.TestTime}
+		if sample.At.IsZero() {
+			sample.At = time.Now()
+		}
+		if result.Available {
+			sample.LatencyMs = result.Latency.Milliseconds()
+		}
+		stats.Samples = append(stats.Samples, sample)
+		stats.Hourly = countAvailability(stats.Hourly, sample)
+		if len(stats.Samples) > ss.historySize {
+			stats.Samples = append([]PingSample(nil), stats.Samples[len(stats.Samples)-ss.historySize:]...)
+		}
+		ss.data[result.Server.ID] = stats
+	}
+	return ss.saveUnsafe()
+}
+
+// RecordThroughput stores the measured download speed of a server in bytes per second
+func (ss *StatsStore) RecordThroughput(serverID string, bytesPerSecond float64) error {
+	if bytesPerSecond <= 0 {
+		return fmt.Errorf("throughput must be positive")
+	}
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.loadUnsafe()
+	defer ss.releaseUnsafe()
+	stats := ss.data[serverID]
+	stats.Throughput = bytesPerSecond
+	stats.ThroughputAt = time.Now()
+	ss.data[serverID] = stats
+	return ss.saveUnsafe()
+}
+
+// Get returns the statistics of a server
+func (ss *StatsStore) Get(serverID string) ServerStats {
+	return ss.Lookup([]string{serverID})[serverID]
+}
+
+// Lookup returns the statistics of several servers, reading the file at most once
+func (ss *StatsStore) Lookup(serverIDs []string) map[string]ServerStats {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.loadUnsafe()
+	defer ss.releaseUnsafe()
+	found := make(map[string]ServerStats, len(serverIDs))
+	for _, id := range serverIDs {
+		if stats, ok := ss.data[id]; ok {
+			found[id] = stats
+		}
+	}
+	return found
+}
+
+// Reload drops the statistics held in memory, they are read from the file on next use
+func (ss *StatsStore) Reload() {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.data = nil
+	ss.loaded = false
+}
+
+// loadUnsafe reads the statistics file once. A missing or broken file gives no statistics.
+func (ss *StatsStore) loadUnsafe() {
+	if ss.loaded {
+		return
+	}
+	ss.loaded = true
+	ss.data = make(map[string]ServerStats)
+	data, err := os.ReadFile(ss.path)
+	if err != nil {
+		return
+	}
+	var stored map[string]ServerStats
+	if err := json.Unmarshal(data, &stored); err != nil || stored == nil {
+		return
+	}
+	ss.data = stored
+}
+
+// releaseUnsafe drops statistics of too many servers from memory, they are
+// read from the file on next use
+func (ss *StatsStore) releaseUnsafe() {
+	if len(ss.data) > ss.maxInMemory {
+		ss.data = nil
+		ss.loaded = false
+	}
+}
+func (ss *StatsStore) saveUnsafe() error {
+	data, err := json.Marshal(ss.data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal server stats: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(ss.path), 0755); err != nil {
+		return fmt.Errorf("failed to create stats directory: %w", err)
+	}
+	if err := fsutil.WriteShared(ss.path, data); err != nil {
+		return fmt.Errorf("failed to save server stats: %w", err)
+	}
+	return nil
+}
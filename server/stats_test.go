@@ -0,0 +1,149 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"xray-telegram-manager/types"
+)
+
+func TestStatsStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), statsFileName)
+	const historySize = 20
+	store := NewStatsStore(path, historySize, 1)
+	server := types.Server{ID: "a"}
+
+	for i := 0; i < historySize+5; i++ {
+		results := []types.PingResult{{Server: server, Available: i%5 != 0, Latency: 40 * time.Millisecond, TestTime: time.Now()}}
+		if err := store.RecordPings(results); err != nil {
+			t.Fatalf("RecordPings failed: %v", err)
+		}
+	}
+	if err := store.RecordThroughput("a", 0); err == nil {
+		t.Error("Expected an error for zero throughput")
+	}
+	if err := store.RecordThroughput("a", 1_500_000); err != nil {
+		t.Fatalf("RecordThroughput failed: %v", err)
+	}
+
+	// A new store reads what the first one saved
+	stats := NewStatsStore(path, historySize, 1).Get("a")
+	if len(stats.Samples) != historySize {
+		t.Errorf("Expected %d samples, got %d", historySize, len(stats.Samples))
+	}
+	if stats.Throughput != 1_500_000 {
+		t.Errorf("Expected throughput 1500000, got %v", stats.Throughput)
+	}
+	if stability, ok := stats.Stability(); !ok || stability != 0.8 {
+		t.Errorf("Expected stability 0.8, got %v (%v)", stability, ok)
+	}
+	if _, ok := NewStatsStore(path, historySize, 1).Get("missing").Stability(); ok {
+		t.Error("Expected no stability without samples")
+	}
+}
+
+func TestStatsStoreReleasesLargeData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), statsFileName)
+	store := NewStatsStore(path, 5, 1)
+	results := []types.PingResult{
+		{Server: types.Server{ID: "a"}, Available: true, Latency: 10 * time.Millisecond},
+		{Server: types.Server{ID: "b"}, Available: false},
+	}
+	if err := store.RecordPings(results); err != nil {
+		t.Fatalf("RecordPings failed: %v", err)
+	}
+	if store.data != nil {
+		t.Error("Expected statistics of more servers than the limit to be released from memory")
+	}
+
+	found := store.Lookup([]string{"a", "b", "c"})
+	if len(found) != 2 || found["a"].Samples[0].LatencyMs != 10 {
+		t.Errorf("Expected statistics to be read back from disk, got %+v", found)
+	}
+}
+
+func TestStatsStoreAvailability(t *testing.T) {
+	store := NewStatsStore(filepath.Join(t.TempDir(), statsFileName), 5, 10)
+	server := types.Server{ID: "a"}
+	now := time.Now().Truncate(time.Hour).Add(30 * time.Minute)
+
+	record := func(at time.Time, available bool) {
+		t.Helper()
+		if err := store.RecordPings([]types.PingResult{{Server: server, Available: available, TestTime: at}}); err != nil {
+			t.Fatalf("RecordPings failed: %v", err)
+		}
+	}
+	// Older than the week, dropped once newer pings arrive
+	record(now.Add(-9*24*time.Hour), false)
+	// Three days ago: 1 of 2 up
+	record(now.Add(-72*time.Hour), true)
+	record(now.Add(-72*time.Hour), false)
+	// Last day: 3 of 3 up, more than the ping history keeps
+	for i := 3; i > 0; i-- {
+		record(now.Add(-time.Duration(i)*time.Hour), true)
+	}
+
+	stats := store.Get("a")
+	if len(stats.Hourly) != 4 {
+		t.Fatalf("Expected 4 hourly buckets, got %+v", stats.Hourly)
+	}
+	availability := stats.Availability(now)
+	if availability.Day != 1 || availability.Week != 0.8 {
+		t.Errorf("Expected 100%% for the day and 80%% for the week, got %+v", availability)
+	}
+	if unknown := (ServerStats{}).Availability(now); unknown.Known() || unknown.Day != -1 {
+		t.Errorf("Expected unknown availability without pings, got %+v", unknown)
+	}
+}
+
+func TestServerStatsDaySummary(t *testing.T) {
+	now := time.Now().Truncate(time.Hour).Add(30 * time.Minute)
+	stats := ServerStats{Hourly: []AvailabilityBucket{
+		// Older than a day, not counted
+		{Hour: now.Add(-48 * time.Hour).Truncate(time.Hour), Up: 0, Total: 4},
+		{Hour: now.Add(-3 * time.Hour).Truncate(time.Hour), Up: 2, Total: 2, LatencyMs: 100},
+		{Hour: now.Add(-2 * time.Hour).Truncate(time.Hour), Up: 0, Total: 2},
+		{Hour: now.Truncate(time.Hour), Up: 1, Total: 1, LatencyMs: 80},
+	}}
+
+	summary, ok := stats.DaySummary(now)
+	if !ok {
+		t.Fatal("Expected a summary for a checked server")
+	}
+	if summary.Availability != 0.6 || summary.AvgLatency != 60*time.Millisecond || summary.OutageHours != 1 {
+		t.Errorf("Expected 60%% availability, 60ms and 1 outage hour, got %+v", summary)
+	}
+	if _, ok := (ServerStats{}).DaySummary(now); ok {
+		t.Error("Expected no summary without pings")
+	}
+}
+
+func TestReloadStateReadsRestoredFiles(t *testing.T) {
+	dir := t.TempDir()
+	overrides := NewManualOverrides(filepath.Join(dir, overridesFileName))
+	stats := NewStatsStore(filepath.Join(dir, statsFileName), 20, 10)
+	sm := &ServerManager{overrides: overrides, stats: stats}
+	if _, err := overrides.ToggleFavorite("a"); err != nil {
+		t.Fatalf("ToggleFavorite failed: %v", err)
+	}
+	if err := stats.RecordPings([]types.PingResult{{Server: types.Server{ID: "a"}, Available: true, TestTime: time.Now()}}); err != nil {
+		t.Fatalf("RecordPings failed: %v", err)
+	}
+
+	// A restore replaces the files while both stores hold them in memory
+	if err := os.WriteFile(sm.GetOverridesFile(), []byte(`{"favorites":["b"],"notes":{"b":"restored"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sm.GetStatsFile(), []byte(`{"b":{"samples":[{"available":true,"latency_ms":42}]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sm.ReloadState()
+
+	if favorites := overrides.GetFavorites(); len(favorites) != 1 || favorites[0] != "b" || overrides.GetNote("b") != "restored" {
+		t.Errorf("Expected the restored overrides, got favorites %v", overrides.GetFavorites())
+	}
+	if len(stats.Get("a").Samples) != 0 || len(stats.Get("b").Samples) != 1 {
+		t.Error("Expected the restored statistics")
+	}
+}
@@ -1,185 +1,266 @@
 package server
 
 import (
+	"bufio"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net"
-	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"xray-telegram-manager/clock"
 	"xray-telegram-manager/config"
+	"xray-telegram-manager/fsutil"
+	"xray-telegram-manager/httpclient"
 	"xray-telegram-manager/types"
 )
 
 // SubscriptionLoader interface for loading servers from subscription
 type SubscriptionLoader interface {
-	LoadFromURL() ([]types.Server, error)
+	LoadFromURL(ctx context.Context) ([]types.Server, error)
 	InvalidateCache()
+	GetCacheFile() string
+	GetSubscriptionInfo() *types.SubscriptionInfo
 }
 
+// parallelParseThreshold is the number of entries from which parsing is split
+// between goroutines. Smaller lists are not worth the scheduling.
+const parallelParseThreshold = 128
+
+// subscriptionRetries is how often a failed subscription request is repeated
+const subscriptionRetries = 2
+
+// parseBatchSize is how many decoded entries are collected before they are parsed
+const parseBatchSize = 512
+
+// maxSubscriptionLineLength bounds one decoded subscription line
+const maxSubscriptionLineLength = 1024 * 1024
+
 type SubscriptionLoaderImpl struct {
 	config     *config.Config
-	httpClient *http.Client
 	cache      []types.Server
 	lastUpdate time.Time
 	mutex      sync.RWMutex
 	parser     *VlessParser
 	cacheFile  string
+	info       *types.SubscriptionInfo
+	// source is created from the subscription URL on the first load
+	source    SubscriptionSource
+	sourceURL string
+	// clock dates loads for the cache duration and the subscription info
+	clock clock.Clock
 }
 
 func NewSubscriptionLoader(cfg *config.Config) *SubscriptionLoaderImpl {
-	httpClient := &http.Client{
-		Timeout: time.Duration(cfg.PingTimeout) * time.Second,
-		Transport: &http.Transport{
-			DisableKeepAlives: true,
-			DialContext: (&net.Dialer{
-				Timeout: 10 * time.Second,
-			}).DialContext,
-			TLSHandshakeTimeout:   10 * time.Second,
-			MaxIdleConns:          10,
-			MaxIdleConnsPerHost:   2,
-			ResponseHeaderTimeout: 15 * time.Second,
-		},
-	}
 	return &SubscriptionLoaderImpl{
-		config:     cfg,
-		httpClient: httpClient,
-		parser:     NewVlessParser(),
-		cacheFile:  "/opt/etc/xray-manager/cache/servers.json",
+		config:    cfg,
+		parser:    NewVlessParser(),
+		cacheFile: "/opt/etc/xray-manager/cache/servers.json",
+		clock:     clock.Real,
 	}
 }
 func NewSubscriptionLoaderWithCacheDir(cfg *config.Config, cacheDir string) *SubscriptionLoaderImpl {
-	httpClient := &http.Client{
+	return &SubscriptionLoaderImpl{
+		config:    cfg,
+		parser:    NewVlessParser(),
+		cacheFile: filepath.Join(cacheDir, "servers.json"),
+		clock:     clock.Real,
+	}
+}
+
+// SetClock replaces the clock dating loads, for tests. Advancing a fake clock past
+// cache_duration makes the next load fetch the subscription again.
+func (sl *SubscriptionLoaderImpl) SetClock(c clock.Clock) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	sl.clock = c
+}
+
+// SetServerIDFunc makes loaded servers get their ID from fn instead of their address
+// and port, for tests, see VlessParser.SetServerIDFunc
+func (sl *SubscriptionLoaderImpl) SetServerIDFunc(fn ServerIDFunc) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	sl.parser.SetServerIDFunc(fn)
+}
+
+// newSubscriptionClient creates the client fetching the subscription, through the
+// configured proxy if any
+func newSubscriptionClient(cfg *config.Config) *httpclient.Client {
+	opts := httpclient.Options{
 		Timeout: time.Duration(cfg.PingTimeout) * time.Second,
-		Transport: &http.Transport{
-			DisableKeepAlives: true,
-			DialContext: (&net.Dialer{
-				Timeout: 10 * time.Second,
-			}).DialContext,
-			TLSHandshakeTimeout:   10 * time.Second,
-			MaxIdleConns:          10,
-			MaxIdleConnsPerHost:   2,
-			ResponseHeaderTimeout: 15 * time.Second,
-		},
+		Retries: subscriptionRetries,
+		Proxy:   cfg.HTTPProxy,
 	}
-	return &SubscriptionLoaderImpl{
-		config:     cfg,
-		httpClient: httpClient,
-		parser:     NewVlessParser(),
-		cacheFile:  filepath.Join(cacheDir, "servers.json"),
+	client, err := httpclient.New("subscription", opts)
+	if err != nil {
+		fmt.Printf("Warning: %v, fetching the subscription without proxy\n", err)
+		opts.Proxy = ""
+		client, _ = httpclient.New("subscription", opts)
 	}
+	return client
 }
-func (sl *SubscriptionLoaderImpl) LoadFromURL() ([]types.Server, error) {
+
+// LoadFromURL fetches and parses the subscription through the source registered for
+// the scheme of subscription_url, falling back to the cache file when it cannot be
+// fetched. Failed requests are retried by the HTTP client.
+func (sl *SubscriptionLoaderImpl) LoadFromURL(ctx context.Context) ([]types.Server, error) {
 	sl.mutex.Lock()
 	defer sl.mutex.Unlock()
 	if sl.isCacheValid() && len(sl.cache) > 0 {
 		return sl.cache, nil
 	}
-	var data string
-	var err error
-	maxRetries := 3
-	for i := 0; i < maxRetries; i++ {
-		data, err = sl.fetchFromURL()
-		if err == nil {
-			break
-		}
-		if i < maxRetries-1 {
-			time.Sleep(time.Duration(i+1) * time.Second) // Exponential backoff
-		}
-	}
+	servers, err := sl.fetchFromSource(ctx)
 	if err != nil {
 		if cachedServers, cacheErr := sl.loadFromCacheFile(); cacheErr == nil {
 			sl.cache = cachedServers
 			return cachedServers, nil
 		}
-		return nil, fmt.Errorf("failed to fetch from URL after %d retries and no valid cache: %w", maxRetries, err)
-	}
-	servers, err := sl.DecodeBase64Config(data)
-	if err != nil {
-		if cachedServers, cacheErr := sl.loadFromCacheFile(); cacheErr == nil {
-			sl.cache = cachedServers
-			return cachedServers, nil
+		err = fmt.Errorf("failed to fetch from URL after %d retries and no valid cache: %w", subscriptionRetries, err)
+		if errors.Is(err, types.ErrSubscriptionInvalid) {
+			return nil, err
 		}
-		return nil, fmt.Errorf("failed to decode configuration: %w", err)
+		return nil, types.MarkError(types.ErrSubscriptionUnreachable, err)
 	}
 	sl.cache = servers
-	sl.lastUpdate = time.Now()
+	sl.lastUpdate = sl.clock.Now()
 	if err := sl.saveToCacheFile(servers); err != nil {
 		fmt.Printf("Warning: failed to save cache file: %v\n", err)
 	}
 	return servers, nil
 }
-func (sl *SubscriptionLoaderImpl) fetchFromURL() (string, error) {
-	if sl.config.SubscriptionURL == "" {
-		return "", fmt.Errorf("subscription URL is empty")
-	}
-	resp, err := sl.httpClient.Get(sl.config.SubscriptionURL)
-	if err != nil {
-		return "", fmt.Errorf("HTTP request failed: %w", err)
-	}
-	defer func() {
-		if closeErr := resp.Body.Close(); closeErr != nil {
-			fmt.Printf("Warning: failed to close response body: %v\n", closeErr)
+
+// fetchFromSource loads the servers from the source of the subscription URL. The
+// source is created again when the URL changed.
+func (sl *SubscriptionLoaderImpl) fetchFromSource(ctx context.Context) ([]types.Server, error) {
+	if sl.source == nil || sl.sourceURL != sl.config.SubscriptionURL {
+		source, err := NewSource(SourceEnv{Config: sl.config, Decode: sl.DecodeBase64Config, Parse: sl.ParseVlessUrls})
+		if err != nil {
+			return nil, err
 		}
-	}()
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("HTTP request failed with status: %d %s", resp.StatusCode, resp.Status)
-	}
-	const maxResponseSize = 10 * 1024 * 1024 // 10MB
-	limitedReader := io.LimitReader(resp.Body, maxResponseSize)
-	body, err := io.ReadAll(limitedReader)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %w", err)
+		sl.source = source
+		sl.sourceURL = sl.config.SubscriptionURL
 	}
-	if len(body) == 0 {
-		return "", fmt.Errorf("received empty response from subscription URL")
+	servers, meta, err := sl.source.Fetch(ctx)
+	if meta.Info != nil {
+		meta.Info.UpdatedAt = sl.clock.Now()
+		sl.info = meta.Info
+		if err := sl.saveSubscriptionInfo(meta.Info); err != nil {
+			fmt.Printf("Warning: failed to save subscription info: %v\n", err)
+		}
 	}
-	return string(body), nil
+	return servers, err
 }
+
+// DecodeBase64Config decodes a subscription line by line and parses the entries in
+// batches, so neither the decoded text nor all raw entries are held in memory at once
 func (sl *SubscriptionLoaderImpl) DecodeBase64Config(data string) ([]types.Server, error) {
 	data = strings.TrimSpace(data)
-	decoded, err := base64.StdEncoding.DecodeString(data)
-	if err != nil {
-		decoded, err = base64.URLEncoding.DecodeString(data)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode base64 data: %w", err)
-		}
+	encoding := base64.StdEncoding
+	if strings.ContainsAny(data, "-_") {
+		encoding = base64.URLEncoding
+	}
+	scanner := bufio.NewScanner(base64.NewDecoder(encoding, strings.NewReader(data)))
+	scanner.Buffer(make([]byte, 0, 4096), maxSubscriptionLineLength)
+
+	var servers []types.Server
+	var errors []string
+	batch := make([]string, 0, parseBatchSize)
+	entries := 0
+	flush := func() {
+		parsed, parseErrors := sl.parseBatch(batch, entries-len(batch))
+		servers = append(servers, parsed...)
+		errors = append(errors, parseErrors...)
+		batch = batch[:0]
 	}
-	lines := strings.Split(string(decoded), "\n")
-	var vlessUrls []string
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "vless://") {
-			vlessUrls = append(vlessUrls, line)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "vless://") {
+			continue
+		}
+		batch = append(batch, line)
+		entries++
+		if len(batch) == parseBatchSize {
+			flush()
 		}
 	}
-	if len(vlessUrls) == 0 {
-		return nil, fmt.Errorf("no VLESS URLs found in decoded data")
+	if err := scanner.Err(); err != nil {
+		return nil, types.MarkError(types.ErrSubscriptionInvalid, fmt.Errorf("failed to decode base64 data: %w", err))
+	}
+	if entries == 0 {
+		return nil, types.MarkError(types.ErrSubscriptionInvalid, fmt.Errorf("no VLESS URLs found in decoded data"))
 	}
-	return sl.ParseVlessUrls(vlessUrls)
+	flush()
+	return parsedServers(servers, errors)
 }
+
+// ParseVlessUrls parses subscription entries, spreading large lists over all CPUs.
+// The order of the entries is kept.
 func (sl *SubscriptionLoaderImpl) ParseVlessUrls(urls []string) ([]types.Server, error) {
-	var servers []types.Server
+	servers, errors := sl.parseBatch(urls, 0)
+	return parsedServers(servers, errors)
+}
+
+// parseBatch parses entries in parallel when there are enough of them. Errors name
+// the entries by their position in the subscription, offset is the position of the
+// first entry of the batch.
+func (sl *SubscriptionLoaderImpl) parseBatch(urls []string, offset int) ([]types.Server, []string) {
+	parsed := make([]types.Server, len(urls))
+	parseErrors := make([]error, len(urls))
+	parseRange := func(from, to int) {
+		for i := from; i < to; i++ {
+			parsed[i], parseErrors[i] = sl.ParseVlessUrl(urls[i])
+		}
+	}
+
+	workers := runtime.NumCPU()
+	if len(urls) < parallelParseThreshold || workers < 2 {
+		parseRange(0, len(urls))
+	} else {
+		chunk := (len(urls) + workers - 1) / workers
+		var wg sync.WaitGroup
+		for from := 0; from < len(urls); from += chunk {
+			to := min(from+chunk, len(urls))
+			wg.Add(1)
+			go func(from, to int) {
+				defer wg.Done()
+				parseRange(from, to)
+			}(from, to)
+		}
+		wg.Wait()
+	}
+
+	servers := make([]types.Server, 0, len(urls))
 	var errors []string
-	for i, vlessUrl := range urls {
-		server, err := sl.ParseVlessUrl(vlessUrl)
+	for i, err := range parseErrors {
 		if err != nil {
-			errors = append(errors, fmt.Sprintf("URL %d: %v", i+1, err))
+			errors = append(errors, fmt.Sprintf("URL %d: %v", offset+i+1, err))
 			continue
 		}
-		servers = append(servers, server)
+		servers = append(servers, parsed[i])
 	}
+	return servers, errors
+}
+
+// parsedServers reports the parse errors, it fails only when nothing could be parsed
+func parsedServers(servers []types.Server, errors []string) ([]types.Server, error) {
 	if len(servers) == 0 {
-		return nil, fmt.Errorf("failed to parse any VLESS URLs: %s", strings.Join(errors, "; "))
+		return nil, types.MarkError(types.ErrSubscriptionInvalid, fmt.Errorf("failed to parse any VLESS URLs: %s", strings.Join(errors, "; ")))
 	}
 	if len(errors) > 0 {
 		fmt.Printf("Warning: some VLESS URLs failed to parse: %s\n", strings.Join(errors, "; "))
 	}
+	for _, server := range servers {
+		if server.Misconfigured() {
+			fmt.Printf("Warning: server %s is misconfigured: %s\n", server.Name, strings.Join(server.Problems, "; "))
+		}
+	}
 	return servers, nil
 }
 func (sl *SubscriptionLoaderImpl) ParseVlessUrl(vlessUrl string) (types.Server, error) {
@@ -191,7 +272,9 @@ func (sl *SubscriptionLoaderImpl) ParseVlessUrl(vlessUrl string) (types.Server,
 	if err != nil {
 		return types.Server{}, fmt.Errorf("failed to convert to xray outbound: %w", err)
 	}
-	server.VlessUrl = vlessUrl
+	if sl.config.Memory.KeepVlessURLs {
+		server.VlessUrl = vlessUrl
+	}
 	return server, nil
 }
 func (sl *SubscriptionLoaderImpl) GetCachedServers() []types.Server {
@@ -206,7 +289,7 @@ func (sl *SubscriptionLoaderImpl) isCacheValid() bool {
 		return false
 	}
 	cacheDuration := time.Duration(sl.config.CacheDuration) * time.Second
-	return time.Since(sl.lastUpdate) < cacheDuration
+	return sl.clock.Since(sl.lastUpdate) < cacheDuration
 }
 func (sl *SubscriptionLoaderImpl) saveToCacheFile(servers []types.Server) error {
 	cacheDir := filepath.Dir(sl.cacheFile)
@@ -217,7 +300,8 @@ func (sl *SubscriptionLoaderImpl) saveToCacheFile(servers []types.Server) error
 	if err != nil {
 		return fmt.Errorf("failed to marshal servers: %w", err)
 	}
-	if err := os.WriteFile(sl.cacheFile, data, 0644); err != nil {
+	// The servers carry their keys, other users must not read them
+	if err := fsutil.WritePrivate(sl.cacheFile, data); err != nil {
 		return fmt.Errorf("failed to write cache file: %w", err)
 	}
 	return nil
@@ -233,6 +317,98 @@ func (sl *SubscriptionLoaderImpl) loadFromCacheFile() ([]types.Server, error) {
 	}
 	return servers, nil
 }
+
+// GetCacheFile returns the path of the on-disk servers cache
+func (sl *SubscriptionLoaderImpl) GetCacheFile() string {
+	return sl.cacheFile
+}
+
+// GetSubscriptionInfo returns the quota reported with the last subscription download,
+// or nil when the provider does not send it
+func (sl *SubscriptionLoaderImpl) GetSubscriptionInfo() *types.SubscriptionInfo {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	if sl.info == nil {
+		// Survive restarts while the subscription is served from cache
+		if data, err := os.ReadFile(sl.subscriptionInfoFile()); err == nil {
+			var info types.SubscriptionInfo
+			if json.Unmarshal(data, &info) == nil {
+				sl.info = &info
+			}
+		}
+	}
+	if sl.info == nil {
+		return nil
+	}
+	info := *sl.info
+	return &info
+}
+func (sl *SubscriptionLoaderImpl) subscriptionInfoFile() string {
+	return filepath.Join(filepath.Dir(sl.cacheFile), "subscription_info.json")
+}
+func (sl *SubscriptionLoaderImpl) saveSubscriptionInfo(info *types.SubscriptionInfo) error {
+	if err := os.MkdirAll(filepath.Dir(sl.cacheFile), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal subscription info: %w", err)
+	}
+	return fsutil.WriteShared(sl.subscriptionInfoFile(), data)
+}
+
+// ParseSubscriptionUserinfo parses a subscription-userinfo header such as
+// "upload=455727941; download=6174315083; total=1073741824000; expire=1671815872"
+func ParseSubscriptionUserinfo(header string) (*types.SubscriptionInfo, bool) {
+	if strings.TrimSpace(header) == "" {
+		return nil, false
+	}
+	info := &types.SubscriptionInfo{UpdatedAt: time.Now()}
+	found := false
+	for _, part := range strings.Split(header, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		// Some providers send fractional values
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || number < 0 {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "upload":
+			info.Upload = int64(number)
+		case "download":
+			info.Download = int64(number)
+		case "total":
+			info.Total = int64(number)
+		case "expire":
+			info.Expire = int64(number)
+		default:
+			continue
+		}
+		found = true
+	}
+	return info, found
+}
+
+// Watchable reports whether the source of the subscription can tell when it changed,
+// it is known after the first load
+func (sl *SubscriptionLoaderImpl) Watchable() bool {
+	sl.mutex.RLock()
+	defer sl.mutex.RUnlock()
+	_, ok := sl.source.(WatchableSource)
+	return ok
+}
+
+// SourceChanged reports whether a watchable source has other servers than it
+// delivered on the last load
+func (sl *SubscriptionLoaderImpl) SourceChanged() bool {
+	sl.mutex.RLock()
+	source, ok := sl.source.(WatchableSource)
+	sl.mutex.RUnlock()
+	return ok && source.Changed()
+}
 func (sl *SubscriptionLoaderImpl) InvalidateCache() {
 	sl.mutex.Lock()
 	defer sl.mutex.Unlock()
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -8,6 +10,7 @@ import (
 	"testing"
 	"time"
 	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
 )
 
 func TestSubscriptionLoader_RetryLogic(t *testing.T) {
@@ -39,7 +42,7 @@ func TestSubscriptionLoader_RetryLogic(t *testing.T) {
 	loader.cacheFile = cacheFile
 
 	// Should succeed after retries
-	servers, err := loader.LoadFromURL()
+	servers, err := loader.LoadFromURL(context.Background())
 	if err != nil {
 		t.Fatalf("LoadFromURL should succeed after retries: %v", err)
 	}
@@ -79,7 +82,7 @@ func TestSubscriptionLoader_MaxRetriesExceeded(t *testing.T) {
 	loader.cacheFile = cacheFile
 
 	// Should fallback to cache after max retries
-	servers, err := loader.LoadFromURL()
+	servers, err := loader.LoadFromURL(context.Background())
 	if err != nil {
 		t.Fatalf("LoadFromURL should succeed with cache fallback: %v", err)
 	}
@@ -112,7 +115,7 @@ func TestSubscriptionLoader_NetworkErrorWithoutCache(t *testing.T) {
 	loader.cacheFile = cacheFile
 
 	// Should fail when no cache is available
-	_, err := loader.LoadFromURL()
+	_, err := loader.LoadFromURL(context.Background())
 	if err == nil {
 		t.Fatal("LoadFromURL should fail when no cache is available")
 	}
@@ -124,6 +127,29 @@ func TestSubscriptionLoader_NetworkErrorWithoutCache(t *testing.T) {
 			t.Errorf("Error message should contain '%s', got: %s", substr, err.Error())
 		}
 	}
+	if !errors.Is(err, types.ErrSubscriptionUnreachable) || errors.Is(err, types.ErrSubscriptionInvalid) {
+		t.Errorf("Expected an unreachable subscription, got %v", err)
+	}
+}
+
+func TestSubscriptionLoader_InvalidSubscriptionWithoutCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("bm90IGEgc3Vic2NyaXB0aW9u")) // "not a subscription"
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{
+		SubscriptionURL: server.URL,
+		CacheDuration:   3600,
+		PingTimeout:     1,
+	}
+	loader := NewSubscriptionLoader(cfg)
+	loader.cacheFile = filepath.Join(t.TempDir(), "servers.json")
+
+	_, err := loader.LoadFromURL(context.Background())
+	if !errors.Is(err, types.ErrSubscriptionInvalid) || errors.Is(err, types.ErrSubscriptionUnreachable) {
+		t.Errorf("Expected an invalid subscription, got %v", err)
+	}
 }
 
 func TestSubscriptionLoader_InvalidBase64WithCache(t *testing.T) {
@@ -153,7 +179,7 @@ func TestSubscriptionLoader_InvalidBase64WithCache(t *testing.T) {
 	loader.cacheFile = cacheFile
 
 	// Should fallback to cache when decoding fails
-	servers, err := loader.LoadFromURL()
+	servers, err := loader.LoadFromURL(context.Background())
 	if err != nil {
 		t.Fatalf("LoadFromURL should succeed with cache fallback: %v", err)
 	}
@@ -191,7 +217,7 @@ func TestSubscriptionLoader_CachePersistence(t *testing.T) {
 	loader.cacheFile = cacheFile
 
 	// First load - should fetch from URL and save to cache
-	servers1, err := loader.LoadFromURL()
+	servers1, err := loader.LoadFromURL(context.Background())
 	if err != nil {
 		t.Fatalf("First LoadFromURL failed: %v", err)
 	}
@@ -209,7 +235,7 @@ func TestSubscriptionLoader_CachePersistence(t *testing.T) {
 	server.Close()
 
 	// Second load - should use cache file
-	servers2, err := loader2.LoadFromURL()
+	servers2, err := loader2.LoadFromURL(context.Background())
 	if err != nil {
 		t.Fatalf("Second LoadFromURL should succeed with cache: %v", err)
 	}
@@ -249,7 +275,7 @@ func TestSubscriptionLoader_CacheExpiration(t *testing.T) {
 	loader.cacheFile = cacheFile
 
 	// First load
-	_, err := loader.LoadFromURL()
+	_, err := loader.LoadFromURL(context.Background())
 	if err != nil {
 		t.Fatalf("First LoadFromURL failed: %v", err)
 	}
@@ -259,7 +285,7 @@ func TestSubscriptionLoader_CacheExpiration(t *testing.T) {
 	}
 
 	// Second load immediately - should use cache
-	_, err = loader.LoadFromURL()
+	_, err = loader.LoadFromURL(context.Background())
 	if err != nil {
 		t.Fatalf("Second LoadFromURL failed: %v", err)
 	}
@@ -272,7 +298,7 @@ func TestSubscriptionLoader_CacheExpiration(t *testing.T) {
 	time.Sleep(1100 * time.Millisecond)
 
 	// Third load - should fetch from URL again
-	_, err = loader.LoadFromURL()
+	_, err = loader.LoadFromURL(context.Background())
 	if err != nil {
 		t.Fatalf("Third LoadFromURL failed: %v", err)
 	}
@@ -295,3 +321,35 @@ func containsInner(s, substr string) bool {
 	}
 	return false
 }
+
+func TestSubscriptionLoader_StoresSubscriptionInfo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Subscription-Userinfo", "upload=100; download=200; total=1000; expire=1893456000")
+		if _, err := w.Write([]byte("dmxlc3M6Ly9lYzgyYmNhOC0xMDcyLTQ2ODItODIyZi0zMDMwNmFmNDA4ZWFAMTI3LjAuMDM6ODA4MD90eXBlPXRjcCZzZWN1cml0eT1ub25lI1Rlc3QlMjBTZXJ2ZXI=")); err != nil {
+			t.Errorf("Failed to write response: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	cfg := &config.Config{
+		SubscriptionURL: server.URL,
+		CacheDuration:   3600,
+		PingTimeout:     1,
+	}
+	loader := NewSubscriptionLoaderWithCacheDir(cfg, cacheDir)
+	if _, err := loader.LoadFromURL(context.Background()); err != nil {
+		t.Fatalf("LoadFromURL failed: %v", err)
+	}
+
+	info := loader.GetSubscriptionInfo()
+	if info == nil || info.Remaining() != 700 {
+		t.Fatalf("Expected 700 bytes remaining, got %+v", info)
+	}
+
+	// A new loader reads the stored info until the next download
+	reloaded := NewSubscriptionLoaderWithCacheDir(cfg, cacheDir)
+	if info := reloaded.GetSubscriptionInfo(); info == nil || info.Total != 1000 {
+		t.Errorf("Expected stored subscription info, got %+v", info)
+	}
+}
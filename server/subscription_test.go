@@ -1,10 +1,13 @@
 package server
 
 import (
+	"context"
 	"encoding/base64"
+	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 	"xray-telegram-manager/config"
@@ -77,7 +80,7 @@ func TestSubscriptionLoader_LoadFromURL(t *testing.T) {
 	loader.cacheFile = cacheFile
 
 	// Test loading from URL
-	servers, err := loader.LoadFromURL()
+	servers, err := loader.LoadFromURL(context.Background())
 	if err != nil {
 		t.Fatalf("LoadFromURL failed: %v", err)
 	}
@@ -150,7 +153,7 @@ func TestSubscriptionLoader_FallbackToCache(t *testing.T) {
 	loader.cacheFile = cacheFile
 
 	// Should fallback to cache when URL fails
-	servers, err := loader.LoadFromURL()
+	servers, err := loader.LoadFromURL(context.Background())
 	if err != nil {
 		t.Fatalf("LoadFromURL should succeed with cache fallback: %v", err)
 	}
@@ -194,3 +197,113 @@ func TestSubscriptionLoader_InvalidateCache(t *testing.T) {
 		t.Errorf("Expected empty cache, got %d servers", len(cached))
 	}
 }
+
+func TestParseSubscriptionUserinfo(t *testing.T) {
+	info, ok := ParseSubscriptionUserinfo("upload=455727941; download=6174315083; total=1073741824000; expire=1671815872")
+	if !ok {
+		t.Fatal("Expected header to be parsed")
+	}
+	if info.Used() != 455727941+6174315083 {
+		t.Errorf("Unexpected used traffic: %d", info.Used())
+	}
+	if info.Remaining() != 1073741824000-info.Used() {
+		t.Errorf("Unexpected remaining traffic: %d", info.Remaining())
+	}
+	if info.ExpiresAt().Unix() != 1671815872 {
+		t.Errorf("Unexpected expiry: %v", info.ExpiresAt())
+	}
+
+	info, ok = ParseSubscriptionUserinfo("upload=0; download=1.5e3; total=0; expire=0")
+	if !ok {
+		t.Fatal("Expected header with zero values to be parsed")
+	}
+	if info.Remaining() != -1 || !info.ExpiresAt().IsZero() {
+		t.Errorf("Expected unlimited quota without expiry, got %+v", info)
+	}
+
+	if _, ok := ParseSubscriptionUserinfo(""); ok {
+		t.Error("Expected empty header to be ignored")
+	}
+	if _, ok := ParseSubscriptionUserinfo("garbage"); ok {
+		t.Error("Expected malformed header to be ignored")
+	}
+}
+
+func TestSubscriptionLoader_ParseVlessUrlsKeepsOrder(t *testing.T) {
+	loader := NewSubscriptionLoaderWithCacheDir(&config.Config{}, t.TempDir())
+	urls := generateVlessUrls(parallelParseThreshold * 4)
+	urls[7] = "vless://broken"
+
+	servers, err := loader.ParseVlessUrls(urls)
+	if err != nil {
+		t.Fatalf("ParseVlessUrls failed: %v", err)
+	}
+	if len(servers) != len(urls)-1 {
+		t.Fatalf("Expected %d servers, got %d", len(urls)-1, len(servers))
+	}
+	for i, server := range servers {
+		index := i
+		if i >= 7 {
+			index++
+		}
+		if expected := fmt.Sprintf("node%d.example.com", index); server.Address != expected {
+			t.Fatalf("Server %d out of order: got %s, expected %s", i, server.Address, expected)
+		}
+		if server.VlessUrl != "" {
+			t.Fatalf("Raw URL of server %d kept although keep_vless_urls is off", i)
+		}
+	}
+}
+
+func BenchmarkParseVlessUrls(b *testing.B) {
+	for _, size := range []int{100, 1000, 5000} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			loader := NewSubscriptionLoaderWithCacheDir(&config.Config{}, b.TempDir())
+			urls := generateVlessUrls(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := loader.ParseVlessUrls(urls); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeBase64Config(b *testing.B) {
+	loader := NewSubscriptionLoaderWithCacheDir(&config.Config{}, b.TempDir())
+	data := base64.StdEncoding.EncodeToString([]byte(strings.Join(generateVlessUrls(1000), "\n")))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := loader.DecodeBase64Config(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func generateVlessUrls(count int) []string {
+	urls := make([]string, count)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("vless://12345678-1234-1234-1234-123456789abc@node%d.example.com:%d?type=tcp&security=reality&sni=example.com&pbk=key&sid=ab&fp=chrome#Server %d | example.com", i, 1000+i, i)
+	}
+	return urls
+}
+
+func TestSubscriptionLoader_DecodeBase64ConfigBatches(t *testing.T) {
+	loader := NewSubscriptionLoaderWithCacheDir(&config.Config{}, t.TempDir())
+	urls := generateVlessUrls(parseBatchSize*2 + 10)
+	urls[parseBatchSize] = "vless://broken"
+	lines := append([]string{"# comment", ""}, urls...)
+	data := base64.URLEncoding.EncodeToString([]byte(strings.Join(lines, "\r\n")))
+
+	servers, err := loader.DecodeBase64Config(data)
+	if err != nil {
+		t.Fatalf("DecodeBase64Config failed: %v", err)
+	}
+	if len(servers) != len(urls)-1 {
+		t.Fatalf("Expected %d servers, got %d", len(urls)-1, len(servers))
+	}
+	if last := servers[len(servers)-1].Address; last != fmt.Sprintf("node%d.example.com", len(urls)-1) {
+		t.Errorf("Unexpected last server %s", last)
+	}
+}
@@ -11,7 +11,25 @@ import (
 	"xray-telegram-manager/types"
 )
 
-type VlessParser struct{}
+// Patterns are compiled once, parsing runs for every subscription entry
+var (
+	uuidRegex     = regexp.MustCompile(`^[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}$`)
+	hostnameRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+)
+
+// unsafeCharsReplacer strips control and shell characters from URL values
+var unsafeCharsReplacer = strings.NewReplacer(
+	"\n", "", "\r", "", "\t", "", "\x00", "", "\x0c", "", "\x0b", "",
+	"\\", "", "$", "", "`", "", ";", "", "&", "", "|", "",
+)
+
+// ServerIDFunc derives the ID of a server from its parsed link
+type ServerIDFunc func(config VlessConfig) string
+
+type VlessParser struct {
+	// serverID replaces generateServerID when set, see SetServerIDFunc
+	serverID ServerIDFunc
+}
 type VlessConfig struct {
 	UUID        string
 	Address     string
@@ -24,11 +42,27 @@ type VlessConfig struct {
 	Fingerprint string
 	Flow        string
 	Name        string
+	// Transport parameters: Path and Host of ws, httpupgrade, xhttp and the tcp http
+	// header, ServiceName, Authority and Mode of grpc, Mode of xhttp
+	Path        string
+	Host        string
+	HeaderType  string
+	ServiceName string
+	Authority   string
+	Mode        string
+	// ALPN is the comma separated list of TLS protocols
+	ALPN string
 }
 
 func NewVlessParser() *VlessParser {
 	return &VlessParser{}
 }
+
+// SetServerIDFunc makes parsed servers get their ID from fn, for tests that compare
+// whole server lists. Nil restores the IDs derived from address and port.
+func (vp *VlessParser) SetServerIDFunc(fn ServerIDFunc) {
+	vp.serverID = fn
+}
 func (vp *VlessParser) ParseUrl(vlessUrl string) (VlessConfig, error) {
 	config := VlessConfig{}
 	if vlessUrl == "" {
@@ -82,11 +116,18 @@ func (vp *VlessParser) ParseUrl(vlessUrl string) (VlessConfig, error) {
 	config.ShortID = vp.sanitizeString(queryParams["sid"], 32)
 	config.Fingerprint = vp.sanitizeString(queryParams["fp"], 32)
 	config.Flow = vp.sanitizeString(queryParams["flow"], 32)
+	config.Path = vp.sanitizeString(queryParams["path"], 256)
+	config.Host = vp.sanitizeString(queryParams["host"], 256)
+	config.HeaderType = vp.sanitizeString(queryParams["headerType"], 32)
+	config.ServiceName = vp.sanitizeString(queryParams["serviceName"], 256)
+	config.Authority = vp.sanitizeString(queryParams["authority"], 256)
+	config.Mode = vp.sanitizeString(queryParams["mode"], 32)
+	config.ALPN = vp.sanitizeString(queryParams["alpn"], 64)
 	if parsedUrl.Fragment != "" {
 		config.Name = vp.sanitizeString(parsedUrl.Fragment, 256)
 	}
 	if config.Name == "" {
-		config.Name = fmt.Sprintf("%s:%d", config.Address, config.Port)
+		config.Name = net.JoinHostPort(config.Address, strconv.Itoa(config.Port))
 	}
 	return config, nil
 }
@@ -108,13 +149,18 @@ func (vp *VlessParser) ExtractQueryParams(rawQuery string) (map[string]string, e
 }
 func (vp *VlessParser) ToXrayOutbound(config VlessConfig) (types.Server, error) {
 	server := types.Server{
-		ID:       generateServerID(config),
+		ID:       vp.generateID(config),
 		Name:     config.Name,
 		VlessUrl: "", // Will be set by caller
 		Tag:      "vless-reality",
 		Protocol: "vless",
 		Address:  config.Address,
 		Port:     config.Port,
+		Network:  config.Type,
+		Path:     config.Path,
+		Host:     config.Host,
+		SNI:      config.SNI,
+		ALPN:     config.ALPN,
 	}
 	settings := map[string]interface{}{
 		"vnext": []map[string]interface{}{
@@ -137,10 +183,14 @@ func (vp *VlessParser) ToXrayOutbound(config VlessConfig) (types.Server, error)
 		users[0]["flow"] = config.Flow
 	}
 	server.Settings = settings
-	if config.Security != "" {
+	transportKey, transport := transportSettings(config)
+	if config.Security != "" || transport != nil {
 		streamSettings := map[string]interface{}{
 			"network": config.Type,
 		}
+		if transport != nil {
+			streamSettings[transportKey] = transport
+		}
 		switch config.Security {
 		case "reality":
 			streamSettings["security"] = "reality"
@@ -160,6 +210,7 @@ func (vp *VlessParser) ToXrayOutbound(config VlessConfig) (types.Server, error)
 				realitySettings["fingerprint"] = config.Fingerprint
 			}
 			streamSettings["realitySettings"] = realitySettings
+			server.Problems = validateReality(config)
 		case "tls":
 			streamSettings["security"] = "tls"
 			tlsSettings := map[string]interface{}{}
@@ -169,12 +220,70 @@ func (vp *VlessParser) ToXrayOutbound(config VlessConfig) (types.Server, error)
 			if config.Fingerprint != "" {
 				tlsSettings["fingerprint"] = config.Fingerprint
 			}
+			if config.ALPN != "" {
+				tlsSettings["alpn"] = strings.Split(config.ALPN, ",")
+			}
 			streamSettings["tlsSettings"] = tlsSettings
 		}
 		server.StreamSettings = streamSettings
 	}
 	return server, nil
 }
+
+// transportSettings returns the stream settings key and the settings of the transport
+// of a link, nil for plain tcp. An empty host is left out, xray then sends the server
+// name or the address.
+func transportSettings(config VlessConfig) (string, map[string]interface{}) {
+	settings := map[string]interface{}{}
+	set := func(key, value string) {
+		if value != "" {
+			settings[key] = value
+		}
+	}
+	switch config.Type {
+	case "ws", "httpupgrade":
+		set("path", config.Path)
+		set("host", config.Host)
+	case "xhttp", "splithttp":
+		set("path", config.Path)
+		set("host", config.Host)
+		set("mode", config.Mode)
+	case "grpc":
+		// Some providers put the service name into path
+		serviceName := config.ServiceName
+		if serviceName == "" {
+			serviceName = strings.TrimPrefix(config.Path, "/")
+		}
+		set("serviceName", serviceName)
+		set("authority", config.Authority)
+		if config.Mode == "multi" {
+			settings["multiMode"] = true
+		}
+	case "", "tcp":
+		if config.HeaderType != "http" {
+			return "", nil
+		}
+		path := config.Path
+		if path == "" {
+			path = "/"
+		}
+		request := map[string]interface{}{"path": strings.Split(path, ",")}
+		if config.Host != "" {
+			request["headers"] = map[string]interface{}{"Host": strings.Split(config.Host, ",")}
+		}
+		settings["header"] = map[string]interface{}{"type": "http", "request": request}
+		return "tcpSettings", settings
+	default:
+		return "", nil
+	}
+	return config.Type + "Settings", settings
+}
+func (vp *VlessParser) generateID(config VlessConfig) string {
+	if vp.serverID != nil {
+		return vp.serverID(config)
+	}
+	return generateServerID(config)
+}
 func generateServerID(config VlessConfig) string {
 	id := strings.ReplaceAll(config.Address, ".", "_")
 	id = strings.ReplaceAll(id, ":", "_")
@@ -187,7 +296,6 @@ func (vp *VlessParser) validateUUID(uuid string) error {
 	if len(uuid) != 36 && len(uuid) != 32 {
 		return fmt.Errorf("UUID has invalid length: %d (expected 32 or 36)", len(uuid))
 	}
-	uuidRegex := regexp.MustCompile(`^[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}$`)
 	if !uuidRegex.MatchString(uuid) {
 		return fmt.Errorf("UUID has invalid format")
 	}
@@ -200,7 +308,6 @@ func (vp *VlessParser) validateAddress(address string) error {
 	if ip := net.ParseIP(address); ip != nil {
 		return nil
 	}
-	hostnameRegex := regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
 	if !hostnameRegex.MatchString(address) {
 		return fmt.Errorf("invalid hostname/IP address format")
 	}
@@ -210,19 +317,7 @@ func (vp *VlessParser) sanitizeString(s string, maxLen int) string {
 	if s == "" {
 		return ""
 	}
-	s = strings.ReplaceAll(s, "\n", "")
-	s = strings.ReplaceAll(s, "\r", "")
-	s = strings.ReplaceAll(s, "\t", "")
-	s = strings.ReplaceAll(s, "\x00", "")
-	s = strings.ReplaceAll(s, "\x0c", "")
-	s = strings.ReplaceAll(s, "\x0b", "")
-	s = strings.ReplaceAll(s, "\\", "")
-	s = strings.ReplaceAll(s, "$", "")
-	s = strings.ReplaceAll(s, "`", "")
-	s = strings.ReplaceAll(s, ";", "")
-	s = strings.ReplaceAll(s, "&", "")
-	s = strings.ReplaceAll(s, "|", "")
-	s = strings.TrimSpace(s)
+	s = strings.TrimSpace(unsafeCharsReplacer.Replace(s))
 
 	// Ensure UTF-8 validity
 	if !utf8.ValidString(s) {
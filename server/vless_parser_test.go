@@ -1,6 +1,7 @@
 package server
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -335,7 +336,9 @@ func TestVlessParser_ToXrayOutbound_EdgeCases(t *testing.T) {
 				Name:    "WebSocket Server",
 			},
 			expected: map[string]interface{}{
-				// Note: Without security, no stream settings are created
+				// The transport is kept without security, xray would fall back to tcp
+				"network":    "ws",
+				"wsSettings": map[string]interface{}{},
 			},
 		},
 	}
@@ -478,3 +481,118 @@ func TestVlessParser_ExtractQueryParams(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkVlessParser_ParseUrl(b *testing.B) {
+	parser := NewVlessParser()
+	vlessUrl := "vless://12345678-1234-1234-1234-123456789abc@node.example.com:443?type=tcp&security=reality&sni=example.com&pbk=key&sid=ab&fp=chrome#Server | example.com"
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parser.ParseUrl(vlessUrl); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestVlessParser_Transports(t *testing.T) {
+	parser := NewVlessParser()
+	const prefix = "vless://ec82bca8-1072-4682-822f-30306af408ea@cdn.example.com:443?"
+
+	tests := []struct {
+		name     string
+		query    string
+		key      string
+		expected map[string]interface{}
+	}{
+		{
+			name:     "ws with path and host",
+			query:    "type=ws&security=tls&path=%2Fws%3Fed%3D2048&host=front.example.com",
+			key:      "wsSettings",
+			expected: map[string]interface{}{"path": "/ws?ed=2048", "host": "front.example.com"},
+		},
+		{
+			name:     "grpc with multi mode",
+			query:    "type=grpc&security=reality&serviceName=tunnel&mode=multi&authority=grpc.example.com",
+			key:      "grpcSettings",
+			expected: map[string]interface{}{"serviceName": "tunnel", "multiMode": true, "authority": "grpc.example.com"},
+		},
+		{
+			name:     "grpc service name in path",
+			query:    "type=grpc&security=tls&path=%2Ftunnel",
+			key:      "grpcSettings",
+			expected: map[string]interface{}{"serviceName": "tunnel"},
+		},
+		{
+			name:     "httpupgrade without security",
+			query:    "type=httpupgrade&path=%2Fup&host=up.example.com",
+			key:      "httpupgradeSettings",
+			expected: map[string]interface{}{"path": "/up", "host": "up.example.com"},
+		},
+		{
+			name:     "xhttp with mode",
+			query:    "type=xhttp&security=tls&path=%2Fx&mode=packet-up",
+			key:      "xhttpSettings",
+			expected: map[string]interface{}{"path": "/x", "mode": "packet-up"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parser.ParseUrl(prefix + tt.query + "#Server")
+			if err != nil {
+				t.Fatalf("ParseUrl failed: %v", err)
+			}
+			server, err := parser.ToXrayOutbound(config)
+			if err != nil {
+				t.Fatalf("ToXrayOutbound failed: %v", err)
+			}
+			if server.StreamSettings["network"] != config.Type {
+				t.Errorf("Expected network %s, got %v", config.Type, server.StreamSettings["network"])
+			}
+			settings, ok := server.StreamSettings[tt.key].(map[string]interface{})
+			if !ok {
+				t.Fatalf("Expected %s, got %v", tt.key, server.StreamSettings)
+			}
+			if len(settings) != len(tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, settings)
+			}
+			for key, value := range tt.expected {
+				if settings[key] != value {
+					t.Errorf("Expected %s.%s %v, got %v", tt.key, key, value, settings[key])
+				}
+			}
+		})
+	}
+}
+
+func TestVlessParser_TCPHTTPHeaderAndALPN(t *testing.T) {
+	parser := NewVlessParser()
+	config, err := parser.ParseUrl("vless://ec82bca8-1072-4682-822f-30306af408ea@1.2.3.4:80?type=tcp&headerType=http&host=a.example.com%2Cb.example.com&security=tls&alpn=h2%2Chttp%2F1.1#Server")
+	if err != nil {
+		t.Fatalf("ParseUrl failed: %v", err)
+	}
+	server, err := parser.ToXrayOutbound(config)
+	if err != nil {
+		t.Fatalf("ToXrayOutbound failed: %v", err)
+	}
+
+	tcpSettings, _ := server.StreamSettings["tcpSettings"].(map[string]interface{})
+	header, _ := tcpSettings["header"].(map[string]interface{})
+	request, _ := header["request"].(map[string]interface{})
+	headers, _ := request["headers"].(map[string]interface{})
+	if header["type"] != "http" || !reflect.DeepEqual(request["path"], []string{"/"}) ||
+		!reflect.DeepEqual(headers["Host"], []string{"a.example.com", "b.example.com"}) {
+		t.Errorf("Unexpected tcp settings %v", tcpSettings)
+	}
+
+	tlsSettings, _ := server.StreamSettings["tlsSettings"].(map[string]interface{})
+	if !reflect.DeepEqual(tlsSettings["alpn"], []string{"h2", "http/1.1"}) || server.ALPN != "h2,http/1.1" {
+		t.Errorf("Expected the ALPN list, got %v and %q", tlsSettings["alpn"], server.ALPN)
+	}
+
+	// Plain tcp needs no transport settings
+	config.HeaderType = ""
+	config.Security = ""
+	if server, _ := parser.ToXrayOutbound(config); server.StreamSettings != nil {
+		t.Errorf("Expected no stream settings for plain tcp, got %v", server.StreamSettings)
+	}
+}
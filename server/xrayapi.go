@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"xray-telegram-manager/types"
+)
+
+// defaultXrayBinary is used when the running xray process is not found
+const defaultXrayBinary = "/opt/sbin/xray"
+
+// apiCallTimeout bounds one call of the xray API
+const apiCallTimeout = 10 * time.Second
+
+// ReloadOutbounds makes the running xray use the outbounds of the config file that
+// differ from previous, through the HandlerService of the xray API. Existing
+// connections of the other outbounds are kept, unlike a restart.
+func (xc *XrayController) ReloadOutbounds(ctx context.Context, previous *types.XrayConfig) error {
+	address := xc.config.GetXrayAPI()
+	if address == "" {
+		return fmt.Errorf("xray_api is not set")
+	}
+	current, err := xc.GetCurrentConfig()
+	if err != nil {
+		return err
+	}
+	removed, added, err := diffOutbounds(previous.Outbounds, current.Outbounds)
+	if err != nil {
+		return err
+	}
+	binary := xc.xrayBinary()
+
+	// xray clears its default (first) outbound when it is removed and makes the next
+	// added one the default. Outbounds are added in config order, so the first stays first.
+	for _, tag := range removed {
+		if err := runXrayAPI(ctx, binary, "rmo", "--server="+address, tag); err != nil {
+			return fmt.Errorf("failed to remove outbound %s: %w", tag, err)
+		}
+	}
+	for _, outbound := range added {
+		if err := xc.addOutbound(ctx, binary, address, outbound); err != nil {
+			return fmt.Errorf("failed to add outbound %s: %w", outbound.Tag, err)
+		}
+	}
+	return nil
+}
+
+// diffOutbounds returns the tags to remove and the outbounds to add to turn previous
+// into current. A changed outbound is both removed and added.
+func diffOutbounds(previous, current []types.XrayOutbound) ([]string, []types.XrayOutbound, error) {
+	previousByTag := map[string][]byte{}
+	for _, outbound := range previous {
+		data, err := json.Marshal(outbound)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal outbound: %w", err)
+		}
+		previousByTag[outbound.Tag] = data
+	}
+
+	var removed []string
+	var added []types.XrayOutbound
+	currentTags := map[string]bool{}
+	for _, outbound := range current {
+		if outbound.Tag == "" {
+			return nil, nil, fmt.Errorf("outbound %s has no tag and cannot be replaced through the API", outbound.Protocol)
+		}
+		currentTags[outbound.Tag] = true
+		data, err := json.Marshal(outbound)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal outbound: %w", err)
+		}
+		old, existed := previousByTag[outbound.Tag]
+		if existed && bytes.Equal(old, data) {
+			continue
+		}
+		if existed {
+			removed = append(removed, outbound.Tag)
+		}
+		added = append(added, outbound)
+	}
+	for _, outbound := range previous {
+		if !currentTags[outbound.Tag] {
+			if outbound.Tag == "" {
+				return nil, nil, fmt.Errorf("outbound %s has no tag and cannot be removed through the API", outbound.Protocol)
+			}
+			removed = append(removed, outbound.Tag)
+		}
+	}
+	return removed, added, nil
+}
+
+// addOutbound passes outbound to xray api ado, which reads outbounds from a file
+func (xc *XrayController) addOutbound(ctx context.Context, binary, address string, outbound types.XrayOutbound) error {
+	data, err := json.Marshal(map[string]interface{}{"outbounds": []types.XrayOutbound{outbound}})
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbound: %w", err)
+	}
+	file, err := os.CreateTemp("", "xray-outbound-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to create outbound file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write outbound file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write outbound file: %w", err)
+	}
+	return runXrayAPI(ctx, binary, "ado", "--server="+address, file.Name())
+}
+
+// runXrayAPI runs one xray api command, its output explains a failure
+func runXrayAPI(ctx context.Context, binary string, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, apiCallTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, binary, append([]string{"api"}, args...)...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if text := strings.TrimSpace(string(output)); text != "" {
+			return fmt.Errorf("%w: %s", err, text)
+		}
+		return err
+	}
+	return nil
+}
+
+// xrayBinary returns the executable of the running xray process
+func (xc *XrayController) xrayBinary() string {
+	pid, err := xc.FindXrayPID()
+	if err != nil {
+		return defaultXrayBinary
+	}
+	binary, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return defaultXrayBinary
+	}
+	return binary
+}
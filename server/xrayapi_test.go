@@ -0,0 +1,35 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"xray-telegram-manager/types"
+)
+
+func TestDiffOutbounds(t *testing.T) {
+	proxy := types.XrayOutbound{Tag: "vless-reality", Protocol: "vless", Settings: map[string]interface{}{"address": "a.example.com"}}
+	direct := types.XrayOutbound{Tag: "direct", Protocol: "freedom"}
+	dialer := types.XrayOutbound{Tag: dialerOutboundTag, Protocol: "freedom"}
+	switched := proxy
+	switched.Settings = map[string]interface{}{"address": "b.example.com"}
+
+	removed, added, err := diffOutbounds([]types.XrayOutbound{proxy, direct, dialer}, []types.XrayOutbound{switched, direct})
+	if err != nil {
+		t.Fatalf("diffOutbounds failed: %v", err)
+	}
+	if !reflect.DeepEqual(removed, []string{"vless-reality", dialerOutboundTag}) {
+		t.Errorf("Expected the proxy and dialer to be removed, got %v", removed)
+	}
+	if len(added) != 1 || added[0].Settings["address"] != "b.example.com" {
+		t.Errorf("Expected only the switched proxy to be added, got %v", added)
+	}
+
+	removed, added, err = diffOutbounds([]types.XrayOutbound{proxy, direct}, []types.XrayOutbound{proxy, direct})
+	if err != nil || len(removed) != 0 || len(added) != 0 {
+		t.Errorf("Expected no changes for equal outbounds, got %v %v %v", removed, added, err)
+	}
+
+	if _, _, err := diffOutbounds(nil, []types.XrayOutbound{{Protocol: "freedom"}}); err == nil {
+		t.Error("Expected an error for an outbound without a tag")
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+)
+
+// logFileName is the log file of the split configs/ directory
+const logFileName = "01_log.json"
+
+// maxLogRead bounds how much of the end of the log is read at once
+const maxLogRead = 256 << 10
+
+// logNoise are fragments of routine lines that say nothing about failures
+var logNoise = []string{
+	"tunneling request",
+	"taking detour",
+	"default route",
+	"sniffed domain",
+	" accepted ",
+	"[debug]",
+}
+
+// logKeywords are fragments of lines about outbound connection problems
+var logKeywords = []string{
+	"[error]",
+	"[warning]",
+	"failed",
+	"reality",
+	"handshake",
+	"timeout",
+	"refused",
+	"reset by peer",
+	"eof",
+	"tls:",
+	"proxy/",
+	"transport/internet",
+}
+
+// XrayLogPath returns the xray error log: xray_log_path, or log.error of the xray config
+func (xc *XrayController) XrayLogPath() (string, error) {
+	if path := xc.config.GetXrayLogPath(); path != "" {
+		return path, nil
+	}
+	configPath := xc.config.GetConfigPath()
+	layout := xc.config.GetXrayLayout()
+	if layout == "" || layout == config.XrayLayoutAuto {
+		if detected, err := DetectXrayLayout(configPath); err == nil {
+			layout = detected
+		}
+	}
+	if layout != config.XrayLayoutSingle {
+		configPath = filepath.Join(filepath.Dir(configPath), logFileName)
+	}
+
+	sections, err := readConfigSections(configPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read xray log settings, set xray_log_path: %w", err)
+	}
+	var logSettings struct {
+		Error string `json:"error"`
+	}
+	if raw, ok := sections["log"]; ok {
+		_ = json.Unmarshal(raw, &logSettings)
+	}
+	if logSettings.Error == "" || logSettings.Error == "none" {
+		return "", fmt.Errorf("xray does not write an error log to a file: set log.error in %s or xray_log_path", configPath)
+	}
+	return logSettings.Error, nil
+}
+
+// ReadXrayLog returns the newest maxLines lines of the xray error log that are
+// about outbound problems, written after offset. Offset 0, or an offset past the
+// end of a rotated log, reads the end of the log.
+func (xc *XrayController) ReadXrayLog(offset int64, maxLines int) (types.XrayLog, error) {
+	path, err := xc.XrayLogPath()
+	if err != nil {
+		return types.XrayLog{}, err
+	}
+	log := types.XrayLog{Path: path}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return log, fmt.Errorf("failed to open xray log: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return log, fmt.Errorf("failed to read xray log: %w", err)
+	}
+	log.Offset = info.Size()
+
+	start := offset
+	if start <= 0 || start > info.Size() {
+		start = 0
+	}
+	// Only the end of a long log is read, its first line may be cut
+	partial := false
+	if info.Size()-start > maxLogRead {
+		start = info.Size() - maxLogRead
+		partial = true
+	}
+	data, err := io.ReadAll(io.NewSectionReader(file, start, info.Size()-start))
+	if err != nil {
+		return log, fmt.Errorf("failed to read xray log: %w", err)
+	}
+	if partial {
+		if newline := bytes.IndexByte(data, '\n'); newline >= 0 {
+			data = data[newline+1:]
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLogRead)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !relevantLogLine(line) {
+			log.Filtered++
+			continue
+		}
+		log.Lines = append(log.Lines, line)
+	}
+	if maxLines > 0 && len(log.Lines) > maxLines {
+		log.Lines = log.Lines[len(log.Lines)-maxLines:]
+	}
+	return log, nil
+}
+
+// relevantLogLine reports whether a log line may explain why traffic does not pass
+func relevantLogLine(line string) bool {
+	lower := strings.ToLower(line)
+	failure := strings.Contains(lower, "failed") || strings.Contains(lower, "[error]")
+	if !failure {
+		for _, noise := range logNoise {
+			if strings.Contains(lower, noise) {
+				return false
+			}
+		}
+	}
+	for _, keyword := range logKeywords {
+		if strings.Contains(lower, keyword) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"xray-telegram-manager/config"
+)
+
+func TestReadXrayLog(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "error.log")
+	configPath := filepath.Join(dir, "config.json")
+	xrayConfig := `{"log": {"loglevel": "warning", "error": "` + logPath + `"}, "inbounds": [{"port": 1080}], "outbounds": []}`
+	if err := os.WriteFile(configPath, []byte(xrayConfig), 0644); err != nil {
+		t.Fatalf("Failed to write xray config: %v", err)
+	}
+	lines := []string{
+		"2024/05/01 10:00:00 [Info] [123] proxy/vless/outbound: tunneling request to tcp:example.com:443 via 1.2.3.4:443",
+		"2024/05/01 10:00:01 [Warning] [123] app/dispatcher: default route for tcp:example.com:443",
+		"2024/05/01 10:00:02 [Info] [124] proxy/vless/outbound: failed to find an available destination > common/retry: all retry attempts failed",
+		"2024/05/01 10:00:03 [Error] transport/internet/reality: REALITY: processed invalid connection",
+		"2024/05/01 10:00:04 [Info] app/proxyman/inbound: connection ends",
+	}
+	if err := os.WriteFile(logPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+
+	xc := NewXrayController(&configAdapter{&config.Config{ConfigPath: configPath, XrayLayout: config.XrayLayoutAuto}})
+	log, err := xc.ReadXrayLog(0, 10)
+	if err != nil {
+		t.Fatalf("ReadXrayLog failed: %v", err)
+	}
+	if log.Path != logPath || len(log.Lines) != 2 || log.Filtered != 3 {
+		t.Fatalf("Expected 2 relevant and 3 filtered lines from %s, got %+v", logPath, log)
+	}
+	if !strings.Contains(log.Lines[1], "REALITY") {
+		t.Errorf("Expected the Reality failure last, got %q", log.Lines[1])
+	}
+
+	// Following the log returns only lines written since the last read
+	file, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	_, _ = file.WriteString("2024/05/01 10:01:00 [Warning] proxy/vless/outbound: dial tcp 1.2.3.4:443: i/o timeout\n")
+	file.Close()
+	next, err := xc.ReadXrayLog(log.Offset, 10)
+	if err != nil {
+		t.Fatalf("ReadXrayLog failed: %v", err)
+	}
+	if len(next.Lines) != 1 || !strings.Contains(next.Lines[0], "i/o timeout") {
+		t.Errorf("Expected only the new timeout line, got %+v", next.Lines)
+	}
+}
+
+func TestXrayLogPathRequiresFileLog(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"log": {"loglevel": "warning"}, "routing": {"rules": [{}]}}`), 0644); err != nil {
+		t.Fatalf("Failed to write xray config: %v", err)
+	}
+	xc := NewXrayController(&configAdapter{&config.Config{ConfigPath: configPath}})
+	if _, err := xc.XrayLogPath(); err == nil {
+		t.Error("Expected an error when xray logs to stdout")
+	}
+	xc = NewXrayController(&configAdapter{&config.Config{ConfigPath: configPath, XrayLogPath: "/var/log/xray.log"}})
+	if path, err := xc.XrayLogPath(); err != nil || path != "/var/log/xray.log" {
+		t.Errorf("Expected xray_log_path to be used, got %q, %v", path, err)
+	}
+}
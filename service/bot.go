@@ -0,0 +1,23 @@
+//go:build !notelegram
+
+package service
+
+import (
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/logger"
+	"xray-telegram-manager/server"
+	"xray-telegram-manager/telegram"
+)
+
+// newBot creates the Telegram bot that controls the service
+func newBot(cfg *config.Config, serverMgr *server.ServerManager, log *logger.Logger) (TelegramBot, error) {
+	bot, err := telegram.NewTelegramBot(cfg, serverMgr, log)
+	if err != nil {
+		return nil, err
+	}
+	return bot, nil
+}
+
+func newNoticeFormatter() noticeFormatter {
+	return telegram.NewMessageFormatter()
+}
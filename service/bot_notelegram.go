@@ -0,0 +1,121 @@
+//go:build notelegram
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/fallback"
+	"xray-telegram-manager/logger"
+	"xray-telegram-manager/notifications"
+	"xray-telegram-manager/server"
+	"xray-telegram-manager/types"
+)
+
+// logBot replaces the Telegram bot in builds without it, notifications go to the log
+// and critical ones also to the fallback channel
+type logBot struct {
+	logger   *logger.Logger
+	fallback *fallback.Notifier
+}
+
+// newBot creates the bot of a build without Telegram
+func newBot(cfg *config.Config, serverMgr *server.ServerManager, log *logger.Logger) (TelegramBot, error) {
+	return &logBot{logger: log, fallback: fallback.New(cfg.GetFallbackNotifier())}, nil
+}
+
+func (b *logBot) Start(ctx context.Context) error {
+	b.logger.Info("Built without the Telegram bot, notifications are only logged")
+	return nil
+}
+
+func (b *logBot) Stop() {}
+
+func (b *logBot) Notify(ctx context.Context, event notifications.Event, text string) {
+	b.logger.Info("Notification %s: %s", event, oneLine(text))
+	if !event.IsCritical() || !b.fallback.Wanted(false) {
+		return
+	}
+	if _, err := b.fallback.Send(ctx, "Xray manager: "+event.DisplayName(), text); err != nil {
+		b.logger.Error("Failed to send %s notification over the fallback channel: %v", event, err)
+	}
+}
+
+func (b *logBot) Announce(ctx context.Context, text string) {
+	b.logger.Info("Announcement: %s", oneLine(text))
+}
+
+func (b *logBot) ReportResult(ctx context.Context, source string, err error) {
+	if err != nil {
+		b.logger.Warn("Background task %s failed: %v", source, err)
+	}
+}
+
+func (b *logBot) PromptConfigRecovery(ctx context.Context, problem string) {
+	b.logger.Warn("Xray config needs recovery: %s", problem)
+}
+
+func (b *logBot) AlertAddressChange(ctx context.Context, change types.AddressChange) {
+	b.logger.Warn("Server %s moved from %s to %s", change.Server.Name,
+		strings.Join(change.Previous, ", "), strings.Join(change.Current, ", "))
+}
+
+func (b *logBot) AlertLatencyAnomaly(ctx context.Context, anomaly types.LatencyAnomaly) {
+	b.logger.Warn("Latency of %s rose to %v from the usual %v", anomaly.Server.Name, anomaly.Current, anomaly.Baseline)
+}
+
+func (b *logBot) OnDuplicateInstance(fn func()) {}
+
+func (b *logBot) PrefetchServerList() {}
+
+func oneLine(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// plainFormatter formats the notifications of a build without Telegram
+type plainFormatter struct{}
+
+func newNoticeFormatter() noticeFormatter {
+	return plainFormatter{}
+}
+
+func (plainFormatter) FormatSubscriptionChange(change types.ServerListChange, total int) string {
+	return fmt.Sprintf("subscription changed: %d servers added, %d removed, %d reattached, %d total",
+		len(change.Added), len(change.Removed), len(change.Reattached), total)
+}
+
+func (plainFormatter) FormatServerChangedNotice(serverName string) string {
+	return fmt.Sprintf("VPN server changed to %s", serverName)
+}
+
+func (plainFormatter) FormatHealthAlert(status string, problems []string) string {
+	if len(problems) == 0 {
+		return fmt.Sprintf("health %s", status)
+	}
+	return fmt.Sprintf("health %s: %s", status, strings.Join(problems, "; "))
+}
+
+func (plainFormatter) FormatVPNDownNotice(serverName string) string {
+	return fmt.Sprintf("VPN server %s is not responding", serverName)
+}
+
+func (plainFormatter) FormatVPNRestoredNotice(serverName string) string {
+	return fmt.Sprintf("VPN server %s is responding again", serverName)
+}
+
+func (plainFormatter) FormatQuotaWarning(info *types.SubscriptionInfo, lowQuota, expiring bool) string {
+	var problems []string
+	if lowQuota {
+		problems = append(problems, fmt.Sprintf("%d bytes of traffic left", info.Remaining()))
+	}
+	if expiring {
+		problems = append(problems, fmt.Sprintf("expires %s", info.ExpiresAt().Format("2006-01-02")))
+	}
+	return "subscription warning: " + strings.Join(problems, ", ")
+}
+
+func (plainFormatter) FormatLoadRetriesExhausted(attempts int, err error) string {
+	return fmt.Sprintf("subscription load failed after %d retries: %v", attempts, err)
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"xray-telegram-manager/fsutil"
+)
+
+// DefaultHealthFile is where the running service publishes its health for --health checks
+const DefaultHealthFile = "/opt/etc/xray-manager/health.json"
+
+// HealthReport is the health snapshot written by the running service
+type HealthReport struct {
+	PID             int    `json:"pid"`
+	Status          string `json:"status"`
+	Ready           bool   `json:"ready"`
+	Timestamp       int64  `json:"timestamp"`
+	IntervalSeconds int    `json:"interval_seconds"`
+	ServersCount    int    `json:"servers_count"`
+	CurrentServer   string `json:"current_server,omitempty"`
+}
+
+// writeHealthFile publishes the health report, replacing the previous one atomically
+func writeHealthFile(path string, report HealthReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal health report: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create health file directory: %w", err)
+	}
+	if err := fsutil.WriteShared(path, data); err != nil {
+		return fmt.Errorf("failed to replace health file: %w", err)
+	}
+	return nil
+}
+
+// CheckHealth reads the health file of a running service and returns a short summary.
+// An error is returned when the service is not running, not ready, stale or unhealthy.
+func CheckHealth(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read health file: %w", err)
+	}
+	var report HealthReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return "", fmt.Errorf("failed to parse health file: %w", err)
+	}
+	if report.PID <= 0 || syscall.Kill(report.PID, 0) != nil {
+		return "", fmt.Errorf("service is not running (pid %d)", report.PID)
+	}
+	if !report.Ready {
+		return "", fmt.Errorf("service is starting (pid %d), servers are not loaded yet", report.PID)
+	}
+	age := time.Since(time.Unix(report.Timestamp, 0))
+	if report.IntervalSeconds > 0 {
+		maxAge := 2*time.Duration(report.IntervalSeconds)*time.Second + time.Minute
+		if age > maxAge {
+			return "", fmt.Errorf("health report is stale (last update %s ago)", age.Round(time.Second))
+		}
+	}
+	if report.Status == "unhealthy" {
+		return "", fmt.Errorf("service is unhealthy (pid %d)", report.PID)
+	}
+
+	summary := fmt.Sprintf("%s (pid %d, %d servers", report.Status, report.PID, report.ServersCount)
+	if report.CurrentServer != "" {
+		summary += ", current: " + report.CurrentServer
+	}
+	summary += fmt.Sprintf(", updated %s ago)", age.Round(time.Second))
+	return summary, nil
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DefaultLockFile keeps a second instance from starting on the same router
+const DefaultLockFile = "/opt/etc/xray-manager/xray-manager.lock"
+
+// InstanceLock is held by the running instance until it stops
+type InstanceLock struct {
+	file *os.File
+}
+
+// AlreadyRunningError is returned by AcquireInstanceLock when another instance holds
+// the lock, PID is 0 when it could not be read
+type AlreadyRunningError struct {
+	PID int
+}
+
+func (e *AlreadyRunningError) Error() string {
+	if e.PID > 0 {
+		return fmt.Sprintf("another instance is already running (pid %d)", e.PID)
+	}
+	return "another instance is already running"
+}
+
+// AcquireInstanceLock locks path for this process and writes its PID there. The lock
+// is released by the system when the process exits, a stale file does not block.
+func AcquireInstanceLock(path string) (*InstanceLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			data, _ := os.ReadFile(path)
+			pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+			return nil, &AlreadyRunningError{PID: pid}
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	if err := file.Truncate(0); err == nil {
+		_, _ = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &InstanceLock{file: file}, nil
+}
+
+// Release unlocks and removes the lock file
+func (l *InstanceLock) Release() {
+	if l == nil || l.file == nil {
+		return
+	}
+	_ = os.Remove(l.file.Name())
+	_ = l.file.Close()
+	l.file = nil
+}
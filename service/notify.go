@@ -0,0 +1,44 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state string to the service manager using the sd_notify protocol.
+// It is a no-op when the process is not started by systemd with NOTIFY_SOCKET set.
+func sdNotify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+	// Abstract namespace sockets are prefixed with '@'
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to notify socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("failed to write to notify socket: %w", err)
+	}
+	return true, nil
+}
+
+// watchdogInterval returns how often WATCHDOG=1 keepalives should be sent, which is
+// half of the WatchdogSec configured in the unit. Zero means the watchdog is disabled.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
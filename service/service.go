@@ -3,13 +3,38 @@ package service
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"xray-telegram-manager/config"
+	"xray-telegram-manager/hooks"
 	"xray-telegram-manager/logger"
+	"xray-telegram-manager/mqtt"
+	"xray-telegram-manager/notifications"
+	"xray-telegram-manager/operations"
+	"xray-telegram-manager/routerstatus"
+	"xray-telegram-manager/scheduler"
 	"xray-telegram-manager/server"
-	"xray-telegram-manager/telegram"
 	"xray-telegram-manager/types"
+	"xray-telegram-manager/version"
+	"xray-telegram-manager/web"
+)
+
+// availabilityCheckDelay lets the startup settle before the first availability check
+const availabilityCheckDelay = 2 * time.Minute
+
+// subscriptionWatchInterval is how often a local server list is checked for changes
+const subscriptionWatchInterval = 10 * time.Second
+
+// Background tasks whose errors are reported to the admin, see TelegramBot.ReportResult
+const (
+	taskSubscriptionRefresh = "subscription refresh"
+	taskAvailabilityCheck   = "availability check"
 )
 
 type Service struct {
@@ -17,6 +42,8 @@ type Service struct {
 	logger          *logger.Logger
 	bot             TelegramBot
 	serverMgr       *server.ServerManager
+	routerStatus    *routerstatus.Reporter
+	mqtt            *mqtt.Publisher
 	ctx             context.Context
 	cancel          context.CancelFunc
 	running         bool
@@ -24,12 +51,45 @@ type Service struct {
 	healthTicker    *time.Ticker
 	lastHealthCheck time.Time
 	healthStatus    map[string]interface{}
+	lastXrayPID     int
+	ready           bool
+	healthFile      string
+	// Status of the last health check, used to alert on changes
+	lastHealthState string
+	// Whether the notification chats were told the VPN is down
+	vpnDownAnnounced bool
+	// Subscription info the quota warning was last sent for, to send it once per state
+	quotaWarningState string
+	// Problem of the corrupted xray config the admin was last prompted about
+	configProblem string
+	// Closed when the service has to stop by itself, see Done
+	done     chan struct{}
+	doneOnce sync.Once
 }
 
 // Local interfaces to avoid dependency on interfaces package
 type TelegramBot interface {
 	Start(ctx context.Context) error
 	Stop()
+	Notify(ctx context.Context, event notifications.Event, text string)
+	Announce(ctx context.Context, text string)
+	ReportResult(ctx context.Context, source string, err error)
+	PromptConfigRecovery(ctx context.Context, problem string)
+	AlertAddressChange(ctx context.Context, change types.AddressChange)
+	AlertLatencyAnomaly(ctx context.Context, anomaly types.LatencyAnomaly)
+	OnDuplicateInstance(fn func())
+	PrefetchServerList()
+}
+
+// noticeFormatter formats the notifications the service sends through the bot
+type noticeFormatter interface {
+	FormatSubscriptionChange(change types.ServerListChange, total int) string
+	FormatServerChangedNotice(serverName string) string
+	FormatHealthAlert(status string, problems []string) string
+	FormatVPNDownNotice(serverName string) string
+	FormatVPNRestoredNotice(serverName string) string
+	FormatQuotaWarning(info *types.SubscriptionInfo, lowQuota, expiring bool) string
+	FormatLoadRetriesExhausted(attempts int, err error) string
 }
 
 func NewService(cfg *config.Config, log *logger.Logger) (*Service, error) {
@@ -41,16 +101,31 @@ func NewService(cfg *config.Config, log *logger.Logger) (*Service, error) {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	serverMgr := server.NewServerManager(cfg)
-	bot, err := telegram.NewTelegramBot(cfg, serverMgr, log)
+	bot, err := newBot(cfg, serverMgr, log)
 	if err != nil {
 		cancel()
 		return nil, fmt.Errorf("failed to create telegram bot: %w", err)
 	}
-	return &Service{
+	serverMgr.OnServersChanged(func(change types.ServerListChange) {
+		message := newNoticeFormatter().FormatSubscriptionChange(change, len(serverMgr.GetServers()))
+		log.Info("Subscription changed: %d servers added, %d removed, %d reattached", len(change.Added), len(change.Removed), len(change.Reattached))
+		go bot.Notify(ctx, notifications.EventSubscriptionChange, message)
+	})
+	serverMgr.OnServersLoaded(func() {
+		go bot.PrefetchServerList()
+	})
+	publisher := mqtt.NewPublisher(cfg.GetMQTT(), log)
+	serverMgr.OnServerSwitched(func(switched types.Server) {
+		go bot.Announce(ctx, newNoticeFormatter().FormatServerChangedNotice(switched.Name))
+		publisher.PublishSwitch(switched)
+	})
+	s := &Service{
 		config:          cfg,
 		logger:          log,
 		bot:             bot,
 		serverMgr:       serverMgr,
+		routerStatus:    routerstatus.NewReporter(cfg.GetRouterStatus()),
+		mqtt:            publisher,
 		ctx:             ctx,
 		cancel:          cancel,
 		running:         false,
@@ -58,7 +133,24 @@ func NewService(cfg *config.Config, log *logger.Logger) (*Service, error) {
 		healthTicker:    nil,
 		lastHealthCheck: time.Time{},
 		healthStatus:    make(map[string]interface{}),
-	}, nil
+		healthFile:      DefaultHealthFile,
+		done:            make(chan struct{}),
+	}
+	if dev := cfg.GetDev(); dev.Enabled {
+		s.healthFile = filepath.Join(dev.SandboxDir, filepath.Base(DefaultHealthFile))
+	}
+	serverMgr.OnLoadRetried(s.loadRetried)
+	bot.OnDuplicateInstance(func() {
+		log.Error("Another instance polls the bot token, this instance stops")
+		s.doneOnce.Do(func() { close(s.done) })
+	})
+	return s, nil
+}
+
+// Done is closed when the service has to stop by itself, because another instance
+// already polls the same bot token
+func (s *Service) Done() <-chan struct{} {
+	return s.done
 }
 func (s *Service) Start() error {
 	s.mutex.Lock()
@@ -66,22 +158,39 @@ func (s *Service) Start() error {
 	if s.running {
 		return fmt.Errorf("service is already running")
 	}
-	s.logger.Info("Starting xray-telegram-manager service")
+	s.logger.Info("Starting xray-telegram-manager service %s", version.String())
+	if dev := s.config.GetDev(); dev.Enabled {
+		s.logger.Warn("Dev mode: xray is emulated in %s and pings are simulated", dev.SandboxDir)
+		if err := s.serverMgr.PrepareDevSandbox(); err != nil {
+			return fmt.Errorf("failed to prepare dev sandbox: %w", err)
+		}
+	}
+	layout, hints, err := s.serverMgr.CheckXrayLayout()
+	if err != nil {
+		s.logger.Warn("Failed to read xray config %s: %v", s.config.ConfigPath, err)
+	} else {
+		s.logger.Info("Xray config layout: %s (%s)", layout, s.config.ConfigPath)
+	}
+	for _, hint := range hints {
+		s.logger.Warn("Xray config: %s", hint)
+	}
 	s.logger.Info("Loading servers from subscription...")
-	if err := s.serverMgr.LoadServers(); err != nil {
+	s.serverMgr.StartLoadRetries(s.ctx)
+	err = s.serverMgr.LoadServers(s.ctx)
+	go s.bot.ReportResult(s.ctx, taskSubscriptionRefresh, err)
+	if err != nil {
 		s.logger.Warn("Failed to load servers on startup: %v", err)
 		s.logger.Info("Service will continue, servers can be loaded later via Telegram commands")
 	} else {
 		servers := s.serverMgr.GetServers()
 		s.logger.Info("Successfully loaded %d servers", len(servers))
-		if err := s.serverMgr.DetectCurrentServer(); err != nil {
-			s.logger.Debug("Could not detect current server: %v", err)
-		} else {
-			currentServer := s.serverMgr.GetCurrentServer()
-			if currentServer != nil {
-				s.logger.Info("Detected current server: %s", currentServer.Name)
-			}
-		}
+		s.detectCurrentServer()
+		// Render the list again with the detected current server marked
+		go s.bot.PrefetchServerList()
+		s.markReadyUnsafe()
+	}
+	if pid, err := s.serverMgr.GetXrayPID(); err == nil {
+		s.lastXrayPID = pid
 	}
 	s.logger.Info("Starting Telegram bot...")
 	go func() {
@@ -89,13 +198,42 @@ func (s *Service) Start() error {
 			s.logger.Error("Telegram bot error: %v", err)
 		}
 	}()
+	if s.config.Web.Enabled {
+		dashboard := web.NewServer(s.config.GetWeb(), s.serverMgr, s.logger)
+		go func() {
+			if err := dashboard.Start(s.ctx); err != nil {
+				s.logger.Error("Web dashboard error: %v", err)
+			}
+		}()
+	}
+	if s.config.MQTT.Enabled() {
+		s.logger.Info("Publishing the VPN state to MQTT broker %s", s.config.MQTT.Broker)
+		go s.mqtt.Run(s.ctx)
+	}
+	s.checkXrayConfigUnsafe()
 	if s.config.HealthCheckInterval > 0 {
 		s.logger.Info("Starting health monitoring (interval: %d seconds)", s.config.HealthCheckInterval)
 		s.startHealthMonitoring()
 	} else {
 		s.logger.Info("Health monitoring disabled (interval: 0)")
 	}
+	if s.config.AvailabilityCheck > 0 {
+		s.logger.Info("Starting availability checks (interval: %d seconds)", s.config.AvailabilityCheck)
+		s.startAvailabilityChecks()
+	}
+	if s.config.AddressCheck > 0 {
+		s.logger.Info("Starting address checks of the active server (interval: %d seconds)", s.config.AddressCheck)
+		s.startAddressChecks()
+	}
+	if s.serverMgr.WatchesSubscription() {
+		s.logger.Info("Watching the server list %s for changes", s.config.SubscriptionURL)
+		s.startSubscriptionWatch()
+	}
 	s.running = true
+	s.publishHealthUnsafe()
+	// The service manager waits for the bot only, the subscription may stay
+	// unreachable for a long time and servers are loaded by the retries
+	s.notify("READY=1\nSTATUS=" + s.notifyStatusUnsafe())
 	s.logger.Info("Service started successfully")
 	return nil
 }
@@ -106,6 +244,7 @@ func (s *Service) Stop() error {
 		return fmt.Errorf("service is not running")
 	}
 	s.logger.Info("Stopping xray-telegram-manager service")
+	s.notify("STOPPING=1")
 	if s.healthTicker != nil {
 		s.logger.Info("Stopping health monitoring...")
 		s.healthTicker.Stop()
@@ -114,8 +253,15 @@ func (s *Service) Stop() error {
 	s.cancel()
 	s.logger.Info("Stopping Telegram bot...")
 	s.bot.Stop()
+	if err := s.routerStatus.Close(); err != nil {
+		s.logger.Debug("Failed to close syslog: %v", err)
+	}
 	time.Sleep(1 * time.Second)
 	s.running = false
+	s.ready = false
+	if err := os.Remove(s.healthFile); err != nil && !os.IsNotExist(err) {
+		s.logger.Debug("Failed to remove health file: %v", err)
+	}
 	s.logger.Info("Service stopped successfully")
 	return nil
 }
@@ -140,12 +286,31 @@ func (s *Service) Reload() error {
 	}
 	s.mutex.RUnlock()
 	s.logger.Info("Reloading service configuration")
-	if err := s.serverMgr.RefreshServers(); err != nil {
+	s.notify("RELOADING=1")
+
+	// Wait for a running ping test or switch instead of refreshing underneath it
+	waitCtx, cancel := context.WithTimeout(s.ctx, 2*time.Minute)
+	defer cancel()
+	_, release, err := s.serverMgr.Operations().Acquire(waitCtx, operations.OperationRefresh, 0, operations.PolicyQueue)
+	if err != nil {
+		return fmt.Errorf("failed to start subscription refresh: %w", err)
+	}
+	defer release()
+
+	err = s.serverMgr.RefreshServers(s.ctx)
+	go s.bot.ReportResult(s.ctx, taskSubscriptionRefresh, err)
+	if err != nil {
 		s.logger.Warn("Failed to refresh servers: %v", err)
 	} else {
 		servers := s.serverMgr.GetServers()
 		s.logger.Info("Successfully refreshed %d servers", len(servers))
 	}
+	s.mutex.Lock()
+	if len(s.serverMgr.GetServers()) > 0 {
+		s.markReadyUnsafe()
+	}
+	s.notify("READY=1\nSTATUS=" + s.notifyStatusUnsafe())
+	s.mutex.Unlock()
 	s.logger.Info("Service configuration reloaded successfully")
 	return nil
 }
@@ -192,13 +357,104 @@ func (s *Service) GetStatus() map[string]interface{} {
 	}
 	return status
 }
+
+// WatchdogInterval returns how often NotifyWatchdog must be called, or zero
+// when the service manager has no watchdog configured
+func (s *Service) WatchdogInterval() time.Duration {
+	return watchdogInterval()
+}
+
+// NotifyWatchdog sends a watchdog keepalive to the service manager
+func (s *Service) NotifyWatchdog() {
+	s.notify("WATCHDOG=1")
+}
+
+// markReadyUnsafe marks the service healthy for the --health check once servers are loaded
+func (s *Service) markReadyUnsafe() {
+	if s.ready {
+		return
+	}
+	s.ready = true
+	s.notify("STATUS=" + s.notifyStatusUnsafe())
+	s.publishHealthUnsafe()
+}
+
+// notifyStatusUnsafe describes the service for the STATUS field of the service manager
+func (s *Service) notifyStatusUnsafe() string {
+	if !s.ready {
+		return "waiting for servers from the subscription"
+	}
+	return fmt.Sprintf("%d servers loaded", len(s.serverMgr.GetServers()))
+}
+func (s *Service) notify(state string) {
+	if _, err := sdNotify(state); err != nil {
+		s.logger.Warn("Failed to notify service manager (%s): %v", state, err)
+	}
+}
+
+// publishHealthUnsafe writes the latest health snapshot for the --health CLI check
+func (s *Service) publishHealthUnsafe() {
+	status := "starting"
+	if s.ready {
+		status = "healthy"
+		if checked, ok := s.healthStatus["status"].(string); ok {
+			status = checked
+		}
+	}
+	report := HealthReport{
+		PID:             os.Getpid(),
+		Status:          status,
+		Ready:           s.ready,
+		Timestamp:       time.Now().Unix(),
+		IntervalSeconds: s.config.HealthCheckInterval,
+		ServersCount:    len(s.serverMgr.GetServers()),
+	}
+	if currentServer := s.serverMgr.GetCurrentServer(); currentServer != nil {
+		report.CurrentServer = currentServer.Name
+	}
+	if err := writeHealthFile(s.healthFile, report); err != nil {
+		s.logger.Debug("Failed to write health file: %v", err)
+	}
+}
+
+// loadRetried reports the automatic retries of failed subscription loads: a success
+// clears the error alert and finishes a startup that found no servers, the last
+// failed attempt tells the admin that only a manual refresh is left
+func (s *Service) loadRetried(retry types.LoadRetry, err error) {
+	if err == nil {
+		s.logger.Info("Loaded %d servers after %d retries", len(s.serverMgr.GetServers()), retry.Attempt)
+		if s.serverMgr.GetCurrentServer() == nil {
+			s.detectCurrentServer()
+		}
+		s.mutex.Lock()
+		s.markReadyUnsafe()
+		s.mutex.Unlock()
+		s.bot.ReportResult(s.ctx, taskSubscriptionRefresh, nil)
+		return
+	}
+	if retry.At.IsZero() {
+		s.bot.Notify(s.ctx, notifications.EventErrorAlert, newNoticeFormatter().FormatLoadRetriesExhausted(retry.Attempt, err))
+	}
+}
+
+// detectCurrentServer re-syncs the stored current server with the xray configuration
+func (s *Service) detectCurrentServer() {
+	if err := s.serverMgr.DetectCurrentServer(); err != nil {
+		s.logger.Debug("Could not detect current server: %v", err)
+		return
+	}
+	currentServer := s.serverMgr.GetCurrentServer()
+	if currentServer != nil {
+		s.logger.Info("Detected current server: %s (%s match)", currentServer.Name, s.serverMgr.GetCurrentServerMatch())
+	}
+}
 func (s *Service) startHealthMonitoring() {
 	interval := time.Duration(s.config.HealthCheckInterval) * time.Second
 	s.healthTicker = time.NewTicker(interval)
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
-				s.logger.Error("Health monitoring goroutine panicked: %v", r)
+				s.logger.Error("Health monitoring goroutine panicked in %s: %v\n%s", version.String(), r, debug.Stack())
 			}
 		}()
 		for {
@@ -213,6 +469,95 @@ func (s *Service) startHealthMonitoring() {
 	}()
 	go s.performHealthCheck()
 }
+
+// startAvailabilityChecks pings all servers periodically, the results make up the
+// availability shown next to the latency
+func (s *Service) startAvailabilityChecks() {
+	jobs := scheduler.New(nil)
+	if maxLoad := s.config.GetBackground().MaxLoad; maxLoad > 0 {
+		s.logger.Info("Availability checks wait while the load average is %.2f or above", maxLoad)
+		jobs.SetLoadLimit(maxLoad)
+	}
+	jobs.Start(s.ctx, scheduler.Job{
+		Name:     "availability check",
+		Delay:    availabilityCheckDelay,
+		Interval: time.Duration(s.config.AvailabilityCheck) * time.Second,
+		Heavy:    true,
+		Run: func(ctx context.Context) {
+			err := s.serverMgr.CheckAvailability(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				s.logger.Warn("Availability check failed: %v", err)
+			} else if anomaly := s.serverMgr.CheckLatencyAnomaly(); anomaly != nil {
+				s.bot.AlertLatencyAnomaly(ctx, *anomaly)
+				s.mqtt.PublishEvent(mqtt.Event{
+					Type:   mqtt.EventLatencyAnomaly,
+					Server: anomaly.Server.Name,
+					Detail: fmt.Sprintf("%dms instead of %dms", anomaly.Current.Milliseconds(), anomaly.Baseline.Milliseconds()),
+				})
+			}
+			s.bot.ReportResult(ctx, taskAvailabilityCheck, err)
+		},
+	})
+}
+
+// startAddressChecks resolves the domain of the active server periodically and alerts
+// when it moved to other IP addresses
+func (s *Service) startAddressChecks() {
+	interval := time.Duration(s.config.AddressCheck) * time.Second
+	scheduler.New(nil).Start(s.ctx, scheduler.Job{
+		Name:     "address check",
+		Delay:    availabilityCheckDelay,
+		Interval: interval,
+		Run: func(ctx context.Context) {
+			change, err := s.serverMgr.CheckServerAddress(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				s.logger.Debug("Address check failed: %v", err)
+				return
+			}
+			if change != nil {
+				s.bot.AlertAddressChange(ctx, *change)
+			}
+		},
+	})
+}
+
+// startSubscriptionWatch reloads the servers when a local server list changed
+func (s *Service) startSubscriptionWatch() {
+	scheduler.New(nil).Start(s.ctx, scheduler.Job{
+		Name:     "subscription watch",
+		Delay:    subscriptionWatchInterval,
+		Interval: subscriptionWatchInterval,
+		Run: func(ctx context.Context) {
+			if !s.serverMgr.SubscriptionChanged() {
+				return
+			}
+			// A running ping test or switch is not disturbed, the change is picked
+			// up on a later check
+			_, release, err := s.serverMgr.Operations().Acquire(ctx, operations.OperationRefresh, 0, operations.PolicyReject)
+			if err != nil {
+				return
+			}
+			defer release()
+			s.logger.Info("Server list %s changed, reloading", s.config.SubscriptionURL)
+			err = s.serverMgr.RefreshServers(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				s.logger.Warn("Failed to reload servers: %v", err)
+			} else {
+				s.logger.Info("Reloaded %d servers", len(s.serverMgr.GetServers()))
+			}
+			s.bot.ReportResult(ctx, taskSubscriptionRefresh, err)
+		},
+	})
+}
 func (s *Service) performHealthCheck() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -228,10 +573,19 @@ func (s *Service) performHealthCheck() {
 		"status":  s.running,
 		"healthy": s.running,
 	}
+	checks["xray_process"] = s.checkXrayProcess()
+	configCheck := s.checkXrayConfigUnsafe()
+	checks["xray_config"] = configCheck
+	if !configCheck["healthy"].(bool) {
+		healthStatus["status"] = "unhealthy"
+	}
 	serverCheck := s.checkServerManager()
 	checks["server_manager"] = serverCheck
 	if !serverCheck["healthy"].(bool) {
 		healthStatus["status"] = "degraded"
+	} else {
+		// Servers may be loaded later via Telegram if the first load failed
+		s.markReadyUnsafe()
 	}
 	currentServer := s.serverMgr.GetCurrentServer()
 	if currentServer != nil {
@@ -240,6 +594,10 @@ func (s *Service) performHealthCheck() {
 		if !connectivityCheck["healthy"].(bool) {
 			healthStatus["status"] = "degraded"
 		}
+		s.announceConnectivityUnsafe(currentServer.Name, connectivityCheck["healthy"].(bool))
+		go s.reportRouterStatus(currentServer.Name, connectivityCheck["healthy"].(bool))
+		latency, _ := connectivityCheck["latency_ms"].(time.Duration)
+		s.mqtt.PublishHealth(*currentServer, connectivityCheck["healthy"].(bool), latency)
 	} else {
 		checks["current_server_connectivity"] = map[string]interface{}{
 			"status":  "no_server_selected",
@@ -247,7 +605,15 @@ func (s *Service) performHealthCheck() {
 		}
 	}
 	s.healthStatus = healthStatus
+	s.publishHealthUnsafe()
 	status := healthStatus["status"].(string)
+	s.alertHealthChangeUnsafe(status, checks)
+	if status == "healthy" {
+		if err := s.serverMgr.SaveGoldenConfig(); err != nil {
+			s.logger.Warn("Failed to save golden xray config: %v", err)
+		}
+	}
+	s.checkQuotaUnsafe()
 	switch status {
 	case "healthy":
 		// s.logger.Debug("Health check completed: %s", status)
@@ -257,6 +623,179 @@ func (s *Service) performHealthCheck() {
 		s.logger.Error("Health check completed: %s", status)
 	}
 }
+
+// alertHealthChangeUnsafe notifies when the health status changes, but not for the first check
+func (s *Service) alertHealthChangeUnsafe(status string, checks map[string]interface{}) {
+	previous := s.lastHealthState
+	s.lastHealthState = status
+	if previous == "" || previous == status {
+		return
+	}
+
+	var problems []string
+	for name, check := range checks {
+		result, ok := check.(map[string]interface{})
+		if !ok || result["healthy"] == true {
+			continue
+		}
+		if message, ok := result["message"].(string); ok {
+			problems = append(problems, message)
+		} else {
+			problems = append(problems, name)
+		}
+	}
+	sort.Strings(problems)
+
+	message := newNoticeFormatter().FormatHealthAlert(status, problems)
+	go s.bot.Notify(s.ctx, notifications.EventHealthAlert, message)
+	if previous == "healthy" {
+		go s.runHealthHook(status, problems)
+	}
+}
+
+// runHealthHook runs the on_health_degraded hook script when the health got worse
+func (s *Service) runHealthHook(status string, problems []string) {
+	env := map[string]string{
+		"XRAY_HEALTH_STATUS":   status,
+		"XRAY_HEALTH_PROBLEMS": strings.Join(problems, "; "),
+	}
+	if current := s.serverMgr.GetCurrentServer(); current != nil {
+		env["XRAY_SERVER_ID"] = current.ID
+		env["XRAY_SERVER_NAME"] = current.Name
+		env["XRAY_SERVER_ADDRESS"] = current.Address
+		env["XRAY_SERVER_PORT"] = strconv.Itoa(current.Port)
+	}
+	result, ok := s.serverMgr.Hooks().Run(s.ctx, hooks.HealthDegraded, env)
+	if ok && result.Err != nil {
+		s.logger.Warn("Hook %s failed: %v, output: %s", result.Script, result.Err, result.Output)
+	}
+}
+
+// announceConnectivityUnsafe tells the notification chats when the current server
+// stops or starts answering again
+func (s *Service) announceConnectivityUnsafe(serverName string, healthy bool) {
+	if healthy == !s.vpnDownAnnounced {
+		return
+	}
+	s.vpnDownAnnounced = !healthy
+	formatter := newNoticeFormatter()
+	notice := formatter.FormatVPNRestoredNotice(serverName)
+	if !healthy {
+		notice = formatter.FormatVPNDownNotice(serverName)
+	}
+	go s.bot.Announce(s.ctx, notice)
+}
+
+// reportRouterStatus shows the state of the VPN in the router syslog and on its LED,
+// every check reports so the LED is also set after a restart
+func (s *Service) reportRouterStatus(serverName string, healthy bool) {
+	changed, err := s.routerStatus.Report(s.ctx, healthy, serverName)
+	if err != nil {
+		s.logger.Warn("Failed to show the VPN state on the router: %v", err)
+	} else if changed {
+		s.logger.Debug("VPN state shown on the router: healthy=%t", healthy)
+	}
+}
+
+// checkQuotaUnsafe warns when the subscription traffic runs low or the subscription
+// is about to expire. The warning is sent once until the situation changes.
+func (s *Service) checkQuotaUnsafe() {
+	info := s.serverMgr.GetSubscriptionInfo()
+	if info == nil {
+		return
+	}
+
+	lowQuota := false
+	if remaining := info.Remaining(); remaining >= 0 {
+		lowQuota = remaining*100 < info.Total*int64(s.config.QuotaWarningPercent)
+	}
+	reminder := 0
+	if expiresAt := info.ExpiresAt(); !expiresAt.IsZero() {
+		reminder = expiryReminder(expiresAt, s.config.ExpiryReminderDays)
+	}
+	expiring := reminder > 0
+
+	// Every reminder day passed sends the warning again
+	state := ""
+	if lowQuota || expiring {
+		state = fmt.Sprintf("%t/%d/%d/%d", lowQuota, reminder, info.Total, info.Expire)
+	}
+	if state == s.quotaWarningState {
+		return
+	}
+	s.quotaWarningState = state
+	if state == "" {
+		return
+	}
+
+	s.logger.Warn("Subscription quota warning: low traffic %t, expiring %t", lowQuota, expiring)
+	message := newNoticeFormatter().FormatQuotaWarning(info, lowQuota, expiring)
+	go s.bot.Notify(s.ctx, notifications.EventQuotaWarning, message)
+}
+
+// expiryReminder returns the smallest of the reminder days the subscription expires
+// within, or 0 when no reminder is due yet
+func expiryReminder(expiresAt time.Time, reminderDays []int) int {
+	left := time.Until(expiresAt)
+	reminder := 0
+	for _, days := range reminderDays {
+		if left < time.Duration(days)*24*time.Hour && (reminder == 0 || days < reminder) {
+			reminder = days
+		}
+	}
+	return reminder
+}
+
+// checkXrayConfigUnsafe checks that the xray config parses and prompts the admin to
+// recover it once per problem
+func (s *Service) checkXrayConfigUnsafe() map[string]interface{} {
+	result := map[string]interface{}{
+		"healthy": true,
+		"status":  "valid",
+	}
+	err := s.serverMgr.CheckXrayConfig()
+	if err == nil {
+		if s.configProblem != "" {
+			s.logger.Info("Xray config is valid again")
+		}
+		s.configProblem = ""
+		return result
+	}
+
+	problem := err.Error()
+	result["healthy"] = false
+	result["status"] = "corrupted"
+	result["message"] = "xray config: " + problem
+	if problem != s.configProblem {
+		s.configProblem = problem
+		s.logger.Error("Xray config %s is corrupted: %v", s.config.ConfigPath, err)
+		go s.bot.PromptConfigRecovery(s.ctx, problem)
+	}
+	return result
+}
+
+// checkXrayProcess tracks the xray PID and re-detects the current server when xray
+// was restarted outside of the bot (e.g. by the router or another tool)
+func (s *Service) checkXrayProcess() map[string]interface{} {
+	result := map[string]interface{}{
+		"healthy": true,
+		"status":  "running",
+	}
+	pid, err := s.serverMgr.GetXrayPID()
+	if err != nil {
+		result["status"] = "unknown"
+		result["message"] = err.Error()
+		return result
+	}
+	result["pid"] = pid
+	if s.lastXrayPID != 0 && s.lastXrayPID != pid {
+		s.logger.Info("Xray restarted (pid %d -> %d), re-detecting current server", s.lastXrayPID, pid)
+		result["restarted"] = true
+		s.detectCurrentServer()
+	}
+	s.lastXrayPID = pid
+	return result
+}
 func (s *Service) checkServerManager() map[string]interface{} {
 	result := map[string]interface{}{
 		"healthy": true,
@@ -0,0 +1,218 @@
+package telegram
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+	"xray-telegram-manager/config"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// Permission is the level of access an action requires
+type Permission int
+
+const (
+	// PermissionView covers read-only views: menus, server list and status
+	PermissionView Permission = iota
+	// PermissionControl covers ping tests, refresh, switching and direct mode
+	PermissionControl
+	// PermissionAdmin covers updates, backups and restores
+	PermissionAdmin
+)
+
+// memberCacheTTL is how long a group membership lookup for a private chat is trusted
+const memberCacheTTL = 5 * time.Minute
+
+type memberCacheEntry struct {
+	member    bool
+	expiresAt time.Time
+}
+
+// chatTopics remembers the forum topic each group chat was last used from,
+// so replies go back to the topic the command came from
+type chatTopics struct {
+	mutex  sync.RWMutex
+	topics map[int64]int
+}
+
+func newChatTopics() *chatTopics {
+	return &chatTopics{topics: make(map[int64]int)}
+}
+
+// middleware records the topic of incoming messages and button presses
+func (ct *chatTopics) middleware(next bot.HandlerFunc) bot.HandlerFunc {
+	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		var message *models.Message
+		if update.Message != nil {
+			message = update.Message
+		} else if update.CallbackQuery != nil {
+			message = update.CallbackQuery.Message.Message
+		}
+		if message != nil && message.Chat.Type == "supergroup" {
+			topicID := 0
+			if message.IsTopicMessage {
+				topicID = message.MessageThreadID
+			}
+			ct.mutex.Lock()
+			ct.topics[message.Chat.ID] = topicID
+			ct.mutex.Unlock()
+		}
+		next(ctx, b, update)
+	}
+}
+func (ct *chatTopics) get(chatID int64) int {
+	ct.mutex.RLock()
+	defer ct.mutex.RUnlock()
+	return ct.topics[chatID]
+}
+
+// isAllowedChat reports whether chatID is one of the configured admin groups
+func (tb *TelegramBot) isAllowedChat(chatID int64) bool {
+	for _, allowed := range tb.config.GetGroupConfig().AllowedChatIDs {
+		if allowed == chatID {
+			return true
+		}
+	}
+	return false
+}
+
+// userRole returns the role of userID acting in chatID, or "" when the user has no access.
+// The admin has full access everywhere. Members of the configured groups get their mapped
+// role inside the group, and in a private chat once their membership is confirmed.
+func (tb *TelegramBot) userRole(ctx context.Context, chatID, userID int64) string {
+	if userID == tb.config.GetAdminID() {
+		return config.RoleAdmin
+	}
+
+	groupCfg := tb.config.GetGroupConfig()
+	if len(groupCfg.AllowedChatIDs) == 0 {
+		return ""
+	}
+	if chatID != userID && !tb.isAllowedChat(chatID) {
+		return ""
+	}
+	if chatID == userID && !tb.isGroupMember(ctx, userID) {
+		return ""
+	}
+
+	if role, ok := groupCfg.Roles[userID]; ok {
+		return role
+	}
+	return groupCfg.DefaultRole
+}
+
+// isGroupMember checks whether userID belongs to any of the configured groups
+func (tb *TelegramBot) isGroupMember(ctx context.Context, userID int64) bool {
+	tb.memberMutex.Lock()
+	entry, cached := tb.memberCache[userID]
+	tb.memberMutex.Unlock()
+	if cached && time.Now().Before(entry.expiresAt) {
+		return entry.member
+	}
+
+	member := false
+	for _, chatID := range tb.config.GetGroupConfig().AllowedChatIDs {
+		chatMember, err := tb.bot.GetChatMember(ctx, &bot.GetChatMemberParams{ChatID: chatID, UserID: userID})
+		if err != nil {
+			tb.logger.Debug("Failed to get membership of user %d in chat %d: %v", userID, chatID, err)
+			continue
+		}
+		if isActiveMember(chatMember) {
+			member = true
+			break
+		}
+	}
+
+	tb.memberMutex.Lock()
+	tb.memberCache[userID] = memberCacheEntry{member: member, expiresAt: time.Now().Add(memberCacheTTL)}
+	tb.memberMutex.Unlock()
+	return member
+}
+func isActiveMember(chatMember *models.ChatMember) bool {
+	switch chatMember.Type {
+	case models.ChatMemberTypeOwner, models.ChatMemberTypeAdministrator, models.ChatMemberTypeMember:
+		return true
+	case models.ChatMemberTypeRestricted:
+		return chatMember.Restricted != nil && chatMember.Restricted.IsMember
+	}
+	return false
+}
+
+// roleAllows reports whether role grants the permission
+func roleAllows(role string, permission Permission) bool {
+	switch role {
+	case config.RoleAdmin:
+		return true
+	case config.RoleOperator:
+		return permission <= PermissionControl
+	case config.RoleViewer:
+		return permission == PermissionView
+	}
+	return false
+}
+
+// isAuthorized reports whether userID may perform an action with the given permission in chatID
+func (tb *TelegramBot) isAuthorized(ctx context.Context, chatID, userID int64, permission Permission) bool {
+	return roleAllows(tb.userRole(ctx, chatID, userID), permission)
+}
+
+// callbackPermission returns the permission required by a callback action
+func callbackPermission(data string) Permission {
+	switch {
+	case data == "confirm_update", data == "update_log", strings.HasPrefix(data, "restore_"), strings.HasPrefix(data, "update_script_"), strings.HasPrefix(data, "notify_"),
+		strings.HasPrefix(data, "settings_"), strings.HasPrefix(data, "routing_"), strings.HasPrefix(data, "inbounds_"),
+		strings.HasPrefix(data, "recover_"), strings.HasPrefix(data, "xraylogs_"), strings.HasPrefix(data, "changes_"), strings.HasPrefix(data, "profiles_"):
+		return PermissionAdmin
+	case data == "refresh", data == "ping_test", data == "switch_previous", data == "panic_confirm",
+		strings.HasPrefix(data, "ping_scope_"), strings.HasPrefix(data, "ping_profile_"), strings.HasPrefix(data, "favorite_"), strings.HasPrefix(data, "note_"),
+		strings.HasPrefix(data, "compare_"), strings.HasPrefix(data, "reach_"), strings.HasPrefix(data, "schedule_"), strings.HasPrefix(data, "pending_cancel_"), strings.HasPrefix(data, "direct_mode_"), strings.HasPrefix(data, "confirm_"), strings.HasPrefix(data, "server_"), strings.HasPrefix(data, "blockedok_"):
+		return PermissionControl
+	}
+	return PermissionView
+}
+
+// topicFor returns the forum topic a new message of messageType should be sent to in chatID.
+// Status messages and alerts go to their configured topics, everything else to the topic
+// the chat was last used from.
+func (tb *TelegramBot) topicFor(chatID int64, messageType MessageType) int {
+	if !tb.isAllowedChat(chatID) {
+		return 0
+	}
+	groupCfg := tb.config.GetGroupConfig()
+	switch {
+	case messageType == MessageTypeStatus && groupCfg.StatusTopicID != 0:
+		return groupCfg.StatusTopicID
+	case messageType == MessageTypeAlert && groupCfg.AlertsTopicID != 0:
+		return groupCfg.AlertsTopicID
+	}
+	return tb.topics.get(chatID)
+}
+
+// commandMatcher matches a command with or without the @botname suffix used in groups
+func (tb *TelegramBot) commandMatcher(command string, prefix bool) bot.MatchFunc {
+	return func(update *models.Update) bool {
+		if update.Message == nil {
+			return false
+		}
+		return tb.matchesCommand(update.Message.Text, command, prefix)
+	}
+}
+
+// matchesCommand reports whether text, a message or a document caption, is command
+func (tb *TelegramBot) matchesCommand(text, command string, prefix bool) bool {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return false
+	}
+	name, mention, hasMention := strings.Cut(fields[0], "@")
+	if hasMention && tb.username != "" && !strings.EqualFold(mention, tb.username) {
+		return false
+	}
+	if name != command {
+		return false
+	}
+	return prefix || len(fields) == 1
+}
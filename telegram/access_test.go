@@ -0,0 +1,28 @@
+package telegram
+
+import (
+	"testing"
+	"xray-telegram-manager/config"
+)
+
+func TestCallbackPermission(t *testing.T) {
+	for data, expected := range map[string]Permission{
+		"main_menu":        PermissionView,
+		"status":           PermissionView,
+		"server_abc":       PermissionControl,
+		"confirm_abc":      PermissionControl,
+		"blockedok_abc":    PermissionControl,
+		"blockedok_abc_v3": PermissionControl,
+		"confirm_update":   PermissionAdmin,
+		"recover_backup":   PermissionAdmin,
+		"changes_page_1":   PermissionAdmin,
+		"profiles_save":    PermissionAdmin,
+	} {
+		if permission := callbackPermission(data); permission != expected {
+			t.Errorf("Expected permission %d for %s, got %d", expected, data, permission)
+		}
+	}
+	if roleAllows(config.RoleViewer, callbackPermission("blockedok_abc")) {
+		t.Error("A viewer must not confirm a switch to a blocked country")
+	}
+}
@@ -0,0 +1,21 @@
+package telegram
+
+import (
+	"context"
+	"xray-telegram-manager/notifications"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot/models"
+)
+
+// AlertAddressChange tells that the domain of the active server resolves to other IP
+// addresses now, with a button testing the server again
+func (tb *TelegramBot) AlertAddressChange(ctx context.Context, change types.AddressChange) {
+	keyboard := &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+		{
+			{Text: "🏓 Re-test", CallbackData: callbackServerID("ping_scope_srv_", change.Server.ID)},
+			{Text: "📊 Status", CallbackData: "status"},
+		},
+	}}
+	tb.notify(ctx, notifications.EventAddressChange, NewMessageFormatter().FormatAddressChange(change), keyboard)
+}
@@ -0,0 +1,223 @@
+package telegram
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// baseUpdateInterval is the minimum delay between progress edits of one message
+	baseUpdateInterval = time.Second
+	// maxUpdateInterval caps the adaptive delay after flood limits
+	maxUpdateInterval = 30 * time.Second
+	// backoffDecayPeriod is how long the API must stay quiet before the delay is lowered again
+	backoffDecayPeriod = time.Minute
+)
+
+var (
+	statusCodeRegex = regexp.MustCompile(`statusCode (\d{3})`)
+	retryAfterRegex = regexp.MustCompile(`retry[ _]after"?:? ?(\d+)`)
+	// Request URLs in transport errors contain the bot token
+	botTokenURLRegex = regexp.MustCompile(`bot\d+:[A-Za-z0-9_-]+`)
+)
+
+// apiErrorBody is the error response of the Bot API, which go-telegram/bot puts into
+// the error text of calls that did not return HTTP 200
+type apiErrorBody struct {
+	ErrorCode  int `json:"error_code"`
+	Parameters struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// APIMethodStats holds counters for a single Telegram API method
+type APIMethodStats struct {
+	Calls       int64
+	Failures    int64
+	RateLimited int64
+	ServerError int64
+}
+
+// APIStats is a snapshot of Telegram API error counters
+type APIStats struct {
+	Methods         map[string]APIMethodStats
+	LastError       string
+	LastErrorAt     time.Time
+	LastRateLimitAt time.Time
+	UpdateInterval  time.Duration
+	// FloodUntil is when the retry_after of the last flood limit ends
+	FloodUntil time.Time
+}
+
+// TotalFailures returns the number of failed calls over all methods
+func (s APIStats) TotalFailures() int64 {
+	var total int64
+	for _, method := range s.Methods {
+		total += method.Failures
+	}
+	return total
+}
+
+// TotalRateLimited returns the number of 429 responses over all methods
+func (s APIStats) TotalRateLimited() int64 {
+	var total int64
+	for _, method := range s.Methods {
+		total += method.RateLimited
+	}
+	return total
+}
+
+// APIErrorTracker counts Telegram API failures and adapts the message update
+// interval when flood limits are hit
+type APIErrorTracker struct {
+	mutex           sync.Mutex
+	methods         map[string]*APIMethodStats
+	lastError       string
+	lastErrorAt     time.Time
+	lastRateLimitAt time.Time
+	updateInterval  time.Duration
+	// floodUntil is when the last retry_after of Telegram ends
+	floodUntil time.Time
+}
+
+// NewAPIErrorTracker creates a new APIErrorTracker instance
+func NewAPIErrorTracker() *APIErrorTracker {
+	return &APIErrorTracker{
+		methods:        make(map[string]*APIMethodStats),
+		updateInterval: baseUpdateInterval,
+	}
+}
+
+// Record registers the outcome of an API call. For rate limited calls it returns
+// the delay requested by Telegram, or zero when none was given.
+func (t *APIErrorTracker) Record(method string, err error) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stats, exists := t.methods[method]
+	if !exists {
+		stats = &APIMethodStats{}
+		t.methods[method] = stats
+	}
+	stats.Calls++
+
+	if err == nil {
+		t.decayUnsafe()
+		return 0
+	}
+
+	stats.Failures++
+	t.lastError = botTokenURLRegex.ReplaceAllString(err.Error(), "bot***")
+	t.lastErrorAt = time.Now()
+
+	statusCode, retryAfter := parseAPIError(err)
+	switch {
+	case statusCode == 429:
+		stats.RateLimited++
+		t.lastRateLimitAt = time.Now()
+		if until := t.lastRateLimitAt.Add(retryAfter); until.After(t.floodUntil) {
+			t.floodUntil = until
+		}
+		t.raiseUnsafe(retryAfter)
+		return retryAfter
+	case statusCode >= 500:
+		stats.ServerError++
+	}
+	return 0
+}
+
+// FloodWait returns how long Telegram still wants no requests after a 429 response
+// with retry_after, zero when requests may be sent
+func (t *APIErrorTracker) FloodWait() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if wait := time.Until(t.floodUntil); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// UpdateInterval returns the current minimum delay between edits of a progress message
+func (t *APIErrorTracker) UpdateInterval() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.decayUnsafe()
+	return t.updateInterval
+}
+
+// Stats returns a snapshot of the counters
+func (t *APIErrorTracker) Stats() APIStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	methods := make(map[string]APIMethodStats, len(t.methods))
+	for name, stats := range t.methods {
+		methods[name] = *stats
+	}
+	return APIStats{
+		Methods:         methods,
+		LastError:       t.lastError,
+		LastErrorAt:     t.lastErrorAt,
+		LastRateLimitAt: t.lastRateLimitAt,
+		UpdateInterval:  t.updateInterval,
+		FloodUntil:      t.floodUntil,
+	}
+}
+
+// raiseUnsafe doubles the update interval, and respects retry_after when it is longer
+func (t *APIErrorTracker) raiseUnsafe(retryAfter time.Duration) {
+	interval := t.updateInterval * 2
+	if retryAfter > interval {
+		interval = retryAfter
+	}
+	if interval > maxUpdateInterval {
+		interval = maxUpdateInterval
+	}
+	t.updateInterval = interval
+}
+
+// decayUnsafe halves the update interval for every quiet period since the last flood limit
+func (t *APIErrorTracker) decayUnsafe() {
+	if t.updateInterval <= baseUpdateInterval || time.Since(t.lastRateLimitAt) < backoffDecayPeriod {
+		return
+	}
+	t.updateInterval /= 2
+	if t.updateInterval < baseUpdateInterval {
+		t.updateInterval = baseUpdateInterval
+	}
+	// Require another quiet period before the next step down
+	t.lastRateLimitAt = time.Now()
+}
+
+// parseAPIError extracts the HTTP status code and retry_after from a go-telegram/bot
+// error. The response body in the error text is used when present, e.g.
+// `unexpected response statusCode 429 for method sendMessage, {"ok":false,...}`.
+func parseAPIError(err error) (int, time.Duration) {
+	message := err.Error()
+
+	var body apiErrorBody
+	if start := strings.Index(message, "{"); start >= 0 {
+		_ = json.Unmarshal([]byte(message[start:]), &body)
+	}
+
+	statusCode := body.ErrorCode
+	if match := statusCodeRegex.FindStringSubmatch(message); match != nil {
+		statusCode, _ = strconv.Atoi(match[1])
+	} else if statusCode == 0 && strings.Contains(strings.ToLower(message), "too many requests") {
+		statusCode = 429
+	}
+
+	retryAfter := time.Duration(body.Parameters.RetryAfter) * time.Second
+	if retryAfter == 0 {
+		if match := retryAfterRegex.FindStringSubmatch(strings.ToLower(message)); match != nil {
+			if seconds, err := strconv.Atoi(match[1]); err == nil {
+				retryAfter = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return statusCode, retryAfter
+}
@@ -0,0 +1,94 @@
+package telegram
+
+import (
+	"context"
+	"path/filepath"
+	"xray-telegram-manager/audit"
+	"xray-telegram-manager/notifications"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// statsRecentActions is how many of the latest actions /stats lists
+const statsRecentActions = 10
+
+// auditPath returns where the audit log is stored, next to the manager config
+func auditPath(config ConfigProvider) string {
+	configFile := config.GetConfigFilePath()
+	if configFile == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(configFile), "audit.json")
+}
+
+// recordAction saves who started a switch or update. In group mode the other admins
+// are told about it, chatID is where the action happened and gets no notice.
+func (tb *TelegramBot) recordAction(ctx context.Context, chatID int64, user *models.User, action audit.Action, detail string) {
+	tb.recordEntry(ctx, chatID, user, audit.Entry{Action: action, Detail: detail})
+}
+
+// recordSwitch saves who switched to the server and why, /status shows it as the
+// time the server became active
+func (tb *TelegramBot) recordSwitch(ctx context.Context, chatID int64, user *models.User, serverName, reason string) {
+	tb.recordEntry(ctx, chatID, user, audit.Entry{Action: audit.ActionSwitch, Detail: serverName, Reason: reason})
+}
+
+func (tb *TelegramBot) recordEntry(ctx context.Context, chatID int64, user *models.User, entry audit.Entry) {
+	if user == nil {
+		return
+	}
+	action := entry.Action
+	entry.UserID, entry.User = user.ID, getUsername(user)
+	if err := tb.audit.Record(entry); err != nil {
+		tb.logger.Error("Failed to record %s by user %d: %v", action, user.ID, err)
+	}
+
+	if len(tb.config.GetGroupConfig().AllowedChatIDs) == 0 {
+		return
+	}
+	pref := tb.notifications.Get(notifications.EventAdminAction)
+	if !pref.Enabled {
+		tb.logger.Debug("Skipping %s notification, disabled by preferences", notifications.EventAdminAction)
+		return
+	}
+	silent := pref.Silent || tb.scheduler.InQuietHours()
+	tb.broadcastExcept(ctx, NewMessageFormatter().FormatActionNotice(entry), silent, nil, chatID)
+	tb.logger.Info("Told other admins about the %s by user %d (silent: %t)", action, user.ID, silent)
+}
+
+// activeSince returns the latest switch when it was to server, the time and reason
+// the server became active. Switches from the web dashboard or the command line are
+// not recorded, then nil is returned.
+func (tb *TelegramBot) activeSince(server *types.Server) *audit.Entry {
+	entry, ok := tb.audit.LastSwitch()
+	if !ok || entry.Detail != server.Name {
+		return nil
+	}
+	return &entry
+}
+
+// handleStats shows how many switches and updates each user started
+func (tb *TelegramBot) handleStats(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	tb.logger.Info("Received /stats command from user %d (%s)", userID, username)
+
+	if !tb.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionAdmin) {
+		tb.logger.Warn("Unauthorized access attempt from user %d (%s) for /stats command", userID, username)
+		tb.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/stats")
+		return
+	}
+
+	content := MessageContent{
+		Text: NewMessageFormatter().FormatActionStats(tb.audit.Users(), tb.audit.Recent(statsRecentActions)),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: "🏠 Main Menu", CallbackData: "main_menu"}},
+		}},
+		Type: MessageTypeMenu,
+	}
+	if err := tb.messageManager.SendNew(ctx, update.Message.Chat.ID, content); err != nil {
+		tb.logger.Error("Failed to send action statistics: %v", err)
+	}
+}
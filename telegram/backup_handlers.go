@@ -0,0 +1,267 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"xray-telegram-manager/audit"
+	"xray-telegram-manager/backup"
+	"xray-telegram-manager/operations"
+	"xray-telegram-manager/version"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// restoreSessionTimeout is how long the bot waits for an archive after /restore
+const restoreSessionTimeout = 10 * time.Minute
+
+// restoreSession tracks a /restore flow: waiting for an archive, then for confirmation
+type restoreSession struct {
+	expiresAt time.Time
+	archive   *backup.Archive
+}
+
+func (ch *CommandHandlers) backupPaths() backup.Paths {
+	return backup.Paths{
+		ConfigFile:   ch.bot.config.GetConfigFilePath(),
+		ServersCache: ch.bot.serverMgr.GetCacheFile(),
+		Overrides:    ch.bot.serverMgr.GetOverridesFile(),
+		Stats:        ch.bot.serverMgr.GetStatsFile(),
+	}
+}
+
+// handleBackup sends the manager state as a tar.gz document. "/backup full" keeps
+// the bot token, admin ID and other secrets in the archived config, by default they
+// are removed.
+func (ch *CommandHandlers) handleBackup(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	ch.bot.logger.Info("Received /backup command from user %d (%s)", userID, username)
+
+	if !ch.bot.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionAdmin) {
+		ch.bot.logger.Warn("Unauthorized access attempt from user %d (%s) for /backup command", userID, username)
+		ch.bot.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/backup")
+		return
+	}
+
+	if !ch.bot.allowRequest(ctx, update.Message.Chat.ID, userID, RequestCommand) {
+		ch.bot.logger.Warn("Rate limit exceeded for user %d (%s)", userID, username)
+		ch.sendRateLimitMessage(ctx, b, update.Message.Chat.ID)
+		return
+	}
+
+	fields := strings.Fields(update.Message.Text)
+	redact := !(len(fields) > 1 && fields[1] == "full")
+
+	opts := backup.Options{
+		Redact:     redact,
+		AppVersion: version.Version,
+	}
+	if currentServer := ch.bot.serverMgr.GetCurrentServer(); currentServer != nil {
+		opts.State = backup.State{CurrentServerID: currentServer.ID, CurrentServerName: currentServer.Name}
+	}
+
+	var archive bytes.Buffer
+	manifest, err := backup.Create(&archive, ch.backupPaths(), opts)
+	if err != nil {
+		ch.bot.logger.Error("Failed to create backup: %v", err)
+		ch.sendErrorMessage(ctx, b, update.Message.Chat.ID, "Backup Failed", err.Error(), "main_menu")
+		return
+	}
+
+	filename := fmt.Sprintf("xray-manager-backup-%s.tar.gz", manifest.CreatedAt.Format("20060102-150405"))
+	_, err = b.SendDocument(ctx, &bot.SendDocumentParams{
+		ChatID:          update.Message.Chat.ID,
+		MessageThreadID: ch.bot.topicFor(update.Message.Chat.ID, MessageTypeMenu),
+		Document:        &models.InputFileUpload{Filename: filename, Data: &archive},
+		Caption:         ch.messageFormatter.FormatBackupCaption(manifest),
+	})
+	if err != nil {
+		ch.bot.logger.Error("Failed to send backup document: %v", err)
+		return
+	}
+	ch.bot.logger.Info("Sent backup %s to user %d (redacted: %t)", filename, userID, redact)
+}
+
+// handleRestore starts the restore flow and waits for the archive document
+func (ch *CommandHandlers) handleRestore(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	ch.bot.logger.Info("Received /restore command from user %d (%s)", userID, username)
+
+	if !ch.bot.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionAdmin) {
+		ch.bot.logger.Warn("Unauthorized access attempt from user %d (%s) for /restore command", userID, username)
+		ch.bot.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/restore")
+		return
+	}
+
+	ch.restoreMutex.Lock()
+	ch.restoreSessions[update.Message.Chat.ID] = &restoreSession{expiresAt: time.Now().Add(restoreSessionTimeout)}
+	ch.restoreMutex.Unlock()
+
+	message := "♻️ Restore Backup\n\n" +
+		"📎 Send the backup archive (.tar.gz) created by /backup as a document.\n\n" +
+		fmt.Sprintf("⏱️ Waiting for %d minutes", int(restoreSessionTimeout.Minutes()))
+
+	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          update.Message.Chat.ID,
+		MessageThreadID: ch.bot.topicFor(update.Message.Chat.ID, MessageTypeMenu),
+		Text:            message,
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: "❌ Cancel", CallbackData: "restore_cancel"}},
+		}},
+	})
+	if err != nil {
+		ch.bot.logger.Error("Failed to send restore instructions: %v", err)
+	}
+}
+
+// isRestoreDocument matches documents sent to a chat while a restore is pending there
+func (ch *CommandHandlers) isRestoreDocument(update *models.Update) bool {
+	if update.Message == nil || update.Message.Document == nil || update.Message.From == nil {
+		return false
+	}
+	ch.restoreMutex.Lock()
+	defer ch.restoreMutex.Unlock()
+	session, exists := ch.restoreSessions[update.Message.Chat.ID]
+	return exists && time.Now().Before(session.expiresAt)
+}
+
+// handleRestoreDocument downloads and validates the archive, then asks for confirmation
+func (ch *CommandHandlers) handleRestoreDocument(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	chatID := update.Message.Chat.ID
+	if !ch.bot.isAuthorized(ctx, chatID, userID, PermissionAdmin) {
+		ch.bot.rejectUnauthorized(ctx, b, chatID, update.Message.From, "restore archive")
+		return
+	}
+
+	document := update.Message.Document
+	ch.bot.logger.Info("Received restore archive %s (%d bytes) from user %d", document.FileName, document.FileSize, userID)
+
+	if document.FileSize > backup.MaxArchiveSize {
+		ch.sendErrorMessage(ctx, b, chatID, "Restore Failed",
+			fmt.Sprintf("The archive is too large (%d bytes)", document.FileSize), "main_menu")
+		return
+	}
+
+	archive, err := ch.downloadBackup(ctx, b, document.FileID)
+	if err == nil {
+		err = archive.Validate(ch.backupPaths())
+	}
+	if err != nil {
+		ch.bot.logger.Warn("Rejected restore archive from user %d: %v", userID, err)
+		ch.sendErrorMessage(ctx, b, chatID, "Invalid Backup", err.Error(), "main_menu")
+		return
+	}
+
+	ch.restoreMutex.Lock()
+	ch.restoreSessions[chatID] = &restoreSession{expiresAt: time.Now().Add(restoreSessionTimeout), archive: archive}
+	ch.restoreMutex.Unlock()
+
+	_, err = b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          chatID,
+		MessageThreadID: ch.bot.topicFor(chatID, MessageTypeMenu),
+		Text:            ch.messageFormatter.FormatRestoreConfirmation(&archive.Manifest),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: "✅ Yes, Restore", CallbackData: "restore_confirm"}},
+			{{Text: "❌ Cancel", CallbackData: "restore_cancel"}},
+		}},
+	})
+	if err != nil {
+		ch.bot.logger.Error("Failed to send restore confirmation: %v", err)
+	}
+}
+func (ch *CommandHandlers) downloadBackup(ctx context.Context, b *bot.Bot, fileID string) (*backup.Archive, error) {
+	file, err := b.GetFile(ctx, &bot.GetFileParams{FileID: fileID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	downloadCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	resp, err := ch.bot.httpClient.Get(downloadCtx, b.FileDownloadLink(file))
+	if err != nil {
+		// The download link contains the bot token, do not leak it through the error
+		return nil, fmt.Errorf("failed to download archive")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download archive: HTTP %d", resp.StatusCode)
+	}
+	return backup.Open(resp.Body)
+}
+
+// handleRestoreConfirm applies the pending archive and switches back to the saved server
+func (ch *CommandHandlers) handleRestoreConfirm(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string, initiator *models.User) {
+	ch.restoreMutex.Lock()
+	session, exists := ch.restoreSessions[chatID]
+	delete(ch.restoreSessions, chatID)
+	ch.restoreMutex.Unlock()
+
+	if !exists || session.archive == nil || time.Now().After(session.expiresAt) {
+		ch.bot.alertCallback(ctx, callbackQueryID, "❌ No pending restore, use /restore again")
+		return
+	}
+
+	_, release, ok := ch.bot.beginOperation(ctx, chatID, callbackQueryID, operations.OperationRestore)
+	if !ok {
+		return
+	}
+	defer release()
+
+	ch.bot.answerCallback(ctx, callbackQueryID, "♻️ Restoring...")
+
+	restored, err := session.archive.Apply(ch.backupPaths())
+	if err != nil {
+		ch.bot.logger.Error("Restore failed for user %d: %v", chatID, err)
+		ch.sendErrorMessage(ctx, b, chatID, "Restore Failed", err.Error(), "main_menu")
+		return
+	}
+	ch.bot.logger.Info("Restored %s for user %d", strings.Join(restored, ", "), chatID)
+	ch.bot.serverMgr.ReloadState()
+	ch.bot.listCache.invalidate()
+
+	var switchNote string
+	state := session.archive.Manifest.State
+	if state.CurrentServerID != "" {
+		currentServer := ch.bot.serverMgr.GetCurrentServer()
+		if currentServer == nil || currentServer.ID != state.CurrentServerID {
+			if err := ch.bot.serverMgr.SwitchServer(ctx, state.CurrentServerID); err != nil {
+				ch.bot.logger.Warn("Failed to switch to restored server %s: %v", state.CurrentServerID, err)
+				switchNote = fmt.Sprintf("⚠️ Could not switch to %s: %v", state.CurrentServerName, err)
+			} else {
+				ch.bot.listCache.invalidate()
+				if restoredServer := ch.bot.serverMgr.GetCurrentServer(); restoredServer != nil {
+					ch.bot.recordSwitch(ctx, chatID, initiator, restoredServer.Name, audit.ReasonRestore)
+				}
+				switchNote = fmt.Sprintf("🔗 Switched to %s", state.CurrentServerName)
+			}
+		}
+	}
+
+	message := ch.messageFormatter.FormatRestoreComplete(restored, switchNote)
+	_, err = b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          chatID,
+		MessageThreadID: ch.bot.topicFor(chatID, MessageTypeMenu),
+		Text:            message,
+		ReplyMarkup:     ch.navigationHelper.CreateMainMenuKeyboard(),
+	})
+	if err != nil {
+		ch.bot.logger.Error("Failed to send restore result: %v", err)
+	}
+}
+
+// handleRestoreCancel drops the pending restore session
+func (ch *CommandHandlers) handleRestoreCancel(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
+	ch.restoreMutex.Lock()
+	delete(ch.restoreSessions, chatID)
+	ch.restoreMutex.Unlock()
+
+	ch.bot.answerCallback(ctx, callbackQueryID, "❌ Restore cancelled")
+	ch.bot.logger.Info("Restore cancelled by user %d", chatID)
+}
@@ -2,15 +2,30 @@ package telegram
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
+	"xray-telegram-manager/audit"
+	"xray-telegram-manager/clock"
+	"xray-telegram-manager/fallback"
+	"xray-telegram-manager/httpclient"
+	"xray-telegram-manager/notifications"
+	"xray-telegram-manager/operations"
+	"xray-telegram-manager/pending"
+	"xray-telegram-manager/profiles"
+	"xray-telegram-manager/scheduler"
+	"xray-telegram-manager/security"
 	"xray-telegram-manager/types"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 )
 
+// serversPerPage is how many servers one page of the server list shows
+const serversPerPage = 32
+
 type TelegramBot struct {
 	bot                 *bot.Bot
 	config              ConfigProvider
@@ -20,12 +35,37 @@ type TelegramBot struct {
 	handlers            *CommandHandlers
 	messageManager      *MessageManager
 	buttonTextProcessor *ButtonTextProcessor
-
-	// Rate limiting for ping progress updates
-	lastPingUpdate  map[int64]time.Time
-	pingUpdateMutex sync.RWMutex
-	// Aggregated logging for skipped ping updates
-	pingSkipCount map[int64]int
+	listCache           *listPageCache
+	conversations       *ConversationManager
+	inflight            *inflightCallbacks
+	shortIDs            *shortIDs
+	callbackAnswers     *callbackAnswers
+	httpClient          *httpclient.Client
+	notifications       *notifications.Store
+	audit               *audit.Store
+	pending             *pending.Store
+	profiles            *profiles.Store
+	scheduler           *scheduler.Scheduler
+	intruders           *security.Tracker
+	pingProfiles        *pingProfileChoices
+	comparisons         *compareSelections
+	reachTargets        *reachTargets
+	conflict            instanceConflict
+	clock               clock.Clock
+
+	// Notifications held back during quiet hours
+	digest      []digestEntry
+	digestMutex sync.Mutex
+	// Repeated errors of background tasks, see ReportResult
+	errorAlerts *notifications.ErrorAggregator
+	// Second channel for critical alerts Telegram could not deliver
+	fallback *fallback.Notifier
+
+	// Group chat support
+	username    string
+	topics      *chatTopics
+	memberCache map[int64]memberCacheEntry
+	memberMutex sync.Mutex
 }
 
 func NewTelegramBot(config ConfigProvider, serverMgr ServerManager, logger Logger) (*TelegramBot, error) {
@@ -39,7 +79,18 @@ func NewTelegramBot(config ConfigProvider, serverMgr ServerManager, logger Logge
 		return nil, fmt.Errorf("logger cannot be nil")
 	}
 
+	topics := newChatTopics()
+	intruders := newIntruderTracker(config)
+	var tb *TelegramBot
 	opts := []bot.Option{
+		bot.WithMiddlewares(banMiddleware(intruders, logger), topics.middleware),
+		bot.WithErrorsHandler(func(err error) {
+			if tb == nil {
+				logger.Error("Telegram bot error: %v", err)
+				return
+			}
+			tb.handleBotError(err)
+		}),
 		bot.WithDefaultHandler(func(ctx context.Context, b *bot.Bot, update *models.Update) {
 			if update.Message != nil {
 				logger.Debug("Unhandled message from user %d: %s", update.Message.From.ID, update.Message.Text)
@@ -58,31 +109,125 @@ func NewTelegramBot(config ConfigProvider, serverMgr ServerManager, logger Logge
 
 	logger.Info("Telegram bot created successfully for admin ID: %d", config.GetAdminID())
 
-	rateLimiter := NewRateLimiter(10, time.Minute)
-
-	tb := &TelegramBot{
-		bot:            b,
-		config:         config,
-		serverMgr:      serverMgr,
-		logger:         logger,
-		rateLimiter:    rateLimiter,
-		lastPingUpdate: make(map[int64]time.Time),
-		pingSkipCount:  make(map[int64]int),
+	rateLimiter := NewRateLimiter(commandRateLimit, callbackRateLimit, rateWindow)
+
+	tb = &TelegramBot{
+		bot:             b,
+		config:          config,
+		serverMgr:       serverMgr,
+		logger:          logger,
+		rateLimiter:     rateLimiter,
+		topics:          topics,
+		memberCache:     make(map[int64]memberCacheEntry),
+		scheduler:       scheduler.New(config.GetQuietHours().Window()),
+		intruders:       intruders,
+		listCache:       newListPageCache(),
+		conversations:   NewConversationManager(),
+		inflight:        newInflightCallbacks(),
+		shortIDs:        newShortIDs(),
+		callbackAnswers: newCallbackAnswers(),
+		pingProfiles:    newPingProfileChoices(),
+		comparisons:     newCompareSelections(),
+		reachTargets:    newReachTargets(),
+		errorAlerts:     notifications.NewErrorAggregator(errorAlertWindow),
+		fallback:        fallback.New(config.GetFallbackNotifier()),
+		clock:           clock.Real,
 	}
 
 	tb.messageManager = NewMessageManager(b, logger)
+	tb.messageManager.SetTopicResolver(tb.topicFor)
 	tb.buttonTextProcessor = NewButtonTextProcessor(50) // Default max length of 50
+	tb.registerNoteFlow()
+	tb.registerReachFlow()
+	tb.registerScheduleFlow()
+	tb.registerProfileFlows()
+
+	notificationStore, err := notifications.NewStore(notificationsPath(config))
+	if err != nil {
+		logger.Warn("Using default notification preferences: %v", err)
+	}
+	tb.notifications = notificationStore
+
+	auditStore, err := audit.NewStore(auditPath(config))
+	if err != nil {
+		logger.Warn("Starting a new audit log: %v", err)
+	}
+	tb.audit = auditStore
+	serverMgr.Hooks().OnResult(tb.recordHook)
+
+	pendingStore, err := pending.NewStore(pendingPath(config))
+	if err != nil {
+		logger.Warn("Starting without pending actions: %v", err)
+	}
+	tb.pending = pendingStore
+
+	profileStore, err := profiles.NewStore(profilesPath(config))
+	if err != nil {
+		logger.Warn("Starting without profiles: %v", err)
+	}
+	tb.profiles = profileStore
+
+	tb.httpClient = newBotHTTPClient(config.GetHTTPProxy(), logger)
 
 	// Create UpdateManager with configuration
 	updateCfg := config.GetUpdateConfig()
 	timeout := time.Duration(updateCfg.TimeoutMinutes) * time.Minute
-	updateManager := NewUpdateManager(updateCfg.ScriptURL, timeout, updateCfg.BackupConfig, logger)
+	updateManager := NewUpdateManager(updateCfg.ScriptURL, timeout, updateCfg.BackupConfig, updateCfg.DownloadLimit(), tb.httpClient, logger)
 	tb.handlers = NewCommandHandlers(tb, updateManager)
 
 	return tb, nil
 }
 
+// pause waits between progress steps. It returns false when ctx ended, the handler
+// should then stop without touching its messages again.
+func pause(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// newBotHTTPClient creates the client for version checks, update scripts and backup
+// downloads. Requests are bounded by their contexts, the client timeout is the upper limit.
+func newBotHTTPClient(proxy string, logger Logger) *httpclient.Client {
+	opts := httpclient.Options{
+		Timeout: time.Minute,
+		Retries: 2,
+		Proxy:   proxy,
+		Observer: func(call httpclient.CallMetrics) {
+			logger.Debug("HTTP %s %s: status %d, %d attempt(s) in %v", call.Method, call.Host, call.Status, call.Attempts, call.Duration)
+		},
+	}
+	client, err := httpclient.New("bot", opts)
+	if err != nil {
+		logger.Warn("Ignoring HTTP proxy: %v", err)
+		opts.Proxy = ""
+		client, _ = httpclient.New("bot", opts)
+	}
+	return client
+}
+
+// SetClock replaces the clock telling when profiles and pending actions are due, for
+// tests. It must be called before Start.
+func (tb *TelegramBot) SetClock(c clock.Clock) {
+	tb.clock = c
+}
+
 func (tb *TelegramBot) Start(ctx context.Context) error {
+	// The bot username is needed to match /command@botname in groups
+	if me, err := tb.bot.GetMe(ctx); err != nil {
+		tb.logger.Warn("Failed to get bot info: %v", err)
+	} else {
+		tb.username = me.Username
+	}
+	if groups := tb.config.GetGroupConfig().AllowedChatIDs; len(groups) > 0 {
+		tb.logger.Info("Group chat mode enabled for chats: %v", groups)
+	}
+
 	tb.registerHandlers()
 
 	// Start rate limiter cleanup routine
@@ -91,8 +236,51 @@ func (tb *TelegramBot) Start(ctx context.Context) error {
 	// Start message manager cleanup routine
 	go tb.messageManager.StartCleanupRoutine(ctx)
 
+	// Start release checks for update notifications, they wait for the end of quiet hours
+	tb.scheduler.Start(ctx, scheduler.Job{
+		Name:       "update check",
+		Delay:      updateCheckDelay,
+		Interval:   updateCheckInterval,
+		Deferrable: true,
+		Run:        tb.checkForUpdate,
+	})
+	// Scheduled switches run in quiet hours as well, they are often planned for the night
+	tb.scheduler.Start(ctx, scheduler.Job{
+		Name:     "pending actions",
+		Delay:    pendingCheckInterval,
+		Interval: pendingCheckInterval,
+		Run:      tb.runPendingActions,
+	})
+	tb.scheduler.Start(ctx, scheduler.Job{
+		Name:     "profile schedule",
+		Delay:    profileCheckInterval,
+		Interval: profileCheckInterval,
+		Run:      tb.runProfileSchedule,
+	})
+	if daily := tb.config.GetDailyDigest().Schedule(); daily != nil {
+		tb.logger.Info("Daily ping digest enabled at %s", daily)
+		tb.scheduler.Start(ctx, scheduler.Job{
+			Name:       "ping digest",
+			At:         daily,
+			Deferrable: true,
+			Run:        tb.sendPingDigest,
+		})
+	}
+	if window := tb.config.GetQuietHours().Window(); window != nil {
+		tb.logger.Info("Quiet hours enabled: %s", window)
+		tb.scheduler.OnQuietHoursEnd(ctx, tb.sendDigest)
+	}
+
+	// Report the result of an update that restarted the bot and remove what it left in /tmp
+	tb.handlers.updateManager.CleanupArtifacts()
+	go tb.handlers.reportUpdateResult(ctx, tb.bot)
+
 	tb.logger.Info("Starting Telegram bot...")
 
+	tb.conflict.mutex.Lock()
+	tb.conflict.startedAt = time.Now()
+	tb.conflict.mutex.Unlock()
+
 	// Start the bot
 	tb.bot.Start(ctx)
 	tb.logger.Info("Telegram bot started and listening for messages")
@@ -110,18 +298,33 @@ func (tb *TelegramBot) GetMessageManager() *MessageManager {
 func (tb *TelegramBot) registerHandlers() {
 	tb.logger.Debug("Registering Telegram bot handlers...")
 
-	tb.bot.RegisterHandler(bot.HandlerTypeMessageText, "/start", bot.MatchTypeExact, tb.handlers.handleStart)
-	tb.bot.RegisterHandler(bot.HandlerTypeMessageText, "/list", bot.MatchTypeExact, tb.handleList)
-	tb.bot.RegisterHandler(bot.HandlerTypeMessageText, "/status", bot.MatchTypeExact, tb.handlers.handleStatus)
-	tb.bot.RegisterHandler(bot.HandlerTypeMessageText, "/ping", bot.MatchTypeExact, tb.handlePing)
-	tb.bot.RegisterHandler(bot.HandlerTypeMessageText, "/update", bot.MatchTypeExact, tb.handlers.handleUpdate)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/start", false), tb.handlers.handleStart)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/list", false), tb.handleList)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/status", false), tb.handlers.handleStatus)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/ping", false), tb.handlePing)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/update", false), tb.handlers.handleUpdate)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/backup", true), tb.handlers.handleBackup)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/restore", false), tb.handlers.handleRestore)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/notifications", false), tb.handleNotifications)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/intruders", false), tb.handleIntruders)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/settings", false), tb.handleSettings)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/routing", false), tb.handleRouting)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/inbounds", false), tb.handleInbounds)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/pending", false), tb.handlePending)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/schedule", false), tb.handleSchedule)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/xraylogs", false), tb.handleXrayLogs)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/changes", false), tb.handleChanges)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/panic", false), tb.handlePanic)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/stats", false), tb.handleStats)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/doctor", false), tb.handleDoctor)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/reset_update_script", false), tb.handlers.handleResetUpdateScript)
+	tb.bot.RegisterHandlerMatchFunc(tb.handlers.isUpdateScriptDocument, tb.handlers.handleUpdateScriptDocument)
+	tb.bot.RegisterHandlerMatchFunc(tb.commandMatcher("/cancel", false), tb.handleCancel)
+	tb.bot.RegisterHandlerMatchFunc(tb.handlers.isRestoreDocument, tb.handlers.handleRestoreDocument)
+	tb.bot.RegisterHandlerMatchFunc(tb.conversations.matches, tb.handleConversationText)
 	tb.bot.RegisterHandler(bot.HandlerTypeCallbackQueryData, "", bot.MatchTypePrefix, tb.handleCallback)
 
-	tb.logger.Info("Registered handlers for commands: /start, /list, /status, /ping, /update and callback queries")
-}
-
-func (tb *TelegramBot) isAuthorized(userID int64) bool {
-	return userID == tb.config.GetAdminID()
+	tb.logger.Info("Registered handlers for commands: /start, /list, /status, /ping, /update, /backup, /restore, /notifications, /intruders, /settings, /routing, /inbounds, /pending, /schedule, /xraylogs, /changes, /panic, /stats, /doctor, /reset_update_script, /cancel, update script documents, conversation input and callback queries")
 }
 
 func (tb *TelegramBot) sendUnauthorizedMessage(ctx context.Context, b *bot.Bot, chatID int64) {
@@ -131,8 +334,9 @@ func (tb *TelegramBot) sendUnauthorizedMessage(ctx context.Context, b *bot.Bot,
 	message := messageFormatter.FormatUnauthorizedMessage()
 
 	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID: chatID,
-		Text:   message,
+		ChatID:          chatID,
+		MessageThreadID: tb.topicFor(chatID, MessageTypeMenu),
+		Text:            message,
 	})
 
 	if err != nil {
@@ -142,14 +346,81 @@ func (tb *TelegramBot) sendUnauthorizedMessage(ctx context.Context, b *bot.Bot,
 	}
 }
 
+// beginOperation acquires the operation lock for a user-triggered action. When a
+// conflicting operation is already running the user is notified and ok is false.
+func (tb *TelegramBot) beginOperation(ctx context.Context, chatID int64, callbackQueryID string, opType operations.OperationType) (*operations.Operation, func(), bool) {
+	op, release, err := tb.serverMgr.Operations().Acquire(ctx, opType, chatID, operations.PolicyReject)
+	if err == nil {
+		return op, release, true
+	}
+
+	var inProgress *operations.OperationInProgressError
+	if !errors.As(err, &inProgress) {
+		tb.logger.Error("Failed to start %s for user %d: %v", opType.DisplayName(), chatID, err)
+		return nil, nil, false
+	}
+
+	tb.logger.Info("Rejected %s for user %d: %s is in progress", opType.DisplayName(), chatID, inProgress.Active.Type.DisplayName())
+
+	tb.alertCallback(ctx, callbackQueryID, fmt.Sprintf("⏳ %s is in progress", toTitle(inProgress.Active.Type.DisplayName())))
+
+	tb.sendOperationInProgressMessage(ctx, chatID, inProgress)
+	return nil, nil, false
+}
+
+// trackOperationMessage remembers the user's active message of the type as the
+// progress message of the operation
+func (tb *TelegramBot) trackOperationMessage(op *operations.Operation, userID int64, messageType MessageType) {
+	if op == nil {
+		return
+	}
+	if activeMsg := tb.messageManager.GetActiveMessage(userID, messageType); activeMsg != nil {
+		tb.serverMgr.Operations().SetProgressMessage(op.ID, activeMsg.ChatID, activeMsg.MessageID)
+	}
+}
+
+// sendOperationInProgressMessage sends a new message (never editing the running operation's
+// progress message) and replies to the progress message when it is known
+func (tb *TelegramBot) sendOperationInProgressMessage(ctx context.Context, chatID int64, inProgress *operations.OperationInProgressError) {
+	messageFormatter := NewMessageFormatter()
+	message := messageFormatter.FormatOperationInProgressMessage(inProgress)
+
+	keyboard := [][]models.InlineKeyboardButton{}
+	if inProgress.Active.Type == operations.OperationUpdate {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: "ℹ️ Check Status", CallbackData: "update_status"},
+		})
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "🏠 Main Menu", CallbackData: "main_menu"},
+	})
+
+	params := &bot.SendMessageParams{
+		ChatID:          chatID,
+		MessageThreadID: tb.topicFor(chatID, MessageTypeMenu),
+		Text:            message,
+		ReplyMarkup:     &models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+	}
+	if inProgress.Active.ChatID == chatID && inProgress.Active.MessageID != 0 {
+		params.ReplyParameters = &models.ReplyParameters{
+			MessageID:                inProgress.Active.MessageID,
+			AllowSendingWithoutReply: true,
+		}
+	}
+
+	if _, err := tb.bot.SendMessage(ctx, params); err != nil {
+		tb.logger.Error("Failed to send operation in progress message: %v", err)
+	}
+}
+
 func (tb *TelegramBot) handleList(ctx context.Context, b *bot.Bot, update *models.Update) {
 	userID := update.Message.From.ID
 	username := update.Message.From.Username
 	tb.logger.Info("Received /list command from user %d (@%s)", userID, username)
 
-	if !tb.isAuthorized(userID) {
+	if !tb.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionView) {
 		tb.logger.Warn("Unauthorized access attempt from user %d (@%s) for /list command", userID, username)
-		tb.sendUnauthorizedMessage(ctx, b, update.Message.Chat.ID)
+		tb.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/list")
 		return
 	}
 
@@ -176,13 +447,10 @@ func (tb *TelegramBot) handleList(ctx context.Context, b *bot.Bot, update *model
 		currentServerID = currentServer.ID
 	}
 
-	messageFormatter := NewMessageFormatter()
-	message := messageFormatter.FormatServerListMessage(servers, currentServerID, 0, 1)
-
-	keyboard := tb.createServerListKeyboard(servers, 0)
+	listPage := tb.serverListPage(servers, currentServerID, 0)
 	serverListContent := MessageContent{
-		Text:        message,
-		ReplyMarkup: keyboard,
+		Text:        listPage.text,
+		ReplyMarkup: listPage.keyboard,
 		Type:        MessageTypeServerList,
 	}
 
@@ -198,98 +466,212 @@ func (tb *TelegramBot) handlePing(ctx context.Context, b *bot.Bot, update *model
 	username := update.Message.From.Username
 	tb.logger.Info("Received /ping command from user %d (@%s)", userID, username)
 
-	if !tb.isAuthorized(userID) {
+	if !tb.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionControl) {
 		tb.logger.Warn("Unauthorized access attempt from user %d (@%s) for /ping command", userID, username)
-		tb.sendUnauthorizedMessage(ctx, b, update.Message.Chat.ID)
+		tb.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/ping")
 		return
 	}
 
 	tb.logger.Debug("User %d is authorized, processing /ping command", userID)
-	tb.handlePingTestCallback(ctx, b, update.Message.Chat.ID, "")
+	tb.handlePingScopeMenu(ctx, b, update.Message.Chat.ID, "")
 }
 
 func (tb *TelegramBot) handleCallback(ctx context.Context, b *bot.Bot, update *models.Update) {
 	userID := update.CallbackQuery.From.ID
 	username := update.CallbackQuery.From.Username
-	data := update.CallbackQuery.Data
+	data := tb.expandCallbackData(update.CallbackQuery.Data)
 	tb.logger.Info("Received callback query from user %d (@%s): %s", userID, username, data)
 
-	if !tb.isAuthorized(userID) {
+	// Every query is answered, by its handler or here, even when the handler panics
+	tb.callbackAnswers.begin(update.CallbackQuery.ID)
+	defer tb.finishCallback(ctx, update.CallbackQuery.ID, data)
+
+	// Answer in the chat the button was pressed in, which is a group in group chat mode
+	chatID := userID
+	if message := update.CallbackQuery.Message.Message; message != nil {
+		chatID = message.Chat.ID
+	} else if message := update.CallbackQuery.Message.InaccessibleMessage; message != nil {
+		chatID = message.Chat.ID
+	}
+
+	if !tb.isAuthorized(ctx, chatID, userID, callbackPermission(data)) {
 		tb.logger.Warn("Unauthorized callback query attempt from user %d (@%s): %s", userID, username, data)
-		_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-			CallbackQueryID: update.CallbackQuery.ID,
-			Text:            "❌ Unauthorized access",
-			ShowAlert:       true,
-		})
+		tb.recordUnauthorized(ctx, chatID, &update.CallbackQuery.From, data)
+		tb.alertCallback(ctx, update.CallbackQuery.ID, "❌ Unauthorized access")
 		return
 	}
 
 	tb.logger.Debug("User %d is authorized, processing callback: %s", userID, data)
 
-	// For callback queries, we'll send new messages instead of editing
-	// This avoids the complexity of handling MaybeInaccessibleMessage
-	chatID := update.CallbackQuery.From.ID
+	if !isRecoveryCallback(data) && !tb.allowRequest(ctx, chatID, userID, RequestCallback) {
+		tb.logger.Warn("Rate limit exceeded for callbacks of user %d (@%s): %s", userID, username, data)
+		tb.alertCallback(ctx, update.CallbackQuery.ID, "⚠️ Too many button presses, please wait a moment")
+		return
+	}
+
+	done, ok := tb.inflight.begin(userID, data)
+	if !ok {
+		tb.logger.Debug("Ignoring callback %s from user %d, a previous press is still processed", data, userID)
+		tb.answerCallback(ctx, update.CallbackQuery.ID, "⏳ Already processing…")
+		return
+	}
+	defer done()
 
+	// The handlers of this press share one read of the server list
+	snap := tb.newServerSnapshot()
 	switch {
 	case data == "refresh":
 		tb.logger.Debug("Processing refresh callback for user %d", userID)
 		tb.handleRefreshCallback(ctx, b, chatID, update.CallbackQuery.ID)
 	case data == "ping_test":
 		tb.logger.Debug("Processing ping_test callback for user %d", userID)
-		tb.handlePingTestCallback(ctx, b, chatID, update.CallbackQuery.ID)
+		tb.handlePingScopeMenu(ctx, b, chatID, update.CallbackQuery.ID)
+	case strings.HasPrefix(data, "ping_profile_"):
+		tb.logger.Debug("Processing ping profile callback for user %d: %s", userID, data)
+		tb.handlePingProfileCallback(ctx, b, chatID, update.CallbackQuery.ID, strings.TrimPrefix(data, "ping_profile_"))
+	case strings.HasPrefix(data, "ping_scope_"):
+		tb.logger.Debug("Processing ping scope callback for user %d: %s", userID, data)
+		tb.handlePingScopeCallback(ctx, b, chatID, update.CallbackQuery.ID, data)
+	case strings.HasPrefix(data, "note_clear_"):
+		tb.logger.Debug("Processing note_clear callback for user %d: %s", userID, data)
+		tb.handleNoteClearCallback(ctx, b, chatID, update.CallbackQuery.ID, strings.TrimPrefix(data, "note_clear_"))
+	case strings.HasPrefix(data, "note_cancel_"):
+		tb.logger.Debug("Processing note_cancel callback for user %d: %s", userID, data)
+		tb.handleNoteCancelCallback(ctx, b, chatID, update.CallbackQuery.ID, strings.TrimPrefix(data, "note_cancel_"))
+	case strings.HasPrefix(data, "note_"):
+		tb.logger.Debug("Processing note callback for user %d: %s", userID, data)
+		tb.handleNoteCallback(ctx, b, chatID, userID, update.CallbackQuery.ID, strings.TrimPrefix(data, "note_"))
+	case strings.HasPrefix(data, "favorite_"):
+		tb.logger.Debug("Processing favorite callback for user %d: %s", userID, data)
+		tb.handleFavoriteCallback(ctx, b, chatID, update.CallbackQuery.ID, strings.TrimPrefix(data, "favorite_"))
+	case strings.HasPrefix(data, "compare_"):
+		tb.logger.Debug("Processing compare callback for user %d: %s", userID, data)
+		tb.handleCompareCallback(ctx, b, chatID, update.CallbackQuery.ID, data)
+	case strings.HasPrefix(data, "reach_"):
+		tb.logger.Debug("Processing reach callback for user %d: %s", userID, data)
+		tb.handleReachCallback(ctx, b, chatID, userID, update.CallbackQuery.ID, data)
+	case strings.HasPrefix(data, "schedule_"):
+		tb.logger.Debug("Processing schedule callback for user %d: %s", userID, data)
+		tb.handleScheduleCallback(ctx, b, chatID, userID, update.CallbackQuery.ID, strings.TrimPrefix(data, "schedule_"))
+	case strings.HasPrefix(data, "pending_"):
+		tb.logger.Debug("Processing pending callback for user %d: %s", userID, data)
+		tb.handlePendingCallback(ctx, b, chatID, update.CallbackQuery.ID, data)
+	case strings.HasPrefix(data, "profiles_"):
+		tb.logger.Debug("Processing profiles callback for user %d: %s", userID, data)
+		tb.handleProfilesCallback(ctx, b, chatID, userID, update.CallbackQuery.ID, data)
 	case data == "main_menu":
 		tb.logger.Debug("Processing main_menu callback for user %d", userID)
-		tb.handleMainMenuCallback(ctx, b, chatID, update.CallbackQuery.ID)
+		tb.handleMainMenuCallback(ctx, b, chatID, update.CallbackQuery.ID, snap)
 	case data == "confirm_update":
 		tb.logger.Debug("Processing confirm_update callback for user %d", userID)
-		tb.handlers.handleUpdateConfirm(ctx, b, chatID, update.CallbackQuery.ID)
+		tb.handlers.handleUpdateConfirm(ctx, b, chatID, update.CallbackQuery.ID, &update.CallbackQuery.From)
 	case data == "update_status":
 		tb.logger.Debug("Processing update_status callback for user %d", userID)
 		tb.handlers.handleUpdateStatus(ctx, b, chatID, update.CallbackQuery.ID)
+	case data == "update_log":
+		tb.logger.Debug("Processing update_log callback for user %d", userID)
+		tb.handlers.handleUpdateLog(ctx, b, chatID, update.CallbackQuery.ID)
 	case data == "update_menu":
 		tb.logger.Debug("Processing update_menu callback for user %d", userID)
 		tb.handleUpdateMenuCallback(ctx, b, chatID, update.CallbackQuery.ID)
 	case data == "status":
 		tb.logger.Debug("Processing status callback for user %d", userID)
 		tb.handleStatusCallback(ctx, b, chatID, update.CallbackQuery.ID)
+	case data == "direct_mode_on":
+		tb.logger.Debug("Processing direct_mode_on callback for user %d", userID)
+		tb.handleDirectModeCallback(ctx, b, chatID, update.CallbackQuery.ID, true)
+	case data == "direct_mode_off":
+		tb.logger.Debug("Processing direct_mode_off callback for user %d", userID)
+		tb.handleDirectModeCallback(ctx, b, chatID, update.CallbackQuery.ID, false)
+	case data == "panic_confirm":
+		tb.logger.Debug("Processing panic_confirm callback for user %d", userID)
+		tb.handlePanicConfirm(ctx, b, chatID, update.CallbackQuery.ID)
+	case data == "restore_confirm":
+		tb.logger.Debug("Processing restore_confirm callback for user %d", userID)
+		tb.handlers.handleRestoreConfirm(ctx, b, chatID, update.CallbackQuery.ID, &update.CallbackQuery.From)
+	case data == "restore_cancel":
+		tb.logger.Debug("Processing restore_cancel callback for user %d", userID)
+		tb.handlers.handleRestoreCancel(ctx, b, chatID, update.CallbackQuery.ID)
+	case data == "update_script_confirm":
+		tb.logger.Debug("Processing update_script_confirm callback for user %d", userID)
+		tb.handlers.handleUpdateScriptConfirm(ctx, b, chatID, update.CallbackQuery.ID)
+	case data == "update_script_cancel":
+		tb.logger.Debug("Processing update_script_cancel callback for user %d", userID)
+		tb.handlers.handleUpdateScriptCancel(ctx, b, chatID, update.CallbackQuery.ID)
+	case data == "switch_previous":
+		tb.logger.Debug("Processing switch_previous callback for user %d", userID)
+		tb.handleSwitchPreviousCallback(ctx, b, chatID, update.CallbackQuery.ID, &update.CallbackQuery.From)
+	case strings.HasPrefix(data, "notify_"):
+		tb.logger.Debug("Processing notifications callback for user %d: %s", userID, data)
+		tb.handleNotificationsCallback(ctx, b, chatID, update.CallbackQuery.ID, data)
+	case strings.HasPrefix(data, "settings_"):
+		tb.logger.Debug("Processing settings callback for user %d: %s", userID, data)
+		tb.handleSettingsCallback(ctx, b, chatID, update.CallbackQuery.ID, data)
+	case strings.HasPrefix(data, "routing_"):
+		tb.logger.Debug("Processing routing callback for user %d: %s", userID, data)
+		tb.handleRoutingCallback(ctx, b, chatID, update.CallbackQuery.ID, data)
+	case strings.HasPrefix(data, "inbounds_"):
+		tb.logger.Debug("Processing inbounds callback for user %d: %s", userID, data)
+		tb.handleInboundsCallback(ctx, b, chatID, update.CallbackQuery.ID, data)
+	case strings.HasPrefix(data, "recover_"):
+		tb.logger.Debug("Processing config recovery callback for user %d: %s", userID, data)
+		tb.handleRecoveryCallback(ctx, b, chatID, update.CallbackQuery.ID, data, &update.CallbackQuery.From)
+	case data == "digest_quick":
+		tb.logger.Debug("Processing digest_quick callback for user %d", userID)
+		tb.handleDigestQuickCallback(ctx, b, chatID, update.CallbackQuery.ID)
+	case strings.HasPrefix(data, "xraylogs_"):
+		tb.logger.Debug("Processing xray log callback for user %d: %s", userID, data)
+		tb.handleXrayLogsCallback(ctx, b, chatID, update.CallbackQuery.ID, data)
+	case strings.HasPrefix(data, "changes_page_"):
+		tb.logger.Debug("Processing config changes callback for user %d: %s", userID, data)
+		tb.handleChangesCallback(ctx, b, chatID, update.CallbackQuery.ID, data)
 	case len(data) > 5 && data[:5] == "page_":
 		tb.logger.Debug("Processing pagination callback for user %d: %s", userID, data)
-		tb.handlePaginationCallback(ctx, b, chatID, update.CallbackQuery.ID, data)
+		tb.handlePaginationCallback(ctx, b, chatID, update.CallbackQuery.ID, data, snap)
 	case len(data) > 8 && data[:8] == "confirm_":
-		serverID := data[8:]
+		serverID, version := splitListVersion(data[8:])
 		tb.logger.Debug("Processing confirm_switch callback for user %d, server: %s", userID, serverID)
-		tb.handleConfirmSwitchCallback(ctx, b, chatID, update.CallbackQuery.ID, serverID)
+		if !tb.checkListVersion(ctx, chatID, update.CallbackQuery.ID, version, snap) {
+			return
+		}
+		tb.handleConfirmSwitchCallback(ctx, b, chatID, update.CallbackQuery.ID, serverID, &update.CallbackQuery.From, false, snap)
+	case strings.HasPrefix(data, "blockedok_"):
+		serverID, version := splitListVersion(strings.TrimPrefix(data, "blockedok_"))
+		tb.logger.Debug("Processing blocked country confirmation for user %d, server: %s", userID, serverID)
+		if !tb.checkListVersion(ctx, chatID, update.CallbackQuery.ID, version, snap) {
+			return
+		}
+		tb.handleConfirmSwitchCallback(ctx, b, chatID, update.CallbackQuery.ID, serverID, &update.CallbackQuery.From, true, snap)
 	case len(data) > 7 && data[:7] == "server_":
-		serverID := data[7:]
+		serverID, version := splitListVersion(data[7:])
 		tb.logger.Debug("Processing server_select callback for user %d, server: %s", userID, serverID)
-		tb.handleServerSelectCallback(ctx, b, chatID, update.CallbackQuery.ID, serverID)
+		if !tb.checkListVersion(ctx, chatID, update.CallbackQuery.ID, version, snap) {
+			return
+		}
+		tb.handleServerSelectCallback(ctx, b, chatID, update.CallbackQuery.ID, serverID, snap)
+	case data == "detect_current":
+		tb.logger.Debug("Processing detect_current callback for user %d", userID)
+		tb.handleDetectCurrentCallback(ctx, b, chatID, update.CallbackQuery.ID)
 	case data == "noop":
 		tb.logger.Debug("Processing noop callback for user %d", userID)
-		_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-			CallbackQueryID: update.CallbackQuery.ID,
-		})
+		tb.answerCallback(ctx, update.CallbackQuery.ID, "")
 	default:
 		tb.logger.Warn("Unknown callback query from user %d: %s", userID, data)
-		_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-			CallbackQueryID: update.CallbackQuery.ID,
-			Text:            "❌ Unknown command",
-		})
+		tb.answerCallback(ctx, update.CallbackQuery.ID, "❌ Unknown command")
 	}
 }
 
-func (tb *TelegramBot) createServerListKeyboard(servers []types.Server, page int) *models.InlineKeyboardMarkup {
-	const serversPerPage = 32
+func (tb *TelegramBot) createServerListKeyboard(servers []types.Server, currentServerID string, page int) *models.InlineKeyboardMarkup {
 	start := page * serversPerPage
 	end := start + serversPerPage
 	if end > len(servers) {
 		end = len(servers)
 	}
 
-	var keyboard [][]models.InlineKeyboardButton
-	currentServer := tb.serverMgr.GetCurrentServer()
-	var currentServerID string
-	if currentServer != nil {
-		currentServerID = currentServer.ID
+	keyboard := make([][]models.InlineKeyboardButton, 0, end-start+2)
+	var notes map[string]string
+	if tb.config.GetUIConfig().ShowNotesInList {
+		notes = tb.serverMgr.GetServerNotes()
 	}
 
 	for i := start; i < end; i++ {
@@ -297,19 +679,28 @@ func (tb *TelegramBot) createServerListKeyboard(servers []types.Server, page int
 
 		// Determine status emoji
 		var statusEmoji string
-		if server.ID == currentServerID {
+		switch {
+		case server.ID == currentServerID:
 			statusEmoji = "✅"
-		} else {
+		case server.Blocked():
+			statusEmoji = "⛔"
+		case server.Misconfigured():
+			statusEmoji = "⚠️"
+		default:
 			statusEmoji = "🌐"
 		}
 
 		// Use ButtonTextProcessor to create properly formatted button text
-		buttonText := tb.buttonTextProcessor.ProcessServerButtonText(server.Name, statusEmoji, 50)
+		name := server.Name
+		if note := notes[server.ID]; note != "" {
+			name += " · " + note
+		}
+		buttonText := tb.buttonTextProcessor.ProcessServerButtonText(name, statusEmoji, 50)
 
 		row := []models.InlineKeyboardButton{
 			{
 				Text:         buttonText,
-				CallbackData: fmt.Sprintf("server_%s", server.ID),
+				CallbackData: tb.serverCallback("server_", server.ID),
 			},
 		}
 
@@ -352,13 +743,26 @@ func (tb *TelegramBot) createEmptyKeyboard() *models.InlineKeyboardMarkup {
 	return &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{}}
 }
 
+// withLoadRetry adds the scheduled retry of a failed server load to title, e.g.
+// "Failed to load servers, retrying in 2m (attempt 1 of 5)"
+func (tb *TelegramBot) withLoadRetry(title string) string {
+	retry := tb.serverMgr.GetLoadRetry()
+	if retry == nil {
+		return title
+	}
+	return title + ", " + retry.Summary(time.Now())
+}
+
 func (tb *TelegramBot) handleRefreshCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
 	tb.logger.Info("Processing refresh callback for user %d", chatID)
 
-	_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-		CallbackQueryID: callbackQueryID,
-		Text:            "🔄 Refreshing server list...",
-	})
+	op, release, ok := tb.beginOperation(ctx, chatID, callbackQueryID, operations.OperationRefresh)
+	if !ok {
+		return
+	}
+	defer release()
+
+	tb.answerCallback(ctx, callbackQueryID, "🔄 Refreshing server list...")
 
 	// Show loading message using MessageManager
 	loadingContent := MessageContent{
@@ -371,18 +775,23 @@ func (tb *TelegramBot) handleRefreshCallback(ctx context.Context, b *bot.Bot, ch
 		tb.logger.Error("Failed to send loading message: %v", err)
 		return
 	}
+	tb.trackOperationMessage(op, chatID, MessageTypeServerList)
 
 	tb.logger.Debug("Loading servers for refresh callback...")
-	if err := tb.serverMgr.LoadServers(); err != nil {
+	if err := tb.serverMgr.LoadServers(ctx); err != nil {
+		if ctx.Err() != nil {
+			tb.logger.Info("Refresh for user %d canceled: %v", chatID, err)
+			return
+		}
 		tb.logger.Error("Failed to load servers for refresh callback: %v", err)
 		messageFormatter := NewMessageFormatter()
-		suggestions := []string{
+		suggestions := messageFormatter.ErrorSuggestions(err, []string{
 			"Check your internet connection",
 			"Verify subscription configuration",
 			"Try again in a few moments",
-		}
+		})
 		errorContent := MessageContent{
-			Text:        messageFormatter.FormatErrorMessage("Failed to Refresh Servers", err.Error(), suggestions),
+			Text:        messageFormatter.FormatErrorMessage(tb.withLoadRetry("Failed to Refresh Servers"), err.Error(), suggestions),
 			ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{}},
 			Type:        MessageTypeServerList,
 		}
@@ -390,6 +799,8 @@ func (tb *TelegramBot) handleRefreshCallback(ctx context.Context, b *bot.Bot, ch
 		return
 	}
 
+	tb.listCache.invalidate()
+
 	servers := tb.serverMgr.GetServers()
 	tb.logger.Debug("Loaded %d servers for refresh callback", len(servers))
 
@@ -411,13 +822,13 @@ func (tb *TelegramBot) handleRefreshCallback(ctx context.Context, b *bot.Bot, ch
 		currentServerID = currentServer.ID
 	}
 
+	listPage := tb.serverListPage(servers, currentServerID, 0)
 	messageFormatter := NewMessageFormatter()
-	message := messageFormatter.FormatServerListMessage(servers, currentServerID, 0, 1)
+	message := listPage.text + messageFormatter.FormatSubscriptionInfo(tb.serverMgr.GetSubscriptionInfo())
 
-	keyboard := tb.createServerListKeyboard(servers, 0)
 	serverListContent := MessageContent{
 		Text:        message,
-		ReplyMarkup: keyboard,
+		ReplyMarkup: listPage.keyboard,
 		Type:        MessageTypeServerList,
 	}
 
@@ -428,44 +839,19 @@ func (tb *TelegramBot) handleRefreshCallback(ctx context.Context, b *bot.Bot, ch
 	}
 }
 
-// canSendPingUpdate checks if enough time has passed since the last ping update for this user
-func (tb *TelegramBot) canSendPingUpdate(userID int64) bool {
-	tb.pingUpdateMutex.RLock()
-	lastUpdate := tb.lastPingUpdate[userID]
-	tb.pingUpdateMutex.RUnlock()
-
-	// Allow updates no more frequently than once per second
-	return time.Since(lastUpdate) >= time.Second
-}
+// runPingTest tests the servers of scope with progress updates and shows the results
+func (tb *TelegramBot) runPingTest(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string, scope pingScope) {
+	tb.logger.Info("Processing ping test callback for user %d (%s)", chatID, scope.action)
 
-// markPingUpdateSent records the time when a ping update was sent
-func (tb *TelegramBot) markPingUpdateSent(userID int64) {
-	tb.pingUpdateMutex.Lock()
-	tb.lastPingUpdate[userID] = time.Now()
-	// If there were skipped updates aggregated, log them once now
-	if skipped := tb.pingSkipCount[userID]; skipped > 0 {
-		tb.logger.Debug("Skipped %d ping updates for user %d due to rate limiting", skipped, userID)
-		delete(tb.pingSkipCount, userID)
+	op, release, ok := tb.beginOperation(ctx, chatID, callbackQueryID, operations.OperationPingTest)
+	if !ok {
+		return
 	}
-	tb.pingUpdateMutex.Unlock()
-}
-
-// markPingSkip increments the skip counter for a user without spamming logs
-func (tb *TelegramBot) markPingSkip(userID int64) {
-	tb.pingUpdateMutex.Lock()
-	tb.pingSkipCount[userID] = tb.pingSkipCount[userID] + 1
-	tb.pingUpdateMutex.Unlock()
-}
+	defer release()
 
-func (tb *TelegramBot) handlePingTestCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
-	tb.logger.Info("Processing ping test callback for user %d", chatID)
+	tb.answerCallback(ctx, callbackQueryID, "🏓 Starting ping test...")
 
-	_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-		CallbackQueryID: callbackQueryID,
-		Text:            "🏓 Starting ping test...",
-	})
-
-	servers := tb.serverMgr.GetServers()
+	servers := scope.servers
 	tb.logger.Debug("Retrieved %d servers for ping test", len(servers))
 
 	if len(servers) == 0 {
@@ -480,9 +866,22 @@ func (tb *TelegramBot) handlePingTestCallback(ctx context.Context, b *bot.Bot, c
 		return
 	}
 
+	profileName, profile, useProfile := tb.pingProfile(chatID)
+	total := len(servers)
+	if useProfile {
+		if profile.MaxServers > 0 && total > profile.MaxServers {
+			total = profile.MaxServers
+		}
+		label := pingProfileLabels[profileName]
+		if scope.title != "" {
+			label = scope.title + ", " + label
+		}
+		scope.title = label
+	}
+
 	// Send initial progress message using MessageManager
 	messageFormatter := NewMessageFormatter()
-	initialMessage := messageFormatter.FormatPingTestProgress(0, len(servers), "Initializing...")
+	initialMessage := messageFormatter.FormatPingTestProgress(0, total, "Initializing...")
 	initialContent := MessageContent{
 		Text:        initialMessage,
 		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{}},
@@ -493,14 +892,16 @@ func (tb *TelegramBot) handlePingTestCallback(ctx context.Context, b *bot.Bot, c
 		tb.logger.Error("Failed to send initial ping test message: %v", err)
 		return
 	}
+	tb.trackOperationMessage(op, chatID, MessageTypePingTest)
 
+	// Large lists report thousands of results, only milestones are shown and the results
+	// replace the progress in the final edit
+	milestones := newProgressMilestones(tb.config.GetUIConfig())
 	progressCallback := func(completed, total int, serverName string) {
-		// Check rate limiting - only send update if enough time has passed
-		if !tb.canSendPingUpdate(chatID) {
-			tb.markPingSkip(chatID)
+		if !milestones.begin(completed, total) {
 			return
 		}
-
+		defer milestones.end()
 		updatedMessage := messageFormatter.FormatPingTestProgress(completed, total, serverName)
 
 		progressContent := MessageContent{
@@ -509,31 +910,34 @@ func (tb *TelegramBot) handlePingTestCallback(ctx context.Context, b *bot.Bot, c
 			Type:        MessageTypePingTest,
 		}
 
-		// Use MessageManager for progress updates
-		if err := tb.messageManager.SendOrEdit(ctx, chatID, progressContent); err != nil {
+		// Updates coming faster than the ping_test debounce interval are dropped
+		if _, err := tb.messageManager.SendProgress(ctx, chatID, progressContent); err != nil {
 			tb.logger.Warn("Failed to send ping progress update: %v", err)
-		} else {
-			// Mark that we sent an update
-			tb.markPingUpdateSent(chatID)
 		}
 	}
 
-	tb.logger.Debug("Starting ping test with progress updates for %d servers", len(servers))
-	results, err := tb.serverMgr.TestPingWithProgress(progressCallback)
+	tb.logger.Debug("Starting ping test with progress updates for %d servers (profile %s)", total, profileName)
+	var results []types.PingResult
+	var err error
+	if useProfile {
+		results, err = tb.serverMgr.TestPingWithProfile(servers, profile, progressCallback)
+	} else {
+		results, err = tb.serverMgr.TestPingWithProgress(servers, progressCallback)
+	}
 	if err != nil {
 		tb.logger.Error("Ping test failed: %v", err)
 		// Force cleanup the user's active message since the operation failed
-		tb.messageManager.ForceCleanupUser(chatID, "ping test failed")
+		tb.messageManager.ForceCleanupType(chatID, MessageTypePingTest, "ping test failed")
 
-		suggestions := []string{
+		suggestions := messageFormatter.ErrorSuggestions(err, []string{
 			"Check your internet connection",
 			"Try again in a few moments",
 			"Verify server configuration",
-		}
+		})
 		errorMessage := messageFormatter.FormatErrorMessage("Ping Test Failed", err.Error(), suggestions)
 
 		navigationHelper := NewNavigationHelper()
-		retryKeyboard := navigationHelper.CreateErrorNavigationKeyboard("ping_test", "ping_test")
+		retryKeyboard := navigationHelper.CreateErrorNavigationKeyboard("ping_test", scope.action)
 
 		errorContent := MessageContent{
 			Text:        errorMessage,
@@ -560,7 +964,12 @@ func (tb *TelegramBot) handlePingTestCallback(ctx context.Context, b *bot.Bot, c
 
 	tb.logger.Info("Ping test completed: %d/%d servers available", availableCount, len(results))
 
-	message := messageFormatter.FormatPingTestResults(results, currentServerID)
+	serverIDs := make([]string, len(results))
+	for i, result := range results {
+		serverIDs[i] = result.Server.ID
+	}
+	availability := tb.serverMgr.GetAvailability(serverIDs)
+	message := messageFormatter.FormatPingTestResults(results, availability, currentServerID, scope.title)
 
 	// Create keyboard with quick select buttons for fastest servers
 	navigationHelper := NewNavigationHelper()
@@ -568,39 +977,11 @@ func (tb *TelegramBot) handlePingTestCallback(ctx context.Context, b *bot.Bot, c
 
 	// Add quick select buttons for fastest servers using the new sorting
 	if availableCount > 0 {
-		// Use the server manager's quick select functionality
-		quickSelectResults := tb.serverMgr.GetQuickSelectServers(results, 10)
-
-		var quickSelectServers []QuickSelectServer
-		for _, result := range quickSelectResults {
-			// Process server name with emoji awareness
-			processedServerName := tb.buttonTextProcessor.ProcessButtonText(result.Server.Name, 15)
-
-			status := ""
-			if result.Server.ID == currentServerID {
-				status = "✅"
-			} else {
-				status = fmt.Sprintf("%dms", result.Latency.Milliseconds())
-			}
-
-			// Create button text with proper formatting
-			buttonText := fmt.Sprintf("%s (%s)", processedServerName, status)
-
-			// Ensure the entire button text fits within reasonable limits
-			finalButtonText := tb.buttonTextProcessor.ProcessButtonText(buttonText, 30)
-
-			quickSelectServers = append(quickSelectServers, QuickSelectServer{
-				ID:         result.Server.ID,
-				ButtonText: finalButtonText,
-			})
-		}
-
-		quickSelectRows := navigationHelper.CreateQuickSelectKeyboard(quickSelectServers)
-		keyboardRows = append(keyboardRows, quickSelectRows...)
+		keyboardRows = append(keyboardRows, tb.quickSelectRows(results, currentServerID)...)
 	}
 
 	// Add standard navigation buttons
-	pingNavKeyboard := navigationHelper.CreatePingTestNavigationKeyboard(availableCount > 0)
+	pingNavKeyboard := navigationHelper.CreatePingTestNavigationKeyboard(availableCount > 0, scope.action)
 	keyboardRows = append(keyboardRows, pingNavKeyboard.InlineKeyboard...)
 
 	keyboard := &models.InlineKeyboardMarkup{
@@ -616,21 +997,52 @@ func (tb *TelegramBot) handlePingTestCallback(ctx context.Context, b *bot.Bot, c
 
 	_ = tb.messageManager.SendOrEdit(ctx, chatID, resultsContent)
 
-	// Clean up rate limiting tracking for this user
-	tb.pingUpdateMutex.Lock()
-	delete(tb.lastPingUpdate, chatID)
-	tb.pingUpdateMutex.Unlock()
+	tb.messageManager.ResetProgress(chatID)
 }
 
-func (tb *TelegramBot) handleMainMenuCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
+// quickSelectRows returns the quick select buttons of the best available servers
+func (tb *TelegramBot) quickSelectRows(results []types.PingResult, currentServerID string) [][]models.InlineKeyboardButton {
+	// Use the server manager's quick select functionality
+	quickSelectResults := tb.serverMgr.GetQuickSelectServers(results, 10)
+	skipConfirmation := tb.config.GetUIConfig().SkipSwitchConfirmation
+
+	var quickSelectServers []QuickSelectServer
+	listVersion := tb.serverMgr.GetListVersion()
+	for _, result := range quickSelectResults {
+		// Process server name with emoji awareness
+		processedServerName := tb.buttonTextProcessor.ProcessButtonText(result.Server.Name, 15)
+
+		status := ""
+		if result.Server.ID == currentServerID {
+			status = "✅"
+		} else {
+			status = fmt.Sprintf("%dms", result.Latency.Milliseconds())
+		}
+
+		// Create button text with proper formatting
+		buttonText := fmt.Sprintf("%s (%s)", processedServerName, status)
+
+		// Ensure the entire button text fits within reasonable limits
+		finalButtonText := tb.buttonTextProcessor.ProcessButtonText(buttonText, 30)
+
+		quickSelectServers = append(quickSelectServers, QuickSelectServer{
+			ID:          result.Server.ID,
+			ButtonText:  finalButtonText,
+			ListVersion: listVersion,
+			// The active server keeps the regular flow so it shows its status instead of failing to switch
+			SwitchNow: skipConfirmation && result.Server.ID != currentServerID,
+		})
+	}
+
+	return NewNavigationHelper().CreateQuickSelectKeyboard(quickSelectServers)
+}
+
+func (tb *TelegramBot) handleMainMenuCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string, snap *serverSnapshot) {
 	tb.logger.Info("Processing main menu callback for user %d", chatID)
 
-	_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-		CallbackQueryID: callbackQueryID,
-		Text:            "🏠 Main menu",
-	})
+	tb.answerCallback(ctx, callbackQueryID, "🏠 Main menu")
 
-	servers := tb.serverMgr.GetServers()
+	servers := snap.Servers()
 	tb.logger.Debug("Retrieved %d servers for main menu", len(servers))
 
 	messageFormatter := NewMessageFormatter()
@@ -638,6 +1050,8 @@ func (tb *TelegramBot) handleMainMenuCallback(ctx context.Context, b *bot.Bot, c
 
 	navigationHelper := NewNavigationHelper()
 	keyboard := navigationHelper.CreateMainMenuKeyboard()
+	tb.addPreviousServerButton(keyboard)
+	tb.addDirectModeButton(keyboard)
 	mainMenuContent := MessageContent{
 		Text:        message,
 		ReplyMarkup: keyboard,
@@ -651,25 +1065,19 @@ func (tb *TelegramBot) handleMainMenuCallback(ctx context.Context, b *bot.Bot, c
 	}
 }
 
-func (tb *TelegramBot) handlePaginationCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string, data string) {
+func (tb *TelegramBot) handlePaginationCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string, data string, snap *serverSnapshot) {
 	tb.logger.Info("Processing pagination callback for user %d: %s", chatID, data)
 
 	var page int
 	if _, err := fmt.Sscanf(data, "page_%d", &page); err != nil {
 		tb.logger.Error("Invalid page number in pagination callback: %s", data)
-		_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-			CallbackQueryID: callbackQueryID,
-			Text:            "❌ Invalid page number",
-		})
+		tb.answerCallback(ctx, callbackQueryID, "❌ Invalid page number")
 		return
 	}
 
-	_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-		CallbackQueryID: callbackQueryID,
-		Text:            fmt.Sprintf("📄 Page %d", page+1),
-	})
+	tb.answerCallback(ctx, callbackQueryID, fmt.Sprintf("📄 Page %d", page+1))
 
-	servers := tb.serverMgr.GetServers()
+	servers := snap.Servers()
 	tb.logger.Debug("Retrieved %d servers for pagination", len(servers))
 
 	if len(servers) == 0 {
@@ -683,7 +1091,6 @@ func (tb *TelegramBot) handlePaginationCallback(ctx context.Context, b *bot.Bot,
 		return
 	}
 
-	const serversPerPage = 32
 	totalPages := (len(servers) + serversPerPage - 1) / serversPerPage
 	if page < 0 || page >= totalPages {
 		tb.logger.Error("Invalid page number %d, total pages: %d", page, totalPages)
@@ -702,19 +1109,10 @@ func (tb *TelegramBot) handlePaginationCallback(ctx context.Context, b *bot.Bot,
 
 	tb.logger.Debug("Showing page %d/%d for user %d", page+1, totalPages, chatID)
 
-	currentServer := tb.serverMgr.GetCurrentServer()
-	var currentServerID string
-	if currentServer != nil {
-		currentServerID = currentServer.ID
-	}
-
-	messageFormatter := NewMessageFormatter()
-	message := messageFormatter.FormatServerListMessage(servers, currentServerID, page, totalPages)
-
-	keyboard := tb.createServerListKeyboard(servers, page)
+	listPage := tb.serverListPage(servers, snap.CurrentID(), page)
 	paginationContent := MessageContent{
-		Text:        message,
-		ReplyMarkup: keyboard,
+		Text:        listPage.text,
+		ReplyMarkup: listPage.keyboard,
 		Type:        MessageTypeServerList,
 	}
 
@@ -725,45 +1123,31 @@ func (tb *TelegramBot) handlePaginationCallback(ctx context.Context, b *bot.Bot,
 	}
 }
 
-func (tb *TelegramBot) handleServerSelectCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string, serverID string) {
+func (tb *TelegramBot) handleServerSelectCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string, serverID string, snap *serverSnapshot) {
 	tb.logger.Info("Processing server select callback for user %d, server: %s", chatID, serverID)
 
-	servers := tb.serverMgr.GetServers()
-	var selectedServer *types.Server
-	for _, server := range servers {
-		if server.ID == serverID {
-			selectedServer = &server
-			break
-		}
-	}
-
+	selectedServer := snap.Find(serverID)
 	if selectedServer == nil {
 		tb.logger.Error("Server not found for selection: %s", serverID)
-		_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-			CallbackQueryID: callbackQueryID,
-			Text:            "❌ Server not found",
-			ShowAlert:       true,
-		})
+		tb.alertCallback(ctx, callbackQueryID, "❌ Server not found")
 		return
 	}
 
 	tb.logger.Debug("Found server for selection: %s (%s:%d)", selectedServer.Name, selectedServer.Address, selectedServer.Port)
 
-	currentServer := tb.serverMgr.GetCurrentServer()
+	currentServer := snap.Current()
 	if currentServer != nil && currentServer.ID == serverID {
 		tb.logger.Debug("Server %s is already active, showing status", selectedServer.Name)
-		_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-			CallbackQueryID: callbackQueryID,
-			Text:            "✅ This server is already active",
-			ShowAlert:       true,
-		})
+		tb.alertCallback(ctx, callbackQueryID, "✅ This server is already active")
 
-		messageFormatter := NewMessageFormatter()
-		message := messageFormatter.FormatServerStatusMessage(selectedServer, nil)
+		message := tb.formatServerStatus(selectedServer, nil)
 		message += "\n🟢 This server is already active and running.\n\n💡 You can test the connection or choose a different server."
 
 		navigationHelper := NewNavigationHelper()
 		keyboard := navigationHelper.CreateServerStatusNavigationKeyboard(true)
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard,
+			[]models.InlineKeyboardButton{tb.favoriteButton(serverID), tb.noteButton(serverID)},
+			[]models.InlineKeyboardButton{tb.compareButton(serverID), tb.reachButton(serverID)})
 
 		activeServerContent := MessageContent{
 			Text:        message,
@@ -780,36 +1164,45 @@ func (tb *TelegramBot) handleServerSelectCallback(ctx context.Context, b *bot.Bo
 	}
 
 	tb.logger.Debug("Showing confirmation dialog for server switch to %s", selectedServer.Name)
-	_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-		CallbackQueryID: callbackQueryID,
-		Text:            "🔄 Preparing to switch...",
-	})
+	tb.answerCallback(ctx, callbackQueryID, "🔄 Preparing to switch...")
 
+	noteInfo := ""
+	if note := tb.serverMgr.GetServerNote(serverID); note != "" {
+		noteInfo = "\n📝 Note: " + note
+	}
 	currentServerInfo := ""
 	if currentServer != nil {
 		currentServerInfo = fmt.Sprintf("\n🔄 Current: %s (%s:%d)\n", currentServer.Name, currentServer.Address, currentServer.Port)
 	}
 
+	blockedInfo := ""
+	if selectedServer.Blocked() {
+		blockedInfo = fmt.Sprintf("⛔ %s is in your blocked countries, you will be asked once more.\n", selectedServer.BlockedCountry)
+	}
+
 	message := fmt.Sprintf("🔄 Confirm Server Switch\n\n"+
 		"🎯 Switch to: %s\n"+
 		"🌐 Address: %s:%d\n"+
 		"🔗 Protocol: %s\n"+
-		"🏷️ Tag: %s%s\n"+
+		"🏷️ Tag: %s%s%s\n"+
+		"%s"+
 		"⚠️ Warning: This will restart the xray service and briefly interrupt your connection.\n\n"+
 		"Are you sure you want to proceed?",
-		selectedServer.Name, selectedServer.Address, selectedServer.Port, selectedServer.Protocol, selectedServer.Tag, currentServerInfo)
+		selectedServer.Name, selectedServer.Address, selectedServer.Port, selectedServer.Protocol, selectedServer.Tag, noteInfo, currentServerInfo, blockedInfo)
 
 	navigationHelper := NewNavigationHelper()
 	confirmKeyboard := navigationHelper.CreateConfirmationKeyboard(
-		fmt.Sprintf("confirm_%s", serverID),
+		tb.serverCallback("confirm_", serverID),
 		"refresh",
 		"✅ Yes, Switch Server",
 		"❌ Cancel")
 
 	// Add test first option
 	confirmKeyboard.InlineKeyboard = append(confirmKeyboard.InlineKeyboard, []models.InlineKeyboardButton{
-		{Text: "📊 Test First", CallbackData: "ping_test"},
-	})
+		{Text: "📊 Test First", CallbackData: callbackServerID("ping_scope_srv_", serverID)},
+		tb.favoriteButton(serverID),
+	}, []models.InlineKeyboardButton{tb.noteButton(serverID), tb.compareButton(serverID)},
+		[]models.InlineKeyboardButton{tb.reachButton(serverID), tb.scheduleButton(serverID)})
 
 	confirmContent := MessageContent{
 		Text:        message,
@@ -824,23 +1217,137 @@ func (tb *TelegramBot) handleServerSelectCallback(ctx context.Context, b *bot.Bo
 	}
 }
 
-func (tb *TelegramBot) handleConfirmSwitchCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string, serverID string) {
-	tb.logger.Info("Processing server switch confirmation for user %d, server: %s", chatID, serverID)
+// showBlockedCountryWarning asks to confirm switching to a server in a blocked country
+func (tb *TelegramBot) showBlockedCountryWarning(ctx context.Context, chatID int64, callbackQueryID string, target *types.Server) {
+	tb.logger.Info("Asking user %d to confirm switching to %s in blocked country %s", chatID, target.Name, target.BlockedCountry)
+	tb.answerCallback(ctx, callbackQueryID, "⛔ Blocked country")
 
-	_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-		CallbackQueryID: callbackQueryID,
-		Text:            "🔄 Switching server...",
-	})
+	keyboard := NewNavigationHelper().CreateConfirmationKeyboard(
+		tb.serverCallback("blockedok_", target.ID),
+		tb.serverCallback("server_", target.ID),
+		"⛔ Switch Anyway",
+		"❌ Cancel")
+	content := MessageContent{
+		Text:        NewMessageFormatter().FormatBlockedCountryWarning(target),
+		ReplyMarkup: keyboard,
+		Type:        MessageTypeStatus,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send blocked country warning: %v", err)
+	}
+}
 
-	servers := tb.serverMgr.GetServers()
-	var selectedServer *types.Server
-	for _, server := range servers {
-		if server.ID == serverID {
-			selectedServer = &server
-			break
+// handleSwitchPreviousCallback switches back to the most recently used server in one tap
+func (tb *TelegramBot) handleSwitchPreviousCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string, initiator *models.User) {
+	previous := tb.serverMgr.GetPreviousServer()
+	if previous == nil {
+		tb.logger.Warn("No previous server available for user %d", chatID)
+		tb.alertCallback(ctx, callbackQueryID, "❌ No previous server available")
+		return
+	}
+
+	tb.logger.Info("Switching user %d back to previous server %s", chatID, previous.Name)
+	tb.handleConfirmSwitchCallback(ctx, b, chatID, callbackQueryID, previous.ID, initiator, false, tb.newServerSnapshot())
+}
+
+// handleDirectModeCallback pauses or resumes the proxy
+func (tb *TelegramBot) handleDirectModeCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string, enable bool) {
+	tb.logger.Info("Processing direct mode callback for user %d (enable: %t)", chatID, enable)
+
+	_, release, ok := tb.beginOperation(ctx, chatID, callbackQueryID, operations.OperationDirect)
+	if !ok {
+		return
+	}
+	defer release()
+
+	answerText := "▶️ Resuming proxy..."
+	if enable {
+		answerText = "⏸️ Disabling proxy..."
+	}
+	tb.answerCallback(ctx, callbackQueryID, answerText)
+
+	var err error
+	if enable {
+		err = tb.serverMgr.EnableDirectMode()
+	} else {
+		err = tb.serverMgr.DisableDirectMode()
+	}
+	if err != nil {
+		tb.logger.Error("Failed to toggle direct mode for user %d: %v", chatID, err)
+		title := "Failed to Resume Proxy"
+		if enable {
+			title = "Failed to Disable Proxy"
 		}
+		tb.messageManager.ForceCleanupUser(chatID, "direct mode toggle failed")
+		tb.sendErrorMessage(ctx, b, chatID, title, err.Error(), "status")
+		return
+	}
+
+	messageFormatter := NewMessageFormatter()
+	message := messageFormatter.FormatDirectModeMessage(enable, tb.serverMgr.GetCurrentServer())
+
+	navigationHelper := NewNavigationHelper()
+	keyboard := navigationHelper.CreateServerStatusNavigationKeyboard(true)
+	tb.addDirectModeButton(keyboard)
+
+	directModeContent := MessageContent{
+		Text:        message,
+		ReplyMarkup: keyboard,
+		Type:        MessageTypeStatus,
+	}
+
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, directModeContent); err != nil {
+		tb.logger.Error("Failed to send direct mode message: %v", err)
+	} else {
+		tb.logger.Info("Direct mode toggled for user %d (enabled: %t)", chatID, enable)
+	}
+}
+
+// addDirectModeButton adds a button to pause or resume the proxy depending on the current mode
+func (tb *TelegramBot) addDirectModeButton(keyboard *models.InlineKeyboardMarkup) {
+	if keyboard == nil {
+		return
 	}
 
+	button := models.InlineKeyboardButton{Text: "⏸️ Disable Proxy", CallbackData: "direct_mode_on"}
+	if tb.serverMgr.IsDirectMode() {
+		button = models.InlineKeyboardButton{Text: "▶️ Resume Proxy", CallbackData: "direct_mode_off"}
+	}
+	keyboard.InlineKeyboard = append([][]models.InlineKeyboardButton{{button}}, keyboard.InlineKeyboard...)
+}
+
+// addPreviousServerButton adds a one-tap button to switch back to the previous server, if any
+func (tb *TelegramBot) addPreviousServerButton(keyboard *models.InlineKeyboardMarkup) {
+	previous := tb.serverMgr.GetPreviousServer()
+	if previous == nil || keyboard == nil {
+		return
+	}
+
+	buttonText := tb.buttonTextProcessor.ProcessButtonText("↩️ Previous: "+previous.Name, 40)
+	row := []models.InlineKeyboardButton{{Text: buttonText, CallbackData: "switch_previous"}}
+	keyboard.InlineKeyboard = append([][]models.InlineKeyboardButton{row}, keyboard.InlineKeyboard...)
+}
+
+// handleConfirmSwitchCallback switches to the server, initiator is recorded in the audit log.
+// A server in a blocked country is only switched to once blockedConfirmed, until then
+// the warning asking to confirm it is shown.
+func (tb *TelegramBot) handleConfirmSwitchCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string, serverID string, initiator *models.User, blockedConfirmed bool, snap *serverSnapshot) {
+	tb.logger.Info("Processing server switch confirmation for user %d, server: %s", chatID, serverID)
+
+	selectedServer := snap.Find(serverID)
+	if selectedServer != nil && selectedServer.Blocked() && !blockedConfirmed {
+		tb.showBlockedCountryWarning(ctx, chatID, callbackQueryID, selectedServer)
+		return
+	}
+
+	op, release, ok := tb.beginOperation(ctx, chatID, callbackQueryID, operations.OperationSwitch)
+	if !ok {
+		return
+	}
+	defer release()
+
+	tb.answerCallback(ctx, callbackQueryID, "🔄 Switching server...")
+
 	if selectedServer == nil {
 		tb.logger.Error("Server not found for switch confirmation: %s", serverID)
 		// Force cleanup the user's active message since we're in an error state
@@ -851,9 +1358,20 @@ func (tb *TelegramBot) handleConfirmSwitchCallback(ctx context.Context, b *bot.B
 
 	tb.logger.Debug("Starting server switch to: %s (%s:%d)", selectedServer.Name, selectedServer.Address, selectedServer.Port)
 
+	// The connection through the previous server is compared with the new one after
+	// the switch, it is not in use in direct mode
+	previous := tb.serverMgr.GetCurrentServer()
+	if tb.serverMgr.IsDirectMode() {
+		previous = nil
+	}
+
 	// Step 1: Preparing configuration
-	message := fmt.Sprintf("🔄 Switching to Server\n\n🏷️ Name: %s\n🌐 Address: %s:%d\n🔗 Protocol: %s\n\n⏳ Step 1/4: Preparing configuration...",
-		selectedServer.Name, selectedServer.Address, selectedServer.Port, selectedServer.Protocol)
+	step1 := "Preparing configuration..."
+	if previous != nil && tb.config.GetSwitchComparison() {
+		step1 = "Preparing configuration and measuring the current connection..."
+	}
+	message := fmt.Sprintf("🔄 Switching to Server\n\n🏷️ Name: %s\n🌐 Address: %s:%d\n🔗 Protocol: %s\n\n⏳ Step 1/4: %s",
+		selectedServer.Name, selectedServer.Address, selectedServer.Port, selectedServer.Protocol, step1)
 
 	step1Content := MessageContent{
 		Text: message,
@@ -864,8 +1382,13 @@ func (tb *TelegramBot) handleConfirmSwitchCallback(ctx context.Context, b *bot.B
 		tb.logger.Error("Failed to send step 1 message: %v", err)
 		return
 	}
+	tb.trackOperationMessage(op, chatID, MessageTypeStatus)
 
-	time.Sleep(500 * time.Millisecond)
+	before := tb.measureSwitchSnapshot(ctx, previous)
+	if !pause(ctx, 500*time.Millisecond) {
+		tb.logger.Info("Server switch for user %d canceled", chatID)
+		return
+	}
 
 	// Step 2: Creating backup
 	message = fmt.Sprintf("🔄 Switching to Server\n\n🏷️ Name: %s\n🌐 Address: %s:%d\n🔗 Protocol: %s\n\n⏳ Step 2/4: Creating backup...",
@@ -878,7 +1401,10 @@ func (tb *TelegramBot) handleConfirmSwitchCallback(ctx context.Context, b *bot.B
 
 	_ = tb.messageManager.SendOrEdit(ctx, chatID, step2Content)
 
-	time.Sleep(500 * time.Millisecond)
+	if !pause(ctx, 500*time.Millisecond) {
+		tb.logger.Info("Server switch for user %d canceled", chatID)
+		return
+	}
 
 	// Step 3: Updating configuration
 	message = fmt.Sprintf("🔄 Switching to Server\n\n🏷️ Name: %s\n🌐 Address: %s:%d\n🔗 Protocol: %s\n\n⏳ Step 3/4: Updating configuration...",
@@ -891,7 +1417,10 @@ func (tb *TelegramBot) handleConfirmSwitchCallback(ctx context.Context, b *bot.B
 
 	_ = tb.messageManager.SendOrEdit(ctx, chatID, step3Content)
 
-	time.Sleep(500 * time.Millisecond)
+	if !pause(ctx, 500*time.Millisecond) {
+		tb.logger.Info("Server switch for user %d canceled", chatID)
+		return
+	}
 
 	// Step 4: Restarting xray service
 	message = fmt.Sprintf("🔄 Switching to Server\n\n🏷️ Name: %s\n🌐 Address: %s:%d\n🔗 Protocol: %s\n\n⏳ Step 4/4: Restarting xray service...",
@@ -905,22 +1434,35 @@ func (tb *TelegramBot) handleConfirmSwitchCallback(ctx context.Context, b *bot.B
 	_ = tb.messageManager.SendOrEdit(ctx, chatID, step4Content)
 
 	tb.logger.Debug("Executing server switch to %s", selectedServer.Name)
-	if err := tb.serverMgr.SwitchServer(serverID); err != nil {
+	if err := tb.serverMgr.SwitchServer(ctx, serverID); err != nil {
+		if ctx.Err() != nil {
+			tb.logger.Info("Server switch to %s for user %d canceled: %v", selectedServer.Name, chatID, err)
+			return
+		}
 		tb.logger.Error("Server switch failed for %s: %v", selectedServer.Name, err)
-		// Force cleanup the user's active message since the operation failed
-		tb.messageManager.ForceCleanupUser(chatID, "server switch failed")
-		tb.sendSwitchErrorMessage(ctx, b, chatID, selectedServer, err)
+		tb.handleSwitchFailure(ctx, b, chatID, selectedServer, err, initiator)
 		return
 	}
 
 	tb.logger.Info("Server switch successful to %s", selectedServer.Name)
+	tb.listCache.invalidate()
+	tb.recordSwitch(ctx, chatID, initiator, selectedServer.Name, audit.ReasonManual)
 
-	messageFormatter := NewMessageFormatter()
-	message = messageFormatter.FormatServerStatusMessage(selectedServer, nil)
+	message = tb.formatServerStatus(selectedServer, nil)
 	message += "\n🟢 Status: Active and ready\n⚡ Service: Xray restarted successfully\n\n🎉 You are now connected to the new server!"
+	if tb.config.GetSwitchComparison() {
+		_ = tb.messageManager.SendOrEdit(ctx, chatID, MessageContent{
+			Text: message + "\n\n⏳ Measuring the new connection...",
+			Type: MessageTypeStatus,
+		})
+		if after := tb.measureSwitchSnapshot(ctx, selectedServer); after != nil {
+			message += "\n\n" + NewMessageFormatter().FormatSwitchComparison(before, *after)
+		}
+	}
 
 	navigationHelper := NewNavigationHelper()
 	keyboard := navigationHelper.CreateServerStatusNavigationKeyboard(true)
+	tb.addPreviousServerButton(keyboard)
 
 	successContent := MessageContent{
 		Text:        message,
@@ -935,6 +1477,21 @@ func (tb *TelegramBot) handleConfirmSwitchCallback(ctx context.Context, b *bot.B
 	}
 }
 
+// measureSwitchSnapshot measures the connection through server for the comparison
+// shown after a switch. It returns nil when there is no server, the comparison is
+// turned off or the measurement could not run.
+func (tb *TelegramBot) measureSwitchSnapshot(ctx context.Context, server *types.Server) *types.ConnectivitySnapshot {
+	if server == nil || !tb.config.GetSwitchComparison() {
+		return nil
+	}
+	snapshot, err := tb.serverMgr.MeasureConnectivity(ctx, server.ID)
+	if err != nil {
+		tb.logger.Warn("Failed to measure the connection through %s: %v", server.Name, err)
+		return nil
+	}
+	return &snapshot
+}
+
 func (tb *TelegramBot) sendErrorMessage(ctx context.Context, _ *bot.Bot, chatID int64, title, description, retryAction string) {
 	tb.logger.Debug("Sending error message to user %d: %s - %s", chatID, title, description)
 
@@ -964,21 +1521,30 @@ func (tb *TelegramBot) sendErrorMessage(ctx context.Context, _ *bot.Bot, chatID
 	}
 }
 
-func (tb *TelegramBot) sendSwitchErrorMessage(ctx context.Context, _ *bot.Bot, chatID int64, server *types.Server, err error) {
+// sendSwitchErrorMessage reports a failed switch to server and which server stayed
+// active. backup, when set, is offered as the server to switch to instead.
+func (tb *TelegramBot) sendSwitchErrorMessage(ctx context.Context, _ *bot.Bot, chatID int64, server *types.Server, err error, backup *types.Server) {
 	tb.logger.Error("Sending server switch error message to user %d for server %s: %v", chatID, server.Name, err)
 	messageFormatter := NewMessageFormatter()
-	suggestions := []string{
+	suggestions := messageFormatter.ErrorSuggestions(err, []string{
 		"Check if the server is accessible",
 		"Try a different server",
 		"Refresh the server list",
 		"Check your network connection",
-	}
+	})
 	errorMessage := messageFormatter.FormatErrorMessage("Server Switch Failed", err.Error(), suggestions)
-	message := fmt.Sprintf("❌ Server Switch Failed\n\n🏷️ Server: %s\n🌐 Address: %s:%d\n\n%s",
-		server.Name, server.Address, server.Port, errorMessage)
+	message := fmt.Sprintf("❌ Server Switch Failed\n\n🏷️ Server: %s\n🌐 Address: %s:%d\n%s\n%s",
+		server.Name, server.Address, server.Port, formatActiveServer(tb.serverMgr.GetCurrentServer()), errorMessage)
 
 	navigationHelper := NewNavigationHelper()
 	keyboard := navigationHelper.CreateErrorNavigationKeyboard("server_switch", "refresh")
+	if backup != nil {
+		message += fmt.Sprintf("\n\n🛟 %s answered the last ping fastest and can be used instead.", backup.Name)
+		keyboard.InlineKeyboard = append([][]models.InlineKeyboardButton{{{
+			Text:         tb.buttonTextProcessor.ProcessServerButtonText(backup.Name, "🛟 Switch to", 50),
+			CallbackData: tb.serverCallback("confirm_", backup.ID),
+		}}}, keyboard.InlineKeyboard...)
+	}
 
 	switchErrorContent := MessageContent{
 		Text:        message,
@@ -995,10 +1561,7 @@ func (tb *TelegramBot) sendSwitchErrorMessage(ctx context.Context, _ *bot.Bot, c
 func (tb *TelegramBot) handleUpdateMenuCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
 	tb.logger.Info("Processing update menu callback for user %d", chatID)
 
-	_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-		CallbackQueryID: callbackQueryID,
-		Text:            "🔄 Checking for updates...",
-	})
+	tb.answerCallback(ctx, callbackQueryID, "🔄 Checking for updates...")
 
 	// Get update manager from handlers
 	updateManager := tb.handlers.updateManager
@@ -1071,10 +1634,7 @@ func (tb *TelegramBot) handleUpdateMenuCallback(ctx context.Context, b *bot.Bot,
 func (tb *TelegramBot) handleStatusCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
 	tb.logger.Info("Processing status callback for user %d", chatID)
 
-	_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-		CallbackQueryID: callbackQueryID,
-		Text:            "📊 Checking status...",
-	})
+	tb.answerCallback(ctx, callbackQueryID, "📊 Checking status...")
 
 	// This is similar to the /status command but accessed via callback
 	currentServer := tb.serverMgr.GetCurrentServer()
@@ -1091,7 +1651,7 @@ func (tb *TelegramBot) handleStatusCallback(ctx context.Context, b *bot.Bot, cha
 			"No server is currently selected or active", suggestions)
 
 		navigationHelper := NewNavigationHelper()
-		keyboard := navigationHelper.CreateErrorNavigationKeyboard("no_servers", "refresh")
+		keyboard := navigationHelper.CreateErrorNavigationKeyboard("no_active_server", "refresh")
 
 		noServerContent := MessageContent{
 			Text:        message,
@@ -1107,7 +1667,7 @@ func (tb *TelegramBot) handleStatusCallback(ctx context.Context, b *bot.Bot, cha
 		currentServer.Name, currentServer.Address, currentServer.Port)
 
 	messageFormatter := NewMessageFormatter()
-	message := messageFormatter.FormatServerStatusMessage(currentServer, nil)
+	message := tb.formatServerStatus(currentServer, nil)
 
 	// Show loading state first
 	loadingContent := MessageContent{
@@ -1123,15 +1683,15 @@ func (tb *TelegramBot) handleStatusCallback(ctx context.Context, b *bot.Bot, cha
 
 	tb.logger.Debug("Starting ping test for server %s", currentServer.Name)
 
-	results, err := tb.serverMgr.TestPing()
+	results, err := tb.serverMgr.TestPingWithProgress([]types.Server{*currentServer}, nil)
 	if err != nil {
 		tb.logger.Error("Ping test failed for status callback: %v", err)
 
-		suggestions := []string{
+		suggestions := messageFormatter.ErrorSuggestions(err, []string{
 			"Check your internet connection",
 			"Try a different server",
 			"Refresh server list",
-		}
+		})
 		errorMessage := messageFormatter.FormatErrorMessage("Connection Test Failed", err.Error(), suggestions)
 
 		navigationHelper := NewNavigationHelper()
@@ -1158,7 +1718,7 @@ func (tb *TelegramBot) handleStatusCallback(ctx context.Context, b *bot.Bot, cha
 	if currentResult == nil {
 		tb.logger.Warn("Current server not found in ping results for status callback")
 
-		updatedMessage := messageFormatter.FormatServerStatusMessage(currentServer, nil)
+		updatedMessage := tb.formatServerStatus(currentServer, nil)
 		updatedMessage += "\n⚠️ Warning\n" +
 			"└ Server not found in available servers\n" +
 			"└ Configuration may have changed"
@@ -1177,10 +1737,19 @@ func (tb *TelegramBot) handleStatusCallback(ctx context.Context, b *bot.Bot, cha
 	}
 
 	// Show final results
-	finalMessage := messageFormatter.FormatServerStatusMessage(currentServer, currentResult)
+	finalMessage := tb.formatServerStatus(currentServer, currentResult)
+	finalMessage += messageFormatter.FormatAvailability(tb.serverMgr.GetAvailability([]string{currentServer.ID})[currentServer.ID])
+	finalMessage += messageFormatter.FormatMatchConfidence(tb.serverMgr.GetCurrentServerMatch())
+	if tb.serverMgr.IsDirectMode() {
+		finalMessage += messageFormatter.FormatDirectModeNotice()
+	}
+	finalMessage += messageFormatter.FormatSubscriptionInfo(tb.serverMgr.GetSubscriptionInfo())
+	finalMessage += messageFormatter.FormatAPIStats(tb.messageManager.APIStats())
+	finalMessage += messageFormatter.FormatBotStats(tb.botStats())
 
 	navigationHelper := NewNavigationHelper()
 	keyboard := navigationHelper.CreateServerStatusNavigationKeyboard(true)
+	tb.addDirectModeButton(keyboard)
 
 	// Add next action suggestions
 	nextActions := navigationHelper.CreateNextActionSuggestions("status_checked", currentResult.Available)
@@ -1200,3 +1769,42 @@ func (tb *TelegramBot) handleStatusCallback(ctx context.Context, b *bot.Bot, cha
 		tb.logger.Info("Successfully sent server status to user %d", chatID)
 	}
 }
+
+// handleDetectCurrentCallback finds the active server in the xray config again and shows it
+func (tb *TelegramBot) handleDetectCurrentCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
+	tb.logger.Info("Processing detect current server callback for user %d", chatID)
+
+	tb.answerCallback(ctx, callbackQueryID, "🔎 Detecting current server...")
+
+	if err := tb.serverMgr.DetectCurrentServer(); err != nil {
+		tb.logger.Warn("Failed to detect current server: %v", err)
+		tb.sendErrorMessage(ctx, b, chatID, "Detection Failed", err.Error(), "detect_current")
+		return
+	}
+
+	currentServer := tb.serverMgr.GetCurrentServer()
+	if currentServer == nil {
+		tb.logger.Debug("Xray configuration has no proxy outbound")
+		tb.sendErrorMessage(ctx, b, chatID, "No Active Server", "The xray configuration has no proxy outbound", "refresh")
+		return
+	}
+
+	messageFormatter := NewMessageFormatter()
+	message := tb.formatServerStatus(currentServer, nil)
+	message += messageFormatter.FormatMatchConfidence(tb.serverMgr.GetCurrentServerMatch())
+
+	navigationHelper := NewNavigationHelper()
+	keyboard := navigationHelper.CreateServerStatusNavigationKeyboard(true)
+
+	detectContent := MessageContent{
+		Text:        message,
+		ReplyMarkup: keyboard,
+		Type:        MessageTypeStatus,
+	}
+
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, detectContent); err != nil {
+		tb.logger.Error("Failed to send detected server message: %v", err)
+	} else {
+		tb.logger.Info("Detected current server %s for user %d", currentServer.Name, chatID)
+	}
+}
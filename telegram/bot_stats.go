@@ -0,0 +1,65 @@
+package telegram
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"xray-telegram-manager/version"
+)
+
+// processStart is when the bot process started, for the uptime in /status
+var processStart = time.Now()
+
+// BotStats is a snapshot of the bot process, shown in /status to spot leaks on
+// long-running routers
+type BotStats struct {
+	Version    string
+	Uptime     time.Duration
+	RSS        int64
+	Goroutines int
+	// ActiveMessages is the number of active messages of all users and types
+	ActiveMessages int
+	// PendingUpdates is the number of progress updates held back by debouncing
+	PendingUpdates int
+	// Throttle counts the messages held back by the send throttle
+	Throttle ThrottleStats
+	// LastRefresh is when the server list was last loaded, zero before the first load
+	LastRefresh time.Time
+}
+
+// botStats collects the bot process metrics
+func (tb *TelegramBot) botStats() BotStats {
+	return BotStats{
+		Version:        version.String(),
+		Uptime:         time.Since(processStart),
+		RSS:            residentMemory(),
+		Goroutines:     runtime.NumGoroutine(),
+		ActiveMessages: tb.messageManager.ActiveMessageCount(),
+		PendingUpdates: tb.messageManager.PendingProgressCount(),
+		Throttle:       tb.messageManager.ThrottleStats(),
+		LastRefresh:    tb.serverMgr.GetLastRefresh(),
+	}
+}
+
+// residentMemory returns the resident set size of the process from /proc, or the
+// memory obtained by the Go runtime where /proc is not available
+func residentMemory() int64 {
+	if file, err := os.Open("/proc/self/status"); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "VmRSS:" {
+				if kb, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+					return kb * 1024
+				}
+			}
+		}
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return int64(mem.Sys)
+}
@@ -1,5 +1,11 @@
 package telegram
 
+import "unicode/utf16"
+
+// maxButtonTextUnits is the length limit of button text. Telegram counts UTF-16 code
+// units, so an emoji outside the basic plane takes two and a flag four.
+const maxButtonTextUnits = 64
+
 // ButtonTextProcessor handles emoji-aware text processing for Telegram buttons
 type ButtonTextProcessor struct {
 	maxLength int
@@ -48,11 +54,46 @@ func (btp *ButtonTextProcessor) ProcessButtonText(text string, maxLength int) st
 
 	// If text fits, return as-is
 	if displayLength <= targetLength {
-		return text
+		return btp.LimitButtonText(text)
 	}
 
 	// Truncate with emoji preservation
-	return btp.TruncateWithEmoji(text, targetLength)
+	return btp.LimitButtonText(btp.TruncateWithEmoji(text, targetLength))
+}
+
+// LimitButtonText cuts text to maxButtonTextUnits UTF-16 code units with an ellipsis.
+// Emoji sequences count as two display units but can take up to a dozen code units,
+// so text fitting the display length may still be too long for Telegram.
+func (btp *ButtonTextProcessor) LimitButtonText(text string) string {
+	if utf16Length(text) <= maxButtonTextUnits {
+		return text
+	}
+	ellipsis := "..."
+	limit := maxButtonTextUnits - len(ellipsis)
+
+	runes := []rune(text)
+	result := make([]rune, 0, len(runes))
+	units := 0
+	for i := 0; i < len(runes); {
+		length := btp.getEmojiLength(runes, i)
+		if length == 0 {
+			length = 1
+		}
+		sequence := runes[i : i+length]
+		sequenceUnits := len(utf16.Encode(sequence))
+		if units+sequenceUnits > limit {
+			break
+		}
+		result = append(result, sequence...)
+		units += sequenceUnits
+		i += length
+	}
+	return string(result) + ellipsis
+}
+
+// utf16Length returns the length of text in UTF-16 code units
+func utf16Length(text string) int {
+	return len(utf16.Encode([]rune(text)))
 }
 
 // CalculateTextLength calculates the real display length considering emojis
@@ -155,6 +196,11 @@ func (btp *ButtonTextProcessor) getEmojiLength(runes []rune, startIndex int) int
 	// Check for common emoji patterns
 	r := runes[startIndex]
 
+	// A flag is a pair of regional indicators and must not be split
+	if btp.isRegionalIndicator(r) && startIndex+1 < len(runes) && btp.isRegionalIndicator(runes[startIndex+1]) {
+		return 2
+	}
+
 	// Single emoji characters
 	if btp.isEmojiRune(r) {
 		length := 1
@@ -207,6 +253,11 @@ func (btp *ButtonTextProcessor) isEmojiRune(r rune) bool {
 		r == 0x2049 // Exclamation Question Mark
 }
 
+// isRegionalIndicator checks if a rune is one of the letters making up flags
+func (btp *ButtonTextProcessor) isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
 // isEmojiModifier checks if a rune is an emoji modifier
 func (btp *ButtonTextProcessor) isEmojiModifier(r rune) bool {
 	return r >= 0x1F3FB && r <= 0x1F3FF // Skin tone modifiers
@@ -282,5 +333,5 @@ func (btp *ButtonTextProcessor) ProcessServerButtonText(serverName string, statu
 	processedName := btp.ProcessButtonText(serverName, availableLength)
 
 	// Combine status emoji with processed name
-	return statusEmoji + " " + processedName
+	return btp.LimitButtonText(statusEmoji + " " + processedName)
 }
@@ -0,0 +1,111 @@
+package telegram
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot/models"
+)
+
+func TestButtonTextFitsTelegramLimit(t *testing.T) {
+	processor := NewButtonTextProcessor(50)
+	names := []string{
+		strings.Repeat("👨‍👩‍👧‍👦", 20),
+		strings.Repeat("🇩🇪", 40) + " Germany",
+		"🇯🇵 東京 " + strings.Repeat("サーバー", 20),
+		"🇷🇺 Москва " + strings.Repeat("очень длинное имя ", 5),
+		"⭐️ " + strings.Repeat("🏳️‍🌈", 30),
+	}
+	for _, name := range names {
+		for _, text := range []string{
+			processor.ProcessServerButtonText(name, "🟢", 50),
+			processor.ProcessButtonText(name, 0),
+			processor.LimitButtonText(name),
+		} {
+			if units := utf16Length(text); units > maxButtonTextUnits {
+				t.Errorf("Button text %q takes %d UTF-16 units, limit is %d", text, units, maxButtonTextUnits)
+			}
+			if !utf8.ValidString(text) {
+				t.Errorf("Button text %q is not valid UTF-8", text)
+			}
+		}
+	}
+}
+
+func TestLimitButtonTextKeepsFlagsWhole(t *testing.T) {
+	processor := NewButtonTextProcessor(50)
+	text := processor.LimitButtonText(strings.Repeat("🇩🇪", 40))
+	if !strings.HasSuffix(text, "...") {
+		t.Fatalf("Expected the text to be cut with an ellipsis, got %q", text)
+	}
+	flags := strings.TrimSuffix(text, "...")
+	if strings.Trim(flags, "🇩🇪") != "" || utf8.RuneCountInString(flags)%2 != 0 {
+		t.Errorf("Expected whole flags only, got %q", flags)
+	}
+	if short := "🇩🇪 Berlin"; processor.LimitButtonText(short) != short {
+		t.Errorf("Expected short text to stay as is, got %q", processor.LimitButtonText(short))
+	}
+}
+
+func TestLongServerIDsFitCallbackData(t *testing.T) {
+	long := strings.Repeat("very-long-subdomain_", 8) + "example_com_443"
+	short := "de_example_com_443"
+	servers := func() []types.Server {
+		return []types.Server{{ID: short}, {ID: long}}
+	}
+	ids := newShortIDs()
+
+	for _, action := range []string{"server_", "confirm_", "blockedok_", "compare_with_", "note_cancel_", "ping_scope_srv_"} {
+		data := serverCallbackData(action, long, "1a2b3c4d")
+		if len(data) > maxCallbackData {
+			t.Errorf("Callback data %q has %d bytes", data, len(data))
+		}
+		expanded := ids.expand(data, servers)
+		serverID, version := splitListVersion(strings.TrimPrefix(expanded, action))
+		if !strings.HasPrefix(expanded, action) || serverID != long || version != "1a2b3c4d" {
+			t.Errorf("Expected %q to expand to %s%s@1a2b3c4d, got %q", data, action, long, expanded)
+		}
+	}
+
+	if data := callbackServerID("server_", short); data != "server_"+short {
+		t.Errorf("Expected a short ID to be kept, got %q", data)
+	}
+	if data := ids.expand("server_"+short, servers); data != "server_"+short {
+		t.Errorf("Expected data without a hash to stay as is, got %q", data)
+	}
+	unknown := callbackServerID("server_", strings.Repeat("gone", 20))
+	if data := ids.expand(unknown, servers); data != unknown {
+		t.Errorf("Expected an unknown hash to stay as is, got %q", data)
+	}
+	// Known hashes are resolved without the server list
+	known := callbackServerID("server_", long)
+	if data := ids.expand(known, func() []types.Server { return nil }); data != "server_"+long {
+		t.Errorf("Expected a remembered hash to expand, got %q", data)
+	}
+}
+
+func TestValidateKeyboardDisablesOversizedButtons(t *testing.T) {
+	oversized := "server_" + strings.Repeat("x", maxCallbackData)
+	markup := &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+		{{Text: "🏠 Main Menu", CallbackData: "main_menu"}},
+		{{Text: strings.Repeat("👨‍👩‍👧‍👦", 20), CallbackData: oversized}},
+	}}
+	var reported []string
+	fixed := validateKeyboard(markup, func(data string) { reported = append(reported, data) })
+
+	if len(reported) != 1 || reported[0] != oversized {
+		t.Errorf("Expected the oversized callback data to be reported, got %v", reported)
+	}
+	button := fixed.InlineKeyboard[1][0]
+	if button.CallbackData != "noop" || utf16Length(button.Text) > maxButtonTextUnits {
+		t.Errorf("Expected the button to be fixed, got %+v", button)
+	}
+	if markup.InlineKeyboard[1][0].CallbackData != oversized {
+		t.Error("Expected the original keyboard to stay unchanged")
+	}
+	if valid := validateKeyboard(fixed, func(string) {}); valid != fixed {
+		t.Error("Expected a valid keyboard to be returned as is")
+	}
+}
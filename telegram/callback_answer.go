@@ -0,0 +1,92 @@
+package telegram
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"xray-telegram-manager/version"
+
+	"github.com/go-telegram/bot"
+)
+
+// callbackAnswers tracks the callback queries being handled and whether they were
+// answered. Telegram clients show a spinner on the pressed button until the query
+// is answered, so the dispatcher answers the ones a handler did not.
+type callbackAnswers struct {
+	mutex   sync.Mutex
+	pending map[string]bool
+}
+
+func newCallbackAnswers() *callbackAnswers {
+	return &callbackAnswers{pending: make(map[string]bool)}
+}
+
+// begin registers a callback query as not answered yet
+func (ca *callbackAnswers) begin(callbackQueryID string) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	ca.pending[callbackQueryID] = false
+}
+
+// claim marks a query as answered, false when it was answered before. Queries that
+// are not handled by the dispatcher can always be answered.
+func (ca *callbackAnswers) claim(callbackQueryID string) bool {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	answered, ok := ca.pending[callbackQueryID]
+	if !ok {
+		return true
+	}
+	if answered {
+		return false
+	}
+	ca.pending[callbackQueryID] = true
+	return true
+}
+
+// finish forgets a query and reports whether it was answered
+func (ca *callbackAnswers) finish(callbackQueryID string) bool {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	answered := ca.pending[callbackQueryID]
+	delete(ca.pending, callbackQueryID)
+	return answered
+}
+
+// answerCallback answers a callback query with a toast, an empty text only stops the
+// spinner. Only the first answer of a query is sent, empty IDs are ignored.
+func (tb *TelegramBot) answerCallback(ctx context.Context, callbackQueryID, text string) {
+	tb.sendCallbackAnswer(ctx, callbackQueryID, text, false)
+}
+
+// alertCallback answers a callback query with an alert the user has to close
+func (tb *TelegramBot) alertCallback(ctx context.Context, callbackQueryID, text string) {
+	tb.sendCallbackAnswer(ctx, callbackQueryID, text, true)
+}
+
+func (tb *TelegramBot) sendCallbackAnswer(ctx context.Context, callbackQueryID, text string, alert bool) {
+	if callbackQueryID == "" || !tb.callbackAnswers.claim(callbackQueryID) {
+		return
+	}
+	_, err := tb.bot.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+		CallbackQueryID: callbackQueryID,
+		Text:            text,
+		ShowAlert:       alert,
+	})
+	if err != nil {
+		tb.logger.Debug("Failed to answer callback query %s: %v", callbackQueryID, err)
+	}
+}
+
+// finishCallback answers a callback query its handler left unanswered. A panic of
+// the handler is logged and shown as an alert instead of stopping the bot.
+func (tb *TelegramBot) finishCallback(ctx context.Context, callbackQueryID, data string) {
+	if r := recover(); r != nil {
+		tb.logger.Error("Callback handler for %s panicked in %s: %v\n%s", data, version.String(), r, debug.Stack())
+		tb.alertCallback(ctx, callbackQueryID, "❌ Something went wrong, please try again")
+	}
+	if !tb.callbackAnswers.finish(callbackQueryID) {
+		tb.logger.Debug("Callback %s was not answered by its handler, answering it", data)
+		_, _ = tb.bot.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{CallbackQueryID: callbackQueryID})
+	}
+}
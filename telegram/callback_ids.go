@@ -0,0 +1,128 @@
+package telegram
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	// shortIDPrefix marks a shortened server ID in callback data, server IDs never
+	// contain it
+	shortIDPrefix = "#"
+	// shortIDLength is the number of hex digits of a shortened server ID
+	shortIDLength = 12
+)
+
+// callbackServerID returns the callback data of a button acting on a server. Server
+// IDs are made from the server address and can be longer than the 64 bytes Telegram
+// allows, such IDs are replaced with a hash the bot resolves when the button is
+// pressed, see expandCallbackData.
+func callbackServerID(action, serverID string) string {
+	if len(action)+len(serverID) <= maxCallbackData {
+		return action + serverID
+	}
+	return action + shortServerID(serverID)
+}
+
+// shortServerID returns the hash standing in for a long server ID
+func shortServerID(serverID string) string {
+	sum := sha256.Sum256([]byte(serverID))
+	return shortIDPrefix + hex.EncodeToString(sum[:])[:shortIDLength]
+}
+
+// shortIDs maps the shortened server IDs of pressed buttons back to the server IDs
+type shortIDs struct {
+	mutex sync.RWMutex
+	ids   map[string]string
+}
+
+func newShortIDs() *shortIDs {
+	return &shortIDs{ids: make(map[string]string)}
+}
+
+// expandCallbackData replaces a shortened server ID in data with the server ID, so
+// the handlers only see full IDs
+func (tb *TelegramBot) expandCallbackData(data string) string {
+	return tb.shortIDs.expand(data, tb.serverMgr.GetServers)
+}
+
+// expand replaces a shortened server ID in data with the server ID. A hash that is
+// not known yet is looked up in servers, which also resolves buttons sent before a
+// restart. An unknown hash is left as it is and the handler reports the server as
+// not found.
+func (s *shortIDs) expand(data string, servers func() []types.Server) string {
+	start := strings.Index(data, shortIDPrefix)
+	end := start + len(shortIDPrefix) + shortIDLength
+	if start < 0 || len(data) < end {
+		return data
+	}
+	short := data[start:end]
+	if _, err := hex.DecodeString(short[len(shortIDPrefix):]); err != nil {
+		return data
+	}
+
+	s.mutex.RLock()
+	serverID, ok := s.ids[short]
+	s.mutex.RUnlock()
+	if !ok {
+		for _, server := range servers() {
+			if shortServerID(server.ID) == short {
+				serverID, ok = server.ID, true
+				break
+			}
+		}
+		if !ok {
+			return data
+		}
+		s.mutex.Lock()
+		s.ids[short] = serverID
+		s.mutex.Unlock()
+	}
+	return data[:start] + serverID + data[end:]
+}
+
+// keyboardText cuts the button text of keyboards before they are sent
+var keyboardText = NewButtonTextProcessor(maxButtonTextUnits)
+
+// validateKeyboard returns markup with the buttons Telegram would reject fixed: button
+// text is cut to its limit and callback data over maxCallbackData bytes is replaced
+// with noop, since one bad button makes Telegram refuse the whole message. markup is
+// copied before it is changed, keyboards may be shared between messages.
+func validateKeyboard(markup *models.InlineKeyboardMarkup, invalid func(data string)) *models.InlineKeyboardMarkup {
+	var fixed *models.InlineKeyboardMarkup
+	for i, row := range markup.InlineKeyboard {
+		for j, button := range row {
+			text := keyboardText.LimitButtonText(button.Text)
+			data := button.CallbackData
+			if len(data) > maxCallbackData {
+				invalid(data)
+				data = "noop"
+			}
+			if text == button.Text && data == button.CallbackData {
+				continue
+			}
+			if fixed == nil {
+				fixed = copyKeyboard(markup)
+			}
+			fixed.InlineKeyboard[i][j].Text = text
+			fixed.InlineKeyboard[i][j].CallbackData = data
+		}
+	}
+	if fixed == nil {
+		return markup
+	}
+	return fixed
+}
+
+func copyKeyboard(markup *models.InlineKeyboardMarkup) *models.InlineKeyboardMarkup {
+	rows := make([][]models.InlineKeyboardButton, len(markup.InlineKeyboard))
+	for i, row := range markup.InlineKeyboard {
+		rows[i] = append([]models.InlineKeyboardButton(nil), row...)
+	}
+	return &models.InlineKeyboardMarkup{InlineKeyboard: rows}
+}
@@ -0,0 +1,100 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// changeDiffLength keeps a page of /changes well below the Telegram limit of 4096 characters
+const changeDiffLength = 3500
+
+// handleChanges shows the latest recorded change of the xray config
+func (tb *TelegramBot) handleChanges(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	tb.logger.Info("Received /changes command from user %d (%s)", userID, username)
+
+	if !tb.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionAdmin) {
+		tb.logger.Warn("Unauthorized access attempt from user %d (%s) for /changes command", userID, username)
+		tb.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/changes")
+		return
+	}
+
+	if err := tb.messageManager.SendNew(ctx, update.Message.Chat.ID, tb.changesPage(0)); err != nil {
+		tb.logger.Error("Failed to send config changes: %v", err)
+	}
+}
+
+// handleChangesCallback handles changes_page_<n>, which shows the n-th newest change
+func (tb *TelegramBot) handleChangesCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID, data string) {
+	page, err := strconv.Atoi(strings.TrimPrefix(data, "changes_page_"))
+	if err != nil || page < 0 {
+		tb.logger.Warn("Invalid config changes page from user %d: %s", chatID, data)
+		tb.answerCallback(ctx, callbackQueryID, "❌ Invalid page")
+		return
+	}
+	tb.answerCallback(ctx, callbackQueryID, "")
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, tb.changesPage(page)); err != nil {
+		tb.logger.Error("Failed to show config changes: %v", err)
+	}
+}
+
+// changesPage shows one recorded change with buttons to the newer and older ones
+func (tb *TelegramBot) changesPage(page int) MessageContent {
+	changes := tb.serverMgr.GetConfigChanges()
+	mainMenu := []models.InlineKeyboardButton{{Text: "🏠 Main Menu", CallbackData: "main_menu"}}
+	if len(changes) == 0 {
+		return MessageContent{
+			Text:        "📝 Config Changes\n\nNo changes of the xray config were recorded yet.",
+			ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{mainMenu}},
+			Type:        MessageTypeMenu,
+		}
+	}
+	// The list may have grown or been cut since the button was sent
+	page = min(page, len(changes)-1)
+
+	var navigation []models.InlineKeyboardButton
+	if page > 0 {
+		navigation = append(navigation, models.InlineKeyboardButton{
+			Text: "⬅️ Newer", CallbackData: fmt.Sprintf("changes_page_%d", page-1),
+		})
+	}
+	navigation = append(navigation, models.InlineKeyboardButton{
+		Text: fmt.Sprintf("📄 %d/%d", page+1, len(changes)), CallbackData: "noop",
+	})
+	if page < len(changes)-1 {
+		navigation = append(navigation, models.InlineKeyboardButton{
+			Text: "Older ➡️", CallbackData: fmt.Sprintf("changes_page_%d", page+1),
+		})
+	}
+
+	return MessageContent{
+		Text:        formatConfigChange(changes[page]),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{navigation, mainMenu}},
+		Type:        MessageTypeMenu,
+	}
+}
+
+// formatConfigChange shows the time, file and cause of a change followed by its diff
+func formatConfigChange(change types.ConfigChange) string {
+	var builder strings.Builder
+	builder.WriteString("📝 Config Change\n\n")
+	builder.WriteString(fmt.Sprintf("🕒 %s\n", change.Time.Format("2006-01-02 15:04:05")))
+	builder.WriteString(fmt.Sprintf("📄 %s (+%d −%d)\n", filepath.Base(change.File), change.Added, change.Removed))
+	builder.WriteString(fmt.Sprintf("💬 %s\n\n", change.Cause))
+
+	diff := change.Diff
+	if len(diff) > changeDiffLength {
+		cut := strings.LastIndexByte(diff[:changeDiffLength], '\n') + 1
+		diff = diff[:cut] + fmt.Sprintf("... %d more lines, see the changelog in the cache directory\n", strings.Count(diff[cut:], "\n"))
+	}
+	builder.WriteString(diff)
+	return strings.TrimRight(builder.String(), "\n")
+}
@@ -0,0 +1,220 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"xray-telegram-manager/operations"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// compareSelections remembers the first server each chat chose to compare, server
+// IDs are too long to fit both into the callback data of a button
+type compareSelections struct {
+	mutex  sync.Mutex
+	byChat map[int64]string
+}
+
+func newCompareSelections() *compareSelections {
+	return &compareSelections{byChat: make(map[int64]string)}
+}
+
+func (c *compareSelections) get(chatID int64) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.byChat[chatID]
+}
+
+func (c *compareSelections) set(chatID int64, serverID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.byChat[chatID] = serverID
+}
+
+// compareButton starts a comparison of a server with another one
+func (tb *TelegramBot) compareButton(serverID string) models.InlineKeyboardButton {
+	return models.InlineKeyboardButton{Text: "⚖️ Compare", CallbackData: callbackServerID("compare_", serverID)}
+}
+
+// handleCompareCallback handles compare_<id>, compare_page_<n> and compare_with_<id> buttons
+func (tb *TelegramBot) handleCompareCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID, data string) {
+	switch {
+	case strings.HasPrefix(data, "compare_with_"):
+		tb.handleCompareWithCallback(ctx, b, chatID, callbackQueryID, strings.TrimPrefix(data, "compare_with_"))
+	case strings.HasPrefix(data, "compare_page_"):
+		var page int
+		if _, err := fmt.Sscanf(data, "compare_page_%d", &page); err != nil {
+			tb.logger.Error("Invalid page number in compare callback: %s", data)
+			tb.answerCallback(ctx, callbackQueryID, "❌ Invalid page number")
+			return
+		}
+		tb.answerCallback(ctx, callbackQueryID, "")
+		tb.showComparePicker(ctx, chatID, page)
+	default:
+		serverID := strings.TrimPrefix(data, "compare_")
+		if tb.findServer(serverID) == nil {
+			tb.alertCallback(ctx, callbackQueryID, "❌ Server not found")
+			return
+		}
+		tb.comparisons.set(chatID, serverID)
+		tb.answerCallback(ctx, callbackQueryID, "⚖️ Choose the second server")
+		tb.showComparePicker(ctx, chatID, 0)
+	}
+}
+
+// showComparePicker lists the servers the first chosen server can be compared with
+func (tb *TelegramBot) showComparePicker(ctx context.Context, chatID int64, page int) {
+	first := tb.findServer(tb.comparisons.get(chatID))
+	if first == nil {
+		tb.sendCompareExpired(ctx, chatID)
+		return
+	}
+
+	var servers []types.Server
+	for _, server := range tb.serverMgr.GetServers() {
+		if server.ID != first.ID {
+			servers = append(servers, server)
+		}
+	}
+	totalPages := (len(servers) + serversPerPage - 1) / serversPerPage
+	if page < 0 || page >= totalPages {
+		page = 0
+	}
+	start := page * serversPerPage
+	end := start + serversPerPage
+	if end > len(servers) {
+		end = len(servers)
+	}
+
+	keyboard := make([][]models.InlineKeyboardButton, 0, end-start+2)
+	for _, server := range servers[start:end] {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{{
+			Text:         tb.buttonTextProcessor.ProcessServerButtonText(server.Name, "⚖️", 50),
+			CallbackData: callbackServerID("compare_with_", server.ID),
+		}})
+	}
+	if totalPages > 1 {
+		var paginationRow []models.InlineKeyboardButton
+		if page > 0 {
+			paginationRow = append(paginationRow, models.InlineKeyboardButton{
+				Text: "⬅️ Prev", CallbackData: fmt.Sprintf("compare_page_%d", page-1),
+			})
+		}
+		paginationRow = append(paginationRow, models.InlineKeyboardButton{
+			Text: fmt.Sprintf("📄 %d/%d", page+1, totalPages), CallbackData: "noop",
+		})
+		if page < totalPages-1 {
+			paginationRow = append(paginationRow, models.InlineKeyboardButton{
+				Text: "Next ➡️", CallbackData: fmt.Sprintf("compare_page_%d", page+1),
+			})
+		}
+		keyboard = append(keyboard, paginationRow)
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "⬅️ Back", CallbackData: tb.serverCallback("server_", first.ID)},
+	})
+
+	content := MessageContent{
+		Text:        NewMessageFormatter().FormatComparePicker(*first, page, totalPages),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		Type:        MessageTypeServerList,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send compare picker: %v", err)
+	}
+}
+
+// handleCompareWithCallback measures the chosen servers and shows them side by side
+// with a button to switch to the winner
+func (tb *TelegramBot) handleCompareWithCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID, secondID string) {
+	firstID := tb.comparisons.get(chatID)
+	if firstID == "" {
+		tb.answerCallback(ctx, callbackQueryID, "")
+		tb.sendCompareExpired(ctx, chatID)
+		return
+	}
+
+	op, release, ok := tb.beginOperation(ctx, chatID, callbackQueryID, operations.OperationPingTest)
+	if !ok {
+		return
+	}
+	defer release()
+
+	tb.answerCallback(ctx, callbackQueryID, "⚖️ Comparing servers...")
+	loadingContent := MessageContent{
+		Text:        "⚖️ Comparing servers...\n⏳ Pinging both servers, please wait...",
+		ReplyMarkup: tb.createEmptyKeyboard(),
+		Type:        MessageTypeServerList,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, loadingContent); err != nil {
+		tb.logger.Error("Failed to send comparison progress: %v", err)
+		return
+	}
+	tb.trackOperationMessage(op, chatID, MessageTypeServerList)
+
+	comparison, err := tb.serverMgr.CompareServers(firstID, secondID)
+	if err != nil {
+		tb.logger.Error("Failed to compare servers %s and %s: %v", firstID, secondID, err)
+		messageFormatter := NewMessageFormatter()
+		errorContent := MessageContent{
+			Text: messageFormatter.FormatErrorMessage("Comparison Failed", err.Error(), messageFormatter.ErrorSuggestions(err, []string{
+				"Refresh the server list",
+				"Choose the servers again",
+			})),
+			ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+				{{Text: "🏠 Main Menu", CallbackData: "main_menu"}},
+			}},
+			Type: MessageTypeServerList,
+		}
+		_ = tb.messageManager.SendOrEdit(ctx, chatID, errorContent)
+		return
+	}
+
+	var currentServerID string
+	if current := tb.serverMgr.GetCurrentServer(); current != nil {
+		currentServerID = current.ID
+	}
+	var keyboard [][]models.InlineKeyboardButton
+	if winner := comparison.WinnerServer(); winner != nil && winner.ID != currentServerID {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{{
+			Text:         tb.buttonTextProcessor.ProcessServerButtonText(winner.Name, "🔀 Switch to", 50),
+			CallbackData: tb.serverCallback("server_", winner.ID),
+		}})
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "🔁 Compare Again", CallbackData: callbackServerID("compare_with_", secondID)},
+		{Text: "⚖️ Other Server", CallbackData: "compare_page_0"},
+	}, []models.InlineKeyboardButton{
+		{Text: "🏠 Main Menu", CallbackData: "main_menu"},
+	})
+
+	content := MessageContent{
+		Text:        NewMessageFormatter().FormatServerComparison(comparison, currentServerID),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		Type:        MessageTypeServerList,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send server comparison: %v", err)
+	} else {
+		tb.logger.Info("Sent comparison of servers %s and %s to user %d", firstID, secondID, chatID)
+	}
+}
+
+// sendCompareExpired tells that the first server of the comparison is no longer known,
+// after a restart or a subscription refresh
+func (tb *TelegramBot) sendCompareExpired(ctx context.Context, chatID int64) {
+	content := MessageContent{
+		Text: "⚖️ The comparison has expired.\n\n💡 Open a server from /list and press ⚖️ Compare to start again.",
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: "🏠 Main Menu", CallbackData: "main_menu"}},
+		}},
+		Type: MessageTypeServerList,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send comparison expired message: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot"
+)
+
+// conflictStartupWindow is how long after start a getUpdates conflict means this
+// instance is the newcomer. Telegram answers 409 Conflict to both instances, the
+// one that was already running keeps polling and the newcomer stops.
+const conflictStartupWindow = 2 * time.Minute
+
+// conflictAlertInterval limits the warnings of a running instance about conflicts
+const conflictAlertInterval = time.Hour
+
+// conflictNoticeTimeout bounds sending the notice before the newcomer stops
+const conflictNoticeTimeout = 10 * time.Second
+
+// instanceConflict tracks getUpdates conflicts with another instance polling the
+// same bot token
+type instanceConflict struct {
+	mutex     sync.Mutex
+	startedAt time.Time
+	lastAlert time.Time
+	stopping  bool
+	onStop    func()
+}
+
+// OnDuplicateInstance sets what is called when this instance has to stop because
+// another one polls the same bot token
+func (tb *TelegramBot) OnDuplicateInstance(fn func()) {
+	tb.conflict.mutex.Lock()
+	defer tb.conflict.mutex.Unlock()
+	tb.conflict.onStop = fn
+}
+
+// handleBotError receives the errors of the bot library, a conflict of getUpdates
+// means another instance polls the same token
+func (tb *TelegramBot) handleBotError(err error) {
+	if !isConflictError(err) {
+		tb.logger.Error("Telegram bot error: %v", err)
+		return
+	}
+
+	tb.conflict.mutex.Lock()
+	if tb.conflict.stopping {
+		tb.conflict.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	newcomer := !tb.conflict.startedAt.IsZero() && now.Sub(tb.conflict.startedAt) < conflictStartupWindow
+	alert := newcomer || now.Sub(tb.conflict.lastAlert) >= conflictAlertInterval
+	if alert {
+		tb.conflict.lastAlert = now
+	}
+	tb.conflict.stopping = newcomer
+	onStop := tb.conflict.onStop
+	tb.conflict.mutex.Unlock()
+
+	if !newcomer {
+		tb.logger.Warn("Another instance polls the same bot token: %v", err)
+		if alert {
+			tb.sendConflictNotice(NewMessageFormatter().FormatDuplicateInstance(instanceName(), false))
+		}
+		return
+	}
+
+	tb.logger.Error("Another instance already polls the same bot token, stopping this one: %v", err)
+	tb.sendConflictNotice(NewMessageFormatter().FormatDuplicateInstance(instanceName(), true))
+	if onStop != nil {
+		onStop()
+	}
+}
+
+// sendConflictNotice tells the admin about the other instance. Sending is not
+// affected by the conflict, only receiving updates is.
+func (tb *TelegramBot) sendConflictNotice(text string) {
+	ctx, cancel := context.WithTimeout(context.Background(), conflictNoticeTimeout)
+	defer cancel()
+	if _, err := tb.messageManager.Send(ctx, &bot.SendMessageParams{
+		ChatID: tb.config.GetAdminID(),
+		Text:   text,
+	}); err != nil {
+		tb.logger.Error("Failed to send duplicate instance notice: %v", err)
+	}
+}
+
+// isConflictError reports whether err is the 409 Conflict Telegram returns to
+// getUpdates when another instance polls the same token
+func isConflictError(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	return strings.Contains(message, "getUpdates") &&
+		(strings.Contains(message, "statusCode 409") || strings.Contains(message, "Conflict:"))
+}
+
+// instanceName identifies this instance in the notice, e.g. router (pid 1234)
+func instanceName() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown host"
+	}
+	return fmt.Sprintf("%s (pid %d)", host, os.Getpid())
+}
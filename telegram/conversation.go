@@ -0,0 +1,215 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// defaultConversationTimeout ends a conversation when the user sends nothing for this long
+const defaultConversationTimeout = 5 * time.Minute
+
+// Conversation is the multi-step flow a chat is in, for example waiting for a
+// search query or a subscription URL. Only the user who started it can answer.
+type Conversation struct {
+	Flow   string
+	Step   string
+	ChatID int64
+	UserID int64
+	// Data keeps the input collected by the previous steps
+	Data map[string]string
+
+	expiresAt time.Time
+	busy      bool
+}
+
+// ConversationHandler handles a text message sent during the flow and returns the
+// next step. An empty step ends the conversation.
+type ConversationHandler func(ctx context.Context, b *bot.Bot, update *models.Update, conv *Conversation) string
+
+// ConversationFlow describes a multi-step flow
+type ConversationFlow struct {
+	// Title is shown when the flow is cancelled
+	Title string
+	// Timeout since the last input, defaultConversationTimeout when zero
+	Timeout time.Duration
+	Handle  ConversationHandler
+}
+
+// ConversationManager tracks which flow every chat is in and routes plain text
+// messages to it
+type ConversationManager struct {
+	mutex  sync.Mutex
+	flows  map[string]ConversationFlow
+	active map[int64]*Conversation
+}
+
+func NewConversationManager() *ConversationManager {
+	return &ConversationManager{
+		flows:  make(map[string]ConversationFlow),
+		active: make(map[int64]*Conversation),
+	}
+}
+
+// RegisterFlow makes a flow available to Start
+func (cm *ConversationManager) RegisterFlow(name string, flow ConversationFlow) {
+	if flow.Title == "" {
+		flow.Title = name
+	}
+	if flow.Timeout <= 0 {
+		flow.Timeout = defaultConversationTimeout
+	}
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.flows[name] = flow
+}
+
+// Start puts the chat into the first step of a flow, replacing the conversation
+// it was in
+func (cm *ConversationManager) Start(chatID, userID int64, flowName, step string) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	flow, exists := cm.flows[flowName]
+	if !exists {
+		return fmt.Errorf("unknown conversation flow %q", flowName)
+	}
+	cm.pruneUnsafe()
+	cm.active[chatID] = &Conversation{
+		Flow:      flowName,
+		Step:      step,
+		ChatID:    chatID,
+		UserID:    userID,
+		Data:      make(map[string]string),
+		expiresAt: time.Now().Add(flow.Timeout),
+	}
+	return nil
+}
+
+// Active returns a copy of the conversation of the chat
+func (cm *ConversationManager) Active(chatID int64) (Conversation, bool) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	conv := cm.activeUnsafe(chatID)
+	if conv == nil {
+		return Conversation{}, false
+	}
+	return *conv, true
+}
+
+// Cancel ends the conversation of the chat and returns the title of its flow
+func (cm *ConversationManager) Cancel(chatID int64) (string, bool) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	conv := cm.activeUnsafe(chatID)
+	if conv == nil {
+		return "", false
+	}
+	delete(cm.active, chatID)
+	return cm.flows[conv.Flow].Title, true
+}
+
+// matches reports whether update is plain text answering the conversation of its chat
+func (cm *ConversationManager) matches(update *models.Update) bool {
+	if update.Message == nil || update.Message.From == nil || update.Message.Text == "" {
+		return false
+	}
+	if strings.HasPrefix(update.Message.Text, "/") {
+		return false
+	}
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	conv := cm.activeUnsafe(update.Message.Chat.ID)
+	return conv != nil && conv.UserID == update.Message.From.ID
+}
+
+// handle runs the current step of the conversation with the message. Messages
+// arriving while a step is still running are ignored.
+func (cm *ConversationManager) handle(ctx context.Context, b *bot.Bot, update *models.Update) (handled bool) {
+	chatID := update.Message.Chat.ID
+
+	cm.mutex.Lock()
+	conv := cm.activeUnsafe(chatID)
+	if conv == nil || conv.busy || conv.UserID != update.Message.From.ID {
+		cm.mutex.Unlock()
+		return false
+	}
+	flow := cm.flows[conv.Flow]
+	conv.busy = true
+	cm.mutex.Unlock()
+
+	next := flow.Handle(ctx, b, update, conv)
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	conv.busy = false
+	// The handler may have started another flow or the user may have cancelled
+	if cm.active[chatID] != conv {
+		return true
+	}
+	if next == "" {
+		delete(cm.active, chatID)
+		return true
+	}
+	conv.Step = next
+	conv.expiresAt = time.Now().Add(flow.Timeout)
+	return true
+}
+
+// activeUnsafe returns the conversation of the chat, dropping it when it expired
+func (cm *ConversationManager) activeUnsafe(chatID int64) *Conversation {
+	conv, exists := cm.active[chatID]
+	if !exists {
+		return nil
+	}
+	if time.Now().After(conv.expiresAt) && !conv.busy {
+		delete(cm.active, chatID)
+		return nil
+	}
+	return conv
+}
+func (cm *ConversationManager) pruneUnsafe() {
+	for chatID := range cm.active {
+		cm.activeUnsafe(chatID)
+	}
+}
+
+// handleConversationText routes a plain text message to the flow the chat is in
+func (tb *TelegramBot) handleConversationText(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if !tb.conversations.handle(ctx, b, update) {
+		tb.logger.Debug("Ignored conversation input from user %d", update.Message.From.ID)
+	}
+}
+
+// handleCancel ends the flow the chat is in
+func (tb *TelegramBot) handleCancel(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatID := update.Message.Chat.ID
+	userID := update.Message.From.ID
+	tb.logger.Info("Received /cancel command from user %d (%s)", userID, getUsername(update.Message.From))
+
+	if !tb.isAuthorized(ctx, chatID, userID, PermissionView) {
+		tb.rejectUnauthorized(ctx, b, chatID, update.Message.From, "/cancel")
+		return
+	}
+
+	text := "ℹ️ Nothing to cancel"
+	if title, cancelled := tb.conversations.Cancel(chatID); cancelled {
+		tb.logger.Info("Cancelled %s for user %d", title, userID)
+		text = fmt.Sprintf("❌ %s cancelled", toTitle(title))
+	}
+
+	err := tb.messageManager.SendNew(ctx, chatID, MessageContent{
+		Text: text,
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: "🏠 Main Menu", CallbackData: "main_menu"}},
+		}},
+		Type: MessageTypeMenu,
+	})
+	if err != nil {
+		tb.logger.Error("Failed to send cancel message: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/fsutil"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// doctorFile is a file /doctor inspects
+type doctorFile struct {
+	path string
+	// private files may hold the bot token, the subscription URL or server keys
+	private bool
+}
+
+// doctorFiles returns the files with secrets the manager writes
+func (tb *TelegramBot) doctorFiles() []doctorFile {
+	configFile := tb.config.GetConfigFilePath()
+	files := []doctorFile{
+		{path: configFile, private: true},
+		{path: configFile + ".before-restore", private: true},
+	}
+	if cache := tb.serverMgr.GetCacheFile(); cache != "" {
+		files = append(files, doctorFile{path: cache, private: true})
+	}
+	return files
+}
+
+// handleDoctor checks the permissions of the files holding secrets
+func (tb *TelegramBot) handleDoctor(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	tb.logger.Info("Received /doctor command from user %d (%s)", userID, username)
+
+	if !tb.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionAdmin) {
+		tb.logger.Warn("Unauthorized access attempt from user %d (%s) for /doctor command", userID, username)
+		tb.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/doctor")
+		return
+	}
+
+	content := MessageContent{
+		Text: tb.doctorReport(),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: "🏠 Main Menu", CallbackData: "main_menu"}},
+		}},
+		Type: MessageTypeMenu,
+	}
+	if err := tb.messageManager.SendNew(ctx, update.Message.Chat.ID, content); err != nil {
+		tb.logger.Error("Failed to send doctor report: %v", err)
+	}
+}
+
+// doctorReport inspects the files and lists what is wrong with a command to fix it
+func (tb *TelegramBot) doctorReport() string {
+	tokenInConfig := tb.config.SecretSource("bot_token") == config.SourceConfig
+	configFile := tb.config.GetConfigFilePath()
+
+	var builder strings.Builder
+	builder.WriteString("🩺 Doctor\n\n")
+	switch tb.config.SecretSource("bot_token") {
+	case config.SourceEnv:
+		builder.WriteString("🔑 Bot token: environment\n\n")
+	case config.SourceSecretsFile:
+		builder.WriteString("🔑 Bot token: secrets file\n\n")
+	default:
+		builder.WriteString("🔑 Bot token: config file\n\n")
+	}
+
+	severe, total := 0, 0
+	reported := make(map[string]bool)
+	for _, file := range tb.doctorFiles() {
+		problems, err := fsutil.Inspect(file.path, file.private)
+		if err != nil {
+			builder.WriteString(fmt.Sprintf("⚠️ %s: %v\n", file.path, err))
+			total++
+			continue
+		}
+		for _, problem := range problems {
+			// The directory is reported once for all its files
+			key := problem.Path + "|" + problem.Text
+			if reported[key] {
+				continue
+			}
+			reported[key] = true
+			total++
+			icon := "⚠️"
+			if problem.Severe {
+				icon = "❌"
+				severe++
+			}
+			text := problem.Text
+			if problem.Path == configFile && tokenInConfig && strings.HasPrefix(problem.Text, "readable") {
+				text += ", it holds the bot token"
+			}
+			builder.WriteString(fmt.Sprintf("%s %s: %s\n", icon, problem.Path, text))
+			if problem.Fix != "" {
+				builder.WriteString(fmt.Sprintf("└ Fix: %s\n", problem.Fix))
+			}
+		}
+	}
+
+	switch {
+	case total == 0:
+		builder.WriteString("✅ Files with secrets are only accessible by the manager")
+	case severe > 0:
+		builder.WriteString(fmt.Sprintf("\n❌ %d problem(s), %d expose secrets or let other users change files", total, severe))
+	default:
+		builder.WriteString(fmt.Sprintf("\n⚠️ %d problem(s)", total))
+	}
+	return builder.String()
+}
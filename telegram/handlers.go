@@ -2,8 +2,12 @@ package telegram
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
+	"xray-telegram-manager/audit"
+	"xray-telegram-manager/operations"
 	"xray-telegram-manager/types"
 
 	"github.com/go-telegram/bot"
@@ -15,6 +19,11 @@ type CommandHandlers struct {
 	updateManager    UpdateManagerInterface
 	messageFormatter *MessageFormatter
 	navigationHelper *NavigationHelper
+
+	restoreSessions map[int64]*restoreSession
+	restoreMutex    sync.Mutex
+	scriptSessions  map[int64]*scriptSession
+	scriptMutex     sync.Mutex
 }
 
 func NewCommandHandlers(tb *TelegramBot, updateManager UpdateManagerInterface) *CommandHandlers {
@@ -23,6 +32,8 @@ func NewCommandHandlers(tb *TelegramBot, updateManager UpdateManagerInterface) *
 		updateManager:    updateManager,
 		messageFormatter: NewMessageFormatter(),
 		navigationHelper: NewNavigationHelper(),
+		restoreSessions:  make(map[int64]*restoreSession),
+		scriptSessions:   make(map[int64]*scriptSession),
 	}
 }
 
@@ -31,13 +42,13 @@ func (ch *CommandHandlers) handleStart(ctx context.Context, b *bot.Bot, update *
 	username := getUsername(update.Message.From)
 	ch.bot.logger.Info("Received /start command from user %d (%s)", userID, username)
 
-	if !ch.bot.isAuthorized(userID) {
+	if !ch.bot.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionView) {
 		ch.bot.logger.Warn("Unauthorized access attempt from user %d (%s)", userID, username)
-		ch.bot.sendUnauthorizedMessage(ctx, b, update.Message.Chat.ID)
+		ch.bot.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/start")
 		return
 	}
 
-	if !ch.bot.rateLimiter.IsAllowed(userID) {
+	if !ch.bot.allowRequest(ctx, update.Message.Chat.ID, userID, RequestCommand) {
 		ch.bot.logger.Warn("Rate limit exceeded for user %d (%s)", userID, username)
 		ch.sendRateLimitMessage(ctx, b, update.Message.Chat.ID)
 		return
@@ -46,9 +57,13 @@ func (ch *CommandHandlers) handleStart(ctx context.Context, b *bot.Bot, update *
 	ch.bot.logger.Debug("User %d is authorized, processing /start command", userID)
 
 	ch.bot.logger.Debug("Loading servers for /start command...")
-	if err := ch.bot.serverMgr.LoadServers(); err != nil {
+	if err := ch.bot.serverMgr.LoadServers(ctx); err != nil {
+		if ctx.Err() != nil {
+			ch.bot.logger.Info("/start for user %d canceled: %v", userID, err)
+			return
+		}
 		ch.bot.logger.Error("Failed to load servers for /start command: %v", err)
-		ch.sendErrorMessage(ctx, b, update.Message.Chat.ID, "Failed to load servers", err.Error(), "refresh")
+		ch.sendErrorMessage(ctx, b, update.Message.Chat.ID, ch.bot.withLoadRetry("Failed to load servers"), err.Error(), "refresh")
 		return
 	}
 
@@ -65,10 +80,13 @@ func (ch *CommandHandlers) handleStart(ctx context.Context, b *bot.Bot, update *
 	message := ch.messageFormatter.FormatWelcomeMessage(len(servers))
 
 	keyboard := ch.navigationHelper.CreateMainMenuKeyboard()
+	ch.bot.addPreviousServerButton(keyboard)
+	ch.bot.addDirectModeButton(keyboard)
 	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID:      update.Message.Chat.ID,
-		Text:        message,
-		ReplyMarkup: keyboard,
+		ChatID:          update.Message.Chat.ID,
+		MessageThreadID: ch.bot.topicFor(update.Message.Chat.ID, MessageTypeMenu),
+		Text:            message,
+		ReplyMarkup:     keyboard,
 	})
 
 	if err != nil {
@@ -83,13 +101,13 @@ func (ch *CommandHandlers) handleStatus(ctx context.Context, b *bot.Bot, update
 	username := getUsername(update.Message.From)
 	ch.bot.logger.Info("Received /status command from user %d (%s)", userID, username)
 
-	if !ch.bot.isAuthorized(userID) {
+	if !ch.bot.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionView) {
 		ch.bot.logger.Warn("Unauthorized access attempt from user %d (%s) for /status command", userID, username)
-		ch.bot.sendUnauthorizedMessage(ctx, b, update.Message.Chat.ID)
+		ch.bot.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/status")
 		return
 	}
 
-	if !ch.bot.rateLimiter.IsAllowed(userID) {
+	if !ch.bot.allowRequest(ctx, update.Message.Chat.ID, userID, RequestCommand) {
 		ch.bot.logger.Warn("Rate limit exceeded for user %d (%s)", userID, username)
 		ch.sendRateLimitMessage(ctx, b, update.Message.Chat.ID)
 		return
@@ -107,11 +125,12 @@ func (ch *CommandHandlers) handleStatus(ctx context.Context, b *bot.Bot, update
 	ch.bot.logger.Debug("Found active server: %s (%s:%d) for /status command",
 		currentServer.Name, currentServer.Address, currentServer.Port)
 
-	message := ch.messageFormatter.FormatServerStatusMessage(currentServer, nil)
+	message := ch.bot.formatServerStatus(currentServer, nil)
 
 	sentMsg, err := b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID: update.Message.Chat.ID,
-		Text:   message,
+		ChatID:          update.Message.Chat.ID,
+		MessageThreadID: ch.bot.topicFor(update.Message.Chat.ID, MessageTypeStatus),
+		Text:            message,
 	})
 	if err != nil {
 		ch.bot.logger.Error("Failed to send initial status message: %v", err)
@@ -120,7 +139,7 @@ func (ch *CommandHandlers) handleStatus(ctx context.Context, b *bot.Bot, update
 
 	ch.bot.logger.Debug("Sent initial status message, starting ping test for server %s", currentServer.Name)
 
-	results, err := ch.bot.serverMgr.TestPing()
+	results, err := ch.bot.serverMgr.TestPingWithProgress([]types.Server{*currentServer}, nil)
 	if err != nil {
 		ch.bot.logger.Error("Ping test failed for /status command: %v", err)
 		ch.updateStatusMessageWithError(ctx, b, sentMsg, currentServer, err)
@@ -153,12 +172,13 @@ func (ch *CommandHandlers) sendNoActiveServerMessage(ctx context.Context, b *bot
 	message := ch.messageFormatter.FormatErrorMessage("No Active Server",
 		"No server is currently selected or active", suggestions)
 
-	keyboard := ch.navigationHelper.CreateErrorNavigationKeyboard("no_servers", "refresh")
+	keyboard := ch.navigationHelper.CreateErrorNavigationKeyboard("no_active_server", "refresh")
 
 	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID:      chatID,
-		Text:        message,
-		ReplyMarkup: keyboard,
+		ChatID:          chatID,
+		MessageThreadID: ch.bot.topicFor(chatID, MessageTypeStatus),
+		Text:            message,
+		ReplyMarkup:     keyboard,
 	})
 
 	if err != nil {
@@ -176,7 +196,7 @@ func (ch *CommandHandlers) updateStatusMessageWithError(ctx context.Context, b *
 		Error:     testErr,
 	}
 
-	updatedMessage := ch.messageFormatter.FormatServerStatusMessage(server, mockResult)
+	updatedMessage := ch.bot.formatServerStatus(server, mockResult)
 
 	// Add suggestions
 	updatedMessage += "\n💡 Suggestions\n" +
@@ -195,7 +215,7 @@ func (ch *CommandHandlers) updateStatusMessageWithError(ctx context.Context, b *
 }
 
 func (ch *CommandHandlers) updateStatusMessageWithWarning(ctx context.Context, b *bot.Bot, sentMsg *models.Message, server *Server) {
-	updatedMessage := ch.messageFormatter.FormatServerStatusMessage(server, nil)
+	updatedMessage := ch.bot.formatServerStatus(server, nil)
 
 	// Add warning section
 	updatedMessage += "\n⚠️ Warning\n" +
@@ -219,6 +239,7 @@ func (ch *CommandHandlers) updateStatusMessageWithResult(ctx context.Context, b
 		Available: result.Available,
 		Latency:   result.Latency,
 		Error:     result.Error,
+		Family:    result.Family,
 	}
 
 	if result.Available {
@@ -227,9 +248,18 @@ func (ch *CommandHandlers) updateStatusMessageWithResult(ctx context.Context, b
 		ch.bot.logger.Debug("Server %s is not available, error: %v", server.Name, result.Error)
 	}
 
-	updatedMessage := ch.messageFormatter.FormatServerStatusMessage(server, pingResult)
+	updatedMessage := ch.bot.formatServerStatus(server, pingResult)
+	updatedMessage += ch.messageFormatter.FormatAvailability(ch.bot.serverMgr.GetAvailability([]string{server.ID})[server.ID])
+	updatedMessage += ch.messageFormatter.FormatMatchConfidence(ch.bot.serverMgr.GetCurrentServerMatch())
+	if ch.bot.serverMgr.IsDirectMode() {
+		updatedMessage += ch.messageFormatter.FormatDirectModeNotice()
+	}
+	updatedMessage += ch.messageFormatter.FormatSubscriptionInfo(ch.bot.serverMgr.GetSubscriptionInfo())
+	updatedMessage += ch.messageFormatter.FormatAPIStats(ch.bot.messageManager.APIStats())
+	updatedMessage += ch.messageFormatter.FormatBotStats(ch.bot.botStats())
 
 	keyboard := ch.navigationHelper.CreateServerStatusNavigationKeyboard(true)
+	ch.bot.addDirectModeButton(keyboard)
 
 	_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
 		ChatID:      sentMsg.Chat.ID,
@@ -249,8 +279,9 @@ func (ch *CommandHandlers) sendRateLimitMessage(ctx context.Context, b *bot.Bot,
 	message := ch.messageFormatter.FormatRateLimitMessage()
 
 	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID: chatID,
-		Text:   message,
+		ChatID:          chatID,
+		MessageThreadID: ch.bot.topicFor(chatID, MessageTypeMenu),
+		Text:            message,
 	})
 
 	if err != nil {
@@ -268,9 +299,10 @@ func (ch *CommandHandlers) sendErrorMessage(ctx context.Context, b *bot.Bot, cha
 	keyboard := ch.navigationHelper.CreateErrorNavigationKeyboard("general", retryAction)
 
 	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID:      chatID,
-		Text:        message,
-		ReplyMarkup: keyboard,
+		ChatID:          chatID,
+		MessageThreadID: ch.bot.topicFor(chatID, MessageTypeAlert),
+		Text:            message,
+		ReplyMarkup:     keyboard,
 	})
 
 	if err != nil {
@@ -284,9 +316,10 @@ func (ch *CommandHandlers) sendNoServersMessage(ctx context.Context, b *bot.Bot,
 	keyboard := ch.navigationHelper.CreateErrorNavigationKeyboard("no_servers", "refresh")
 
 	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID:      chatID,
-		Text:        message,
-		ReplyMarkup: keyboard,
+		ChatID:          chatID,
+		MessageThreadID: ch.bot.topicFor(chatID, MessageTypeMenu),
+		Text:            message,
+		ReplyMarkup:     keyboard,
 	})
 
 	if err != nil {
@@ -299,13 +332,13 @@ func (ch *CommandHandlers) handleUpdate(ctx context.Context, b *bot.Bot, update
 	username := getUsername(update.Message.From)
 	ch.bot.logger.Info("Received /update command from user %d (%s)", userID, username)
 
-	if !ch.bot.isAuthorized(userID) {
+	if !ch.bot.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionAdmin) {
 		ch.bot.logger.Warn("Unauthorized access attempt from user %d (%s) for /update command", userID, username)
-		ch.bot.sendUnauthorizedMessage(ctx, b, update.Message.Chat.ID)
+		ch.bot.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/update")
 		return
 	}
 
-	if !ch.bot.rateLimiter.IsAllowed(userID) {
+	if !ch.bot.allowRequest(ctx, update.Message.Chat.ID, userID, RequestCommand) {
 		ch.bot.logger.Warn("Rate limit exceeded for user %d (%s)", userID, username)
 		ch.sendRateLimitMessage(ctx, b, update.Message.Chat.ID)
 		return
@@ -321,11 +354,18 @@ func (ch *CommandHandlers) handleUpdate(ctx context.Context, b *bot.Bot, update
 		return
 	}
 
+	scriptStep := "• Download latest update script\n"
+	if script, err := ch.updateManager.CustomScript(); err != nil {
+		ch.bot.logger.Warn("Failed to read uploaded update script info: %v", err)
+	} else if script != nil {
+		scriptStep = fmt.Sprintf("• Run the uploaded update script %s (sha256 %s…)\n", script.Name, script.SHA256[:12])
+	}
+
 	// Send initial update message
 	message := "🔄 Bot Update\n\n" +
 		"⚠️ Warning: This will update the bot to the latest version and restart the service.\n\n" +
 		"📋 What will happen:\n" +
-		"• Download latest update script\n" +
+		scriptStep +
 		"• Create configuration backup (if enabled)\n" +
 		"• Install updates\n" +
 		"• Restart bot service\n\n" +
@@ -346,9 +386,10 @@ func (ch *CommandHandlers) handleUpdate(ctx context.Context, b *bot.Bot, update
 	}
 
 	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID:      update.Message.Chat.ID,
-		Text:        message,
-		ReplyMarkup: keyboard,
+		ChatID:          update.Message.Chat.ID,
+		MessageThreadID: ch.bot.topicFor(update.Message.Chat.ID, MessageTypeMenu),
+		Text:            message,
+		ReplyMarkup:     keyboard,
 	})
 
 	if err != nil {
@@ -358,13 +399,10 @@ func (ch *CommandHandlers) handleUpdate(ctx context.Context, b *bot.Bot, update
 	}
 }
 
-func (ch *CommandHandlers) handleUpdateConfirm(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
+func (ch *CommandHandlers) handleUpdateConfirm(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string, initiator *models.User) {
 	ch.bot.logger.Info("Processing update confirmation for user %d", chatID)
 
-	_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-		CallbackQueryID: callbackQueryID,
-		Text:            "🔄 Starting update...",
-	})
+	ch.bot.answerCallback(ctx, callbackQueryID, "🔄 Starting update...")
 
 	// Check if update is already in progress
 	status := ch.updateManager.GetUpdateStatus()
@@ -374,6 +412,11 @@ func (ch *CommandHandlers) handleUpdateConfirm(ctx context.Context, b *bot.Bot,
 		return
 	}
 
+	op, release, ok := ch.bot.beginOperation(ctx, chatID, "", operations.OperationUpdate)
+	if !ok {
+		return
+	}
+
 	// Send initial progress message
 	message := "🔄 Bot Update Started\n\n" +
 		"📊 Progress: 0%\n" +
@@ -382,25 +425,34 @@ func (ch *CommandHandlers) handleUpdateConfirm(ctx context.Context, b *bot.Bot,
 		"🔔 You will be notified when the update is complete."
 
 	progressMsg, err := b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID: chatID,
-		Text:   message,
+		ChatID:          chatID,
+		MessageThreadID: ch.bot.topicFor(chatID, MessageTypeMenu),
+		Text:            message,
 	})
 	if err != nil {
 		ch.bot.logger.Error("Failed to send initial update progress message: %v", err)
+		release()
 		return
 	}
+	ch.bot.serverMgr.Operations().SetProgressMessage(op.ID, chatID, progressMsg.ID)
+	ch.updateManager.TrackProgressMessage(chatID, progressMsg.ID)
+	ch.bot.recordAction(ctx, chatID, initiator, audit.ActionUpdate, ch.updateManager.GetCurrentVersion())
 
 	// Start monitoring progress updates
 	progressChan := ch.updateManager.StartProgressMonitoring()
 	defer ch.updateManager.StopProgressMonitoring()
+	defer ch.bot.messageManager.ResetProgress(chatID)
 
-	// Start the update process in a goroutine
+	// Start the update process in a goroutine; it owns the operation lock from now on
 	go func() {
+		defer release()
 		updateErr := ch.updateManager.ExecuteUpdate(ctx)
 		if updateErr != nil {
 			ch.bot.logger.Error("Update failed: %v", updateErr)
 			ch.sendUpdateErrorMessage(ctx, b, chatID, progressMsg.ID, updateErr)
 		}
+		// An update that restarts the bot runs the hook from the new process
+		ch.bot.runUpdateHook(ctx, ch.updateManager.GetUpdateStatus().FromVersion, updateErr)
 	}()
 
 	// Monitor progress updates
@@ -414,6 +466,7 @@ func (ch *CommandHandlers) handleUpdateConfirm(ctx context.Context, b *bot.Bot,
 		case progress, ok := <-progressChan:
 			if !ok {
 				// Channel closed, update completed
+				ch.redetectCurrentServer()
 				ch.sendUpdateCompleteMessage(ctx, b, chatID, progressMsg.ID)
 				return
 			}
@@ -433,6 +486,7 @@ func (ch *CommandHandlers) handleUpdateConfirm(ctx context.Context, b *bot.Bot,
 				if status.Error != nil {
 					ch.sendUpdateErrorMessage(ctx, b, chatID, progressMsg.ID, status.Error)
 				} else {
+					ch.redetectCurrentServer()
 					ch.sendUpdateCompleteMessage(ctx, b, chatID, progressMsg.ID)
 				}
 				return
@@ -450,6 +504,117 @@ func (ch *CommandHandlers) handleUpdateConfirm(ctx context.Context, b *bot.Bot,
 	}
 }
 
+// updateLogMaxBytes keeps the update log view below the message size limit of Telegram
+const updateLogMaxBytes = 3500
+
+// handleUpdateLog shows the end of the log of the last update run
+func (ch *CommandHandlers) handleUpdateLog(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
+	ch.bot.answerCallback(ctx, callbackQueryID, "")
+
+	var message string
+	text, modified, err := ch.updateManager.ReadUpdateLog(updateLogMaxBytes)
+	switch {
+	case err != nil:
+		ch.bot.logger.Warn("Failed to read update log: %v", err)
+		message = "📄 Update Log\n\n❌ The log of the last update is not available."
+	case text == "":
+		message = "📄 Update Log\n\nThe log of the last update is empty."
+	default:
+		message = fmt.Sprintf("📄 Update Log\n🕐 Last written: %s\n\n%s", modified.Format("02.01 15:04:05"), text)
+	}
+
+	keyboard := &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{
+			{
+				{Text: "ℹ️ Update Status", CallbackData: "update_status"},
+				{Text: "🏠 Main Menu", CallbackData: "main_menu"},
+			},
+		},
+	}
+
+	_, err = b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          chatID,
+		MessageThreadID: ch.bot.topicFor(chatID, MessageTypeMenu),
+		Text:            message,
+		ReplyMarkup:     keyboard,
+	})
+	if err != nil {
+		ch.bot.logger.Error("Failed to send update log: %v", err)
+	}
+}
+
+// reportUpdateResult edits the progress message of an update that restarted the bot
+// with the final status reported by the update script
+func (ch *CommandHandlers) reportUpdateResult(ctx context.Context, b *bot.Bot) {
+	result, err := ch.updateManager.TakeUpdateResult(ctx)
+	if err != nil {
+		ch.bot.logger.Warn("Failed to read the result of the last update: %v", err)
+		return
+	}
+	if result == nil {
+		return
+	}
+
+	ch.bot.logger.Info("Last update from %s finished at stage %q: %s", result.FromVersion, result.Stage, result.Message)
+	var updateErr error
+	if !result.Succeeded() {
+		updateErr = fmt.Errorf("update ended at stage %q: %s", result.Stage, result.Message)
+	}
+	go ch.bot.runUpdateHook(ctx, result.FromVersion, updateErr)
+	switch {
+	case result.Succeeded():
+		ch.redetectCurrentServer()
+		ch.sendUpdateCompleteMessage(ctx, b, result.ChatID, result.MessageID)
+	case result.Failed():
+		ch.sendUpdateErrorMessage(ctx, b, result.ChatID, result.MessageID, errors.New(result.Message))
+	default:
+		ch.sendUpdateInterruptedMessage(ctx, b, result)
+	}
+}
+
+// sendUpdateInterruptedMessage reports an update whose script stopped without a final status
+func (ch *CommandHandlers) sendUpdateInterruptedMessage(ctx context.Context, b *bot.Bot, result *UpdateResult) {
+	stage := result.Stage
+	if stage == "" {
+		stage = "not started"
+	}
+	message := fmt.Sprintf("⚠️ Update Status Unknown\n\n"+
+		"The bot was restarted, but the updater did not report the end of the update.\n\n"+
+		"📋 Last stage: %s\n"+
+		"🏷️ Previous version: %s\n"+
+		"🏷️ Running version: %s\n\n"+
+		"💡 The update log is available from the update status.",
+		stage,
+		result.FromVersion,
+		ch.updateManager.GetCurrentVersion())
+
+	keyboard := &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{
+			{
+				{Text: "ℹ️ Check Status", CallbackData: "update_status"},
+				{Text: "🏠 Main Menu", CallbackData: "main_menu"},
+			},
+		},
+	}
+
+	_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:      result.ChatID,
+		MessageID:   result.MessageID,
+		Text:        message,
+		ReplyMarkup: keyboard,
+	})
+	if err != nil {
+		ch.bot.logger.Error("Failed to send update interrupted message: %v", err)
+	}
+}
+
+// redetectCurrentServer re-syncs the current server after an update may have rewritten xray configs
+func (ch *CommandHandlers) redetectCurrentServer() {
+	if err := ch.bot.serverMgr.DetectCurrentServer(); err != nil {
+		ch.bot.logger.Warn("Failed to detect current server after update: %v", err)
+	}
+}
+
 func (ch *CommandHandlers) sendUpdateInProgressMessage(ctx context.Context, b *bot.Bot, chatID int64, status UpdateStatus) {
 	elapsed := time.Since(status.StartedAt)
 	message := fmt.Sprintf("🔄 Update Already in Progress\n\n"+
@@ -471,9 +636,10 @@ func (ch *CommandHandlers) sendUpdateInProgressMessage(ctx context.Context, b *b
 	}
 
 	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID:      chatID,
-		Text:        message,
-		ReplyMarkup: keyboard,
+		ChatID:          chatID,
+		MessageThreadID: ch.bot.topicFor(chatID, MessageTypeMenu),
+		Text:            message,
+		ReplyMarkup:     keyboard,
 	})
 
 	if err != nil {
@@ -482,20 +648,7 @@ func (ch *CommandHandlers) sendUpdateInProgressMessage(ctx context.Context, b *b
 }
 
 func (ch *CommandHandlers) updateProgressMessage(ctx context.Context, b *bot.Bot, chatID int64, messageID int, progress UpdateProgress) {
-	var stageEmoji string
-	switch progress.Stage {
-	case "downloading":
-		stageEmoji = "📥"
-	case "backing_up":
-		stageEmoji = "💾"
-	case "installing":
-		stageEmoji = "⚙️"
-	case "completing":
-		stageEmoji = "✅"
-	default:
-		stageEmoji = "🔄"
-	}
-
+	stageEmoji := ch.messageFormatter.getUpdateStageEmoji(progress.Stage)
 	progressBar := ch.messageFormatter.createProgressBar(progress.Progress, 20)
 
 	message := fmt.Sprintf("🔄 Bot Update in Progress\n\n"+
@@ -510,12 +663,11 @@ func (ch *CommandHandlers) updateProgressMessage(ctx context.Context, b *bot.Bot
 		progress.Stage,
 		progress.Message)
 
-	_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
-		ChatID:    chatID,
-		MessageID: messageID,
-		Text:      message,
+	// Updates coming faster than the update debounce interval are dropped
+	_, err := ch.bot.messageManager.EditProgress(ctx, chatID, messageID, MessageContent{
+		Text: message,
+		Type: MessageTypeUpdate,
 	})
-
 	if err != nil {
 		ch.bot.logger.Error("Failed to update progress message: %v", err)
 	}
@@ -530,6 +682,7 @@ func (ch *CommandHandlers) sendUpdateCompleteMessage(ctx context.Context, b *bot
 		"• ✅ Installed updates\n" +
 		"• ✅ Restarted bot service\n\n" +
 		"🟢 Status: Bot is now running the latest version\n" +
+		"🏷️ Version: " + ch.updateManager.GetCurrentVersion() + "\n" +
 		"🔄 Service: Fully operational\n\n" +
 		"💡 You can now continue using the bot normally."
 
@@ -561,7 +714,8 @@ func (ch *CommandHandlers) sendUpdateCompleteMessage(ctx context.Context, b *bot
 
 func (ch *CommandHandlers) sendUpdateErrorMessage(ctx context.Context, b *bot.Bot, chatID int64, messageID int, updateErr error) {
 	message := fmt.Sprintf("❌ Bot Update Failed\n\n"+
-		"🔴 Error: %s\n\n"+
+		"🔴 Error: %s\n"+
+		"🏷️ Running version: %s\n\n"+
 		"📋 Possible causes:\n"+
 		"• Network connectivity issues\n"+
 		"• Server maintenance\n"+
@@ -571,7 +725,7 @@ func (ch *CommandHandlers) sendUpdateErrorMessage(ctx context.Context, b *bot.Bo
 		"• Check your internet connection\n"+
 		"• Try again in a few minutes\n"+
 		"• Contact support if the issue persists",
-		updateErr.Error())
+		updateErr.Error(), ch.updateManager.GetCurrentVersion())
 
 	keyboard := &models.InlineKeyboardMarkup{
 		InlineKeyboard: [][]models.InlineKeyboardButton{
@@ -597,6 +751,8 @@ func (ch *CommandHandlers) sendUpdateErrorMessage(ctx context.Context, b *bot.Bo
 	} else {
 		ch.bot.logger.Info("Successfully sent update error message to user %d", chatID)
 	}
+	ch.bot.sendFallback(ctx, "Bot update failed", fmt.Sprintf("Bot update failed: %s\nRunning version: %s",
+		updateErr.Error(), ch.updateManager.GetCurrentVersion()), err == nil)
 }
 
 func (ch *CommandHandlers) sendUpdateTimeoutMessage(ctx context.Context, b *bot.Bot, chatID int64, messageID int) {
@@ -638,10 +794,7 @@ func (ch *CommandHandlers) sendUpdateTimeoutMessage(ctx context.Context, b *bot.
 func (ch *CommandHandlers) handleUpdateStatus(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
 	ch.bot.logger.Info("Processing update status request for user %d", chatID)
 
-	_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-		CallbackQueryID: callbackQueryID,
-		Text:            "ℹ️ Checking status...",
-	})
+	ch.bot.answerCallback(ctx, callbackQueryID, "ℹ️ Checking status...")
 
 	status := ch.updateManager.GetUpdateStatus()
 	currentVersion := ch.updateManager.GetCurrentVersion()
@@ -677,10 +830,12 @@ func (ch *CommandHandlers) handleUpdateStatus(ctx context.Context, b *bot.Bot, c
 		message = fmt.Sprintf("❌ Update Status: Failed\n\n"+
 			"🔴 Error: %s\n"+
 			"⏱️ Duration: %s\n"+
+			"🕐 Finished: %s\n"+
 			"🏷️ Current version: %s\n\n"+
 			"💡 The bot is still running on the previous version.",
 			status.Error.Error(),
 			elapsed.Round(time.Second),
+			status.CompletedAt.Format("2006-01-02 15:04:05"),
 			currentVersion)
 
 		keyboard = &models.InlineKeyboardMarkup{
@@ -696,14 +851,20 @@ func (ch *CommandHandlers) handleUpdateStatus(ctx context.Context, b *bot.Bot, c
 		}
 	} else if !status.StartedAt.IsZero() {
 		elapsed := status.CompletedAt.Sub(status.StartedAt)
+		previous := ""
+		if status.FromVersion != "" && status.FromVersion != currentVersion {
+			previous = fmt.Sprintf("🏷️ Previous version: %s\n", status.FromVersion)
+		}
 		message = fmt.Sprintf("✅ Update Status: Completed\n\n"+
 			"🎉 Last update: Successful\n"+
 			"⏱️ Duration: %s\n"+
 			"🕐 Completed: %s\n"+
+			"%s"+
 			"🏷️ Current version: %s\n\n"+
 			"🟢 Bot is running the latest version.",
 			elapsed.Round(time.Second),
-			status.CompletedAt.Format("15:04:05"),
+			status.CompletedAt.Format("2006-01-02 15:04:05"),
+			previous,
 			currentVersion)
 
 		keyboard = &models.InlineKeyboardMarkup{
@@ -736,10 +897,17 @@ func (ch *CommandHandlers) handleUpdateStatus(ctx context.Context, b *bot.Bot, c
 		}
 	}
 
+	if ch.updateManager.HasUpdateLog() {
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []models.InlineKeyboardButton{
+			{Text: "📄 View update log", CallbackData: "update_log"},
+		})
+	}
+
 	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID:      chatID,
-		Text:        message,
-		ReplyMarkup: keyboard,
+		ChatID:          chatID,
+		MessageThreadID: ch.bot.topicFor(chatID, MessageTypeMenu),
+		Text:            message,
+		ReplyMarkup:     keyboard,
 	})
 
 	if err != nil {
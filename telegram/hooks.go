@@ -0,0 +1,39 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"xray-telegram-manager/audit"
+	"xray-telegram-manager/hooks"
+)
+
+// recordHook saves the run of a hook script with its output in the audit log
+func (tb *TelegramBot) recordHook(result hooks.Result) {
+	detail := fmt.Sprintf("%s, exit %d in %s", result.Event, result.ExitCode, result.Duration.Round(100*time.Millisecond))
+	if result.Err != nil {
+		detail = fmt.Sprintf("%s, failed: %v", result.Event, result.Err)
+	}
+	entry := audit.Entry{User: "hook", Action: audit.ActionHook, Detail: detail, Output: result.Output}
+	if err := tb.audit.Record(entry); err != nil {
+		tb.logger.Error("Failed to record the %s hook: %v", result.Event, err)
+	}
+}
+
+// runUpdateHook runs the post_update hook script with the outcome of an update from
+// fromVersion, updateErr is nil when the update succeeded
+func (tb *TelegramBot) runUpdateHook(ctx context.Context, fromVersion string, updateErr error) {
+	env := map[string]string{
+		"XRAY_RESULT":       "ok",
+		"XRAY_FROM_VERSION": fromVersion,
+		"XRAY_TO_VERSION":   tb.handlers.updateManager.GetCurrentVersion(),
+	}
+	if updateErr != nil {
+		env["XRAY_RESULT"] = "failed"
+		env["XRAY_ERROR"] = updateErr.Error()
+	}
+	result, ok := tb.serverMgr.Hooks().Run(context.WithoutCancel(ctx), hooks.PostUpdate, env)
+	if ok && result.Err != nil {
+		tb.logger.Warn("Hook %s failed: %v, output: %s", result.Script, result.Err, result.Output)
+	}
+}
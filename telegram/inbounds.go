@@ -0,0 +1,121 @@
+package telegram
+
+import (
+	"context"
+	"strings"
+	"xray-telegram-manager/operations"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// localProxyProtocols are the local proxies /inbounds can turn on, in button order
+var localProxyProtocols = []struct {
+	protocol string
+	name     string
+}{
+	{"socks", "SOCKS5"},
+	{"http", "HTTP"},
+}
+
+// handleInbounds shows the xray inbounds and the local proxy buttons
+func (tb *TelegramBot) handleInbounds(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	tb.logger.Info("Received /inbounds command from user %d (%s)", userID, username)
+
+	if !tb.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionAdmin) {
+		tb.logger.Warn("Unauthorized access attempt from user %d (%s) for /inbounds command", userID, username)
+		tb.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/inbounds")
+		return
+	}
+
+	if err := tb.messageManager.SendNew(ctx, update.Message.Chat.ID, tb.inboundsMenuContent("")); err != nil {
+		tb.logger.Error("Failed to send inbounds menu: %v", err)
+	}
+}
+
+// handleInboundsCallback handles the inbounds_on_<protocol> and inbounds_off_<protocol>
+// buttons. The inbounds file is changed and xray is restarted, so it runs as an operation.
+func (tb *TelegramBot) handleInboundsCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID, data string) {
+	action, protocol, found := strings.Cut(strings.TrimPrefix(data, "inbounds_"), "_")
+	if !found || (action != "on" && action != "off") {
+		tb.logger.Warn("Unknown inbounds callback from user %d: %s", chatID, data)
+		tb.answerCallback(ctx, callbackQueryID, "❌ Unknown inbounds action")
+		return
+	}
+	enable := action == "on"
+
+	op, release, ok := tb.beginOperation(ctx, chatID, callbackQueryID, operations.OperationInbounds)
+	if !ok {
+		return
+	}
+	defer release()
+
+	tb.answerCallback(ctx, callbackQueryID, "🔄 Updating inbounds and restarting xray...")
+
+	progress := MessageContent{
+		Text: "🔄 Updating inbounds\n\n└ Restarting xray and checking it is running...",
+		Type: MessageTypeStatus,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, progress); err != nil {
+		tb.logger.Error("Failed to send inbounds progress: %v", err)
+	}
+	tb.trackOperationMessage(op, chatID, MessageTypeStatus)
+
+	if err := tb.serverMgr.SetLocalProxy(protocol, enable); err != nil {
+		tb.logger.Error("Failed to change local %s proxy for user %d: %v", protocol, chatID, err)
+		tb.messageManager.ForceCleanupUser(chatID, "inbounds change failed")
+		tb.sendErrorMessage(ctx, b, chatID, "Failed to Change Inbounds", err.Error(), data)
+		return
+	}
+
+	tb.logger.Info("User %d turned local %s proxy %s", chatID, protocol, action)
+	notice := "✅ Inbounds updated, xray restarted"
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, tb.inboundsMenuContent(notice)); err != nil {
+		tb.logger.Error("Failed to update inbounds menu: %v", err)
+	}
+}
+
+func (tb *TelegramBot) inboundsMenuContent(notice string) MessageContent {
+	messageFormatter := NewMessageFormatter()
+	inbounds, err := tb.serverMgr.GetInbounds()
+
+	var keyboard [][]models.InlineKeyboardButton
+	if err == nil {
+		for _, proxy := range localProxyProtocols {
+			enabled := localProxyEnabled(inbounds, proxy.protocol)
+			action := "on"
+			if enabled {
+				action = "off"
+			}
+			keyboard = append(keyboard, []models.InlineKeyboardButton{
+				{Text: onOffIcon(enabled) + " Local " + proxy.name, CallbackData: "inbounds_" + action + "_" + proxy.protocol},
+			})
+		}
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "🏠 Main Menu", CallbackData: "main_menu"},
+	})
+
+	text := messageFormatter.FormatInbounds(inbounds, err)
+	if notice != "" {
+		text = notice + "\n\n" + text
+	}
+	return MessageContent{
+		Text:        text,
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		Type:        MessageTypeMenu,
+	}
+}
+
+// localProxyEnabled reports whether the bot added the local proxy of protocol
+func localProxyEnabled(inbounds []types.InboundStatus, protocol string) bool {
+	for _, inbound := range inbounds {
+		if inbound.Managed && inbound.Protocol == protocol {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package telegram
+
+import (
+	"strings"
+	"sync"
+)
+
+// inflightCallbacks tracks the callbacks each user is waiting for, so double taps
+// do not run the same action twice or start a second restart of xray
+type inflightCallbacks struct {
+	mutex sync.Mutex
+	users map[int64]map[string]bool
+}
+
+func newInflightCallbacks() *inflightCallbacks {
+	return &inflightCallbacks{users: make(map[int64]map[string]bool)}
+}
+
+// begin registers data as in flight for userID. It fails when the same callback is
+// still processed, or when data is exclusive and another exclusive callback of the
+// user runs. done must be called when the callback was handled.
+func (ic *inflightCallbacks) begin(userID int64, data string) (done func(), ok bool) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+
+	pending := ic.users[userID]
+	if pending[data] {
+		return nil, false
+	}
+	if isExclusiveCallback(data) {
+		for other := range pending {
+			if isExclusiveCallback(other) {
+				return nil, false
+			}
+		}
+	}
+
+	if pending == nil {
+		pending = make(map[string]bool)
+		ic.users[userID] = pending
+	}
+	pending[data] = true
+	return func() {
+		ic.mutex.Lock()
+		defer ic.mutex.Unlock()
+		delete(pending, data)
+		if len(pending) == 0 {
+			delete(ic.users, userID)
+		}
+	}, true
+}
+
+// isExclusiveCallback reports whether a callback restarts xray, changes its config or
+// runs a long check. A user runs one of them at a time.
+func isExclusiveCallback(data string) bool {
+	switch {
+	case data == "refresh", data == "status", data == "switch_previous", data == "restore_confirm",
+		strings.HasPrefix(data, "ping_scope_"), strings.HasPrefix(data, "confirm_"),
+		strings.HasPrefix(data, "direct_mode_"), strings.HasPrefix(data, "recover_"):
+		return true
+	}
+	return false
+}
@@ -1,7 +1,11 @@
 package telegram
 
 import (
+	"context"
+	"time"
 	"xray-telegram-manager/config"
+	"xray-telegram-manager/hooks"
+	"xray-telegram-manager/operations"
 	"xray-telegram-manager/types"
 )
 
@@ -17,19 +21,77 @@ type ConfigProvider interface {
 	GetAdminID() int64
 	GetBotToken() string
 	GetUpdateConfig() config.UpdateConfig
+	GetUIConfig() config.UIConfig
+	GetPingProfiles() config.PingProfiles
+	GetGroupConfig() config.GroupConfig
+	GetQuietHours() config.QuietHours
+	GetDailyDigest() config.DailyDigest
+	GetSecurity() config.Security
+	GetHTTPProxy() string
+	GetSwitchFallback() string
+	GetSwitchComparison() bool
+	GetNotificationChats() []int64
+	GetFallbackNotifier() config.Fallback
+	GetConfigFilePath() string
+	SecretSource(name string) string
 }
 
 type ServerManager interface {
-	LoadServers() error
+	LoadServers(ctx context.Context) error
 	GetServers() []types.Server
+	GetListVersion() string
 	GetCurrentServer() *types.Server
-	SwitchServer(serverID string) error
+	SwitchServer(ctx context.Context, serverID string) error
 	GetServerByID(serverID string) (*types.Server, error)
-	RefreshServers() error
+	RefreshServers(ctx context.Context) error
 	TestPing() ([]types.PingResult, error)
-	TestPingWithProgress(progressCallback func(completed, total int, serverName string)) ([]types.PingResult, error)
+	TestPingWithProgress(servers []types.Server, progressCallback func(completed, total int, serverName string)) ([]types.PingResult, error)
+	TestPingWithProfile(servers []types.Server, profile config.PingProfile, progressCallback func(completed, total int, serverName string)) ([]types.PingResult, error)
 	GetQuickSelectServers(results []types.PingResult, limit int) []types.PingResult
+	GetBackupServers(exclude []string, limit int) []types.Server
+	GetAvailability(serverIDs []string) map[string]types.Availability
+	GetPingDigest() types.PingDigest
+	CompareServers(firstID, secondID string) (types.ServerComparison, error)
+	ProbeDomain(ctx context.Context, serverID, domain string) (types.ReachResult, error)
+	MeasureConnectivity(ctx context.Context, serverID string) (types.ConnectivitySnapshot, error)
+	ReadXrayLog(offset int64, maxLines int) (types.XrayLog, error)
+	GetFavoriteServers() []types.Server
+	IsFavorite(serverID string) bool
+	ToggleFavorite(serverID string) (bool, error)
+	GetServerNote(serverID string) string
+	GetServerNotes() map[string]string
+	SetServerNote(serverID, note string) error
+	GetCountries() []types.CountryGroup
+	GetServersByCountry(code string) []types.Server
 	GetServerStatus() (map[string]interface{}, error)
 	SetCurrentServer(serverID string) error
 	DetectCurrentServer() error
+	GetCurrentServerMatch() types.MatchConfidence
+	GetPreviousServer() *types.Server
+	IsDirectMode() bool
+	EnableDirectMode() error
+	DisableDirectMode() error
+	Panic(ctx context.Context) (types.PanicResult, error)
+	GetCacheFile() string
+	GetOverridesFile() string
+	GetStatsFile() string
+	ReloadState()
+	GetConfigChanges() []types.ConfigChange
+	GetSubscriptionInfo() *types.SubscriptionInfo
+	GetLastRefresh() time.Time
+	GetLoadRetry() *types.LoadRetry
+	OutboundOptions(serverID string) types.OutboundOptions
+	GetOutboundDefaults() types.OutboundOverride
+	SetOutboundDefaults(override types.OutboundOverride) error
+	GetOutboundOverride(serverID string) types.OutboundOverride
+	SetOutboundOverride(serverID string, override types.OutboundOverride) error
+	ApplyOutboundOptions() error
+	GetRoutingPresets() ([]types.RoutingPresetStatus, error)
+	SetRoutingPreset(id string, enabled bool) error
+	GetInbounds() ([]types.InboundStatus, error)
+	SetLocalProxy(protocol string, enabled bool) error
+	GetConfigRecoveryInfo() types.ConfigRecoveryInfo
+	RecoverXrayConfig(source string) error
+	Operations() *operations.Coordinator
+	Hooks() *hooks.Runner
 }
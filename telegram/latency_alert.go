@@ -0,0 +1,29 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"xray-telegram-manager/notifications"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot/models"
+)
+
+// AlertLatencyAnomaly tells that the latency of the active server rose far above its
+// usual level, with buttons switching to the faster servers and testing all again
+func (tb *TelegramBot) AlertLatencyAnomaly(ctx context.Context, anomaly types.LatencyAnomaly) {
+	var keyboard [][]models.InlineKeyboardButton
+	for _, alternate := range anomaly.Alternates {
+		label := fmt.Sprintf("%s · %dms", alternate.Server.Name, alternate.Latency.Milliseconds())
+		keyboard = append(keyboard, []models.InlineKeyboardButton{{
+			Text:         tb.buttonTextProcessor.ProcessServerButtonText(label, "🔀 Switch to", 50),
+			CallbackData: tb.serverCallback("confirm_", alternate.Server.ID),
+		}})
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "📊 Ping Test", CallbackData: "ping_test"},
+		{Text: "📊 Status", CallbackData: "status"},
+	})
+	markup := &models.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	tb.notify(ctx, notifications.EventLatencyAnomaly, NewMessageFormatter().FormatLatencyAnomaly(anomaly), markup)
+}
@@ -0,0 +1,113 @@
+package telegram
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot/models"
+)
+
+// maxCachedListPages bounds the page cache, it is emptied when full
+const maxCachedListPages = 64
+
+// listPageKey identifies a rendered page of the server list
+type listPageKey struct {
+	serverSet uint64
+	page      int
+	currentID string
+}
+
+// listPage is a rendered page of the server list. Cached keyboards are shared
+// between messages and must not be modified.
+type listPage struct {
+	text     string
+	keyboard *models.InlineKeyboardMarkup
+}
+
+// listPageCache keeps rendered server list pages, so pagination does not rebuild
+// the message and keyboard on every click
+type listPageCache struct {
+	mutex sync.Mutex
+	pages map[listPageKey]listPage
+}
+
+func newListPageCache() *listPageCache {
+	return &listPageCache{pages: make(map[listPageKey]listPage)}
+}
+func (c *listPageCache) get(key listPageKey) (listPage, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	page, ok := c.pages[key]
+	return page, ok
+}
+func (c *listPageCache) put(key listPageKey, page listPage) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.pages) >= maxCachedListPages {
+		c.pages = make(map[listPageKey]listPage)
+	}
+	c.pages[key] = page
+}
+
+// invalidate drops all pages, called when the server list is refreshed or the
+// current server changes
+func (c *listPageCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pages = make(map[listPageKey]listPage)
+}
+
+// serverSetHash fingerprints the servers shown in the list
+func serverSetHash(servers []types.Server) uint64 {
+	hash := fnv.New64a()
+	for _, server := range servers {
+		_, _ = hash.Write([]byte(server.ID))
+		_, _ = hash.Write([]byte{0})
+		_, _ = hash.Write([]byte(server.Name))
+		_, _ = hash.Write([]byte{0})
+		if server.Misconfigured() {
+			_, _ = hash.Write([]byte{1})
+		}
+		if server.Blocked() {
+			_, _ = hash.Write([]byte{2})
+		}
+	}
+	return hash.Sum64()
+}
+
+// PrefetchServerList renders the first page of the server list after the servers
+// were loaded, so the first /list after a refresh does not wait for it on slow routers
+func (tb *TelegramBot) PrefetchServerList() {
+	started := time.Now()
+	servers := tb.serverMgr.GetServers()
+	if len(servers) == 0 {
+		return
+	}
+	var currentServerID string
+	if currentServer := tb.serverMgr.GetCurrentServer(); currentServer != nil {
+		currentServerID = currentServer.ID
+	}
+	tb.listCache.invalidate()
+	tb.serverListPage(servers, currentServerID, 0)
+	tb.logger.Debug("Prefetched the server list of %d servers in %v", len(servers), time.Since(started))
+}
+
+// serverListPage returns the rendered list page, building it only when it is not cached
+func (tb *TelegramBot) serverListPage(servers []types.Server, currentServerID string, page int) listPage {
+	key := listPageKey{serverSet: serverSetHash(servers), page: page, currentID: currentServerID}
+	if cached, ok := tb.listCache.get(key); ok {
+		tb.logger.Debug("Using cached server list page %d", page+1)
+		return cached
+	}
+
+	totalPages := (len(servers) + serversPerPage - 1) / serversPerPage
+	messageFormatter := NewMessageFormatter()
+	rendered := listPage{
+		text:     messageFormatter.FormatServerListMessage(servers, currentServerID, page, totalPages),
+		keyboard: tb.createServerListKeyboard(servers, currentServerID, page),
+	}
+	tb.listCache.put(key, rendered)
+	return rendered
+}
@@ -0,0 +1,69 @@
+package telegram
+
+import (
+	"context"
+	"strings"
+)
+
+// listVersionSeparator separates the server ID from the server list version in the
+// callback data of server buttons, server IDs never contain it
+const listVersionSeparator = "@"
+
+// maxCallbackData is the size limit of the callback data of a button in bytes
+const maxCallbackData = 64
+
+// serverCallbackData returns the callback data of a button acting on a server, with
+// the version of the server list the button was made from when it is known. The
+// version is left out when it would not fit into the callback data.
+func serverCallbackData(action, serverID, version string) string {
+	data := callbackServerID(action, serverID)
+	if version == "" || len(data)+len(listVersionSeparator)+len(version) > maxCallbackData {
+		return data
+	}
+	return data + listVersionSeparator + version
+}
+
+// splitListVersion returns the server ID and the list version of the callback data
+// after the action prefix. Buttons sent before versioning have no version.
+func splitListVersion(value string) (serverID, version string) {
+	if i := strings.LastIndex(value, listVersionSeparator); i >= 0 {
+		return value[:i], value[i+1:]
+	}
+	return value, ""
+}
+
+// serverCallback is serverCallbackData with the version of the current server list
+func (tb *TelegramBot) serverCallback(action, serverID string) string {
+	return serverCallbackData(action, serverID, tb.serverMgr.GetListVersion())
+}
+
+// checkListVersion reports whether a server button was made from the current server
+// list. A button from an older list may name a server that is gone or was replaced,
+// so the current list is shown instead of acting on it.
+func (tb *TelegramBot) checkListVersion(ctx context.Context, chatID int64, callbackQueryID, version string, snap *serverSnapshot) bool {
+	current := tb.serverMgr.GetListVersion()
+	if version == "" || version == current {
+		return true
+	}
+	tb.logger.Info("Server button of list version %s pressed by user %d, the list is now %s", version, chatID, current)
+	tb.answerCallback(ctx, callbackQueryID, "🔄 The server list changed, refreshing...")
+
+	servers := snap.Servers()
+	if len(servers) == 0 {
+		_ = tb.messageManager.SendOrEdit(ctx, chatID, MessageContent{
+			Text: NewMessageFormatter().FormatNoServersMessage(),
+			Type: MessageTypeServerList,
+		})
+		return false
+	}
+	page := tb.serverListPage(servers, snap.CurrentID(), 0)
+	content := MessageContent{
+		Text:        "🔄 The server list changed since this message was sent, choose the server again.\n\n" + page.text,
+		ReplyMarkup: page.keyboard,
+		Type:        MessageTypeServerList,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send the changed server list: %v", err)
+	}
+	return false
+}
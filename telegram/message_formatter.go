@@ -1,11 +1,22 @@
 package telegram
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
 	"unicode/utf8"
+	"xray-telegram-manager/audit"
+	"xray-telegram-manager/backup"
+	"xray-telegram-manager/notifications"
+	"xray-telegram-manager/operations"
+	"xray-telegram-manager/pending"
+	"xray-telegram-manager/profiles"
+	"xray-telegram-manager/security"
 	"xray-telegram-manager/types"
 )
 
@@ -72,7 +83,6 @@ func (mf *MessageFormatter) FormatServerListMessage(servers []types.Server, curr
 	// Servers grouped by status
 	builder.WriteString("🌐 Available Servers\n")
 
-	const serversPerPage = 32
 	start := page * serversPerPage
 	end := start + serversPerPage
 	if end > len(servers) {
@@ -118,8 +128,27 @@ func (mf *MessageFormatter) FormatPingTestProgress(completed, total int, current
 		completed, total, percentage, progressBar, displayName)
 }
 
-// FormatPingTestResults creates a formatted ping test results message
-func (mf *MessageFormatter) FormatPingTestResults(results []types.PingResult, currentServerID string) string {
+// FormatPingScopeMenu formats the choice of servers to ping, profile describes the
+// selected ping profile
+func (mf *MessageFormatter) FormatPingScopeMenu(total, favorites int, hasCountries bool, profile string) string {
+	var builder strings.Builder
+	builder.WriteString("🏓 Ping Test\n\n")
+	builder.WriteString(fmt.Sprintf("└ Servers: %d\n", total))
+	builder.WriteString(fmt.Sprintf("└ Favorites: %d\n", favorites))
+	builder.WriteString(fmt.Sprintf("└ Profile: %s\n\n", profile))
+	builder.WriteString("💡 Choose which servers to test, a smaller set finishes faster.")
+	if favorites == 0 {
+		builder.WriteString(" Mark servers with ⭐ when selecting them to test them together.")
+	}
+	if hasCountries {
+		builder.WriteString(" Countries are recognized by the flag in server names.")
+	}
+	return builder.String()
+}
+
+// FormatPingTestResults creates a formatted ping test results message. The
+// availability may be nil or miss servers that were never checked.
+func (mf *MessageFormatter) FormatPingTestResults(results []types.PingResult, availability map[string]types.Availability, currentServerID, scope string) string {
 	var builder strings.Builder
 
 	// Count available servers
@@ -132,6 +161,9 @@ func (mf *MessageFormatter) FormatPingTestResults(results []types.PingResult, cu
 
 	// Header and summary
 	builder.WriteString("🏓 Ping Test Complete\n\n")
+	if scope != "" {
+		builder.WriteString(fmt.Sprintf("🎯 Tested: %s\n\n", scope))
+	}
 	builder.WriteString(fmt.Sprintf("📊 Test Summary\n"+
 		"└ Available: %d/%d servers\n"+
 		"└ Success rate: %.1f%%\n\n",
@@ -162,8 +194,13 @@ func (mf *MessageFormatter) FormatPingTestResults(results []types.PingResult, cu
 					displayName = displayName[:17] + "..."
 				}
 
-				builder.WriteString(fmt.Sprintf("%s %s %s %dms%s\n",
-					statusIcon, displayName, qualityEmoji, result.Latency.Milliseconds(), statusText))
+				uptime := ""
+				if a, ok := availability[result.Server.ID]; ok && a.Known() {
+					uptime = " · " + formatUptime(a)
+				}
+
+				builder.WriteString(fmt.Sprintf("%s %s %s %dms%s%s\n",
+					statusIcon, displayName, qualityEmoji, result.Latency.Milliseconds(), uptime, statusText))
 				count++
 			}
 		}
@@ -180,8 +217,404 @@ func (mf *MessageFormatter) FormatPingTestResults(results []types.PingResult, cu
 	return builder.String()
 }
 
+// FormatNotePrompt asks for the note of a server
+func (mf *MessageFormatter) FormatNotePrompt(serverName, note string, maxLength int) string {
+	var builder strings.Builder
+	builder.WriteString("📝 Server Note\n\n")
+	builder.WriteString(fmt.Sprintf("🏷️ Server: %s\n", serverName))
+	if note != "" {
+		builder.WriteString(fmt.Sprintf("📝 Current note: %s\n", note))
+	}
+	builder.WriteString(fmt.Sprintf("\n✏️ Send a short note, up to %d characters, e.g. \"good for Netflix\" or \"blocks torrents\".\n", maxLength))
+	builder.WriteString("💡 Send - to remove the note or /cancel to keep it.")
+	return builder.String()
+}
+
+// FormatReachPrompt asks for the site to open through a server
+func (mf *MessageFormatter) FormatReachPrompt(serverName string) string {
+	var builder strings.Builder
+	builder.WriteString("🔎 Can It Reach?\n\n")
+	builder.WriteString(fmt.Sprintf("🌐 Server: %s\n\n", serverName))
+	builder.WriteString("Send the site to open through this server, e.g. netflix.com, or choose one below.\n\n")
+	builder.WriteString("💡 The current connection is not changed, a temporary one is used for the check.")
+	return builder.String()
+}
+
+// FormatSchedulePrompt asks when to switch to a server
+func (mf *MessageFormatter) FormatSchedulePrompt(serverName string) string {
+	var builder strings.Builder
+	builder.WriteString("⏰ Schedule Switch\n\n")
+	builder.WriteString(fmt.Sprintf("🎯 Switch to: %s\n\n", serverName))
+	builder.WriteString("Send when to switch: a time like 02:00 or a delay like 2h or 30m.\n\n")
+	builder.WriteString("💡 The switch restarts xray, schedule it for when nobody is in a call. /cancel keeps the current server.")
+	return builder.String()
+}
+
+// FormatPendingActions formats the /pending list, notice is shown above it
+func (mf *MessageFormatter) FormatPendingActions(actions []pending.Action, now time.Time, notice string) string {
+	var builder strings.Builder
+	if notice != "" {
+		builder.WriteString(notice + "\n\n")
+	}
+	builder.WriteString("⏰ Pending Actions\n\n")
+	if len(actions) == 0 {
+		builder.WriteString("Nothing is scheduled.\n\n💡 Open a server and press ⏰ Schedule to switch to it later.")
+		return builder.String()
+	}
+	for _, action := range actions {
+		builder.WriteString(fmt.Sprintf("🔄 Switch to %s\n", action.ServerName))
+		builder.WriteString(fmt.Sprintf("└ %s\n", formatScheduledTime(action.At, now)))
+		builder.WriteString(fmt.Sprintf("└ By %s\n", action.User))
+	}
+	builder.WriteString("\n💡 Press a button below to cancel an action.")
+	return builder.String()
+}
+
+// formatScheduledTime formats when a pending action runs, e.g. "at 02:00 (in 3h 20m)"
+func formatScheduledTime(at, now time.Time) string {
+	layout := "15:04"
+	if at.Sub(now) >= 24*time.Hour {
+		layout = "Jan 2 15:04"
+	}
+	return fmt.Sprintf("at %s (in %s)", at.Local().Format(layout), formatProcessUptime(at.Sub(now).Round(time.Minute)))
+}
+
+// FormatScheduledSwitchDone formats the report of a scheduled switch that went through
+func (mf *MessageFormatter) FormatScheduledSwitchDone(action pending.Action) string {
+	return fmt.Sprintf("⏰ Scheduled Switch Done\n\n🟢 Connected to %s\n└ Scheduled by %s\n\n🎉 Xray restarted successfully.", action.ServerName, action.User)
+}
+
+// FormatScheduledSwitchFailed formats the report of a scheduled switch that failed,
+// the previous server stays active
+func (mf *MessageFormatter) FormatScheduledSwitchFailed(action pending.Action, err error) string {
+	errorMsg := err.Error()
+	if len(errorMsg) > mf.maxErrorLength {
+		errorMsg = errorMsg[:mf.maxErrorLength-3] + "..."
+	}
+	return fmt.Sprintf("⏰ Scheduled Switch Failed\n\n❌ Could not switch to %s\n└ %s\n\n💡 The previous server is still in use. Open the server to try again.", action.ServerName, errorMsg)
+}
+
+// FormatScheduledSwitchMissed formats the report of a scheduled switch dropped because
+// the bot was not running at its time
+func (mf *MessageFormatter) FormatScheduledSwitchMissed(action pending.Action) string {
+	return fmt.Sprintf("⏰ Scheduled Switch Skipped\n\n⚠️ The switch to %s was due at %s, but the bot was not running then. It was not done to avoid interrupting the connection unexpectedly.",
+		action.ServerName, action.At.Local().Format("Jan 2 15:04"))
+}
+
+// FormatProfileNamePrompt asks for the name of a profile for the active server
+func (mf *MessageFormatter) FormatProfileNamePrompt(serverName string) string {
+	var builder strings.Builder
+	builder.WriteString("💾 Save Profile\n\n")
+	builder.WriteString(fmt.Sprintf("🌐 Server: %s\n\n", serverName))
+	builder.WriteString("Send a name for this server, e.g. Work or Streaming.\n\n")
+	builder.WriteString("💡 Saving an existing name moves that profile to this server and keeps its times.")
+	return builder.String()
+}
+
+// FormatProfileRulePrompt asks when to apply a profile
+func (mf *MessageFormatter) FormatProfileRulePrompt(saved []profiles.Profile) string {
+	names := make([]string, 0, len(saved))
+	for _, profile := range saved {
+		names = append(names, profile.Name)
+	}
+	var builder strings.Builder
+	builder.WriteString("➕ Add Time\n\n")
+	builder.WriteString(fmt.Sprintf("🗂 Profiles: %s\n\n", strings.Join(names, ", ")))
+	builder.WriteString("Send the profile, the time and the days, e.g.\n")
+	builder.WriteString("Work 09:00 weekdays\n")
+	builder.WriteString("Streaming 20:00\n")
+	builder.WriteString("Night 23:30 fri-sat\n\n")
+	builder.WriteString("💡 Without days the profile is applied every day.")
+	return builder.String()
+}
+
+// FormatProfileSchedule formats the /schedule menu, notice is shown above it. When the
+// active server is not the one of the profile applied last, it was chosen by hand and
+// stays until the next time.
+func (mf *MessageFormatter) FormatProfileSchedule(store *profiles.Store, current *types.Server, now time.Time, notice string) string {
+	var builder strings.Builder
+	if notice != "" {
+		builder.WriteString(notice + "\n\n")
+	}
+	builder.WriteString("🗓 Profile Schedule\n\n")
+	saved := store.Profiles()
+	if len(saved) == 0 {
+		builder.WriteString("No profiles yet.\n\n💡 Choose a server, then press 💾 Save Current to name it, e.g. Work. Press ➕ Add Time to apply it automatically, e.g. at 09:00 on weekdays.")
+		return builder.String()
+	}
+	builder.WriteString("🗂 Profiles:\n")
+	for _, profile := range saved {
+		builder.WriteString(fmt.Sprintf("└ %s → %s\n", profile.Name, profile.ServerName))
+	}
+
+	rules := store.Rules()
+	builder.WriteString("\n⏰ Times:\n")
+	if len(rules) == 0 {
+		builder.WriteString("└ None, press ➕ Add Time\n")
+	}
+	for _, rule := range rules {
+		profile, _ := store.Profile(rule.ProfileID)
+		state := "▶️"
+		if !rule.Enabled {
+			state = "⏸"
+		}
+		builder.WriteString(fmt.Sprintf("%s %s %s → %s\n", state, rule.At, rule.Days, profile.Name))
+	}
+
+	if applied, at, ok := store.Applied(); ok {
+		builder.WriteString(fmt.Sprintf("\n🟢 Applied: %s at %s\n", applied.Name, at.Local().Format("Jan 2 15:04")))
+		if current != nil && current.ID != applied.ServerID {
+			builder.WriteString(fmt.Sprintf("✋ Chosen by hand: %s, kept until the next time\n", current.Name))
+		}
+	}
+	if rule, at, ok := store.Next(now); ok {
+		profile, _ := store.Profile(rule.ProfileID)
+		builder.WriteString(fmt.Sprintf("\n⏭ Next: %s %s\n", profile.Name, formatScheduledTime(at, now)))
+	}
+	builder.WriteString("\n💡 A server chosen by hand stays until the next time. Press a time to pause it.")
+	return builder.String()
+}
+
+// FormatProfileSwitchDone formats the report of a profile applied by the schedule
+func (mf *MessageFormatter) FormatProfileSwitchDone(profile profiles.Profile, rule profiles.Rule) string {
+	return fmt.Sprintf("🗓 Profile Applied\n\n🟢 %s: connected to %s\n└ Scheduled at %s, %s\n\n💡 /schedule changes the times.", profile.Name, profile.ServerName, rule.At, rule.Days)
+}
+
+// FormatProfileSwitchFailed formats the report of a profile the schedule could not
+// apply, the previous server stays active
+func (mf *MessageFormatter) FormatProfileSwitchFailed(profile profiles.Profile, rule profiles.Rule, err error) string {
+	errorMsg := err.Error()
+	if len(errorMsg) > mf.maxErrorLength {
+		errorMsg = errorMsg[:mf.maxErrorLength-3] + "..."
+	}
+	return fmt.Sprintf("🗓 Profile Not Applied\n\n❌ Could not switch to %s for %s at %s\n└ %s\n\n💡 The previous server is still in use.", profile.ServerName, profile.Name, rule.At, errorMsg)
+}
+
+// FormatReachResult formats whether a site answered through a server and where it
+// sees the request from
+func (mf *MessageFormatter) FormatReachResult(result types.ReachResult) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("🔎 Can It Reach %s?\n\n", result.Domain))
+	builder.WriteString(fmt.Sprintf("🌐 Server: %s\n", result.Server.Name))
+
+	status := fmt.Sprintf("%d %s", result.StatusCode, http.StatusText(result.StatusCode))
+	switch {
+	case !result.Reached():
+		builder.WriteString("❌ Not reachable\n")
+		if result.Error != nil {
+			builder.WriteString(fmt.Sprintf("└ Error: %s\n", mf.safeTruncateUTF8(result.Error.Error(), mf.maxErrorLength)))
+		}
+	case result.StatusCode == http.StatusForbidden || result.StatusCode == http.StatusUnavailableForLegalReasons:
+		builder.WriteString("⛔ Blocked for this location\n")
+		builder.WriteString(fmt.Sprintf("└ HTTP %s in %dms\n", status, result.Latency.Milliseconds()))
+	case result.StatusCode >= 400:
+		builder.WriteString("⚠️ The site answered with an error\n")
+		builder.WriteString(fmt.Sprintf("└ HTTP %s in %dms\n", status, result.Latency.Milliseconds()))
+	default:
+		builder.WriteString("✅ Reachable\n")
+		builder.WriteString(fmt.Sprintf("└ HTTP %s in %dms\n", status, result.Latency.Milliseconds()))
+	}
+
+	if result.ExitIP != "" {
+		location := result.ExitIP
+		if result.Country != "" {
+			location += fmt.Sprintf(" (%s %s)", result.CountryFlag, result.Country)
+		}
+		builder.WriteString(fmt.Sprintf("\n📍 Seen from: %s\n", location))
+	}
+	return strings.TrimRight(builder.String(), "\n")
+}
+
+// FormatSwitchComparison compares the connection through the previous server with the
+// one through the new server after a switch. before is nil when there was no previous
+// server or it could not be measured.
+func (mf *MessageFormatter) FormatSwitchComparison(before *types.ConnectivitySnapshot, after types.ConnectivitySnapshot) string {
+	var builder strings.Builder
+	builder.WriteString("📊 Before → After\n")
+	builder.WriteString(fmt.Sprintf("⏱️ Response: %s → %s\n", snapshotLatency(before), snapshotLatency(&after)))
+	builder.WriteString(fmt.Sprintf("📍 Exit: %s → %s\n", snapshotExit(before), snapshotExit(&after)))
+
+	switch {
+	case after.Error != nil:
+		builder.WriteString(fmt.Sprintf("❌ Nothing answered through the new server: %s", mf.safeTruncateUTF8(after.Error.Error(), mf.maxErrorLength)))
+	case before == nil || before.Error != nil:
+		builder.WriteString("✅ The new server answers")
+	case after.Latency < before.Latency*9/10:
+		builder.WriteString(fmt.Sprintf("✅ Faster by %dms", (before.Latency - after.Latency).Milliseconds()))
+	case after.Latency > before.Latency*11/10:
+		builder.WriteString(fmt.Sprintf("⚠️ Slower by %dms", (after.Latency - before.Latency).Milliseconds()))
+	default:
+		builder.WriteString("➖ About the same speed")
+	}
+	return builder.String()
+}
+
+// snapshotLatency shows the response time of a snapshot, a dash when there is none
+func snapshotLatency(snapshot *types.ConnectivitySnapshot) string {
+	switch {
+	case snapshot == nil:
+		return "—"
+	case snapshot.Error != nil:
+		return "no answer"
+	}
+	return fmt.Sprintf("%dms", snapshot.Latency.Milliseconds())
+}
+
+// snapshotExit shows where sites saw the requests of a snapshot from
+func snapshotExit(snapshot *types.ConnectivitySnapshot) string {
+	if snapshot == nil || snapshot.ExitIP == "" {
+		return "—"
+	}
+	if snapshot.Country == "" {
+		return snapshot.ExitIP
+	}
+	return fmt.Sprintf("%s %s %s", snapshot.ExitIP, snapshot.CountryFlag, snapshot.Country)
+}
+
+// FormatComparePicker asks for the server to compare the first one with
+func (mf *MessageFormatter) FormatComparePicker(first types.Server, page, totalPages int) string {
+	var builder strings.Builder
+	builder.WriteString("⚖️ Compare Servers\n\n")
+	builder.WriteString(fmt.Sprintf("🅰️ %s\n", first.Name))
+	builder.WriteString("🅱️ Choose the server to compare with")
+	if totalPages > 1 {
+		builder.WriteString(fmt.Sprintf(" (page %d/%d)", page+1, totalPages))
+	}
+	builder.WriteString("\n\n💡 Both servers are pinged again, history and throughput come from earlier checks.")
+	return builder.String()
+}
+
+// FormatServerComparison formats two servers side by side, the better value of each
+// metric is marked with a trophy
+func (mf *MessageFormatter) FormatServerComparison(comparison types.ServerComparison, currentServerID string) string {
+	var builder strings.Builder
+	builder.WriteString("⚖️ Server Comparison\n\n")
+	labels := [2]string{"🅰️", "🅱️"}
+	for i, measured := range comparison.Servers {
+		current := ""
+		if measured.Server.ID == currentServerID {
+			current = " (current)"
+		}
+		builder.WriteString(fmt.Sprintf("%s %s%s\n", labels[i], measured.Server.Name, current))
+	}
+	builder.WriteString("\n")
+
+	row := func(title, metric string, value func(types.ServerMeasurement) string) {
+		values := [2]string{value(comparison.Servers[0]), value(comparison.Servers[1])}
+		if index, ok := comparison.Better[metric]; ok {
+			values[index] += " 🏆"
+		}
+		builder.WriteString(fmt.Sprintf("%s\n└ 🅰️ %s\n└ 🅱️ %s\n", title, values[0], values[1]))
+	}
+	row("📶 Ping", types.CompareLatency, func(m types.ServerMeasurement) string {
+		if !m.Ping.Available {
+			return "❌ no answer"
+		}
+		return fmt.Sprintf("%dms", m.Ping.Latency.Milliseconds())
+	})
+	row("🤝 Handshake", types.CompareHandshake, func(m types.ServerMeasurement) string {
+		if m.Handshake <= 0 {
+			return "—"
+		}
+		return fmt.Sprintf("%dms", m.Handshake.Milliseconds())
+	})
+	row("📈 Availability (24h / 7d)", types.CompareAvailability, func(m types.ServerMeasurement) string {
+		if !m.Availability.Known() {
+			return "no checks"
+		}
+		day := "—"
+		if m.Availability.Day >= 0 {
+			day = fmt.Sprintf("%.1f%%", m.Availability.Day*100)
+		}
+		return fmt.Sprintf("%s / %.1f%%", day, m.Availability.Week*100)
+	})
+	row("🎯 Stability", types.CompareStability, func(m types.ServerMeasurement) string {
+		if m.Stability < 0 {
+			return "not enough pings"
+		}
+		return fmt.Sprintf("%.0f%% of recent pings", m.Stability*100)
+	})
+	row("🚀 Throughput", types.CompareThroughput, func(m types.ServerMeasurement) string {
+		if m.Throughput <= 0 {
+			return "not measured"
+		}
+		return formatBytes(int64(m.Throughput)) + "/s"
+	})
+	row("🔗 Protocol", "", func(m types.ServerMeasurement) string {
+		details := []string{m.Server.Protocol}
+		if m.Network != "" {
+			details = append(details, m.Network)
+		}
+		if m.Security != "" {
+			details = append(details, m.Security)
+		}
+		return strings.Join(details, " / ")
+	})
+
+	if winner := comparison.WinnerServer(); winner != nil {
+		builder.WriteString(fmt.Sprintf("\n🏆 Winner: %s\n", winner.Name))
+	} else {
+		builder.WriteString("\n🤝 The servers are even\n")
+	}
+	return builder.String()
+}
+
+// FormatFallbackProgress tells which servers failed and which backup server is tried next
+func (mf *MessageFormatter) FormatFallbackProgress(failures []switchFailure, next types.Server) string {
+	var builder strings.Builder
+	builder.WriteString("⚠️ Server Switch Failed\n\n")
+	writeSwitchFailures(&builder, failures)
+	builder.WriteString(fmt.Sprintf("\n🛟 Trying backup server %s...", next.Name))
+	return builder.String()
+}
+
+// FormatFallbackSwitched reports the backup server that became active instead of the
+// chosen one
+func (mf *MessageFormatter) FormatFallbackSwitched(failures []switchFailure, active types.Server) string {
+	var builder strings.Builder
+	builder.WriteString("🛟 Switched to Backup Server\n\n")
+	writeSwitchFailures(&builder, failures)
+	builder.WriteString(fmt.Sprintf("\n🟢 Active now: %s\n", active.Name))
+	builder.WriteString(fmt.Sprintf("🌐 Address: %s:%d\n", active.Address, active.Port))
+	builder.WriteString("\n💡 It answered the last ping fastest. Choose another server from the list to change it.")
+	return builder.String()
+}
+
+// FormatAutoSwitchNotice tells the other chats that a backup server became active
+// because the switch to the chosen one failed
+func (mf *MessageFormatter) FormatAutoSwitchNotice(target, backup types.Server, user string) string {
+	return fmt.Sprintf("🛟 Auto-Switch\n\n❌ Switch to %s failed\n🟢 Switched to backup server %s\n└ Started by %s", target.Name, backup.Name, user)
+}
+
+// FormatFallbackFailed reports that neither the chosen server nor the backup servers
+// could be switched to
+func (mf *MessageFormatter) FormatFallbackFailed(failures []switchFailure, current *types.Server) string {
+	var builder strings.Builder
+	builder.WriteString("❌ Server Switch Failed\n\n")
+	writeSwitchFailures(&builder, failures)
+	builder.WriteString("\n" + formatActiveServer(current) + "\n")
+	builder.WriteString("\n💡 Run a ping test to find working servers, or refresh the server list.")
+	return builder.String()
+}
+
+func writeSwitchFailures(builder *strings.Builder, failures []switchFailure) {
+	for i, failure := range failures {
+		label := "Backup"
+		if i == 0 {
+			label = "Chosen"
+		}
+		builder.WriteString(fmt.Sprintf("❌ %s: %s\n└ %s\n", label, failure.server.Name, failure.err))
+	}
+}
+
 // FormatServerStatusMessage creates a formatted server status message
 func (mf *MessageFormatter) FormatServerStatusMessage(server *types.Server, result *types.PingResult) string {
+	return mf.FormatServerStatusWithNote(server, result, "", nil)
+}
+
+// FormatServerStatusWithNote is FormatServerStatusMessage with the note of the server
+// and, for the active server, the switch that made it active
+func (mf *MessageFormatter) FormatServerStatusWithNote(server *types.Server, result *types.PingResult, note string, activated *audit.Entry) string {
 	var builder strings.Builder
 
 	builder.WriteString("📊 Current Server Status\n\n")
@@ -189,9 +622,27 @@ func (mf *MessageFormatter) FormatServerStatusMessage(server *types.Server, resu
 	// Server information section
 	builder.WriteString("🏷️ Server Information\n")
 	builder.WriteString(fmt.Sprintf("└ Name: %s\n", server.Name))
-	builder.WriteString(fmt.Sprintf("└ Address: %s:%d\n", server.Address, server.Port))
+	builder.WriteString(fmt.Sprintf("└ Address: %s\n", net.JoinHostPort(server.Address, strconv.Itoa(server.Port))))
 	builder.WriteString(fmt.Sprintf("└ Protocol: %s\n", server.Protocol))
-	builder.WriteString(fmt.Sprintf("└ Tag: %s\n\n", server.Tag))
+	builder.WriteString(fmt.Sprintf("└ Tag: %s\n", server.Tag))
+	if note != "" {
+		builder.WriteString(fmt.Sprintf("└ 📝 Note: %s\n", note))
+	}
+	if activated != nil {
+		builder.WriteString(fmt.Sprintf("└ ⏱ Active since %s (%s)\n", formatActiveSince(activated.Time), switchReasonText(activated.Reason)))
+	}
+	builder.WriteString("\n")
+	if server.Blocked() {
+		builder.WriteString(fmt.Sprintf("⛔ Blocked Country: %s\n", server.BlockedCountry))
+		builder.WriteString("└ Never used for automatic switches\n\n")
+	}
+	if server.Misconfigured() {
+		builder.WriteString("⚠️ Invalid Subscription Entry\n")
+		for _, problem := range server.Problems {
+			builder.WriteString(fmt.Sprintf("└ %s\n", toTitle(problem)))
+		}
+		builder.WriteString("└ Switching to this server will likely fail\n\n")
+	}
 
 	// Connection status section
 	builder.WriteString("🔗 Connection Status\n")
@@ -202,6 +653,9 @@ func (mf *MessageFormatter) FormatServerStatusMessage(server *types.Server, resu
 			qualityText := mf.getLatencyQualityText(result.Latency.Milliseconds())
 
 			builder.WriteString("└ Status: ✅ Connected\n")
+			if family := addressFamily(server.Address, result.Family); family != "" {
+				builder.WriteString(fmt.Sprintf("└ IP: %s\n", family))
+			}
 			builder.WriteString(fmt.Sprintf("└ Latency: ⚡ %dms\n", result.Latency.Milliseconds()))
 			builder.WriteString(fmt.Sprintf("└ Quality: %s %s\n", qualityEmoji, qualityText))
 		} else {
@@ -225,6 +679,776 @@ func (mf *MessageFormatter) FormatServerStatusMessage(server *types.Server, resu
 	return builder.String()
 }
 
+// addressFamily returns the family the server answered over, or the family of an IP
+// literal address
+func addressFamily(address, answered string) string {
+	if answered != "" {
+		return answered
+	}
+	ip := net.ParseIP(strings.Trim(address, "[]"))
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return types.IPv4
+	default:
+		return types.IPv6
+	}
+}
+
+// FormatMatchConfidence creates a section describing how the current server was detected
+func (mf *MessageFormatter) FormatMatchConfidence(confidence types.MatchConfidence) string {
+	var matchText string
+	switch confidence {
+	case types.MatchStrong:
+		matchText = "✅ Strong (address, port and keys match)"
+	case types.MatchFallback:
+		matchText = "🟡 Fallback (keys match, address differs)"
+	default:
+		matchText = "❔ Unknown"
+	}
+
+	return fmt.Sprintf("\n🔎 Detection\n└ Match: %s\n", matchText)
+}
+
+// FormatAvailability creates a section with the share of checks the server answered,
+// empty when it was not checked in the last week
+func (mf *MessageFormatter) FormatAvailability(availability types.Availability) string {
+	if !availability.Known() {
+		return ""
+	}
+	day := "no checks"
+	if availability.Day >= 0 {
+		day = fmt.Sprintf("%.1f%%", availability.Day*100)
+	}
+	return fmt.Sprintf("\n📈 Availability\n└ 24h: %s\n└ 7d: %.1f%%\n", day, availability.Week*100)
+}
+
+// formatUptime formats the availability for a ping result line, preferring the last day
+func formatUptime(availability types.Availability) string {
+	if availability.Day >= 0 {
+		return fmt.Sprintf("%.0f%% 24h", availability.Day*100)
+	}
+	return fmt.Sprintf("%.0f%% 7d", availability.Week*100)
+}
+
+// digestServerCount is how many best and worst servers the ping digest lists
+const digestServerCount = 3
+
+// FormatPingDigest summarizes the background checks of the last day
+func (mf *MessageFormatter) FormatPingDigest(digest types.PingDigest) string {
+	var builder strings.Builder
+	builder.WriteString("📅 Daily Ping Digest\n")
+	builder.WriteString(fmt.Sprintf("└ %d servers checked in the last 24 hours\n", len(digest.Servers)))
+
+	var answering []types.ServerDigest
+	outages := 0
+	for _, server := range digest.Servers {
+		if server.AvgLatency > 0 {
+			answering = append(answering, server)
+		}
+		if server.OutageHours > 0 {
+			outages++
+		}
+	}
+
+	if len(answering) > 0 {
+		builder.WriteString("\n🏆 Fastest\n")
+		for i := 0; i < len(answering) && i < digestServerCount; i++ {
+			builder.WriteString(mf.formatDigestLine(answering[i]))
+		}
+	}
+	if len(digest.Servers) > digestServerCount {
+		builder.WriteString("\n🐢 Slowest\n")
+		// Servers listed as the fastest are not repeated
+		start := len(digest.Servers) - digestServerCount
+		if start < digestServerCount {
+			start = digestServerCount
+		}
+		for i := len(digest.Servers) - 1; i >= start; i-- {
+			builder.WriteString(mf.formatDigestLine(digest.Servers[i]))
+		}
+	}
+
+	if digest.Current != nil {
+		builder.WriteString(fmt.Sprintf("\n🔗 Current Server: %s\n", mf.safeTruncateUTF8(digest.Current.Server.Name, 50)))
+		if digest.Current.AvgLatency > 0 {
+			builder.WriteString(fmt.Sprintf("└ Average latency: %dms\n", digest.Current.AvgLatency.Milliseconds()))
+		}
+		builder.WriteString(fmt.Sprintf("└ Availability: %.1f%%\n", digest.Current.Availability*100))
+	}
+
+	builder.WriteString("\n⚠️ Outages\n")
+	if outages == 0 {
+		builder.WriteString("└ None detected\n")
+	} else {
+		if digest.Current != nil && digest.Current.OutageHours > 0 {
+			builder.WriteString(fmt.Sprintf("└ Current server was down for %d hours\n", digest.Current.OutageHours))
+		}
+		builder.WriteString(fmt.Sprintf("└ %d servers did not answer for at least an hour\n", outages))
+	}
+
+	return builder.String()
+}
+
+// formatDigestLine formats one server of the ping digest
+func (mf *MessageFormatter) formatDigestLine(server types.ServerDigest) string {
+	name := mf.safeTruncateUTF8(server.Server.Name, 30)
+	if server.AvgLatency <= 0 {
+		return fmt.Sprintf("└ %s: 🔴 unreachable\n", name)
+	}
+	return fmt.Sprintf("└ %s: %dms, %.0f%% up\n", name, server.AvgLatency.Milliseconds(), server.Availability*100)
+}
+
+// FormatDirectModeNotice returns a status section shown while the proxy is paused
+func (mf *MessageFormatter) FormatDirectModeNotice() string {
+	return "\n⏸️ Direct Mode\n└ Proxy is disabled, traffic goes directly\n└ Use ▶️ Resume Proxy to reconnect\n"
+}
+
+// FormatDirectModeMessage formats the result of pausing or resuming the proxy
+func (mf *MessageFormatter) FormatDirectModeMessage(enabled bool, server *types.Server) string {
+	var builder strings.Builder
+
+	if enabled {
+		builder.WriteString("⏸️ Proxy Disabled\n\n")
+		builder.WriteString("🌐 Traffic now goes directly without VPN\n")
+		if server != nil {
+			builder.WriteString(fmt.Sprintf("└ Remembered server: %s\n", mf.safeTruncateUTF8(server.Name, 50)))
+		}
+		builder.WriteString("\n💡 Use ▶️ Resume Proxy to reconnect")
+	} else {
+		builder.WriteString("▶️ Proxy Resumed\n\n")
+		if server != nil {
+			builder.WriteString(fmt.Sprintf("🔗 Connected to: %s\n", mf.safeTruncateUTF8(server.Name, 50)))
+		}
+		builder.WriteString("⚡ Service: Xray restarted successfully")
+	}
+
+	return builder.String()
+}
+
+// FormatPanicConfirm asks to drop the VPN for direct internet
+func (mf *MessageFormatter) FormatPanicConfirm(server *types.Server, directMode bool) string {
+	var builder strings.Builder
+	builder.WriteString("🚨 Switch to Direct Internet?\n\n")
+	switch {
+	case directMode:
+		builder.WriteString("The proxy is already paused, xray will be restarted and the connection checked.\n")
+	case server != nil:
+		builder.WriteString(fmt.Sprintf("The VPN through %s will be turned off, all traffic goes directly.\n", mf.safeTruncateUTF8(server.Name, 50)))
+	default:
+		builder.WriteString("The VPN will be turned off, all traffic goes directly.\n")
+	}
+	builder.WriteString("\n💡 Pick any server or use ▶️ Resume Proxy to turn the VPN back on")
+	return builder.String()
+}
+
+// FormatPanicResult formats the state after the VPN was dropped for direct internet
+func (mf *MessageFormatter) FormatPanicResult(result types.PanicResult, server *types.Server) string {
+	var builder strings.Builder
+	builder.WriteString("🚨 Direct Internet\n\n")
+	if result.WasDirect {
+		builder.WriteString("⏸️ The proxy was already paused, xray was restarted\n")
+	} else {
+		builder.WriteString("⏸️ The VPN is off, xray was restarted\n")
+	}
+	if result.Reachable != "" {
+		builder.WriteString(fmt.Sprintf("✅ The router reaches the internet directly (%s)\n", result.Reachable))
+	} else {
+		builder.WriteString("❌ The router does not reach the internet directly")
+		if result.CheckError != nil {
+			builder.WriteString(fmt.Sprintf(": %s", mf.safeTruncateUTF8(result.CheckError.Error(), 200)))
+		}
+		builder.WriteString("\n💡 The problem is not the VPN, check the provider connection")
+	}
+	if server != nil {
+		builder.WriteString(fmt.Sprintf("\n└ Remembered server: %s", mf.safeTruncateUTF8(server.Name, 50)))
+	}
+	return builder.String()
+}
+
+// FormatNotificationsMenu formats the notification preferences menu
+func (mf *MessageFormatter) FormatNotificationsMenu(prefs map[notifications.Event]notifications.Preference) string {
+	var builder strings.Builder
+	builder.WriteString("🔔 Notifications\n\n")
+
+	for _, event := range notifications.Events {
+		pref := prefs[event]
+		state := "off"
+		if pref.Enabled {
+			state = "on"
+			if pref.Silent {
+				state = "on, silent"
+			}
+		}
+		builder.WriteString(fmt.Sprintf("└ %s: %s\n", event.DisplayName(), state))
+	}
+
+	builder.WriteString("\n💡 Tap an event to turn it on or off, 🔔/🔇 to toggle the sound")
+	return builder.String()
+}
+
+// FormatOutboundSettings formats the /settings menu with the options for all servers
+// and the overrides of the current server
+func (mf *MessageFormatter) FormatOutboundSettings(defaults types.OutboundOptions, current *types.Server, override types.OutboundOverride, effective types.OutboundOptions) string {
+	var builder strings.Builder
+	builder.WriteString("⚙️ Outbound Settings\n\n")
+
+	builder.WriteString("🌐 All servers\n")
+	builder.WriteString(fmt.Sprintf("└ Mux: %s (concurrency %d)\n", onOff(defaults.Mux), defaults.MuxConcurrency))
+	builder.WriteString(fmt.Sprintf("└ Fragment: %s (%s, %s bytes, %s ms)\n", onOff(defaults.Fragment), defaults.FragmentPackets, defaults.FragmentLength, defaults.FragmentInterval))
+	builder.WriteString(fmt.Sprintf("└ Noise: %s\n", onOff(defaults.Noise)))
+
+	if current != nil {
+		builder.WriteString(fmt.Sprintf("\n🖥 %s\n", current.Name))
+		builder.WriteString(fmt.Sprintf("└ Mux: %s → %s\n", overrideState(override.Mux), onOff(effective.Mux)))
+		builder.WriteString(fmt.Sprintf("└ Fragment: %s → %s\n", overrideState(override.Fragment), onOff(effective.Fragment)))
+		builder.WriteString(fmt.Sprintf("└ Noise: %s → %s\n", overrideState(override.Noise), onOff(effective.Noise)))
+	}
+
+	builder.WriteString("\n💡 First row changes all servers, second row cycles the current server between default, on and off. Changes are used on the next switch or with Apply now.")
+	builder.WriteString("\n⚠️ Mux is skipped for servers with XTLS Vision flow")
+	return builder.String()
+}
+
+// FormatAddressChange formats the alert about the active server moving to other IP addresses
+func (mf *MessageFormatter) FormatAddressChange(change types.AddressChange) string {
+	var builder strings.Builder
+	builder.WriteString("🌐 Server IP Changed\n\n")
+	builder.WriteString(fmt.Sprintf("🖥 %s\n", change.Server.Name))
+	builder.WriteString(fmt.Sprintf("└ Domain: %s\n", change.Server.Address))
+	builder.WriteString(fmt.Sprintf("└ Before: %s\n", strings.Join(change.Previous, ", ")))
+	builder.WriteString(fmt.Sprintf("└ Now: %s\n", strings.Join(change.Current, ", ")))
+	builder.WriteString("\n💡 A new IP often means the provider moved the server, but it can also be a hijacked domain. Test the server again before relying on it.")
+	return builder.String()
+}
+
+// FormatLatencyAnomaly formats the alert about a sudden rise of the active server's
+// latency with the faster servers of the latest pings
+func (mf *MessageFormatter) FormatLatencyAnomaly(anomaly types.LatencyAnomaly) string {
+	var builder strings.Builder
+	builder.WriteString("🐢 Latency Spike\n\n")
+	builder.WriteString(fmt.Sprintf("🖥 %s\n", anomaly.Server.Name))
+	builder.WriteString(fmt.Sprintf("└ Now: %dms, usually %dms\n", anomaly.Current.Milliseconds(), anomaly.Baseline.Milliseconds()))
+	builder.WriteString(fmt.Sprintf("└ Since: %s\n", formatActiveSince(anomaly.Since)))
+	if len(anomaly.Alternates) == 0 {
+		builder.WriteString("\n💡 No faster server answered the latest pings. Run a ping test to look for one.")
+		return builder.String()
+	}
+	builder.WriteString("\n⚡ Faster in the latest pings\n")
+	for _, alternate := range anomaly.Alternates {
+		builder.WriteString(fmt.Sprintf("└ %s %s %dms\n", mf.getLatencyQualityEmoji(alternate.Latency.Milliseconds()),
+			alternate.Server.Name, alternate.Latency.Milliseconds()))
+	}
+	builder.WriteString("\n💡 The server still answers but got much slower, often before an outage. Switch now or test the servers again.")
+	return builder.String()
+}
+
+// FormatRoutingPresets formats the /routing menu. err is shown when the routing file
+// cannot be read.
+func (mf *MessageFormatter) FormatRoutingPresets(presets []types.RoutingPresetStatus, err error) string {
+	var builder strings.Builder
+	builder.WriteString("🧭 Routing\n\n")
+
+	if err != nil {
+		builder.WriteString(fmt.Sprintf("❌ %v", err))
+		return builder.String()
+	}
+	for _, preset := range presets {
+		builder.WriteString(fmt.Sprintf("%s %s\n└ %s\n", onOffIcon(preset.Enabled), preset.Name, preset.Description))
+	}
+
+	builder.WriteString("\n💡 Tap a preset to install or remove its rules, xray is restarted and checked. Your own rules are kept.")
+	return builder.String()
+}
+
+// FormatInbounds formats the /inbounds menu. err is shown when the inbounds file
+// cannot be read.
+func (mf *MessageFormatter) FormatInbounds(inbounds []types.InboundStatus, err error) string {
+	var builder strings.Builder
+	builder.WriteString("🔌 Inbounds\n\n")
+
+	if err != nil {
+		builder.WriteString(fmt.Sprintf("❌ %v", err))
+		return builder.String()
+	}
+	if len(inbounds) == 0 {
+		builder.WriteString("No inbounds configured\n")
+	}
+	for _, inbound := range inbounds {
+		tag := inbound.Tag
+		if tag == "" {
+			tag = "(no tag)"
+		}
+		listen := inbound.Listen
+		if listen == "" {
+			listen = "0.0.0.0"
+		}
+		marker := ""
+		if inbound.Managed {
+			marker = " 🤖"
+		}
+		builder.WriteString(fmt.Sprintf("• %s%s\n└ %s on %s:%s\n", tag, marker, inbound.Protocol, listen, inbound.Port))
+	}
+
+	builder.WriteString("\n💡 The buttons add or remove a local SOCKS5 or HTTP proxy for LAN clients, xray is restarted and checked. 🤖 marks inbounds added by the bot, others are never changed.")
+	return builder.String()
+}
+
+// FormatConfigCorrupted formats the prompt sent when the xray config cannot be parsed
+func (mf *MessageFormatter) FormatConfigCorrupted(problem string, info types.ConfigRecoveryInfo) string {
+	var builder strings.Builder
+	builder.WriteString("🚨 Xray Config Corrupted\n\n")
+	builder.WriteString(fmt.Sprintf("└ %s\n\n", problem))
+
+	if info.BackupTime.IsZero() && info.GoldenTime.IsZero() {
+		builder.WriteString("❌ No valid backup or golden config found, fix the file manually")
+		return builder.String()
+	}
+	builder.WriteString("🛠 Recovery options\n")
+	if !info.BackupTime.IsZero() {
+		builder.WriteString(fmt.Sprintf("└ Latest valid backup: %s\n", info.BackupTime.Format("2006-01-02 15:04")))
+	}
+	if !info.GoldenTime.IsZero() {
+		builder.WriteString(fmt.Sprintf("└ Golden config (last known good): %s\n", info.GoldenTime.Format("2006-01-02 15:04")))
+	}
+	builder.WriteString("\n💡 The corrupted file is kept with the .corrupted suffix")
+	return builder.String()
+}
+
+// FormatConfigRecovered formats the result of a successful config recovery
+func (mf *MessageFormatter) FormatConfigRecovered(source string, current *types.Server) string {
+	from := "the latest valid backup"
+	if source == types.ConfigRecoveryGolden {
+		from = "the golden config"
+	}
+	message := fmt.Sprintf("✅ Xray Config Recovered\n\n└ Restored from %s\n└ Xray restarted\n", from)
+	if current != nil {
+		message += fmt.Sprintf("└ Active server: %s\n", current.Name)
+	}
+	return message
+}
+
+// FormatUpdateAvailableNotification formats the notification about a new release
+func (mf *MessageFormatter) FormatUpdateAvailableNotification(current, latest string) string {
+	return fmt.Sprintf("🆕 Update Available\n\n"+
+		"└ Current version: %s\n"+
+		"└ Latest version: %s\n\n"+
+		"💡 Use /update to install it", current, latest)
+}
+
+// FormatHealthAlert formats a notification about a health status change
+func (mf *MessageFormatter) FormatHealthAlert(status string, problems []string) string {
+	var builder strings.Builder
+	if status == "healthy" {
+		builder.WriteString("✅ Health Restored\n\n")
+		builder.WriteString("└ All checks are passing again")
+		return builder.String()
+	}
+
+	builder.WriteString(fmt.Sprintf("⚠️ Health Alert: %s\n\n", status))
+	for _, problem := range problems {
+		builder.WriteString(fmt.Sprintf("└ %s\n", problem))
+	}
+	return strings.TrimRight(builder.String(), "\n")
+}
+
+// FormatErrorNotice formats a notification about a failing background task
+func (mf *MessageFormatter) FormatErrorNotice(notice *notifications.ErrorNotice) string {
+	var builder strings.Builder
+	message := notice.Message
+	if len(message) > mf.maxErrorLength {
+		message = mf.safeTruncateUTF8(message, mf.maxErrorLength)
+	}
+
+	switch notice.Kind {
+	case notifications.ErrorRecovered:
+		builder.WriteString(fmt.Sprintf("✅ %s Recovered\n\n", toTitle(notice.Source)))
+		builder.WriteString(fmt.Sprintf("└ Works again after %s and %d failures\n", formatProcessUptime(notice.Period), notice.Total))
+		builder.WriteString(fmt.Sprintf("└ Last error: %s", message))
+	case notifications.ErrorRepeated:
+		builder.WriteString(fmt.Sprintf("❗ %s Still Failing\n\n", toTitle(notice.Source)))
+		builder.WriteString(fmt.Sprintf("└ Failed %d× in the last %s\n", notice.Count, formatProcessUptime(notice.Period)))
+		builder.WriteString(fmt.Sprintf("└ Failing since %s, %d failures in total\n", notice.Since.Format("02.01 15:04"), notice.Total))
+		builder.WriteString(fmt.Sprintf("└ Error: %s", message))
+	default:
+		builder.WriteString(fmt.Sprintf("❌ %s Failed\n\n", toTitle(notice.Source)))
+		builder.WriteString(fmt.Sprintf("└ Error: %s\n", message))
+		builder.WriteString("└ Repeats of this error are summarized, you will be told when it works again")
+	}
+	return builder.String()
+}
+
+// FormatServerChangedNotice formats the notice for notification chats about a new VPN server
+func (mf *MessageFormatter) FormatServerChangedNotice(serverName string) string {
+	return fmt.Sprintf("🔄 VPN server changed\n\nThe VPN now works through %s.\nIf something stopped working, reopen the app or page.", serverName)
+}
+
+// FormatVPNDownNotice formats the notice for notification chats when the VPN server stops answering
+func (mf *MessageFormatter) FormatVPNDownNotice(serverName string) string {
+	return fmt.Sprintf("🔴 VPN is down\n\nThe VPN server %s is not responding, sites that need the VPN may not open.\nThe administrator has been notified.", serverName)
+}
+
+// FormatVPNRestoredNotice formats the notice for notification chats when the VPN works again
+func (mf *MessageFormatter) FormatVPNRestoredNotice(serverName string) string {
+	return fmt.Sprintf("🟢 VPN works again\n\nThe VPN server %s is responding again.", serverName)
+}
+
+// FormatLoadRetriesExhausted formats the admin notice when the automatic retries of a
+// failed subscription load are used up
+func (mf *MessageFormatter) FormatLoadRetriesExhausted(attempts int, err error) string {
+	errorMsg := err.Error()
+	if len(errorMsg) > mf.maxErrorLength {
+		errorMsg = errorMsg[:mf.maxErrorLength-3] + "..."
+	}
+	return fmt.Sprintf("❌ Subscription still unavailable\n\nThe servers could not be loaded after %d automatic retries:\n└ %s\n\nPress 🔄 Refresh to try again.", attempts, errorMsg)
+}
+
+// FormatDuplicateInstance formats the admin notice about another instance polling the
+// same bot token, stopping is true when this instance stops because of it
+func (mf *MessageFormatter) FormatDuplicateInstance(instance string, stopping bool) string {
+	if stopping {
+		return fmt.Sprintf("⚠️ Duplicate Bot Instance\n\n"+
+			"Another instance already receives updates for this bot token, so the new instance on %s is stopping.\n\n"+
+			"💡 Run only one instance per bot token, or give each one its own bot.", instance)
+	}
+	return fmt.Sprintf("⚠️ Duplicate Bot Instance\n\n"+
+		"Another instance started receiving updates for this bot token, commands may reach either of them. "+
+		"The new instance should stop by itself, this one on %s keeps running.\n\n"+
+		"💡 If this repeats, find and stop the other instance.", instance)
+}
+
+// FormatSubscriptionChange formats a notification about servers added to or removed
+// from the subscription, and servers whose favorites and notes followed a new ID
+func (mf *MessageFormatter) FormatSubscriptionChange(change types.ServerListChange, total int) string {
+	var builder strings.Builder
+	builder.WriteString("📋 Subscription Changed\n\n")
+	builder.WriteString(fmt.Sprintf("📊 Servers: %d\n", total))
+
+	const maxListed = 10
+	writeServers := func(title string, servers []types.Server) {
+		if len(servers) == 0 {
+			return
+		}
+		builder.WriteString(fmt.Sprintf("\n%s (%d)\n", title, len(servers)))
+		for i, server := range servers {
+			if i == maxListed {
+				builder.WriteString(fmt.Sprintf("└ ...and %d more\n", len(servers)-maxListed))
+				break
+			}
+			builder.WriteString(fmt.Sprintf("└ %s\n", mf.safeTruncateUTF8(server.Name, 50)))
+		}
+	}
+	writeServers("➕ Added", change.Added)
+	writeServers("➖ Removed", change.Removed)
+	if len(change.Reattached) > 0 {
+		builder.WriteString(fmt.Sprintf("\n🔗 Moved (%d)\n", len(change.Reattached)))
+		for i, moved := range change.Reattached {
+			if i == maxListed {
+				builder.WriteString(fmt.Sprintf("└ ...and %d more\n", len(change.Reattached)-maxListed))
+				break
+			}
+			builder.WriteString(fmt.Sprintf("└ %s: %s → %s, kept %s (%.0f%% sure)\n",
+				mf.safeTruncateUTF8(moved.To.Name, 40), formatEndpoint(moved.From), formatEndpoint(moved.To),
+				strings.Join(moved.Moved, ", "), moved.Confidence*100))
+		}
+	}
+
+	return strings.TrimRight(builder.String(), "\n")
+}
+
+// formatEndpoint returns the address and port of a server
+func formatEndpoint(server types.Server) string {
+	return net.JoinHostPort(server.Address, strconv.Itoa(server.Port))
+}
+
+// FormatQuietHoursDigest formats the notifications held back during quiet hours
+func (mf *MessageFormatter) FormatQuietHoursDigest(entries []digestEntry) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("🌙 Quiet Hours Digest (%d)\n", len(entries)))
+	for _, entry := range entries {
+		builder.WriteString(fmt.Sprintf("\n🕐 %s · %s\n", entry.time.Format("15:04"), entry.event.DisplayName()))
+		builder.WriteString(entry.text)
+		builder.WriteString("\n")
+	}
+	// Keep the digest within the Telegram message limit
+	return mf.safeTruncateUTF8(strings.TrimRight(builder.String(), "\n"), 4000)
+}
+
+// FormatSubscriptionInfo returns a section with the subscription quota and expiry,
+// or an empty string when the provider does not report them
+func (mf *MessageFormatter) FormatSubscriptionInfo(info *types.SubscriptionInfo) string {
+	if info == nil {
+		return ""
+	}
+
+	var builder strings.Builder
+	builder.WriteString("\n💳 Subscription\n")
+	if remaining := info.Remaining(); remaining >= 0 {
+		builder.WriteString(fmt.Sprintf("└ Traffic: %s of %s used\n", formatBytes(info.Used()), formatBytes(info.Total)))
+		builder.WriteString(fmt.Sprintf("└ Remaining: %s (%.0f%%)\n", formatBytes(remaining), float64(remaining)*100/float64(info.Total)))
+	} else {
+		builder.WriteString(fmt.Sprintf("└ Traffic: %s used (unlimited)\n", formatBytes(info.Used())))
+	}
+	if expiresAt := info.ExpiresAt(); !expiresAt.IsZero() {
+		builder.WriteString(fmt.Sprintf("└ Expires: %s (%s)\n", expiresAt.Format("2006-01-02"), formatDaysLeft(expiresAt)))
+	}
+	return builder.String()
+}
+
+// FormatQuotaWarning formats the notification about low traffic or an expiring subscription
+func (mf *MessageFormatter) FormatQuotaWarning(info *types.SubscriptionInfo, lowQuota, expiring bool) string {
+	var builder strings.Builder
+	builder.WriteString("⚠️ Subscription Warning\n\n")
+	if lowQuota {
+		builder.WriteString(fmt.Sprintf("📉 Low traffic: %s left of %s\n", formatBytes(info.Remaining()), formatBytes(info.Total)))
+	}
+	if expiring {
+		expiresAt := info.ExpiresAt()
+		builder.WriteString(fmt.Sprintf("⏰ Expires %s (%s)\n", expiresAt.Format("2006-01-02 15:04"), formatDaysLeft(expiresAt)))
+	}
+	builder.WriteString("\n💡 Renew or top up the subscription with your provider")
+	return builder.String()
+}
+
+// formatBytes formats a byte count with binary units
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	value := float64(bytes)
+	units := []string{"KB", "MB", "GB", "TB", "PB"}
+	i := -1
+	for value >= unit && i < len(units)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+func formatDaysLeft(t time.Time) string {
+	left := time.Until(t)
+	switch {
+	case left <= 0:
+		return "expired"
+	case left < 24*time.Hour:
+		return fmt.Sprintf("%d hours left", int(left.Hours()))
+	default:
+		return fmt.Sprintf("%d days left", int(left.Hours()/24))
+	}
+}
+
+// FormatAPIStats returns a status section with Telegram API problems, or an empty
+// string when all calls succeeded
+func (mf *MessageFormatter) FormatAPIStats(stats APIStats) string {
+	if stats.TotalFailures() == 0 {
+		return ""
+	}
+
+	var builder strings.Builder
+	builder.WriteString("\n📡 Telegram API\n")
+	builder.WriteString(fmt.Sprintf("└ Failed calls: %d\n", stats.TotalFailures()))
+	if rateLimited := stats.TotalRateLimited(); rateLimited > 0 {
+		builder.WriteString(fmt.Sprintf("└ Flood limits (429): %d, last %s ago\n",
+			rateLimited, time.Since(stats.LastRateLimitAt).Round(time.Second)))
+	}
+	if wait := time.Until(stats.FloodUntil); wait > 0 {
+		builder.WriteString(fmt.Sprintf("└ Paused by Telegram for %v more\n", wait.Round(time.Second)))
+	}
+	if stats.UpdateInterval > baseUpdateInterval {
+		builder.WriteString(fmt.Sprintf("└ Update interval raised to %v\n", stats.UpdateInterval))
+	}
+	if stats.LastError != "" {
+		builder.WriteString(fmt.Sprintf("└ Last error: %s\n", mf.safeTruncateUTF8(stats.LastError, 100)))
+	}
+	return builder.String()
+}
+
+// FormatBotStats returns a status section with the bot process metrics
+func (mf *MessageFormatter) FormatBotStats(stats BotStats) string {
+	var builder strings.Builder
+	builder.WriteString("\n🤖 Bot\n")
+	if stats.Version != "" {
+		builder.WriteString(fmt.Sprintf("└ Version: %s\n", stats.Version))
+	}
+	builder.WriteString(fmt.Sprintf("└ Uptime: %s\n", formatProcessUptime(stats.Uptime)))
+	builder.WriteString(fmt.Sprintf("└ Memory (RSS): %s\n", formatBytes(stats.RSS)))
+	builder.WriteString(fmt.Sprintf("└ Goroutines: %d\n", stats.Goroutines))
+	builder.WriteString(fmt.Sprintf("└ Active messages: %d\n", stats.ActiveMessages))
+	builder.WriteString(fmt.Sprintf("└ Debounced updates: %d\n", stats.PendingUpdates))
+	if stats.Throttle.Throttled > 0 {
+		builder.WriteString(fmt.Sprintf("└ Throttled messages: %d of %d, longest wait %v\n",
+			stats.Throttle.Throttled, stats.Throttle.Sends, stats.Throttle.MaxWait.Round(100*time.Millisecond)))
+	}
+	if stats.LastRefresh.IsZero() {
+		builder.WriteString("└ Subscription refreshed: never\n")
+	} else {
+		builder.WriteString(fmt.Sprintf("└ Subscription refreshed: %s (%s ago)\n",
+			stats.LastRefresh.Format("2006-01-02 15:04"), time.Since(stats.LastRefresh).Round(time.Minute)))
+	}
+	return builder.String()
+}
+
+// formatActiveSince tells how long ago a server became active
+func formatActiveSince(since time.Time) string {
+	elapsed := time.Since(since)
+	if elapsed < time.Minute {
+		return "just now"
+	}
+	return formatProcessUptime(elapsed) + " ago"
+}
+
+// switchReasonText describes why a server became active
+func switchReasonText(reason string) string {
+	switch reason {
+	case audit.ReasonFallback:
+		return "auto-switch after a failed switch"
+	case audit.ReasonRestore:
+		return "restored from backup"
+	case audit.ReasonRollback:
+		return "config rollback"
+	case audit.ReasonScheduled:
+		return "scheduled switch"
+	case audit.ReasonProfile:
+		return "profile schedule"
+	case audit.ReasonManual, "":
+		// Switches recorded before reasons were kept were all manual
+		return "manual"
+	default:
+		return reason
+	}
+}
+
+// formatProcessUptime formats the bot uptime as days, hours and minutes
+func formatProcessUptime(uptime time.Duration) string {
+	days := int(uptime.Hours()) / 24
+	hours := int(uptime.Hours()) % 24
+	minutes := int(uptime.Minutes()) % 60
+	if days > 0 {
+		return fmt.Sprintf("%dd %dh %dm", days, hours, minutes)
+	}
+	return fmt.Sprintf("%dh %dm", hours, minutes)
+}
+
+// FormatBackupCaption describes a backup archive sent as a document
+func (mf *MessageFormatter) FormatBackupCaption(manifest *backup.Manifest) string {
+	var builder strings.Builder
+
+	builder.WriteString("💾 Backup created\n\n")
+	builder.WriteString(fmt.Sprintf("📦 Files: %s\n", strings.Join(manifest.Files, ", ")))
+	if manifest.State.CurrentServerName != "" {
+		builder.WriteString(fmt.Sprintf("🔗 Current server: %s\n", mf.safeTruncateUTF8(manifest.State.CurrentServerName, 50)))
+	}
+	if manifest.Redacted {
+		builder.WriteString("🔒 Bot token, admin ID and passwords are not included (use /backup full to include them)\n")
+	} else {
+		builder.WriteString("⚠️ Contains the bot token and passwords, keep this file private\n")
+	}
+	builder.WriteString("\n♻️ Use /restore to apply it")
+
+	return builder.String()
+}
+
+// FormatRestoreConfirmation summarizes a validated archive before it is applied
+func (mf *MessageFormatter) FormatRestoreConfirmation(manifest *backup.Manifest) string {
+	var builder strings.Builder
+
+	builder.WriteString("♻️ Restore Backup\n\n")
+	builder.WriteString("📋 Backup details:\n")
+	builder.WriteString(fmt.Sprintf("└ Created: %s\n", manifest.CreatedAt.Local().Format("2006-01-02 15:04:05")))
+	if manifest.AppVersion != "" {
+		builder.WriteString(fmt.Sprintf("└ Version: %s\n", manifest.AppVersion))
+	}
+	builder.WriteString(fmt.Sprintf("└ Files: %s\n", strings.Join(manifest.Files, ", ")))
+	if manifest.State.CurrentServerName != "" {
+		builder.WriteString(fmt.Sprintf("└ Server: %s\n", mf.safeTruncateUTF8(manifest.State.CurrentServerName, 50)))
+	}
+	if manifest.Redacted {
+		builder.WriteString("└ Secrets: kept from the current config\n")
+	}
+	builder.WriteString("\n⚠️ The current config will be replaced (a copy is kept as config.json.before-restore).\n\n")
+	builder.WriteString("Are you sure you want to proceed?")
+
+	return builder.String()
+}
+
+// FormatUpdateScriptConfirmation asks to confirm an uploaded update script by its checksum
+func (mf *MessageFormatter) FormatUpdateScriptConfirmation(script CustomScript, firstLine string) string {
+	var builder strings.Builder
+
+	builder.WriteString("📜 Custom Update Script\n\n")
+	builder.WriteString(fmt.Sprintf("└ File: %s\n", mf.safeTruncateUTF8(script.Name, 50)))
+	builder.WriteString(fmt.Sprintf("└ Size: %d bytes\n", script.Size))
+	builder.WriteString(fmt.Sprintf("└ Interpreter: %s\n", mf.safeTruncateUTF8(strings.TrimSpace(firstLine), 50)))
+	builder.WriteString(fmt.Sprintf("└ SHA-256: %s\n", script.SHA256))
+	builder.WriteString("\n⚠️ /update will run this script as root instead of downloading the official one. ")
+	builder.WriteString("Compare the checksum with the one of your file before confirming.\n\n")
+	builder.WriteString("Use this script for updates?")
+
+	return builder.String()
+}
+
+// FormatRestoreComplete reports the result of a restore
+func (mf *MessageFormatter) FormatRestoreComplete(restored []string, switchNote string) string {
+	var builder strings.Builder
+
+	builder.WriteString("✅ Backup Restored\n\n")
+	builder.WriteString(fmt.Sprintf("📦 Restored: %s\n", strings.Join(restored, ", ")))
+	if switchNote != "" {
+		builder.WriteString(switchNote + "\n")
+	}
+	builder.WriteString("\n🔄 Restart the service to apply the restored configuration")
+
+	return builder.String()
+}
+
+// FormatXrayLog splits the xray log lines into messages of at most chunkSize
+// characters. Lines longer than lineLength are cut.
+func (mf *MessageFormatter) FormatXrayLog(log types.XrayLog, follow bool, chunkSize, lineLength int) []string {
+	var header strings.Builder
+	if follow {
+		header.WriteString("📜 Xray Log (new entries)\n")
+	} else {
+		header.WriteString("📜 Xray Log (latest entries)\n")
+	}
+	header.WriteString(fmt.Sprintf("📁 %s\n", log.Path))
+	if log.Filtered > 0 {
+		header.WriteString(fmt.Sprintf("🔇 %d routine lines hidden\n", log.Filtered))
+	}
+	header.WriteString("\n")
+
+	if len(log.Lines) == 0 {
+		if follow {
+			return []string{header.String() + "✅ No new connection problems logged"}
+		}
+		return []string{header.String() + "✅ No connection problems in the log"}
+	}
+
+	var chunks []string
+	current := header.String()
+	for _, line := range log.Lines {
+		line = mf.safeTruncateUTF8(line, lineLength) + "\n"
+		if len(current)+len(line) > chunkSize {
+			chunks = append(chunks, current)
+			current = ""
+		}
+		current += line
+	}
+	return append(chunks, current)
+}
+
+// FormatBlockedCountryWarning asks to confirm switching to a server in a country of
+// blocked_countries
+func (mf *MessageFormatter) FormatBlockedCountryWarning(server *types.Server) string {
+	var builder strings.Builder
+	builder.WriteString("⛔ Blocked Country\n\n")
+	builder.WriteString(fmt.Sprintf("🎯 %s exits in %s, which is in blocked_countries of the config.\n\n",
+		server.Name, server.BlockedCountry))
+	builder.WriteString("Traffic would leave the VPN in a country you chose not to use. Automatic switches never pick this server.\n\n")
+	builder.WriteString("Switch to it anyway?")
+	return builder.String()
+}
+
 // FormatErrorMessage creates a consistently formatted error message
 func (mf *MessageFormatter) FormatErrorMessage(title, description string, suggestions []string) string {
 	var builder strings.Builder
@@ -251,6 +1475,55 @@ func (mf *MessageFormatter) FormatErrorMessage(title, description string, sugges
 	return builder.String()
 }
 
+// errorAdvice is what the user is told to do about a kind of error
+type errorAdvice struct {
+	kind        error
+	suggestions []string
+}
+
+// errorAdvices are checked in order, a failed restore after a failed restart matches
+// the more specific kinds first
+var errorAdvices = []errorAdvice{
+	{types.ErrServerNotFound, []string{
+		"The server is no longer in the subscription",
+		"Refresh the server list and pick another server",
+	}},
+	{types.ErrConfigWriteFailed, []string{
+		"Check that the router has free space",
+		"Check that the manager may write config_path",
+	}},
+	{types.ErrConfigInvalid, []string{
+		"Check that config_path points to the xray outbounds config",
+		"Make sure the file is valid JSON with a proxy outbound",
+		"Restore the config with the recovery buttons when they are offered",
+	}},
+	{types.ErrXrayRestartFailed, []string{
+		"See /xraylogs for why xray stopped",
+		"Try a different server, its settings may be rejected by xray",
+		"Check xray_commands in the config if the restart command itself fails",
+	}},
+	{types.ErrSubscriptionInvalid, []string{
+		"The subscription has no VLESS servers the manager can use",
+		"Check subscription_url and whether the subscription expired",
+	}},
+	{types.ErrSubscriptionUnreachable, []string{
+		"Check that the router has internet access",
+		"Open subscription_url in a browser to see if the provider is up",
+		"Check http_proxy if the subscription is fetched through a proxy",
+	}},
+}
+
+// ErrorSuggestions returns the suggestions for the kind of err, fallback when err has
+// none of the kinds in types
+func (mf *MessageFormatter) ErrorSuggestions(err error, fallback []string) []string {
+	for _, advice := range errorAdvices {
+		if errors.Is(err, advice.kind) {
+			return advice.suggestions
+		}
+	}
+	return fallback
+}
+
 // FormatUpdateProgressMessage creates a formatted update progress message
 func (mf *MessageFormatter) FormatUpdateProgressMessage(progress int, stage, message string) string {
 	var builder strings.Builder
@@ -281,6 +1554,27 @@ func (mf *MessageFormatter) FormatUpdateProgressMessage(progress int, stage, mes
 	return builder.String()
 }
 
+// FormatOperationInProgressMessage creates a formatted message for a rejected conflicting operation
+func (mf *MessageFormatter) FormatOperationInProgressMessage(inProgress *operations.OperationInProgressError) string {
+	var builder strings.Builder
+
+	builder.WriteString("⏳ Operation In Progress\n\n")
+
+	builder.WriteString("🔒 Busy\n")
+	builder.WriteString(fmt.Sprintf("└ %s is already running\n", toTitle(inProgress.Active.Type.DisplayName())))
+	builder.WriteString(fmt.Sprintf("└ Started: %s (%s ago)\n\n",
+		inProgress.Active.StartedAt.Format("15:04:05"),
+		time.Since(inProgress.Active.StartedAt).Round(time.Second)))
+
+	builder.WriteString("💡 Next Steps\n")
+	builder.WriteString(fmt.Sprintf("└ Wait for it to finish, then start the %s again\n", inProgress.Requested.DisplayName()))
+	if inProgress.Active.MessageID != 0 {
+		builder.WriteString("└ Progress is shown in the replied message\n")
+	}
+
+	return builder.String()
+}
+
 // FormatNoServersMessage creates a formatted "no servers" message
 func (mf *MessageFormatter) FormatNoServersMessage() string {
 	return "❌ No Servers Available\n\n" +
@@ -293,6 +1587,113 @@ func (mf *MessageFormatter) FormatNoServersMessage() string {
 		"🔄 Use the refresh button to try again"
 }
 
+// FormatIntruderAlert formats the alert sent when a user is banned for repeated unauthorized attempts
+func (mf *MessageFormatter) FormatIntruderAlert(intruder security.Intruder) string {
+	var builder strings.Builder
+	builder.WriteString("🚨 Repeated Unauthorized Access\n\n")
+	builder.WriteString(fmt.Sprintf("👤 User: %s\n", formatIntruderName(intruder)))
+	builder.WriteString(fmt.Sprintf("└ Attempts: %d\n", intruder.Attempts))
+	builder.WriteString(fmt.Sprintf("└ Last command: %s\n", mf.safeTruncateUTF8(intruder.LastCommand, 50)))
+	builder.WriteString(fmt.Sprintf("└ 🚫 Ignored until %s\n", intruder.BannedUntil.Format("15:04")))
+	builder.WriteString("\n💡 See /intruders for all attempts")
+	return builder.String()
+}
+
+// FormatIntrudersReport formats the list of users with unauthorized attempts
+func (mf *MessageFormatter) FormatIntrudersReport(intruders []security.Intruder) string {
+	if len(intruders) == 0 {
+		return "🛡 Intruders\n\n✅ No unauthorized access attempts since the bot started"
+	}
+
+	const maxListed = 15
+	now := time.Now()
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("🛡 Intruders (%d)\n", len(intruders)))
+	for i, intruder := range intruders {
+		if i == maxListed {
+			builder.WriteString(fmt.Sprintf("\n...and %d more", len(intruders)-maxListed))
+			break
+		}
+		builder.WriteString(fmt.Sprintf("\n👤 %s\n", formatIntruderName(intruder)))
+		builder.WriteString(fmt.Sprintf("└ Attempts: %d\n", intruder.Attempts))
+		builder.WriteString(fmt.Sprintf("└ Last seen: %s (%s)\n", intruder.LastSeen.Format("2006-01-02 15:04"), mf.safeTruncateUTF8(intruder.LastCommand, 30)))
+		if intruder.IsBanned(now) {
+			builder.WriteString(fmt.Sprintf("└ 🚫 Ignored until %s (%d updates dropped)\n", intruder.BannedUntil.Format("15:04"), intruder.Ignored))
+		}
+	}
+	return strings.TrimRight(builder.String(), "\n")
+}
+
+// FormatActionStats formats the counters of switches and updates per user and the
+// latest actions
+func (mf *MessageFormatter) FormatActionStats(users []audit.UserStats, recent []audit.Entry) string {
+	if len(users) == 0 && len(recent) == 0 {
+		return "📊 Action Statistics\n\n📭 No switches or updates recorded yet"
+	}
+
+	var builder strings.Builder
+	builder.WriteString("📊 Action Statistics\n")
+	for _, user := range users {
+		builder.WriteString(fmt.Sprintf("\n👤 %s\n", formatActor(user.UserID, user.User)))
+		builder.WriteString(fmt.Sprintf("└ Switches: %d, updates: %d\n", user.Actions[audit.ActionSwitch], user.Actions[audit.ActionUpdate]))
+		builder.WriteString(fmt.Sprintf("└ Last action: %s\n", user.Last.Format("2006-01-02 15:04")))
+	}
+	if len(recent) > 0 {
+		builder.WriteString("\n🕓 Recent actions\n")
+		for _, entry := range recent {
+			builder.WriteString(fmt.Sprintf("└ %s %s: %s %s\n", entry.Time.Format("01-02 15:04"),
+				formatActor(entry.UserID, entry.User), actionVerb(entry.Action), mf.safeTruncateUTF8(entry.Detail, 30)))
+		}
+	}
+	return strings.TrimRight(builder.String(), "\n")
+}
+
+// FormatActionNotice formats the notice to other admins about a switch or update
+// started by someone else
+func (mf *MessageFormatter) FormatActionNotice(entry audit.Entry) string {
+	actor := formatActor(entry.UserID, entry.User)
+	switch entry.Action {
+	case audit.ActionSwitch:
+		notice := fmt.Sprintf("🔄 Server Switched\n\n🏷️ Server: %s\n👤 Switched by %s", entry.Detail, actor)
+		if entry.Reason != "" && entry.Reason != audit.ReasonManual {
+			notice += fmt.Sprintf("\n💡 Reason: %s", switchReasonText(entry.Reason))
+		}
+		return notice
+	case audit.ActionUpdate:
+		return fmt.Sprintf("🔄 Bot Update Started\n\n📦 From version: %s\n👤 Started by %s", entry.Detail, actor)
+	default:
+		return fmt.Sprintf("ℹ️ %s by %s", entry.Action, actor)
+	}
+}
+
+// formatActor returns the name of a user, or the ID when the name is unknown
+func formatActor(userID int64, name string) string {
+	if name != "" {
+		return name
+	}
+	return fmt.Sprintf("%d", userID)
+}
+
+// actionVerb describes an audit action in the recent actions list
+func actionVerb(action audit.Action) string {
+	switch action {
+	case audit.ActionSwitch:
+		return "switched to"
+	case audit.ActionUpdate:
+		return "updated from"
+	case audit.ActionHook:
+		return "ran"
+	default:
+		return string(action)
+	}
+}
+func formatIntruderName(intruder security.Intruder) string {
+	if intruder.Username != "" {
+		return fmt.Sprintf("%d (@%s)", intruder.UserID, intruder.Username)
+	}
+	return fmt.Sprintf("%d", intruder.UserID)
+}
+
 // FormatUnauthorizedMessage creates a formatted unauthorized access message
 func (mf *MessageFormatter) FormatUnauthorizedMessage() string {
 	return "❌ Unauthorized Access\n\n" +
@@ -363,12 +1764,18 @@ func (mf *MessageFormatter) getLatencyQualityText(latency int64) string {
 
 func (mf *MessageFormatter) getUpdateStageEmoji(stage string) string {
 	switch strings.ToLower(stage) {
-	case "downloading":
+	case "downloading", "downloading_binary":
 		return "📥"
 	case "backing_up":
 		return "💾"
+	case "launching":
+		return "🚀"
+	case "stopping_service":
+		return "⏹️"
 	case "installing":
 		return "⚙️"
+	case "starting_service":
+		return "▶️"
 	case "completing":
 		return "✅"
 	case "initializing":
@@ -2,10 +2,15 @@ package telegram
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"strings"
 	"sync"
 	"time"
 	"unicode/utf8"
+	"xray-telegram-manager/clock"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
@@ -18,28 +23,236 @@ type BotInterface interface {
 	DeleteMessage(ctx context.Context, params *bot.DeleteMessageParams) (bool, error)
 }
 
+// MessageSender shows bot messages. Handlers and background tasks such as the ping
+// and update progress use it instead of calling the Bot API directly, so retries,
+// flood limits and debouncing are handled in one place. A user has one active
+// message per message type, so a ping test does not take over the server list.
+type MessageSender interface {
+	// SendOrEdit edits the active message of the user and content type or sends a new one
+	SendOrEdit(ctx context.Context, userID int64, content MessageContent) error
+	// SendNew always sends a new message, it becomes the active message of its type
+	SendNew(ctx context.Context, userID int64, content MessageContent) error
+	// SendProgress is SendOrEdit for progress updates. Updates of a debounced message
+	// type that come faster than its interval are dropped, sent reports whether the
+	// update was shown.
+	SendProgress(ctx context.Context, userID int64, content MessageContent) (sent bool, err error)
+	// EditProgress edits a known message with the same debouncing as SendProgress
+	EditProgress(ctx context.Context, chatID int64, messageID int, content MessageContent) (sent bool, err error)
+	// ResetProgress forgets the debouncing state of the user, called when a progress ends
+	ResetProgress(userID int64)
+}
+
+var _ MessageSender = (*MessageManager)(nil)
+
+// messageKey identifies the active message or the progress updates of one message
+// type in one chat
+type messageKey struct {
+	chatID      int64
+	messageType MessageType
+}
+
+// progressState tracks when a progress update was last shown
+type progressState struct {
+	lastSent time.Time
+	skipped  int
+}
+
+// editWindow is how long Telegram allows bots to edit their messages
+const editWindow = 48 * time.Hour
+
+// maxFloodWait bounds how long a send waits for the retry_after of Telegram, it
+// stays below the operation timeout. Longer waits fail with a *FloodWaitError.
+const maxFloodWait = 20 * time.Second
+
+// FloodWaitError is returned instead of calling the Bot API while Telegram asks the
+// bot to wait longer than maxFloodWait
+type FloodWaitError struct {
+	Wait time.Duration
+}
+
+func (e *FloodWaitError) Error() string {
+	return fmt.Sprintf("telegram flood limit, retry after %v", e.Wait.Round(time.Second))
+}
+
+// errMessageNotEditable is returned when Telegram refuses to edit a message, e.g.
+// after editWindow or when the message was deleted
+var errMessageNotEditable = errors.New("message can't be edited")
+
 // MessageManager handles message editing and fallbacks
 type MessageManager struct {
-	bot              BotInterface
-	logger           Logger
-	activeMessages   map[int64]*ActiveMessage
-	mutex            sync.RWMutex
-	messageTimeout   time.Duration
+	bot            BotInterface
+	logger         Logger
+	activeMessages map[messageKey]*ActiveMessage
+	mutex          sync.RWMutex
+	messageTimeout time.Duration
+	// Time after the last edit when a message of the type is left alone and the next
+	// one is sent as a new message, types without an entry use messageTimeout
+	typeTimeouts     map[MessageType]time.Duration
 	operationTimeout time.Duration
 	maxRetries       int
 	retryDelay       time.Duration
+	apiTracker       *APIErrorTracker
+	throttle         *sendThrottle
+	topicResolver    func(chatID int64, messageType MessageType) int
+	// Minimum delay between progress updates per message type, see SetDebounce
+	debounce map[MessageType]time.Duration
+	progress map[messageKey]*progressState
+	clock    clock.Clock
 }
 
 // NewMessageManager creates a new MessageManager instance
 func NewMessageManager(b BotInterface, logger Logger) *MessageManager {
 	return &MessageManager{
-		bot:              b,
-		logger:           logger,
-		activeMessages:   make(map[int64]*ActiveMessage),
-		messageTimeout:   60 * time.Minute, // Default timeout of 60 minutes
+		bot:            b,
+		logger:         logger,
+		activeMessages: make(map[messageKey]*ActiveMessage),
+		messageTimeout: 60 * time.Minute, // Default timeout of 60 minutes
+		typeTimeouts: map[MessageType]time.Duration{
+			// A menu or ping result scrolled far up is replaced instead of edited
+			MessageTypeMenu:     15 * time.Minute,
+			MessageTypePingTest: 30 * time.Minute,
+		},
 		operationTimeout: 30 * time.Second, // Default operation timeout of 30 seconds
 		maxRetries:       3,                // Default max retries
 		retryDelay:       1 * time.Second,  // Default retry delay
+		apiTracker:       NewAPIErrorTracker(),
+		throttle:         newSendThrottle(time.Now()),
+		debounce: map[MessageType]time.Duration{
+			MessageTypePingTest: time.Second,
+			MessageTypeUpdate:   time.Second,
+		},
+		progress: make(map[messageKey]*progressState),
+		clock:    clock.Real,
+	}
+}
+
+// SetClock replaces the clock used for expiry, debouncing, retries and the send
+// throttle, for tests. It must be called before the manager is used.
+func (mm *MessageManager) SetClock(c clock.Clock) {
+	mm.clock = c
+	mm.throttle = newSendThrottle(c.Now())
+}
+
+// SetDebounce sets the minimum delay between progress updates of a message type.
+// Zero turns debouncing off for the type. After flood limits the delay is raised
+// to the API update interval.
+func (mm *MessageManager) SetDebounce(messageType MessageType, interval time.Duration) {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+	if interval <= 0 {
+		delete(mm.debounce, messageType)
+		return
+	}
+	mm.debounce[messageType] = interval
+}
+
+// SetMessageTimeout sets how long after its last edit the active message of a type is
+// still edited, later messages of the type are sent as new messages. Zero makes the
+// type use the default timeout.
+func (mm *MessageManager) SetMessageTimeout(messageType MessageType, timeout time.Duration) {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+	if timeout <= 0 {
+		delete(mm.typeTimeouts, messageType)
+		return
+	}
+	mm.typeTimeouts[messageType] = timeout
+}
+
+// SetTopicResolver sets the function choosing the forum topic of new messages
+func (mm *MessageManager) SetTopicResolver(resolver func(chatID int64, messageType MessageType) int) {
+	mm.topicResolver = resolver
+}
+
+// UpdateInterval returns the minimum delay between progress edits, raised after flood limits
+func (mm *MessageManager) UpdateInterval() time.Duration {
+	return mm.apiTracker.UpdateInterval()
+}
+
+// APIStats returns the Telegram API error counters
+func (mm *MessageManager) APIStats() APIStats {
+	return mm.apiTracker.Stats()
+}
+
+// ThrottleStats returns the counters of sends held back to stay within the flood
+// limits of Telegram
+func (mm *MessageManager) ThrottleStats() ThrottleStats {
+	return mm.throttle.Stats()
+}
+
+// ActiveMessageCount returns the number of active messages of all users and types
+func (mm *MessageManager) ActiveMessageCount() int {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+	return len(mm.activeMessages)
+}
+
+// PendingProgressCount returns the number of progress updates dropped by debouncing
+// that were not followed by a shown update yet
+func (mm *MessageManager) PendingProgressCount() int {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+	pending := 0
+	for _, state := range mm.progress {
+		pending += state.skipped
+	}
+	return pending
+}
+
+// waitBeforeAttempt waits until the retry_after of the last flood limit is over, and
+// for at least the retry delay before retries. Every API call of the manager waits
+// here, so a 429 pauses all sends instead of only the one that got it.
+func (mm *MessageManager) waitBeforeAttempt(ctx context.Context, attempt int) error {
+	delay := mm.apiTracker.FloodWait()
+	if delay > maxFloodWait {
+		return &FloodWaitError{Wait: delay}
+	}
+	if attempt > 0 && delay < mm.retryDelay {
+		delay = mm.retryDelay
+	}
+	if delay <= 0 {
+		return nil
+	}
+	timer := mm.clock.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
+
+// waitForSendSlot waits until a send or edit in the chat fits the global and per
+// chat limits of Telegram
+func (mm *MessageManager) waitForSendSlot(ctx context.Context, chatID any) error {
+	id := throttleChatID(chatID)
+	wait := mm.throttle.reserve(id, mm.clock.Now())
+	if wait <= 0 {
+		return nil
+	}
+	mm.logger.Debug("Throttling message to chat %d for %v", id, wait)
+	timer := mm.clock.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		mm.throttle.cancel(id)
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
+
+// throttleChatID returns the numeric chat ID of API params, channel usernames share
+// the zero ID
+func throttleChatID(chatID any) int64 {
+	switch id := chatID.(type) {
+	case int64:
+		return id
+	case int:
+		return int64(id)
+	default:
+		return 0
 	}
 }
 
@@ -55,16 +268,35 @@ func (mm *MessageManager) SendOrEdit(ctx context.Context, userID int64, content
 	opCtx, cancel := context.WithTimeout(ctx, mm.operationTimeout)
 	defer cancel()
 
+	key := messageKey{userID, content.Type}
 	mm.mutex.Lock()
-	activeMsg := mm.activeMessages[userID]
+	activeMsg := mm.activeMessages[key]
+	expired := activeMsg != nil && mm.isMessageExpired(activeMsg)
 	mm.mutex.Unlock()
 
 	// If no active message or message is too old, send new message
-	if activeMsg == nil || mm.isMessageExpired(activeMsg) {
-		mm.logger.Debug("No active message or expired message for user %d, sending new message", userID)
+	if activeMsg == nil || expired {
+		mm.logger.Debug("No active or an expired %s message for user %d, sending new message", content.Type, userID)
+		return mm.sendNewWithRetry(opCtx, userID, content)
+	}
+	if mm.clock.Since(activeMsg.SentAt) > editWindow {
+		mm.logger.Debug("Message %d for user %d is past the edit window, sending new message", activeMsg.MessageID, userID)
+		mm.clearActive(key)
 		return mm.sendNewWithRetry(opCtx, userID, content)
 	}
 
+	hash := contentHash(content)
+	mm.mutex.Lock()
+	unchanged := activeMsg.ContentHash == hash
+	if unchanged {
+		activeMsg.CreatedAt = mm.clock.Now()
+	}
+	mm.mutex.Unlock()
+	if unchanged {
+		mm.logger.Debug("Edit skipped: message %d for user %d already shows this content", activeMsg.MessageID, userID)
+		return nil
+	}
+
 	// Try to edit the existing message with retry logic
 	mm.logger.Debug("Attempting to edit message %d for user %d", activeMsg.MessageID, userID)
 
@@ -77,21 +309,27 @@ func (mm *MessageManager) SendOrEdit(ctx context.Context, userID int64, content
 	}
 
 	err := mm.editMessageWithRetry(opCtx, editParams)
+	if errors.Is(err, errMessageNotEditable) {
+		// Old or deleted messages cannot be deleted either
+		mm.logger.Debug("Message %d for user %d can no longer be edited, sending new message", activeMsg.MessageID, userID)
+		mm.clearActive(key)
+		return mm.sendNewWithRetry(opCtx, userID, content)
+	}
 	if err != nil {
 		mm.logger.Warn("Failed to edit message %d for user %d after retries: %v, falling back to new message",
 			activeMsg.MessageID, userID, err)
 
 		// Fallback: try to delete old message and send new one
 		mm.deleteMessageWithTimeout(opCtx, activeMsg.ChatID, activeMsg.MessageID)
-		mm.ClearActiveMessage(userID)
+		mm.clearActive(key)
 
 		return mm.sendNewWithRetry(opCtx, userID, content)
 	}
 
-	// Update the message type and timestamp
+	// Update the content and timestamp
 	mm.mutex.Lock()
-	activeMsg.Type = content.Type
-	activeMsg.CreatedAt = time.Now()
+	activeMsg.ContentHash = hash
+	activeMsg.CreatedAt = mm.clock.Now()
 	mm.mutex.Unlock()
 
 	mm.logger.Debug("Successfully edited message %d for user %d", activeMsg.MessageID, userID)
@@ -107,12 +345,108 @@ func (mm *MessageManager) SendNew(ctx context.Context, userID int64, content Mes
 	return mm.sendNewWithRetry(opCtx, userID, content)
 }
 
+// SendProgress sends or edits a progress update unless it comes too soon after the previous one
+func (mm *MessageManager) SendProgress(ctx context.Context, userID int64, content MessageContent) (bool, error) {
+	if !mm.progressDue(userID, content.Type) {
+		return false, nil
+	}
+	if err := mm.SendOrEdit(ctx, userID, content); err != nil {
+		return false, err
+	}
+	mm.markProgressSent(userID, content.Type)
+	return true, nil
+}
+
+// EditProgress edits messageID with a progress update unless it comes too soon after the previous one
+func (mm *MessageManager) EditProgress(ctx context.Context, chatID int64, messageID int, content MessageContent) (bool, error) {
+	if !mm.progressDue(chatID, content.Type) {
+		return false, nil
+	}
+	opCtx, cancel := context.WithTimeout(ctx, mm.operationTimeout)
+	defer cancel()
+	err := mm.editMessageWithRetry(opCtx, &bot.EditMessageTextParams{
+		ChatID:      chatID,
+		MessageID:   messageID,
+		Text:        content.Text,
+		ReplyMarkup: content.ReplyMarkup,
+		ParseMode:   content.ParseMode,
+	})
+	if err != nil {
+		return false, err
+	}
+	mm.mutex.Lock()
+	if activeMsg := mm.activeMessages[messageKey{chatID, content.Type}]; activeMsg != nil && activeMsg.MessageID == messageID {
+		activeMsg.ContentHash = contentHash(content)
+	}
+	mm.mutex.Unlock()
+	mm.markProgressSent(chatID, content.Type)
+	return true, nil
+}
+
+// ResetProgress forgets when progress updates were last shown to the user
+func (mm *MessageManager) ResetProgress(userID int64) {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+	mm.resetProgressUnsafe(userID)
+}
+func (mm *MessageManager) resetProgressUnsafe(userID int64) {
+	for key := range mm.progress {
+		if key.chatID == userID {
+			delete(mm.progress, key)
+		}
+	}
+}
+
+// progressDue reports whether a progress update of messageType may be shown now,
+// counting the updates it drops
+func (mm *MessageManager) progressDue(chatID int64, messageType MessageType) bool {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+	interval, debounced := mm.debounce[messageType]
+	if !debounced {
+		return true
+	}
+	if apiInterval := mm.apiTracker.UpdateInterval(); apiInterval > interval {
+		interval = apiInterval
+	}
+	key := messageKey{chatID, messageType}
+	state := mm.progress[key]
+	// Updates are dropped while Telegram asked to wait, instead of queueing behind the flood limit
+	flooded := mm.apiTracker.FloodWait() > 0
+	if !flooded && (state == nil || mm.clock.Since(state.lastSent) >= interval) {
+		return true
+	}
+	if state == nil {
+		state = &progressState{}
+		mm.progress[key] = state
+	}
+	state.skipped++
+	return false
+}
+func (mm *MessageManager) markProgressSent(chatID int64, messageType MessageType) {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+	key := messageKey{chatID, messageType}
+	state := mm.progress[key]
+	if state == nil {
+		state = &progressState{}
+		mm.progress[key] = state
+	}
+	if state.skipped > 0 {
+		mm.logger.Debug("Skipped %d %s updates for user %d due to rate limiting", state.skipped, messageType, chatID)
+		state.skipped = 0
+	}
+	state.lastSent = mm.clock.Now()
+}
+
 // ensureValidReplyMarkup ensures that ReplyMarkup is valid or returns an empty keyboard
 func (mm *MessageManager) ensureValidReplyMarkup(markup *models.InlineKeyboardMarkup) *models.InlineKeyboardMarkup {
 	if markup == nil {
 		return &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{}}
 	}
-	return markup
+	return validateKeyboard(markup, func(data string) {
+		mm.logger.Error("Callback data of %d bytes exceeds the Telegram limit, button disabled: %s", len(data), data)
+	})
 }
 
 // sendNewWithRetry sends a new message with retry logic
@@ -125,73 +459,113 @@ func (mm *MessageManager) sendNewWithRetry(ctx context.Context, userID int64, co
 		ReplyMarkup: mm.ensureValidReplyMarkup(content.ReplyMarkup),
 		ParseMode:   content.ParseMode,
 	}
+	if mm.topicResolver != nil {
+		sendParams.MessageThreadID = mm.topicResolver(userID, content.Type)
+	}
+
+	sentMsg, err := mm.sendWithRetry(ctx, sendParams)
+	if err != nil {
+		mm.logger.Error("Failed to send new message to user %d: %v", userID, err)
+		return err
+	}
+
+	// Store the new active message
+	mm.mutex.Lock()
+	now := mm.clock.Now()
+	mm.activeMessages[messageKey{userID, content.Type}] = &ActiveMessage{
+		ChatID:      sentMsg.Chat.ID,
+		MessageID:   sentMsg.ID,
+		Type:        content.Type,
+		CreatedAt:   now,
+		SentAt:      now,
+		ContentHash: contentHash(content),
+	}
+	mm.mutex.Unlock()
+
+	mm.logger.Debug("Successfully sent new message %d to user %d", sentMsg.ID, userID)
+	return nil
+}
 
+// Send sends a message that does not become the active message of the chat, such as
+// notifications to several chats, with the retries and flood limit handling of the
+// manager
+func (mm *MessageManager) Send(ctx context.Context, params *bot.SendMessageParams) (*models.Message, error) {
+	return mm.sendWithRetry(ctx, params)
+}
+
+// sendWithRetry calls sendMessage until it succeeds or fails with an error that is
+// not worth retrying
+func (mm *MessageManager) sendWithRetry(ctx context.Context, params *bot.SendMessageParams) (*models.Message, error) {
 	var sentMsg *models.Message
 	var err error
 
 	for attempt := 0; attempt < mm.maxRetries; attempt++ {
-		if attempt > 0 {
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case <-time.After(mm.retryDelay):
-				// Wait before retry, but respect context cancellation
-			}
+		if waitErr := mm.waitBeforeAttempt(ctx, attempt); waitErr != nil {
+			return nil, waitErr
 		}
 
-		sentMsg, err = mm.bot.SendMessage(ctx, sendParams)
+		if waitErr := mm.waitForSendSlot(ctx, params.ChatID); waitErr != nil {
+			return nil, waitErr
+		}
+		sentMsg, err = mm.bot.SendMessage(ctx, params)
+		retryAfter := mm.apiTracker.Record("sendMessage", err)
 		if err == nil {
-			break // Success
+			return sentMsg, nil
+		}
+		if retryAfter > 0 {
+			mm.logger.Warn("Telegram flood limit on sendMessage, retry after %v (update interval now %v)", retryAfter, mm.apiTracker.UpdateInterval())
 		}
 
-		mm.logger.Debug("Attempt %d failed to send message to user %d: %v", attempt+1, userID, err)
+		mm.logger.Debug("Attempt %d failed to send message to chat %v: %v", attempt+1, params.ChatID, err)
 
 		// Check if we should retry based on error type
 		if !mm.shouldRetry(err) {
 			break
 		}
 	}
+	return nil, err
+}
 
-	if err != nil {
-		mm.logger.Error("Failed to send new message to user %d after %d attempts: %v", userID, mm.maxRetries, err)
-		return err
-	}
-
-	// Store the new active message
+// ClearActiveMessage clears the active messages of all types for a user
+func (mm *MessageManager) ClearActiveMessage(userID int64) {
 	mm.mutex.Lock()
-	mm.activeMessages[userID] = &ActiveMessage{
-		ChatID:    sentMsg.Chat.ID,
-		MessageID: sentMsg.ID,
-		Type:      content.Type,
-		CreatedAt: time.Now(),
+	for key := range mm.activeMessages {
+		if key.chatID == userID {
+			delete(mm.activeMessages, key)
+		}
 	}
 	mm.mutex.Unlock()
 
-	mm.logger.Debug("Successfully sent new message %d to user %d", sentMsg.ID, userID)
-	return nil
+	mm.logger.Debug("Cleared active messages for user %d", userID)
 }
 
-// ClearActiveMessage clears the active message for a user
-func (mm *MessageManager) ClearActiveMessage(userID int64) {
+// clearActive forgets one active message, the next message of its type is sent anew
+func (mm *MessageManager) clearActive(key messageKey) {
 	mm.mutex.Lock()
-	delete(mm.activeMessages, userID)
+	delete(mm.activeMessages, key)
 	mm.mutex.Unlock()
-
-	mm.logger.Debug("Cleared active message for user %d", userID)
 }
 
-// GetActiveMessage gets the active message for a user
-func (mm *MessageManager) GetActiveMessage(userID int64) *ActiveMessage {
+// GetActiveMessage gets the active message of a type for a user
+func (mm *MessageManager) GetActiveMessage(userID int64, messageType MessageType) *ActiveMessage {
 	mm.mutex.RLock()
-	activeMsg := mm.activeMessages[userID]
+	activeMsg := mm.activeMessages[messageKey{userID, messageType}]
 	mm.mutex.RUnlock()
 
 	return activeMsg
 }
 
-// isMessageExpired checks if a message is too old to be edited
+// isMessageExpired checks if a message is too old to be edited, the mutex must be held
 func (mm *MessageManager) isMessageExpired(msg *ActiveMessage) bool {
-	return time.Since(msg.CreatedAt) > mm.messageTimeout
+	return mm.clock.Since(msg.CreatedAt) > mm.timeoutFor(msg.Type)
+}
+
+// timeoutFor returns how long a message of the type is edited after its last edit
+func (mm *MessageManager) timeoutFor(messageType MessageType) time.Duration {
+	if timeout, ok := mm.typeTimeouts[messageType]; ok {
+		return timeout
+	}
+	return mm.messageTimeout
 }
 
 // editMessageWithRetry attempts to edit a message with retry logic
@@ -199,27 +573,35 @@ func (mm *MessageManager) editMessageWithRetry(ctx context.Context, params *bot.
 	var err error
 
 	for attempt := 0; attempt < mm.maxRetries; attempt++ {
-		if attempt > 0 {
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case <-time.After(mm.retryDelay):
-				// Wait before retry, but respect context cancellation
-			}
+		if waitErr := mm.waitBeforeAttempt(ctx, attempt); waitErr != nil {
+			return waitErr
 		}
 
+		if waitErr := mm.waitForSendSlot(ctx, params.ChatID); waitErr != nil {
+			return waitErr
+		}
 		_, err = mm.bot.EditMessageText(ctx, params)
 		// If Telegram returns "message is not modified", treat it as success
 		if err != nil {
 			es := strings.ToLower(err.Error())
 			if strings.Contains(es, "message is not modified") {
+				mm.apiTracker.Record("editMessageText", nil)
 				mm.logger.Debug("Edit skipped: message %d content is identical; treating as success", params.MessageID)
 				return nil
 			}
+			if isNotEditable(es) {
+				mm.apiTracker.Record("editMessageText", nil)
+				return fmt.Errorf("%w: %v", errMessageNotEditable, err)
+			}
+			retryAfter := mm.apiTracker.Record("editMessageText", err)
+			if retryAfter > 0 {
+				mm.logger.Warn("Telegram flood limit on editMessageText, retry after %v (update interval now %v)", retryAfter, mm.apiTracker.UpdateInterval())
+			}
 			// Only log a failed attempt when there is a real error
 			mm.logger.Debug("Attempt %d failed to edit message %d: %v", attempt+1, params.MessageID, err)
 		} else {
 			// Success
+			mm.apiTracker.Record("editMessageText", nil)
 			return nil
 		}
 
@@ -232,6 +614,28 @@ func (mm *MessageManager) editMessageWithRetry(ctx context.Context, params *bot.
 	return err
 }
 
+// isNotEditable reports whether a lowercased edit error means the message can never
+// be edited again, so retrying or deleting it is pointless
+func isNotEditable(errText string) bool {
+	return strings.Contains(errText, "message can't be edited") ||
+		strings.Contains(errText, "message to edit not found")
+}
+
+// contentHash identifies the text, parse mode and keyboard of a message
+func contentHash(content MessageContent) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(content.Text))
+	h.Write([]byte{0})
+	h.Write([]byte(content.ParseMode))
+	h.Write([]byte{0})
+	if content.ReplyMarkup != nil {
+		if markup, err := json.Marshal(content.ReplyMarkup); err == nil {
+			h.Write(markup)
+		}
+	}
+	return h.Sum64()
+}
+
 // deleteMessageWithTimeout attempts to delete a message with timeout (best effort)
 func (mm *MessageManager) deleteMessageWithTimeout(ctx context.Context, chatID int64, messageID int) {
 	deleteParams := &bot.DeleteMessageParams{
@@ -240,6 +644,7 @@ func (mm *MessageManager) deleteMessageWithTimeout(ctx context.Context, chatID i
 	}
 
 	_, err := mm.bot.DeleteMessage(ctx, deleteParams)
+	mm.apiTracker.Record("deleteMessage", err)
 	if err != nil {
 		mm.logger.Debug("Could not delete message %d from chat %d: %v", messageID, chatID, err)
 	} else {
@@ -282,37 +687,38 @@ func (mm *MessageManager) CleanupExpiredMessages() {
 	mm.mutex.Lock()
 	defer mm.mutex.Unlock()
 
-	now := time.Now()
-	expiredUsers := make([]int64, 0)
+	now := mm.clock.Now()
+	mm.throttle.cleanup(now)
+	expired := make([]messageKey, 0)
 	totalMessages := len(mm.activeMessages)
 
-	for userID, msg := range mm.activeMessages {
-		if now.Sub(msg.CreatedAt) > mm.messageTimeout {
-			expiredUsers = append(expiredUsers, userID)
+	for key, msg := range mm.activeMessages {
+		if now.Sub(msg.CreatedAt) > mm.timeoutFor(key.messageType) {
+			expired = append(expired, key)
 		}
 	}
 
-	for _, userID := range expiredUsers {
-		delete(mm.activeMessages, userID)
-		mm.logger.Debug("Cleaned up expired message for user %d", userID)
+	for _, key := range expired {
+		delete(mm.activeMessages, key)
+		mm.logger.Debug("Cleaned up expired %s message for user %d", key.messageType, key.chatID)
 	}
 
-	if len(expiredUsers) > 0 {
+	if len(expired) > 0 {
 		mm.logger.Info("Cleaned up %d expired messages (total active: %d -> %d)",
-			len(expiredUsers), totalMessages, len(mm.activeMessages))
+			len(expired), totalMessages, len(mm.activeMessages))
 	}
 }
 
 // StartCleanupRoutine starts a goroutine that periodically cleans up expired messages
 func (mm *MessageManager) StartCleanupRoutine(ctx context.Context) {
-	ticker := time.NewTicker(5 * time.Minute) // Cleanup every 5 minutes
+	ticker := mm.clock.NewTicker(5 * time.Minute) // Cleanup every 5 minutes
 	defer ticker.Stop()
 
 	mm.logger.Info("Started message cleanup routine")
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 			mm.CleanupExpiredMessages()
 		case <-ctx.Done():
 			mm.logger.Info("Message cleanup routine stopped")
@@ -321,13 +727,31 @@ func (mm *MessageManager) StartCleanupRoutine(ctx context.Context) {
 	}
 }
 
-// ForceCleanupUser forces cleanup of a specific user's active message
+// ForceCleanupUser forces cleanup of the active messages of all types of a user, the
+// next message is sent below whatever the user typed
 func (mm *MessageManager) ForceCleanupUser(userID int64, reason string) {
 	mm.mutex.Lock()
 	defer mm.mutex.Unlock()
 
-	if _, exists := mm.activeMessages[userID]; exists {
-		delete(mm.activeMessages, userID)
-		mm.logger.Debug("Force cleaned up message for user %d, reason: %s", userID, reason)
+	mm.resetProgressUnsafe(userID)
+	for key := range mm.activeMessages {
+		if key.chatID == userID {
+			delete(mm.activeMessages, key)
+			mm.logger.Debug("Force cleaned up %s message for user %d, reason: %s", key.messageType, userID, reason)
+		}
+	}
+}
+
+// ForceCleanupType forces cleanup of the active message of one type of a user, the
+// messages of other types stay active
+func (mm *MessageManager) ForceCleanupType(userID int64, messageType MessageType, reason string) {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	key := messageKey{userID, messageType}
+	delete(mm.progress, key)
+	if _, exists := mm.activeMessages[key]; exists {
+		delete(mm.activeMessages, key)
+		mm.logger.Debug("Force cleaned up %s message for user %d, reason: %s", messageType, userID, reason)
 	}
 }
@@ -0,0 +1,123 @@
+package telegram
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+	"xray-telegram-manager/clock"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// testLogger drops all log messages
+type testLogger struct{}
+
+func (testLogger) Debug(format string, args ...interface{}) {}
+func (testLogger) Info(format string, args ...interface{})  {}
+func (testLogger) Warn(format string, args ...interface{})  {}
+func (testLogger) Error(format string, args ...interface{}) {}
+
+// fakeBot counts the messages sent and edited through the Bot API
+type fakeBot struct {
+	mutex  sync.Mutex
+	nextID int
+	sent   int
+	edited int
+}
+
+func (b *fakeBot) SendMessage(ctx context.Context, params *bot.SendMessageParams) (*models.Message, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.nextID++
+	b.sent++
+	return &models.Message{ID: b.nextID, Chat: models.Chat{ID: params.ChatID.(int64)}}, nil
+}
+
+func (b *fakeBot) EditMessageText(ctx context.Context, params *bot.EditMessageTextParams) (*models.Message, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.edited++
+	return &models.Message{ID: params.MessageID}, nil
+}
+
+func (b *fakeBot) DeleteMessage(ctx context.Context, params *bot.DeleteMessageParams) (bool, error) {
+	return true, nil
+}
+
+func (b *fakeBot) counts() (int, int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.sent, b.edited
+}
+
+func TestMessageManagerExpiry(t *testing.T) {
+	fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	b := &fakeBot{}
+	mm := NewMessageManager(b, testLogger{})
+	mm.SetClock(fake)
+	ctx := context.Background()
+
+	send := func(messageType MessageType, text string) {
+		t.Helper()
+		if err := mm.SendOrEdit(ctx, 42, MessageContent{Text: text, Type: messageType}); err != nil {
+			t.Fatalf("SendOrEdit failed: %v", err)
+		}
+	}
+	send(MessageTypeMenu, "menu")
+	send(MessageTypeStatus, "status")
+
+	// Within the timeout of the menu it is edited
+	fake.Advance(10 * time.Minute)
+	send(MessageTypeMenu, "menu 2")
+	if sent, edited := b.counts(); sent != 2 || edited != 1 {
+		t.Fatalf("Expected 2 sends and 1 edit, got %d and %d", sent, edited)
+	}
+
+	// The edit restarted the timeout, 15 minutes after it the menu expires while the
+	// status with the default timeout of an hour stays
+	fake.Advance(15*time.Minute + time.Second)
+	mm.CleanupExpiredMessages()
+	if mm.GetActiveMessage(42, MessageTypeMenu) != nil || mm.GetActiveMessage(42, MessageTypeStatus) == nil {
+		t.Fatalf("Expected only the menu to expire, %d active messages left", mm.ActiveMessageCount())
+	}
+	send(MessageTypeMenu, "menu 3")
+	if sent, edited := b.counts(); sent != 3 || edited != 1 {
+		t.Errorf("Expected the expired menu to be sent anew, got %d sends and %d edits", sent, edited)
+	}
+
+	fake.Advance(time.Hour)
+	mm.CleanupExpiredMessages()
+	if count := mm.ActiveMessageCount(); count != 0 {
+		t.Errorf("Expected all messages to expire after an hour, %d left", count)
+	}
+}
+
+func TestMessageManagerProgressDebounce(t *testing.T) {
+	fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	b := &fakeBot{}
+	mm := NewMessageManager(b, testLogger{})
+	mm.SetClock(fake)
+	ctx := context.Background()
+
+	progress := func(text string) bool {
+		t.Helper()
+		sent, err := mm.SendProgress(ctx, 42, MessageContent{Text: text, Type: MessageTypePingTest})
+		if err != nil {
+			t.Fatalf("SendProgress failed: %v", err)
+		}
+		return sent
+	}
+	if !progress("1/10") {
+		t.Fatal("Expected the first update to be shown")
+	}
+	fake.Advance(500 * time.Millisecond)
+	if progress("2/10") || mm.PendingProgressCount() != 1 {
+		t.Fatalf("Expected an update within the debounce interval to be dropped, %d pending", mm.PendingProgressCount())
+	}
+	fake.Advance(500 * time.Millisecond)
+	if !progress("3/10") || mm.PendingProgressCount() != 0 {
+		t.Errorf("Expected the update after the interval to be shown, %d pending", mm.PendingProgressCount())
+	}
+}
@@ -14,6 +14,10 @@ const (
 	MessageTypeServerList MessageType = "server_list"
 	MessageTypePingTest   MessageType = "ping_test"
 	MessageTypeStatus     MessageType = "status"
+	// MessageTypeAlert marks errors and failures, sent to the alerts topic in groups
+	MessageTypeAlert MessageType = "alert"
+	// MessageTypeUpdate marks the bot self-update progress
+	MessageTypeUpdate MessageType = "update"
 )
 
 // ActiveMessage represents an active message that can be edited
@@ -21,7 +25,12 @@ type ActiveMessage struct {
 	ChatID    int64
 	MessageID int
 	Type      MessageType
+	// CreatedAt is when the message was last sent or edited
 	CreatedAt time.Time
+	// SentAt is when the message was sent, Telegram refuses edits after editWindow
+	SentAt time.Time
+	// ContentHash identifies the content last shown, identical edits are skipped
+	ContentHash uint64
 }
 
 // MessageContent represents the content to be sent or edited
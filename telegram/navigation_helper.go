@@ -1,6 +1,8 @@
 package telegram
 
 import (
+	"fmt"
+
 	"github.com/go-telegram/bot/models"
 )
 
@@ -77,6 +79,11 @@ func (nh *NavigationHelper) CreateServerListNavigationKeyboard(page, totalPages
 		{Text: "🔄 Refresh List", CallbackData: "refresh"},
 		{Text: "📊 Test Servers", CallbackData: "ping_test"},
 	})
+	if totalPages > 1 {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: "🏓 Test This Page", CallbackData: fmt.Sprintf("ping_scope_page_%d", page)},
+		})
+	}
 
 	// Next logical actions if enabled
 	if nh.enableNextActions {
@@ -101,15 +108,16 @@ func (nh *NavigationHelper) CreateServerListNavigationKeyboard(page, totalPages
 	return keyboard
 }
 
-// CreatePingTestNavigationKeyboard creates navigation for ping test results
-func (nh *NavigationHelper) CreatePingTestNavigationKeyboard(hasResults bool) *models.InlineKeyboardMarkup {
+// CreatePingTestNavigationKeyboard creates navigation for ping test results. retestAction
+// repeats the test with the same scope.
+func (nh *NavigationHelper) CreatePingTestNavigationKeyboard(hasResults bool, retestAction string) *models.InlineKeyboardMarkup {
 	var keyboard [][]models.InlineKeyboardButton
 
 	if hasResults {
 		// Primary actions for successful results
 		keyboard = append(keyboard, []models.InlineKeyboardButton{
 			{Text: "📋 View All Servers", CallbackData: "refresh"},
-			{Text: "🔄 Test Again", CallbackData: "ping_test"},
+			{Text: "🔄 Test Again", CallbackData: retestAction},
 		})
 
 		// Next logical actions if enabled
@@ -122,7 +130,7 @@ func (nh *NavigationHelper) CreatePingTestNavigationKeyboard(hasResults bool) *m
 		// Retry and alternative actions for failed results
 		if nh.enableRetryButtons {
 			keyboard = append(keyboard, []models.InlineKeyboardButton{
-				{Text: "🔄 Retry Test", CallbackData: "ping_test"},
+				{Text: "🔄 Retry Test", CallbackData: retestAction},
 			})
 		}
 
@@ -171,6 +179,7 @@ func (nh *NavigationHelper) CreateServerStatusNavigationKeyboard(isCurrentServer
 		if nh.enableNextActions {
 			keyboard = append(keyboard, []models.InlineKeyboardButton{
 				{Text: "� Refresh Status", CallbackData: "status"},
+				{Text: "🔎 Detect Current", CallbackData: "detect_current"},
 			})
 		}
 	} else {
@@ -240,10 +249,16 @@ func (nh *NavigationHelper) CreateErrorNavigationKeyboard(errorType string, retr
 
 	// Alternative actions based on error type
 	switch errorType {
-	case "server_load", "no_servers":
+	case "server_load", "no_servers", "no_active_server":
 		keyboard = append(keyboard, []models.InlineKeyboardButton{
 			{Text: "🔄 Refresh", CallbackData: "refresh"},
 		})
+		// The server may be active but not recognized yet
+		if errorType == "no_active_server" {
+			keyboard = append(keyboard, []models.InlineKeyboardButton{
+				{Text: "🔎 Detect Current", CallbackData: "detect_current"},
+			})
+		}
 		// Next logical actions for server loading errors
 		if nh.enableNextActions {
 			keyboard = append(keyboard, []models.InlineKeyboardButton{
@@ -401,10 +416,15 @@ func (nh *NavigationHelper) CreateQuickSelectKeyboard(servers []QuickSelectServe
 
 		// Server buttons (each on its own row for better readability)
 		for _, server := range servers {
+			// Switch-now buttons skip the confirmation dialog
+			callbackData := serverCallbackData("server_", server.ID, server.ListVersion)
+			if server.SwitchNow {
+				callbackData = serverCallbackData("confirm_", server.ID, server.ListVersion)
+			}
 			keyboard = append(keyboard, []models.InlineKeyboardButton{
 				{
 					Text:         server.ButtonText,
-					CallbackData: "server_" + server.ID,
+					CallbackData: callbackData,
 				},
 			})
 		}
@@ -458,6 +478,9 @@ func (nh *NavigationHelper) CreateLoadingKeyboard() *models.InlineKeyboardMarkup
 type QuickSelectServer struct {
 	ID         string
 	ButtonText string
+	SwitchNow  bool
+	// ListVersion is the version of the server list the server was taken from
+	ListVersion string
 }
 
 // CreateBreadcrumbNavigation creates breadcrumb-style navigation
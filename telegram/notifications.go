@@ -0,0 +1,287 @@
+package telegram
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+	"xray-telegram-manager/notifications"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	// updateCheckDelay postpones the first release check after start
+	updateCheckDelay = 2 * time.Minute
+	// updateCheckInterval is how often new releases are looked up
+	updateCheckInterval = 24 * time.Hour
+	// errorAlertWindow is how often an error that keeps repeating is reported again
+	errorAlertWindow = time.Hour
+)
+
+// notificationsPath returns where notification preferences are stored, next to the manager config
+func notificationsPath(config ConfigProvider) string {
+	configFile := config.GetConfigFilePath()
+	if configFile == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(configFile), "notifications.json")
+}
+
+// digestEntry is a notification held back during quiet hours
+type digestEntry struct {
+	event notifications.Event
+	text  string
+	time  time.Time
+}
+
+// Notify sends a proactive notification to the admin and to the configured groups,
+// respecting the user's preferences for the event. During quiet hours non-critical
+// notifications are collected and sent as a digest when the quiet hours end.
+func (tb *TelegramBot) Notify(ctx context.Context, event notifications.Event, text string) {
+	tb.notify(ctx, event, text, nil)
+}
+
+// notify is Notify with buttons. The buttons are dropped when the notification is
+// held back for the quiet hours digest.
+func (tb *TelegramBot) notify(ctx context.Context, event notifications.Event, text string, keyboard *models.InlineKeyboardMarkup) {
+	tb.notifyExcept(ctx, event, text, keyboard, 0)
+}
+
+// notifyExcept is notify without the chat except, where the reported action happened
+// and was already shown
+func (tb *TelegramBot) notifyExcept(ctx context.Context, event notifications.Event, text string, keyboard *models.InlineKeyboardMarkup, except int64) {
+	pref := tb.notifications.Get(event)
+	if !pref.Enabled {
+		tb.logger.Debug("Skipping %s notification, disabled by preferences", event)
+		return
+	}
+
+	if !event.IsCritical() && tb.scheduler.InQuietHours() {
+		tb.digestMutex.Lock()
+		tb.digest = append(tb.digest, digestEntry{event: event, text: text, time: time.Now()})
+		tb.digestMutex.Unlock()
+		tb.logger.Debug("Quiet hours: %s notification added to the digest", event)
+		return
+	}
+
+	delivered := tb.broadcastExcept(ctx, text, pref.Silent, keyboard, except)
+	tb.logger.Info("Sent %s notification (silent: %t)", event, pref.Silent)
+	if event.IsCritical() {
+		tb.sendFallback(ctx, event.DisplayName(), text, delivered)
+	}
+}
+
+// sendFallback sends a critical alert over the fallback channel when Telegram did not
+// deliver it, or always with fallback_notifier.always. It does not wait for the send.
+func (tb *TelegramBot) sendFallback(ctx context.Context, title, text string, delivered bool) {
+	if !tb.fallback.Wanted(delivered) {
+		return
+	}
+	go func() {
+		sent, err := tb.fallback.Send(context.WithoutCancel(ctx), "Xray manager: "+title, text)
+		if err != nil {
+			tb.logger.Error("Failed to send %q over the fallback channel: %v", title, err)
+		} else if sent {
+			tb.logger.Info("Sent %q over the fallback channel (delivered by Telegram: %t)", title, delivered)
+		}
+	}()
+}
+
+// ReportResult records the result of a background task, err is nil on success. The
+// admin is told about a new error, gets a summary of the repeats at most once per
+// errorAlertWindow and a notice when the task works again.
+func (tb *TelegramBot) ReportResult(ctx context.Context, source string, err error) {
+	notice := tb.errorAlerts.Record(source, err)
+	if notice == nil {
+		return
+	}
+	tb.Notify(ctx, notifications.EventErrorAlert, NewMessageFormatter().FormatErrorNotice(notice))
+}
+
+// sendDigest sends the notifications collected during quiet hours as one message
+func (tb *TelegramBot) sendDigest(ctx context.Context) {
+	tb.digestMutex.Lock()
+	entries := tb.digest
+	tb.digest = nil
+	tb.digestMutex.Unlock()
+
+	if len(entries) == 0 {
+		return
+	}
+
+	silent := true
+	for _, entry := range entries {
+		silent = silent && tb.notifications.Get(entry.event).Silent
+	}
+	messageFormatter := NewMessageFormatter()
+	tb.broadcast(ctx, messageFormatter.FormatQuietHoursDigest(entries), silent, nil)
+	tb.logger.Info("Sent quiet hours digest with %d notifications", len(entries))
+}
+
+// broadcast sends text to the admin and to the alerts topic of the configured groups,
+// with keyboard when it is not nil. It reports whether any chat got the message.
+func (tb *TelegramBot) broadcast(ctx context.Context, text string, silent bool, keyboard *models.InlineKeyboardMarkup) bool {
+	return tb.broadcastExcept(ctx, text, silent, keyboard, 0)
+}
+
+// broadcastExcept is broadcast without the chat except, where the action being
+// reported happened
+func (tb *TelegramBot) broadcastExcept(ctx context.Context, text string, silent bool, keyboard *models.InlineKeyboardMarkup, except int64) bool {
+	delivered := false
+	recipients := append([]int64{tb.config.GetAdminID()}, tb.config.GetGroupConfig().AllowedChatIDs...)
+	for _, chatID := range recipients {
+		if chatID == except {
+			continue
+		}
+		params := &bot.SendMessageParams{
+			ChatID:              chatID,
+			MessageThreadID:     tb.topicFor(chatID, MessageTypeAlert),
+			Text:                text,
+			DisableNotification: silent,
+		}
+		if keyboard != nil {
+			params.ReplyMarkup = keyboard
+		}
+		_, err := tb.messageManager.Send(ctx, params)
+		if err != nil {
+			tb.logger.Error("Failed to send notification to chat %d: %v", chatID, err)
+			continue
+		}
+		delivered = true
+	}
+	return delivered
+}
+
+// Announce sends a notice to the notification chats. They only get these notices,
+// commands from them are rejected like from any other chat. During quiet hours the
+// notice is sent without sound.
+func (tb *TelegramBot) Announce(ctx context.Context, text string) {
+	chats := tb.config.GetNotificationChats()
+	if len(chats) == 0 {
+		return
+	}
+	silent := tb.scheduler.InQuietHours()
+	for _, chatID := range chats {
+		_, err := tb.messageManager.Send(ctx, &bot.SendMessageParams{
+			ChatID:              chatID,
+			Text:                text,
+			DisableNotification: silent,
+		})
+		if err != nil {
+			tb.logger.Error("Failed to send notice to chat %d: %v", chatID, err)
+		}
+	}
+	tb.logger.Info("Sent notice to %d notification chats (silent: %t)", len(chats), silent)
+}
+
+func (tb *TelegramBot) checkForUpdate(ctx context.Context) {
+	if !tb.notifications.Get(notifications.EventUpdateAvailable).Enabled {
+		return
+	}
+
+	available, latest, err := tb.handlers.updateManager.CheckUpdateAvailable()
+	if err != nil {
+		tb.logger.Debug("Failed to check for updates: %v", err)
+		return
+	}
+	if !available || latest == tb.notifications.LastNotifiedVersion() {
+		return
+	}
+
+	messageFormatter := NewMessageFormatter()
+	tb.Notify(ctx, notifications.EventUpdateAvailable,
+		messageFormatter.FormatUpdateAvailableNotification(tb.handlers.updateManager.GetCurrentVersion(), latest))
+	if err := tb.notifications.SetLastNotifiedVersion(latest); err != nil {
+		tb.logger.Warn("Failed to save last notified version: %v", err)
+	}
+}
+
+// handleNotifications shows the notification preferences menu
+func (tb *TelegramBot) handleNotifications(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	tb.logger.Info("Received /notifications command from user %d (%s)", userID, username)
+
+	if !tb.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionAdmin) {
+		tb.logger.Warn("Unauthorized access attempt from user %d (%s) for /notifications command", userID, username)
+		tb.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/notifications")
+		return
+	}
+
+	if err := tb.messageManager.SendNew(ctx, update.Message.Chat.ID, tb.notificationsMenuContent()); err != nil {
+		tb.logger.Error("Failed to send notifications menu: %v", err)
+	}
+}
+
+// handleNotificationsCallback handles the notify_toggle_<event> and notify_silent_<event> buttons
+func (tb *TelegramBot) handleNotificationsCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID, data string) {
+	answerText := ""
+	if action, name, found := strings.Cut(strings.TrimPrefix(data, "notify_"), "_"); found {
+		event := notifications.Event(name)
+		if !event.IsValid() {
+			tb.logger.Warn("Unknown notification event from user %d: %s", chatID, name)
+			tb.answerCallback(ctx, callbackQueryID, "❌ Unknown notification")
+			return
+		}
+
+		var pref notifications.Preference
+		var err error
+		switch action {
+		case "toggle":
+			pref, err = tb.notifications.ToggleEnabled(event)
+			answerText = "🚫 " + event.DisplayName() + " off"
+			if pref.Enabled {
+				answerText = "✅ " + event.DisplayName() + " on"
+			}
+		case "silent":
+			pref, err = tb.notifications.ToggleSilent(event)
+			answerText = "🔔 " + event.DisplayName() + " with sound"
+			if pref.Silent {
+				answerText = "🔇 " + event.DisplayName() + " silent"
+			}
+		}
+		if err != nil {
+			tb.logger.Error("Failed to save notification preferences: %v", err)
+		}
+		tb.logger.Info("User %d changed %s notifications: %+v", chatID, event, pref)
+	}
+
+	tb.answerCallback(ctx, callbackQueryID, answerText)
+
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, tb.notificationsMenuContent()); err != nil {
+		tb.logger.Error("Failed to update notifications menu: %v", err)
+	}
+}
+func (tb *TelegramBot) notificationsMenuContent() MessageContent {
+	prefs := make(map[notifications.Event]notifications.Preference, len(notifications.Events))
+	var keyboard [][]models.InlineKeyboardButton
+	for _, event := range notifications.Events {
+		pref := tb.notifications.Get(event)
+		prefs[event] = pref
+
+		enabledIcon := "🚫"
+		if pref.Enabled {
+			enabledIcon = "✅"
+		}
+		soundIcon := "🔔"
+		if pref.Silent {
+			soundIcon = "🔇"
+		}
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: enabledIcon + " " + event.DisplayName(), CallbackData: "notify_toggle_" + string(event)},
+			{Text: soundIcon, CallbackData: "notify_silent_" + string(event)},
+		})
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "🏠 Main Menu", CallbackData: "main_menu"},
+	})
+
+	messageFormatter := NewMessageFormatter()
+	return MessageContent{
+		Text:        messageFormatter.FormatNotificationsMenu(prefs),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		Type:        MessageTypeMenu,
+	}
+}
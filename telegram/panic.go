@@ -0,0 +1,78 @@
+package telegram
+
+import (
+	"context"
+	"time"
+	"xray-telegram-manager/operations"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// panicWaitTimeout bounds waiting for a running switch or restore before the panic
+// pauses the proxy, those are bounded by their own timeouts
+const panicWaitTimeout = 2 * time.Minute
+
+// handlePanic asks to drop the VPN for direct internet
+func (tb *TelegramBot) handlePanic(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	tb.logger.Info("Received /panic command from user %d (%s)", userID, username)
+
+	if !tb.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionControl) {
+		tb.logger.Warn("Unauthorized access attempt from user %d (%s) for /panic command", userID, username)
+		tb.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/panic")
+		return
+	}
+
+	chatID := update.Message.Chat.ID
+	keyboard := &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+		{{Text: "🚨 Yes, go direct", CallbackData: "panic_confirm"}},
+		{{Text: "❌ Cancel", CallbackData: "main_menu"}},
+	}}
+	content := MessageContent{
+		Text:        NewMessageFormatter().FormatPanicConfirm(tb.serverMgr.GetCurrentServer(), tb.serverMgr.IsDirectMode()),
+		ReplyMarkup: keyboard,
+		Type:        MessageTypeStatus,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send panic confirmation: %v", err)
+	}
+}
+
+// handlePanicConfirm pauses the proxy, restarts xray and checks the direct connection.
+// Unlike other operations it waits for a running one instead of being rejected.
+func (tb *TelegramBot) handlePanicConfirm(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
+	tb.logger.Warn("Panic requested by user %d, switching to direct internet", chatID)
+	tb.answerCallback(ctx, callbackQueryID, "🚨 Switching to direct internet...")
+
+	waitCtx, cancel := context.WithTimeout(ctx, panicWaitTimeout)
+	defer cancel()
+	_, release, err := tb.serverMgr.Operations().Acquire(waitCtx, operations.OperationDirect, chatID, operations.PolicyQueue)
+	if err != nil {
+		tb.logger.Error("Panic of user %d could not start: %v", chatID, err)
+		tb.sendErrorMessage(ctx, b, chatID, "Failed to Switch to Direct Internet", err.Error(), "status")
+		return
+	}
+	defer release()
+
+	result, err := tb.serverMgr.Panic(ctx)
+	if err != nil {
+		tb.logger.Error("Panic of user %d failed: %v", chatID, err)
+		tb.messageManager.ForceCleanupUser(chatID, "panic failed")
+		tb.sendErrorMessage(ctx, b, chatID, "Failed to Switch to Direct Internet", err.Error(), "status")
+		return
+	}
+	tb.logger.Info("Panic of user %d done, direct connection reachable: %t", chatID, result.Reachable != "")
+
+	keyboard := NewNavigationHelper().CreateServerStatusNavigationKeyboard(true)
+	tb.addDirectModeButton(keyboard)
+	content := MessageContent{
+		Text:        NewMessageFormatter().FormatPanicResult(result, tb.serverMgr.GetCurrentServer()),
+		ReplyMarkup: keyboard,
+		Type:        MessageTypeStatus,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send panic result: %v", err)
+	}
+}
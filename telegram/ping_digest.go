@@ -0,0 +1,67 @@
+package telegram
+
+import (
+	"context"
+	"xray-telegram-manager/notifications"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// sendPingDigest sends the daily summary of the background availability checks. It
+// is skipped when no server was checked in the last day.
+func (tb *TelegramBot) sendPingDigest(ctx context.Context) {
+	digest := tb.serverMgr.GetPingDigest()
+	if len(digest.Servers) == 0 {
+		tb.logger.Debug("Skipping ping digest, no servers were checked in the last day")
+		return
+	}
+
+	keyboard := &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+		{{Text: "⚡ Quick Select Fastest", CallbackData: "digest_quick"}},
+	}}
+	tb.notify(ctx, notifications.EventPingDigest, NewMessageFormatter().FormatPingDigest(digest), keyboard)
+}
+
+// handleDigestQuickCallback shows quick select buttons for the servers that were
+// fastest over the last day, without testing them again
+func (tb *TelegramBot) handleDigestQuickCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
+	tb.answerCallback(ctx, callbackQueryID, "")
+
+	digest := tb.serverMgr.GetPingDigest()
+	var results []types.PingResult
+	for _, server := range digest.Servers {
+		if server.AvgLatency > 0 {
+			results = append(results, types.PingResult{
+				Server:    server.Server,
+				Latency:   server.AvgLatency,
+				Success:   true,
+				Available: true,
+			})
+		}
+	}
+
+	var currentServerID string
+	if currentServer := tb.serverMgr.GetCurrentServer(); currentServer != nil {
+		currentServerID = currentServer.ID
+	}
+
+	text := "⚡ Fastest Servers Today\n\nAverage latency of the background checks over the last 24 hours."
+	var keyboardRows [][]models.InlineKeyboardButton
+	if len(results) > 0 {
+		keyboardRows = tb.quickSelectRows(results, currentServerID)
+	} else {
+		text = "⚡ Fastest Servers Today\n\nNo server answered the background checks in the last 24 hours."
+	}
+	keyboardRows = append(keyboardRows, []models.InlineKeyboardButton{
+		{Text: "🏓 Test Now", CallbackData: "ping_test"},
+		{Text: "🏠 Main Menu", CallbackData: "main_menu"},
+	})
+
+	_ = tb.messageManager.SendOrEdit(ctx, chatID, MessageContent{
+		Text:        text,
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: keyboardRows},
+		Type:        MessageTypePingTest,
+	})
+}
@@ -0,0 +1,265 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// maxScopeCountries limits the country buttons of the ping scope menu
+const maxScopeCountries = 12
+
+// pingScope is the set of servers a ping test runs on
+type pingScope struct {
+	// action is the callback that runs the test again with the same scope
+	action  string
+	title   string
+	servers []types.Server
+}
+
+// handlePingScopeMenu lets the user choose which servers to test before starting,
+// since testing all servers of a large subscription is slow
+func (tb *TelegramBot) handlePingScopeMenu(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
+	tb.logger.Info("Showing ping scope menu to user %d", chatID)
+	tb.answerCallback(ctx, callbackQueryID, "")
+
+	servers := tb.serverMgr.GetServers()
+	favorites := tb.serverMgr.GetFavoriteServers()
+	countries := tb.serverMgr.GetCountries()
+
+	keyboard := [][]models.InlineKeyboardButton{
+		{{Text: fmt.Sprintf("🌐 All Servers (%d)", len(servers)), CallbackData: "ping_scope_all"}},
+	}
+	if len(favorites) > 0 {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: fmt.Sprintf("⭐ Favorites (%d)", len(favorites)), CallbackData: "ping_scope_fav"},
+		})
+	}
+	if len(countries) > maxScopeCountries {
+		countries = countries[:maxScopeCountries]
+	}
+	var row []models.InlineKeyboardButton
+	for _, country := range countries {
+		row = append(row, models.InlineKeyboardButton{
+			Text:         fmt.Sprintf("%s %s (%d)", country.Flag, country.Code, country.Servers),
+			CallbackData: "ping_scope_cc_" + country.Code,
+		})
+		if len(row) == 3 {
+			keyboard = append(keyboard, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		keyboard = append(keyboard, row)
+	}
+	keyboard = append(keyboard, tb.pingProfileRows(chatID)...)
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "🏠 Main Menu", CallbackData: "main_menu"},
+	})
+
+	messageFormatter := NewMessageFormatter()
+	content := MessageContent{
+		Text:        messageFormatter.FormatPingScopeMenu(len(servers), len(favorites), len(countries) > 0, tb.describePingProfile(chatID)),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		Type:        MessageTypePingTest,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send ping scope menu: %v", err)
+	}
+}
+
+// handlePingScopeCallback runs a ping test on the scope of a ping_scope_all,
+// ping_scope_fav, ping_scope_cc_<code>, ping_scope_page_<n> or ping_scope_srv_<id> button
+func (tb *TelegramBot) handlePingScopeCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID, data string) {
+	scope, err := tb.resolvePingScope(data)
+	if err != nil {
+		tb.logger.Warn("Invalid ping scope from user %d: %s (%v)", chatID, data, err)
+		tb.alertCallback(ctx, callbackQueryID, "❌ "+err.Error())
+		return
+	}
+	tb.runPingTest(ctx, b, chatID, callbackQueryID, scope)
+}
+func (tb *TelegramBot) resolvePingScope(data string) (pingScope, error) {
+	scope := pingScope{action: data}
+	name := strings.TrimPrefix(data, "ping_scope_")
+	switch {
+	case name == "all":
+		scope.servers = tb.serverMgr.GetServers()
+	case name == "fav":
+		scope.title = "⭐ Favorites"
+		scope.servers = tb.serverMgr.GetFavoriteServers()
+		if len(scope.servers) == 0 {
+			return scope, fmt.Errorf("no favorite servers, mark them with ⭐ when selecting a server")
+		}
+	case strings.HasPrefix(name, "cc_"):
+		code := strings.TrimPrefix(name, "cc_")
+		scope.title = code
+		for _, country := range tb.serverMgr.GetCountries() {
+			if country.Code == code {
+				scope.title = country.Flag + " " + code
+			}
+		}
+		scope.servers = tb.serverMgr.GetServersByCountry(code)
+		if len(scope.servers) == 0 {
+			return scope, fmt.Errorf("no servers found for %s", code)
+		}
+	case strings.HasPrefix(name, "page_"):
+		var page int
+		if _, err := fmt.Sscanf(name, "page_%d", &page); err != nil {
+			return scope, fmt.Errorf("invalid page number")
+		}
+		servers := tb.serverMgr.GetServers()
+		start := page * serversPerPage
+		if page < 0 || start >= len(servers) {
+			return scope, fmt.Errorf("page is out of range")
+		}
+		end := start + serversPerPage
+		if end > len(servers) {
+			end = len(servers)
+		}
+		scope.title = fmt.Sprintf("📄 Page %d", page+1)
+		scope.servers = servers[start:end]
+	case strings.HasPrefix(name, "srv_"):
+		server, err := tb.serverMgr.GetServerByID(strings.TrimPrefix(name, "srv_"))
+		if err != nil {
+			return scope, fmt.Errorf("server not found")
+		}
+		scope.title = server.Name
+		scope.servers = []types.Server{*server}
+	default:
+		return scope, fmt.Errorf("unknown ping scope")
+	}
+	return scope, nil
+}
+
+// pingProfileStandard is the standard test with ping_mode and ping_timeout, it is
+// used until a chat selects another profile
+const pingProfileStandard = "standard"
+
+// pingProfileLabels are the button labels of the ping profiles
+var pingProfileLabels = map[string]string{
+	pingProfileStandard:        "📶 Standard",
+	config.PingProfileQuick:    "⚡ Quick",
+	config.PingProfileThorough: "🔬 Thorough",
+	config.PingProfileCustom:   "🛠 Custom",
+}
+
+// pingProfileChoices remembers the ping profile each chat selected in the ping menu
+type pingProfileChoices struct {
+	mutex  sync.Mutex
+	byChat map[int64]string
+}
+
+func newPingProfileChoices() *pingProfileChoices {
+	return &pingProfileChoices{byChat: make(map[int64]string)}
+}
+
+func (c *pingProfileChoices) get(chatID int64) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if name, ok := c.byChat[chatID]; ok {
+		return name
+	}
+	return pingProfileStandard
+}
+
+func (c *pingProfileChoices) set(chatID int64, name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if name == pingProfileStandard {
+		delete(c.byChat, chatID)
+		return
+	}
+	c.byChat[chatID] = name
+}
+
+// pingProfile returns the profile selected in chatID, false for the standard test.
+// A custom profile removed from the config falls back to the standard test.
+func (tb *TelegramBot) pingProfile(chatID int64) (string, config.PingProfile, bool) {
+	name := tb.pingProfiles.get(chatID)
+	profile, ok := tb.config.GetPingProfiles().Get(name)
+	if !ok {
+		return pingProfileStandard, config.PingProfile{}, false
+	}
+	return name, profile, true
+}
+
+// pingProfileRows are the buttons selecting the ping profile, the selected one is checked
+func (tb *TelegramBot) pingProfileRows(chatID int64) [][]models.InlineKeyboardButton {
+	selected, _, _ := tb.pingProfile(chatID)
+	var row []models.InlineKeyboardButton
+	for _, name := range append([]string{pingProfileStandard}, tb.config.GetPingProfiles().Names()...) {
+		text := pingProfileLabels[name]
+		if name == selected {
+			text = "✅ " + text
+		}
+		row = append(row, models.InlineKeyboardButton{Text: text, CallbackData: "ping_profile_" + name})
+	}
+	if len(row) > 2 {
+		return [][]models.InlineKeyboardButton{row[:2], row[2:]}
+	}
+	return [][]models.InlineKeyboardButton{row}
+}
+
+// describePingProfile describes the profile selected in chatID for the ping menu
+func (tb *TelegramBot) describePingProfile(chatID int64) string {
+	name, profile, ok := tb.pingProfile(chatID)
+	if !ok {
+		return pingProfileLabels[pingProfileStandard] + " (ping_mode and ping_timeout of the config)"
+	}
+	details := []string{strings.ToUpper(profile.Mode), fmt.Sprintf("%ds timeout", profile.TimeoutSeconds)}
+	if profile.Retries > 0 {
+		details = append(details, fmt.Sprintf("%d retries", profile.Retries))
+	}
+	details = append(details, fmt.Sprintf("%d at once", profile.Concurrency))
+	if profile.MaxServers > 0 {
+		details = append(details, fmt.Sprintf("best %d servers", profile.MaxServers))
+	} else {
+		details = append(details, "all servers")
+	}
+	return fmt.Sprintf("%s (%s)", pingProfileLabels[name], strings.Join(details, ", "))
+}
+
+// handlePingProfileCallback selects the ping profile of a ping_profile_<name> button
+// and shows the ping menu again
+func (tb *TelegramBot) handlePingProfileCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID, name string) {
+	if _, ok := tb.config.GetPingProfiles().Get(name); !ok && name != pingProfileStandard {
+		tb.alertCallback(ctx, callbackQueryID, "❌ Unknown ping profile")
+		return
+	}
+	tb.pingProfiles.set(chatID, name)
+	tb.logger.Info("User %d selected ping profile %s", chatID, name)
+	tb.answerCallback(ctx, callbackQueryID, pingProfileLabels[name]+" profile selected")
+	tb.handlePingScopeMenu(ctx, b, chatID, "")
+}
+
+// handleFavoriteCallback marks or unmarks a server as favorite and shows the server again
+func (tb *TelegramBot) handleFavoriteCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID, serverID string) {
+	favorite, err := tb.serverMgr.ToggleFavorite(serverID)
+	answerText := "☆ Removed from favorites"
+	if favorite {
+		answerText = "⭐ Added to favorites"
+	}
+	if err != nil {
+		tb.logger.Error("Failed to save favorites: %v", err)
+		answerText = "❌ Failed to save favorites"
+	} else {
+		tb.logger.Info("User %d changed favorite server %s: %t", chatID, serverID, favorite)
+	}
+	tb.answerCallback(ctx, callbackQueryID, answerText)
+	tb.handleServerSelectCallback(ctx, b, chatID, "", serverID, tb.newServerSnapshot())
+}
+
+// favoriteButton toggles the favorite mark of a server
+func (tb *TelegramBot) favoriteButton(serverID string) models.InlineKeyboardButton {
+	if tb.serverMgr.IsFavorite(serverID) {
+		return models.InlineKeyboardButton{Text: "★ Unfavorite", CallbackData: callbackServerID("favorite_", serverID)}
+	}
+	return models.InlineKeyboardButton{Text: "⭐ Favorite", CallbackData: callbackServerID("favorite_", serverID)}
+}
@@ -0,0 +1,331 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+	"xray-telegram-manager/audit"
+	"xray-telegram-manager/notifications"
+	"xray-telegram-manager/operations"
+	"xray-telegram-manager/profiles"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	// profileNameFlow is the conversation that asks for the name of a new profile
+	profileNameFlow = "profile_name"
+	// profileRuleFlow is the conversation that asks for a rule of the schedule
+	profileRuleFlow = "profile_rule"
+	// profileCheckInterval is how often the schedule is looked at
+	profileCheckInterval = 30 * time.Second
+	// profileSwitchWait bounds waiting for a running ping test or switch
+	profileSwitchWait = 10 * time.Minute
+)
+
+// profilesPath returns where the profiles are stored, next to the manager config
+func profilesPath(config ConfigProvider) string {
+	configFile := config.GetConfigFilePath()
+	if configFile == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(configFile), "profiles.json")
+}
+
+// registerProfileFlows makes the profile inputs available to the /schedule buttons
+func (tb *TelegramBot) registerProfileFlows() {
+	tb.conversations.RegisterFlow(profileNameFlow, ConversationFlow{
+		Title:  "profile name",
+		Handle: tb.handleProfileNameInput,
+	})
+	tb.conversations.RegisterFlow(profileRuleFlow, ConversationFlow{
+		Title:  "schedule rule",
+		Handle: tb.handleProfileRuleInput,
+	})
+}
+
+// handleSchedule shows the profiles and the schedule applying them
+func (tb *TelegramBot) handleSchedule(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	tb.logger.Info("Received /schedule command from user %d (%s)", userID, username)
+
+	if !tb.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionAdmin) {
+		tb.logger.Warn("Unauthorized access attempt from user %d (%s) for /schedule command", userID, username)
+		tb.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/schedule")
+		return
+	}
+
+	if err := tb.messageManager.SendNew(ctx, update.Message.Chat.ID, tb.profilesContent("")); err != nil {
+		tb.logger.Error("Failed to send profiles: %v", err)
+	}
+}
+
+// handleProfilesCallback handles the profiles_ buttons of the /schedule menu
+func (tb *TelegramBot) handleProfilesCallback(ctx context.Context, b *bot.Bot, chatID, userID int64, callbackQueryID, data string) {
+	notice := ""
+	switch {
+	case data == "profiles_save":
+		current := tb.serverMgr.GetCurrentServer()
+		if current == nil {
+			tb.alertCallback(ctx, callbackQueryID, "❌ No active server to save")
+			return
+		}
+		if current.Blocked() {
+			tb.alertCallback(ctx, callbackQueryID, "⛔ The server is in a blocked country, the schedule never switches to it")
+			return
+		}
+		tb.startProfileInput(ctx, chatID, userID, callbackQueryID, profileNameFlow, NewMessageFormatter().FormatProfileNamePrompt(current.Name))
+		return
+	case data == "profiles_rule":
+		if len(tb.profiles.Profiles()) == 0 {
+			tb.alertCallback(ctx, callbackQueryID, "❌ Save a profile first")
+			return
+		}
+		tb.startProfileInput(ctx, chatID, userID, callbackQueryID, profileRuleFlow, NewMessageFormatter().FormatProfileRulePrompt(tb.profiles.Profiles()))
+		return
+	case data == "profiles_back":
+		tb.conversations.Cancel(chatID)
+		tb.answerCallback(ctx, callbackQueryID, "")
+	case strings.HasPrefix(data, "profiles_delete_"):
+		profile, found, err := tb.profiles.RemoveProfile(strings.TrimPrefix(data, "profiles_delete_"))
+		if !tb.answerProfileChange(ctx, callbackQueryID, found, err, "🗑 Profile deleted") {
+			return
+		}
+		if found {
+			tb.logger.Info("User %d deleted profile %s", userID, profile.Name)
+			notice = fmt.Sprintf("🗑 Profile %s and its times deleted", profile.Name)
+		}
+	case strings.HasPrefix(data, "profiles_toggle_"):
+		enabled, found, err := tb.profiles.ToggleRule(strings.TrimPrefix(data, "profiles_toggle_"))
+		answer := "⏸ Paused"
+		if enabled {
+			answer = "▶️ Resumed"
+		}
+		if !tb.answerProfileChange(ctx, callbackQueryID, found, err, answer) {
+			return
+		}
+	case strings.HasPrefix(data, "profiles_delrule_"):
+		found, err := tb.profiles.RemoveRule(strings.TrimPrefix(data, "profiles_delrule_"))
+		if !tb.answerProfileChange(ctx, callbackQueryID, found, err, "🗑 Time deleted") {
+			return
+		}
+	default:
+		tb.answerCallback(ctx, callbackQueryID, "")
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, tb.profilesContent(notice)); err != nil {
+		tb.logger.Error("Failed to update profiles: %v", err)
+	}
+}
+
+// answerProfileChange answers a button that changed the profiles. It returns false
+// when saving failed and the menu should not be redrawn.
+func (tb *TelegramBot) answerProfileChange(ctx context.Context, callbackQueryID string, found bool, err error, answer string) bool {
+	switch {
+	case err != nil:
+		tb.logger.Error("Failed to save profiles: %v", err)
+		tb.alertCallback(ctx, callbackQueryID, "❌ Failed to save the schedule")
+		return false
+	case !found:
+		tb.answerCallback(ctx, callbackQueryID, "ℹ️ Already deleted")
+	default:
+		tb.answerCallback(ctx, callbackQueryID, answer)
+	}
+	return true
+}
+
+// startProfileInput starts a profile conversation and shows its prompt
+func (tb *TelegramBot) startProfileInput(ctx context.Context, chatID, userID int64, callbackQueryID, flow, prompt string) {
+	if err := tb.conversations.Start(chatID, userID, flow, flow); err != nil {
+		tb.logger.Error("Failed to start %s input for user %d: %v", flow, userID, err)
+		return
+	}
+	tb.answerCallback(ctx, callbackQueryID, "")
+
+	content := MessageContent{
+		Text: prompt,
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: "⬅️ Back", CallbackData: "profiles_back"}},
+		}},
+		Type: MessageTypeStatus,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send %s prompt: %v", flow, err)
+	}
+}
+
+// handleProfileNameInput saves the active server as a profile with the name sent by
+// the user
+func (tb *TelegramBot) handleProfileNameInput(ctx context.Context, b *bot.Bot, update *models.Update, conv *Conversation) string {
+	current := tb.serverMgr.GetCurrentServer()
+	if current == nil {
+		tb.sendProfileInputError(ctx, conv.ChatID, fmt.Errorf("no active server to save"), "Choose a server in /list first.")
+		return ""
+	}
+	if current.Blocked() {
+		err := tb.messageManager.SendNew(ctx, conv.ChatID, MessageContent{
+			Text: fmt.Sprintf("⛔ %s\n\nThe schedule never switches to it, choose another server in /list first.", errBlockedTarget(current)),
+			Type: MessageTypeStatus,
+		})
+		if err != nil {
+			tb.logger.Error("Failed to send profile input error: %v", err)
+		}
+		return ""
+	}
+	profile, err := tb.profiles.SaveProfile(update.Message.Text, current.ID, current.Name)
+	if err != nil {
+		tb.logger.Warn("Rejected profile name from user %d: %v", conv.UserID, err)
+		tb.sendProfileInputError(ctx, conv.ChatID, err, "Send another name, or /cancel.")
+		return conv.Step
+	}
+	tb.logger.Info("User %d saved profile %s for %s", conv.UserID, profile.Name, current.Name)
+	tb.sendProfilesAfterInput(ctx, conv.ChatID, fmt.Sprintf("✅ Profile %s saved for %s", profile.Name, current.Name))
+	return ""
+}
+
+// handleProfileRuleInput adds the rule sent by the user, e.g. "Work 09:00 weekdays"
+func (tb *TelegramBot) handleProfileRuleInput(ctx context.Context, b *bot.Bot, update *models.Update, conv *Conversation) string {
+	rule, profile, err := tb.profiles.AddRule(update.Message.Text)
+	if err != nil {
+		tb.logger.Warn("Rejected schedule rule from user %d: %v", conv.UserID, err)
+		tb.sendProfileInputError(ctx, conv.ChatID, err, "Send a rule like Work 09:00 weekdays, or /cancel.")
+		return conv.Step
+	}
+	tb.logger.Info("User %d scheduled profile %s at %s %s", conv.UserID, profile.Name, rule.At, rule.Days)
+	tb.sendProfilesAfterInput(ctx, conv.ChatID, fmt.Sprintf("✅ %s will be applied at %s, %s", profile.Name, rule.At, rule.Days))
+	return ""
+}
+
+func (tb *TelegramBot) sendProfileInputError(ctx context.Context, chatID int64, err error, hint string) {
+	err = tb.messageManager.SendNew(ctx, chatID, MessageContent{
+		Text: fmt.Sprintf("❌ %s\n\n%s", toTitle(err.Error()), hint),
+		Type: MessageTypeStatus,
+	})
+	if err != nil {
+		tb.logger.Error("Failed to send profile input error: %v", err)
+	}
+}
+
+// sendProfilesAfterInput sends the menu as a new message below the input of the user
+func (tb *TelegramBot) sendProfilesAfterInput(ctx context.Context, chatID int64, notice string) {
+	tb.messageManager.ForceCleanupUser(chatID, "profiles changed")
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, tb.profilesContent(notice)); err != nil {
+		tb.logger.Error("Failed to send profiles: %v", err)
+	}
+}
+
+// profilesContent is the /schedule menu. A profile button opens its server, where
+// it can be switched to by hand.
+func (tb *TelegramBot) profilesContent(notice string) MessageContent {
+	var keyboard [][]models.InlineKeyboardButton
+	for _, profile := range tb.profiles.Profiles() {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: tb.buttonTextProcessor.ProcessServerButtonText(profile.ServerName, "🗂 "+profile.Name+" →", 50), CallbackData: tb.serverCallback("server_", profile.ServerID)},
+			{Text: "🗑", CallbackData: "profiles_delete_" + profile.ID},
+		})
+	}
+	for _, rule := range tb.profiles.Rules() {
+		profile, _ := tb.profiles.Profile(rule.ProfileID)
+		state := "⏸"
+		if rule.Enabled {
+			state = "▶️"
+		}
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: fmt.Sprintf("%s %s %s", state, rule.At, profile.Name), CallbackData: "profiles_toggle_" + rule.ID},
+			{Text: "🗑", CallbackData: "profiles_delrule_" + rule.ID},
+		})
+	}
+	keyboard = append(keyboard,
+		[]models.InlineKeyboardButton{
+			{Text: "💾 Save Current", CallbackData: "profiles_save"},
+			{Text: "➕ Add Time", CallbackData: "profiles_rule"},
+		},
+		[]models.InlineKeyboardButton{
+			{Text: "🔄 Refresh", CallbackData: "profiles_menu"},
+			{Text: "🏠 Main Menu", CallbackData: "main_menu"},
+		},
+	)
+	return MessageContent{
+		Text:        NewMessageFormatter().FormatProfileSchedule(tb.profiles, tb.serverMgr.GetCurrentServer(), tb.clock.Now(), notice),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		Type:        MessageTypeStatus,
+	}
+}
+
+// runProfileSchedule applies the profile whose time came. A server chosen by hand
+// since the previous time is replaced only now, at the next time of the schedule.
+func (tb *TelegramBot) runProfileSchedule(ctx context.Context) {
+	rule, at, due, err := tb.profiles.Due(tb.clock.Now())
+	if err != nil {
+		tb.logger.Error("Failed to save profiles: %v", err)
+	}
+	if !due {
+		return
+	}
+	profile, ok := tb.profiles.Profile(rule.ProfileID)
+	if !ok {
+		return
+	}
+	formatter := NewMessageFormatter()
+	if current := tb.serverMgr.GetCurrentServer(); current != nil && current.ID == profile.ServerID {
+		tb.logger.Info("Profile %s due at %s is already active", profile.Name, rule.At)
+		tb.setAppliedProfile(profile, at)
+		return
+	}
+	if err := tb.switchToProfile(ctx, profile); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		tb.logger.Error("Profile %s could not be applied: %v", profile.Name, err)
+		tb.Notify(ctx, notifications.EventAutoSwitch, formatter.FormatProfileSwitchFailed(profile, rule, err))
+		return
+	}
+	tb.setAppliedProfile(profile, at)
+	tb.Notify(ctx, notifications.EventAutoSwitch, formatter.FormatProfileSwitchDone(profile, rule))
+}
+
+// errBlockedTarget is why a switch nobody confirms skips a server in a blocked
+// country, the same as backup servers and quick select do
+func errBlockedTarget(server *types.Server) error {
+	return fmt.Errorf("%s exits in %s, which is in blocked_countries", server.Name, server.BlockedCountry)
+}
+
+// switchToProfile switches to the server of the profile. A running ping test or
+// switch is waited for instead of skipping the time.
+func (tb *TelegramBot) switchToProfile(ctx context.Context, profile profiles.Profile) error {
+	target := tb.findServer(profile.ServerID)
+	if target == nil {
+		return fmt.Errorf("%s is no longer in the subscription", profile.ServerName)
+	}
+	if target.Blocked() {
+		return errBlockedTarget(target)
+	}
+
+	adminID := tb.config.GetAdminID()
+	waitCtx, cancel := context.WithTimeout(ctx, profileSwitchWait)
+	defer cancel()
+	_, release, err := tb.serverMgr.Operations().Acquire(waitCtx, operations.OperationSwitch, adminID, operations.PolicyQueue)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tb.logger.Info("Applying profile %s, switching to %s", profile.Name, target.Name)
+	if err := tb.serverMgr.SwitchServer(ctx, target.ID); err != nil {
+		return err
+	}
+	tb.listCache.invalidate()
+	initiator := &models.User{ID: adminID, FirstName: "Schedule"}
+	tb.recordSwitch(ctx, adminID, initiator, target.Name, audit.ReasonProfile)
+	return nil
+}
+
+func (tb *TelegramBot) setAppliedProfile(profile profiles.Profile, at time.Time) {
+	if err := tb.profiles.SetApplied(profile.ID, at); err != nil {
+		tb.logger.Error("Failed to save applied profile %s: %v", profile.Name, err)
+	}
+}
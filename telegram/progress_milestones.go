@@ -0,0 +1,55 @@
+package telegram
+
+import (
+	"sync"
+	"xray-telegram-manager/config"
+)
+
+// progressMilestones picks the progress updates of a long operation worth an edit:
+// one each time another progress_percent_step percent or progress_server_step servers
+// were completed. Updates arriving while the previous edit is in flight are dropped,
+// so workers reporting in parallel never edit the message at the same time. The last
+// update is left out, the results replace the progress in one final edit.
+type progressMilestones struct {
+	percentStep int
+	serverStep  int
+
+	mutex    sync.Mutex
+	lastSent int
+	sending  bool
+}
+
+func newProgressMilestones(ui config.UIConfig) *progressMilestones {
+	return &progressMilestones{percentStep: ui.ProgressPercentStep, serverStep: ui.ProgressServerStep}
+}
+
+// begin reports whether the update of completed out of total should be sent. Every
+// begin that returned true must be followed by end once the edit finished.
+func (p *progressMilestones) begin(completed, total int) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.sending || completed >= total || completed <= p.lastSent || !p.reachedUnsafe(completed, total) {
+		return false
+	}
+	p.sending = true
+	p.lastSent = completed
+	return true
+}
+
+// end allows the next milestone to be sent
+func (p *progressMilestones) end() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.sending = false
+}
+
+// reachedUnsafe reports whether completed passed a milestone since the last update
+func (p *progressMilestones) reachedUnsafe(completed, total int) bool {
+	if p.percentStep <= 0 && p.serverStep <= 0 {
+		return true
+	}
+	if p.percentStep > 0 && completed*100/total/p.percentStep > p.lastSent*100/total/p.percentStep {
+		return true
+	}
+	return p.serverStep > 0 && completed-p.lastSent >= p.serverStep
+}
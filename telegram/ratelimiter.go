@@ -2,33 +2,78 @@ package telegram
 
 import (
 	"context"
+	"strings"
 	"sync"
 	"time"
+	"xray-telegram-manager/clock"
+	"xray-telegram-manager/config"
 )
 
+const (
+	// commandRateLimit and callbackRateLimit are the commands and button presses a
+	// user may send per rateWindow. Moving through menus takes many quick presses.
+	commandRateLimit  = 10
+	callbackRateLimit = 60
+	rateWindow        = time.Minute
+	// adminLimitFactor multiplies the budgets of group members with the admin role
+	adminLimitFactor = 3
+)
+
+// RequestKind separates typed commands from button presses, each has its own budget
+type RequestKind int
+
+const (
+	RequestCommand RequestKind = iota
+	RequestCallback
+)
+
+// rateKey counts the requests of one kind of a user
+type rateKey struct {
+	userID int64
+	kind   RequestKind
+}
+
 type RateLimiter struct {
-	requests map[int64][]time.Time
+	requests map[rateKey][]time.Time
 	mutex    sync.RWMutex
-	limit    int
+	limits   map[RequestKind]int
 	window   time.Duration
+	clock    clock.Clock
 }
 
-func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+// NewRateLimiter allows each user commandLimit commands and callbackLimit button
+// presses per window
+func NewRateLimiter(commandLimit, callbackLimit int, window time.Duration) *RateLimiter {
 	return &RateLimiter{
-		requests: make(map[int64][]time.Time),
+		requests: make(map[rateKey][]time.Time),
 		mutex:    sync.RWMutex{},
-		limit:    limit,
+		limits:   map[RequestKind]int{RequestCommand: commandLimit, RequestCallback: callbackLimit},
 		window:   window,
+		clock:    clock.Real,
 	}
 }
 
-func (rl *RateLimiter) IsAllowed(userID int64) bool {
+// SetClock replaces the clock of the rate limiter, for tests
+func (rl *RateLimiter) SetClock(c clock.Clock) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.clock = c
+}
+
+// IsAllowed records a request of kind from userID acting with role and reports
+// whether it is within the budget. Admins get adminLimitFactor times the budget.
+func (rl *RateLimiter) IsAllowed(userID int64, kind RequestKind, role string) bool {
 	rl.mutex.Lock()
 	defer rl.mutex.Unlock()
 
-	now := time.Now()
+	now := rl.clock.Now()
+	limit := rl.limits[kind]
+	if role == config.RoleAdmin {
+		limit *= adminLimitFactor
+	}
 
-	userRequests := rl.requests[userID]
+	key := rateKey{userID: userID, kind: kind}
+	userRequests := rl.requests[key]
 
 	var validRequests []time.Time
 	for _, reqTime := range userRequests {
@@ -37,12 +82,12 @@ func (rl *RateLimiter) IsAllowed(userID int64) bool {
 		}
 	}
 
-	if len(validRequests) >= rl.limit {
+	if len(validRequests) >= limit {
 		return false
 	}
 
 	validRequests = append(validRequests, now)
-	rl.requests[userID] = validRequests
+	rl.requests[key] = validRequests
 
 	return true
 }
@@ -51,8 +96,8 @@ func (rl *RateLimiter) Cleanup() {
 	rl.mutex.Lock()
 	defer rl.mutex.Unlock()
 
-	now := time.Now()
-	for userID, requests := range rl.requests {
+	now := rl.clock.Now()
+	for key, requests := range rl.requests {
 		var validRequests []time.Time
 		for _, reqTime := range requests {
 			if now.Sub(reqTime) < rl.window {
@@ -61,23 +106,45 @@ func (rl *RateLimiter) Cleanup() {
 		}
 
 		if len(validRequests) == 0 {
-			delete(rl.requests, userID)
+			delete(rl.requests, key)
 		} else {
-			rl.requests[userID] = validRequests
+			rl.requests[key] = validRequests
 		}
 	}
 }
 
 func (rl *RateLimiter) StartCleanupRoutine(ctx context.Context) {
-	ticker := time.NewTicker(rl.window)
+	ticker := rl.clock.NewTicker(rl.window)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-ticker.C():
 			rl.Cleanup()
 		}
 	}
 }
+
+// isRecoveryCallback reports whether data is a button leading out of a failure or a
+// stuck screen: back to the menu, cancel, config recovery, the panic button or the
+// status of a failed update. They are never rate limited.
+func isRecoveryCallback(data string) bool {
+	switch {
+	case data == "main_menu", data == "noop", data == "update_status", data == "restore_cancel", data == "update_script_cancel",
+		strings.HasPrefix(data, "recover_"), strings.HasPrefix(data, "panic_"):
+		return true
+	}
+	return false
+}
+
+// allowRequest reports whether a request of kind from userID in chatID is within the
+// rate limit. The owner from admin_id is never limited, so quick clicking cannot lock
+// them out of the bot.
+func (tb *TelegramBot) allowRequest(ctx context.Context, chatID, userID int64, kind RequestKind) bool {
+	if userID == tb.config.GetAdminID() {
+		return true
+	}
+	return tb.rateLimiter.IsAllowed(userID, kind, tb.userRole(ctx, chatID, userID))
+}
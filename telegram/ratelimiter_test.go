@@ -0,0 +1,178 @@
+package telegram
+
+import (
+	"context"
+	"testing"
+	"time"
+	"xray-telegram-manager/clock"
+	"xray-telegram-manager/config"
+)
+
+const (
+	testAdminID    = 1
+	testGroupID    = -100
+	testViewer     = 10
+	testOperator   = 11
+	testGroupAdmin = 12
+)
+
+// rateConfig is a ConfigProvider with a group of a viewer, an operator and an admin
+type rateConfig struct {
+	ConfigProvider
+}
+
+func (rateConfig) GetAdminID() int64 { return testAdminID }
+
+func (rateConfig) GetGroupConfig() config.GroupConfig {
+	return config.GroupConfig{
+		AllowedChatIDs: []int64{testGroupID},
+		Roles: map[int64]string{
+			testViewer:     config.RoleViewer,
+			testOperator:   config.RoleOperator,
+			testGroupAdmin: config.RoleAdmin,
+		},
+	}
+}
+
+func newRateLimitedBot(fake *clock.Fake) *TelegramBot {
+	rateLimiter := NewRateLimiter(2, 4, time.Minute)
+	rateLimiter.SetClock(fake)
+	return &TelegramBot{config: rateConfig{}, rateLimiter: rateLimiter}
+}
+
+func TestAllowRequest(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		userID int64
+		kind   RequestKind
+		budget int
+	}{
+		{"viewer commands", testViewer, RequestCommand, 2},
+		{"viewer button presses", testViewer, RequestCallback, 4},
+		{"operator commands", testOperator, RequestCommand, 2},
+		{"operator button presses", testOperator, RequestCallback, 4},
+		{"group admin commands", testGroupAdmin, RequestCommand, 2 * adminLimitFactor},
+		{"group admin button presses", testGroupAdmin, RequestCallback, 4 * adminLimitFactor},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+			tb := newRateLimitedBot(fake)
+			ctx := context.Background()
+
+			for i := 0; i < test.budget; i++ {
+				if !tb.allowRequest(ctx, testGroupID, test.userID, test.kind) {
+					t.Fatalf("Expected request %d of %d to be allowed", i+1, test.budget)
+				}
+			}
+			if tb.allowRequest(ctx, testGroupID, test.userID, test.kind) {
+				t.Fatal("Expected the request over the budget to be rejected")
+			}
+
+			// The other kind has its own budget
+			other := RequestCallback
+			if test.kind == RequestCallback {
+				other = RequestCommand
+			}
+			if !tb.allowRequest(ctx, testGroupID, test.userID, other) {
+				t.Error("Expected the other kind of request to be allowed")
+			}
+
+			// Requests leave the window one by one
+			fake.Advance(time.Minute - time.Second)
+			if tb.allowRequest(ctx, testGroupID, test.userID, test.kind) {
+				t.Error("Expected the budget to stay exhausted within the window")
+			}
+			fake.Advance(time.Second)
+			for i := 0; i < test.budget; i++ {
+				if !tb.allowRequest(ctx, testGroupID, test.userID, test.kind) {
+					t.Fatalf("Expected request %d to be allowed after the window", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowRequestOwner(t *testing.T) {
+	tb := newRateLimitedBot(clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)))
+	for i := 0; i < 100; i++ {
+		if !tb.allowRequest(context.Background(), testAdminID, testAdminID, RequestCommand) {
+			t.Fatalf("Expected admin_id never to be limited, rejected request %d", i+1)
+		}
+	}
+}
+
+func TestRecoveryCallbacksBypassLimit(t *testing.T) {
+	tb := newRateLimitedBot(clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)))
+	for tb.allowRequest(context.Background(), testGroupID, testViewer, RequestCallback) {
+	}
+
+	for data, recovery := range map[string]bool{
+		"main_menu":            true,
+		"noop":                 true,
+		"update_status":        true,
+		"restore_cancel":       true,
+		"update_script_cancel": true,
+		"recover_backup":       true,
+		"panic_confirm":        true,
+		"refresh":              false,
+		"server_abc":           false,
+		"restore_confirm":      false,
+	} {
+		if isRecoveryCallback(data) != recovery {
+			t.Errorf("Expected isRecoveryCallback(%q) to be %t", data, recovery)
+		}
+		// handleCallback only asks the limiter for buttons that are not for recovery
+		passes := isRecoveryCallback(data) || tb.allowRequest(context.Background(), testGroupID, testViewer, RequestCallback)
+		if passes != recovery {
+			t.Errorf("Expected %q to pass the exhausted budget: %t", data, recovery)
+		}
+	}
+}
+
+func TestRateLimiterCleanup(t *testing.T) {
+	fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	rl := NewRateLimiter(1, 1, time.Minute)
+	rl.SetClock(fake)
+
+	rl.IsAllowed(testViewer, RequestCommand, config.RoleViewer)
+	fake.Advance(30 * time.Second)
+	rl.IsAllowed(testOperator, RequestCommand, config.RoleOperator)
+
+	fake.Advance(30 * time.Second)
+	rl.Cleanup()
+	if len(rl.requests) != 1 {
+		t.Fatalf("Expected only the requests within the window to be kept, got %d users", len(rl.requests))
+	}
+	if !rl.IsAllowed(testViewer, RequestCommand, config.RoleViewer) || rl.IsAllowed(testOperator, RequestCommand, config.RoleOperator) {
+		t.Error("Expected the viewer to have a new budget and the operator none")
+	}
+}
+
+func TestRateLimiterCleanupRoutine(t *testing.T) {
+	fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	rl := NewRateLimiter(1, 1, time.Minute)
+	rl.SetClock(fake)
+	rl.IsAllowed(testViewer, RequestCallback, config.RoleViewer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rl.StartCleanupRoutine(ctx)
+	if !fake.WaitForTimers(1) {
+		t.Fatal("Expected the cleanup routine to start its ticker")
+	}
+	fake.Advance(time.Minute)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		rl.mutex.RLock()
+		left := len(rl.requests)
+		rl.mutex.RUnlock()
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the tick to remove the expired requests")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
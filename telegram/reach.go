@@ -0,0 +1,219 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"xray-telegram-manager/operations"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	// reachDomainFlow is the conversation that asks for the site to open through a server
+	reachDomainFlow = "reach_domain"
+	// reachTimeout bounds starting the temporary xray and both requests through it
+	reachTimeout = 45 * time.Second
+)
+
+// reachPresets are offered as buttons so common services need no typing
+var reachPresets = []string{"netflix.com", "youtube.com", "chatgpt.com", "instagram.com"}
+
+// reachTarget is the server and the last site a chat checked
+type reachTarget struct {
+	serverID string
+	domain   string
+}
+
+// reachTargets remember the server a chat is checking, a server ID and a domain do
+// not fit into the callback data of a button together
+type reachTargets struct {
+	mutex  sync.Mutex
+	byChat map[int64]reachTarget
+}
+
+func newReachTargets() *reachTargets {
+	return &reachTargets{byChat: make(map[int64]reachTarget)}
+}
+
+func (r *reachTargets) get(chatID int64) reachTarget {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.byChat[chatID]
+}
+
+func (r *reachTargets) set(chatID int64, target reachTarget) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.byChat[chatID] = target
+}
+
+// registerReachFlow makes the site input available to the reach buttons
+func (tb *TelegramBot) registerReachFlow() {
+	tb.conversations.RegisterFlow(reachDomainFlow, ConversationFlow{
+		Title:  "site check",
+		Handle: tb.handleReachInput,
+	})
+}
+
+// reachButton asks which site to open through a server
+func (tb *TelegramBot) reachButton(serverID string) models.InlineKeyboardButton {
+	return models.InlineKeyboardButton{Text: "🔎 Can It Reach?", CallbackData: callbackServerID("reach_", serverID)}
+}
+
+// handleReachCallback handles reach_<id>, reach_site_<n> and reach_again buttons
+func (tb *TelegramBot) handleReachCallback(ctx context.Context, b *bot.Bot, chatID, userID int64, callbackQueryID, data string) {
+	switch {
+	case strings.HasPrefix(data, "reach_site_"):
+		var index int
+		if _, err := fmt.Sscanf(data, "reach_site_%d", &index); err != nil || index < 0 || index >= len(reachPresets) {
+			tb.logger.Error("Invalid site in reach callback: %s", data)
+			tb.answerCallback(ctx, callbackQueryID, "❌ Invalid site")
+			return
+		}
+		tb.conversations.Cancel(chatID)
+		tb.runReachTest(ctx, chatID, callbackQueryID, tb.reachTargets.get(chatID).serverID, reachPresets[index])
+	case data == "reach_again":
+		target := tb.reachTargets.get(chatID)
+		tb.runReachTest(ctx, chatID, callbackQueryID, target.serverID, target.domain)
+	default:
+		tb.showReachPrompt(ctx, chatID, userID, callbackQueryID, strings.TrimPrefix(data, "reach_"))
+	}
+}
+
+// showReachPrompt asks for the site to open through a server
+func (tb *TelegramBot) showReachPrompt(ctx context.Context, chatID, userID int64, callbackQueryID, serverID string) {
+	selected := tb.findServer(serverID)
+	if selected == nil {
+		tb.alertCallback(ctx, callbackQueryID, "❌ Server not found")
+		return
+	}
+	if err := tb.conversations.Start(chatID, userID, reachDomainFlow, serverID); err != nil {
+		tb.logger.Error("Failed to start site input for user %d: %v", userID, err)
+		return
+	}
+	tb.reachTargets.set(chatID, reachTarget{serverID: serverID})
+	tb.answerCallback(ctx, callbackQueryID, "")
+
+	var keyboard [][]models.InlineKeyboardButton
+	for i := 0; i < len(reachPresets); i += 2 {
+		row := []models.InlineKeyboardButton{}
+		for j := i; j < i+2 && j < len(reachPresets); j++ {
+			row = append(row, models.InlineKeyboardButton{Text: reachPresets[j], CallbackData: fmt.Sprintf("reach_site_%d", j)})
+		}
+		keyboard = append(keyboard, row)
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{{Text: "⬅️ Back", CallbackData: tb.serverCallback("server_", serverID)}})
+
+	content := MessageContent{
+		Text:        NewMessageFormatter().FormatReachPrompt(selected.Name),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		Type:        MessageTypeStatus,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send site prompt: %v", err)
+	}
+}
+
+// handleReachInput checks the site sent by the user. The step of the conversation is
+// the server ID.
+func (tb *TelegramBot) handleReachInput(ctx context.Context, b *bot.Bot, update *models.Update, conv *Conversation) string {
+	// The result is sent as a new message below the input of the user
+	tb.messageManager.ForceCleanupUser(conv.ChatID, "site entered")
+	tb.runReachTest(ctx, conv.ChatID, "", conv.Step, strings.TrimSpace(update.Message.Text))
+	return ""
+}
+
+// runReachTest opens the site through the server and shows the result with a button
+// to switch to the server when the site answered
+func (tb *TelegramBot) runReachTest(ctx context.Context, chatID int64, callbackQueryID, serverID, domain string) {
+	selected := tb.findServer(serverID)
+	if selected == nil || domain == "" {
+		tb.answerCallback(ctx, callbackQueryID, "")
+		tb.sendReachExpired(ctx, chatID)
+		return
+	}
+	op, release, ok := tb.beginOperation(ctx, chatID, callbackQueryID, operations.OperationReachTest)
+	if !ok {
+		return
+	}
+	defer release()
+
+	tb.reachTargets.set(chatID, reachTarget{serverID: serverID, domain: domain})
+	tb.answerCallback(ctx, callbackQueryID, "🔎 Checking...")
+	loadingContent := MessageContent{
+		Text:        fmt.Sprintf("🔎 Opening %s through %s...\n⏳ Starting a temporary connection, please wait...", domain, selected.Name),
+		ReplyMarkup: tb.createEmptyKeyboard(),
+		Type:        MessageTypeStatus,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, loadingContent); err != nil {
+		tb.logger.Error("Failed to send site check progress: %v", err)
+		return
+	}
+	tb.trackOperationMessage(op, chatID, MessageTypeStatus)
+
+	probeCtx, cancel := context.WithTimeout(ctx, reachTimeout)
+	defer cancel()
+	result, err := tb.serverMgr.ProbeDomain(probeCtx, serverID, domain)
+	if err != nil {
+		tb.logger.Error("Failed to check %s through server %s: %v", domain, serverID, err)
+		messageFormatter := NewMessageFormatter()
+		errorContent := MessageContent{
+			Text: messageFormatter.FormatErrorMessage("Site Check Failed", err.Error(), messageFormatter.ErrorSuggestions(err, []string{
+				"Check the spelling of the site, e.g. netflix.com",
+				"Make sure the xray binary is installed",
+			})),
+			ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+				{{Text: "🌐 Other Site", CallbackData: callbackServerID("reach_", serverID)}},
+				{{Text: "⬅️ Back", CallbackData: tb.serverCallback("server_", serverID)}},
+			}},
+			Type: MessageTypeStatus,
+		}
+		_ = tb.messageManager.SendOrEdit(ctx, chatID, errorContent)
+		return
+	}
+	tb.reachTargets.set(chatID, reachTarget{serverID: serverID, domain: result.Domain})
+
+	var keyboard [][]models.InlineKeyboardButton
+	current := tb.serverMgr.GetCurrentServer()
+	if result.Reached() && (current == nil || current.ID != serverID) {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{{
+			Text:         tb.buttonTextProcessor.ProcessServerButtonText(selected.Name, "🔀 Switch to", 50),
+			CallbackData: tb.serverCallback("server_", serverID),
+		}})
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "🔁 Check Again", CallbackData: "reach_again"},
+		{Text: "🌐 Other Site", CallbackData: callbackServerID("reach_", serverID)},
+	}, []models.InlineKeyboardButton{
+		{Text: "⬅️ Back", CallbackData: tb.serverCallback("server_", serverID)},
+		{Text: "🏠 Main Menu", CallbackData: "main_menu"},
+	})
+
+	content := MessageContent{
+		Text:        NewMessageFormatter().FormatReachResult(result),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		Type:        MessageTypeStatus,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send site check result: %v", err)
+	}
+}
+
+// sendReachExpired tells that the server of the site check is no longer known, after
+// a restart or a subscription refresh
+func (tb *TelegramBot) sendReachExpired(ctx context.Context, chatID int64) {
+	content := MessageContent{
+		Text: "🔎 The site check has expired.\n\n💡 Open a server from /list and press 🔎 Can It Reach? to start again.",
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: "🏠 Main Menu", CallbackData: "main_menu"}},
+		}},
+		Type: MessageTypeStatus,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send site check expired message: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package telegram
+
+import (
+	"context"
+	"strings"
+	"xray-telegram-manager/audit"
+	"xray-telegram-manager/operations"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// PromptConfigRecovery tells the admin the xray config is corrupted and offers to
+// restore it from the latest valid backup or the golden snapshot. It bypasses the
+// notification preferences because xray cannot work until the config is fixed.
+func (tb *TelegramBot) PromptConfigRecovery(ctx context.Context, problem string) {
+	info := tb.serverMgr.GetConfigRecoveryInfo()
+	messageFormatter := NewMessageFormatter()
+
+	adminID := tb.config.GetAdminID()
+	_, err := tb.bot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          adminID,
+		MessageThreadID: tb.topicFor(adminID, MessageTypeAlert),
+		Text:            messageFormatter.FormatConfigCorrupted(problem, info),
+		ReplyMarkup:     recoveryKeyboard(info),
+	})
+	if err != nil {
+		tb.logger.Error("Failed to send config recovery prompt: %v", err)
+		return
+	}
+	tb.logger.Info("Sent config recovery prompt to admin %d", adminID)
+}
+
+// handleRecoveryCallback handles the recover_backup and recover_golden buttons, the
+// server of the recovered config is recorded as active by a rollback
+func (tb *TelegramBot) handleRecoveryCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID, data string, initiator *models.User) {
+	source := strings.TrimPrefix(data, "recover_")
+	if source != types.ConfigRecoveryBackup && source != types.ConfigRecoveryGolden {
+		tb.logger.Warn("Unknown recovery callback from user %d: %s", chatID, data)
+		tb.answerCallback(ctx, callbackQueryID, "❌ Unknown recovery source")
+		return
+	}
+	tb.logger.Info("Processing config recovery from %s for user %d", source, chatID)
+
+	_, release, ok := tb.beginOperation(ctx, chatID, callbackQueryID, operations.OperationRecover)
+	if !ok {
+		return
+	}
+	defer release()
+
+	tb.answerCallback(ctx, callbackQueryID, "🛠 Recovering xray config...")
+
+	if err := tb.serverMgr.RecoverXrayConfig(source); err != nil {
+		tb.logger.Error("Failed to recover xray config from %s for user %d: %v", source, chatID, err)
+		tb.messageManager.ForceCleanupUser(chatID, "config recovery failed")
+		tb.sendErrorMessage(ctx, b, chatID, "Failed to Recover Config", err.Error(), data)
+		return
+	}
+
+	current := tb.serverMgr.GetCurrentServer()
+	if current != nil {
+		tb.recordSwitch(ctx, chatID, initiator, current.Name, audit.ReasonRollback)
+	}
+
+	messageFormatter := NewMessageFormatter()
+	navigationHelper := NewNavigationHelper()
+	content := MessageContent{
+		Text:        messageFormatter.FormatConfigRecovered(source, current),
+		ReplyMarkup: navigationHelper.CreateServerStatusNavigationKeyboard(true),
+		Type:        MessageTypeStatus,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send config recovery result: %v", err)
+	} else {
+		tb.logger.Info("Xray config recovered from %s for user %d", source, chatID)
+	}
+}
+
+// recoveryKeyboard offers the available recovery sources
+func recoveryKeyboard(info types.ConfigRecoveryInfo) *models.InlineKeyboardMarkup {
+	var keyboard [][]models.InlineKeyboardButton
+	if !info.BackupTime.IsZero() {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: "♻️ Restore latest backup", CallbackData: "recover_" + types.ConfigRecoveryBackup},
+		})
+	}
+	if !info.GoldenTime.IsZero() {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: "🏅 Restore golden config", CallbackData: "recover_" + types.ConfigRecoveryGolden},
+		})
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "🏠 Main Menu", CallbackData: "main_menu"},
+	})
+	return &models.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+}
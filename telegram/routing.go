@@ -0,0 +1,97 @@
+package telegram
+
+import (
+	"context"
+	"strings"
+	"xray-telegram-manager/operations"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// handleRouting shows the routing presets menu
+func (tb *TelegramBot) handleRouting(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	tb.logger.Info("Received /routing command from user %d (%s)", userID, username)
+
+	if !tb.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionAdmin) {
+		tb.logger.Warn("Unauthorized access attempt from user %d (%s) for /routing command", userID, username)
+		tb.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/routing")
+		return
+	}
+
+	if err := tb.messageManager.SendNew(ctx, update.Message.Chat.ID, tb.routingMenuContent("")); err != nil {
+		tb.logger.Error("Failed to send routing menu: %v", err)
+	}
+}
+
+// handleRoutingCallback handles the routing_on_<preset> and routing_off_<preset> buttons.
+// The routing file is changed and xray is restarted, so it runs as an operation.
+func (tb *TelegramBot) handleRoutingCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID, data string) {
+	action, id, found := strings.Cut(strings.TrimPrefix(data, "routing_"), "_")
+	if !found || (action != "on" && action != "off") {
+		tb.logger.Warn("Unknown routing callback from user %d: %s", chatID, data)
+		tb.answerCallback(ctx, callbackQueryID, "❌ Unknown routing action")
+		return
+	}
+	enable := action == "on"
+
+	op, release, ok := tb.beginOperation(ctx, chatID, callbackQueryID, operations.OperationRouting)
+	if !ok {
+		return
+	}
+	defer release()
+
+	tb.answerCallback(ctx, callbackQueryID, "🔄 Updating routing and restarting xray...")
+
+	progress := MessageContent{
+		Text: "🔄 Updating routing rules\n\n└ Restarting xray and checking it is running...",
+		Type: MessageTypeStatus,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, progress); err != nil {
+		tb.logger.Error("Failed to send routing progress: %v", err)
+	}
+	tb.trackOperationMessage(op, chatID, MessageTypeStatus)
+
+	if err := tb.serverMgr.SetRoutingPreset(id, enable); err != nil {
+		tb.logger.Error("Failed to change routing preset %s for user %d: %v", id, chatID, err)
+		tb.messageManager.ForceCleanupUser(chatID, "routing change failed")
+		tb.sendErrorMessage(ctx, b, chatID, "Failed to Change Routing", err.Error(), data)
+		return
+	}
+
+	tb.logger.Info("User %d turned routing preset %s %s", chatID, id, action)
+	notice := "✅ Routing updated, xray restarted"
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, tb.routingMenuContent(notice)); err != nil {
+		tb.logger.Error("Failed to update routing menu: %v", err)
+	}
+}
+func (tb *TelegramBot) routingMenuContent(notice string) MessageContent {
+	messageFormatter := NewMessageFormatter()
+	presets, err := tb.serverMgr.GetRoutingPresets()
+
+	var keyboard [][]models.InlineKeyboardButton
+	for _, preset := range presets {
+		action := "on"
+		if preset.Enabled {
+			action = "off"
+		}
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: onOffIcon(preset.Enabled) + " " + preset.Name, CallbackData: "routing_" + action + "_" + preset.ID},
+		})
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "🏠 Main Menu", CallbackData: "main_menu"},
+	})
+
+	text := messageFormatter.FormatRoutingPresets(presets, err)
+	if notice != "" {
+		text = notice + "\n\n" + text
+	}
+	return MessageContent{
+		Text:        text,
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		Type:        MessageTypeMenu,
+	}
+}
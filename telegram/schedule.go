@@ -0,0 +1,274 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+	"xray-telegram-manager/audit"
+	"xray-telegram-manager/operations"
+	"xray-telegram-manager/pending"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	// scheduleSwitchFlow is the conversation that asks when to switch to a server
+	scheduleSwitchFlow = "schedule_switch"
+	// pendingCheckInterval is how often due actions are looked for
+	pendingCheckInterval = 30 * time.Second
+	// pendingMaxDelay drops actions that were due longer ago, when the bot was not
+	// running at their time a switch much later would come unexpected
+	pendingMaxDelay = time.Hour
+	// scheduledSwitchWait bounds waiting for a running ping test or switch
+	scheduledSwitchWait = 10 * time.Minute
+)
+
+// pendingPath returns where the pending actions are stored, next to the manager config
+func pendingPath(config ConfigProvider) string {
+	configFile := config.GetConfigFilePath()
+	if configFile == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(configFile), "pending.json")
+}
+
+// registerScheduleFlow makes the time input available to the schedule buttons
+func (tb *TelegramBot) registerScheduleFlow() {
+	tb.conversations.RegisterFlow(scheduleSwitchFlow, ConversationFlow{
+		Title:  "scheduled switch",
+		Handle: tb.handleScheduleInput,
+	})
+}
+
+// scheduleButton asks when to switch to a server
+func (tb *TelegramBot) scheduleButton(serverID string) models.InlineKeyboardButton {
+	return models.InlineKeyboardButton{Text: "⏰ Schedule", CallbackData: callbackServerID("schedule_", serverID)}
+}
+
+// handleScheduleCallback asks when to switch to a server. A server in a blocked
+// country is refused, nobody is there to confirm it a second time when the switch runs.
+func (tb *TelegramBot) handleScheduleCallback(ctx context.Context, b *bot.Bot, chatID, userID int64, callbackQueryID, serverID string) {
+	selected := tb.findServer(serverID)
+	if selected == nil {
+		tb.alertCallback(ctx, callbackQueryID, "❌ Server not found")
+		return
+	}
+	if selected.Blocked() {
+		tb.alertCallback(ctx, callbackQueryID, "⛔ The server is in a blocked country, switch to it by hand")
+		return
+	}
+	if err := tb.conversations.Start(chatID, userID, scheduleSwitchFlow, serverID); err != nil {
+		tb.logger.Error("Failed to start schedule input for user %d: %v", userID, err)
+		return
+	}
+	tb.answerCallback(ctx, callbackQueryID, "")
+
+	keyboard := [][]models.InlineKeyboardButton{
+		{{Text: "⬅️ Back", CallbackData: tb.serverCallback("server_", serverID)}},
+	}
+	content := MessageContent{
+		Text:        NewMessageFormatter().FormatSchedulePrompt(selected.Name),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		Type:        MessageTypeStatus,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send schedule prompt: %v", err)
+	}
+}
+
+// handleScheduleInput schedules the switch for the time sent by the user. The step of
+// the conversation is the server ID.
+func (tb *TelegramBot) handleScheduleInput(ctx context.Context, b *bot.Bot, update *models.Update, conv *Conversation) string {
+	serverID := conv.Step
+	selected := tb.findServer(serverID)
+	if selected == nil {
+		tb.sendReachExpired(ctx, conv.ChatID)
+		return ""
+	}
+	if selected.Blocked() {
+		// blocked_countries changed since the button was pressed
+		err := tb.messageManager.SendNew(ctx, conv.ChatID, MessageContent{
+			Text: fmt.Sprintf("⛔ %s\n\nSwitch to it by hand from /list.", errBlockedTarget(selected)),
+			Type: MessageTypeStatus,
+		})
+		if err != nil {
+			tb.logger.Error("Failed to send schedule error: %v", err)
+		}
+		return ""
+	}
+	now := tb.clock.Now()
+	at, err := pending.ParseTime(update.Message.Text, now)
+	if err == nil {
+		_, err = tb.pending.Add(pending.Action{
+			Kind:       pending.KindSwitch,
+			At:         at,
+			ServerID:   serverID,
+			ServerName: selected.Name,
+			ChatID:     conv.ChatID,
+			UserID:     conv.UserID,
+			User:       getUsername(update.Message.From),
+		})
+	}
+	if err != nil {
+		tb.logger.Warn("Rejected scheduled switch to %s from user %d: %v", selected.Name, conv.UserID, err)
+		err = tb.messageManager.SendNew(ctx, conv.ChatID, MessageContent{
+			Text: fmt.Sprintf("❌ %s\n\nSend a time like 02:00 or a delay like 2h, or /cancel.", toTitle(err.Error())),
+			Type: MessageTypeStatus,
+		})
+		if err != nil {
+			tb.logger.Error("Failed to send schedule error: %v", err)
+		}
+		return serverID
+	}
+
+	tb.logger.Info("User %d scheduled a switch to %s at %s", conv.UserID, selected.Name, at.Format(time.RFC3339))
+	// The list is sent as a new message below the input of the user
+	tb.messageManager.ForceCleanupUser(conv.ChatID, "switch scheduled")
+	notice := fmt.Sprintf("✅ Switch to %s scheduled %s", selected.Name, formatScheduledTime(at, now))
+	if err := tb.messageManager.SendOrEdit(ctx, conv.ChatID, tb.pendingContent(notice)); err != nil {
+		tb.logger.Error("Failed to send pending actions: %v", err)
+	}
+	return ""
+}
+
+// handlePending shows the pending actions with buttons cancelling them
+func (tb *TelegramBot) handlePending(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	tb.logger.Info("Received /pending command from user %d (%s)", userID, username)
+
+	if !tb.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionView) {
+		tb.logger.Warn("Unauthorized access attempt from user %d (%s) for /pending command", userID, username)
+		tb.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/pending")
+		return
+	}
+
+	if err := tb.messageManager.SendNew(ctx, update.Message.Chat.ID, tb.pendingContent("")); err != nil {
+		tb.logger.Error("Failed to send pending actions: %v", err)
+	}
+}
+
+// handlePendingCallback handles the pending_list and pending_cancel_<id> buttons
+func (tb *TelegramBot) handlePendingCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID, data string) {
+	notice := ""
+	if id, ok := strings.CutPrefix(data, "pending_cancel_"); ok {
+		action, found, err := tb.pending.Remove(id)
+		switch {
+		case err != nil:
+			tb.logger.Error("Failed to save pending actions after cancelling %s: %v", id, err)
+			tb.alertCallback(ctx, callbackQueryID, "❌ Failed to cancel the action")
+			return
+		case !found:
+			tb.answerCallback(ctx, callbackQueryID, "ℹ️ Already done or cancelled")
+		default:
+			tb.logger.Info("User %d cancelled the scheduled switch to %s", chatID, action.ServerName)
+			tb.answerCallback(ctx, callbackQueryID, "🗑 Cancelled")
+			notice = fmt.Sprintf("🗑 Switch to %s cancelled", action.ServerName)
+		}
+	} else {
+		tb.answerCallback(ctx, callbackQueryID, "")
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, tb.pendingContent(notice)); err != nil {
+		tb.logger.Error("Failed to update pending actions: %v", err)
+	}
+}
+
+// pendingContent is the list of pending actions with a cancel button for each
+func (tb *TelegramBot) pendingContent(notice string) MessageContent {
+	actions := tb.pending.List()
+	var keyboard [][]models.InlineKeyboardButton
+	for _, action := range actions {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{{
+			Text:         tb.buttonTextProcessor.ProcessServerButtonText(action.ServerName, "❌ Cancel", 50),
+			CallbackData: "pending_cancel_" + action.ID,
+		}})
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "🔄 Refresh", CallbackData: "pending_list"},
+		{Text: "🏠 Main Menu", CallbackData: "main_menu"},
+	})
+	return MessageContent{
+		Text:        NewMessageFormatter().FormatPendingActions(actions, tb.clock.Now(), notice),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		Type:        MessageTypeStatus,
+	}
+}
+
+// runPendingActions runs the actions that became due and reports each in the chat it
+// was scheduled from
+func (tb *TelegramBot) runPendingActions(ctx context.Context) {
+	now := tb.clock.Now()
+	due, err := tb.pending.Take(now)
+	if err != nil {
+		tb.logger.Error("Failed to save pending actions: %v", err)
+	}
+	for _, action := range due {
+		if now.Sub(action.At) > pendingMaxDelay {
+			tb.logger.Warn("Skipping the switch to %s due at %s, the bot was not running then", action.ServerName, action.At.Format(time.RFC3339))
+			tb.sendScheduledResult(ctx, action, NewMessageFormatter().FormatScheduledSwitchMissed(action))
+			continue
+		}
+		tb.runScheduledSwitch(ctx, action)
+	}
+}
+
+// runScheduledSwitch switches to the server of action. A running ping test or switch
+// is waited for instead of skipping the action.
+func (tb *TelegramBot) runScheduledSwitch(ctx context.Context, action pending.Action) {
+	formatter := NewMessageFormatter()
+	target := tb.findServer(action.ServerID)
+	if target == nil {
+		err := fmt.Errorf("the server is no longer in the subscription")
+		tb.logger.Warn("Scheduled switch to %s failed: %v", action.ServerName, err)
+		tb.sendScheduledResult(ctx, action, formatter.FormatScheduledSwitchFailed(action, err))
+		return
+	}
+	if target.Blocked() {
+		err := errBlockedTarget(target)
+		tb.logger.Warn("Skipping scheduled switch: %v", err)
+		tb.sendScheduledResult(ctx, action, formatter.FormatScheduledSwitchFailed(action, err))
+		return
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, scheduledSwitchWait)
+	defer cancel()
+	_, release, err := tb.serverMgr.Operations().Acquire(waitCtx, operations.OperationSwitch, action.ChatID, operations.PolicyQueue)
+	if err != nil {
+		tb.logger.Error("Scheduled switch to %s could not start: %v", action.ServerName, err)
+		tb.sendScheduledResult(ctx, action, formatter.FormatScheduledSwitchFailed(action, err))
+		return
+	}
+	defer release()
+
+	tb.logger.Info("Running the switch to %s scheduled by %s", target.Name, action.User)
+	if err := tb.serverMgr.SwitchServer(ctx, target.ID); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		tb.logger.Error("Scheduled switch to %s failed: %v", target.Name, err)
+		tb.sendScheduledResult(ctx, action, formatter.FormatScheduledSwitchFailed(action, err))
+		return
+	}
+	tb.listCache.invalidate()
+	// The name was formatted when the switch was scheduled
+	initiator := &models.User{ID: action.UserID, FirstName: action.User}
+	tb.recordSwitch(ctx, action.ChatID, initiator, target.Name, audit.ReasonScheduled)
+	tb.sendScheduledResult(ctx, action, formatter.FormatScheduledSwitchDone(action))
+}
+
+// sendScheduledResult reports the outcome of a pending action as a new message in the
+// chat it was scheduled from
+func (tb *TelegramBot) sendScheduledResult(ctx context.Context, action pending.Action, text string) {
+	keyboard := NewNavigationHelper().CreateServerStatusNavigationKeyboard(true)
+	content := MessageContent{
+		Text:        text,
+		ReplyMarkup: keyboard,
+		Type:        MessageTypeStatus,
+	}
+	if err := tb.messageManager.SendNew(ctx, action.ChatID, content); err != nil {
+		tb.logger.Error("Failed to report the scheduled switch to %s: %v", action.ServerName, err)
+	}
+}
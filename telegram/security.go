@@ -0,0 +1,88 @@
+package telegram
+
+import (
+	"context"
+	"time"
+	"xray-telegram-manager/notifications"
+	"xray-telegram-manager/security"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// newIntruderTracker creates the tracker of unauthorized attempts from the security config
+func newIntruderTracker(config ConfigProvider) *security.Tracker {
+	securityCfg := config.GetSecurity()
+	return security.NewTracker(security.Policy{
+		MaxAttempts: securityCfg.MaxAttempts,
+		Window:      time.Duration(securityCfg.WindowMinutes) * time.Minute,
+		BanDuration: time.Duration(securityCfg.BanMinutes) * time.Minute,
+	})
+}
+
+// banMiddleware drops updates from temporarily banned users before any handler runs
+func banMiddleware(tracker *security.Tracker, logger Logger) bot.Middleware {
+	return func(next bot.HandlerFunc) bot.HandlerFunc {
+		return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+			var from *models.User
+			if update.Message != nil {
+				from = update.Message.From
+			} else if update.CallbackQuery != nil {
+				from = &update.CallbackQuery.From
+			}
+			if from != nil && tracker.ShouldIgnore(from.ID) {
+				logger.Debug("Ignoring update from banned user %d", from.ID)
+				return
+			}
+			next(ctx, b, update)
+		}
+	}
+}
+
+// recordUnauthorized registers an unauthorized attempt and alerts the admin when the
+// user gets banned. Users with a role in the group are reported but never banned.
+func (tb *TelegramBot) recordUnauthorized(ctx context.Context, chatID int64, from *models.User, command string) {
+	if from == nil {
+		return
+	}
+	canBan := tb.userRole(ctx, chatID, from.ID) == ""
+	intruder, banned := tb.intruders.Record(from.ID, from.Username, command, canBan)
+	if !banned {
+		return
+	}
+
+	tb.logger.Warn("User %d (%s) banned for %v after %d unauthorized attempts", from.ID, getUsername(from), tb.intruders.Policy().BanDuration, intruder.Attempts)
+	messageFormatter := NewMessageFormatter()
+	tb.Notify(ctx, notifications.EventSecurityAlert, messageFormatter.FormatIntruderAlert(intruder))
+}
+
+// rejectUnauthorized records an unauthorized command and tells the user access is denied
+func (tb *TelegramBot) rejectUnauthorized(ctx context.Context, b *bot.Bot, chatID int64, from *models.User, command string) {
+	tb.recordUnauthorized(ctx, chatID, from, command)
+	tb.sendUnauthorizedMessage(ctx, b, chatID)
+}
+
+// handleIntruders shows the report of unauthorized access attempts
+func (tb *TelegramBot) handleIntruders(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	tb.logger.Info("Received /intruders command from user %d (%s)", userID, username)
+
+	if !tb.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionAdmin) {
+		tb.logger.Warn("Unauthorized access attempt from user %d (%s) for /intruders command", userID, username)
+		tb.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/intruders")
+		return
+	}
+
+	messageFormatter := NewMessageFormatter()
+	content := MessageContent{
+		Text: messageFormatter.FormatIntrudersReport(tb.intruders.Intruders()),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: "🏠 Main Menu", CallbackData: "main_menu"}},
+		}},
+		Type: MessageTypeMenu,
+	}
+	if err := tb.messageManager.SendNew(ctx, update.Message.Chat.ID, content); err != nil {
+		tb.logger.Error("Failed to send intruders report: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package telegram
+
+import (
+	"sync"
+	"time"
+)
+
+// Outgoing message limits of the Bot API FAQ: about 30 messages per second overall,
+// one per second in a chat with short bursts allowed, and 20 per minute in a group
+const (
+	globalSendRate  = 30.0
+	globalSendBurst = 30.0
+	chatSendRate    = 1.0
+	chatSendBurst   = 3.0
+	groupSendRate   = 20.0 / 60
+	groupSendBurst  = 5.0
+	// idleChatBucket is how long an unused chat keeps its bucket
+	idleChatBucket = 10 * time.Minute
+)
+
+// ThrottleStats counts the sends held back by the outgoing message throttle
+type ThrottleStats struct {
+	Sends     int64
+	Throttled int64
+	// Waited is the total time sends were held back
+	Waited  time.Duration
+	MaxWait time.Duration
+}
+
+// tokenBucket allows rate sends per second with bursts of up to burst sends. Tokens
+// below zero are sends that were already promised a later slot.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// used is when the last token was taken
+	used time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// reserve takes a token and returns how long the send must wait for it
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.refill(now)
+	b.used = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel gives back a token of a send that was not made
+func (b *tokenBucket) cancel() {
+	b.tokens++
+}
+
+// idle reports whether the bucket is full again and unused for a while
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst && now.Sub(b.used) >= idleChatBucket
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		b.last = now
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// sendThrottle spaces out sends and edits so bursts such as ping tests of many
+// servers or notices to all admins stay within the flood limits of Telegram
+type sendThrottle struct {
+	mutex  sync.Mutex
+	global *tokenBucket
+	chats  map[int64]*tokenBucket
+	stats  ThrottleStats
+}
+
+func newSendThrottle(now time.Time) *sendThrottle {
+	return &sendThrottle{
+		global: newTokenBucket(globalSendRate, globalSendBurst, now),
+		chats:  make(map[int64]*tokenBucket),
+	}
+}
+
+// reserve returns how long a send to the chat must wait. Negative chat IDs are
+// groups and get the lower group limit.
+func (t *sendThrottle) reserve(chatID int64, now time.Time) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	chat, ok := t.chats[chatID]
+	if !ok {
+		if chatID < 0 {
+			chat = newTokenBucket(groupSendRate, groupSendBurst, now)
+		} else {
+			chat = newTokenBucket(chatSendRate, chatSendBurst, now)
+		}
+		t.chats[chatID] = chat
+	}
+	wait := t.global.reserve(now)
+	if chatWait := chat.reserve(now); chatWait > wait {
+		wait = chatWait
+	}
+
+	t.stats.Sends++
+	if wait > 0 {
+		t.stats.Throttled++
+		t.stats.Waited += wait
+		if wait > t.stats.MaxWait {
+			t.stats.MaxWait = wait
+		}
+	}
+	return wait
+}
+
+// cancel gives back the slot of a send that gave up waiting
+func (t *sendThrottle) cancel(chatID int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.global.cancel()
+	if chat, ok := t.chats[chatID]; ok {
+		chat.cancel()
+	}
+}
+
+// cleanup drops the buckets of chats that were not sent to for a while
+func (t *sendThrottle) cleanup(now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for chatID, chat := range t.chats {
+		if chat.idle(now) {
+			delete(t.chats, chatID)
+		}
+	}
+}
+
+// Stats returns a snapshot of the throttle counters
+func (t *sendThrottle) Stats() ThrottleStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.stats
+}
@@ -0,0 +1,121 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"xray-telegram-manager/audit"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// serverNoteFlow is the conversation that asks for the note of a server
+const serverNoteFlow = "server_note"
+
+// registerNoteFlow makes the note input available to the note buttons
+func (tb *TelegramBot) registerNoteFlow() {
+	tb.conversations.RegisterFlow(serverNoteFlow, ConversationFlow{
+		Title:  "server note",
+		Handle: tb.handleServerNoteInput,
+	})
+}
+
+// formatServerStatus formats the server status with the note of the server
+func (tb *TelegramBot) formatServerStatus(server *types.Server, result *types.PingResult) string {
+	var activated *audit.Entry
+	if current := tb.serverMgr.GetCurrentServer(); current != nil && current.ID == server.ID {
+		activated = tb.activeSince(server)
+	}
+	return NewMessageFormatter().FormatServerStatusWithNote(server, result, tb.serverMgr.GetServerNote(server.ID), activated)
+}
+
+// noteButton opens the note input of a server
+func (tb *TelegramBot) noteButton(serverID string) models.InlineKeyboardButton {
+	if tb.serverMgr.GetServerNote(serverID) != "" {
+		return models.InlineKeyboardButton{Text: "📝 Edit Note", CallbackData: callbackServerID("note_", serverID)}
+	}
+	return models.InlineKeyboardButton{Text: "📝 Note", CallbackData: callbackServerID("note_", serverID)}
+}
+
+// findServer returns the loaded server with the ID, or nil
+func (tb *TelegramBot) findServer(serverID string) *types.Server {
+	return tb.newServerSnapshot().Find(serverID)
+}
+
+// handleNoteCallback asks for the note of a server
+func (tb *TelegramBot) handleNoteCallback(ctx context.Context, b *bot.Bot, chatID, userID int64, callbackQueryID, serverID string) {
+	selected := tb.findServer(serverID)
+	if selected == nil {
+		tb.alertCallback(ctx, callbackQueryID, "❌ Server not found")
+		return
+	}
+	if err := tb.conversations.Start(chatID, userID, serverNoteFlow, serverID); err != nil {
+		tb.logger.Error("Failed to start note input for user %d: %v", userID, err)
+		return
+	}
+	tb.answerCallback(ctx, callbackQueryID, "")
+
+	note := tb.serverMgr.GetServerNote(serverID)
+	keyboard := [][]models.InlineKeyboardButton{}
+	if note != "" {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{{Text: "🗑 Remove Note", CallbackData: callbackServerID("note_clear_", serverID)}})
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{{Text: "⬅️ Back", CallbackData: callbackServerID("note_cancel_", serverID)}})
+
+	content := MessageContent{
+		Text:        NewMessageFormatter().FormatNotePrompt(selected.Name, note, types.MaxServerNoteLength),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		Type:        MessageTypeStatus,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send note prompt: %v", err)
+	}
+}
+
+// handleNoteClearCallback removes the note of a server
+func (tb *TelegramBot) handleNoteClearCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID, serverID string) {
+	tb.conversations.Cancel(chatID)
+	if err := tb.serverMgr.SetServerNote(serverID, ""); err != nil {
+		tb.logger.Error("Failed to remove note of server %s: %v", serverID, err)
+		tb.alertCallback(ctx, callbackQueryID, "❌ Failed to remove the note")
+		return
+	}
+	tb.listCache.invalidate()
+	tb.answerCallback(ctx, callbackQueryID, "🗑 Note removed")
+	tb.handleServerSelectCallback(ctx, b, chatID, "", serverID, tb.newServerSnapshot())
+}
+
+// handleNoteCancelCallback leaves the note input and goes back to the server
+func (tb *TelegramBot) handleNoteCancelCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID, serverID string) {
+	tb.conversations.Cancel(chatID)
+	tb.answerCallback(ctx, callbackQueryID, "")
+	tb.handleServerSelectCallback(ctx, b, chatID, "", serverID, tb.newServerSnapshot())
+}
+
+// handleServerNoteInput saves the note sent by the user, "-" removes it. The step of
+// the conversation is the server ID.
+func (tb *TelegramBot) handleServerNoteInput(ctx context.Context, b *bot.Bot, update *models.Update, conv *Conversation) string {
+	serverID := conv.Step
+	note := strings.TrimSpace(update.Message.Text)
+	if note == "-" {
+		note = ""
+	}
+	if err := tb.serverMgr.SetServerNote(serverID, note); err != nil {
+		tb.logger.Warn("Rejected note of server %s from user %d: %v", serverID, conv.UserID, err)
+		err = tb.messageManager.SendNew(ctx, conv.ChatID, MessageContent{
+			Text: fmt.Sprintf("❌ %s\n\nSend a shorter note, or /cancel to keep the current one.", toTitle(err.Error())),
+			Type: MessageTypeStatus,
+		})
+		if err != nil {
+			tb.logger.Error("Failed to send note error: %v", err)
+		}
+		return serverID
+	}
+	tb.listCache.invalidate()
+	// The server view is sent as a new message below the input of the user
+	tb.messageManager.ForceCleanupUser(conv.ChatID, "note saved")
+	tb.handleServerSelectCallback(ctx, b, conv.ChatID, "", serverID, tb.newServerSnapshot())
+	return ""
+}
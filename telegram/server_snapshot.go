@@ -0,0 +1,57 @@
+package telegram
+
+import "xray-telegram-manager/types"
+
+// serverSnapshot is the server list and the current server as one button press sees
+// them. Each is read from the server manager on first use only, so the handlers of a
+// callback share one copy instead of asking the manager again and again. A snapshot
+// belongs to one interaction and is not safe for concurrent use.
+type serverSnapshot struct {
+	serverMgr   ServerManager
+	servers     []types.Server
+	serversRead bool
+	current     *types.Server
+	currentRead bool
+}
+
+// newServerSnapshot starts the snapshot of an interaction
+func (tb *TelegramBot) newServerSnapshot() *serverSnapshot {
+	return &serverSnapshot{serverMgr: tb.serverMgr}
+}
+
+// Servers returns the servers sorted by name, shared by all users of the snapshot
+// and not to be modified
+func (s *serverSnapshot) Servers() []types.Server {
+	if !s.serversRead {
+		s.servers = s.serverMgr.GetServers()
+		s.serversRead = true
+	}
+	return s.servers
+}
+
+// Current returns the active server, nil when unknown
+func (s *serverSnapshot) Current() *types.Server {
+	if !s.currentRead {
+		s.current = s.serverMgr.GetCurrentServer()
+		s.currentRead = true
+	}
+	return s.current
+}
+
+// CurrentID returns the ID of the active server, empty when unknown
+func (s *serverSnapshot) CurrentID() string {
+	if current := s.Current(); current != nil {
+		return current.ID
+	}
+	return ""
+}
+
+// Find returns a copy of the server with the ID, or nil
+func (s *serverSnapshot) Find(serverID string) *types.Server {
+	for _, server := range s.Servers() {
+		if server.ID == serverID {
+			return &server
+		}
+	}
+	return nil
+}
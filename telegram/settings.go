@@ -0,0 +1,220 @@
+package telegram
+
+import (
+	"context"
+	"strings"
+	"xray-telegram-manager/operations"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// outboundSetting is an anti-DPI option that can be toggled in /settings
+type outboundSetting struct {
+	key   string
+	label string
+	field func(o *types.OutboundOverride) **bool
+	value func(o types.OutboundOptions) bool
+}
+
+var outboundSettings = []outboundSetting{
+	{
+		key:   "mux",
+		label: "Mux",
+		field: func(o *types.OutboundOverride) **bool { return &o.Mux },
+		value: func(o types.OutboundOptions) bool { return o.Mux },
+	},
+	{
+		key:   "fragment",
+		label: "Fragment",
+		field: func(o *types.OutboundOverride) **bool { return &o.Fragment },
+		value: func(o types.OutboundOptions) bool { return o.Fragment },
+	},
+	{
+		key:   "noise",
+		label: "Noise",
+		field: func(o *types.OutboundOverride) **bool { return &o.Noise },
+		value: func(o types.OutboundOptions) bool { return o.Noise },
+	},
+}
+
+func findOutboundSetting(key string) (outboundSetting, bool) {
+	for _, setting := range outboundSettings {
+		if setting.key == key {
+			return setting, true
+		}
+	}
+	return outboundSetting{}, false
+}
+
+// handleSettings shows the outbound settings menu
+func (tb *TelegramBot) handleSettings(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	tb.logger.Info("Received /settings command from user %d (%s)", userID, username)
+
+	if !tb.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionAdmin) {
+		tb.logger.Warn("Unauthorized access attempt from user %d (%s) for /settings command", userID, username)
+		tb.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/settings")
+		return
+	}
+
+	if err := tb.messageManager.SendNew(ctx, update.Message.Chat.ID, tb.settingsMenuContent()); err != nil {
+		tb.logger.Error("Failed to send settings menu: %v", err)
+	}
+}
+
+// handleSettingsCallback handles the settings_default_<option>, settings_server_<option>
+// and settings_apply buttons. Changes are saved at once and used on the next server
+// switch, settings_apply rewrites the current outbound right away.
+func (tb *TelegramBot) handleSettingsCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID, data string) {
+	if data == "settings_apply" {
+		tb.handleSettingsApply(ctx, b, chatID, callbackQueryID)
+		return
+	}
+
+	answerText := ""
+	scope, key, _ := strings.Cut(strings.TrimPrefix(data, "settings_"), "_")
+	setting, ok := findOutboundSetting(key)
+	if !ok {
+		tb.logger.Warn("Unknown settings callback from user %d: %s", chatID, data)
+		tb.answerCallback(ctx, callbackQueryID, "❌ Unknown setting")
+		return
+	}
+
+	var err error
+	switch scope {
+	case "default":
+		defaults := tb.serverMgr.GetOutboundDefaults()
+		enabled := !setting.value(tb.serverMgr.OutboundOptions(""))
+		*setting.field(&defaults) = &enabled
+		err = tb.serverMgr.SetOutboundDefaults(defaults)
+		answerText = setting.label + " " + onOff(enabled) + " for all servers"
+	case "server":
+		current := tb.serverMgr.GetCurrentServer()
+		if current == nil {
+			answerText = "❌ No active server"
+			break
+		}
+		override := tb.serverMgr.GetOutboundOverride(current.ID)
+		field := setting.field(&override)
+		// Cycle default -> on -> off -> default
+		switch {
+		case *field == nil:
+			enabled := true
+			*field = &enabled
+		case **field:
+			enabled := false
+			*field = &enabled
+		default:
+			*field = nil
+		}
+		err = tb.serverMgr.SetOutboundOverride(current.ID, override)
+		answerText = setting.label + ": " + overrideState(*field) + " for " + current.Name
+	}
+	if err != nil {
+		tb.logger.Error("Failed to save outbound settings: %v", err)
+		answerText = "❌ Failed to save settings"
+	} else {
+		tb.logger.Info("User %d changed outbound setting %s", chatID, strings.TrimPrefix(data, "settings_"))
+	}
+
+	tb.answerCallback(ctx, callbackQueryID, answerText)
+
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, tb.settingsMenuContent()); err != nil {
+		tb.logger.Error("Failed to update settings menu: %v", err)
+	}
+}
+
+// handleSettingsApply rewrites the outbound of the current server with the current settings
+func (tb *TelegramBot) handleSettingsApply(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
+	tb.logger.Info("Applying outbound settings for user %d", chatID)
+
+	_, release, ok := tb.beginOperation(ctx, chatID, callbackQueryID, operations.OperationSwitch)
+	if !ok {
+		return
+	}
+	defer release()
+
+	tb.answerCallback(ctx, callbackQueryID, "🔄 Applying settings...")
+
+	if err := tb.serverMgr.ApplyOutboundOptions(); err != nil {
+		tb.logger.Error("Failed to apply outbound settings for user %d: %v", chatID, err)
+		tb.messageManager.ForceCleanupUser(chatID, "outbound settings apply failed")
+		tb.sendErrorMessage(ctx, b, chatID, "Failed to Apply Settings", err.Error(), "settings_apply")
+		return
+	}
+
+	content := tb.settingsMenuContent()
+	content.Text = "✅ Settings applied, xray restarted\n\n" + content.Text
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, content); err != nil {
+		tb.logger.Error("Failed to send settings menu: %v", err)
+	} else {
+		tb.logger.Info("Outbound settings applied for user %d", chatID)
+	}
+}
+func (tb *TelegramBot) settingsMenuContent() MessageContent {
+	defaults := tb.serverMgr.OutboundOptions("")
+	current := tb.serverMgr.GetCurrentServer()
+
+	var keyboard [][]models.InlineKeyboardButton
+	row := []models.InlineKeyboardButton{}
+	for _, setting := range outboundSettings {
+		row = append(row, models.InlineKeyboardButton{
+			Text:         onOffIcon(setting.value(defaults)) + " " + setting.label,
+			CallbackData: "settings_default_" + setting.key,
+		})
+	}
+	keyboard = append(keyboard, row)
+
+	var override types.OutboundOverride
+	var effective types.OutboundOptions
+	if current != nil {
+		override = tb.serverMgr.GetOutboundOverride(current.ID)
+		effective = tb.serverMgr.OutboundOptions(current.ID)
+		row = []models.InlineKeyboardButton{}
+		for _, setting := range outboundSettings {
+			icon := "⚪"
+			if value := *setting.field(&override); value != nil {
+				icon = onOffIcon(*value)
+			}
+			row = append(row, models.InlineKeyboardButton{
+				Text:         icon + " " + setting.label,
+				CallbackData: "settings_server_" + setting.key,
+			})
+		}
+		keyboard = append(keyboard, row)
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: "🔄 Apply now", CallbackData: "settings_apply"},
+		})
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "🏠 Main Menu", CallbackData: "main_menu"},
+	})
+
+	messageFormatter := NewMessageFormatter()
+	return MessageContent{
+		Text:        messageFormatter.FormatOutboundSettings(defaults, current, override, effective),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		Type:        MessageTypeMenu,
+	}
+}
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
+func onOffIcon(enabled bool) string {
+	if enabled {
+		return "✅"
+	}
+	return "🚫"
+}
+func overrideState(value *bool) string {
+	if value == nil {
+		return "default"
+	}
+	return onOff(*value)
+}
@@ -0,0 +1,279 @@
+package telegram
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+	"xray-telegram-manager/config"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// maxSetupCodeAttempts is how many wrong confirmation codes a candidate may enter
+// before the code is replaced and setup has to be started over
+const maxSetupCodeAttempts = 3
+
+// setupCodeTimeout is how long a candidate may leave the code prompt unanswered
+// before another user's /start takes the setup over with a new code
+const setupCodeTimeout = 5 * time.Minute
+
+// setupStep is the stage of the first-run setup wizard
+type setupStep int
+
+const (
+	setupStepStart setupStep = iota
+	setupStepCode
+	setupStepSubscriptionURL
+	setupStepConfigPath
+	setupStepPingMode
+	setupStepConfirm
+)
+
+// SetupWizard configures the manager through Telegram on the first run, when the
+// config has a bot token but no admin or subscription yet. The first user to send
+// /start becomes the admin candidate and proves it with a code shown on the console,
+// a candidate who leaves the code prompt idle can be replaced by the next /start.
+type SetupWizard struct {
+	bot      *bot.Bot
+	cfg      *config.Config
+	logger   Logger
+	showCode func(code string)
+
+	mutex       sync.Mutex
+	code        string
+	step        setupStep
+	candidateID int64
+	candidateAt time.Time
+	attempts    int
+	values      config.SetupValues
+	done        chan *config.Config
+}
+
+// NewSetupWizard creates the wizard for an incomplete config. showCode is called with
+// every new confirmation code so it can be printed where only the router owner sees it.
+func NewSetupWizard(cfg *config.Config, logger Logger, showCode func(code string)) (*SetupWizard, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config cannot be nil")
+	}
+	if logger == nil {
+		return nil, fmt.Errorf("logger cannot be nil")
+	}
+
+	w := &SetupWizard{
+		cfg:      cfg,
+		logger:   logger,
+		showCode: showCode,
+		done:     make(chan *config.Config, 1),
+	}
+	b, err := bot.New(cfg.GetBotToken(), bot.WithDefaultHandler(w.handleUpdate))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bot: %w", err)
+	}
+	w.bot = b
+	return w, nil
+}
+
+// Run polls Telegram until the setup is saved and returns the completed config
+func (w *SetupWizard) Run(ctx context.Context) (*config.Config, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w.mutex.Lock()
+	w.resetUnsafe()
+	w.mutex.Unlock()
+
+	go w.bot.Start(ctx)
+	w.logger.Info("Setup mode: waiting for /start in a private chat with the bot")
+
+	select {
+	case cfg := <-w.done:
+		return cfg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resetUnsafe forgets the candidate and issues a new confirmation code
+func (w *SetupWizard) resetUnsafe() {
+	w.code = newSetupCode()
+	w.step = setupStepStart
+	w.candidateID = 0
+	w.candidateAt = time.Time{}
+	w.attempts = 0
+	w.values = config.SetupValues{}
+	w.logger.Warn("Setup confirmation code: %s", w.code)
+	if w.showCode != nil {
+		w.showCode(w.code)
+	}
+}
+func newSetupCode() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate setup code: %v", err))
+	}
+	return fmt.Sprintf("%06d", n.Int64())
+}
+func (w *SetupWizard) handleUpdate(ctx context.Context, b *bot.Bot, update *models.Update) {
+	switch {
+	case update.Message != nil && update.Message.From != nil:
+		if update.Message.Chat.Type != "private" {
+			return
+		}
+		w.handleMessage(ctx, update.Message)
+	case update.CallbackQuery != nil:
+		_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{CallbackQueryID: update.CallbackQuery.ID})
+		w.handleCallback(ctx, update.CallbackQuery.From.ID, update.CallbackQuery.Data)
+	}
+}
+func (w *SetupWizard) handleMessage(ctx context.Context, message *models.Message) {
+	userID := message.From.ID
+	text := strings.TrimSpace(message.Text)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if text == "/start" {
+		if w.candidateID != 0 && w.candidateID != userID {
+			if w.step > setupStepCode || time.Since(w.candidateAt) < setupCodeTimeout {
+				w.send(ctx, userID, "⏳ Setup is already in progress by another user", nil)
+				return
+			}
+			// The code was never entered, a stale candidate must not block the setup
+			w.logger.Warn("Setup candidate %d did not enter the code in %v, user %d takes over", w.candidateID, setupCodeTimeout, userID)
+			w.resetUnsafe()
+		}
+		if w.step > setupStepCode {
+			w.promptUnsafe(ctx)
+			return
+		}
+		w.candidateID = userID
+		w.candidateAt = time.Now()
+		w.step = setupStepCode
+		w.logger.Info("Setup candidate: user %d (%s)", userID, getUsername(message.From))
+		w.send(ctx, userID, "👋 Welcome to Xray Manager setup!\n\n🔐 Send the confirmation code printed in the manager console and log to become the admin.", nil)
+		return
+	}
+	if userID != w.candidateID {
+		w.send(ctx, userID, "🛠 The manager is not configured yet. Send /start to set it up.", nil)
+		return
+	}
+
+	switch w.step {
+	case setupStepCode:
+		w.candidateAt = time.Now()
+		if subtle.ConstantTimeCompare([]byte(text), []byte(w.code)) != 1 {
+			w.attempts++
+			w.logger.Warn("Wrong setup code from user %d (attempt %d of %d)", userID, w.attempts, maxSetupCodeAttempts)
+			if w.attempts >= maxSetupCodeAttempts {
+				w.resetUnsafe()
+				w.send(ctx, userID, "❌ Too many wrong codes. A new code was printed, send /start to try again.", nil)
+				return
+			}
+			w.send(ctx, userID, fmt.Sprintf("❌ Wrong code, %d attempts left", maxSetupCodeAttempts-w.attempts), nil)
+			return
+		}
+		w.values.AdminID = userID
+		w.step = setupStepSubscriptionURL
+		w.logger.Info("Setup code confirmed, user %d will be the admin", userID)
+		w.promptUnsafe(ctx)
+	case setupStepSubscriptionURL:
+		if err := config.ValidateSubscriptionURL(text); err != nil {
+			w.send(ctx, userID, fmt.Sprintf("❌ %v\n\n🔗 Send the subscription URL starting with https://", err), nil)
+			return
+		}
+		w.values.SubscriptionURL = text
+		w.step = setupStepConfigPath
+		w.promptUnsafe(ctx)
+	case setupStepConfigPath:
+		if err := config.ValidateConfigPath(text); err != nil {
+			w.send(ctx, userID, fmt.Sprintf("❌ %v\n\n📁 Send an absolute path to the xray outbounds config", err), nil)
+			return
+		}
+		w.values.ConfigPath = text
+		w.step = setupStepPingMode
+		w.promptUnsafe(ctx)
+	default:
+		w.promptUnsafe(ctx)
+	}
+}
+func (w *SetupWizard) handleCallback(ctx context.Context, userID int64, data string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if userID != w.candidateID || w.step < setupStepSubscriptionURL {
+		return
+	}
+
+	switch {
+	case data == "setup_path_default" && w.step == setupStepConfigPath:
+		w.values.ConfigPath = w.cfg.ConfigPath
+		w.step = setupStepPingMode
+	case strings.HasPrefix(data, "setup_ping_") && w.step == setupStepPingMode:
+		w.values.PingMode = strings.TrimPrefix(data, "setup_ping_")
+		w.step = setupStepConfirm
+	case data == "setup_restart":
+		w.values = config.SetupValues{AdminID: w.values.AdminID}
+		w.step = setupStepSubscriptionURL
+	case data == "setup_save" && w.step == setupStepConfirm:
+		cfg, err := config.SaveSetup(w.cfg.GetConfigFilePath(), w.values)
+		if err != nil {
+			w.logger.Error("Failed to save setup: %v", err)
+			w.send(ctx, userID, fmt.Sprintf("❌ Failed to save config: %v", err), setupKeyboard(
+				[]models.InlineKeyboardButton{{Text: "💾 Try again", CallbackData: "setup_save"}},
+				[]models.InlineKeyboardButton{{Text: "🔄 Start over", CallbackData: "setup_restart"}},
+			))
+			return
+		}
+		w.logger.Info("Setup completed, config saved to %s", w.cfg.GetConfigFilePath())
+		w.send(ctx, userID, "🎉 Setup complete!\n\n🚀 Starting the manager, send /start in a moment to open the menu.", nil)
+		w.done <- cfg
+		return
+	default:
+		return
+	}
+	w.promptUnsafe(ctx)
+}
+
+// promptUnsafe asks the candidate for the input of the current step
+func (w *SetupWizard) promptUnsafe(ctx context.Context) {
+	switch w.step {
+	case setupStepCode:
+		w.send(ctx, w.candidateID, "🔐 Send the confirmation code printed in the manager console and log", nil)
+	case setupStepSubscriptionURL:
+		w.send(ctx, w.candidateID, "✅ You are the admin\n\n🔗 Step 1/3: send your subscription URL", nil)
+	case setupStepConfigPath:
+		w.send(ctx, w.candidateID, fmt.Sprintf("📁 Step 2/3: xray outbounds config\n\n└ Default: %s\n\nSend another absolute path or use the default", w.cfg.ConfigPath),
+			setupKeyboard([]models.InlineKeyboardButton{{Text: "✅ Use default", CallbackData: "setup_path_default"}}))
+	case setupStepPingMode:
+		w.send(ctx, w.candidateID, "⚡ Step 3/3: how to measure server latency\n\n└ TCP: connection time, works for all servers\n└ Handshake: TLS/Reality handshake time, closer to real latency",
+			setupKeyboard([]models.InlineKeyboardButton{
+				{Text: "🔌 TCP", CallbackData: "setup_ping_" + config.PingModeTCP},
+				{Text: "🤝 Handshake", CallbackData: "setup_ping_" + config.PingModeHandshake},
+			}))
+	case setupStepConfirm:
+		text := fmt.Sprintf("📋 Review settings\n\n└ Admin ID: %d\n└ Subscription: %s\n└ Xray config: %s\n└ Ping mode: %s",
+			w.values.AdminID, w.values.SubscriptionURL, w.values.ConfigPath, w.values.PingMode)
+		w.send(ctx, w.candidateID, text, setupKeyboard(
+			[]models.InlineKeyboardButton{{Text: "💾 Save", CallbackData: "setup_save"}},
+			[]models.InlineKeyboardButton{{Text: "🔄 Start over", CallbackData: "setup_restart"}},
+		))
+	}
+}
+func (w *SetupWizard) send(ctx context.Context, chatID int64, text string, markup models.ReplyMarkup) {
+	params := &bot.SendMessageParams{ChatID: chatID, Text: text}
+	if markup != nil {
+		params.ReplyMarkup = markup
+	}
+	if _, err := w.bot.SendMessage(ctx, params); err != nil {
+		w.logger.Error("Failed to send setup message to %d: %v", chatID, err)
+	}
+}
+func setupKeyboard(rows ...[]models.InlineKeyboardButton) *models.InlineKeyboardMarkup {
+	return &models.InlineKeyboardMarkup{InlineKeyboard: rows}
+}
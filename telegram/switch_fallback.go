@@ -0,0 +1,107 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"xray-telegram-manager/audit"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/notifications"
+	"xray-telegram-manager/types"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// maxFallbackAttempts is how many backup servers switch_fallback auto tries in turn
+const maxFallbackAttempts = 2
+
+// switchFailure is a server that could not be switched to
+type switchFailure struct {
+	server types.Server
+	err    error
+}
+
+// handleSwitchFailure reports that switching to target failed. Depending on
+// switch_fallback it offers the fastest server of the last pings, or switches to
+// the fastest ones in turn until one works.
+func (tb *TelegramBot) handleSwitchFailure(ctx context.Context, b *bot.Bot, chatID int64, target *types.Server, switchErr error, initiator *models.User) {
+	mode := tb.config.GetSwitchFallback()
+	exclude := []string{target.ID}
+	if current := tb.serverMgr.GetCurrentServer(); current != nil {
+		exclude = append(exclude, current.ID)
+	}
+	var backups []types.Server
+	switch mode {
+	case config.SwitchFallbackOffer:
+		backups = tb.serverMgr.GetBackupServers(exclude, 1)
+	case config.SwitchFallbackAuto:
+		backups = tb.serverMgr.GetBackupServers(exclude, maxFallbackAttempts)
+	}
+
+	if mode != config.SwitchFallbackAuto || len(backups) == 0 {
+		var backup *types.Server
+		if len(backups) > 0 {
+			backup = &backups[0]
+		}
+		// Force cleanup the user's active message since the operation failed
+		tb.messageManager.ForceCleanupUser(chatID, "server switch failed")
+		tb.sendSwitchErrorMessage(ctx, b, chatID, target, switchErr, backup)
+		return
+	}
+
+	messageFormatter := NewMessageFormatter()
+	failures := []switchFailure{{server: *target, err: switchErr}}
+	for _, backup := range backups {
+		tb.logger.Info("Trying backup server %s after the failed switch to %s", backup.Name, target.Name)
+		progressContent := MessageContent{
+			Text: messageFormatter.FormatFallbackProgress(failures, backup),
+			Type: MessageTypeStatus,
+		}
+		_ = tb.messageManager.SendOrEdit(ctx, chatID, progressContent)
+
+		if err := tb.serverMgr.SwitchServer(ctx, backup.ID); err != nil {
+			if ctx.Err() != nil {
+				tb.logger.Info("Backup switch to %s for user %d canceled: %v", backup.Name, chatID, err)
+				return
+			}
+			tb.logger.Error("Switch to backup server %s failed: %v", backup.Name, err)
+			failures = append(failures, switchFailure{server: backup, err: err})
+			continue
+		}
+
+		tb.logger.Info("Switched to backup server %s instead of %s", backup.Name, target.Name)
+		tb.listCache.invalidate()
+		tb.recordSwitch(ctx, chatID, initiator, backup.Name, audit.ReasonFallback)
+		tb.notifyExcept(ctx, notifications.EventAutoSwitch, messageFormatter.FormatAutoSwitchNotice(*target, backup, getUsername(initiator)), nil, chatID)
+
+		keyboard := NewNavigationHelper().CreateServerStatusNavigationKeyboard(true)
+		tb.addPreviousServerButton(keyboard)
+		successContent := MessageContent{
+			Text:        messageFormatter.FormatFallbackSwitched(failures, backup),
+			ReplyMarkup: keyboard,
+			Type:        MessageTypeStatus,
+		}
+		if err := tb.messageManager.SendOrEdit(ctx, chatID, successContent); err != nil {
+			tb.logger.Error("Failed to send backup switch message: %v", err)
+		}
+		return
+	}
+
+	tb.messageManager.ForceCleanupUser(chatID, "server switch failed")
+	failedContent := MessageContent{
+		Text:        messageFormatter.FormatFallbackFailed(failures, tb.serverMgr.GetCurrentServer()),
+		ReplyMarkup: NewNavigationHelper().CreateErrorNavigationKeyboard("server_switch", "refresh"),
+		Type:        MessageTypeStatus,
+	}
+	if err := tb.messageManager.SendOrEdit(ctx, chatID, failedContent); err != nil {
+		tb.logger.Error("Failed to send backup switch failure message: %v", err)
+	}
+}
+
+// formatActiveServer describes the server that is active after a failed switch
+func formatActiveServer(current *types.Server) string {
+	if current == nil {
+		return "🟡 Active now: unknown server"
+	}
+	return fmt.Sprintf("🟢 Active now: %s", current.Name)
+}
@@ -0,0 +1,181 @@
+package telegram
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+	"xray-telegram-manager/httpclient"
+)
+
+const (
+	// releaseAssetPrefix starts the names of the release binaries, the tag and the
+	// architecture follow, e.g. xray-telegram-manager-v1.2.0-mips-softfloat
+	releaseAssetPrefix = "xray-telegram-manager-"
+	// downloadProgressStep is how many percent of the binary pass between progress updates
+	downloadProgressStep = 5
+	// maxChecksumSize caps the checksum file of an asset
+	maxChecksumSize = 1 << 10
+)
+
+// releaseArch returns the architecture suffix of the release binaries matching this
+// build, empty when none are released for it
+func releaseArch() string {
+	goarch := runtime.GOARCH
+	if goarch != "mips" && goarch != "mipsle" {
+		return ""
+	}
+	float := "hardfloat"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "GOMIPS" && setting.Value == "softfloat" {
+				float = "softfloat"
+			}
+		}
+	}
+	return goarch + "-" + float
+}
+
+// asset returns the asset of the release with the given name, nil when it has none
+func (r *GitHubRelease) asset(name string) *GitHubAsset {
+	for i := range r.Assets {
+		if r.Assets[i].Name == name {
+			return &r.Assets[i]
+		}
+	}
+	return nil
+}
+
+// downloadRelease downloads the binary of the latest release for the update script.
+// A dropped connection resumes where it stopped and the speed is capped by the
+// configured limit. It returns the path of the binary, empty when the script has to
+// download it itself: with an uploaded script, for builds without released binaries
+// or when the download failed.
+func (um *UpdateManager) downloadRelease(ctx context.Context) string {
+	if script, err := um.CustomScript(); err != nil || script != nil {
+		return ""
+	}
+	arch := releaseArch()
+	if arch == "" {
+		um.logger.Debug("No release binaries for %s, the update script downloads the new version", runtime.GOARCH)
+		return ""
+	}
+	release, err := um.fetchLatestRelease(ctx)
+	if err != nil {
+		um.logger.Warn("Failed to get the latest release, the update script downloads it: %v", err)
+		return ""
+	}
+	name := releaseAssetPrefix + release.TagName + "-" + arch
+	asset := release.asset(name)
+	if asset == nil {
+		um.logger.Warn("Release %s has no binary %s, the update script downloads it", release.TagName, name)
+		return ""
+	}
+	path := filepath.Join(um.tempDir, name)
+	if !um.isValidScriptPath(path) {
+		um.logger.Warn("Invalid binary path %s, the update script downloads the release", path)
+		return ""
+	}
+
+	// A binary left by an update that was stopped after the download is reused
+	if info, err := os.Stat(path); err != nil || asset.Size <= 0 || info.Size() != asset.Size {
+		um.updateProgress("downloading_binary", 11, fmt.Sprintf("Downloading %s...", release.TagName))
+		err := um.httpClient.Download(ctx, asset.URL, path, httpclient.DownloadOptions{
+			RateLimit: um.downloadLimit,
+			Progress:  um.downloadProgress(release.TagName),
+		})
+		if err != nil {
+			um.logger.Warn("Failed to download %s, the update script tries again: %v", name, err)
+			um.updateProgress("downloading_binary", 19, "Download failed, the updater tries again...")
+			return ""
+		}
+	}
+
+	if err := um.verifyAsset(ctx, release, name, path); err != nil {
+		um.logger.Warn("Downloaded %s is damaged, the update script downloads it again: %v", name, err)
+		if err := os.Remove(path); err != nil {
+			um.logger.Warn("Failed to remove %s: %v", path, err)
+		}
+		return ""
+	}
+	um.logger.Info("Downloaded %s for the update", name)
+	return path
+}
+
+// downloadProgress reports the download of the binary between 11% and 19% of the
+// update, every few percent or every few seconds while the size is unknown
+func (um *UpdateManager) downloadProgress(tag string) func(done, total int64) {
+	lastPercent := -downloadProgressStep
+	var lastReport time.Time
+	limit := ""
+	if um.downloadLimit > 0 {
+		limit = fmt.Sprintf(" at up to %s/s", formatBytes(um.downloadLimit))
+	}
+	return func(done, total int64) {
+		if total <= 0 {
+			if time.Since(lastReport) < 2*time.Second {
+				return
+			}
+			lastReport = time.Now()
+			um.updateProgress("downloading_binary", 11, fmt.Sprintf("Downloading %s: %s%s", tag, formatBytes(done), limit))
+			return
+		}
+		percent := int(done * 100 / total)
+		if percent < lastPercent+downloadProgressStep && done != total {
+			return
+		}
+		lastPercent = percent
+		um.updateProgress("downloading_binary", 11+percent*8/100,
+			fmt.Sprintf("Downloading %s: %s of %s (%d%%)%s", tag, formatBytes(done), formatBytes(total), percent, limit))
+	}
+}
+
+// verifyAsset compares the file at path with the ".sha256" asset published next to
+// it. A release without checksums is accepted.
+func (um *UpdateManager) verifyAsset(ctx context.Context, release *GitHubRelease, name, path string) error {
+	checksumAsset := release.asset(name + ".sha256")
+	if checksumAsset == nil {
+		um.logger.Debug("Release %s has no checksum for %s", release.TagName, name)
+		return nil
+	}
+	resp, err := um.httpClient.Get(ctx, checksumAsset.URL)
+	if err != nil {
+		return fmt.Errorf("failed to download the checksum: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("checksum download returned status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxChecksumSize))
+	if err != nil {
+		return fmt.Errorf("failed to read the checksum: %w", err)
+	}
+	// The file holds "<hex>  <name>" as written by sha256sum
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return fmt.Errorf("empty checksum file")
+	}
+	expected := strings.ToLower(fields[0])
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return fmt.Errorf("failed to read the binary: %w", err)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		return fmt.Errorf("sha256 %s, expected %s", actual, expected)
+	}
+	return nil
+}
@@ -1,33 +1,43 @@
 package telegram
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
-)
-
-// Version information - will be set by build flags
-var (
-	CurrentVersion = "dev"
-	BuildTime      = "unknown"
-	GoVersion      = "unknown"
+	"xray-telegram-manager/clock"
+	"xray-telegram-manager/fsutil"
+	"xray-telegram-manager/httpclient"
+	"xray-telegram-manager/version"
 )
 
 // GitHub API response for releases
 type GitHubRelease struct {
-	TagName     string `json:"tag_name"`
-	Name        string `json:"name"`
-	Draft       bool   `json:"draft"`
-	PreRelease  bool   `json:"prerelease"`
-	PublishedAt string `json:"published_at"`
-	Body        string `json:"body"`
+	TagName     string        `json:"tag_name"`
+	Name        string        `json:"name"`
+	Draft       bool          `json:"draft"`
+	PreRelease  bool          `json:"prerelease"`
+	PublishedAt string        `json:"published_at"`
+	Body        string        `json:"body"`
+	Assets      []GitHubAsset `json:"assets"`
+}
+
+// GitHubAsset is a file attached to a release
+type GitHubAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+	Size int64  `json:"size"`
 }
 
 // VersionInfo contains version comparison information
@@ -39,6 +49,46 @@ type VersionInfo struct {
 	PublishedAt     string
 }
 
+const (
+	// updateProgressFile is where the detached update script appends its stages as
+	// "stage|percent|message" lines, see scripts/update.sh
+	updateProgressFile = "/opt/etc/xray-manager/update-progress"
+	// updatePendingFile remembers the progress message of an update across the
+	// restart of the bot, so the new process can report the final status
+	updatePendingFile = "/opt/etc/xray-manager/update-pending.json"
+	// updateStatusFile keeps the last update attempt, so its status survives the
+	// restart every update ends with
+	updateStatusFile = "/opt/etc/xray-manager/update-status.json"
+
+	// Stages written by the update script when it ends
+	updateStageDone   = "done"
+	updateStageFailed = "failed"
+
+	// updateLogFile receives the output of the update script, the log of the run
+	// before is kept with a ".1" suffix
+	updateLogFile = "/tmp/xray-tg-update.log"
+	// maxUpdateLogSize caps the update logs in /tmp, which is in RAM on routers
+	maxUpdateLogSize = 256 << 10
+
+	// updateProgressPoll is how often the progress file is read while the script runs
+	updateProgressPoll = 500 * time.Millisecond
+	// updateResultWait is how long the restarted bot waits for the script to write
+	// its final stage, the script checks the service for a few seconds after the start
+	updateResultWait = 15 * time.Second
+)
+
+// updateArtifactPatterns match the files an update leaves in the temp directory when
+// the bot is stopped before it could clean up: downloaded scripts, binaries and archives
+var updateArtifactPatterns = []string{
+	"update-script-*.sh",
+	"xray-telegram-manager.[0-9]*",
+	"xray-telegram-manager-*.tar.gz",
+	"xray-telegram-manager-*-*",
+}
+
+// ansiEscape matches the color codes of the update script output
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
 // getAvailableShell returns the path to an available shell, preferring bash over sh
 func getAvailableShell() string {
 	shells := []string{"/bin/bash", "/usr/bin/bash", "/bin/sh", "/usr/bin/sh"}
@@ -56,10 +106,24 @@ type UpdateManager struct {
 	scriptURL    string
 	timeout      time.Duration
 	backupConfig bool
-	logger       Logger
-	mutex        sync.RWMutex
-	updateStatus UpdateStatus
-	progressChan chan UpdateProgress
+	// downloadLimit caps the download of the release binary in bytes per second
+	downloadLimit int64
+	logger        Logger
+	httpClient    *httpclient.Client
+	mutex         sync.RWMutex
+	updateStatus  UpdateStatus
+	progressChan  chan UpdateProgress
+	progressPath  string
+	pendingPath   string
+	statusPath    string
+	// customScriptPath is the uploaded update script, see SetCustomScript
+	customScriptPath string
+	// progressChatID and progressMessageID locate the progress message of the next update
+	progressChatID    int64
+	progressMessageID int
+	logPath           string
+	tempDir           string
+	clock             clock.Clock
 }
 
 // UpdateStatus represents the current status of an update operation
@@ -70,6 +134,21 @@ type UpdateStatus struct {
 	Error       error
 	StartedAt   time.Time
 	CompletedAt time.Time
+	// FromVersion is the version the update started from, ToVersion the one that ran
+	// after the bot was restarted by the update
+	FromVersion string
+	ToVersion   string
+}
+
+// savedUpdateStatus is the on-disk format of the last update attempt
+type savedUpdateStatus struct {
+	Stage       string    `json:"stage"`
+	Progress    int       `json:"progress"`
+	Error       string    `json:"error,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+	FromVersion string    `json:"from_version"`
+	ToVersion   string    `json:"to_version,omitempty"`
 }
 
 // UpdateProgress represents progress updates during the update process
@@ -80,6 +159,28 @@ type UpdateProgress struct {
 	Error    error
 }
 
+// UpdateResult is the outcome of an update that restarted the bot, read back by the
+// new process from the files the update script left behind
+type UpdateResult struct {
+	ChatID      int64     `json:"chat_id"`
+	MessageID   int       `json:"message_id"`
+	FromVersion string    `json:"from_version"`
+	StartedAt   time.Time `json:"started_at"`
+	// Stage and Message are the last stage the script reported
+	Stage   string `json:"-"`
+	Message string `json:"-"`
+}
+
+// Succeeded reports whether the update script finished all stages
+func (r *UpdateResult) Succeeded() bool {
+	return r.Stage == updateStageDone
+}
+
+// Failed reports whether the update script reported a failure
+func (r *UpdateResult) Failed() bool {
+	return r.Stage == updateStageFailed
+}
+
 // UpdateManagerInterface defines the interface for update operations
 type UpdateManagerInterface interface {
 	ExecuteUpdate(ctx context.Context) error
@@ -89,10 +190,18 @@ type UpdateManagerInterface interface {
 	GetUpdateStatus() UpdateStatus
 	StartProgressMonitoring() <-chan UpdateProgress
 	StopProgressMonitoring()
+	TrackProgressMessage(chatID int64, messageID int)
+	TakeUpdateResult(ctx context.Context) (*UpdateResult, error)
+	CleanupArtifacts()
+	HasUpdateLog() bool
+	ReadUpdateLog(maxBytes int) (string, time.Time, error)
+	CustomScript() (*CustomScript, error)
+	SetCustomScript(script CustomScript, data []byte) error
+	ResetCustomScript() error
 }
 
 // NewUpdateManager creates a new UpdateManager instance
-func NewUpdateManager(scriptURL string, timeout time.Duration, backupConfig bool, logger Logger) *UpdateManager {
+func NewUpdateManager(scriptURL string, timeout time.Duration, backupConfig bool, downloadLimit int64, httpClient *httpclient.Client, logger Logger) *UpdateManager {
 	if scriptURL == "" {
 		scriptURL = "https://raw.githubusercontent.com/ad/xray-subscription-telegram-manager-for-keenetic/main/scripts/update.sh"
 	}
@@ -100,14 +209,31 @@ func NewUpdateManager(scriptURL string, timeout time.Duration, backupConfig bool
 		timeout = 10 * time.Minute
 	}
 
-	return &UpdateManager{
-		scriptURL:    scriptURL,
-		timeout:      timeout,
-		backupConfig: backupConfig,
-		logger:       logger,
-		updateStatus: UpdateStatus{},
-		progressChan: make(chan UpdateProgress, 10),
+	um := &UpdateManager{
+		scriptURL:        scriptURL,
+		timeout:          timeout,
+		backupConfig:     backupConfig,
+		downloadLimit:    downloadLimit,
+		logger:           logger,
+		httpClient:       httpClient,
+		updateStatus:     UpdateStatus{},
+		progressChan:     make(chan UpdateProgress, 10),
+		progressPath:     updateProgressFile,
+		pendingPath:      updatePendingFile,
+		statusPath:       updateStatusFile,
+		customScriptPath: customScriptFile,
+		logPath:          updateLogFile,
+		tempDir:          os.TempDir(),
+		clock:            clock.Real,
 	}
+	um.loadStatus()
+	return um
+}
+
+// SetClock replaces the clock used for status times and progress polling, for tests.
+// It must be called before the manager is used.
+func (um *UpdateManager) SetClock(c clock.Clock) {
+	um.clock = c
 }
 
 // ExecuteUpdate performs the bot update process
@@ -119,17 +245,20 @@ func (um *UpdateManager) ExecuteUpdate(ctx context.Context) error {
 	}
 
 	um.updateStatus = UpdateStatus{
-		InProgress: true,
-		StartedAt:  time.Now(),
-		Stage:      "initializing",
-		Progress:   0,
+		InProgress:  true,
+		StartedAt:   um.clock.Now(),
+		Stage:       "initializing",
+		Progress:    0,
+		FromVersion: um.GetCurrentVersion(),
 	}
+	um.saveStatusLocked()
 	um.mutex.Unlock()
 
 	defer func() {
 		um.mutex.Lock()
 		um.updateStatus.InProgress = false
-		um.updateStatus.CompletedAt = time.Now()
+		um.updateStatus.CompletedAt = um.clock.Now()
+		um.saveStatusLocked()
 		um.mutex.Unlock()
 	}()
 
@@ -139,12 +268,11 @@ func (um *UpdateManager) ExecuteUpdate(ctx context.Context) error {
 	updateCtx, cancel := context.WithTimeout(ctx, um.timeout)
 	defer cancel()
 
-	// Step 1: Download update script (25% progress)
-	um.updateProgress("downloading", 25, "Downloading update script...")
-	scriptPath, err := um.downloadScript(updateCtx)
+	// Step 1: Download the update script, or take the uploaded one
+	scriptPath, err := um.prepareScript(updateCtx)
 	if err != nil {
 		um.updateError(err)
-		return fmt.Errorf("failed to download update script: %w", err)
+		return fmt.Errorf("failed to prepare update script: %w", err)
 	}
 	defer func() {
 		if err := os.Remove(scriptPath); err != nil {
@@ -152,31 +280,394 @@ func (um *UpdateManager) ExecuteUpdate(ctx context.Context) error {
 		}
 	}() // Clean up downloaded script
 
-	// Step 2: Backup configuration if enabled (50% progress)
+	// The binary is downloaded here, where an interrupted download resumes, the
+	// script downloads it itself when this fails
+	binaryPath := um.downloadRelease(updateCtx)
+
+	// Step 2: Backup configuration if enabled
 	if um.backupConfig {
-		um.updateProgress("backing_up", 50, "Creating configuration backup...")
+		um.updateProgress("backing_up", 20, "Creating configuration backup...")
 		if err := um.createConfigBackup(updateCtx); err != nil {
 			um.logger.Warn("Failed to create config backup (continuing anyway): %v", err)
 			// Don't fail the update if backup fails, just log it
 		}
 	} else {
-		um.updateProgress("preparing", 50, "Preparing for update...")
+		um.updateProgress("preparing", 20, "Preparing for update...")
 	}
 
-	// Step 3: Execute update script (75% progress)
-	um.updateProgress("installing", 75, "Installing update and restarting service...")
-	if err := um.executeScript(updateCtx, scriptPath); err != nil {
+	um.rotateLog()
+
+	// Step 3: Launch the detached update script. The pending file lets the restarted
+	// bot report the result when this process is stopped by the script.
+	um.updateProgress("launching", 30, "Starting the updater...")
+	if err := os.Remove(um.progressPath); err != nil && !os.IsNotExist(err) {
+		um.logger.Warn("Failed to remove old update progress file: %v", err)
+	}
+	if err := um.savePending(); err != nil {
+		um.logger.Warn("Failed to save pending update, the result will not be reported after the restart: %v", err)
+	}
+	if err := um.executeScript(updateCtx, scriptPath, binaryPath); err != nil {
+		um.removePending()
 		um.updateError(err)
 		return fmt.Errorf("failed to execute update script: %w", err)
 	}
 
-	// Step 4: Verify update completion (100% progress)
-	um.updateProgress("completing", 100, "Update completed successfully")
-	um.logger.Info("Bot update completed successfully - service should be restarted automatically")
+	// Step 4: Relay the stages of the script until it ends or stops this process
+	if err := um.followProgress(updateCtx); err != nil {
+		um.removePending()
+		um.updateError(err)
+		return err
+	}
+	um.removePending()
+	um.logger.Info("Bot update completed successfully")
 
 	return nil
 }
 
+// TrackProgressMessage sets the message that shows the progress of the next update,
+// so its final status can be reported after the bot was restarted
+func (um *UpdateManager) TrackProgressMessage(chatID int64, messageID int) {
+	um.mutex.Lock()
+	defer um.mutex.Unlock()
+	um.progressChatID = chatID
+	um.progressMessageID = messageID
+}
+
+// followProgress reads the stages the update script appends to the progress file and
+// relays them as progress updates. It returns when the script reports done or failed.
+func (um *UpdateManager) followProgress(ctx context.Context) error {
+	ticker := um.clock.NewTicker(updateProgressPoll)
+	defer ticker.Stop()
+
+	var offset int64
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("update script did not finish: %w", ctx.Err())
+		case <-ticker.C():
+		}
+
+		lines, next, err := readProgressLines(um.progressPath, offset)
+		if err != nil {
+			um.logger.Debug("Update progress not available yet: %v", err)
+			continue
+		}
+		offset = next
+		for _, line := range lines {
+			stage, progress, message, ok := parseProgressLine(line)
+			if !ok {
+				um.logger.Warn("Ignoring malformed update progress line: %q", line)
+				continue
+			}
+			switch stage {
+			case updateStageFailed:
+				return errors.New(message)
+			case updateStageDone:
+				um.updateProgress("completing", 100, message)
+				return nil
+			default:
+				um.updateProgress(stage, progress, message)
+			}
+		}
+	}
+}
+
+// TakeUpdateResult returns the result of an update that restarted the bot, or nil
+// when no update was pending. It waits a little for the final stage of the script
+// and removes the files of the update.
+func (um *UpdateManager) TakeUpdateResult(ctx context.Context) (*UpdateResult, error) {
+	data, err := os.ReadFile(um.pendingPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	defer um.removePending()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pending update: %w", err)
+	}
+
+	var result UpdateResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse pending update: %w", err)
+	}
+
+	deadline := um.clock.NewTimer(updateResultWait)
+	defer deadline.Stop()
+	ticker := um.clock.NewTicker(updateProgressPoll)
+	defer ticker.Stop()
+	for {
+		if lines, _, err := readProgressLines(um.progressPath, 0); err == nil && len(lines) > 0 {
+			result.Stage, _, result.Message, _ = parseProgressLine(lines[len(lines)-1])
+		}
+		if result.Succeeded() || result.Failed() {
+			um.settleStatus(&result)
+			return &result, nil
+		}
+		select {
+		case <-ctx.Done():
+			um.settleStatus(&result)
+			return &result, nil
+		case <-deadline.C():
+			um.settleStatus(&result)
+			return &result, nil
+		case <-ticker.C():
+		}
+	}
+}
+
+// loadStatus restores the last update attempt saved by the process before. An
+// attempt without an end was cut by the restart of the bot, it ends now and its
+// outcome is settled when the result of the update script is read.
+func (um *UpdateManager) loadStatus() {
+	data, err := os.ReadFile(um.statusPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			um.logger.Warn("Failed to read the last update status: %v", err)
+		}
+		return
+	}
+	var saved savedUpdateStatus
+	if err := json.Unmarshal(data, &saved); err != nil {
+		um.logger.Warn("Failed to parse the last update status: %v", err)
+		return
+	}
+
+	status := UpdateStatus{
+		Stage:       saved.Stage,
+		Progress:    saved.Progress,
+		StartedAt:   saved.StartedAt,
+		CompletedAt: saved.CompletedAt,
+		FromVersion: saved.FromVersion,
+		ToVersion:   saved.ToVersion,
+	}
+	if saved.Error != "" {
+		status.Error = errors.New(saved.Error)
+	}
+	if status.CompletedAt.IsZero() {
+		status.CompletedAt = um.clock.Now()
+		status.ToVersion = um.GetCurrentVersion()
+	}
+
+	um.mutex.Lock()
+	defer um.mutex.Unlock()
+	um.updateStatus = status
+	if saved.CompletedAt.IsZero() {
+		um.saveStatusLocked()
+	}
+}
+
+// settleStatus records the outcome reported by the update script for the attempt
+// that restarted the bot
+func (um *UpdateManager) settleStatus(result *UpdateResult) {
+	um.mutex.Lock()
+	defer um.mutex.Unlock()
+	if um.updateStatus.StartedAt.IsZero() || um.updateStatus.Error != nil {
+		return
+	}
+	switch {
+	case result.Succeeded():
+		um.updateStatus.Stage = updateStageDone
+		um.updateStatus.Progress = 100
+	case result.Failed():
+		um.updateStatus.Stage = updateStageFailed
+		um.updateStatus.Error = errors.New(result.Message)
+	default:
+		if um.updateStatus.ToVersion != um.updateStatus.FromVersion {
+			return
+		}
+		stage := result.Stage
+		if stage == "" {
+			stage = um.updateStatus.Stage
+		}
+		um.updateStatus.Error = fmt.Errorf("the updater did not report the end of the update, last stage: %s", stage)
+	}
+	um.saveStatusLocked()
+}
+
+// saveStatusLocked writes the update status to disk, the caller holds the mutex
+func (um *UpdateManager) saveStatusLocked() {
+	status := um.updateStatus
+	saved := savedUpdateStatus{
+		Stage:       status.Stage,
+		Progress:    status.Progress,
+		StartedAt:   status.StartedAt,
+		CompletedAt: status.CompletedAt,
+		FromVersion: status.FromVersion,
+		ToVersion:   status.ToVersion,
+	}
+	if status.Error != nil {
+		saved.Error = status.Error.Error()
+	}
+	data, err := json.Marshal(saved)
+	if err == nil {
+		err = fsutil.WriteShared(um.statusPath, data)
+	}
+	if err != nil {
+		um.logger.Warn("Failed to save the update status: %v", err)
+	}
+}
+
+// CleanupArtifacts removes the files earlier updates left in the temp directory and
+// caps the update logs. It is called at startup, when no update runs.
+func (um *UpdateManager) CleanupArtifacts() {
+	for _, pattern := range updateArtifactPatterns {
+		matches, err := filepath.Glob(filepath.Join(um.tempDir, pattern))
+		if err != nil {
+			continue
+		}
+		for _, path := range matches {
+			if err := os.Remove(path); err != nil {
+				um.logger.Warn("Failed to remove stale update file %s: %v", path, err)
+				continue
+			}
+			um.logger.Info("Removed stale update file %s", path)
+		}
+	}
+
+	for _, path := range []string{um.logPath, um.logPath + ".1"} {
+		if err := capFile(path, maxUpdateLogSize); err != nil {
+			um.logger.Warn("Failed to cap update log %s: %v", path, err)
+		}
+	}
+}
+
+// rotateLog keeps the log of the previous update before the script overwrites it
+func (um *UpdateManager) rotateLog() {
+	if err := os.Rename(um.logPath, um.logPath+".1"); err != nil && !os.IsNotExist(err) {
+		um.logger.Warn("Failed to rotate update log: %v", err)
+	}
+}
+
+// HasUpdateLog reports whether the log of the last update exists
+func (um *UpdateManager) HasUpdateLog() bool {
+	info, err := os.Stat(um.logPath)
+	return err == nil && info.Size() > 0
+}
+
+// ReadUpdateLog returns at most the last maxBytes of the last update log without
+// color codes, and when it was last written
+func (um *UpdateManager) ReadUpdateLog(maxBytes int) (string, time.Time, error) {
+	file, err := os.Open(um.logPath)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	offset := info.Size() - int64(maxBytes)
+	if offset < 0 {
+		offset = 0
+	}
+	data := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(data, offset); err != nil && err != io.EOF {
+		return "", time.Time{}, err
+	}
+
+	text := strings.ToValidUTF8(ansiEscape.ReplaceAllString(string(data), ""), "")
+	if offset > 0 {
+		// Start at a full line
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			text = text[i+1:]
+		}
+	}
+	return strings.TrimSpace(text), info.ModTime(), nil
+}
+
+// capFile keeps only the last maxBytes of a file
+func capFile(path string, maxBytes int64) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil || info.Size() <= maxBytes {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, maxBytes)
+	_, err = file.ReadAt(data, info.Size()-maxBytes)
+	file.Close()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// savePending writes the pending update file for the tracked progress message
+func (um *UpdateManager) savePending() error {
+	um.mutex.RLock()
+	pending := UpdateResult{
+		ChatID:      um.progressChatID,
+		MessageID:   um.progressMessageID,
+		FromVersion: um.GetCurrentVersion(),
+		StartedAt:   um.updateStatus.StartedAt,
+	}
+	um.mutex.RUnlock()
+	if pending.MessageID == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	return fsutil.WritePrivate(um.pendingPath, data)
+}
+
+// removePending removes the files of a finished update
+func (um *UpdateManager) removePending() {
+	for _, path := range []string{um.pendingPath, um.progressPath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			um.logger.Warn("Failed to remove %s: %v", path, err)
+		}
+	}
+}
+
+// readProgressLines returns the complete lines of the progress file after offset and
+// the offset to continue from
+func readProgressLines(path string, offset int64) ([]string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, offset, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+
+	var lines []string
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// A partial line is read again once the script finished writing it
+			return lines, offset, nil
+		}
+		offset += int64(len(line))
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+}
+
+// parseProgressLine splits a "stage|percent|message" line of the update script
+func parseProgressLine(line string) (stage string, progress int, message string, ok bool) {
+	parts := strings.SplitN(line, "|", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return "", 0, "", false
+	}
+	progress, err := strconv.Atoi(parts[1])
+	if err != nil || progress < 0 || progress > 100 {
+		return "", 0, "", false
+	}
+	return parts[0], progress, parts[2], true
+}
+
 // CheckUpdateAvailable checks if an update is available by querying GitHub releases
 func (um *UpdateManager) CheckUpdateAvailable() (bool, string, error) {
 	versionInfo, err := um.GetVersionInfo()
@@ -216,37 +707,48 @@ func (um *UpdateManager) GetVersionInfo() (*VersionInfo, error) {
 
 // getLatestReleaseFromGitHub fetches the latest release from GitHub API
 func (um *UpdateManager) getLatestReleaseFromGitHub() (string, string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	release, err := um.fetchLatestRelease(ctx)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	// Clean up release notes (limit length)
+	releaseNotes := strings.TrimSpace(release.Body)
+	if len(releaseNotes) > 500 {
+		releaseNotes = releaseNotes[:497] + "..."
+	}
+
+	return release.TagName, releaseNotes, release.PublishedAt, nil
+}
+
+// fetchLatestRelease fetches the latest release with its assets, drafts and
+// pre-releases are refused
+func (um *UpdateManager) fetchLatestRelease(ctx context.Context) (*GitHubRelease, error) {
 	// GitHub API URL for the latest release
 	url := "https://api.github.com/repos/ad/xray-subscription-telegram-manager-for-keenetic/releases/latest"
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(url)
+	resp, err := um.httpClient.Get(ctx, url)
 	if err != nil {
-		return "", "", "", fmt.Errorf("failed to fetch release info: %w", err)
+		return nil, fmt.Errorf("failed to fetch release info: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", "", "", fmt.Errorf("GitHub API returned status %d", resp.StatusCode)
+		return nil, fmt.Errorf("GitHub API returned status %d", resp.StatusCode)
 	}
 
 	var release GitHubRelease
 	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
-		return "", "", "", fmt.Errorf("failed to parse release info: %w", err)
+		return nil, fmt.Errorf("failed to parse release info: %w", err)
 	}
 
 	// Skip draft and pre-release versions
 	if release.Draft || release.PreRelease {
-		return "", "", "", fmt.Errorf("latest release is draft or pre-release")
-	}
-
-	// Clean up release notes (limit length)
-	releaseNotes := strings.TrimSpace(release.Body)
-	if len(releaseNotes) > 500 {
-		releaseNotes = releaseNotes[:497] + "..."
+		return nil, fmt.Errorf("latest release is draft or pre-release")
 	}
-
-	return release.TagName, releaseNotes, release.PublishedAt, nil
+	return &release, nil
 }
 
 // compareVersions compares two version strings
@@ -268,7 +770,7 @@ func (um *UpdateManager) compareVersions(current, latest string) bool {
 
 // GetCurrentVersion returns the current version of the bot
 func (um *UpdateManager) GetCurrentVersion() string {
-	return CurrentVersion
+	return version.Version
 }
 
 // GetUpdateStatus returns the current update status
@@ -293,16 +795,9 @@ func (um *UpdateManager) StopProgressMonitoring() {
 func (um *UpdateManager) downloadScript(ctx context.Context) (string, error) {
 	um.logger.Debug("Downloading update script from: %s", um.scriptURL)
 
-	req, err := http.NewRequestWithContext(ctx, "GET", um.scriptURL, nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
-
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
-	resp, err := client.Do(req)
+	downloadCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	resp, err := um.httpClient.Get(downloadCtx, um.scriptURL)
 	if err != nil {
 		return "", fmt.Errorf("failed to download script: %w", err)
 	}
@@ -357,7 +852,7 @@ func (um *UpdateManager) createConfigBackup(ctx context.Context) error {
 		return fmt.Errorf("failed to create backup directory: %w", err)
 	}
 
-	timestamp := time.Now().Format("20060102-150405")
+	timestamp := um.clock.Now().Format("20060102-150405")
 	backupPath := fmt.Sprintf("%s/config-backup-%s.json", backupDir, timestamp)
 
 	configPath := "/opt/etc/xray-manager/config.json"
@@ -378,8 +873,9 @@ func (um *UpdateManager) createConfigBackup(ctx context.Context) error {
 	return nil
 }
 
-// executeScript executes the update script with proper security measures
-func (um *UpdateManager) executeScript(ctx context.Context, scriptPath string) error {
+// executeScript executes the update script with proper security measures. A binaryPath
+// is handed to the script to install instead of downloading the release.
+func (um *UpdateManager) executeScript(ctx context.Context, scriptPath, binaryPath string) error {
 	um.logger.Debug("Executing update script: %s", scriptPath)
 
 	// Validate script path to prevent path traversal
@@ -393,6 +889,10 @@ func (um *UpdateManager) executeScript(ctx context.Context, scriptPath string) e
 		// Continue anyway, as the shell might still be able to execute it
 	}
 
+	if binaryPath != "" && !um.isValidScriptPath(binaryPath) {
+		return fmt.Errorf("invalid binary path: %s", binaryPath)
+	}
+
 	shell := getAvailableShell()
 	um.logger.Debug("Using shell: %s for script execution", shell)
 
@@ -401,8 +901,14 @@ func (um *UpdateManager) executeScript(ctx context.Context, scriptPath string) e
 		args := []string{
 			"--unit", "xray-telegram-manager-update",
 			"--quiet",
-			shell, scriptPath, "--force",
 		}
+		// The transient unit does not inherit the environment of systemd-run
+		if binaryPath != "" {
+			args = append(args, "--setenv", "XRAY_UPDATE_BINARY="+binaryPath)
+		}
+		args = append(args,
+			shell, "-c", fmt.Sprintf("exec %s '%s' --force --progress-file '%s' >'%s' 2>&1", shell, scriptPath, um.progressPath, um.logPath),
+		)
 		cmd := exec.CommandContext(ctx, "systemd-run", args...)
 		// Minimal env
 		cmd.Env = []string{
@@ -420,12 +926,15 @@ func (um *UpdateManager) executeScript(ctx context.Context, scriptPath string) e
 
 	// Fallback: nohup in background (OpenWrt/BusyBox etc.)
 	// Use sh -c to run nohup and background the process so that stop script doesn't kill it
-	cmd := exec.CommandContext(ctx, shell, "-c", fmt.Sprintf("nohup %s '%s' --force >/tmp/xray-tg-update.log 2>&1 &", shell, scriptPath))
+	cmd := exec.CommandContext(ctx, shell, "-c", fmt.Sprintf("nohup %s '%s' --force --progress-file '%s' >'%s' 2>&1 &", shell, scriptPath, um.progressPath, um.logPath))
 	cmd.Env = []string{
 		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin:/opt/sbin:/opt/bin",
 		"HOME=/root",
 		"SHELL=" + shell,
 	}
+	if binaryPath != "" {
+		cmd.Env = append(cmd.Env, "XRAY_UPDATE_BINARY="+binaryPath)
+	}
 	if err := cmd.Start(); err != nil {
 		um.logger.Error("Failed to start detached update script: %v", err)
 		return fmt.Errorf("failed to start detached updater: %w", err)
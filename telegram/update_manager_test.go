@@ -0,0 +1,95 @@
+package telegram
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"xray-telegram-manager/clock"
+)
+
+func newTestUpdateManager(t *testing.T, fake *clock.Fake) *UpdateManager {
+	t.Helper()
+	dir := t.TempDir()
+	um := NewUpdateManager("", time.Minute, false, 0, nil, testLogger{})
+	um.SetClock(fake)
+	um.progressPath = filepath.Join(dir, "update-progress")
+	um.pendingPath = filepath.Join(dir, "update-pending.json")
+	um.statusPath = filepath.Join(dir, "update-status.json")
+	um.updateStatus = UpdateStatus{}
+	return um
+}
+
+func TestUpdateManagerFollowProgress(t *testing.T) {
+	fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	um := newTestUpdateManager(t, fake)
+	if err := os.WriteFile(um.progressPath, []byte("downloading|40|Downloading...\ndone|100|Updated\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan error, 1)
+	go func() { result <- um.followProgress(context.Background()) }()
+	if !fake.WaitForTimers(1) {
+		t.Fatal("Expected followProgress to poll with a ticker")
+	}
+	select {
+	case err := <-result:
+		t.Fatalf("Expected the progress to be read only on a tick, returned %v", err)
+	default:
+	}
+
+	fake.Advance(updateProgressPoll)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("Expected the update to complete, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("followProgress did not return after the tick")
+	}
+	if status := um.GetUpdateStatus(); status.Progress != 100 || status.Stage != "completing" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+func TestUpdateManagerTakeUpdateResultWaits(t *testing.T) {
+	fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	um := newTestUpdateManager(t, fake)
+	if err := os.WriteFile(um.pendingPath, []byte(`{"chat_id":42,"message_id":7,"from_version":"1.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	type taken struct {
+		result *UpdateResult
+		err    error
+	}
+	done := make(chan taken, 1)
+	go func() {
+		result, err := um.TakeUpdateResult(context.Background())
+		done <- taken{result, err}
+	}()
+	if !fake.WaitForTimers(2) {
+		t.Fatal("Expected TakeUpdateResult to arm its deadline and ticker")
+	}
+
+	// Without a final stage of the script it gives up after updateResultWait
+	fake.Advance(updateResultWait - updateProgressPoll)
+	select {
+	case <-done:
+		t.Fatal("Expected TakeUpdateResult to wait for the final stage")
+	case <-time.After(20 * time.Millisecond):
+	}
+	fake.Advance(updateProgressPoll)
+	select {
+	case got := <-done:
+		if got.err != nil || got.result == nil || got.result.ChatID != 42 || got.result.Succeeded() || got.result.Failed() {
+			t.Fatalf("Unexpected result %+v (%v)", got.result, got.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("TakeUpdateResult did not return after updateResultWait")
+	}
+	if _, err := os.Stat(um.pendingPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the pending update to be removed, got %v", err)
+	}
+}
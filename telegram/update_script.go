@@ -0,0 +1,336 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"xray-telegram-manager/fsutil"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	// customScriptFile is the update script uploaded by the admin, it replaces the
+	// download from the script URL until it is reset
+	customScriptFile = "/opt/etc/xray-manager/update-script.sh"
+	// maxCustomScriptSize limits the size of an uploaded update script
+	maxCustomScriptSize = 256 << 10
+	// scriptSessionTimeout is how long an uploaded script waits for confirmation
+	scriptSessionTimeout = 10 * time.Minute
+)
+
+// CustomScript describes the uploaded update script
+type CustomScript struct {
+	Name       string    `json:"name"`
+	SHA256     string    `json:"sha256"`
+	Size       int       `json:"size"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	UploadedBy string    `json:"uploaded_by"`
+}
+
+// scriptSession is an uploaded update script waiting for confirmation
+type scriptSession struct {
+	expiresAt time.Time
+	script    CustomScript
+	data      []byte
+}
+
+// scriptChecksum returns the hex SHA-256 of a script
+func scriptChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// validateCustomScript checks that data looks like a shell script
+func validateCustomScript(name string, data []byte) error {
+	if !strings.HasSuffix(strings.ToLower(name), ".sh") {
+		return fmt.Errorf("the update script must be a .sh file")
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("the update script is empty")
+	}
+	if len(data) > maxCustomScriptSize {
+		return fmt.Errorf("the update script is too large (%d bytes, at most %d)", len(data), maxCustomScriptSize)
+	}
+	if !bytes.HasPrefix(data, []byte("#!")) {
+		return fmt.Errorf("the update script must start with a shebang line, e.g. #!/bin/sh")
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return fmt.Errorf("the update script is not a text file")
+	}
+	return nil
+}
+
+// customScriptMetaPath is where the checksum and origin of the uploaded script are kept
+func (um *UpdateManager) customScriptMetaPath() string {
+	return strings.TrimSuffix(um.customScriptPath, ".sh") + ".json"
+}
+
+// CustomScript returns the uploaded update script, or nil when updates download the
+// script from the configured URL
+func (um *UpdateManager) CustomScript() (*CustomScript, error) {
+	data, err := os.ReadFile(um.customScriptMetaPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read update script info: %w", err)
+	}
+	var script CustomScript
+	if err := json.Unmarshal(data, &script); err != nil {
+		return nil, fmt.Errorf("failed to parse update script info: %w", err)
+	}
+	return &script, nil
+}
+
+// SetCustomScript stores an uploaded update script, the next updates run it instead
+// of downloading one
+func (um *UpdateManager) SetCustomScript(script CustomScript, data []byte) error {
+	if err := validateCustomScript(script.Name, data); err != nil {
+		return err
+	}
+	if script.SHA256 != scriptChecksum(data) {
+		return fmt.Errorf("the update script checksum does not match")
+	}
+	meta, err := json.MarshalIndent(script, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal update script info: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(um.customScriptPath), 0755); err != nil {
+		return fmt.Errorf("failed to create update script directory: %w", err)
+	}
+	for _, file := range []struct {
+		path string
+		data []byte
+		mode os.FileMode
+	}{{um.customScriptPath, data, 0700}, {um.customScriptMetaPath(), meta, 0600}} {
+		if err := fsutil.WriteFile(file.path, file.data, file.mode); err != nil {
+			return fmt.Errorf("failed to save update script: %w", err)
+		}
+	}
+	um.logger.Info("Update script %s (sha256 %s) stored, updates no longer download the script", script.Name, script.SHA256)
+	return nil
+}
+
+// ResetCustomScript removes the uploaded update script, updates download the script
+// from the configured URL again
+func (um *UpdateManager) ResetCustomScript() error {
+	for _, path := range []string{um.customScriptMetaPath(), um.customScriptPath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove update script: %w", err)
+		}
+	}
+	um.logger.Info("Update script reset to %s", um.scriptURL)
+	return nil
+}
+
+// prepareScript returns a temporary copy of the update script to run: the uploaded
+// one after its checksum is verified, otherwise the one from the script URL
+func (um *UpdateManager) prepareScript(ctx context.Context) (string, error) {
+	script, err := um.CustomScript()
+	if err != nil {
+		return "", err
+	}
+	if script == nil {
+		um.updateProgress("downloading", 10, "Downloading update script...")
+		return um.downloadScript(ctx)
+	}
+
+	um.updateProgress("downloading", 10, "Using the uploaded update script...")
+	data, err := os.ReadFile(um.customScriptPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read uploaded update script: %w", err)
+	}
+	if checksum := scriptChecksum(data); checksum != script.SHA256 {
+		return "", fmt.Errorf("uploaded update script was modified: sha256 %s, expected %s", checksum, script.SHA256)
+	}
+	tmpFile, err := os.CreateTemp("", "update-script-*.sh")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpFile.Name(), 0755)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return "", fmt.Errorf("failed to copy uploaded update script: %w", err)
+	}
+	um.logger.Info("Using uploaded update script %s (sha256 %s)", script.Name, script.SHA256)
+	return tmpFile.Name(), nil
+}
+
+// isUpdateScriptDocument matches documents with the /set_update_script caption
+func (ch *CommandHandlers) isUpdateScriptDocument(update *models.Update) bool {
+	if update.Message == nil || update.Message.Document == nil || update.Message.From == nil {
+		return false
+	}
+	return ch.bot.matchesCommand(update.Message.Caption, "/set_update_script", false)
+}
+
+// handleUpdateScriptDocument checks the uploaded script and asks to confirm its checksum
+func (ch *CommandHandlers) handleUpdateScriptDocument(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	chatID := update.Message.Chat.ID
+	ch.bot.logger.Info("Received /set_update_script from user %d (%s)", userID, username)
+
+	if !ch.bot.isAuthorized(ctx, chatID, userID, PermissionAdmin) {
+		ch.bot.logger.Warn("Unauthorized access attempt from user %d (%s) for /set_update_script command", userID, username)
+		ch.bot.rejectUnauthorized(ctx, b, chatID, update.Message.From, "/set_update_script")
+		return
+	}
+
+	document := update.Message.Document
+	if document.FileSize > maxCustomScriptSize {
+		ch.sendErrorMessage(ctx, b, chatID, "Invalid Update Script",
+			fmt.Sprintf("The script is too large (%d bytes)", document.FileSize), "main_menu")
+		return
+	}
+	data, err := ch.downloadScriptDocument(ctx, b, document.FileID)
+	if err == nil {
+		err = validateCustomScript(document.FileName, data)
+	}
+	if err != nil {
+		ch.bot.logger.Warn("Rejected update script from user %d: %v", userID, err)
+		ch.sendErrorMessage(ctx, b, chatID, "Invalid Update Script", err.Error(), "main_menu")
+		return
+	}
+
+	script := CustomScript{
+		Name:       filepath.Base(document.FileName),
+		SHA256:     scriptChecksum(data),
+		Size:       len(data),
+		UploadedAt: time.Now(),
+		UploadedBy: username,
+	}
+	ch.scriptMutex.Lock()
+	ch.scriptSessions[chatID] = &scriptSession{expiresAt: time.Now().Add(scriptSessionTimeout), script: script, data: data}
+	ch.scriptMutex.Unlock()
+
+	firstLine, _, _ := strings.Cut(string(data), "\n")
+	_, err = b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          chatID,
+		MessageThreadID: ch.bot.topicFor(chatID, MessageTypeMenu),
+		Text:            ch.messageFormatter.FormatUpdateScriptConfirmation(script, firstLine),
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: "✅ Use This Script", CallbackData: "update_script_confirm"}},
+			{{Text: "❌ Cancel", CallbackData: "update_script_cancel"}},
+		}},
+	})
+	if err != nil {
+		ch.bot.logger.Error("Failed to send update script confirmation: %v", err)
+	}
+}
+
+// downloadScriptDocument downloads an uploaded script from Telegram
+func (ch *CommandHandlers) downloadScriptDocument(ctx context.Context, b *bot.Bot, fileID string) ([]byte, error) {
+	file, err := b.GetFile(ctx, &bot.GetFileParams{FileID: fileID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	downloadCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	resp, err := ch.bot.httpClient.Get(downloadCtx, b.FileDownloadLink(file))
+	if err != nil {
+		// The download link contains the bot token, do not leak it through the error
+		return nil, fmt.Errorf("failed to download script")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download script: HTTP %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxCustomScriptSize+1))
+}
+
+// handleUpdateScriptConfirm stores the confirmed script for the next updates
+func (ch *CommandHandlers) handleUpdateScriptConfirm(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
+	ch.scriptMutex.Lock()
+	session, exists := ch.scriptSessions[chatID]
+	delete(ch.scriptSessions, chatID)
+	ch.scriptMutex.Unlock()
+
+	if !exists || time.Now().After(session.expiresAt) {
+		ch.bot.alertCallback(ctx, callbackQueryID, "❌ No pending update script, send it again")
+		return
+	}
+
+	if err := ch.updateManager.SetCustomScript(session.script, session.data); err != nil {
+		ch.bot.logger.Error("Failed to store update script for user %d: %v", chatID, err)
+		ch.bot.answerCallback(ctx, callbackQueryID, "")
+		ch.sendErrorMessage(ctx, b, chatID, "Update Script Not Saved", err.Error(), "main_menu")
+		return
+	}
+
+	ch.bot.answerCallback(ctx, callbackQueryID, "✅ Update script saved")
+	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          chatID,
+		MessageThreadID: ch.bot.topicFor(chatID, MessageTypeMenu),
+		Text: fmt.Sprintf("✅ Update Script Saved\n\n"+
+			"📜 %s\n🔐 SHA-256: %s\n\n"+
+			"/update now runs this script instead of downloading one. Use /reset_update_script to go back to the default.",
+			session.script.Name, session.script.SHA256),
+		ReplyMarkup: ch.navigationHelper.CreateMainMenuKeyboard(),
+	})
+	if err != nil {
+		ch.bot.logger.Error("Failed to send update script result: %v", err)
+	}
+}
+
+// handleUpdateScriptCancel drops the uploaded script
+func (ch *CommandHandlers) handleUpdateScriptCancel(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID string) {
+	ch.scriptMutex.Lock()
+	delete(ch.scriptSessions, chatID)
+	ch.scriptMutex.Unlock()
+
+	ch.bot.answerCallback(ctx, callbackQueryID, "❌ Update script discarded")
+	ch.bot.logger.Info("Update script discarded by user %d", chatID)
+}
+
+// handleResetUpdateScript removes the uploaded script so updates download the default one
+func (ch *CommandHandlers) handleResetUpdateScript(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	chatID := update.Message.Chat.ID
+	ch.bot.logger.Info("Received /reset_update_script command from user %d (%s)", userID, username)
+
+	if !ch.bot.isAuthorized(ctx, chatID, userID, PermissionAdmin) {
+		ch.bot.logger.Warn("Unauthorized access attempt from user %d (%s) for /reset_update_script command", userID, username)
+		ch.bot.rejectUnauthorized(ctx, b, chatID, update.Message.From, "/reset_update_script")
+		return
+	}
+
+	message := "✅ Update Script Reset\n\n/update downloads the update script from the configured URL again."
+	script, err := ch.updateManager.CustomScript()
+	if err == nil && script == nil {
+		message = "ℹ️ No uploaded update script, /update already downloads the script from the configured URL."
+	} else if err = ch.updateManager.ResetCustomScript(); err != nil {
+		ch.bot.logger.Error("Failed to reset update script: %v", err)
+		ch.sendErrorMessage(ctx, b, chatID, "Update Script Not Reset", err.Error(), "main_menu")
+		return
+	}
+
+	_, err = b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          chatID,
+		MessageThreadID: ch.bot.topicFor(chatID, MessageTypeMenu),
+		Text:            message,
+		ReplyMarkup:     ch.navigationHelper.CreateMainMenuKeyboard(),
+	})
+	if err != nil {
+		ch.bot.logger.Error("Failed to send update script reset result: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package telegram
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	// xrayLogLines is how many of the newest relevant log lines are shown
+	xrayLogLines = 60
+	// xrayLogChunkSize keeps every message well below the Telegram limit of 4096 characters
+	xrayLogChunkSize = 3500
+	// xrayLogLineLength cuts very long log lines
+	xrayLogLineLength = 400
+)
+
+// handleXrayLogs shows the end of the xray error log, filtered to outbound problems
+func (tb *TelegramBot) handleXrayLogs(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := update.Message.From.ID
+	username := getUsername(update.Message.From)
+	tb.logger.Info("Received /xraylogs command from user %d (%s)", userID, username)
+
+	if !tb.isAuthorized(ctx, update.Message.Chat.ID, userID, PermissionAdmin) {
+		tb.logger.Warn("Unauthorized access attempt from user %d (%s) for /xraylogs command", userID, username)
+		tb.rejectUnauthorized(ctx, b, update.Message.Chat.ID, update.Message.From, "/xraylogs")
+		return
+	}
+
+	tb.sendXrayLog(ctx, update.Message.Chat.ID, 0)
+}
+
+// handleXrayLogsCallback handles xraylogs_tail, which shows the end of the log again,
+// and xraylogs_follow_<offset>, which shows only the lines written since the last view
+func (tb *TelegramBot) handleXrayLogsCallback(ctx context.Context, b *bot.Bot, chatID int64, callbackQueryID, data string) {
+	tb.answerCallback(ctx, callbackQueryID, "📜 Reading xray log...")
+
+	var offset int64
+	if rawOffset, ok := strings.CutPrefix(data, "xraylogs_follow_"); ok {
+		parsed, err := strconv.ParseInt(rawOffset, 10, 64)
+		if err != nil || parsed <= 0 {
+			tb.logger.Warn("Invalid xray log offset from user %d: %s", chatID, data)
+			return
+		}
+		offset = parsed
+	}
+	tb.sendXrayLog(ctx, chatID, offset)
+}
+
+// sendXrayLog sends the log lines after offset in as many messages as needed, the
+// last one with the follow and refresh buttons
+func (tb *TelegramBot) sendXrayLog(ctx context.Context, chatID int64, offset int64) {
+	log, err := tb.serverMgr.ReadXrayLog(offset, xrayLogLines)
+	if err != nil {
+		tb.logger.Warn("Failed to read xray log: %v", err)
+		tb.sendErrorMessage(ctx, tb.bot, chatID, "Xray Log Unavailable", err.Error(), "main_menu")
+		return
+	}
+
+	messageFormatter := NewMessageFormatter()
+	chunks := messageFormatter.FormatXrayLog(log, offset > 0, xrayLogChunkSize, xrayLogLineLength)
+	keyboard := &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+		{
+			{Text: "⏩ New Lines", CallbackData: "xraylogs_follow_" + strconv.FormatInt(log.Offset, 10)},
+			{Text: "🔄 Refresh", CallbackData: "xraylogs_tail"},
+		},
+		{{Text: "🏠 Main Menu", CallbackData: "main_menu"}},
+	}}
+
+	for i, chunk := range chunks {
+		content := MessageContent{Text: chunk, Type: MessageTypeStatus}
+		if i == len(chunks)-1 {
+			content.ReplyMarkup = keyboard
+		}
+		if err := tb.messageManager.SendNew(ctx, chatID, content); err != nil {
+			tb.logger.Error("Failed to send xray log: %v", err)
+			return
+		}
+	}
+}
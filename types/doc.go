@@ -0,0 +1,3 @@
+// Package types holds the data shared by the server, the service and the bot:
+// servers, xray config structures and the interfaces between the packages.
+package types
@@ -0,0 +1,51 @@
+package types
+
+import "errors"
+
+// Kinds of failures the server manager marks its errors with, so the bot can explain
+// them without parsing messages. Test for them with errors.Is.
+var (
+	// ErrSubscriptionUnreachable is a subscription that could not be fetched while
+	// no cached server list was available
+	ErrSubscriptionUnreachable = errors.New("subscription is unreachable")
+	// ErrSubscriptionInvalid is a subscription that was fetched but has no server
+	// that could be parsed
+	ErrSubscriptionInvalid = errors.New("subscription has no usable servers")
+	// ErrXrayRestartFailed is xray failing to restart or exiting after the restart
+	ErrXrayRestartFailed = errors.New("xray restart failed")
+	// ErrConfigInvalid is an xray config that cannot be read, is not valid JSON or
+	// lacks the outbound the manager replaces
+	ErrConfigInvalid = errors.New("xray config is invalid")
+	// ErrConfigWriteFailed is an xray config that could not be written
+	ErrConfigWriteFailed = errors.New("xray config could not be written")
+	// ErrServerNotFound is a server ID that is not in the current server list
+	ErrServerNotFound = errors.New("server not found")
+)
+
+// KindError marks an error with one of the kinds above. Its message is the message
+// of the error, so marking an error does not change what is logged.
+type KindError struct {
+	Kind error
+	Err  error
+}
+
+// MarkError returns err marked with kind, nil when err is nil
+func MarkError(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &KindError{Kind: kind, Err: err}
+}
+
+func (e *KindError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *KindError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the kind of the error
+func (e *KindError) Is(target error) bool {
+	return target == e.Kind
+}
@@ -1,6 +1,10 @@
 package types
 
-import "time"
+import (
+	"context"
+	"fmt"
+	"time"
+)
 
 // Server represents a proxy server configuration
 type Server struct {
@@ -23,6 +27,61 @@ type Server struct {
 	Settings       map[string]interface{} `json:"settings,omitempty"`
 	StreamSettings map[string]interface{} `json:"streamSettings,omitempty"`
 	VlessUrl       string                 `json:"vlessUrl,omitempty"`
+	// Problems are errors in the parameters of the subscription entry, such as a
+	// malformed Reality key. Switching to such a server is likely to fail.
+	Problems []string `json:"problems,omitempty"`
+	// BlockedCountry is the country of the flag in the name when it is one of
+	// blocked_countries. Such servers are never switched to automatically.
+	BlockedCountry string `json:"-"`
+}
+
+// Misconfigured reports whether the subscription entry of the server has problems
+func (s Server) Misconfigured() bool {
+	return len(s.Problems) > 0
+}
+
+// Blocked reports whether the server exits in a country of blocked_countries
+func (s Server) Blocked() bool {
+	return s.BlockedCountry != ""
+}
+
+// MaxServerNoteLength limits the note the user attaches to a server, in characters
+const MaxServerNoteLength = 60
+
+// MatchConfidence describes how reliably the active xray outbound was matched to a server
+type MatchConfidence string
+
+const (
+	// MatchNone means no server matched the outbound
+	MatchNone MatchConfidence = "none"
+	// MatchFallback means identity keys matched but the address or port differ
+	MatchFallback MatchConfidence = "fallback"
+	// MatchStrong means address, port and security keys all matched
+	MatchStrong MatchConfidence = "strong"
+)
+
+// ServerListChange is what a subscription refresh changed in the server list
+type ServerListChange struct {
+	Added   []Server
+	Removed []Server
+	// Reattached are servers that got a new ID, e.g. after the provider changed the
+	// port, whose user data followed them. They are not in Added and Removed.
+	Reattached []Reattachment
+}
+
+// Empty reports whether the refresh changed nothing
+func (c ServerListChange) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Reattached) == 0
+}
+
+// Reattachment is a server recognized under a new ID by its UUID, host and name
+type Reattachment struct {
+	From Server
+	To   Server
+	// Confidence is how sure the match is, from 0 to 1
+	Confidence float64
+	// Moved names the user data moved to the new ID, e.g. "favorite" and "note"
+	Moved []string
 }
 
 // PingResult represents the result of pinging a server
@@ -33,8 +92,186 @@ type PingResult struct {
 	Success   bool
 	Available bool
 	TestTime  time.Time
+	// Method is how Latency was measured, see PingMethodTCP, PingMethodHandshake,
+	// PingMethodCDN and PingMethodObservatory
+	Method string
+	// Family is the address family the server answered over, see IPv4 and IPv6
+	Family string
+}
+
+// Address families reported in PingResult
+const (
+	IPv4 = "IPv4"
+	IPv6 = "IPv6"
+)
+
+// Availability is the share of checks a server answered over the last day and
+// week. A negative value means the server was not checked in that period.
+type Availability struct {
+	Day  float64
+	Week float64
+}
+
+// Known reports whether the server was checked in the last week
+func (a Availability) Known() bool {
+	return a.Week >= 0
+}
+
+// ServerDigest summarizes the checks of a server over the last day
+type ServerDigest struct {
+	Server Server
+	// Availability is the share of checks the server answered
+	Availability float64
+	// AvgLatency is the average latency of the answered checks, zero when none was answered
+	AvgLatency time.Duration
+	// OutageHours counts the hours in which every check failed
+	OutageHours int
+}
+
+// PingDigest summarizes the checks of all servers over the last day
+type PingDigest struct {
+	// Servers that were checked, answering servers by latency first
+	Servers []ServerDigest
+	// Current is the summary of the current server, nil when it was not checked
+	Current *ServerDigest
+}
+
+// Metrics compared by a ServerComparison
+const (
+	CompareLatency      = "latency"
+	CompareHandshake    = "handshake"
+	CompareAvailability = "availability"
+	CompareStability    = "stability"
+	CompareThroughput   = "throughput"
+)
+
+// ServerMeasurement is what is known about a server when it is compared to another
+type ServerMeasurement struct {
+	Server Server
+	// Ping is a fresh TCP connect check
+	Ping PingResult
+	// Handshake is the TLS or Reality handshake time, zero when the server does not
+	// use one or the handshake failed
+	Handshake time.Duration
+	// Network and Security are the transport and stream security of the server
+	Network  string
+	Security string
+	// Availability is the share of background checks the server answered
+	Availability Availability
+	// Stability is the share of recent pings answered, negative when unknown
+	Stability float64
+	// Throughput is the last measured download speed in bytes per second, zero when
+	// it was never measured
+	Throughput float64
+}
+
+// ServerComparison is the side by side comparison of two servers
+type ServerComparison struct {
+	Servers [2]ServerMeasurement
+	// Better maps each compared metric to the index of the better server, metrics
+	// without data for both servers or with too close values are left out
+	Better map[string]int
+	// Winner is the index of the better server overall, -1 when they are even
+	Winner int
+}
+
+// WinnerServer returns the better server overall, nil when the servers are even
+func (sc ServerComparison) WinnerServer() *Server {
+	if sc.Winner < 0 || sc.Winner > 1 {
+		return nil
+	}
+	return &sc.Servers[sc.Winner].Server
+}
+
+// ReachResult is the outcome of opening a site through a server
+type ReachResult struct {
+	Server Server
+	Domain string
+	// StatusCode is the HTTP status of the first response, redirects are not followed
+	StatusCode int
+	// Latency is the time until the response headers arrived
+	Latency time.Duration
+	// ExitIP and Country are where sites see the requests from, empty when unknown
+	ExitIP      string
+	Country     string
+	CountryFlag string
+	// Error is why the site did not answer, nil when it did
+	Error error
+}
+
+// ConnectivitySnapshot is a quick measurement of a server, taken before and after a
+// switch to show whether it improved the connection
+type ConnectivitySnapshot struct {
+	Server Server
+	// Latency is the time a request through the server took to answer
+	Latency time.Duration
+	// ExitIP and Country are where sites see the requests from
+	ExitIP      string
+	Country     string
+	CountryFlag string
+	// Error is why nothing answered through the server, nil when it did
+	Error error
+}
+
+// Reached reports whether the site answered through the server
+func (r ReachResult) Reached() bool {
+	return r.Error == nil && r.StatusCode > 0
+}
+
+// XrayLog is a part of the xray error log
+type XrayLog struct {
+	Path  string
+	Lines []string
+	// Offset is where the next read continues, the size of the log when it was read
+	Offset int64
+	// Filtered counts the lines dropped as noise
+	Filtered int
 }
 
+// SubscriptionInfo is the traffic quota and expiry reported by the provider in the
+// subscription-userinfo response header. Zero Total means unlimited traffic, zero
+// Expire means no expiry date.
+type SubscriptionInfo struct {
+	Upload    int64     `json:"upload"`
+	Download  int64     `json:"download"`
+	Total     int64     `json:"total"`
+	Expire    int64     `json:"expire"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Used returns the consumed traffic in bytes
+func (si SubscriptionInfo) Used() int64 {
+	return si.Upload + si.Download
+}
+
+// Remaining returns the traffic left in bytes, or -1 for unlimited traffic
+func (si SubscriptionInfo) Remaining() int64 {
+	if si.Total <= 0 {
+		return -1
+	}
+	if remaining := si.Total - si.Used(); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// ExpiresAt returns the expiry time, or the zero time when the subscription does not expire
+func (si SubscriptionInfo) ExpiresAt() time.Time {
+	if si.Expire <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(si.Expire, 0)
+}
+
+// Latency measurement methods reported in PingResult
+const (
+	PingMethodTCP       = "tcp"
+	PingMethodHandshake = "handshake"
+	PingMethodCDN       = "cdn"
+	// PingMethodObservatory is the last probe of the xray observatory
+	PingMethodObservatory = "observatory"
+)
+
 // XrayConfig represents the Xray configuration structure
 type XrayConfig struct {
 	Inbounds  []XrayInbound  `json:"inbounds"`
@@ -55,12 +292,160 @@ type XrayOutbound struct {
 	Protocol       string                 `json:"protocol"`
 	Settings       map[string]interface{} `json:"settings"`
 	StreamSettings map[string]interface{} `json:"streamSettings,omitempty"`
+	Mux            map[string]interface{} `json:"mux,omitempty"`
+}
+
+// OutboundOptions are the anti-DPI options applied to the generated proxy outbound
+type OutboundOptions struct {
+	Mux            bool
+	MuxConcurrency int
+	// Fragment splits the TLS hello through a freedom dialer outbound
+	Fragment         bool
+	FragmentPackets  string
+	FragmentLength   string
+	FragmentInterval string
+	// Noise sends random UDP packets from the same dialer outbound
+	Noise bool
+	// IPFamily is the preferred address family of servers given by domain name,
+	// see config.IPFamilyAuto
+	IPFamily string
+	// Extra fields merged into the generated outbounds, see config.Outbound.Extra
+	Extra map[string]interface{}
+	// PinnedAddress replaces the domain of the server in the outbound, see
+	// config.DNS.PinAddress
+	PinnedAddress string
+}
+
+// PanicResult is the state after the proxy was dropped for direct internet
+type PanicResult struct {
+	// WasDirect is set when the proxy was already paused
+	WasDirect bool
+	// Reachable is the address that answered without the proxy, empty when none did
+	Reachable string
+	// CheckError is why no address answered
+	CheckError error
+}
+
+// OutboundOverride changes some outbound options, nil fields keep the inherited value
+type OutboundOverride struct {
+	Mux      *bool `json:"mux,omitempty"`
+	Fragment *bool `json:"fragment,omitempty"`
+	Noise    *bool `json:"noise,omitempty"`
+}
+
+// Apply sets the overridden options on options
+func (o OutboundOverride) Apply(options *OutboundOptions) {
+	if o.Mux != nil {
+		options.Mux = *o.Mux
+	}
+	if o.Fragment != nil {
+		options.Fragment = *o.Fragment
+	}
+	if o.Noise != nil {
+		options.Noise = *o.Noise
+	}
+}
+
+// RoutingPresetStatus describes a predefined set of routing rules and whether it is installed
+type RoutingPresetStatus struct {
+	ID          string
+	Name        string
+	Description string
+	Enabled     bool
+}
+
+// LoadRetry is an automatic retry of a failed subscription load
+type LoadRetry struct {
+	// Attempt counts the retries from 1, MaxAttempts is the last one
+	Attempt     int
+	MaxAttempts int
+	// At is when the retry runs, zero for a retry that already ran
+	At time.Time
+}
+
+// Summary describes a scheduled retry, e.g. "retrying in 2m (attempt 3 of 5)"
+func (r LoadRetry) Summary(now time.Time) string {
+	wait := r.At.Sub(now)
+	if wait < time.Minute {
+		wait = wait.Round(time.Second)
+		if wait < time.Second {
+			wait = time.Second
+		}
+		return fmt.Sprintf("retrying in %ds (attempt %d of %d)", int(wait.Seconds()), r.Attempt, r.MaxAttempts)
+	}
+	return fmt.Sprintf("retrying in %dm (attempt %d of %d)", int(wait.Round(time.Minute).Minutes()), r.Attempt, r.MaxAttempts)
+}
+
+// AddressChange is a move of the active server's domain to other IP addresses
+type AddressChange struct {
+	Server Server
+	// Previous and Current are the addresses of the domain before and now, sorted
+	Previous []string
+	Current  []string
+}
+
+// LatencyAnomaly is a sudden and lasting rise of the active server's latency
+type LatencyAnomaly struct {
+	Server Server
+	// Baseline is the usual latency, the median of the earlier pings
+	Baseline time.Duration
+	// Current is the latest latency, degraded since Since
+	Current time.Duration
+	Since   time.Time
+	// Alternates are servers that answered faster in their latest ping, fastest first
+	Alternates []PingResult
+}
+
+// InboundStatus is an inbound of the xray config as /inbounds shows it
+type InboundStatus struct {
+	Tag      string
+	Protocol string
+	// Listen is the address the inbound listens on, empty for all addresses
+	Listen string
+	// Port is a number or a range such as "1000-2000"
+	Port string
+	// Managed inbounds were added by the bot and are the only ones it changes
+	Managed bool
+}
+
+// CountryGroup is the servers of one country, recognized by the flag in their names
+type CountryGroup struct {
+	// Code is the ISO 3166 country code, e.g. "DE"
+	Code    string
+	Flag    string
+	Servers int
+}
+
+// Sources the xray config can be recovered from when it is corrupted
+const (
+	// ConfigRecoveryBackup is the latest backup that parses
+	ConfigRecoveryBackup = "backup"
+	// ConfigRecoveryGolden is the snapshot of the last config xray ran fine with
+	ConfigRecoveryGolden = "golden"
+)
+
+// ConfigRecoveryInfo tells which recovery sources are available, zero times mean none
+type ConfigRecoveryInfo struct {
+	BackupTime time.Time
+	GoldenTime time.Time
+}
+
+// ConfigChange is a recorded write of an xray config file
+type ConfigChange struct {
+	Time time.Time `json:"time"`
+	File string    `json:"file"`
+	// Cause tells what the manager changed and during which operation
+	Cause string `json:"cause"`
+	// Diff is the unified diff of the file, cut when it is too long
+	Diff    string `json:"diff"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
 }
 
 // SubscriptionLoader interface for loading servers from subscription
 type SubscriptionLoader interface {
 	LoadServers() ([]Server, error)
-	LoadFromURL() ([]Server, error)
+	LoadFromURL(ctx context.Context) ([]Server, error)
 	InvalidateCache()
 }
 
@@ -73,6 +458,6 @@ type PingTester interface {
 
 // XrayController interface for managing Xray configuration
 type XrayControllerInterface interface {
-	UpdateConfig(server Server) error
+	UpdateConfig(server Server, options OutboundOptions) error
 	RestartXray() error
 }
@@ -0,0 +1,31 @@
+// Package version holds the version of the build. The variables are set by the build
+// flags, e.g. -ldflags "-X xray-telegram-manager/version.Version=v1.2.3", and every
+// package reads them from here, so the version printed at startup, shown in /status
+// and compared by the update check is always the same.
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+var (
+	Version   = "dev"
+	BuildTime = "unknown"
+	GoVersion = "unknown"
+)
+
+// Go returns the Go version the binary was built with, from the runtime when the
+// build did not set it
+func Go() string {
+	if GoVersion == "" || GoVersion == "unknown" {
+		return runtime.Version()
+	}
+	return GoVersion
+}
+
+// String returns the version with the build time and Go version, e.g.
+// "v1.2.3 (built 2026-01-02_10:00:00 with go1.24.1)"
+func String() string {
+	return fmt.Sprintf("v%s (built %s with %s)", Version, BuildTime, Go())
+}
@@ -0,0 +1,22 @@
+package version
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	defer func(version, buildTime, goVersion string) {
+		Version, BuildTime, GoVersion = version, buildTime, goVersion
+	}(Version, BuildTime, GoVersion)
+
+	Version, BuildTime, GoVersion = "1.2.3", "2026-01-02_10:00:00", "go1.24.1"
+	if s := String(); s != "v1.2.3 (built 2026-01-02_10:00:00 with go1.24.1)" {
+		t.Errorf("Unexpected version string %q", s)
+	}
+
+	GoVersion = "unknown"
+	if Go() != runtime.Version() {
+		t.Errorf("Expected the runtime Go version when the build did not set it, got %q", Go())
+	}
+}
@@ -0,0 +1,250 @@
+// Package web serves a small dashboard with the current server, the latency history
+// and the server list, for people who do not use the Telegram bot.
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/logger"
+	"xray-telegram-manager/operations"
+	"xray-telegram-manager/server"
+	"xray-telegram-manager/types"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// shutdownTimeout bounds waiting for running requests when the server stops
+const shutdownTimeout = 5 * time.Second
+
+// webOwner is the owner of operations started from the dashboard
+const webOwner = 0
+
+// ServerManager is the part of the server manager the dashboard uses
+type ServerManager interface {
+	GetServers() []types.Server
+	GetCurrentServer() *types.Server
+	GetServerStats(serverID string) server.ServerStats
+	GetLastRefresh() time.Time
+	IsDirectMode() bool
+	SwitchServer(ctx context.Context, serverID string) error
+	Operations() *operations.Coordinator
+}
+
+// Server is the HTTP server of the dashboard
+type Server struct {
+	config    config.Web
+	serverMgr ServerManager
+	logger    *logger.Logger
+}
+
+// NewServer creates the dashboard server, it does not listen until Start
+func NewServer(cfg config.Web, serverMgr ServerManager, log *logger.Logger) *Server {
+	return &Server{config: cfg, serverMgr: serverMgr, logger: log}
+}
+
+// Start serves the dashboard until ctx is done
+func (s *Server) Start(ctx context.Context) error {
+	httpServer := &http.Server{
+		Addr:              s.config.Listen,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = httpServer.Shutdown(shutdownCtx)
+	}()
+
+	s.logger.Info("Web dashboard listening on %s", s.config.Listen)
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("web dashboard failed: %w", err)
+	}
+	return nil
+}
+
+// Handler returns the routes of the dashboard. The page itself holds no data, the
+// API under /api/ needs the token.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handlePage)
+	mux.Handle("GET /api/status", s.authorized(s.handleStatus))
+	mux.Handle("GET /api/servers", s.authorized(s.handleServers))
+	mux.Handle("GET /api/servers/{id}/history", s.authorized(s.handleHistory))
+	mux.Handle("POST /api/servers/{id}/switch", s.authorized(s.handleSwitch))
+	return mux
+}
+
+// authorized checks the bearer token before calling next
+func (s *Server) authorized(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (s *Server) handlePage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(dashboardPage)
+}
+
+// serverView is a server as shown in the dashboard, without its credentials
+type serverView struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	Current bool   `json:"current"`
+	// LatencyMs is the last measured latency, 0 when unknown or unavailable
+	LatencyMs int64 `json:"latency_ms,omitempty"`
+	Available *bool `json:"available,omitempty"`
+	// Stability is the share of recent pings answered, from 0 to 1
+	Stability *float64 `json:"stability,omitempty"`
+	// BlockedCountry is set for servers in blocked_countries, switching to them
+	// needs confirm_blocked=1
+	BlockedCountry string `json:"blocked_country,omitempty"`
+}
+
+type statusView struct {
+	Current     *serverView `json:"current,omitempty"`
+	DirectMode  bool        `json:"direct_mode"`
+	Servers     int         `json:"servers"`
+	LastRefresh time.Time   `json:"last_refresh,omitempty"`
+	ReadOnly    bool        `json:"read_only"`
+}
+
+func (s *Server) newServerView(srv types.Server, currentID string) serverView {
+	view := serverView{
+		ID:             srv.ID,
+		Name:           srv.Name,
+		Address:        srv.Address,
+		Port:           srv.Port,
+		Current:        srv.ID == currentID,
+		BlockedCountry: srv.BlockedCountry,
+	}
+	stats := s.serverMgr.GetServerStats(srv.ID)
+	if count := len(stats.Samples); count > 0 {
+		last := stats.Samples[count-1]
+		view.Available = &last.Available
+		view.LatencyMs = last.LatencyMs
+	}
+	if stability, ok := stats.Stability(); ok {
+		view.Stability = &stability
+	}
+	return view
+}
+
+func (s *Server) currentID() string {
+	if current := s.serverMgr.GetCurrentServer(); current != nil {
+		return current.ID
+	}
+	return ""
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := statusView{
+		DirectMode:  s.serverMgr.IsDirectMode(),
+		Servers:     len(s.serverMgr.GetServers()),
+		LastRefresh: s.serverMgr.GetLastRefresh(),
+		ReadOnly:    s.config.ReadOnly,
+	}
+	if current := s.serverMgr.GetCurrentServer(); current != nil {
+		view := s.newServerView(*current, current.ID)
+		status.Current = &view
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) handleServers(w http.ResponseWriter, r *http.Request) {
+	currentID := s.currentID()
+	servers := s.serverMgr.GetServers()
+	views := make([]serverView, 0, len(servers))
+	for _, srv := range servers {
+		views = append(views, s.newServerView(srv, currentID))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	serverID := r.PathValue("id")
+	if !s.hasServer(serverID) {
+		writeError(w, http.StatusNotFound, "server not found")
+		return
+	}
+	stats := s.serverMgr.GetServerStats(serverID)
+	samples := stats.Samples
+	if samples == nil {
+		samples = []server.PingSample{}
+	}
+	writeJSON(w, http.StatusOK, samples)
+}
+
+func (s *Server) handleSwitch(w http.ResponseWriter, r *http.Request) {
+	if s.config.ReadOnly {
+		writeError(w, http.StatusForbidden, "the dashboard is read-only")
+		return
+	}
+	serverID := r.PathValue("id")
+	target := s.findServer(serverID)
+	if target == nil {
+		writeError(w, http.StatusNotFound, "server not found")
+		return
+	}
+	if target.Blocked() && r.URL.Query().Get("confirm_blocked") != "1" {
+		writeError(w, http.StatusPreconditionRequired, "the server is in blocked country "+target.BlockedCountry+", confirm with confirm_blocked=1")
+		return
+	}
+
+	// Same lock as switching from the bot, so both cannot rewrite the config at once
+	_, release, err := s.serverMgr.Operations().Acquire(r.Context(), operations.OperationSwitch, webOwner, operations.PolicyReject)
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	defer release()
+
+	s.logger.Info("Switching to server %s from the web dashboard", serverID)
+	if err := s.serverMgr.SwitchServer(r.Context(), serverID); err != nil {
+		s.logger.Error("Web dashboard switch to %s failed: %v", serverID, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.handleStatus(w, r)
+}
+
+func (s *Server) hasServer(serverID string) bool {
+	return s.findServer(serverID) != nil
+}
+
+func (s *Server) findServer(serverID string) *types.Server {
+	for _, srv := range s.serverMgr.GetServers() {
+		if srv.ID == serverID {
+			return &srv
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
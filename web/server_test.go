@@ -0,0 +1,148 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"xray-telegram-manager/config"
+	"xray-telegram-manager/logger"
+	"xray-telegram-manager/operations"
+	"xray-telegram-manager/server"
+	"xray-telegram-manager/types"
+)
+
+const testToken = "dashboard-token-123"
+
+type fakeManager struct {
+	servers    []types.Server
+	current    string
+	stats      map[string]server.ServerStats
+	operations *operations.Coordinator
+	switched   []string
+}
+
+func newFakeManager() *fakeManager {
+	return &fakeManager{
+		servers: []types.Server{
+			{ID: "a", Name: "Amsterdam", Address: "a.example.com", Port: 443, UUID: "secret-uuid"},
+			{ID: "b", Name: "Berlin", Address: "b.example.com", Port: 443},
+		},
+		current: "a",
+		stats: map[string]server.ServerStats{
+			"a": {Samples: []server.PingSample{{Available: true, LatencyMs: 40, At: time.Now()}}},
+		},
+		operations: operations.NewCoordinator(),
+	}
+}
+
+func (m *fakeManager) GetServers() []types.Server { return m.servers }
+
+func (m *fakeManager) GetCurrentServer() *types.Server {
+	for i := range m.servers {
+		if m.servers[i].ID == m.current {
+			return &m.servers[i]
+		}
+	}
+	return nil
+}
+
+func (m *fakeManager) GetServerStats(serverID string) server.ServerStats { return m.stats[serverID] }
+func (m *fakeManager) GetLastRefresh() time.Time                         { return time.Time{} }
+func (m *fakeManager) IsDirectMode() bool                                { return false }
+func (m *fakeManager) Operations() *operations.Coordinator               { return m.operations }
+
+func (m *fakeManager) SwitchServer(ctx context.Context, serverID string) error {
+	m.switched = append(m.switched, serverID)
+	m.current = serverID
+	return nil
+}
+
+func request(handler http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func newTestServer(manager *fakeManager, readOnly bool) http.Handler {
+	cfg := config.Web{Enabled: true, Listen: ":0", Token: testToken, ReadOnly: readOnly}
+	return NewServer(cfg, manager, logger.NewLogger(logger.ERROR, nil)).Handler()
+}
+
+func TestDashboardRequiresToken(t *testing.T) {
+	handler := newTestServer(newFakeManager(), false)
+
+	if got := request(handler, http.MethodGet, "/", "").Code; got != http.StatusOK {
+		t.Errorf("Expected the page to load without a token, got %d", got)
+	}
+	for _, token := range []string{"", "wrong-token-000000000"} {
+		if got := request(handler, http.MethodGet, "/api/servers", token).Code; got != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for token %q, got %d", token, got)
+		}
+	}
+}
+
+func TestDashboardServers(t *testing.T) {
+	handler := newTestServer(newFakeManager(), false)
+
+	recorder := request(handler, http.MethodGet, "/api/servers", testToken)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if strings.Contains(recorder.Body.String(), "secret-uuid") {
+		t.Error("Expected the server credentials not to be exposed")
+	}
+	var servers []serverView
+	if err := json.Unmarshal(recorder.Body.Bytes(), &servers); err != nil {
+		t.Fatalf("Failed to decode servers: %v", err)
+	}
+	if len(servers) != 2 || !servers[0].Current || servers[0].LatencyMs != 40 || servers[1].Available != nil {
+		t.Errorf("Unexpected servers: %+v", servers)
+	}
+
+	if got := request(handler, http.MethodGet, "/api/servers/missing/history", testToken).Code; got != http.StatusNotFound {
+		t.Errorf("Expected 404 for the history of an unknown server, got %d", got)
+	}
+}
+
+func TestDashboardSwitch(t *testing.T) {
+	manager := newFakeManager()
+	handler := newTestServer(manager, false)
+
+	recorder := request(handler, http.MethodPost, "/api/servers/b/switch", testToken)
+	if recorder.Code != http.StatusOK || len(manager.switched) != 1 || manager.current != "b" {
+		t.Fatalf("Expected the switch to b, got %d %v: %s", recorder.Code, manager.switched, recorder.Body)
+	}
+
+	// A running switch from the bot blocks the dashboard
+	_, release, err := manager.operations.Acquire(context.Background(), operations.OperationSwitch, 1, operations.PolicyReject)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if got := request(handler, http.MethodPost, "/api/servers/a/switch", testToken).Code; got != http.StatusConflict {
+		t.Errorf("Expected 409 while another switch runs, got %d", got)
+	}
+	release()
+
+	blocked := newFakeManager()
+	blocked.servers[1].BlockedCountry = "DE"
+	blockedHandler := newTestServer(blocked, false)
+	if got := request(blockedHandler, http.MethodPost, "/api/servers/b/switch", testToken).Code; got != http.StatusPreconditionRequired || len(blocked.switched) != 0 {
+		t.Errorf("Expected a switch to a blocked country to need confirmation, got %d", got)
+	}
+	if got := request(blockedHandler, http.MethodPost, "/api/servers/b/switch?confirm_blocked=1", testToken).Code; got != http.StatusOK || len(blocked.switched) != 1 {
+		t.Errorf("Expected the confirmed switch to a blocked country, got %d", got)
+	}
+
+	readOnly := newFakeManager()
+	if got := request(newTestServer(readOnly, true), http.MethodPost, "/api/servers/b/switch", testToken).Code; got != http.StatusForbidden || len(readOnly.switched) != 0 {
+		t.Errorf("Expected a read-only dashboard to refuse switching, got %d", got)
+	}
+}